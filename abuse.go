@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var errQuarantined = errors.New("quarantined pending review")
+
+const (
+	// maxReports is the number of reports kept for a file; further reports are dropped.
+	maxReports = 50
+	// maxReportLength limits the reason and contact of a report.
+	maxReportLength = 1000
+)
+
+// abuseReport is a report, by an end user, that a stored file is abusive.
+type abuseReport struct {
+	Reason  string    `json:"reason"`
+	Contact string    `json:"contact,omitempty"`
+	At      time.Time `json:"at"`
+	By      string    `json:"by"`
+}
+
+// quarantine keeps a file from being downloaded until it is reviewed.
+type quarantine struct {
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+	By     string    `json:"by,omitempty"`
+}
+
+// reportedFile is an entry of the queue of reported and quarantined files.
+type reportedFile struct {
+	Path       string            `json:"path"`
+	Reports    []abuseReport     `json:"reports,omitempty"`
+	Quarantine *quarantine       `json:"quarantine,omitempty"`
+	Moderation *moderationResult `json:"moderation,omitempty"`
+}
+
+type reportsResponse struct {
+	response
+	Files []reportedFile `json:"files"`
+}
+
+// checkQuarantine returns an error if rel, a path relative to the document root, is quarantined or pending a scan.
+func (s Server) checkQuarantine(rel string) error {
+	if s.Meta == nil {
+		return nil
+	}
+	meta, err := s.Meta.get(rel)
+	if err != nil {
+		return err
+	}
+	if q := meta.Quarantine; q != nil {
+		err := fmt.Errorf("\"/files%s\" is %w", rel, errQuarantined)
+		if q.Reason != "" {
+			err = fmt.Errorf("%w: %s", err, q.Reason)
+		}
+		return withStatus(http.StatusForbidden, err)
+	}
+	if meta.Scan != nil && meta.Scan.Status == scanPending {
+		return withStatus(http.StatusForbidden, fmt.Errorf("\"/files%s\" is %w", rel, errPendingScan))
+	}
+	return nil
+}
+
+// storedFile returns the path relative to the document root of the stored file named by urlPath after prefix.
+func (s Server) storedFile(urlPath string, prefix string) (string, error) {
+	rel := path.Clean("/" + strings.TrimPrefix(urlPath, prefix))
+	if info, err := os.Stat(path.Join(s.DocumentRoot, rel)); err != nil || info.IsDir() {
+		return "", fmt.Errorf("\"/files%s\" is %w", rel, errNotFound)
+	}
+	return rel, nil
+}
+
+// handleReport serves POST /report/(filename), for end users to report a file as abusive with a reason,
+// and optionally a contact. It requires what downloading the file does, and so no token if downloads do not,
+// as reporters are rarely the uploaders. A client reporting the same file again replaces its report.
+func (s Server) handleReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	if s.Meta == nil {
+		respondError(w, withStatus(http.StatusNotImplemented, errNoMetadataStore))
+		return
+	}
+	// files which cannot be downloaded cannot be reported, nor found to exist.
+	rel := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/report/"))
+	if err := s.checkDownload(r, rel); err != nil {
+		respondError(w, err)
+		return
+	}
+	if isInternalName(strings.SplitN(rel[1:], "/", 2)[0]) {
+		respondError(w, fmt.Errorf("\"/files%s\" is %w", rel, errNotFound))
+		return
+	}
+	rel, err := s.storedFile(r.URL.Path, "/report/")
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	reason := strings.TrimSpace(r.FormValue("reason"))
+	contact := strings.TrimSpace(r.FormValue("contact"))
+	if reason == "" {
+		respondError(w, withStatus(http.StatusBadRequest, errors.New("a reason is required")))
+		return
+	}
+	if len(reason) > maxReportLength || len(contact) > maxReportLength {
+		respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("reason and contact are limited to %d bytes", maxReportLength)))
+		return
+	}
+	report := abuseReport{Reason: reason, Contact: contact, At: time.Now(), By: clientIP(r)}
+	quarantined := false
+	err = s.Meta.update(rel, func(meta *fileMeta) {
+		reports := meta.Reports[:0]
+		for _, other := range meta.Reports {
+			if other.By != report.By {
+				reports = append(reports, other)
+			}
+		}
+		if len(reports) < maxReports {
+			reports = append(reports, report)
+		}
+		meta.Reports = reports
+		if s.QuarantineReports > 0 && len(reports) >= s.QuarantineReports && meta.Quarantine == nil {
+			meta.Quarantine = &quarantine{Reason: fmt.Sprintf("reported by %d clients", len(reports)), Since: report.At}
+			quarantined = true
+		}
+	})
+	if err != nil {
+		logger.WithError(err).WithField("path", rel).Error("failed to update metadata")
+		respondError(w, err)
+		return
+	}
+	entry := auditLog().WithFields(logrus.Fields{
+		"path":   rel,
+		"remote": report.By,
+	})
+	entry.WithField("reason", reason).Warn("abuse reported")
+	if quarantined {
+		entry.Warn("file quarantined by reports")
+		s.Purger.changed("/files" + rel)
+	}
+	w.WriteHeader(http.StatusOK)
+	writeSuccess(w, "/files"+rel)
+}
+
+// reportedFiles returns the files with reports or in quarantine, the quarantined ones and the most reported first.
+func (s Server) reportedFiles() ([]reportedFile, error) {
+	files := []reportedFile{}
+	err := filepath.Walk(s.Meta.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(p, ".json") || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		var meta fileMeta
+		if json.Unmarshal(b, &meta) != nil || (len(meta.Reports) == 0 && meta.Quarantine == nil) {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Meta.dir, strings.TrimSuffix(p, ".json"))
+		if err != nil {
+			return err
+		}
+		files = append(files, reportedFile{Path: "/files/" + filepath.ToSlash(rel), Reports: meta.Reports, Quarantine: meta.Quarantine, Moderation: meta.Moderation})
+		return nil
+	})
+	sort.SliceStable(files, func(i, j int) bool {
+		if (files[i].Quarantine != nil) != (files[j].Quarantine != nil) {
+			return files[i].Quarantine != nil
+		}
+		if len(files[i].Reports) != len(files[j].Reports) {
+			return len(files[i].Reports) > len(files[j].Reports)
+		}
+		return files[i].Path < files[j].Path
+	})
+	return files, err
+}
+
+// handleReports serves the review queue: GET /admin/reports lists the reported and quarantined files,
+// and DELETE /admin/reports/(filename) dismisses the reports of a file once reviewed.
+func (s Server) handleReports(w http.ResponseWriter, r *http.Request) {
+	if s.Meta == nil {
+		respondError(w, withStatus(http.StatusNotImplemented, errNoMetadataStore))
+		return
+	}
+	if r.URL.Path == "/admin/reports" || r.URL.Path == "/admin/reports/" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+			return
+		}
+		files, err := s.reportedFiles()
+		if err != nil {
+			logger.WithError(err).Error("failed to list reported files")
+			respondError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		writeJSON(w, reportsResponse{response: response{OK: true}, Files: files})
+		return
+	}
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	rel := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/admin/reports/"))
+	if err := s.Meta.update(rel, func(meta *fileMeta) { meta.Reports = nil }); err != nil {
+		logger.WithError(err).WithField("path", rel).Error("failed to update metadata")
+		respondError(w, err)
+		return
+	}
+	auditLog().WithFields(logrus.Fields{"path": rel, "remote": r.RemoteAddr}).Info("abuse reports dismissed")
+	w.WriteHeader(http.StatusOK)
+	writeSuccess(w, "/files"+rel)
+}
+
+// handleQuarantine serves PUT /admin/quarantine/(filename) to quarantine a file, with an optional reason
+// shown to those trying to download it, and DELETE /admin/quarantine/(filename) to release it.
+func (s Server) handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "PUT,DELETE")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	if s.Meta == nil {
+		respondError(w, withStatus(http.StatusNotImplemented, errNoMetadataStore))
+		return
+	}
+	rel, err := s.storedFile(r.URL.Path, "/admin/quarantine/")
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	placed := r.Method == http.MethodPut
+	err = s.Meta.update(rel, func(meta *fileMeta) {
+		if placed {
+			meta.Quarantine = &quarantine{Reason: r.FormValue("reason"), Since: time.Now(), By: r.RemoteAddr}
+		} else {
+			meta.Quarantine = nil
+		}
+	})
+	if err != nil {
+		logger.WithError(err).WithField("path", rel).Error("failed to update metadata")
+		respondError(w, err)
+		return
+	}
+	entry := auditLog().WithFields(logrus.Fields{
+		"path":   rel,
+		"remote": r.RemoteAddr,
+	})
+	if placed {
+		entry.WithField("reason", r.FormValue("reason")).Warn("file quarantined")
+	} else {
+		entry.Info("file released from quarantine")
+	}
+	s.Purger.changed("/files" + rel)
+	w.WriteHeader(http.StatusOK)
+	writeSuccess(w, "/files"+rel)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReportRequiresDownloadCredentials(t *testing.T) {
+	root, err := ioutil.TempDir("", "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	s := NewServer(filepath.Join(root, "files"), 1024, "secret", false, []string{http.MethodGet, http.MethodPost, http.MethodPut})
+	if s.Meta, err = newMetaStore(filepath.Join(root, "meta")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(s.DocumentRoot, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(s.DocumentRoot, "invoice.html"), []byte("<html>"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	report := func(target string) int {
+		r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(url.Values{"reason": {"phishing"}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		s.handleReport(w, r)
+		return w.Code
+	}
+	for _, tc := range []struct {
+		target string
+		want   int
+	}{
+		// without the token, files which exist cannot be told from those which do not.
+		{"/report/invoice.html", http.StatusUnauthorized},
+		{"/report/missing.html", http.StatusUnauthorized},
+		{"/report/invoice.html?token=wrong", http.StatusUnauthorized},
+		{"/report/missing.html?token=secret", http.StatusNotFound},
+		{"/report/invoice.html?token=secret", http.StatusOK},
+	} {
+		if got := report(tc.target); got != tc.want {
+			t.Errorf("POST %s: status %d, want %d", tc.target, got, tc.want)
+		}
+	}
+
+	// downloads without the token allow reports without it.
+	s.ProtectedMethods = []string{http.MethodPost, http.MethodPut}
+	if got := report("/report/invoice.html"); got != http.StatusOK {
+		t.Errorf("POST /report/invoice.html with public downloads: status %d, want 200", got)
+	}
+	meta, err := s.Meta.get("/invoice.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Reports) != 1 {
+		t.Errorf("%d reports, want 1 by the same client", len(meta.Reports))
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newCertManager creates a manager which obtains and renews certificates for domains from Let's Encrypt.
+// Certificates are cached in cacheDir, so they survive restarts.
+func newCertManager(domains []string, cacheDir string, email string) *autocert.Manager {
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}
+}
+
+// redirectHTTPS returns a handler which redirects every request to the same URL on the HTTPS port, with 308 Permanent
+// Redirect so that clients repeat uploads there with the same method and body, which 301 lets them change to GET.
+func redirectHTTPS(tlsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if tlsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(tlsPort))
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedirectHTTPS(t *testing.T) {
+	for _, tc := range []struct {
+		method  string
+		target  string
+		tlsPort int
+		want    string
+	}{
+		{http.MethodGet, "http://example.com:8080/files/a.txt?download=1", 25443, "https://example.com:25443/files/a.txt?download=1"},
+		{http.MethodPost, "http://example.com/upload", 443, "https://example.com/upload"},
+		{http.MethodPut, "http://[::1]:8080/files/a%20b.txt", 8443, "https://[::1]:8443/files/a%20b.txt"},
+	} {
+		r := httptest.NewRequest(tc.method, tc.target, strings.NewReader("content"))
+		w := httptest.NewRecorder()
+		redirectHTTPS(tc.tlsPort).ServeHTTP(w, r)
+		// clients must not turn uploads into GETs.
+		if w.Code != http.StatusPermanentRedirect {
+			t.Errorf("%s %s: %d, want %d", tc.method, tc.target, w.Code, http.StatusPermanentRedirect)
+		}
+		if got := w.Header().Get("Location"); got != tc.want {
+			t.Errorf("%s %s: Location %q, want %q", tc.method, tc.target, got, tc.want)
+		}
+	}
+}
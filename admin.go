@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/subtle"
+	"expvar"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+)
+
+// newAdminMux creates a mux serving the endpoints for operators: profiles, runtime dumps and expvar.
+func newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	// pprof.Index also serves the named profiles, e.g. /debug/pprof/heap and /debug/pprof/goroutine?debug=2
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// isLoopback tells whether host, the address to bind a listener to, is only reachable from the same machine.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// requireAdmin wraps h so that it is served only when the request carries the admin token,
+// either as "token" query parameter or as bearer token. If the token is empty, h is served unconditionally.
+func requireAdmin(adminToken *secretValue, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := adminToken.get(); token != "" {
+			given := r.URL.Query().Get("token")
+			if auth := r.Header.Get("Authorization"); given == "" && strings.HasPrefix(auth, "Bearer ") {
+				given = strings.TrimPrefix(auth, "Bearer ")
+			}
+			if given == "" {
+				recordAuthFailure(r, errMissingToken)
+				respondError(w, errMissingToken)
+				return
+			}
+			if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+				recordAuthFailure(r, errTokenMismatch)
+				respondError(w, errTokenMismatch)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
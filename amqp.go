@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AMQP 0-9-1 frame types.
+const (
+	amqpFrameMethod    = 1
+	amqpFrameHeader    = 2
+	amqpFrameBody      = 3
+	amqpFrameHeartbeat = 8
+	amqpFrameEnd       = 0xce
+)
+
+// AMQP 0-9-1 classes and methods, as class<<16 | method.
+const (
+	amqpConnectionStart   = 10<<16 | 10
+	amqpConnectionStartOk = 10<<16 | 11
+	amqpConnectionTune    = 10<<16 | 30
+	amqpConnectionTuneOk  = 10<<16 | 31
+	amqpConnectionOpen    = 10<<16 | 40
+	amqpConnectionOpenOk  = 10<<16 | 41
+	amqpConnectionClose   = 10<<16 | 50
+	amqpConnectionCloseOk = 10<<16 | 51
+	amqpChannelOpen       = 20<<16 | 10
+	amqpChannelOpenOk     = 20<<16 | 11
+	amqpChannelClose      = 20<<16 | 40
+	amqpChannelCloseOk    = 20<<16 | 41
+	amqpBasicQos          = 60<<16 | 10
+	amqpBasicQosOk        = 60<<16 | 11
+	amqpBasicConsume      = 60<<16 | 20
+	amqpBasicConsumeOk    = 60<<16 | 21
+	amqpBasicDeliver      = 60<<16 | 60
+	amqpBasicAck          = 60<<16 | 80
+	amqpBasicReject       = 60<<16 | 90
+)
+
+// amqpWriter encodes the arguments of AMQP methods.
+type amqpWriter struct {
+	bytes.Buffer
+}
+
+func (w *amqpWriter) octet(v uint8)     { w.WriteByte(v) }
+func (w *amqpWriter) short(v uint16)    { binary.Write(w, binary.BigEndian, v) }
+func (w *amqpWriter) long(v uint32)     { binary.Write(w, binary.BigEndian, v) }
+func (w *amqpWriter) longlong(v uint64) { binary.Write(w, binary.BigEndian, v) }
+
+func (w *amqpWriter) shortstr(s string) {
+	w.octet(uint8(len(s)))
+	w.WriteString(s)
+}
+
+func (w *amqpWriter) longstr(s string) {
+	w.long(uint32(len(s)))
+	w.WriteString(s)
+}
+
+// table encodes a field table of strings.
+func (w *amqpWriter) table(fields map[string]string) {
+	var t amqpWriter
+	for k, v := range fields {
+		t.shortstr(k)
+		t.octet('S')
+		t.longstr(v)
+	}
+	w.long(uint32(t.Len()))
+	w.Write(t.Bytes())
+}
+
+// amqpReader decodes the arguments of AMQP methods; the first error sticks.
+type amqpReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (r *amqpReader) read(v interface{}) {
+	if r.err == nil {
+		r.err = binary.Read(r.r, binary.BigEndian, v)
+	}
+}
+
+func (r *amqpReader) octet() (v uint8)     { r.read(&v); return }
+func (r *amqpReader) short() (v uint16)    { r.read(&v); return }
+func (r *amqpReader) long() (v uint32)     { r.read(&v); return }
+func (r *amqpReader) longlong() (v uint64) { r.read(&v); return }
+
+func (r *amqpReader) bytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > r.r.Len() {
+		r.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := make([]byte, n)
+	r.r.Read(b)
+	return b
+}
+
+func (r *amqpReader) shortstr() string { return string(r.bytes(int(r.octet()))) }
+func (r *amqpReader) longstr() string  { return string(r.bytes(int(r.long()))) }
+
+// table decodes a field table, keeping the string values only.
+func (r *amqpReader) table() map[string]string {
+	fields := map[string]string{}
+	t := &amqpReader{r: bytes.NewReader(r.bytes(int(r.long())))}
+	for r.err == nil && t.err == nil && t.r.Len() > 0 {
+		name := t.shortstr()
+		if v, ok := t.value(); ok {
+			fields[name] = v
+		}
+	}
+	if r.err == nil {
+		r.err = t.err
+	}
+	return fields
+}
+
+// value decodes a field value, and returns it if it is a string.
+func (r *amqpReader) value() (string, bool) {
+	switch kind := r.octet(); kind {
+	case 'S':
+		return r.longstr(), true
+	case 'x':
+		r.longstr()
+	case 't', 'b', 'B':
+		r.bytes(1)
+	case 's', 'u':
+		r.bytes(2)
+	case 'I', 'i', 'f':
+		r.bytes(4)
+	case 'l', 'd', 'T':
+		r.bytes(8)
+	case 'D':
+		r.bytes(5)
+	case 'V':
+	case 'F':
+		r.table()
+	case 'A':
+		a := &amqpReader{r: bytes.NewReader(r.bytes(int(r.long())))}
+		for r.err == nil && a.err == nil && a.r.Len() > 0 {
+			a.value()
+		}
+		if r.err == nil {
+			r.err = a.err
+		}
+	default:
+		if r.err == nil {
+			r.err = fmt.Errorf("unknown AMQP field type %q", kind)
+		}
+	}
+	return "", false
+}
+
+// amqpMessage is a message delivered by the broker.
+type amqpMessage struct {
+	DeliveryTag uint64
+	ContentType string
+	MessageID   string
+	Headers     map[string]string
+	Body        []byte
+	// TooLarge is true if the body was over the limit, and has been discarded.
+	TooLarge bool
+}
+
+// amqpConn is a connection to an AMQP 0-9-1 broker, such as RabbitMQ, consuming from a queue on channel 1.
+type amqpConn struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	heartbeat time.Duration
+
+	// mu serializes the writes of frames, which heartbeats are sent concurrently with.
+	mu     sync.Mutex
+	closed chan struct{}
+}
+
+// dialAMQP connects to the broker at u, an amqp:// or amqps:// URL whose path is the virtual host, and opens channel 1.
+func dialAMQP(u *url.URL) (*amqpConn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		port := "5672"
+		if u.Scheme == "amqps" {
+			port = "5671"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second}
+	var conn net.Conn
+	var err error
+	if u.Scheme == "amqps" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c := &amqpConn{conn: conn, r: bufio.NewReader(conn), closed: make(chan struct{})}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	if err := c.open(u); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	if c.heartbeat > 0 {
+		go c.sendHeartbeats()
+	}
+	return c, nil
+}
+
+// open negotiates the connection and opens channel 1.
+func (c *amqpConn) open(u *url.URL) error {
+	if _, err := c.conn.Write([]byte("AMQP\x00\x00\x09\x01")); err != nil {
+		return err
+	}
+	if _, err := c.expect(0, amqpConnectionStart); err != nil {
+		return err
+	}
+	user, password := "guest", "guest"
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	var args amqpWriter
+	args.table(map[string]string{"product": "simple-upload-server"})
+	args.shortstr("PLAIN")
+	args.longstr("\x00" + user + "\x00" + password)
+	args.shortstr("en_US")
+	if err := c.send(0, amqpConnectionStartOk, args.Bytes()); err != nil {
+		return err
+	}
+	tune, err := c.expect(0, amqpConnectionTune)
+	if err != nil {
+		return err
+	}
+	channelMax, frameMax, heartbeat := tune.short(), tune.long(), tune.short()
+	c.heartbeat = time.Duration(heartbeat) * time.Second
+	args.Reset()
+	args.short(channelMax)
+	args.long(frameMax)
+	args.short(heartbeat)
+	if err := c.send(0, amqpConnectionTuneOk, args.Bytes()); err != nil {
+		return err
+	}
+	vhost := strings.TrimPrefix(u.Path, "/")
+	if vhost == "" {
+		vhost = "/"
+	}
+	args.Reset()
+	args.shortstr(vhost)
+	args.shortstr("")
+	args.octet(0)
+	if err := c.send(0, amqpConnectionOpen, args.Bytes()); err != nil {
+		return err
+	}
+	if _, err := c.expect(0, amqpConnectionOpenOk); err != nil {
+		return err
+	}
+	args.Reset()
+	args.shortstr("")
+	if err := c.send(1, amqpChannelOpen, args.Bytes()); err != nil {
+		return err
+	}
+	_, err = c.expect(1, amqpChannelOpenOk)
+	return err
+}
+
+func (c *amqpConn) sendHeartbeats() {
+	ticker := time.NewTicker(c.heartbeat / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.writeFrame(amqpFrameHeartbeat, 0, nil); err != nil {
+				return
+			}
+		case <-c.closed:
+			return
+		}
+	}
+}
+
+func (c *amqpConn) Close() error {
+	close(c.closed)
+	return c.conn.Close()
+}
+
+func (c *amqpConn) writeFrame(kind uint8, channel uint16, payload []byte) error {
+	var frame amqpWriter
+	frame.octet(kind)
+	frame.short(channel)
+	frame.long(uint32(len(payload)))
+	frame.Write(payload)
+	frame.octet(amqpFrameEnd)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.conn.Write(frame.Bytes())
+	return err
+}
+
+// send sends a method with its encoded arguments.
+func (c *amqpConn) send(channel uint16, method uint32, args []byte) error {
+	var payload amqpWriter
+	payload.long(method)
+	payload.Write(args)
+	return c.writeFrame(amqpFrameMethod, channel, payload.Bytes())
+}
+
+// readFrame reads the next frame other than a heartbeat.
+// The broker is considered gone if nothing, not even a heartbeat, arrives for three heartbeat intervals.
+func (c *amqpConn) readFrame() (uint8, uint16, []byte, error) {
+	for {
+		if c.heartbeat > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(3 * c.heartbeat))
+		}
+		var header struct {
+			Kind    uint8
+			Channel uint16
+			Size    uint32
+		}
+		if err := binary.Read(c.r, binary.BigEndian, &header); err != nil {
+			return 0, 0, nil, err
+		}
+		payload := make([]byte, int(header.Size)+1)
+		if _, err := io.ReadFull(c.r, payload); err != nil {
+			return 0, 0, nil, err
+		}
+		if payload[header.Size] != amqpFrameEnd {
+			return 0, 0, nil, errors.New("malformed AMQP frame")
+		}
+		if header.Kind != amqpFrameHeartbeat {
+			return header.Kind, header.Channel, payload[:header.Size], nil
+		}
+	}
+}
+
+// readMethod reads the next method, and returns its arguments. A connection or channel closed by the broker is reported as an error.
+func (c *amqpConn) readMethod() (uint32, *amqpReader, error) {
+	kind, channel, payload, err := c.readFrame()
+	if err != nil {
+		return 0, nil, err
+	}
+	if kind != amqpFrameMethod {
+		return 0, nil, fmt.Errorf("unexpected AMQP frame of type %d", kind)
+	}
+	args := &amqpReader{r: bytes.NewReader(payload)}
+	method := args.long()
+	switch method {
+	case amqpConnectionClose, amqpChannelClose:
+		code, text := args.short(), args.shortstr()
+		if method == amqpConnectionClose {
+			c.send(0, amqpConnectionCloseOk, nil)
+		} else {
+			c.send(channel, amqpChannelCloseOk, nil)
+		}
+		return 0, nil, fmt.Errorf("closed by the AMQP broker: %d %s", code, text)
+	}
+	return method, args, args.err
+}
+
+// expect reads the next method, which must be method on channel.
+func (c *amqpConn) expect(channel uint16, method uint32) (*amqpReader, error) {
+	got, args, err := c.readMethod()
+	if err != nil {
+		return nil, err
+	}
+	if got != method {
+		return nil, fmt.Errorf("unexpected AMQP method %d.%d", got>>16, got&0xffff)
+	}
+	return args, nil
+}
+
+// consume starts consuming from queue, one unacknowledged message at a time.
+func (c *amqpConn) consume(queue string) error {
+	var args amqpWriter
+	args.long(0)  // prefetch-size
+	args.short(1) // prefetch-count
+	args.octet(0) // global
+	if err := c.send(1, amqpBasicQos, args.Bytes()); err != nil {
+		return err
+	}
+	if _, err := c.expect(1, amqpBasicQosOk); err != nil {
+		return err
+	}
+	args.Reset()
+	args.short(0)
+	args.shortstr(queue)
+	args.shortstr("") // consumer-tag, chosen by the broker
+	args.octet(0)     // no-local, no-ack, exclusive, no-wait
+	args.table(nil)
+	if err := c.send(1, amqpBasicConsume, args.Bytes()); err != nil {
+		return err
+	}
+	_, err := c.expect(1, amqpBasicConsumeOk)
+	return err
+}
+
+// next waits for the next message. Bodies over limit bytes are discarded as they arrive.
+func (c *amqpConn) next(limit int64) (amqpMessage, error) {
+	deliver, err := c.expect(1, amqpBasicDeliver)
+	if err != nil {
+		return amqpMessage{}, err
+	}
+	deliver.shortstr() // consumer-tag
+	msg := amqpMessage{DeliveryTag: deliver.longlong()}
+
+	kind, _, payload, err := c.readFrame()
+	if err != nil {
+		return msg, err
+	}
+	if kind != amqpFrameHeader {
+		return msg, fmt.Errorf("unexpected AMQP frame of type %d", kind)
+	}
+	header := &amqpReader{r: bytes.NewReader(payload)}
+	header.short() // class-id
+	header.short() // weight
+	size := header.longlong()
+	flags := header.short()
+	// the properties are in the order of their flags, from the highest bit; those after message-id are not needed.
+	if flags&(1<<15) != 0 {
+		msg.ContentType = header.shortstr()
+	}
+	if flags&(1<<14) != 0 {
+		header.shortstr() // content-encoding
+	}
+	if flags&(1<<13) != 0 {
+		msg.Headers = header.table()
+	}
+	if flags&(1<<12) != 0 {
+		header.octet() // delivery-mode
+	}
+	if flags&(1<<11) != 0 {
+		header.octet() // priority
+	}
+	for bit := uint(10); bit >= 8; bit-- {
+		if flags&(1<<bit) != 0 {
+			header.shortstr() // correlation-id, reply-to, expiration
+		}
+	}
+	if flags&(1<<7) != 0 {
+		msg.MessageID = header.shortstr()
+	}
+	if header.err != nil {
+		return msg, header.err
+	}
+
+	msg.TooLarge = int64(size) > limit
+	for read := uint64(0); read < size; {
+		kind, _, payload, err := c.readFrame()
+		if err != nil {
+			return msg, err
+		}
+		if kind != amqpFrameBody {
+			return msg, fmt.Errorf("unexpected AMQP frame of type %d", kind)
+		}
+		read += uint64(len(payload))
+		if !msg.TooLarge {
+			msg.Body = append(msg.Body, payload...)
+		}
+	}
+	return msg, nil
+}
+
+// ack acknowledges a message, which the broker then removes from the queue.
+func (c *amqpConn) ack(tag uint64) error {
+	var args amqpWriter
+	args.longlong(tag)
+	args.octet(0) // multiple
+	return c.send(1, amqpBasicAck, args.Bytes())
+}
+
+// reject rejects a message, which the broker puts back in the queue if requeue is true,
+// and otherwise drops or dead-letters as configured for the queue.
+func (c *amqpConn) reject(tag uint64, requeue bool) error {
+	var args amqpWriter
+	args.longlong(tag)
+	if requeue {
+		args.octet(1)
+	} else {
+		args.octet(0)
+	}
+	return c.send(1, amqpBasicReject, args.Bytes())
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// amqpRetryInterval is the time to wait before reconnecting to the broker, and before taking messages again
+// while the storage is read-only.
+const amqpRetryInterval = 5 * time.Second
+
+// amqpIngest stores the files sent as messages to an AMQP queue.
+type amqpIngest struct {
+	// URL is the broker, as amqp[s]://user:password@host[:port]/vhost.
+	URL   *url.URL
+	Queue string
+	// client downloads the files given by URL.
+	client *http.Client
+}
+
+// amqpUpload is the body of a JSON message, which gives a file either by its content or by a URL to download it from.
+type amqpUpload struct {
+	Name       string `json:"name"`
+	ContentB64 string `json:"content_b64"`
+	URL        string `json:"url"`
+}
+
+// consumeAMQP stores the messages of the queue as they arrive, reconnecting whenever the connection is lost. It never returns.
+func (s Server) consumeAMQP(in *amqpIngest) {
+	entry := logger.WithFields(logrus.Fields{
+		"broker": in.URL.Host,
+		"queue":  in.Queue,
+	})
+	for {
+		err := s.consumeAMQPOnce(in, entry)
+		entry.WithError(err).Warn("AMQP consumer disconnected, reconnecting")
+		time.Sleep(amqpRetryInterval)
+	}
+}
+
+func (s Server) consumeAMQPOnce(in *amqpIngest, entry *logrus.Entry) error {
+	conn, err := dialAMQP(in.URL)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.consume(in.Queue); err != nil {
+		return err
+	}
+	entry.Info("consuming uploads from AMQP")
+	// base64 content takes a third more than the file.
+	limit := base64Size(s.MaxUploadSize) + s.MultipartMemory
+	for {
+		msg, err := conn.next(limit)
+		if err != nil {
+			return err
+		}
+		msgEntry := entry.WithField("message_id", msg.MessageID)
+		if err := s.checkWritable(); err != nil {
+			// the message is kept for later; the broker redelivers it once the storage is writable again.
+			msgEntry.WithError(err).Warn("cannot store AMQP uploads")
+			if err := conn.reject(msg.DeliveryTag, true); err != nil {
+				return err
+			}
+			time.Sleep(amqpRetryInterval)
+			continue
+		}
+		if msg.TooLarge {
+			err = errFileTooLarge
+		} else {
+			err = s.ingestMessage(in, msg)
+		}
+		if err != nil {
+			logFailure(msgEntry, err, "failed to store the AMQP upload")
+			if err := conn.reject(msg.DeliveryTag, false); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := conn.ack(msg.DeliveryTag); err != nil {
+			return err
+		}
+	}
+}
+
+// ingestMessage stores the file of msg as if it were uploaded by POST: a JSON message gives its name, and either
+// its content or a URL to download it from; any other message is the content itself, named by its "name" header.
+func (s Server) ingestMessage(in *amqpIngest, msg amqpMessage) error {
+	ctx := context.Background()
+	var src io.Reader = bytes.NewReader(msg.Body)
+	name := msg.Headers["name"]
+	source := "amqp://" + in.URL.Host + "/" + in.Queue
+	if mediaType, _, _ := mime.ParseMediaType(msg.ContentType); mediaType == "application/json" {
+		var upload amqpUpload
+		if err := json.Unmarshal(msg.Body, &upload); err != nil {
+			return fmt.Errorf("invalid message: %v", err)
+		}
+		name = upload.Name
+		switch {
+		case upload.URL != "" && upload.ContentB64 != "":
+			return fmt.Errorf("invalid message: both url and content_b64 given")
+		case upload.URL != "":
+			u, err := url.Parse(upload.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("invalid message: url must be an http(s) URL")
+			}
+			body, err := in.download(ctx, u)
+			if err != nil {
+				return err
+			}
+			defer body.Close()
+			src = body
+			source = withoutUserinfo(u)
+			if name == "" {
+				name = path.Base(u.Path)
+			}
+		default:
+			src = base64.NewDecoder(base64.StdEncoding, strings.NewReader(upload.ContentB64))
+		}
+	}
+
+	rcv := received{}
+	if name != "" {
+		// the same as the file name of a multipart form, which never has directories.
+		rcv.Filename = path.Base(toSlash(name))
+	}
+	rcv, err := s.spool(ctx, src, rcv)
+	if err != nil {
+		return err
+	}
+	// the temporary file is moved into place on success, so this only cleans up on failure.
+	defer os.Remove(rcv.TempName)
+	rel, stored, err := s.storeReceived(ctx, &rcv)
+	if err != nil {
+		return err
+	}
+	auditLog().WithFields(logrus.Fields{
+		"path":       "/files" + rel,
+		"size":       rcv.Size,
+		"digest":     s.Digests.label(rcv.Digest),
+		"source":     source,
+		"message_id": msg.MessageID,
+	}).Info("file uploaded by AMQP")
+	s.pinIPFS(ctx, rel)
+	if stored {
+		s.announce(uploadEvent{
+			Path:     "/files" + rel,
+			URL:      (&url.URL{Path: "/files" + rel}).String(),
+			Size:     rcv.Size,
+			Digest:   s.Digests.label(rcv.Digest),
+			Uploader: "amqp",
+		})
+	}
+	return nil
+}
+
+// download requests the file at u, and returns its content.
+func (in *amqpIngest) download(ctx context.Context, u *url.URL) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := in.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to download %s: %s", withoutUserinfo(u), resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// withoutUserinfo returns u without the user name and password, to be logged.
+func withoutUserinfo(u *url.URL) string {
+	safe := *u
+	safe.User = nil
+	return safe.String()
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	errImmutable        = errors.New("published and immutable")
+	errChecksumMismatch = errors.New("does not match the artifact")
+)
+
+// maxChecksumFileSize bounds the checksum files uploaded next to artifacts.
+const maxChecksumFileSize = 1 << 10
+
+// checksumHashes are the hashes of the checksum files kept next to the artifacts, by extension, as Maven expects them.
+var checksumHashes = map[string]func() hash.Hash{
+	".md5":    md5.New,
+	".sha1":   sha1.New,
+	".sha256": sha256.New,
+}
+
+// checksumOf returns the artifact whose checksum rel, a path relative to the document root, is the file of.
+func checksumOf(rel string) (artifact string, ext string, ok bool) {
+	ext = path.Ext(rel)
+	if _, ok := checksumHashes[ext]; !ok || len(rel) == len(ext) {
+		return "", "", false
+	}
+	return strings.TrimSuffix(rel, ext), ext, true
+}
+
+// isMutableArtifact reports whether rel may be replaced in artifact mode: Maven rewrites the maven-metadata.xml
+// listing the versions of an artifact, and its checksums, on every deployment.
+func isMutableArtifact(rel string) bool {
+	if artifact, _, ok := checksumOf(rel); ok {
+		rel = artifact
+	}
+	return strings.HasPrefix(path.Base(rel), "maven-metadata")
+}
+
+// isArtifact reports whether rel is under a prefix in artifact mode.
+func (s Server) isArtifact(rel string) bool {
+	p, ok := s.Policies.lookup(rel)
+	return ok && p.Artifacts
+}
+
+// checkImmutable returns an error if rel is an existing artifact, which cannot be replaced or removed.
+// Checksum files of existing artifacts can be uploaded again, as deployment tools do, but only with
+// the right checksum, which checkArtifactChecksum verifies once it is received.
+func (s Server) checkImmutable(rel string) error {
+	if !s.isArtifact(rel) || isMutableArtifact(rel) || !fileExists(path.Join(s.DocumentRoot, rel)) {
+		return nil
+	}
+	if artifact, _, ok := checksumOf(rel); ok && fileExists(path.Join(s.DocumentRoot, artifact)) {
+		return nil
+	}
+	auditLog().WithField("path", rel).Warn("change rejected by artifact mode")
+	return withStatus(http.StatusConflict, fmt.Errorf("\"/files%s\" is %w", rel, errImmutable))
+}
+
+// checkArtifactChecksum returns an error if file, received to be stored as rel, is the checksum file of an existing
+// artifact, and does not hold its checksum.
+func (s Server) checkArtifactChecksum(rel string, file string) error {
+	if !s.isArtifact(rel) {
+		return nil
+	}
+	artifact, ext, ok := checksumOf(rel)
+	if !ok || !fileExists(path.Join(s.DocumentRoot, artifact)) {
+		return nil
+	}
+	mismatch := withStatus(http.StatusConflict, fmt.Errorf("\"/files%s\" %w \"/files%s\"", rel, errChecksumMismatch, artifact))
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if info.Size() > maxChecksumFileSize {
+		return mismatch
+	}
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	want, err := hashFile(path.Join(s.DocumentRoot, artifact), checksumHashes[ext]())
+	if err != nil {
+		return err
+	}
+	// tools write the checksum alone, or followed by the file name like sha1sum.
+	if fields := strings.Fields(string(b)); len(fields) == 0 || !strings.EqualFold(fields[0], want) {
+		auditLog().WithField("path", rel).Warn("checksum not matching the artifact rejected")
+		return mismatch
+	}
+	return nil
+}
+
+// checkReceived returns an error if rcv, received to be stored as rel, must not be stored for its name or content.
+// SVG images are sanitized as the policy of rel requires, which updates rcv.
+func (s Server) checkReceived(rel string, rcv *received) error {
+	if err := s.checkExtension(rel); err != nil {
+		return err
+	}
+	if err := s.checkSignature(rel, rcv.TempName, rcv.Signature); err != nil {
+		return err
+	}
+	if err := s.checkArtifactChecksum(rel, rcv.TempName); err != nil {
+		return err
+	}
+	return s.checkSVG(rel, rcv)
+}
+
+// writeChecksums writes the checksum files of the artifact rel, a path relative to the document root, next to it.
+func (s Server) writeChecksums(rel string) {
+	name := path.Join(s.DocumentRoot, rel)
+	for ext, newHash := range checksumHashes {
+		sum, err := hashFile(name, newHash())
+		if os.IsNotExist(err) {
+			return
+		}
+		if err == nil {
+			err = writeFileAtomically(name+ext, []byte(sum))
+		}
+		if err != nil {
+			logger.WithError(err).WithFields(logrus.Fields{"path": rel, "checksum": ext}).Warn("failed to write the checksum file")
+		}
+	}
+}
+
+// artifactChanged writes the checksum files of the artifact changed by e, if under a prefix in artifact mode.
+func (s Server) artifactChanged(e fileEvent) {
+	if e.Type != eventUpload && e.Type != eventRestore {
+		return
+	}
+	rel := path.Clean("/" + strings.TrimPrefix(e.Path, "/files"))
+	if _, _, ok := checksumOf(rel); ok || !s.isArtifact(rel) {
+		return
+	}
+	go s.writeChecksums(rel)
+}
+
+// serveChecksum serves the checksum file of an artifact which has none yet, like one stored before its prefix
+// was in artifact mode. It returns false if rel is not such a file.
+func (s Server) serveChecksum(w http.ResponseWriter, r *http.Request, rel string) bool {
+	artifact, ext, ok := checksumOf(rel)
+	if !ok || !s.isArtifact(rel) || fileExists(path.Join(s.DocumentRoot, rel)) {
+		return false
+	}
+	name := path.Join(s.DocumentRoot, artifact)
+	info, err := os.Stat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	if err := s.checkQuarantine(artifact); err != nil {
+		respondError(w, err)
+		return true
+	}
+	sum, err := hashFile(name, checksumHashes[ext]())
+	if err != nil {
+		logger.WithError(err).WithField("path", artifact).Error("failed to hash the artifact")
+		respondError(w, err)
+		return true
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	http.ServeContent(w, r, path.Base(rel), info.ModTime(), strings.NewReader(sum))
+	return true
+}
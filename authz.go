@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Kinds of external authorization services.
+const (
+	// authzOPA is an Open Policy Agent, asked at a data API URL like http://localhost:8181/v1/data/upload/allow.
+	authzOPA = "opa"
+	// authzWebhook is any HTTP endpoint taking the input as it is, and responding {"allow":...,"reason":"..."}.
+	authzWebhook = "webhook"
+)
+
+const (
+	// authzTimeout bounds a decision of the authorization service.
+	authzTimeout = 5 * time.Second
+	// maxAuthzDecisions is the number of decisions cached, beyond which the expired ones are dropped.
+	maxAuthzDecisions = 10000
+)
+
+// authzInput describes a request to the authorization service.
+type authzInput struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	// Subject is the user making the request with -rbac, or empty.
+	Subject string   `json:"subject"`
+	Groups  []string `json:"groups"`
+	// Authenticated tells whether the request carries valid credentials, and Admin whether they are the server token.
+	Authenticated bool `json:"authenticated"`
+	Admin         bool `json:"admin"`
+	// Size is the Content-Length of the request, or -1 if unknown.
+	Size   int64  `json:"size"`
+	Remote string `json:"remote"`
+}
+
+// authzDecision is a decision of the authorization service, as responded by webhooks, or as the result of
+// an OPA rule if it is an object.
+type authzDecision struct {
+	Allow  bool   `json:"allow"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type cachedDecision struct {
+	authzDecision
+	expires time.Time
+}
+
+// authorizer enforces the decisions of an external authorization service on every request, so that policies
+// can be written once for many services. Decisions are cached for a while by their input.
+type authorizer struct {
+	Kind     string
+	URL      string
+	token    string
+	TTL      time.Duration
+	FailOpen bool
+	client   *http.Client
+
+	mu        sync.Mutex
+	decisions map[string]cachedDecision
+}
+
+// newAuthorizer makes an authorizer asking the service of kind, opa or webhook, at url, with the bearer token
+// if not empty. Decisions are cached for ttl, not at all if 0. If failOpen, requests are allowed when
+// the service cannot be asked, instead of refused.
+func newAuthorizer(kind string, url string, token string, ttl time.Duration, failOpen bool) (*authorizer, error) {
+	if kind != authzOPA && kind != authzWebhook {
+		return nil, fmt.Errorf("unknown authorization service %q (%s or %s)", kind, authzOPA, authzWebhook)
+	}
+	if url == "" {
+		return nil, errors.New("-authz_url is required to authorize requests")
+	}
+	return &authorizer{
+		Kind:      kind,
+		URL:       url,
+		token:     token,
+		TTL:       ttl,
+		FailOpen:  failOpen,
+		client:    &http.Client{Timeout: authzTimeout},
+		decisions: map[string]cachedDecision{},
+	}, nil
+}
+
+// authzInputOf describes r. Only the credentials outside of its body are looked at, since reading a form would
+// consume the body: those given in a form field are not seen by the authorization service.
+func (s Server) authzInputOf(r *http.Request) authzInput {
+	in := authzInput{Method: r.Method, Path: r.URL.Path, Groups: []string{}, Size: r.ContentLength, Remote: clientIP(r)}
+	// Basic credentials are a directory user and password with LDAP, and else a token, as for the registry.
+	if s.RBAC == nil || s.RBAC.LDAP == nil {
+		r = withBasicToken(r)
+	}
+	if !s.hasCredentials(r) {
+		return in
+	}
+	if s.RBAC != nil {
+		id, err := s.RBAC.identify(r, s.SecureToken.get())
+		if err != nil {
+			return in
+		}
+		in.Subject, in.Authenticated, in.Admin = id.name, true, id.server
+		if id.groups != nil {
+			in.Groups = id.groups
+		}
+		return in
+	}
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); token == "" && strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.SecureToken.get())) == 1 {
+		in.Authenticated, in.Admin = true, true
+	}
+	return in
+}
+
+// decide returns the decision of the service on in, from the cache if it was made recently.
+func (a *authorizer) decide(ctx context.Context, in authzInput) (authzDecision, error) {
+	key, err := json.Marshal(in)
+	if err != nil {
+		return authzDecision{}, err
+	}
+	now := time.Now()
+	a.mu.Lock()
+	cached, ok := a.decisions[string(key)]
+	a.mu.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.authzDecision, nil
+	}
+	d, err := a.ask(ctx, in)
+	if err != nil || a.TTL <= 0 {
+		return d, err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.decisions) >= maxAuthzDecisions {
+		for k, c := range a.decisions {
+			if !now.Before(c.expires) {
+				delete(a.decisions, k)
+			}
+		}
+		if len(a.decisions) >= maxAuthzDecisions {
+			a.decisions = map[string]cachedDecision{}
+		}
+	}
+	a.decisions[string(key)] = cachedDecision{authzDecision: d, expires: now.Add(a.TTL)}
+	return d, nil
+}
+
+// ask sends in to the service and returns its decision. OPA takes it as {"input":...}, and returns
+// {"result":...} where the result is either true or false, or a decision; an undefined result denies.
+func (a *authorizer) ask(ctx context.Context, in authzInput) (authzDecision, error) {
+	var body interface{} = in
+	if a.Kind == authzOPA {
+		body = struct {
+			Input authzInput `json:"input"`
+		}{in}
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return authzDecision{}, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.URL, bytes.NewReader(b))
+	if err != nil {
+		return authzDecision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+	injectTraceparent(ctx, req)
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return authzDecision{}, err
+	}
+	defer resp.Body.Close()
+	b, err = ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return authzDecision{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return authzDecision{}, fmt.Errorf("authorization service responded %s", resp.Status)
+	}
+	if a.Kind == authzWebhook {
+		var d authzDecision
+		if err := json.Unmarshal(b, &d); err != nil {
+			return authzDecision{}, fmt.Errorf("invalid decision: %v", err)
+		}
+		return d, nil
+	}
+	var result struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal(b, &result); err != nil {
+		return authzDecision{}, fmt.Errorf("invalid decision: %v", err)
+	}
+	if len(result.Result) == 0 {
+		return authzDecision{Reason: "no decision"}, nil
+	}
+	var d authzDecision
+	if err := json.Unmarshal(result.Result, &d.Allow); err == nil {
+		return d, nil
+	}
+	if err := json.Unmarshal(result.Result, &d); err != nil {
+		return authzDecision{}, fmt.Errorf("invalid decision: %v", err)
+	}
+	return d, nil
+}
+
+// authorizeExternally wraps h so that every request is first allowed by the authorization service. Credentials
+// are still checked by h, so the service can only refine who may do what.
+func (s Server) authorizeExternally(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		in := s.authzInputOf(r)
+		d, err := s.Authz.decide(r.Context(), in)
+		entry := logger.WithFields(logrus.Fields{"method": in.Method, "path": in.Path, "subject": in.Subject, "remote": in.Remote})
+		switch {
+		case err != nil && s.Authz.FailOpen:
+			entry.WithError(err).Warn("failed to authorize the request, allowing it")
+		case err != nil:
+			entry.WithError(err).Error("failed to authorize the request")
+			respondError(w, withStatus(http.StatusServiceUnavailable, errors.New("failed to authorize the request")))
+			return
+		case !d.Allow:
+			entry.WithField("reason", d.Reason).Info("request denied by the authorization service")
+			err := fmt.Errorf("%s %s is %w", r.Method, r.URL.Path, errForbidden)
+			if d.Reason != "" {
+				err = fmt.Errorf("%w: %s", err, d.Reason)
+			}
+			respondError(w, withStatus(http.StatusForbidden, err))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
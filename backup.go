@@ -0,0 +1,514 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var errBackupRunning = errors.New("a backup is already running")
+
+// backupTarget stores backups remotely. Names are slash-separated paths relative to the root of the target.
+//
+// A backup is laid out as content-addressed objects, objects/(algorithm)/(digest[:2])/(digest), and a manifest per snapshot,
+// snapshots/(id).json, listing the paths and digests of the files. Files unchanged since a previous backup are
+// already there as objects, which makes backups incremental.
+type backupTarget interface {
+	// list returns the names starting with prefix.
+	list(ctx context.Context, prefix string) ([]string, error)
+	// put stores body as name. sha256 is the hex SHA-256 digest of body, if known.
+	put(ctx context.Context, name string, body io.Reader, size int64, sha256 string) error
+	get(ctx context.Context, name string) (io.ReadCloser, error)
+	remove(ctx context.Context, names []string) error
+	// String describes the target without credentials.
+	String() string
+}
+
+// s3Target keeps backups in an S3 bucket, under a prefix.
+type s3Target struct {
+	client *s3Client
+	prefix string
+}
+
+func (t s3Target) list(ctx context.Context, prefix string) ([]string, error) {
+	keys, err := t.client.list(ctx, t.prefix+prefix)
+	for i := range keys {
+		keys[i] = strings.TrimPrefix(keys[i], t.prefix)
+	}
+	return keys, err
+}
+
+func (t s3Target) put(ctx context.Context, name string, body io.Reader, size int64, sum string) error {
+	return t.client.put(ctx, t.prefix+name, body, size, sum)
+}
+
+func (t s3Target) get(ctx context.Context, name string) (io.ReadCloser, error) {
+	return t.client.get(ctx, t.prefix+name)
+}
+
+func (t s3Target) remove(ctx context.Context, names []string) error {
+	for _, name := range names {
+		if err := t.client.remove(ctx, t.prefix+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t s3Target) String() string {
+	return "s3://" + t.client.bucket + "/" + t.prefix
+}
+
+// uploadServerTarget keeps backups in a directory of another upload server,
+// which is written by PUT and pruned and listed by its sync endpoints.
+type uploadServerTarget struct {
+	base   *url.URL
+	dir    string
+	token  string
+	client *http.Client
+}
+
+func (t uploadServerTarget) url(endpoint string, name string) string {
+	u := *t.base
+	u.Path = endpoint + path.Join(t.dir, name)
+	if t.token != "" {
+		u.RawQuery = url.Values{"token": {t.token}}.Encode()
+	}
+	return u.String()
+}
+
+func (t uploadServerTarget) do(ctx context.Context, method string, u string, body io.Reader, size int64, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	injectTraceparent(ctx, req)
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		var e errorResponse
+		if json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&e) == nil && e.Message != "" {
+			return resp, fmt.Errorf("%s %s: %s: %s", method, req.URL.Path, resp.Status, e.Message)
+		}
+		return resp, fmt.Errorf("%s %s: %s", method, req.URL.Path, resp.Status)
+	}
+	return resp, nil
+}
+
+func (t uploadServerTarget) list(ctx context.Context, prefix string) ([]string, error) {
+	resp, err := t.do(ctx, http.MethodGet, t.url("/sync/manifest", prefix), nil, 0, "")
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var manifest manifestResponse
+	if err := json.NewDecoder(resp.Body).Decode(&manifest); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(manifest.Files))
+	for _, f := range manifest.Files {
+		names = append(names, path.Join(prefix, f.Path))
+	}
+	return names, nil
+}
+
+func (t uploadServerTarget) put(ctx context.Context, name string, body io.Reader, size int64, sum string) error {
+	resp, err := t.do(ctx, http.MethodPut, t.url("/files", name), body, size, "application/octet-stream")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (t uploadServerTarget) get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := t.do(ctx, http.MethodGet, t.url("/files", name), nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (t uploadServerTarget) remove(ctx context.Context, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(syncRequest{Delete: names})
+	if err != nil {
+		return err
+	}
+	resp, err := t.do(ctx, http.MethodPost, t.url("/sync/apply", ""), bytes.NewReader(body), int64(len(body)), "application/json")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (t uploadServerTarget) String() string {
+	u := *t.base
+	u.Path = "/files" + t.dir
+	return u.String()
+}
+
+// parseBackupTarget parses the URL of a backup target:
+// s3://bucket/prefix (with optional region and endpoint query parameters), or
+// http(s)://host/files/dir of another upload server (with its token as query parameter).
+func parseBackupTarget(raw string) (backupTarget, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backup target: %v", err)
+	}
+	switch u.Scheme {
+	case "s3":
+		bucket, prefix := parseS3URL(u)
+		if bucket == "" {
+			return nil, fmt.Errorf("backup target %q has no bucket", raw)
+		}
+		client, err := newS3Client(bucket, u.Query().Get("region"), u.Query().Get("endpoint"))
+		if err != nil {
+			return nil, err
+		}
+		return s3Target{client: client, prefix: prefix}, nil
+	case "http", "https":
+		dir := path.Clean("/" + strings.TrimPrefix(path.Clean("/"+u.Path), "/files"))
+		if dir == "/" {
+			dir = ""
+		}
+		return uploadServerTarget{
+			base:   &url.URL{Scheme: u.Scheme, Host: u.Host, User: u.User},
+			dir:    dir,
+			token:  u.Query().Get("token"),
+			client: &http.Client{},
+		}, nil
+	}
+	return nil, fmt.Errorf("backup target %q must be an s3:// or http(s):// URL", raw)
+}
+
+// backupManifest lists the files of a snapshot: the document root under files/, and the metadata under meta/.
+type backupManifest struct {
+	ID      string          `json:"id"`
+	Created time.Time       `json:"created"`
+	Files   []manifestEntry `json:"files"`
+}
+
+// backupRun is the outcome of a backup.
+type backupRun struct {
+	ID       string    `json:"id"`
+	Started  time.Time `json:"started"`
+	Duration float64   `json:"duration"`
+	Files    int       `json:"files"`
+	// Uploaded counts the files which were not in the target yet.
+	Uploaded      int      `json:"uploaded"`
+	UploadedBytes int64    `json:"uploaded_bytes"`
+	Pruned        []string `json:"pruned,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// maxBackupHistory is the number of backup runs reported by /admin/backups.
+const maxBackupHistory = 20
+
+// backups pushes snapshots of the document root to a target on a schedule, keeping the Keep newest.
+type backups struct {
+	target   backupTarget
+	schedule cronSchedule
+	Keep     int
+
+	mu      sync.Mutex
+	running bool
+	next    time.Time
+	history []backupRun
+}
+
+func newBackups(target backupTarget, schedule cronSchedule, keep int) *backups {
+	return &backups{target: target, schedule: schedule, Keep: keep}
+}
+
+type backupsResponse struct {
+	response
+	Target    string      `json:"target"`
+	Schedule  string      `json:"schedule"`
+	Keep      int         `json:"keep"`
+	Running   bool        `json:"running"`
+	Next      time.Time   `json:"next"`
+	Runs      []backupRun `json:"runs"`
+	Snapshots []string    `json:"snapshots"`
+}
+
+// runBackups takes backups on the schedule. It never returns.
+func (s Server) runBackups() {
+	for {
+		s.Backups.mu.Lock()
+		s.Backups.next = s.Backups.schedule.next(time.Now())
+		next := s.Backups.next
+		s.Backups.mu.Unlock()
+		if next.IsZero() {
+			logger.WithField("schedule", s.Backups.schedule.String()).Warn("the backup schedule never matches")
+			return
+		}
+		time.Sleep(time.Until(next))
+		ctx := confined(context.Background())
+		if err := s.Maintenance.wait(ctx, "backup"); err != nil {
+			continue
+		}
+		if _, err := s.backup(ctx); err != nil {
+			logger.WithError(err).Error("backup failed")
+		}
+	}
+}
+
+// backup takes a snapshot and pushes it to the target, then prunes the snapshots beyond the retention.
+func (s Server) backup(ctx context.Context) (backupRun, error) {
+	b := s.Backups
+	b.mu.Lock()
+	if b.running {
+		b.mu.Unlock()
+		return backupRun{}, withStatus(http.StatusConflict, errBackupRunning)
+	}
+	b.running = true
+	b.mu.Unlock()
+
+	run := backupRun{ID: time.Now().UTC().Format("20060102T150405Z"), Started: time.Now()}
+	err := s.pushBackup(ctx, &run)
+	run.Duration = time.Since(run.Started).Seconds()
+	entry := auditLog().WithFields(logrus.Fields{
+		"id":             run.ID,
+		"target":         b.target.String(),
+		"files":          run.Files,
+		"uploaded":       run.Uploaded,
+		"uploaded_bytes": run.UploadedBytes,
+		"pruned":         len(run.Pruned),
+		"duration":       run.Duration,
+	})
+	if err != nil {
+		run.Error = err.Error()
+		entry.WithError(err).Warn("backup failed")
+	} else {
+		entry.Info("backup taken")
+	}
+
+	b.mu.Lock()
+	b.running = false
+	b.history = append([]backupRun{run}, b.history...)
+	if len(b.history) > maxBackupHistory {
+		b.history = b.history[:maxBackupHistory]
+	}
+	b.mu.Unlock()
+	return run, err
+}
+
+func (s Server) pushBackup(ctx context.Context, run *backupRun) error {
+	target := s.Backups.target
+	dir, _, err := s.stageSnapshot()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	existing, err := target.list(ctx, "objects/")
+	if err != nil {
+		return err
+	}
+	stored := make(map[string]bool, len(existing))
+	for _, name := range existing {
+		stored[name] = true
+	}
+	manifest := backupManifest{ID: run.ID, Created: run.Started, Files: []manifestEntry{}}
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		// the files are links to the ones in the document root, so their digests are likely cached under those paths.
+		key := p
+		if strings.HasPrefix(rel, "files/") {
+			key = filepath.Join(s.DocumentRoot, filepath.FromSlash(strings.TrimPrefix(rel, "files/")))
+		}
+		sum, err := s.Digests.sum(key, p, info)
+		if err != nil {
+			return err
+		}
+		digest := s.Digests.label(sum)
+		manifest.Files = append(manifest.Files, manifestEntry{Path: rel, Size: info.Size(), ModTime: info.ModTime(), Digest: digest})
+		run.Files++
+		object, _ := backupObject(digest)
+		if stored[object] {
+			return nil
+		}
+		if err := s.Maintenance.pause(ctx, "backup"); err != nil {
+			return err
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if s.Digests.algorithm != digestSHA256 {
+			sum = ""
+		}
+		if err := target.put(ctx, object, s.Maintenance.reader(ctx, f), info.Size(), sum); err != nil {
+			return err
+		}
+		stored[object] = true
+		run.Uploaded++
+		run.UploadedBytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	if err := target.put(ctx, "snapshots/"+run.ID+".json", bytes.NewReader(body), int64(len(body)), hex.EncodeToString(sum[:])); err != nil {
+		return err
+	}
+	return s.pruneBackups(ctx, manifest, run)
+}
+
+// backupObject returns the name of the object keeping content with the given digest, "algorithm:hex".
+func backupObject(digest string) (string, bool) {
+	algorithm, sum, err := parseDigest(digest)
+	if err != nil || len(sum) < 2 {
+		return "", false
+	}
+	return "objects/" + algorithm + "/" + sum[:2] + "/" + sum, true
+}
+
+// pruneBackups removes the snapshots beyond the retention, and then the objects no longer referenced by any snapshot.
+func (s Server) pruneBackups(ctx context.Context, latest backupManifest, run *backupRun) error {
+	target := s.Backups.target
+	snapshots, err := target.list(ctx, "snapshots/")
+	if err != nil {
+		return err
+	}
+	// IDs are timestamps, so that the names sort by age.
+	sort.Sort(sort.Reverse(sort.StringSlice(snapshots)))
+	if len(snapshots) <= s.Backups.Keep {
+		return nil
+	}
+	expired := snapshots[s.Backups.Keep:]
+	if err := target.remove(ctx, expired); err != nil {
+		return err
+	}
+	run.Pruned = expired
+
+	referenced := map[string]bool{}
+	for _, f := range latest.Files {
+		if object, ok := backupObject(f.Digest); ok {
+			referenced[object] = true
+		}
+	}
+	for _, name := range snapshots[:s.Backups.Keep] {
+		if name == "snapshots/"+latest.ID+".json" {
+			continue
+		}
+		body, err := target.get(ctx, name)
+		if err != nil {
+			return err
+		}
+		var m backupManifest
+		err = json.NewDecoder(body).Decode(&m)
+		body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", name, err)
+		}
+		for _, f := range m.Files {
+			if object, ok := backupObject(f.Digest); ok {
+				referenced[object] = true
+			}
+		}
+	}
+	objects, err := target.list(ctx, "objects/")
+	if err != nil {
+		return err
+	}
+	var unreferenced []string
+	for _, name := range objects {
+		if !referenced[name] {
+			unreferenced = append(unreferenced, name)
+		}
+	}
+	return target.remove(ctx, unreferenced)
+}
+
+// handleBackups serves the admin endpoint /admin/backups: GET reports the status of backups,
+// and POST takes a backup now, in the background.
+func (s Server) handleBackups(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		b := s.Backups
+		snapshots, err := b.target.list(r.Context(), "snapshots/")
+		if err != nil {
+			logger.WithError(err).Warn("failed to list the backups")
+		}
+		sort.Sort(sort.Reverse(sort.StringSlice(snapshots)))
+		for i := range snapshots {
+			snapshots[i] = strings.TrimSuffix(strings.TrimPrefix(snapshots[i], "snapshots/"), ".json")
+		}
+		b.mu.Lock()
+		resp := backupsResponse{
+			response:  response{OK: true},
+			Target:    b.target.String(),
+			Schedule:  b.schedule.String(),
+			Keep:      b.Keep,
+			Running:   b.running,
+			Next:      b.next,
+			Runs:      append([]backupRun{}, b.history...),
+			Snapshots: append([]string{}, snapshots...),
+		}
+		b.mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+		writeJSON(w, resp)
+	case http.MethodPost:
+		s.Backups.mu.Lock()
+		running := s.Backups.running
+		s.Backups.mu.Unlock()
+		if running {
+			respondError(w, withStatus(http.StatusConflict, errBackupRunning))
+			return
+		}
+		go func() {
+			if _, err := s.backup(context.Background()); err != nil {
+				logger.WithError(err).Error("backup failed")
+			}
+		}()
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, response{OK: true})
+	default:
+		w.Header().Set("Allow", "GET,POST")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	bansActiveMetric     = expvar.NewInt("bans_active")
+	bansTotalMetric      = expvar.NewInt("bans_total")
+	bannedRequestsMetric = expvar.NewInt("banned_requests")
+	tripwireHitsMetric   = expvar.NewInt("tripwire_hits")
+	authFailuresMetric   = expvar.NewInt("auth_failures")
+)
+
+var errBanned = errors.New("banned")
+
+// ban is an IP address blocked until a time.
+type ban struct {
+	IP     string    `json:"ip"`
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+	Until  time.Time `json:"until"`
+}
+
+// banOptions configures a banList.
+type banOptions struct {
+	// Tripwires are path patterns (see path.Match) which no legitimate client requests.
+	Tripwires []string
+	Duration  time.Duration
+	// MaxDuration caps the duration of repeated bans for authentication failures, which doubles each time.
+	MaxDuration time.Duration
+	MaxFailures int
+	Window      time.Duration
+	// Exempt lists the networks of trusted clients, which are never banned.
+	Exempt []*net.IPNet
+	// AuthLog receives a line per authentication failure in a fixed format, for tools like fail2ban; it may be nil.
+	AuthLog io.Writer
+}
+
+// banList temporarily bans the IP addresses of clients which request a tripwire path, like /wp-login.php,
+// or fail authentication MaxFailures times within Window.
+type banList struct {
+	banOptions
+
+	mu       sync.Mutex
+	bans     map[string]ban
+	failures map[string][]time.Time
+	// strikes counts the bans of a client for authentication failures, to lock out persistent guessing for longer each time.
+	strikes map[string]strike
+	authLog sync.Mutex
+}
+
+type strike struct {
+	count int
+	until time.Time
+}
+
+func newBanList(opts banOptions) (*banList, error) {
+	for _, pattern := range opts.Tripwires {
+		if _, err := path.Match(pattern, "/"); err != nil {
+			return nil, fmt.Errorf("invalid tripwire %q: %v", pattern, err)
+		}
+	}
+	if opts.MaxDuration < opts.Duration {
+		opts.MaxDuration = opts.Duration
+	}
+	return &banList{
+		banOptions: opts,
+		bans:       map[string]ban{},
+		failures:   map[string][]time.Time{},
+		strikes:    map[string]strike{},
+	}, nil
+}
+
+// parseNetworks parses a comma-separated list of networks in CIDR notation or IP addresses.
+func parseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %v", s, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// isExempt reports whether ip is in a trusted network.
+func (b *banList) isExempt(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range b.Exempt {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client of r. Requests through a reverse proxy all come from the proxy,
+// unless it is trusted by trustProxies.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// trustProxies makes the requests which come from the proxies come from the client they forward them for, as given
+// by X-Forwarded-For, so that bans, rate limits and logs apply to clients rather than to the proxies. Clients can
+// send the header themselves, so the client is the last address in it which is not of a proxy, which they cannot forge.
+func trustProxies(h http.Handler, proxies []*net.IPNet) http.Handler {
+	trusted := func(ip net.IP) bool {
+		for _, network := range proxies {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := net.ParseIP(clientIP(r))
+		if ip == nil || !trusted(ip) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		var forwarded []string
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			forwarded = append(forwarded, strings.Split(v, ",")...)
+		}
+		for i := len(forwarded) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(forwarded[i]))
+			if hop == nil {
+				// what comes before is not known to come from the proxies.
+				break
+			}
+			ip = hop
+			if !trusted(hop) {
+				break
+			}
+		}
+		forwardedFor := *r
+		forwardedFor.RemoteAddr = net.JoinHostPort(ip.String(), "0")
+		h.ServeHTTP(w, &forwardedFor)
+	})
+}
+
+// isTripwire reports whether urlPath matches a tripwire.
+func (b *banList) isTripwire(urlPath string) bool {
+	for _, pattern := range b.Tripwires {
+		if ok, _ := path.Match(pattern, urlPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// banned returns the ban of ip, if any.
+func (b *banList) banned(ip string) (ban, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	bn, ok := b.bans[ip]
+	if ok && time.Now().After(bn.Until) {
+		delete(b.bans, ip)
+		bansActiveMetric.Set(int64(len(b.bans)))
+		return ban{}, false
+	}
+	return bn, ok
+}
+
+// add bans ip for d.
+func (b *banList) add(ip string, reason string, d time.Duration) ban {
+	now := time.Now()
+	bn := ban{IP: ip, Reason: reason, Since: now, Until: now.Add(d)}
+	b.mu.Lock()
+	b.bans[ip] = bn
+	delete(b.failures, ip)
+	bansActiveMetric.Set(int64(len(b.bans)))
+	b.mu.Unlock()
+	bansTotalMetric.Add(1)
+	auditLog().WithFields(logrus.Fields{
+		"ip":     ip,
+		"reason": reason,
+		"until":  bn.Until.UTC().Format(time.RFC3339),
+	}).Warn("client banned")
+	return bn
+}
+
+// remove lifts the ban of ip, and reports whether there was one.
+func (b *banList) remove(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.bans[ip]
+	delete(b.bans, ip)
+	delete(b.failures, ip)
+	delete(b.strikes, ip)
+	bansActiveMetric.Set(int64(len(b.bans)))
+	return ok
+}
+
+// fail records an authentication failure of ip, and bans it when there are too many.
+// The first ban lasts Duration, and each one after it twice as long as the previous, up to MaxDuration,
+// until the client has behaved for MaxDuration.
+func (b *banList) fail(ip string) {
+	if b.MaxFailures <= 0 || b.isExempt(ip) {
+		return
+	}
+	now := time.Now()
+	b.mu.Lock()
+	recent := b.failures[ip][:0]
+	for _, t := range b.failures[ip] {
+		if now.Sub(t) < b.Window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	b.failures[ip] = recent
+	if len(recent) < b.MaxFailures {
+		b.mu.Unlock()
+		return
+	}
+	st := b.strikes[ip]
+	if now.Sub(st.until) >= b.MaxDuration {
+		st.count = 0
+	}
+	d := b.Duration
+	for i := 0; i < st.count && d < b.MaxDuration; i++ {
+		d *= 2
+	}
+	if d > b.MaxDuration {
+		d = b.MaxDuration
+	}
+	b.strikes[ip] = strike{count: st.count + 1, until: now.Add(d)}
+	b.mu.Unlock()
+	b.add(ip, fmt.Sprintf("%d authentication failures", len(recent)), d)
+}
+
+// logAuthFailure writes a line for an authentication failure of r to AuthLog, in the format
+//
+//	2006-01-02T15:04:05Z auth failure from 192.0.2.1: PUT /files/a.txt: token mismatched
+//
+// which stays the same regardless of -log_format, so that it can be matched by a fail2ban filter.
+func (b *banList) logAuthFailure(ip string, r *http.Request, reason string) {
+	if b.AuthLog == nil {
+		return
+	}
+	b.authLog.Lock()
+	defer b.authLog.Unlock()
+	fmt.Fprintf(b.AuthLog, "%s auth failure from %s: %s %q: %s\n", time.Now().UTC().Format(time.RFC3339), ip, r.Method, r.URL.Path, reason)
+}
+
+// list returns the active bans, the latest first.
+func (b *banList) list() []ban {
+	now := time.Now()
+	b.mu.Lock()
+	bans := make([]ban, 0, len(b.bans))
+	for _, bn := range b.bans {
+		if now.Before(bn.Until) {
+			bans = append(bans, bn)
+		}
+	}
+	b.mu.Unlock()
+	sort.Slice(bans, func(i, j int) bool {
+		return bans[i].Since.After(bans[j].Since)
+	})
+	return bans
+}
+
+// expire forgets expired bans and stale failures periodically. It never returns.
+func (b *banList) expire() {
+	for range time.Tick(time.Minute) {
+		now := time.Now()
+		b.mu.Lock()
+		for ip, bn := range b.bans {
+			if now.After(bn.Until) {
+				delete(b.bans, ip)
+			}
+		}
+		for ip, times := range b.failures {
+			if len(times) == 0 || now.Sub(times[len(times)-1]) >= b.Window {
+				delete(b.failures, ip)
+			}
+		}
+		for ip, st := range b.strikes {
+			if now.Sub(st.until) >= b.MaxDuration {
+				delete(b.strikes, ip)
+			}
+		}
+		bansActiveMetric.Set(int64(len(b.bans)))
+		b.mu.Unlock()
+	}
+}
+
+// guard wraps h to reject requests from banned clients, ban clients which hit a tripwire,
+// and count authentication failures.
+func (b *banList) guard(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if bn, ok := b.banned(ip); ok {
+			bannedRequestsMetric.Add(1)
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Retry-After", fmt.Sprint(int(time.Until(bn.Until).Seconds())+1))
+			respondError(w, withStatus(http.StatusForbidden, errBanned))
+			return
+		}
+		if b.isTripwire(r.URL.Path) && !b.isExempt(ip) {
+			tripwireHitsMetric.Add(1)
+			b.add(ip, "tripwire "+r.URL.Path, b.Duration)
+			// look like any missing file, so as not to tell scanners what happened.
+			w.Header().Set("Connection", "close")
+			respondError(w, fmt.Errorf("\"%s\" is %w", r.URL.Path, errNotFound))
+			return
+		}
+		var reason error
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), authFailureKey{}, &reason)))
+		if rec.status != http.StatusUnauthorized {
+			return
+		}
+		if reason == nil {
+			reason = errors.New(http.StatusText(http.StatusUnauthorized))
+		}
+		authFailuresMetric.Add(1)
+		logger.WithFields(logrus.Fields{
+			"log":    "auth",
+			"ip":     ip,
+			"method": r.Method,
+			"path":   r.URL.Path,
+			"reason": reason.Error(),
+		}).Warn("authentication failed")
+		b.logAuthFailure(ip, r, reason.Error())
+		// requests without any credentials are not guesses.
+		if !errors.Is(reason, errMissingToken) {
+			b.fail(ip)
+		}
+	})
+}
+
+type authFailureKey struct{}
+
+// recordAuthFailure tells the ban list why the authentication of r failed, which is logged if it is rejected.
+func recordAuthFailure(r *http.Request, err error) {
+	if reason, ok := r.Context().Value(authFailureKey{}).(*error); ok {
+		*reason = err
+	}
+}
+
+// handleBans serves the admin endpoint /admin/bans: GET lists the active bans, and DELETE /admin/bans/(ip) lifts one.
+func (b *banList) handleBans(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.WriteHeader(http.StatusOK)
+		writeJSON(w, bansResponse{response: response{OK: true}, Bans: b.list()})
+	case http.MethodDelete:
+		ip := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/bans"), "/")
+		if !b.remove(ip) {
+			respondError(w, fmt.Errorf("ban of \"%s\" is %w", ip, errNotFound))
+			return
+		}
+		auditLog().WithFields(logrus.Fields{
+			"ip":     ip,
+			"remote": r.RemoteAddr,
+		}).Info("client unbanned")
+		w.WriteHeader(http.StatusOK)
+		writeJSON(w, response{OK: true})
+	default:
+		w.Header().Set("Allow", "GET,DELETE")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+	}
+}
+
+type bansResponse struct {
+	response
+	Bans []ban `json:"bans"`
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrustProxies(t *testing.T) {
+	proxies, err := parseNetworks("10.0.0.0/8,192.0.2.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got string
+	h := trustProxies(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = clientIP(r) }), proxies)
+	for _, tc := range []struct {
+		remote    string
+		forwarded []string
+		want      string
+	}{
+		{"203.0.113.5:4711", nil, "203.0.113.5"},
+		// only proxies are believed.
+		{"203.0.113.5:4711", []string{"198.51.100.7"}, "203.0.113.5"},
+		{"192.0.2.1:4711", []string{"198.51.100.7"}, "198.51.100.7"},
+		{"192.0.2.1:4711", nil, "192.0.2.1"},
+		// the client can prepend anything, but not what the proxies append.
+		{"192.0.2.1:4711", []string{"127.0.0.1, 198.51.100.7"}, "198.51.100.7"},
+		{"192.0.2.1:4711", []string{"127.0.0.1", "198.51.100.7, 10.1.2.3"}, "198.51.100.7"},
+		{"10.1.2.3:4711", []string{"198.51.100.7, 192.0.2.1"}, "198.51.100.7"},
+		{"192.0.2.1:4711", []string{"10.1.2.3, 10.4.5.6"}, "10.1.2.3"},
+		{"192.0.2.1:4711", []string{"198.51.100.7, garbage"}, "192.0.2.1"},
+		{"192.0.2.1:4711", []string{" 2001:db8::1 "}, "2001:db8::1"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/files/a", nil)
+		r.RemoteAddr = tc.remote
+		for _, v := range tc.forwarded {
+			r.Header.Add("X-Forwarded-For", v)
+		}
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		if got != tc.want {
+			t.Errorf("%s with X-Forwarded-For %q: client %s, want %s", tc.remote, tc.forwarded, got, tc.want)
+		}
+	}
+}
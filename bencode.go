@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// bencode encodes v as in BitTorrent metainfo files: v is an int, int64, string, []byte, []interface{}
+// or map[string]interface{}, whose keys are written in sorted order.
+func bencode(v interface{}) []byte {
+	var buf bytes.Buffer
+	bencodeTo(&buf, v)
+	return buf.Bytes()
+}
+
+func bencodeTo(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case int:
+		fmt.Fprintf(buf, "i%de", v)
+	case int64:
+		fmt.Fprintf(buf, "i%de", v)
+	case string:
+		fmt.Fprintf(buf, "%d:%s", len(v), v)
+	case []byte:
+		fmt.Fprintf(buf, "%d:", len(v))
+		buf.Write(v)
+	case []interface{}:
+		buf.WriteByte('l')
+		for _, e := range v {
+			bencodeTo(buf, e)
+		}
+		buf.WriteByte('e')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('d')
+		for _, k := range keys {
+			bencodeTo(buf, k)
+			bencodeTo(buf, v[k])
+		}
+		buf.WriteByte('e')
+	default:
+		panic(fmt.Sprintf("bencode: unsupported type %T", v))
+	}
+}
+
+var errInvalidBencode = errors.New("invalid bencoded data")
+
+// bdecode decodes b into int64, string, []interface{} and map[string]interface{} values.
+func bdecode(b []byte) (interface{}, error) {
+	v, rest, err := bdecodeValue(b)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errInvalidBencode
+	}
+	return v, nil
+}
+
+func bdecodeValue(b []byte) (interface{}, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, errInvalidBencode
+	}
+	switch c := b[0]; {
+	case c == 'i':
+		end := bytes.IndexByte(b, 'e')
+		if end < 0 {
+			return nil, nil, errInvalidBencode
+		}
+		n, err := strconv.ParseInt(string(b[1:end]), 10, 64)
+		if err != nil {
+			return nil, nil, errInvalidBencode
+		}
+		return n, b[end+1:], nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(b, ':')
+		if colon < 0 {
+			return nil, nil, errInvalidBencode
+		}
+		n, err := strconv.Atoi(string(b[:colon]))
+		if err != nil || n < 0 || colon+1+n > len(b) {
+			return nil, nil, errInvalidBencode
+		}
+		return string(b[colon+1 : colon+1+n]), b[colon+1+n:], nil
+	case c == 'l':
+		list := []interface{}{}
+		b = b[1:]
+		for len(b) > 0 && b[0] != 'e' {
+			v, rest, err := bdecodeValue(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			list = append(list, v)
+			b = rest
+		}
+		if len(b) == 0 {
+			return nil, nil, errInvalidBencode
+		}
+		return list, b[1:], nil
+	case c == 'd':
+		dict := map[string]interface{}{}
+		b = b[1:]
+		for len(b) > 0 && b[0] != 'e' {
+			k, rest, err := bdecodeValue(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, nil, errInvalidBencode
+			}
+			v, rest, err := bdecodeValue(rest)
+			if err != nil {
+				return nil, nil, err
+			}
+			dict[key] = v
+			b = rest
+		}
+		if len(b) == 0 {
+			return nil, nil, errInvalidBencode
+		}
+		return dict, b[1:], nil
+	}
+	return nil, nil, errInvalidBencode
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// Buffers are pooled, since allocating them for every request makes the garbage collector busy under concurrent uploads.
+var (
+	copyBuffers = sync.Pool{New: func() interface{} {
+		b := make([]byte, 32<<10)
+		return &b
+	}}
+	chunkBuffers = sync.Pool{New: func() interface{} {
+		b := make([]byte, pipelineChunkSize)
+		return &b
+	}}
+	jsonBuffers = sync.Pool{New: func() interface{} {
+		return new(bytes.Buffer)
+	}}
+)
+
+// copyBuffer is io.Copy with a pooled buffer. The buffer is not used if src or dst can copy by itself,
+// e.g. between files with copy_file_range.
+func copyBuffer(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(dst, src, *buf)
+}
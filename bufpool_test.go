@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+// The benchmarks compare the pooled buffers with allocating them, under concurrent requests, where the garbage
+// collector matters. Run them with -benchmem to see the allocations.
+
+const benchmarkCopySize = 4 << 20
+
+// onlyReader and onlyWriter hide WriterTo and ReaderFrom, so that copies go through the buffer.
+type onlyReader struct{ io.Reader }
+
+type onlyWriter struct{ io.Writer }
+
+func benchmarkCopy(b *testing.B, copy func(dst io.Writer, src io.Reader) (int64, error)) {
+	content := make([]byte, benchmarkCopySize)
+	b.SetBytes(benchmarkCopySize)
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n, err := copy(onlyWriter{ioutil.Discard}, onlyReader{bytes.NewReader(content)})
+			if err != nil || n != benchmarkCopySize {
+				b.Fatalf("copied %d bytes: %v", n, err)
+			}
+		}
+	})
+}
+
+func BenchmarkCopyBuffer(b *testing.B) {
+	benchmarkCopy(b, copyBuffer)
+}
+
+func BenchmarkCopyUnpooled(b *testing.B) {
+	benchmarkCopy(b, func(dst io.Writer, src io.Reader) (int64, error) {
+		return io.CopyBuffer(dst, src, make([]byte, 32<<10))
+	})
+}
+
+func BenchmarkPipeCopy(b *testing.B) {
+	benchmarkCopy(b, func(dst io.Writer, src io.Reader) (int64, error) {
+		return pipeCopy(context.Background(), src, dst, onlyWriter{ioutil.Discard})
+	})
+}
+
+// discardResponse is a ResponseWriter which writes nowhere.
+type discardResponse struct{ header http.Header }
+
+func (w discardResponse) Header() http.Header         { return w.header }
+func (w discardResponse) Write(b []byte) (int, error) { return len(b), nil }
+func (w discardResponse) WriteHeader(int)             {}
+
+func benchmarkWriteJSON(b *testing.B, write func(w http.ResponseWriter, v interface{}) (int, error)) {
+	files := make([]manifestEntry, 100)
+	for i := range files {
+		files[i] = manifestEntry{Path: "/reports/2024/report.pdf", Size: 48213}
+	}
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		w := discardResponse{header: http.Header{}}
+		for pb.Next() {
+			if _, err := write(w, files); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkWriteJSON(b *testing.B) {
+	benchmarkWriteJSON(b, writeJSON)
+}
+
+func BenchmarkWriteJSONUnpooled(b *testing.B) {
+	benchmarkWriteJSON(b, func(w http.ResponseWriter, v interface{}) (int, error) {
+		var buf bytes.Buffer
+		if err := json.NewEncoder(&buf).Encode(v); err != nil {
+			return 0, err
+		}
+		return w.Write(buf.Bytes())
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// callbackAttempts is how many times a callback is tried before it is given up.
+const callbackAttempts = 3
+
+// urlAllowlist holds the URLs a client may have the server send requests to, like callbacks. A URL is allowed
+// if it has the scheme and the host of one of them, and a path under its path.
+type urlAllowlist []*url.URL
+
+// parseURLAllowlist parses the allowed URLs, like "https://hooks.example.com/uploads".
+func parseURLAllowlist(defs []string) (urlAllowlist, error) {
+	allowed := urlAllowlist{}
+	for _, def := range defs {
+		u, err := url.Parse(def)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid URL %q: must be an absolute http or https URL", def)
+		}
+		allowed = append(allowed, u)
+	}
+	return allowed, nil
+}
+
+// allows reports whether u is under one of the allowed URLs. Paths with dot segments, even percent-encoded,
+// are never allowed, since the server they are sent to may resolve them to a path outside of the allowed one.
+func (a urlAllowlist) allows(u *url.URL) bool {
+	if u.Opaque != "" || hasDotSegments(u.Path) {
+		return false
+	}
+	for _, allowed := range a {
+		if u.Scheme != allowed.Scheme || !strings.EqualFold(u.Host, allowed.Host) || u.User != nil {
+			continue
+		}
+		prefix := strings.TrimSuffix(allowed.Path, "/")
+		if u.Path == prefix || strings.HasPrefix(u.Path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// hasDotSegments reports whether the decoded path p has "." or ".." segments, taking backslashes as slashes
+// as some servers do.
+func hasDotSegments(p string) bool {
+	for _, segment := range strings.FieldsFunc(p, func(c rune) bool { return c == '/' || c == '\\' }) {
+		if segment == "." || segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// callbackOf returns the URL given by the "callback" query parameter of r, or nil if there is none.
+// It fails if the URL is not allowed, so that the upload is rejected before anything is stored.
+func (s Server) callbackOf(r *http.Request) (*url.URL, error) {
+	callback := r.URL.Query().Get("callback")
+	if callback == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(callback)
+	if err != nil || !s.Callbacks.allows(u) {
+		logger.WithField("callback", callback).Info("callback URL rejected")
+		return nil, withStatus(http.StatusBadRequest, fmt.Errorf("callback URL %q is not allowed", callback))
+	}
+	return u, nil
+}
+
+// callbackEvent is posted to the callback URL of an upload.
+type callbackEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	// UploadID is the ID of the upload, as returned in X-Upload-Id.
+	UploadID string `json:"upload_id,omitempty"`
+	// Upload is the same as the response to the upload request.
+	Upload interface{} `json:"upload"`
+}
+
+// notifyCallback calls back the URL given with r, if any, once the upload has been processed:
+// stored, with its digest and retention recorded. It returns right away; failed calls are retried.
+func (s Server) notifyCallback(r *http.Request, upload interface{}) {
+	callback, err := s.callbackOf(r)
+	if err != nil || callback == nil {
+		return
+	}
+	event := callbackEvent{Event: "upload.processed", Time: time.Now().UTC(), UploadID: uploadIDOf(r.Context()), Upload: upload}
+	go func() {
+		entry := uploadLog(r.Context()).WithFields(logrus.Fields{
+			"callback": callback.String(),
+			"path":     r.URL.Path,
+		})
+		// the request is over by the time the callback is sent, so its context is not used.
+		for attempt := 1; ; attempt++ {
+			err := postJSON(context.Background(), callback.String(), event)
+			if err == nil {
+				entry.Debug("callback sent")
+				return
+			}
+			if attempt == callbackAttempts {
+				entry.WithError(err).Warn("failed to send the callback")
+				return
+			}
+			entry.WithError(err).Info("failed to send the callback, retrying")
+			time.Sleep(time.Duration(attempt) * 5 * time.Second)
+		}
+	}()
+}
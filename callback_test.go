@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestURLAllowlistAllows(t *testing.T) {
+	allowed, err := parseURLAllowlist([]string{"https://hooks.example.com/uploads"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		url  string
+		want bool
+	}{
+		{"https://hooks.example.com/uploads", true},
+		{"https://hooks.example.com/uploads/", true},
+		{"https://hooks.example.com/uploads/done?id=1", true},
+		{"https://HOOKS.example.com/uploads/done", true},
+		{"https://hooks.example.com/uploads-admin", false},
+		{"https://hooks.example.com/admin", false},
+		{"http://hooks.example.com/uploads/done", false},
+		{"https://hooks.example.com.evil.test/uploads/done", false},
+		{"https://user@hooks.example.com/uploads/done", false},
+		{"https://hooks.example.com/uploads/../admin", false},
+		{"https://hooks.example.com/uploads/%2e%2e/admin", false},
+		{"https://hooks.example.com/uploads/%2E%2E%2Fadmin", false},
+		{"https://hooks.example.com/uploads/./done", false},
+		{"https://hooks.example.com/uploads\\..\\admin", false},
+		{"https://hooks.example.com/uploads/..done", true},
+	} {
+		u, err := url.Parse(tc.url)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.url, err)
+		}
+		if got := allowed.allows(u); got != tc.want {
+			t.Errorf("allows(%s) = %v, want %v", tc.url, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// capabilities describes what this instance accepts, so that generic clients can configure themselves.
+type capabilities struct {
+	response
+	MaxUploadSize int64    `json:"max_upload_size"`
+	AcceptedTypes []string `json:"accepted_types"`
+	// ChunkedUpload reports that PUT accepts bodies of unknown length with chunked transfer encoding.
+	ChunkedUpload bool `json:"chunked_upload"`
+	// ValidateOnly reports that uploads can be checked beforehand with the validate_only parameter.
+	ValidateOnly  bool             `json:"validate_only"`
+	UploadMethods []string         `json:"upload_methods"`
+	Auth          capabilitiesAuth `json:"auth"`
+	Naming        string           `json:"naming"`
+	// Digest is the algorithm digests of content are made with.
+	Digest    string            `json:"digest"`
+	Endpoints map[string]string `json:"endpoints"`
+}
+
+type capabilitiesAuth struct {
+	// ProtectedMethods lists the methods which require the token, or with RBAC, to be authorized.
+	ProtectedMethods []string `json:"protected_methods"`
+	// TokenParameter is the name of the query or form parameter carrying the token.
+	TokenParameter string `json:"token_parameter"`
+	// PublicRead reports that downloads never require the token, and every other request always does.
+	PublicRead bool `json:"public_read"`
+	// RBAC reports that requests are authorized by the roles of users, whatever their methods; those granted to
+	// the anonymous user need no credentials.
+	RBAC bool `json:"rbac"`
+	// Captcha names the CAPTCHA provider whose challenge uploads without credentials must solve, if any.
+	Captcha string `json:"captcha,omitempty"`
+}
+
+func (s Server) capabilities() capabilities {
+	c := capabilities{
+		response:      response{OK: true},
+		MaxUploadSize: s.MaxUploadSize,
+		AcceptedTypes: []string{"*/*"},
+		ChunkedUpload: true,
+		ValidateOnly:  true,
+		UploadMethods: []string{http.MethodPost, http.MethodPut},
+		Auth: capabilitiesAuth{
+			ProtectedMethods: s.protectedMethods(),
+			TokenParameter:   "token",
+			PublicRead:       s.PublicRead && s.RBAC == nil,
+			RBAC:             s.RBAC != nil,
+		},
+		Naming: s.Naming.Strategy,
+		Digest: s.Digests.algorithm,
+		Endpoints: map[string]string{
+			"upload":    "/upload",
+			"files":     "/files/",
+			"authorize": "/upload/authorize",
+			"request":   "/upload/request",
+			"check":     "/upload/check",
+			"json":      "/upload/json",
+			"sessions":  "/upload/sessions/",
+			"share":     "/share",
+			"report":    "/report/",
+			"data":      "/data/",
+			"segments":  "/segments/",
+			"version":   "/version",
+		},
+	}
+	if s.Torrents != nil {
+		c.Endpoints["torrents"] = "/torrents"
+	}
+	if s.Converter != nil {
+		c.Endpoints["convert"] = "/convert/"
+	}
+	if s.Captcha != nil {
+		c.Auth.Captcha = s.Captcha.Provider
+	}
+	return c
+}
+
+// protectedMethods lists the methods for which isAuthenticationRequired, among those served and those given as
+// protected.
+func (s Server) protectedMethods() []string {
+	methods := []string{}
+	seen := map[string]bool{}
+	for _, m := range append([]string{
+		http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete,
+	}, s.ProtectedMethods...) {
+		if !seen[m] && s.isAuthenticationRequired(&http.Request{Method: m}) {
+			methods = append(methods, m)
+		}
+		seen[m] = true
+	}
+	return methods
+}
+
+// setCapabilityHeaders advertises the main capabilities as response headers, for clients which only send HEAD or OPTIONS.
+func (s Server) setCapabilityHeaders(w http.ResponseWriter) {
+	c := s.capabilities()
+	w.Header().Set("X-Upload-Max-Size", strconv.FormatInt(c.MaxUploadSize, 10))
+	w.Header().Set("X-Upload-Accept", strings.Join(c.AcceptedTypes, ","))
+	w.Header().Set("X-Upload-Chunked", strconv.FormatBool(c.ChunkedUpload))
+	w.Header().Set("X-Upload-Token-Methods", strings.Join(c.Auth.ProtectedMethods, ","))
+}
+
+// handleCapabilities serves GET /capabilities. It does not require the token.
+func (s Server) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET,HEAD")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	s.setCapabilityHeaders(w)
+	if s.EnableCORS {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodGet {
+		writeJSON(w, s.capabilities())
+	}
+}
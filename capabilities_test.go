@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestCapabilitiesProtectedMethods(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		protected  []string
+		publicRead bool
+		rbac       bool
+		want       []string
+		header     string
+	}{
+		{"default", []string{http.MethodGet, http.MethodPost, http.MethodHead, http.MethodPut}, false, false,
+			[]string{"GET", "HEAD", "POST", "PUT"}, "GET,HEAD,POST,PUT"},
+		{"uploads only", []string{http.MethodPost, http.MethodPut}, false, false, []string{"POST", "PUT"}, "POST,PUT"},
+		{"none", nil, false, false, []string{}, ""},
+		{"custom method", []string{http.MethodPut, "LOCK"}, false, false, []string{"PUT", "LOCK"}, "PUT,LOCK"},
+		// -public_read overrides -protected_method.
+		{"public read", []string{http.MethodGet, http.MethodPost}, true, false,
+			[]string{"POST", "PUT", "PATCH", "DELETE"}, "POST,PUT,PATCH,DELETE"},
+		{"public read with custom method", []string{"LOCK"}, true, false,
+			[]string{"POST", "PUT", "PATCH", "DELETE", "LOCK"}, "POST,PUT,PATCH,DELETE,LOCK"},
+		// with RBAC, every request is authorized, as made by the anonymous user if without credentials.
+		{"rbac", []string{http.MethodPost}, true, true,
+			[]string{"GET", "HEAD", "OPTIONS", "POST", "PUT", "PATCH", "DELETE"}, "GET,HEAD,OPTIONS,POST,PUT,PATCH,DELETE"},
+	} {
+		s := NewServer("", 1024, "secret", false, tc.protected)
+		s.PublicRead = tc.publicRead
+		if tc.rbac {
+			s.RBAC = newRBACStore()
+		}
+		w := httptest.NewRecorder()
+		s.handleCapabilities(w, httptest.NewRequest(http.MethodGet, "/capabilities", nil))
+		var c capabilities
+		if err := json.Unmarshal(w.Body.Bytes(), &c); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(c.Auth.ProtectedMethods, tc.want) {
+			t.Errorf("%s: protected methods %q, want %q", tc.name, c.Auth.ProtectedMethods, tc.want)
+		}
+		if got := w.Header().Get("X-Upload-Token-Methods"); got != tc.header {
+			t.Errorf("%s: X-Upload-Token-Methods %q, want %q", tc.name, got, tc.header)
+		}
+		if c.Auth.PublicRead != (tc.publicRead && !tc.rbac) || c.Auth.RBAC != tc.rbac {
+			t.Errorf("%s: public_read %v, rbac %v", tc.name, c.Auth.PublicRead, c.Auth.RBAC)
+		}
+		for _, m := range []string{http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+			listed := false
+			for _, p := range c.Auth.ProtectedMethods {
+				listed = listed || p == m
+			}
+			if required := s.isAuthenticationRequired(httptest.NewRequest(m, "/files/a.txt", nil)); listed != required {
+				t.Errorf("%s: %s listed %v, but requires authentication %v", tc.name, m, listed, required)
+			}
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var errCaptchaFailed = errors.New("CAPTCHA verification failed")
+
+// captchaTimeout bounds the verification of a CAPTCHA response by the provider.
+const captchaTimeout = 10 * time.Second
+
+// captchaProviders are the verification endpoints of the supported providers, and the form fields their widgets
+// submit the response in.
+var captchaProviders = map[string]struct {
+	verifyURL string
+	field     string
+}{
+	"hcaptcha":  {verifyURL: "https://api.hcaptcha.com/siteverify", field: "h-captcha-response"},
+	"turnstile": {verifyURL: "https://challenges.cloudflare.com/turnstile/v0/siteverify", field: "cf-turnstile-response"},
+}
+
+// captchaVerifier checks the CAPTCHA responses sent with anonymous uploads with the provider, which both
+// hCaptcha and Cloudflare Turnstile do by the same siteverify protocol.
+type captchaVerifier struct {
+	Provider  string
+	VerifyURL string
+	secret    string
+	client    *http.Client
+}
+
+// newCaptchaVerifier makes a verifier for provider, hcaptcha or turnstile; verifyURL overrides its endpoint if not empty.
+func newCaptchaVerifier(provider string, secret string, verifyURL string) (*captchaVerifier, error) {
+	p, ok := captchaProviders[provider]
+	if !ok {
+		return nil, fmt.Errorf("unknown CAPTCHA provider %q (hcaptcha or turnstile)", provider)
+	}
+	if secret == "" {
+		return nil, errors.New("-captcha_secret is required to verify CAPTCHAs")
+	}
+	if verifyURL == "" {
+		verifyURL = p.verifyURL
+	}
+	return &captchaVerifier{Provider: provider, VerifyURL: verifyURL, secret: secret, client: &http.Client{Timeout: captchaTimeout}}, nil
+}
+
+// responseOf returns the CAPTCHA response sent with r: in the X-Captcha-Response header by scripts,
+// or in the form field of the provider's widget.
+func (c *captchaVerifier) responseOf(r *http.Request) string {
+	if v := r.Header.Get("X-Captcha-Response"); v != "" {
+		return v
+	}
+	// the body of a PUT is the file itself, which reading a form would consume.
+	if r.Method != http.MethodPost {
+		return ""
+	}
+	return r.FormValue(captchaProviders[c.Provider].field)
+}
+
+// verify checks the CAPTCHA response of r with the provider. Responses can only be verified once.
+func (c *captchaVerifier) verify(ctx context.Context, r *http.Request) error {
+	response := c.responseOf(r)
+	if response == "" {
+		return withStatus(http.StatusForbidden, fmt.Errorf("%w: no response to the challenge", errCaptchaFailed))
+	}
+	form := url.Values{}
+	form.Set("secret", c.secret)
+	form.Set("response", response)
+	form.Set("remoteip", clientIP(r))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.VerifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return withStatus(http.StatusServiceUnavailable, fmt.Errorf("failed to verify the CAPTCHA: %v", err))
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(b, &result) != nil {
+		return withStatus(http.StatusServiceUnavailable, fmt.Errorf("failed to verify the CAPTCHA: %s responded %s", c.Provider, resp.Status))
+	}
+	if !result.Success {
+		return withStatus(http.StatusForbidden, fmt.Errorf("%w: %s", errCaptchaFailed, strings.Join(result.ErrorCodes, ", ")))
+	}
+	return nil
+}
+
+// isAnonymous tells whether r carries no credentials granting it, so that it is only accepted as an anonymous upload.
+func (s Server) isAnonymous(r *http.Request) bool {
+	if s.RBAC != nil {
+		id, err := s.RBAC.identify(r, s.SecureToken.get())
+		return err == nil && !id.server && id.name == anonymousUser
+	}
+	return s.checkToken(r) != nil
+}
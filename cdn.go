@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// purgeQueueSize is the number of keys waiting to be purged, beyond which new ones are dropped.
+	purgeQueueSize = 10000
+	// purgeDelay is how long changes are collected to be purged together.
+	purgeDelay    = time.Second
+	purgeAttempts = 3
+)
+
+// The APIs of the CDNs.
+const (
+	fastlyAPI     = "https://api.fastly.com"
+	cloudflareAPI = "https://api.cloudflare.com/client/v4"
+)
+
+// cleanFilesPath cleans urlPath, a path under /files/, keeping the trailing slash of a directory.
+func cleanFilesPath(urlPath string) string {
+	rel := path.Clean("/" + strings.TrimPrefix(urlPath, "/files/"))
+	if rel != "/" && strings.HasSuffix(urlPath, "/") {
+		rel += "/"
+	}
+	return "/files" + rel
+}
+
+// surrogateKeys returns the keys of the response to GET urlPath, a path under /files/: the path itself, which is
+// the key of the index of a directory when it ends with a slash, and "dir/*" for every directory above it,
+// to purge a whole tree at once. Keys are escaped, so that they never contain spaces or commas.
+func surrogateKeys(urlPath string) []string {
+	key := (&url.URL{Path: urlPath}).EscapedPath()
+	keys := []string{key}
+	for dir := key; dir != "/files/"; {
+		dir = dir[:strings.LastIndex(strings.TrimSuffix(dir, "/"), "/")+1]
+		keys = append(keys, dir+"*")
+	}
+	return keys
+}
+
+// setSurrogateKeys tags the response to GET urlPath with its keys, for Fastly and Varnish as Surrogate-Key and
+// for Cloudflare as Cache-Tag.
+func setSurrogateKeys(w http.ResponseWriter, urlPath string) {
+	keys := surrogateKeys(urlPath)
+	w.Header().Set("Surrogate-Key", strings.Join(keys, " "))
+	w.Header().Set("Cache-Tag", strings.Join(keys, ","))
+}
+
+// purgeKeysOf returns the keys to purge for urlPath, a path under /files/: a directory, ending with a slash,
+// is purged with everything below it.
+func purgeKeysOf(urlPath string) []string {
+	key := (&url.URL{Path: urlPath}).EscapedPath()
+	if strings.HasSuffix(key, "/") {
+		return []string{key, key + "*"}
+	}
+	return []string{key}
+}
+
+// purgeTarget purges cached responses by their keys.
+type purgeTarget interface {
+	purge(ctx context.Context, keys []string) error
+	// maxKeys is the number of keys it takes at once.
+	maxKeys() int
+	String() string
+}
+
+// parsePurgeTarget parses a cache to purge: varnish://host[:port][/path] (or varnish+https://),
+// fastly://token@service_id or cloudflare://token@zone_id.
+func parsePurgeTarget(raw string) (purgeTarget, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid purge target: %v", err)
+	}
+	switch u.Scheme {
+	case "varnish", "varnish+https":
+		if u.Host == "" {
+			return nil, errors.New("Varnish purge target must be given as varnish://host[:port][/path]")
+		}
+		endpoint := *u
+		endpoint.Scheme = "http"
+		if u.Scheme == "varnish+https" {
+			endpoint.Scheme = "https"
+		}
+		if endpoint.Path == "" {
+			endpoint.Path = "/"
+		}
+		return varnishPurger{url: endpoint.String()}, nil
+	case "fastly":
+		if u.User == nil || u.User.Username() == "" || u.Host == "" {
+			return nil, errors.New("Fastly purge target must be given as fastly://token@service_id")
+		}
+		return fastlyPurger{token: u.User.Username(), service: u.Host}, nil
+	case "cloudflare":
+		if u.User == nil || u.User.Username() == "" || u.Host == "" {
+			return nil, errors.New("Cloudflare purge target must be given as cloudflare://token@zone_id")
+		}
+		return cloudflarePurger{token: u.User.Username(), zone: u.Host}, nil
+	}
+	return nil, fmt.Errorf("purge target %q must be a varnish://, fastly:// or cloudflare:// URL", raw)
+}
+
+// sendPurge sends req, which fails unless it is answered with 2xx.
+func sendPurge(req *http.Request) error {
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("purge responded %s", resp.Status)
+	}
+	return nil
+}
+
+// varnishPurger sends PURGE requests with the keys in the xkey header, as taken by xkey.purge of vmod_xkey.
+type varnishPurger struct {
+	url string
+}
+
+func (v varnishPurger) purge(ctx context.Context, keys []string) error {
+	req, err := http.NewRequest("PURGE", v.url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("xkey", strings.Join(keys, " "))
+	return sendPurge(req.WithContext(ctx))
+}
+
+func (v varnishPurger) maxKeys() int {
+	return 256
+}
+
+func (v varnishPurger) String() string {
+	return v.url
+}
+
+// fastlyPurger purges by surrogate key with the Fastly API.
+type fastlyPurger struct {
+	token, service string
+}
+
+func (f fastlyPurger) purge(ctx context.Context, keys []string) error {
+	req, err := http.NewRequest(http.MethodPost, fastlyAPI+"/service/"+url.PathEscape(f.service)+"/purge", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Fastly-Key", f.token)
+	req.Header.Set("Surrogate-Key", strings.Join(keys, " "))
+	return sendPurge(req.WithContext(ctx))
+}
+
+func (f fastlyPurger) maxKeys() int {
+	return 256
+}
+
+func (f fastlyPurger) String() string {
+	return "fastly://" + f.service
+}
+
+// cloudflarePurger purges by cache tag with the Cloudflare API.
+type cloudflarePurger struct {
+	token, zone string
+}
+
+func (c cloudflarePurger) purge(ctx context.Context, keys []string) error {
+	body, err := json.Marshal(map[string][]string{"tags": keys})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, cloudflareAPI+"/zones/"+url.PathEscape(c.zone)+"/purge_cache", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	return sendPurge(req.WithContext(ctx))
+}
+
+func (c cloudflarePurger) maxKeys() int {
+	return 30
+}
+
+func (c cloudflarePurger) String() string {
+	return "cloudflare://" + c.zone
+}
+
+// cachePurger purges the responses of the changed files from the caches in front of the server.
+// Changes are collected for a moment, so that a burst of uploads makes few purges.
+type cachePurger struct {
+	targets []purgeTarget
+	queue   chan string
+}
+
+func newCachePurger(targets []purgeTarget) *cachePurger {
+	return &cachePurger{targets: targets, queue: make(chan string, purgeQueueSize)}
+}
+
+// changed queues the purge of urlPath, a file under /files/, and of the index of its directory.
+// It never blocks: the keys are dropped if the queue is full.
+func (p *cachePurger) changed(urlPath string) {
+	if p == nil {
+		return
+	}
+	for _, key := range append(purgeKeysOf(urlPath), purgeKeysOf(path.Dir(urlPath) + "/")[0]) {
+		select {
+		case p.queue <- key:
+		default:
+			logger.WithField("path", urlPath).Warn("purge queue is full, dropping the purge")
+			return
+		}
+	}
+}
+
+// run purges the queued keys. It never returns.
+func (p *cachePurger) run() {
+	for key := range p.queue {
+		batch := map[string]bool{key: true}
+		timer := time.NewTimer(purgeDelay)
+	collect:
+		for {
+			select {
+			case key := <-p.queue:
+				batch[key] = true
+			case <-timer.C:
+				break collect
+			}
+		}
+		keys := make([]string, 0, len(batch))
+		for key := range batch {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		entry := logger.WithField("keys", len(keys))
+		for attempt := 1; ; attempt++ {
+			err := p.purge(context.Background(), keys)
+			if err == nil {
+				entry.Debug("cached responses purged")
+				break
+			}
+			if attempt == purgeAttempts {
+				entry.WithError(err).Warn("failed to purge cached responses")
+				break
+			}
+			entry.WithError(err).Info("failed to purge cached responses, retrying")
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+}
+
+// purge purges keys from every target, in batches as large as each takes.
+func (p *cachePurger) purge(ctx context.Context, keys []string) error {
+	var failed []string
+	for _, t := range p.targets {
+		for i := 0; i < len(keys); i += t.maxKeys() {
+			end := i + t.maxKeys()
+			if end > len(keys) {
+				end = len(keys)
+			}
+			if err := t.purge(ctx, keys[i:end]); err != nil {
+				failed = append(failed, fmt.Sprintf("%s: %v", t, err))
+				break
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// purgeRequest is the body of POST /admin/purge.
+type purgeRequest struct {
+	// Paths are URL paths under /files/; a directory, ending with a slash, is purged with everything below it.
+	Paths []string `json:"paths"`
+	// Keys are surrogate keys, as sent in Surrogate-Key.
+	Keys []string `json:"keys"`
+}
+
+type purgeResponse struct {
+	response
+	Keys []string `json:"keys"`
+}
+
+// handlePurge serves POST /admin/purge, and PURGE /files/(path) with the token: it purges the cached responses
+// of the given paths and keys right away, and reports failures with 502.
+func (s Server) handlePurge(w http.ResponseWriter, r *http.Request) {
+	var keys []string
+	switch {
+	case r.Method == "PURGE":
+		keys = purgeKeysOf(cleanFilesPath(r.URL.Path))
+	case r.Method == http.MethodPost && r.URL.Path == "/admin/purge":
+		var req purgeRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("invalid purge request: %v", err)))
+			return
+		}
+		for _, p := range req.Paths {
+			if !strings.HasPrefix(p, "/files/") {
+				respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("invalid path %q: must be under /files/", p)))
+				return
+			}
+			keys = append(keys, purgeKeysOf(cleanFilesPath(p))...)
+		}
+		for _, key := range req.Keys {
+			if key == "" || strings.ContainsAny(key, " ,\t\r\n") {
+				respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("invalid key %q", key)))
+				return
+			}
+			keys = append(keys, key)
+		}
+	default:
+		w.Header().Set("Allow", "POST")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	if len(keys) == 0 {
+		respondError(w, withStatus(http.StatusBadRequest, errors.New("nothing to purge")))
+		return
+	}
+	entry := auditLog().WithFields(logrus.Fields{"keys": keys, "remote": clientIP(r)})
+	if err := s.Purger.purge(r.Context(), keys); err != nil {
+		entry.WithError(err).Warn("failed to purge cached responses")
+		respondError(w, withStatus(http.StatusBadGateway, err))
+		return
+	}
+	entry.Info("cached responses purged")
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, purgeResponse{response: response{OK: true}, Keys: keys})
+}
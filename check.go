@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// maxCheckFiles limits the number of files in a single check request.
+const maxCheckFiles = 10000
+
+type checkRequest struct {
+	Files []checkFile `json:"files"`
+}
+
+// checkFile is a file a client intends to upload.
+type checkFile struct {
+	Name string `json:"name"`
+	Size *int64 `json:"size,omitempty"`
+	// Digest is the digest of the content as "algorithm:hex"; if empty, files are compared by size only.
+	Digest string `json:"digest,omitempty"`
+	// SHA256 is the hex SHA-256 digest of the content, accepted from older clients.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+type checkResult struct {
+	Name   string `json:"name"`
+	Path   string `json:"path"`
+	Exists bool   `json:"exists"`
+}
+
+type checkResponse struct {
+	response
+	Files []checkResult `json:"files"`
+}
+
+// handleUploadCheck serves POST /upload/check, which reports which of the given files are already stored
+// with the same content, so that sync clients can skip uploading them.
+func (s Server) handleUploadCheck(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	if err := s.checkToken(r); s.isAuthenticationRequired(r) && err != nil {
+		respondError(w, err)
+		return
+	}
+	var req checkRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<20)).Decode(&req); err != nil {
+		respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("invalid request: %v", err)))
+		return
+	}
+	if len(req.Files) > maxCheckFiles {
+		respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("too many files (at most %d)", maxCheckFiles)))
+		return
+	}
+	results := make([]checkResult, 0, len(req.Files))
+	for _, f := range req.Files {
+		rel := path.Clean("/" + toSlash(f.Name))
+		result := checkResult{Name: f.Name, Path: "/files" + rel}
+		result.Exists = s.isStored(rel, f)
+		results = append(results, result)
+	}
+	if s.EnableCORS {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, checkResponse{response: response{OK: true}, Files: results})
+}
+
+// isStored reports whether rel is stored with the size and the digest of f.
+func (s Server) isStored(rel string, f checkFile) bool {
+	if rel == "/" || isInternalName(strings.SplitN(rel[1:], "/", 2)[0]) {
+		return false
+	}
+	file := path.Join(s.DocumentRoot, rel)
+	info, err := os.Stat(file)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	if f.Size != nil && *f.Size != info.Size() {
+		return false
+	}
+	digest := f.Digest
+	if digest == "" && f.SHA256 != "" {
+		digest = digestSHA256 + ":" + f.SHA256
+	}
+	if digest == "" {
+		return true
+	}
+	ok, err := s.Digests.matches(file, info, digest)
+	if err != nil {
+		logger.WithError(err).WithField("path", rel).Warn("failed to compare the digest")
+		return false
+	}
+	return ok
+}
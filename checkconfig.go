@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// minTokenLength is the length under which a token is considered guessable: the generated ones have 20 hex digits.
+const minTokenLength = 16
+
+// secretFlags are the options whose values are never printed.
+var secretFlags = map[string]bool{
+	"token":              true,
+	"admin_token":        true,
+	"smtp_password":      true,
+	"signing_key":        true,
+	"vault_token":        true,
+	"jwt_secret":         true,
+	"captcha_secret":     true,
+	"moderation_token":   true,
+	"sandbox_token":      true,
+	"authz_token":        true,
+	"ldap_bind_password": true,
+}
+
+// configCheck collects the problems found in the configuration. Warnings do not fail the check.
+type configCheck struct {
+	problems []string
+	warnings []string
+}
+
+func (c *configCheck) problem(format string, args ...interface{}) {
+	c.problems = append(c.problems, fmt.Sprintf(format, args...))
+}
+
+func (c *configCheck) warn(format string, args ...interface{}) {
+	c.warnings = append(c.warnings, fmt.Sprintf(format, args...))
+}
+
+// flagValue returns the value of the option name as given, or its default.
+func flagValue(name string) string {
+	return flag.Lookup(name).Value.String()
+}
+
+// maskedValue returns the value of an option to be printed: secrets are masked, and so are credentials in URLs.
+func maskedValue(name string, value string) string {
+	if value == "" {
+		return value
+	}
+	if secretFlags[name] {
+		return "********"
+	}
+	// the values of repeatable options are joined by commas.
+	parts := strings.Split(value, ",")
+	for i, part := range parts {
+		parts[i] = maskedURL(part)
+	}
+	return strings.Join(parts, ",")
+}
+
+// maskedURL returns value with the credentials masked if it is a URL: the password, or the user name if there is
+// none, since services like fastly://token@service take the token as user name, and the token parameter.
+func maskedURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return value
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), "********")
+	} else if u.User != nil {
+		u.User = url.User("********")
+	}
+	if q := u.Query(); q.Get("token") != "" {
+		q.Set("token", "********")
+		u.RawQuery = q.Encode()
+	}
+	// the masks are escaped as any other asterisk would be.
+	return strings.Replace(u.String(), strings.Repeat("%2A", 8), "********", -1)
+}
+
+// checkDir adds a problem unless dir is a directory the server can create files in.
+func (c *configCheck) checkDir(option string, dir string) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		c.problem("%s: %v", option, err)
+		return
+	}
+	if !info.IsDir() {
+		c.problem("%s: %s is not a directory", option, dir)
+		return
+	}
+	f, err := ioutil.TempFile(dir, ".check_")
+	if err != nil {
+		c.problem("%s: %s is not writable: %v", option, dir, err)
+		return
+	}
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// checkTLS adds a problem unless the certificate and key, from files or secret stores, load as a pair,
+// and warns if the certificate expires soon.
+func (c *configCheck) checkTLS(secrets *secretStore, certFile string, keyFile string) {
+	pair, err := secrets.loadCertificate(certFile, keyFile)
+	if err != nil {
+		c.problem("%v", err)
+		return
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		c.problem("-cert: %v", err)
+		return
+	}
+	switch {
+	case time.Now().After(cert.NotAfter):
+		c.problem("-cert: the certificate expired on %s", cert.NotAfter.Format(time.RFC3339))
+	case time.Now().Before(cert.NotBefore):
+		c.problem("-cert: the certificate is not valid until %s", cert.NotBefore.Format(time.RFC3339))
+	case time.Until(cert.NotAfter) < 14*24*time.Hour:
+		c.warn("-cert: the certificate expires on %s", cert.NotAfter.Format(time.RFC3339))
+	}
+}
+
+// checkConfig serves the check-config subcommand, once the options have been parsed and validated the same way
+// as on startup: it checks what can only be checked against the environment, like the directories and TLS files,
+// and the options which make no sense together, then prints the effective configuration and the problems found.
+// It returns the exit status: 0 if the configuration is fine, or 1.
+func checkConfig(out io.Writer, s Server, secrets *secretStore) int {
+	c := &configCheck{}
+
+	c.checkDir("document root", s.DocumentRoot)
+	for _, option := range []string{"spool_dir", "state_dir", "cold_dir"} {
+		// cold storage may be a bucket, which is checked by using it.
+		if dir := flagValue(option); dir != "" && !strings.HasPrefix(dir, "s3://") {
+			c.checkDir("-"+option, dir)
+		}
+	}
+
+	if token := flagValue("token"); token == "" {
+		c.warn("-token: not given, so a new token is generated on each start")
+	} else if len(token) < minTokenLength {
+		c.problem("-token: shorter than %d characters, which is easy to guess", minTokenLength)
+	}
+	if token := flagValue("admin_token"); token != "" && len(token) < minTokenLength {
+		c.problem("-admin_token: shorter than %d characters, which is easy to guess", minTokenLength)
+	}
+	if flagValue("admin_port") != "0" && flagValue("admin_token") == "" {
+		c.warn("-admin_port: the admin endpoints are served without a token to whoever can connect to %s", flagValue("admin_ip"))
+	}
+
+	certFile, keyFile := flagValue("cert"), flagValue("key")
+	acme := flagValue("acme_domains") != ""
+	switch {
+	case (certFile == "") != (keyFile == ""):
+		c.problem("-cert and -key must be given together")
+	case certFile != "" && acme:
+		c.problem("-cert/-key and -acme_domains cannot be used together")
+	case certFile != "":
+		c.checkTLS(secrets, certFile, keyFile)
+	}
+	if flagValue("redirect_port") != "0" && certFile == "" && !acme {
+		c.problem("-redirect_port requires TLS (-cert and -key, or -acme_domains)")
+	}
+	ports := map[string]string{}
+	for _, option := range []string{"port", "tlsport", "admin_port", "redirect_port", "acme_http_port", "torrent_port"} {
+		port := flagValue(option)
+		switch {
+		case port == "0",
+			(option == "tlsport" || option == "redirect_port") && certFile == "" && !acme,
+			option == "acme_http_port" && !acme,
+			option == "torrent_port" && flagValue("torrent_announce") == "":
+			continue
+		}
+		if other, ok := ports[port]; ok {
+			c.problem("-%s and -%s use the same port %s", other, option, port)
+		}
+		ports[port] = option
+	}
+	if flagValue("backup_schedule") == "" && flagValue("backup_target") != "" && !s.Tasks.has(taskBackup) {
+		c.warn("-backup_target: ignored without -backup_schedule or a backup task")
+	}
+	if flagValue("prune_empty_dirs") == "false" && (flagValue("prune_keep_depth") != "0" || flagValue("prune_protect") != "") {
+		c.warn("-prune_keep_depth and -prune_protect are ignored without -prune_empty_dirs")
+	}
+	if flagValue("rbac") == "false" && (flagValue("jwt_secret") != "" || flagValue("jwt_public_key") != "" || flagValue("client_ca") != "" || flagValue("ldap_url") != "" || flagValue("saml_idp_metadata") != "") {
+		c.warn("-jwt_secret, -jwt_public_key, -client_ca, -ldap_url and -saml_idp_metadata are ignored without -rbac")
+	}
+	if strings.HasPrefix(flagValue("saml_url"), "http://") {
+		c.warn("-saml_url: the session cookie of the web UI is sent without TLS")
+	}
+	if flagValue("ldap_url") != "" && flagValue("ldap_base_dn") == "" {
+		c.warn("-ldap_base_dn: users are searched for in the whole directory, which Active Directory refuses")
+	}
+	if flagValue("public_read") == "true" && flagValue("rbac") == "true" {
+		c.warn("-public_read: ignored with -rbac, which authorizes reads by the roles of the anonymous user")
+	} else if flagValue("public_read") == "true" && flagValue("protected_method") != flag.Lookup("protected_method").DefValue {
+		c.warn("-protected_method: ignored with -public_read")
+	}
+	if flagValue("homes") == "false" && flagValue("home_quota") != "0" {
+		c.warn("-home_quota: ignored without -homes")
+	}
+	if s.Captcha != nil && s.RBAC == nil && s.isAuthenticationRequired(&http.Request{Method: http.MethodPost}) && s.isAuthenticationRequired(&http.Request{Method: http.MethodPut}) {
+		c.warn("-captcha: ignored while -protected_method requires the token for POST and PUT")
+	}
+	if flagValue("client_ca") != "" && certFile == "" && !acme {
+		c.warn("-client_ca: ignored without TLS")
+	}
+	if flagValue("torrent_announce") != "" && flagValue("state_dir") == "" {
+		c.warn("-torrent_announce: without -state_dir, the seeded files are forgotten on restart")
+	}
+
+	given := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	fmt.Fprintf(out, "# effective configuration\n")
+	flag.VisitAll(func(f *flag.Flag) {
+		if f.Name == "ingest_move" {
+			return
+		}
+		source := ""
+		if from, ok := configSources[f.Name]; ok {
+			source = " (" + from + ")"
+		} else if !given[f.Name] {
+			source = " (default)"
+		}
+		fmt.Fprintf(out, "-%s=%s%s\n", f.Name, maskedValue(f.Name, f.Value.String()), source)
+	})
+	fmt.Fprintf(out, "document root: %s\n", s.DocumentRoot)
+	for _, w := range c.warnings {
+		fmt.Fprintf(out, "warning: %s\n", w)
+	}
+	for _, p := range c.problems {
+		fmt.Fprintf(out, "error: %s\n", p)
+	}
+	if len(c.problems) > 0 {
+		fmt.Fprintf(out, "%d problem(s) found\n", len(c.problems))
+		return 1
+	}
+	fmt.Fprintf(out, "configuration OK\n")
+	return 0
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif" // registers the GIF decoder
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	errNotImage          = errors.New("not an image in a supported format")
+	errUnsupportedFormat = errors.New("unsupported image format")
+)
+
+const (
+	defaultConvertFormat  = "webp"
+	defaultConvertQuality = 80
+	// convertCacheLow is the share of the max size of the cache it is evicted down to.
+	convertCacheLow = 0.9
+	// convertTempPrefix names the directories images are converted in, which the cache leaves out.
+	convertTempPrefix = ".convert_"
+	// maxEncoderOutput bounds the output of image encoders kept for the logs.
+	maxEncoderOutput = 1024
+)
+
+// imageEncoder is a command converting a PNG image into another format, given as arguments with the placeholders
+// {in} and {out} for the files, and {quality} for the quality from 1 to 100, e.g. "avifenc -q {quality} {in} {out}".
+type imageEncoder []string
+
+// builtinEncoders encode images without commands. WebP images are lossless, whatever the quality.
+var builtinEncoders = map[string]func(w io.Writer, img image.Image, quality int) error{
+	"png": func(w io.Writer, img image.Image, quality int) error {
+		return png.Encode(w, img)
+	},
+	"jpeg": func(w io.Writer, img image.Image, quality int) error {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	},
+	"webp": func(w io.Writer, img image.Image, quality int) error {
+		return encodeWebP(w, img)
+	},
+}
+
+// imageConverter converts PNG, JPEG and GIF images into other formats on demand.
+type imageConverter struct {
+	// Encoders are the commands encoding the formats not built in, or replacing the built-in encoders, by format.
+	Encoders map[string]imageEncoder
+	// MaxPixels bounds the size of the images converted, against decompression bombs.
+	MaxPixels int64
+	// cache keeps the converted images; it is nil if they are converted again for each request.
+	cache *convertCache
+	// limit bounds the conversions running at once.
+	limit chan struct{}
+}
+
+func newImageConverter(maxPixels int64) *imageConverter {
+	return &imageConverter{
+		Encoders:  map[string]imageEncoder{},
+		MaxPixels: maxPixels,
+		limit:     make(chan struct{}, runtime.NumCPU()),
+	}
+}
+
+// parseImageEncoder parses an encoder given as "format=command".
+func parseImageEncoder(def string) (string, imageEncoder, error) {
+	i := strings.Index(def, "=")
+	if i <= 0 {
+		return "", nil, fmt.Errorf("image encoder %q must be given as format=command", def)
+	}
+	format := strings.ToLower(strings.TrimPrefix(def[:i], "."))
+	args := strings.Fields(def[i+1:])
+	if len(args) == 0 || !strings.Contains(def[i+1:], "{in}") || !strings.Contains(def[i+1:], "{out}") {
+		return "", nil, fmt.Errorf("command of image encoder %q must have the {in} and {out} placeholders", def)
+	}
+	return format, imageEncoder(args), nil
+}
+
+// supports tells whether images can be converted into format.
+func (c *imageConverter) supports(format string) bool {
+	_, builtin := builtinEncoders[format]
+	_, ok := c.Encoders[format]
+	return builtin || ok
+}
+
+// formats lists the formats images can be converted into.
+func (c *imageConverter) formats() []string {
+	var formats []string
+	for f := range builtinEncoders {
+		formats = append(formats, f)
+	}
+	for f := range c.Encoders {
+		if _, ok := builtinEncoders[f]; !ok {
+			formats = append(formats, f)
+		}
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// convert converts the image in file src into format, writing it to dst, a file with the extension of the format.
+func (c *imageConverter) convert(ctx context.Context, src string, format string, quality int, dst string) (err error) {
+	select {
+	case c.limit <- struct{}{}:
+		defer func() { <-c.limit }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	started := time.Now()
+	defer func() {
+		if err != nil {
+			return
+		}
+		logger.WithFields(logrus.Fields{"file": src, "format": format, "quality": quality, "elapsed": time.Since(started).String()}).Debug("image converted")
+	}()
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	config, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return withStatus(http.StatusUnsupportedMediaType, errNotImage)
+	}
+	if pixels := int64(config.Width) * int64(config.Height); c.MaxPixels > 0 && pixels > c.MaxPixels {
+		return withStatus(http.StatusUnprocessableEntity, fmt.Errorf("%w: %dx%d pixels exceed %d", errImageTooLarge, config.Width, config.Height, c.MaxPixels))
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return withStatus(http.StatusUnsupportedMediaType, fmt.Errorf("%w: %v", errNotImage, err))
+	}
+	if args, ok := c.Encoders[format]; ok {
+		return args.encode(ctx, img, quality, dst)
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := builtinEncoders[format](out, img, quality); err != nil {
+		out.Close()
+		if errors.Is(err, errImageTooLarge) {
+			err = withStatus(http.StatusUnprocessableEntity, err)
+		}
+		return err
+	}
+	return out.Close()
+}
+
+// encode runs the command of e on img, written as PNG next to dst, to write dst.
+func (e imageEncoder) encode(ctx context.Context, img image.Image, quality int, dst string) error {
+	in := strings.TrimSuffix(dst, filepath.Ext(dst)) + "_in.png"
+	f, err := os.Create(in)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(in)
+	err = png.Encode(f, img)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	args := make([]string, len(e))
+	r := strings.NewReplacer("{in}", in, "{out}", dst, "{quality}", strconv.Itoa(quality))
+	for i, a := range e {
+		args[i] = r.Replace(a)
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		out = bytes.TrimSpace(out)
+		if len(out) > maxEncoderOutput {
+			out = append(out[:maxEncoderOutput:maxEncoderOutput], "..."...)
+		}
+		return fmt.Errorf("image encoder %s failed: %v: %s", args[0], err, out)
+	}
+	if _, err := os.Stat(dst); err != nil {
+		return fmt.Errorf("image encoder %s wrote no image: %v", args[0], err)
+	}
+	return nil
+}
+
+// convertCache keeps converted images on disk, evicting the least recently used ones beyond its max size.
+type convertCache struct {
+	dir     string
+	MaxSize int64
+
+	mu   sync.Mutex
+	size int64
+}
+
+func newConvertCache(dir string, maxSize int64) (*convertCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	c := &convertCache{dir: dir, MaxSize: maxSize}
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && strings.HasPrefix(info.Name(), convertTempPrefix) {
+			// left over by conversions interrupted when the server stopped.
+			os.RemoveAll(p)
+			return filepath.SkipDir
+		}
+		if info.Mode().IsRegular() {
+			c.size += info.Size()
+		}
+		return nil
+	})
+	return c, err
+}
+
+// file returns the file of the image cached under key, in format.
+func (c *convertCache) file(key string, format string) string {
+	return filepath.Join(c.dir, key[:2], key+"."+format)
+}
+
+// get returns the file of the image cached under key, if any, marking it as used.
+func (c *convertCache) get(key string, format string) (string, bool) {
+	file := c.file(key, format)
+	if _, err := os.Stat(file); err != nil {
+		return "", false
+	}
+	now := time.Now()
+	os.Chtimes(file, now, now)
+	return file, true
+}
+
+// put moves the converted image in tmp into the cache under key, and returns its file.
+func (c *convertCache) put(tmp string, key string, format string) (string, error) {
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return "", err
+	}
+	file := c.file(key, format)
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return "", err
+	}
+	if err := renameFile(tmp, file); err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size += info.Size()
+	if c.size > c.MaxSize {
+		c.evict(file)
+	}
+	return file, nil
+}
+
+// evict removes the least recently used images, but keep, until the cache is down to its low watermark.
+// It must be called with mu held.
+func (c *convertCache) evict(keep string) {
+	type entry struct {
+		file string
+		size int64
+		used time.Time
+	}
+	var entries []entry
+	var size int64
+	filepath.Walk(c.dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() && strings.HasPrefix(info.Name(), convertTempPrefix) {
+			return filepath.SkipDir
+		}
+		if err == nil && info.Mode().IsRegular() {
+			entries = append(entries, entry{p, info.Size(), info.ModTime()})
+			size += info.Size()
+		}
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].used.Before(entries[j].used) })
+	low := int64(float64(c.MaxSize) * convertCacheLow)
+	evicted := 0
+	for _, e := range entries {
+		if size <= low {
+			break
+		}
+		if e.file == keep {
+			continue
+		}
+		if err := os.Remove(e.file); err != nil {
+			logger.WithError(err).WithField("file", e.file).Warn("failed to evict a converted image")
+			continue
+		}
+		size -= e.size
+		evicted++
+	}
+	c.size = size
+	logger.WithFields(logrus.Fields{"evicted": evicted, "size": size}).Info("evicted converted images from the cache")
+}
+
+// tempDir returns the directory to convert images in, next to the cache so that they are moved into it.
+func (c *imageConverter) tempDir() string {
+	if c.cache != nil {
+		return c.cache.dir
+	}
+	return os.TempDir()
+}
+
+// convertKey identifies the conversion of the file rel, at its current size and modification time.
+func convertKey(rel string, info os.FileInfo, format string, quality int) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%d\x00%s\x00%d", rel, info.Size(), info.ModTime().UnixNano(), format, quality)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// handleConvert serves GET /convert/(filename)?format=webp&quality=80, the image converted into the format,
+// to whoever may download it.
+func (s Server) handleConvert(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET,HEAD")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	rel := path.Clean("/" + toSlash(strings.TrimPrefix(r.URL.Path, "/convert/")))
+	if err := s.checkDownload(r, rel); err != nil {
+		respondError(w, err)
+		return
+	}
+	if s.EnableCORS {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+	if isInternalName(strings.SplitN(strings.TrimPrefix(rel, "/"), "/", 2)[0]) {
+		respondError(w, fmt.Errorf("\"%s\" is %w", r.URL.Path, errNotFound))
+		return
+	}
+	if s.Tiering != nil && s.serveCold(w, r, rel) {
+		return
+	}
+	if err := s.checkQuarantine(rel); err != nil {
+		respondError(w, err)
+		return
+	}
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	switch format {
+	case "":
+		format = defaultConvertFormat
+	case "jpg":
+		format = "jpeg"
+	}
+	if !s.Converter.supports(format) {
+		respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("%w %q (supported: %s)", errUnsupportedFormat, format, strings.Join(s.Converter.formats(), ", "))))
+		return
+	}
+	quality := defaultConvertQuality
+	if q := r.URL.Query().Get("quality"); q != "" {
+		var err error
+		if quality, err = strconv.Atoi(q); err != nil || quality < 1 || quality > 100 {
+			respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("quality %q must be from 1 to 100", q)))
+			return
+		}
+	}
+	src := filepath.Join(s.DocumentRoot, filepath.FromSlash(rel))
+	s.publishLock.RLock()
+	info, err := os.Stat(src)
+	s.publishLock.RUnlock()
+	if err != nil || !info.Mode().IsRegular() {
+		respondError(w, fmt.Errorf("\"/files%s\" is %w", rel, errNotFound))
+		return
+	}
+
+	key := convertKey(rel, info, format, quality)
+	file, cached := "", false
+	if s.Converter.cache != nil {
+		file, cached = s.Converter.cache.get(key, format)
+	}
+	if !cached {
+		tmpDir, err := ioutil.TempDir(s.Converter.tempDir(), convertTempPrefix)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		defer os.RemoveAll(tmpDir)
+		file = filepath.Join(tmpDir, "image."+format)
+		err = s.Converter.convert(r.Context(), src, format, quality, file)
+		if err == nil && s.Converter.cache != nil {
+			file, err = s.Converter.cache.put(file, key, format)
+		}
+		if err != nil {
+			logFailure(logger.WithFields(logrus.Fields{"path": "/files" + rel, "format": format}), err, "failed to convert the image")
+			respondError(w, err)
+			return
+		}
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	defer f.Close()
+	contentType := mime.TypeByExtension("." + format)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+key[:32]+`"`)
+	if cached {
+		w.Header().Set("X-Cache", "HIT")
+	} else {
+		w.Header().Set("X-Cache", "MISS")
+	}
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, tc := range []struct {
+		expr   string
+		minute []int
+		hour   []int
+		dom    []int
+		month  []int
+		dow    []int
+	}{
+		{"* * * * *", cronRange(0, 59, 1), cronRange(0, 23, 1), cronRange(1, 31, 1), cronRange(1, 12, 1), cronRange(0, 7, 1)},
+		{"30 2 * * *", []int{30}, []int{2}, cronRange(1, 31, 1), cronRange(1, 12, 1), cronRange(0, 7, 1)},
+		{"*/15 9-17 1,15 */3 1-5", []int{0, 15, 30, 45}, cronRange(9, 17, 1), []int{1, 15}, []int{1, 4, 7, 10}, cronRange(1, 5, 1)},
+		{"5/20 0-23/6 10-20/5 2-3,11 0", []int{5, 25, 45}, []int{0, 6, 12, 18}, []int{10, 15, 20}, []int{2, 3, 11}, []int{0}},
+		{"59 23 31 12 6", []int{59}, []int{23}, []int{31}, []int{12}, []int{6}},
+		// 7 is Sunday too.
+		{"0 0 * * 7", []int{0}, []int{0}, cronRange(1, 31, 1), cronRange(1, 12, 1), []int{0, 7}},
+		{"0 0 * * 5-7", []int{0}, []int{0}, cronRange(1, 31, 1), cronRange(1, 12, 1), []int{0, 5, 6, 7}},
+		{"  0\t0  *  * *  ", []int{0}, []int{0}, cronRange(1, 31, 1), cronRange(1, 12, 1), cronRange(0, 7, 1)},
+	} {
+		c, err := parseCron(tc.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tc.expr, err)
+			continue
+		}
+		for _, f := range []struct {
+			name string
+			got  uint64
+			want []int
+		}{
+			{"minute", c.minute, tc.minute},
+			{"hour", c.hour, tc.hour},
+			{"day of month", c.dom, tc.dom},
+			{"month", c.month, tc.month},
+			{"day of week", c.dow, tc.dow},
+		} {
+			if want := bitSet(f.want); f.got != want {
+				t.Errorf("%q: %s %b, want %b", tc.expr, f.name, f.got, want)
+			}
+		}
+		if c.String() != tc.expr {
+			t.Errorf("%q: String() is %q", tc.expr, c.String())
+		}
+	}
+}
+
+func cronRange(lo, hi, step int) []int {
+	var values []int
+	for v := lo; v <= hi; v += step {
+		values = append(values, v)
+	}
+	return values
+}
+
+func bitSet(values []int) uint64 {
+	var set uint64
+	for _, v := range values {
+		set |= 1 << uint(v)
+	}
+	return set
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, tc := range []struct {
+		expr string
+		err  string
+	}{
+		{"", "must have 5 fields"},
+		{"* * * *", "must have 5 fields"},
+		{"* * * * * *", "must have 5 fields"},
+		{"@daily", "must have 5 fields"},
+		{"60 * * * *", "invalid minute"},
+		{"-1 * * * *", "invalid minute"},
+		{"* 24 * * *", "invalid hour"},
+		{"* * 0 * *", "invalid day of month"},
+		{"* * 32 * *", "invalid day of month"},
+		{"* * * 0 *", "invalid month"},
+		{"* * * 13 *", "invalid month"},
+		{"* * * * 8", "invalid day of week"},
+		{"* * * JAN *", "invalid month"},
+		{"* * * * MON", "invalid day of week"},
+		{"10-5 * * * *", "invalid minute"},
+		{"1-2-3 * * * *", "invalid minute"},
+		{"*/0 * * * *", "invalid minute"},
+		{"*/-5 * * * *", "invalid minute"},
+		{"*/x * * * *", "invalid minute"},
+		{"1,,2 * * * *", "invalid minute"},
+		{"1, * * * *", "invalid minute"},
+		{"? * * * *", "invalid minute"},
+	} {
+		_, err := parseCron(tc.expr)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%q: %v, want an error with %q", tc.expr, err, tc.err)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, time.UTC)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+	for _, tc := range []struct {
+		expr string
+		from string
+		// want are the next times, or "" if none.
+		want []string
+	}{
+		{"* * * * *", "2024-03-10 10:00", []string{"2024-03-10 10:01", "2024-03-10 10:02"}},
+		{"30 2 * * *", "2024-03-10 01:00", []string{"2024-03-10 02:30", "2024-03-11 02:30"}},
+		// the time given is not matched again, even at the start of its minute.
+		{"30 2 * * *", "2024-03-10 02:30", []string{"2024-03-11 02:30"}},
+		{"*/20 * * * *", "2024-03-10 23:45", []string{"2024-03-11 00:00", "2024-03-11 00:20"}},
+		{"0 9-17/4 * * *", "2024-03-10 12:00", []string{"2024-03-10 13:00", "2024-03-10 17:00", "2024-03-11 09:00"}},
+		// the end of the year and of months.
+		{"0 0 1 1 *", "2024-06-15 12:00", []string{"2025-01-01 00:00", "2026-01-01 00:00"}},
+		{"0 0 31 * *", "2024-01-31 00:00", []string{"2024-03-31 00:00", "2024-05-31 00:00"}},
+		// leap days.
+		{"0 12 29 2 *", "2024-03-01 00:00", []string{"2028-02-29 12:00"}},
+		{"0 0 30 2 *", "2024-01-01 00:00", []string{""}},
+		// 2024-03-10 is a Sunday.
+		{"0 8 * * 1-5", "2024-03-08 09:00", []string{"2024-03-11 08:00", "2024-03-12 08:00"}},
+		{"0 8 * * 0", "2024-03-10 07:00", []string{"2024-03-10 08:00", "2024-03-17 08:00"}},
+		{"0 8 * * 7", "2024-03-10 07:00", []string{"2024-03-10 08:00", "2024-03-17 08:00"}},
+		// a day matches if either its day of month or its day of week does, unless one of them is "*".
+		{"0 0 13 * 5", "2024-03-10 00:00", []string{"2024-03-13 00:00", "2024-03-15 00:00", "2024-03-22 00:00"}},
+		{"0 0 13 * *", "2024-03-10 00:00", []string{"2024-03-13 00:00", "2024-04-13 00:00"}},
+		{"0 0 * * 5", "2024-03-10 00:00", []string{"2024-03-15 00:00", "2024-03-22 00:00"}},
+		// as in cron, a field with a step from "*" counts as "*": the day must be a Friday among 1, 11, 21 and 31.
+		{"0 0 */10 * 5", "2024-03-10 00:00", []string{"2024-05-31 00:00", "2024-06-21 00:00"}},
+		// February 1 is a Sunday in 2026, then in 2032, which is too far to be found.
+		{"0 0 1 2 */7", "2024-03-10 00:00", []string{"2026-02-01 00:00", ""}},
+	} {
+		c, err := parseCron(tc.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		from := at(tc.from)
+		for _, want := range tc.want {
+			next := c.next(from)
+			got := ""
+			if !next.IsZero() {
+				got = next.Format("2006-01-02 15:04")
+			}
+			if got != want {
+				t.Errorf("%q after %s: %q, want %q", tc.expr, from.Format("2006-01-02 15:04"), got, want)
+				break
+			}
+			from = next
+		}
+	}
+}
+
+func TestCronNextLocation(t *testing.T) {
+	tokyo := time.FixedZone("JST", 9*60*60)
+	c, err := parseCron("0 9 * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 9:00 in Tokyo is midnight UTC.
+	next := c.next(time.Date(2024, 3, 10, 23, 30, 0, 0, time.UTC).In(tokyo))
+	if want := time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC); !next.Equal(want) || next.Location() != tokyo {
+		t.Errorf("%v, want %v in JST", next, want)
+	}
+}
+
+func TestCronNextDaylightSaving(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err)
+	}
+	// the clocks go from 2:00 EST to 3:00 EDT on 2024-03-10, and from 2:00 EDT back to 1:00 EST on 2024-11-03.
+	for _, tc := range []struct {
+		expr string
+		from time.Time
+		want []string
+	}{
+		{"30 2 * * *", time.Date(2024, 3, 9, 12, 0, 0, 0, ny), []string{"2024-03-10 03:30 EDT", "2024-03-11 02:30 EDT"}},
+		{"0 4 * * *", time.Date(2024, 3, 9, 12, 0, 0, 0, ny), []string{"2024-03-10 04:00 EDT", "2024-03-11 04:00 EDT"}},
+		{"*/30 * * * *", time.Date(2024, 3, 10, 1, 0, 0, 0, ny), []string{"2024-03-10 01:30 EST", "2024-03-10 03:00 EDT", "2024-03-10 03:30 EDT"}},
+		{"30 1 * * *", time.Date(2024, 11, 2, 12, 0, 0, 0, ny), []string{"2024-11-03 01:30 EDT", "2024-11-04 01:30 EST"}},
+		{"*/30 * * * *", time.Date(2024, 11, 3, 0, 45, 0, 0, ny), []string{"2024-11-03 01:00 EDT", "2024-11-03 01:30 EDT", "2024-11-03 02:00 EST"}},
+		// during the repeated hour, the times already past are not matched again.
+		{"*/30 * * * *", time.Date(2024, 11, 3, 6, 10, 0, 0, time.UTC).In(ny), []string{"2024-11-03 02:00 EST"}},
+	} {
+		c, err := parseCron(tc.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		from := tc.from
+		for _, want := range tc.want {
+			next := c.next(from)
+			if got := next.Format("2006-01-02 15:04 MST"); got != want {
+				t.Errorf("%q after %s: %s, want %s", tc.expr, from.Format("2006-01-02 15:04 MST"), got, want)
+				break
+			}
+			from = next
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+)
+
+const (
+	// sessionCookie carries the session of a user signed in to the web UI.
+	sessionCookie = "sus_session"
+	// csrfCookie carries the CSRF token, which the UI sends back in csrfHeader or the csrf_token form field.
+	csrfCookie = "sus_csrf"
+	csrfHeader = "X-CSRF-Token"
+)
+
+var errCSRF = errors.New("missing or invalid CSRF token")
+
+type csrfResponse struct {
+	response
+	Token string `json:"csrf_token"`
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// csrfProtect protects requests authenticated by the session cookie with double-submit CSRF tokens:
+// a state-changing request must echo the value of csrfCookie, which other sites cannot read.
+// Requests carrying the token or an Authorization header are API calls, which a browser never sends on its own, so they are exempt.
+func csrfProtect(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the identity provider posts its signed responses to /saml/acs, each answering a request of the server
+		// started by the same browser, which samlLoginCookie ties it to.
+		if _, err := r.Cookie(sessionCookie); err != nil || r.URL.Path == "/saml/acs" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		cookie, err := r.Cookie(csrfCookie)
+		if isSafeMethod(r.Method) {
+			if err != nil || cookie.Value == "" {
+				issueCSRFToken(w, r)
+			}
+			h.ServeHTTP(w, r)
+			return
+		}
+		if r.URL.Query().Get("token") != "" || r.Header.Get("Authorization") != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		sent := r.Header.Get(csrfHeader)
+		if sent == "" && r.Method == http.MethodPost {
+			sent = r.FormValue("csrf_token")
+		}
+		if err != nil || cookie.Value == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(cookie.Value)) != 1 {
+			logger.WithField("path", r.URL.Path).Info("request rejected by CSRF protection")
+			respondError(w, withStatus(http.StatusForbidden, errCSRF))
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func issueCSRFToken(w http.ResponseWriter, r *http.Request) string {
+	token := newNonce()
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookie,
+		Value:    token,
+		Path:     "/",
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// handleCSRF serves GET /csrf, which returns the CSRF token of the session, issuing one if needed.
+func handleCSRF(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	token := ""
+	if cookie, err := r.Cookie(csrfCookie); err == nil && cookie.Value != "" {
+		token = cookie.Value
+	} else {
+		token = issueCSRFToken(w, r)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, csrfResponse{response: response{OK: true}, Token: token})
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the storage usage is sampled every usageSampleInterval, and kept for a day.
+	usageSampleInterval = 5 * time.Minute
+	usageSamples        = 288
+	// responses are counted by minute, for the last hour.
+	responseMinutes = 60
+	recentUploads   = 20
+	topDownloads    = 20
+	// maxTrackedDownloads bounds the number of files whose downloads are counted; further files are not counted.
+	maxTrackedDownloads = 10000
+)
+
+// dashboardStats collects the statistics shown on the dashboard. They are kept in memory, and start over on restart.
+// A nil *dashboardStats collects nothing.
+type dashboardStats struct {
+	dir string
+
+	mu sync.Mutex
+	// usage is oldest first.
+	usage     []usageSample
+	downloads map[string]int64
+	// recent is newest first.
+	recent []uploadEvent
+	// responses is oldest first.
+	responses []responseBucket
+	// moderated is newest first.
+	moderated []moderationEvent
+}
+
+type usageSample struct {
+	Time  time.Time
+	Total uint64
+	Used  uint64
+}
+
+type responseBucket struct {
+	Minute       time.Time
+	Total        int64
+	ClientErrors int64
+	ServerErrors int64
+}
+
+func newDashboardStats(dir string) *dashboardStats {
+	return &dashboardStats{dir: dir, downloads: map[string]int64{}}
+}
+
+// sampleUsage records the storage usage every interval. It never returns.
+func (d *dashboardStats) sampleUsage(interval time.Duration) {
+	for {
+		total, used, err := diskUsage(d.dir)
+		if err != nil {
+			logger.WithError(err).WithField("dir", d.dir).Warn("failed to get the storage usage")
+		} else {
+			d.mu.Lock()
+			d.usage = append(d.usage, usageSample{Time: time.Now(), Total: total, Used: used})
+			if len(d.usage) > usageSamples {
+				d.usage = d.usage[1:]
+			}
+			d.mu.Unlock()
+		}
+		time.Sleep(interval)
+	}
+}
+
+// countDownload counts a download of rel, a path relative to the document root.
+func (d *dashboardStats) countDownload(rel string) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if _, ok := d.downloads[rel]; ok || len(d.downloads) < maxTrackedDownloads {
+		d.downloads[rel]++
+	}
+}
+
+func (d *dashboardStats) addUpload(e uploadEvent) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.recent = append([]uploadEvent{e}, d.recent...)
+	if len(d.recent) > recentUploads {
+		d.recent = d.recent[:recentUploads]
+	}
+}
+
+func (d *dashboardStats) addModeration(e moderationEvent) {
+	if d == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.moderated = append([]moderationEvent{e}, d.moderated...)
+	if len(d.moderated) > recentModerations {
+		d.moderated = d.moderated[:recentModerations]
+	}
+}
+
+func (d *dashboardStats) countResponse(status int, now time.Time) {
+	minute := now.Truncate(time.Minute)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if n := len(d.responses); n == 0 || !d.responses[n-1].Minute.Equal(minute) {
+		d.responses = append(d.responses, responseBucket{Minute: minute})
+		if len(d.responses) > responseMinutes {
+			d.responses = d.responses[1:]
+		}
+	}
+	b := &d.responses[len(d.responses)-1]
+	b.Total++
+	switch {
+	case status >= 500:
+		b.ServerErrors++
+	case status >= 400:
+		b.ClientErrors++
+	}
+}
+
+// countResponses wraps h to count the responses by status for the dashboard.
+func countResponses(h http.Handler, d *dashboardStats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		d.countResponse(rec.status, time.Now())
+	})
+}
+
+// countGet counts the download served to r with the given status, if it was one: a complete GET of a file,
+// or the first range of one, so that a download resumed or fetched in parts counts once.
+func (s Server) countGet(r *http.Request, rel string, status int) {
+	if s.Stats == nil || r.Method != http.MethodGet {
+		return
+	}
+	if status != http.StatusOK && !(status == http.StatusPartialContent && strings.HasPrefix(r.Header.Get("Range"), "bytes=0-")) {
+		return
+	}
+	if info, err := os.Stat(filepath.Join(s.DocumentRoot, filepath.FromSlash(rel))); err != nil || !info.Mode().IsRegular() {
+		return
+	}
+	s.Stats.countDownload(rel)
+}
+
+type dashboardDownload struct {
+	Path  string
+	Count int64
+}
+
+// dashboardPage is rendered by dashboardTemplate.
+type dashboardPage struct {
+	Now        time.Time
+	Usage      *usageSample
+	UsedPct    float64
+	UsageChart string
+	Downloads  []dashboardDownload
+	Recent     []uploadEvent
+	Moderated  []moderationEvent
+	Requests   int64
+	ClientErrs int64
+	ServerErrs int64
+	ErrorChart string
+	ErrorRate  float64
+}
+
+// chartPoints returns the points of an SVG polyline plotting values over a 600x120 area, from 0 to max.
+func chartPoints(values []float64, max float64) string {
+	if max <= 0 {
+		max = 1
+	}
+	points := make([]string, len(values))
+	for i, v := range values {
+		x := 600.0
+		if len(values) > 1 {
+			x = float64(i) * 600 / float64(len(values)-1)
+		}
+		points[i] = fmt.Sprintf("%.1f,%.1f", x, 120-v*120/max)
+	}
+	return strings.Join(points, " ")
+}
+
+func (d *dashboardStats) page() dashboardPage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p := dashboardPage{Now: time.Now(), Recent: append([]uploadEvent(nil), d.recent...), Moderated: append([]moderationEvent(nil), d.moderated...)}
+
+	usage := make([]float64, len(d.usage))
+	for i, u := range d.usage {
+		if u.Total > 0 {
+			usage[i] = float64(u.Used) * 100 / float64(u.Total)
+		}
+	}
+	if n := len(d.usage); n > 0 {
+		last := d.usage[n-1]
+		p.Usage = &last
+		p.UsedPct = usage[n-1]
+	}
+	p.UsageChart = chartPoints(usage, 100)
+
+	for rel, count := range d.downloads {
+		p.Downloads = append(p.Downloads, dashboardDownload{Path: "/files" + rel, Count: count})
+	}
+	sort.Slice(p.Downloads, func(i, j int) bool {
+		if p.Downloads[i].Count != p.Downloads[j].Count {
+			return p.Downloads[i].Count > p.Downloads[j].Count
+		}
+		return p.Downloads[i].Path < p.Downloads[j].Path
+	})
+	if len(p.Downloads) > topDownloads {
+		p.Downloads = p.Downloads[:topDownloads]
+	}
+
+	// the error rate by minute, in percent of the responses.
+	rates := make([]float64, len(d.responses))
+	for i, b := range d.responses {
+		p.Requests += b.Total
+		p.ClientErrs += b.ClientErrors
+		p.ServerErrs += b.ServerErrors
+		if b.Total > 0 {
+			rates[i] = float64(b.ClientErrors+b.ServerErrors) * 100 / float64(b.Total)
+		}
+	}
+	if p.Requests > 0 {
+		p.ErrorRate = float64(p.ClientErrs+p.ServerErrs) * 100 / float64(p.Requests)
+	}
+	p.ErrorChart = chartPoints(rates, 100)
+	return p
+}
+
+// handleDashboard serves an HTML page summarizing the storage usage, downloads, uploads and errors,
+// for operators without a monitoring stack. It refreshes itself every minute.
+func (s Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET,HEAD")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	lang := negotiateLanguage(r)
+	tmpl, err := dashboardTemplate.Clone()
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	tmpl.Funcs(template.FuncMap{
+		"t": func(msg string, args ...interface{}) string {
+			if len(args) == 0 {
+				return translate(lang, msg)
+			}
+			return fmt.Sprintf(translate(lang, msg), args...)
+		},
+		"lang": func() string { return lang },
+	})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", lang)
+	w.Header().Set("Vary", "Accept-Language")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := tmpl.Execute(w, s.Stats.page()); err != nil {
+		logger.WithError(err).Warn("failed to write the dashboard")
+	}
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"bytes": func(n interface{}) string {
+		var v float64
+		switch n := n.(type) {
+		case uint64:
+			v = float64(n)
+		case int64:
+			v = float64(n)
+		}
+		if v < 1024 {
+			return fmt.Sprintf("%.0f B", v)
+		}
+		units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+		i := 0
+		for v >= 1024 && i < len(units)-1 {
+			v /= 1024
+			i++
+		}
+		return fmt.Sprintf("%.1f %s", v, units[i])
+	},
+	"time": func(t time.Time) string { return t.UTC().Format("2006-01-02 15:04:05 UTC") },
+	// t and lang are replaced for the language of each request.
+	"t":    func(msg string, args ...interface{}) string { return msg },
+	"lang": func() string { return defaultLanguage },
+}).Parse(`<!DOCTYPE html>
+<html lang="{{lang}}">
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="60">
+<title>simple-upload-server dashboard</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+section { margin-bottom: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 1em 0.2em 0; text-align: left; }
+td.n { text-align: right; }
+svg { background: #f6f6f6; border: 1px solid #ddd; }
+.muted { color: #888; }
+</style>
+</head>
+<body>
+<h1>simple-upload-server</h1>
+<p class="muted">{{t "%s. Statistics are kept in memory since the server started." (time .Now)}}</p>
+
+<section>
+<h2>{{t "Storage"}}</h2>
+{{if .Usage}}<p>{{t "%s of %s used (%.1f%%)" (bytes .Usage.Used) (bytes .Usage.Total) .UsedPct}}</p>
+<svg width="600" height="120" viewBox="0 0 600 120"><polyline fill="none" stroke="#36c" stroke-width="2" points="{{.UsageChart}}"/></svg>
+<p class="muted">{{t "Usage in percent over the last day, sampled every 5 minutes."}}</p>
+{{else}}<p class="muted">{{t "Not sampled yet."}}</p>{{end}}
+</section>
+
+<section>
+<h2>{{t "Errors"}}</h2>
+<p>{{t "%d requests in the last hour: %d client errors (4xx), %d server errors (5xx), %.1f%% in total." .Requests .ClientErrs .ServerErrs .ErrorRate}}</p>
+<svg width="600" height="120" viewBox="0 0 600 120"><polyline fill="none" stroke="#c33" stroke-width="2" points="{{.ErrorChart}}"/></svg>
+<p class="muted">{{t "Error rate in percent by minute."}}</p>
+</section>
+
+<section>
+<h2>{{t "Top downloads"}}</h2>
+{{if .Downloads}}<table>
+<tr><th>{{t "File"}}</th><th>{{t "Downloads"}}</th></tr>
+{{range .Downloads}}<tr><td>{{.Path}}</td><td class="n">{{.Count}}</td></tr>
+{{end}}</table>
+{{else}}<p class="muted">{{t "No downloads yet."}}</p>{{end}}
+</section>
+
+<section>
+<h2>{{t "Recent uploads"}}</h2>
+{{if .Recent}}<table>
+<tr><th>{{t "File"}}</th><th>{{t "Size"}}</th><th>{{t "Uploader"}}</th></tr>
+{{range .Recent}}<tr><td>{{.Path}}</td><td class="n">{{bytes .Size}}</td><td>{{.Uploader}}</td></tr>
+{{end}}</table>
+{{else}}<p class="muted">{{t "No uploads yet."}}</p>{{end}}
+</section>
+{{if .Moderated}}
+<section>
+<h2>{{t "Recent moderation"}}</h2>
+<table>
+<tr><th>{{t "File"}}</th><th>{{t "Action"}}</th><th>{{t "Category"}}</th><th>{{t "Score"}}</th><th>{{t "Time"}}</th></tr>
+{{range .Moderated}}<tr><td>{{.Path}}</td><td>{{t .Action}}</td><td>{{.Category}}</td><td class="n">{{if .Category}}{{printf "%.2f" (index .Scores .Category)}}{{end}}</td><td>{{time .At}}</td></tr>
+{{end}}</table>
+</section>
+{{end}}</body>
+</html>
+`))
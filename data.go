@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var errNotDataFile = errors.New("not a CSV or JSON file")
+
+const (
+	defaultDataRows = 100
+	maxDataRows     = 10000
+)
+
+// Kinds of data files.
+const (
+	dataCSV       = "csv"
+	dataTSV       = "tsv"
+	dataJSON      = "json"
+	dataJSONLines = "jsonl"
+)
+
+// dataKinds are the kinds of data files by extension.
+var dataKinds = map[string]string{
+	".csv":    dataCSV,
+	".tsv":    dataTSV,
+	".json":   dataJSON,
+	".jsonl":  dataJSONLines,
+	".ndjson": dataJSONLines,
+}
+
+// dataRow is a row of a data file: a JSON value, or the fields of a CSV record named by the columns, if any.
+type dataRow struct {
+	columns []string
+	fields  []string
+	value   json.RawMessage
+}
+
+// MarshalJSON writes the row as an object with the fields in the order of the columns, or as an array of fields
+// without columns.
+func (row dataRow) MarshalJSON() ([]byte, error) {
+	if row.value != nil {
+		return row.value, nil
+	}
+	if row.columns == nil {
+		return json.Marshal(row.fields)
+	}
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, f := range row.fields {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		name, _ := json.Marshal(dataColumn(row.columns, i))
+		value, _ := json.Marshal(f)
+		b.Write(name)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// dataColumn names column i, as column1, column2... beyond the header.
+func dataColumn(columns []string, i int) string {
+	if i < len(columns) {
+		return columns[i]
+	}
+	return "column" + strconv.Itoa(i+1)
+}
+
+// record returns the fields of the row as a CSV record under columns: the fields of a CSV record, or those of a
+// JSON object by name, with strings as they are, null as empty, and other values as JSON.
+func (row dataRow) record(columns []string) []string {
+	if row.value == nil {
+		return row.fields
+	}
+	var object map[string]json.RawMessage
+	if json.Unmarshal(row.value, &object) != nil {
+		var values []json.RawMessage
+		if json.Unmarshal(row.value, &values) != nil {
+			values = []json.RawMessage{row.value}
+		}
+		record := make([]string, len(values))
+		for i, v := range values {
+			record[i] = dataField(v)
+		}
+		return record
+	}
+	record := make([]string, len(columns))
+	for i, c := range columns {
+		if v, ok := object[c]; ok {
+			record[i] = dataField(v)
+		}
+	}
+	return record
+}
+
+func dataField(v json.RawMessage) string {
+	var s string
+	if json.Unmarshal(v, &s) == nil {
+		return s
+	}
+	if string(v) == "null" {
+		return ""
+	}
+	return string(v)
+}
+
+// objectKeys returns the keys of the JSON object v in their order, or nil if v is not an object.
+func objectKeys(v json.RawMessage) []string {
+	d := json.NewDecoder(bytes.NewReader(v))
+	if t, err := d.Token(); err != nil || t != json.Delim('{') {
+		return nil
+	}
+	keys := []string{}
+	for d.More() {
+		t, err := d.Token()
+		if err != nil {
+			return keys
+		}
+		keys = append(keys, t.(string))
+		var skipped json.RawMessage
+		if err := d.Decode(&skipped); err != nil {
+			return keys
+		}
+	}
+	return keys
+}
+
+// dataPage is a page of the rows of a data file.
+type dataPage struct {
+	// Columns are the names of the fields of the rows: the header of a CSV file, or the keys of JSON objects in
+	// the order they appear.
+	Columns []string  `json:"columns,omitempty"`
+	Rows    []dataRow `json:"rows"`
+	Offset  int       `json:"offset"`
+	Limit   int       `json:"limit"`
+	// NextOffset is the offset of the next page, if there are more rows.
+	NextOffset *int `json:"next_offset,omitempty"`
+}
+
+type dataResponse struct {
+	response
+	Path string `json:"path"`
+	dataPage
+}
+
+// readCSVPage reads limit rows after offset from a CSV file, whose first record is the header unless header is
+// false. Records are read one at a time, so that only the rows up to the page are parsed.
+func readCSVPage(r io.Reader, comma rune, header bool, offset int, limit int) (dataPage, error) {
+	br := bufio.NewReader(r)
+	// Excel saves CSV files with a byte order mark.
+	if bom, err := br.Peek(3); err == nil && string(bom) == "\xef\xbb\xbf" {
+		br.Discard(3)
+	}
+	cr := csv.NewReader(br)
+	cr.Comma = comma
+	cr.FieldsPerRecord = -1
+	page := dataPage{Rows: []dataRow{}, Offset: offset, Limit: limit}
+	if header {
+		columns, err := cr.Read()
+		if err == io.EOF {
+			return page, nil
+		} else if err != nil {
+			return page, err
+		}
+		page.Columns = columns
+	}
+	for i := 0; ; i++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return page, nil
+		} else if err != nil {
+			return page, err
+		}
+		if i < offset {
+			continue
+		}
+		if i == offset+limit {
+			next := i
+			page.NextOffset = &next
+			return page, nil
+		}
+		page.Rows = append(page.Rows, dataRow{columns: page.Columns, fields: record})
+	}
+}
+
+// readJSONPage reads limit rows after offset from a JSON file, whose rows are the elements of an array, or from a
+// file of JSON lines, whose rows are its values. The columns are the keys of the objects in the page.
+func readJSONPage(r io.Reader, lines bool, offset int, limit int) (dataPage, error) {
+	d := json.NewDecoder(bufio.NewReader(r))
+	if !lines {
+		if t, err := d.Token(); err != nil {
+			return dataPage{}, err
+		} else if t != json.Delim('[') {
+			return dataPage{}, errors.New("JSON file must be an array of rows")
+		}
+	}
+	page := dataPage{Rows: []dataRow{}, Offset: offset, Limit: limit}
+	seen := map[string]bool{}
+	for i := 0; d.More(); i++ {
+		var v json.RawMessage
+		if err := d.Decode(&v); err != nil {
+			return page, err
+		}
+		if i < offset {
+			continue
+		}
+		if i == offset+limit {
+			next := i
+			page.NextOffset = &next
+			return page, nil
+		}
+		page.Rows = append(page.Rows, dataRow{value: v})
+		for _, k := range objectKeys(v) {
+			if !seen[k] {
+				seen[k] = true
+				page.Columns = append(page.Columns, k)
+			}
+		}
+	}
+	if !lines {
+		if _, err := d.Token(); err != nil {
+			return page, err
+		}
+	}
+	return page, nil
+}
+
+// handleData serves GET /data/(filename)?format=json&offset=0&limit=100, a page of the rows of a CSV or JSON
+// file, as JSON or as CSV, to whoever may download the file.
+func (s Server) handleData(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET,HEAD")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	rel := path.Clean("/" + toSlash(strings.TrimPrefix(r.URL.Path, "/data/")))
+	if err := s.checkDownload(r, rel); err != nil {
+		respondError(w, err)
+		return
+	}
+	if s.EnableCORS {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+	if isInternalName(strings.SplitN(strings.TrimPrefix(rel, "/"), "/", 2)[0]) {
+		respondError(w, fmt.Errorf("\"%s\" is %w", r.URL.Path, errNotFound))
+		return
+	}
+	q := r.URL.Query()
+	format := strings.ToLower(q.Get("format"))
+	if format == "" {
+		format = dataJSON
+	}
+	if format != dataJSON && format != dataCSV {
+		respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("format %q must be json or csv", format)))
+		return
+	}
+	offset, limit := 0, defaultDataRows
+	if v := q.Get("offset"); v != "" {
+		var err error
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("offset %q must be a non-negative integer", v)))
+			return
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxDataRows {
+			respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("limit %q must be from 1 to %d", v, maxDataRows)))
+			return
+		}
+	}
+	if s.Tiering != nil && s.serveCold(w, r, rel) {
+		return
+	}
+	if err := s.checkQuarantine(rel); err != nil {
+		respondError(w, err)
+		return
+	}
+	file := filepath.Join(s.DocumentRoot, filepath.FromSlash(rel))
+	s.publishLock.RLock()
+	f, err := os.Open(file)
+	s.publishLock.RUnlock()
+	if err != nil {
+		respondError(w, fmt.Errorf("\"/files%s\" is %w", rel, errNotFound))
+		return
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		respondError(w, fmt.Errorf("\"/files%s\" is %w", rel, errNotFound))
+		return
+	}
+	kind, ok := dataKinds[strings.ToLower(path.Ext(rel))]
+	if !ok {
+		respondError(w, withStatus(http.StatusUnsupportedMediaType, fmt.Errorf("\"/files%s\" is %w", rel, errNotDataFile)))
+		return
+	}
+	var page dataPage
+	switch kind {
+	case dataCSV, dataTSV:
+		comma := ','
+		if kind == dataTSV {
+			comma = '\t'
+		}
+		page, err = readCSVPage(f, comma, q.Get("header") != "false", offset, limit)
+	default:
+		page, err = readJSONPage(f, kind == dataJSONLines, offset, limit)
+	}
+	if err != nil {
+		respondError(w, withStatus(http.StatusUnprocessableEntity, fmt.Errorf("failed to parse \"/files%s\": %v", rel, err)))
+		return
+	}
+
+	if page.NextOffset != nil {
+		w.Header().Set("X-Next-Offset", strconv.Itoa(*page.NextOffset))
+	}
+	if format == dataJSON {
+		w.WriteHeader(http.StatusOK)
+		writeJSON(w, dataResponse{response: response{OK: true}, Path: "/files" + rel, dataPage: page})
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	cw := csv.NewWriter(w)
+	if page.Columns != nil {
+		cw.Write(page.Columns)
+	}
+	for _, row := range page.Rows {
+		cw.Write(row.record(page.Columns))
+	}
+	cw.Flush()
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// maxControlSize bounds the control archive of a Debian package, and what it decompresses to.
+	maxControlSize = 16 << 20
+	// debReleaseDate is the format of the dates of Release files.
+	debReleaseDate = "Mon, 02 Jan 2006 15:04:05 UTC"
+)
+
+var errBadDeb = errors.New("invalid Debian package")
+
+// debField is a field of a control paragraph; Value keeps the continuation lines of multiline fields.
+type debField struct {
+	Name  string
+	Value string
+}
+
+// debControl is the control paragraph of a Debian package, its fields in order.
+type debControl struct {
+	Fields []debField
+}
+
+func (c *debControl) get(name string) string {
+	for _, f := range c.Fields {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// parseDebControl parses the first paragraph of a control file.
+func parseDebControl(b []byte) (*debControl, error) {
+	c := &debControl{}
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(make([]byte, 64<<10), maxControlSize)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		switch {
+		case strings.TrimSpace(line) == "":
+			if len(c.Fields) > 0 {
+				return c, nil
+			}
+		case strings.HasPrefix(line, "#"):
+		case line[0] == ' ' || line[0] == '\t':
+			if len(c.Fields) == 0 {
+				return nil, fmt.Errorf("%w: continuation line without field", errBadDeb)
+			}
+			c.Fields[len(c.Fields)-1].Value += "\n" + line
+		default:
+			i := strings.Index(line, ":")
+			if i <= 0 {
+				return nil, fmt.Errorf("%w: bad control line %q", errBadDeb, line)
+			}
+			c.Fields = append(c.Fields, debField{Name: line[:i], Value: strings.TrimSpace(line[i+1:])})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if c.get("Package") == "" {
+		return nil, fmt.Errorf("%w: no Package field", errBadDeb)
+	}
+	return c, nil
+}
+
+// readDebControl reads the control paragraph of the Debian package at name, an ar archive whose control
+// member is a tar archive compressed with gzip or xz, or not.
+func readDebControl(name string) (*debControl, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != "!<arch>\n" {
+		return nil, fmt.Errorf("%w: not an ar archive", errBadDeb)
+	}
+	header := make([]byte, 60)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return nil, fmt.Errorf("%w: no control archive", errBadDeb)
+		}
+		member := strings.TrimSuffix(strings.TrimSpace(string(header[:16])), "/")
+		size, err := strconv.ParseInt(strings.TrimSpace(string(header[48:58])), 10, 64)
+		if err != nil || size < 0 || string(header[58:60]) != "`\n" {
+			return nil, fmt.Errorf("%w: bad ar header", errBadDeb)
+		}
+		if !strings.HasPrefix(member, "control.tar") {
+			// members are aligned on two bytes.
+			if _, err := io.CopyN(ioutil.Discard, r, size+size%2); err != nil {
+				return nil, fmt.Errorf("%w: truncated", errBadDeb)
+			}
+			continue
+		}
+		if size > maxControlSize {
+			return nil, fmt.Errorf("%w: control archive too large", errBadDeb)
+		}
+		b := make([]byte, size)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, fmt.Errorf("%w: truncated", errBadDeb)
+		}
+		var tarball io.Reader
+		switch member {
+		case "control.tar":
+			tarball = bytes.NewReader(b)
+		case "control.tar.gz":
+			gz, err := gzip.NewReader(bytes.NewReader(b))
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", errBadDeb, err)
+			}
+			tarball = io.LimitReader(gz, maxControlSize)
+		case "control.tar.xz":
+			decoded, err := xzDecode(b, maxControlSize)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", errBadDeb, err)
+			}
+			tarball = bytes.NewReader(decoded)
+		default:
+			return nil, fmt.Errorf("%w: %s is not supported", errBadDeb, member)
+		}
+		return readControlFile(tarball)
+	}
+}
+
+// readControlFile returns the control paragraph of the control archive of a package.
+func readControlFile(tarball io.Reader) (*debControl, error) {
+	tr := tar.NewReader(tarball)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: no control file", errBadDeb)
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: %v", errBadDeb, err)
+		}
+		if path.Clean(h.Name) != "control" || h.Typeflag != tar.TypeReg {
+			continue
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errBadDeb, err)
+		}
+		return parseDebControl(b)
+	}
+}
+
+// debGeneratedFields are the fields of a Packages paragraph describing the package file rather than the package.
+var debGeneratedFields = map[string]bool{"filename": true, "size": true, "md5sum": true, "sha1": true, "sha256": true}
+
+// writeDebRepo writes the Packages and Release files of a flat repository at root, as dpkg-scanpackages
+// and apt-ftparchive would, for apt sources like "deb http://host/files/debian ./". Release is signed
+// as Release.gpg and InRelease if a signing key is configured.
+func (s Server) writeDebRepo(root string, debs []*repoPackage) error {
+	sort.Slice(debs, func(i, j int) bool {
+		pi, pj := debs[i].Deb.get("Package"), debs[j].Deb.get("Package")
+		if pi != pj {
+			return pi < pj
+		}
+		return debs[i].Path < debs[j].Path
+	})
+	var packages bytes.Buffer
+	architectures := map[string]bool{}
+	for _, pkg := range debs {
+		for _, f := range pkg.Deb.Fields {
+			if !debGeneratedFields[strings.ToLower(f.Name)] {
+				fmt.Fprintf(&packages, "%s: %s\n", f.Name, f.Value)
+			}
+		}
+		fmt.Fprintf(&packages, "Filename: ./%s\nSize: %d\nMD5sum: %s\nSHA1: %s\nSHA256: %s\n\n", pkg.Path, pkg.Size, pkg.MD5, pkg.SHA1, pkg.SHA256)
+		if arch := pkg.Deb.get("Architecture"); arch != "" && arch != "all" {
+			architectures[arch] = true
+		}
+	}
+	packagesGz, err := gzipped(packages.Bytes())
+	if err != nil {
+		return err
+	}
+	files := map[string][]byte{"Packages": packages.Bytes(), "Packages.gz": packagesGz}
+
+	var release bytes.Buffer
+	fmt.Fprintf(&release, "Date: %s\n", time.Now().UTC().Format(debReleaseDate))
+	if len(architectures) > 0 {
+		archs := make([]string, 0, len(architectures))
+		for arch := range architectures {
+			archs = append(archs, arch)
+		}
+		sort.Strings(archs)
+		fmt.Fprintf(&release, "Architectures: %s\n", strings.Join(archs, " "))
+	}
+	for _, sum := range []struct {
+		field string
+		hash  func([]byte) string
+	}{
+		{"MD5Sum", func(b []byte) string { h := md5.Sum(b); return hex.EncodeToString(h[:]) }},
+		{"SHA1", func(b []byte) string { h := sha1.Sum(b); return hex.EncodeToString(h[:]) }},
+		{"SHA256", func(b []byte) string { h := sha256.Sum256(b); return hex.EncodeToString(h[:]) }},
+	} {
+		fmt.Fprintf(&release, "%s:\n", sum.field)
+		for _, name := range []string{"Packages", "Packages.gz"} {
+			fmt.Fprintf(&release, " %s %d %s\n", sum.hash(files[name]), len(files[name]), name)
+		}
+	}
+	files["Release"] = release.Bytes()
+	names := []string{"Packages", "Packages.gz", "Release"}
+	if s.Repos.signer != nil {
+		if files["Release.gpg"], err = s.Repos.detachSign(release.Bytes()); err != nil {
+			return err
+		}
+		if files["InRelease"], err = s.Repos.clearSign(release.Bytes()); err != nil {
+			return err
+		}
+		names = append(names, "Release.gpg", "InRelease")
+	}
+	return writeRepoFiles(root, names, files)
+}
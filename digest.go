@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"lukechampine.com/blake3"
+)
+
+// digest algorithms
+const (
+	digestSHA256 = "sha256"
+	// digestBLAKE3 is much faster than SHA-256 on large files, but fewer clients support it.
+	digestBLAKE3 = "blake3"
+)
+
+// digestAlgorithms makes hashes by the name of the algorithm.
+var digestAlgorithms = map[string]func() hash.Hash{
+	digestSHA256: sha256.New,
+	// 256 bits, the same length as SHA-256
+	digestBLAKE3: func() hash.Hash { return blake3.New(32, nil) },
+}
+
+// parseDigest splits a digest given as "algorithm:hex", e.g. "sha256:9f86d0...", into its algorithm and its hex value.
+func parseDigest(label string) (string, string, error) {
+	i := strings.Index(label, ":")
+	if i <= 0 {
+		return "", "", fmt.Errorf("digest %q must be given as algorithm:hex", label)
+	}
+	algorithm, sum := strings.ToLower(label[:i]), strings.ToLower(label[i+1:])
+	if _, ok := digestAlgorithms[algorithm]; !ok {
+		return "", "", fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+	if _, err := hex.DecodeString(sum); err != nil || sum == "" {
+		return "", "", fmt.Errorf("invalid digest %q", label)
+	}
+	return algorithm, sum, nil
+}
+
+// digests caches the digests of stored files, since hashing large files is expensive.
+// An entry is valid as long as the size and the modification time of the file are unchanged.
+//
+// Files are hashed with a single algorithm, which is used for names, ETags, metadata and comparisons alike.
+type digests struct {
+	algorithm string
+	mu        sync.Mutex
+	byPath    map[string]digestEntry
+}
+
+type digestEntry struct {
+	size  int64
+	mtime time.Time
+	sum   string
+}
+
+// newDigests creates a cache of digests made with algorithm, which must be one of digestAlgorithms.
+func newDigests(algorithm string) *digests {
+	return &digests{algorithm: algorithm, byPath: map[string]digestEntry{}}
+}
+
+// hash returns a new hash of the algorithm.
+func (d *digests) hash() hash.Hash {
+	return digestAlgorithms[d.algorithm]()
+}
+
+// label qualifies a hex digest with the algorithm, as "algorithm:hex".
+func (d *digests) label(sum string) string {
+	return d.algorithm + ":" + sum
+}
+
+// of returns the hex digest of file, whose current info is given.
+func (d *digests) of(file string, info os.FileInfo) (string, error) {
+	return d.sum(file, file, info)
+}
+
+// sum returns the hex digest of file, caching it under key, which is another path of the same file, e.g. a link.
+func (d *digests) sum(key string, file string, info os.FileInfo) (string, error) {
+	d.mu.Lock()
+	e, ok := d.byPath[key]
+	d.mu.Unlock()
+	if ok && e.size == info.Size() && e.mtime.Equal(info.ModTime()) {
+		return e.sum, nil
+	}
+	sum, err := hashFile(file, d.hash())
+	if err != nil {
+		return "", err
+	}
+	d.mu.Lock()
+	d.byPath[key] = digestEntry{size: info.Size(), mtime: info.ModTime(), sum: sum}
+	d.mu.Unlock()
+	return sum, nil
+}
+
+// matches reports whether file, whose current info is given, has the digest given as "algorithm:hex".
+// Digests made with another algorithm than the configured one are computed each time.
+func (d *digests) matches(file string, info os.FileInfo, label string) (bool, error) {
+	algorithm, want, err := parseDigest(label)
+	if err != nil {
+		return false, err
+	}
+	var sum string
+	if algorithm == d.algorithm {
+		sum, err = d.of(file, info)
+	} else {
+		sum, err = hashFile(file, digestAlgorithms[algorithm]())
+	}
+	return sum == want, err
+}
+
+func hashFile(file string, h hash.Hash) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := copyBuffer(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// forget drops the digest of a deleted file.
+func (d *digests) forget(file string) {
+	d.mu.Lock()
+	delete(d.byPath, file)
+	d.mu.Unlock()
+}
+
+// remember records the digest of a file which has just been stored, so that it need not be hashed again.
+func (d *digests) remember(file string, sum string) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return
+	}
+	d.mu.Lock()
+	d.byPath[file] = digestEntry{size: info.Size(), mtime: info.ModTime(), sum: sum}
+	d.mu.Unlock()
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "syscall"
+
+// diskUsage returns the total and used bytes of the filesystem containing dir, as df(1) reports them.
+func diskUsage(dir string) (total uint64, used uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	used = (st.Blocks - st.Bfree) * uint64(st.Bsize)
+	// space reserved for root is not available to us, so it is not counted in total.
+	total = used + st.Bavail*uint64(st.Bsize)
+	return total, used, nil
+}
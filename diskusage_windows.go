@@ -0,0 +1,16 @@
+package main
+
+import "golang.org/x/sys/windows"
+
+// diskUsage returns the total and used bytes of the volume containing dir.
+func diskUsage(dir string) (total uint64, used uint64, err error) {
+	p, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	var available, totalBytes, free uint64
+	if err := windows.GetDiskFreeSpaceEx(p, &available, &totalBytes, &free); err != nil {
+		return 0, 0, err
+	}
+	return totalBytes, totalBytes - free, nil
+}
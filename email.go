@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// emailRule emails the uploads matching Pattern (see matchUploadPattern) to the recipients.
+type emailRule struct {
+	Pattern string
+	To      []string
+}
+
+// parseEmailRule parses a rule given as "pattern=address,address...".
+func parseEmailRule(def string) (emailRule, error) {
+	i := strings.Index(def, "=")
+	if i <= 0 {
+		return emailRule{}, fmt.Errorf("email notification %q must be given as pattern=address,...", def)
+	}
+	rule := emailRule{Pattern: def[:i]}
+	if _, err := path.Match(rule.Pattern, ""); err != nil {
+		return rule, fmt.Errorf("invalid pattern %q in email notification %q", rule.Pattern, def)
+	}
+	addrs, err := mail.ParseAddressList(def[i+1:])
+	if err != nil {
+		return rule, fmt.Errorf("invalid recipients in email notification %q: %v", def, err)
+	}
+	for _, addr := range addrs {
+		rule.To = append(rule.To, addr.Address)
+	}
+	return rule, nil
+}
+
+// mailer sends emails about uploads through an SMTP server.
+type mailer struct {
+	// Addr is the host:port of the SMTP server. STARTTLS is used if the server supports it.
+	Addr     string
+	User     string
+	Password string
+	From     string
+	Rules    []emailRule
+	// AttachLimit is the size up to which a file is attached; larger files are linked by a signed URL valid for LinkTTL.
+	AttachLimit int64
+	LinkTTL     time.Duration
+}
+
+// sendEmails emails the upload to the recipients of the rules matching it. It returns right away.
+func (s Server) sendEmails(e uploadEvent) {
+	if s.Mail == nil {
+		return
+	}
+	rel := strings.TrimPrefix(e.Path, "/files")
+	var to []string
+	seen := map[string]bool{}
+	for _, rule := range s.Mail.Rules {
+		if !matchUploadPattern(rule.Pattern, rel) {
+			continue
+		}
+		for _, addr := range rule.To {
+			if !seen[addr] {
+				seen[addr] = true
+				to = append(to, addr)
+			}
+		}
+	}
+	if len(to) == 0 {
+		return
+	}
+	go func() {
+		entry := logger.WithFields(logrus.Fields{
+			"path": e.Path,
+			"to":   strings.Join(to, ","),
+		})
+		msg, err := s.composeEmail(e, to)
+		if err == nil {
+			err = s.Mail.send(to, msg)
+		}
+		if err != nil {
+			entry.WithError(err).Warn("failed to send the email notification")
+			return
+		}
+		entry.Info("email notification sent")
+	}()
+}
+
+func (m *mailer) send(to []string, msg []byte) error {
+	var auth smtp.Auth
+	if m.User != "" {
+		host, _, _ := net.SplitHostPort(m.Addr)
+		auth = smtp.PlainAuth("", m.User, m.Password, host)
+	}
+	return smtp.SendMail(m.Addr, auth, m.From, to, msg)
+}
+
+// composeEmail builds the message about e, with the file attached if it is small enough, or a signed link to it otherwise.
+func (s Server) composeEmail(e uploadEvent, to []string) ([]byte, error) {
+	rel := strings.TrimPrefix(e.Path, "/files")
+	var attachment []byte
+	attached := e.Size <= s.Mail.AttachLimit
+	link := e.URL
+	expires := time.Now().Add(s.Mail.LinkTTL)
+	if attached {
+		b, err := ioutil.ReadFile(filepath.Join(s.DocumentRoot, filepath.FromSlash(rel)))
+		if err != nil {
+			return nil, err
+		}
+		attachment = b
+	} else {
+		// the link works without the token, even if downloads require it, until it expires.
+		link += "?" + s.Signer.sign(http.MethodGet, e.Path, nil, expires).Encode()
+	}
+
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "A file has been uploaded.\r\n\r\n")
+	fmt.Fprintf(&body, "Path: %s\r\nSize: %d bytes\r\nDigest: %s\r\nUploader: %s\r\n", e.Path, e.Size, e.Digest, e.Uploader)
+	if attached {
+		fmt.Fprintf(&body, "\r\nThe file is attached.\r\n")
+	} else {
+		fmt.Fprintf(&body, "\r\nDownload (valid until %s):\r\n%s\r\n", expires.UTC().Format(time.RFC1123), link)
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.Mail.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", "Uploaded: "+e.Path))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	if !attached {
+		fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+		msg.Write(body.Bytes())
+		return msg.Bytes(), nil
+	}
+	mw := multipart.NewWriter(&msg)
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%s\r\n\r\n", mw.Boundary())
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return nil, err
+	}
+	part.Write(body.Bytes())
+	contentType := mime.TypeByExtension(path.Ext(rel))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	part, err = mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {contentType},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(rel)})},
+		"Content-Transfer-Encoding": {"base64"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// base64 in lines of 76 characters, as required by RFC 2045.
+	encoded := base64.StdEncoding.EncodeToString(attachment)
+	for len(encoded) > 76 {
+		fmt.Fprintf(part, "%s\r\n", encoded[:76])
+		encoded = encoded[76:]
+	}
+	fmt.Fprintf(part, "%s\r\n", encoded)
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return msg.Bytes(), nil
+}
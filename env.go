@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// envPrefix is the prefix of the environment variables options are read from: -upload_limit is read from SUS_UPLOAD_LIMIT.
+const envPrefix = "SUS_"
+
+// envAliases are other names of options in the environment, for the names documented by other deployments.
+var envAliases = map[string]string{
+	"MAX_UPLOAD_SIZE": "upload_limit",
+}
+
+// configSources tells where the options which were not given on the command line were read from, by option name,
+// e.g. "env SUS_TOKEN" or "file /run/secrets/token". It is set once on startup.
+var configSources = map[string]string{}
+
+// envVar returns the name of the environment variable option is read from.
+func envVar(option string) string {
+	return envPrefix + strings.ToUpper(option)
+}
+
+// applyEnv sets the options of fs which were not given on the command line from the environment, looked up with lookup.
+// An option is read from SUS_<NAME>, or from the file named by SUS_<NAME>_FILE, like the secrets mounted by Docker and
+// Kubernetes; a trailing newline in the file is ignored. The command line takes precedence over the environment.
+// It returns the sources of the options it set.
+func applyEnv(fs *flag.FlagSet, lookup func(string) (string, bool)) (map[string]string, error) {
+	given := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	names := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) { names[envVar(f.Name)] = f.Name })
+	for alias, option := range envAliases {
+		names[envPrefix+alias] = option
+	}
+
+	sources := map[string]string{}
+	for name, option := range names {
+		if given[option] {
+			continue
+		}
+		value, ok := lookup(name)
+		fileName, fromFile := lookup(name + "_FILE")
+		var source string
+		switch {
+		case ok && fromFile:
+			return nil, fmt.Errorf("%s and %s_FILE cannot be used together", name, name)
+		case fromFile:
+			b, err := ioutil.ReadFile(fileName)
+			if err != nil {
+				return nil, fmt.Errorf("%s_FILE: %v", name, err)
+			}
+			value = strings.TrimRight(string(b), "\r\n")
+			source = "file " + fileName
+		case ok:
+			source = "env " + name
+		default:
+			continue
+		}
+		if other, ok := sources[option]; ok {
+			return nil, fmt.Errorf("-%s is given by both %s and %s", option, other, source)
+		}
+		if err := fs.Set(option, value); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		sources[option] = source
+	}
+	return sources, nil
+}
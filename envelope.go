@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Response envelopes: the current one, and the one of the first releases, {"ok":true,"path":"..."} for uploads
+// and {"ok":false,"error":"..."} for errors, which old clients may check field by field.
+const (
+	envelopeCurrent = "current"
+	envelopeLegacy  = "legacy"
+)
+
+// parseEnvelope checks the name of a response envelope.
+func parseEnvelope(name string) (string, error) {
+	switch name {
+	case envelopeCurrent, envelopeLegacy:
+		return name, nil
+	}
+	return "", fmt.Errorf("unknown response envelope %q: must be %s or %s", name, envelopeCurrent, envelopeLegacy)
+}
+
+// negotiateEnvelope returns the envelope asked for by the "envelope" parameter of a media type in the Accept header
+// of r, like "application/json; envelope=legacy", or else def.
+func negotiateEnvelope(r *http.Request, def string) string {
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		_, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if envelope, err := parseEnvelope(params["envelope"]); err == nil {
+			return envelope
+		}
+	}
+	return def
+}
+
+// legacyWriter marks the responses to write in the legacy envelope for writeJSON.
+type legacyWriter struct {
+	http.ResponseWriter
+}
+
+// Unwrap returns the writer it wraps.
+func (lw *legacyWriter) Unwrap() http.ResponseWriter {
+	return lw.ResponseWriter
+}
+
+// ReadFrom keeps sendfile available to the handlers, as statusRecorder does.
+func (lw *legacyWriter) ReadFrom(src io.Reader) (int64, error) {
+	if rf, ok := lw.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return copyBuffer(lw.ResponseWriter, src)
+}
+
+// withEnvelopes wraps h so that it responds in the envelope the client asks for, or else in def.
+func withEnvelopes(h http.Handler, def string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if negotiateEnvelope(r, def) == envelopeLegacy {
+			w = &legacyWriter{ResponseWriter: w}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// isLegacy reports whether responses are to be written to w in the legacy envelope.
+func isLegacy(w http.ResponseWriter) bool {
+	for {
+		switch v := w.(type) {
+		case *legacyWriter:
+			return true
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return false
+		}
+	}
+}
+
+// legacyEnvelope returns v in the legacy envelope, leaving out the fields added since, if it is an upload or
+// an error response. Other responses did not exist in the first releases, so they are returned as they are.
+func legacyEnvelope(v interface{}) interface{} {
+	switch v := v.(type) {
+	case uploadedResponse:
+		return struct {
+			response
+			Path string `json:"path"`
+		}{v.response, v.Path}
+	case errorResponse:
+		return struct {
+			response
+			Message string `json:"error"`
+		}{v.response, v.Message}
+	}
+	return v
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	errFileTooLarge = errors.New("uploaded file size exceeds the limit")
+	errNotFound     = errors.New("not found")
+)
+
+// statusClientClosedRequest is logged for requests abandoned by the client; it never reaches the client.
+const statusClientClosedRequest = 499
+
+func errMethodNotAllowed(method string) error {
+	return fmt.Errorf("method \"%s\" is not allowed", method)
+}
+
+// httpError is an error which knows the status code to respond with.
+type httpError struct {
+	status int
+	err    error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+func (e *httpError) Unwrap() error {
+	return e.err
+}
+
+// withStatus annotates err with the status code to respond with.
+func withStatus(status int, err error) error {
+	return &httpError{status: status, err: err}
+}
+
+// statusOf classifies err into the status code to respond with.
+// Problems caused by the request produce 4xx; anything unknown is considered a server fault.
+func statusOf(err error) int {
+	var he *httpError
+	if errors.As(err, &he) {
+		return he.status
+	}
+	switch {
+	case errors.Is(err, errMissingToken), errors.Is(err, errTokenMismatch), errors.Is(err, errInvalidJWT):
+		return http.StatusUnauthorized
+	case errors.Is(err, errForbidden):
+		return http.StatusForbidden
+	case errors.Is(err, errNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, errNameCollision):
+		return http.StatusConflict
+	case errors.Is(err, errReadOnly):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, context.Canceled):
+		return statusClientClosedRequest
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusRequestTimeout
+	case errors.Is(err, errFileTooLarge), errors.Is(err, multipart.ErrMessageTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, http.ErrMissingFile),
+		errors.Is(err, http.ErrNotMultipart),
+		errors.Is(err, http.ErrMissingBoundary),
+		errors.Is(err, io.ErrUnexpectedEOF):
+		return http.StatusBadRequest
+	}
+	// mime/multipart reports a malformed body only with plain errors.
+	if strings.HasPrefix(err.Error(), "multipart: ") {
+		return http.StatusBadRequest
+	}
+	// so does http.MaxBytesReader a body over its limit.
+	if strings.HasSuffix(err.Error(), "http: request body too large") {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusInternalServerError
+}
+
+// respondError writes err as the response with the status code derived from it, in the language of the client.
+func respondError(w http.ResponseWriter, err error) {
+	if lang := languageOf(w); lang != defaultLanguage {
+		w.Header().Set("Content-Language", lang)
+	}
+	w.WriteHeader(statusOf(err))
+	writeError(w, err)
+}
+
+// logFailure logs err with msg; client errors are not the server's problem, so they are logged at a lower level.
+func logFailure(entry *logrus.Entry, err error, msg string) {
+	if statusOf(err) < http.StatusInternalServerError {
+		entry.WithError(err).Info(msg)
+	} else {
+		entry.WithError(err).Error(msg)
+	}
+}
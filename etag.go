@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+)
+
+// ETag strategies
+const (
+	// etagStrong makes ETags from the digest of the content.
+	etagStrong = "strong"
+	// etagWeak makes weak ETags from the size and the modification time, without reading the content.
+	etagWeak = "weak"
+)
+
+// setETag sets the ETag of the file at rel, a path relative to the document root, if it is a regular file.
+// http.FileServer then answers If-None-Match, If-Match and If-Range with it; If-Range only matches strong ETags,
+// so resumed downloads fall back to Last-Modified with weak ones.
+func (s Server) setETag(w http.ResponseWriter, rel string) {
+	file := path.Join(s.DocumentRoot, rel)
+	info, err := os.Stat(file)
+	if err != nil || !info.Mode().IsRegular() {
+		return
+	}
+	if etag := s.etagOf(rel, info); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+}
+
+// etagOf returns the ETag of the regular file at rel, described by info, or an empty string if it cannot be hashed.
+func (s Server) etagOf(rel string, info os.FileInfo) string {
+	if s.ETag == etagWeak {
+		return fmt.Sprintf("W/\"%x-%x\"", info.Size(), info.ModTime().UnixNano())
+	}
+	sum, err := s.Digests.of(path.Join(s.DocumentRoot, rel), info)
+	if err != nil {
+		logger.WithError(err).WithField("path", rel).Warn("failed to hash the file")
+		return ""
+	}
+	return "\"" + sum + "\""
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// eventQueueSize is the number of events waiting to be published, beyond which new events are dropped.
+	eventQueueSize = 1000
+	eventAttempts  = 3
+)
+
+// eventPublisher publishes messages to a message broker. Messages with the same key are kept in order.
+type eventPublisher interface {
+	publish(key string, payload []byte) error
+	String() string
+}
+
+// parseEventTarget parses the broker to publish file events to: nats://[user:password@]host[:port]/subject
+// or kafka://host[:port][,host[:port]...]/topic.
+func parseEventTarget(raw string) (eventPublisher, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid event target: %v", err)
+	}
+	switch u.Scheme {
+	case "nats":
+		return newNATSPublisher(u)
+	case "kafka":
+		return newKafkaPublisher(u)
+	}
+	return nil, fmt.Errorf("event target %q must be a nats:// or kafka:// URL", raw)
+}
+
+// Types of file events.
+const (
+	eventUpload  = "upload"
+	eventDelete  = "delete"
+	eventArchive = "archive"
+	eventRestore = "restore"
+)
+
+// fileEvent is published for every change to a file, as JSON.
+type fileEvent struct {
+	Type string `json:"type"`
+	// Path is the URL path of the file, like "/files/foo.txt".
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	Digest string `json:"digest,omitempty"`
+	// Actor is the IP address of the client which made the change, or empty if the server made it.
+	Actor string `json:"actor,omitempty"`
+	// UploadID is the ID of the upload which stored the file, as returned to its client in X-Upload-Id.
+	UploadID string    `json:"upload_id,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// eventBus publishes file events in the background, in the order they happened.
+type eventBus struct {
+	publisher eventPublisher
+	queue     chan fileEvent
+}
+
+func newEventBus(publisher eventPublisher) *eventBus {
+	return &eventBus{publisher: publisher, queue: make(chan fileEvent, eventQueueSize)}
+}
+
+// run publishes the queued events. It never returns.
+func (b *eventBus) run() {
+	for e := range b.queue {
+		payload, _ := json.Marshal(e)
+		entry := logger.WithFields(logrus.Fields{
+			"event":  e.Type,
+			"path":   e.Path,
+			"target": b.publisher.String(),
+		})
+		if e.UploadID != "" {
+			entry = entry.WithField("upload_id", e.UploadID)
+		}
+		for attempt := 1; ; attempt++ {
+			err := b.publisher.publish(e.Path, payload)
+			if err == nil {
+				entry.Debug("event published")
+				break
+			}
+			if attempt == eventAttempts {
+				entry.WithError(err).Warn("failed to publish the event")
+				break
+			}
+			entry.WithError(err).Info("failed to publish the event, retrying")
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+}
+
+// emit queues e to be published, if events are published. It never blocks: the event is dropped if the queue is full.
+func (s Server) emit(e fileEvent) {
+	s.Manifests.changed(e.Path)
+	s.Repos.changed(e.Path)
+	s.artifactChanged(e)
+	s.Purger.changed(e.Path)
+	if s.Events == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+	select {
+	case s.Events.queue <- e:
+	default:
+		logger.WithFields(logrus.Fields{
+			"event": e.Type,
+			"path":  e.Path,
+		}).Warn("event queue is full, dropping the event")
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultFeedEntries = 50
+	maxFeedEntries     = 1000
+)
+
+// atomFeed is an Atom feed (RFC 4287).
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Title   string      `xml:"title"`
+	ID      string      `xml:"id"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomLink struct {
+	Rel    string `xml:"rel,attr,omitempty"`
+	Href   string `xml:"href,attr"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+}
+
+type atomEntry struct {
+	Title   string     `xml:"title"`
+	ID      string     `xml:"id"`
+	Updated string     `xml:"updated"`
+	Links   []atomLink `xml:"link"`
+	Summary string     `xml:"summary"`
+}
+
+// requestBaseURL returns the scheme and host the request was sent to, like "https://example.com".
+func requestBaseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
+// feedDirOf returns the directory addressed by a feed URL, relative to the document root:
+// /feeds.atom for the document root, and /feeds/(dir).atom for a directory.
+func feedDirOf(urlPath string) (string, bool) {
+	if urlPath == "/feeds.atom" {
+		return "/", true
+	}
+	if !strings.HasPrefix(urlPath, "/feeds/") || !strings.HasSuffix(urlPath, ".atom") {
+		return "", false
+	}
+	dir := path.Clean("/" + strings.TrimSuffix(strings.TrimPrefix(urlPath, "/feeds/"), ".atom"))
+	if dir == "/" || isInternalName(strings.SplitN(dir[1:], "/", 2)[0]) {
+		return "", false
+	}
+	return dir, true
+}
+
+// handleFeed serves an Atom feed of the newest files under a directory, so that new files can be followed in feed readers.
+// The number of entries is given by the "limit" query parameter.
+func (s Server) handleFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET,HEAD")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	if err := s.checkToken(r); s.isAuthenticationRequired(r) && err != nil {
+		respondError(w, err)
+		return
+	}
+	dir, ok := feedDirOf(r.URL.Path)
+	if !ok {
+		respondError(w, fmt.Errorf("\"%s\" is %w", r.URL.Path, errNotFound))
+		return
+	}
+	limit := defaultFeedEntries
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 || n > maxFeedEntries {
+			respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("limit must be between 1 and %d", maxFeedEntries)))
+			return
+		}
+		limit = n
+	}
+	root := filepath.Join(s.DocumentRoot, filepath.FromSlash(dir))
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		respondError(w, fmt.Errorf("\"/files%s\" is %w", dir, errNotFound))
+		return
+	}
+	// the newest files, as listed by a smart folder with "recent:N" and no other terms.
+	files, err := smartFolder{recent: limit}.files(root)
+	if err != nil {
+		logger.WithError(err).WithField("path", dir).Error("failed to list the files for the feed")
+		respondError(w, err)
+		return
+	}
+
+	base := requestBaseURL(r)
+	dirURL := path.Join("/files", dir) + "/"
+	feed := atomFeed{
+		Title:   "Files in " + dirURL,
+		ID:      base + dirURL,
+		Updated: time.Unix(0, 0).UTC().Format(time.RFC3339),
+		Author:  atomPerson{Name: "simple-upload-server"},
+		Links: []atomLink{
+			{Rel: "self", Href: base + (&url.URL{Path: r.URL.Path}).String(), Type: "application/atom+xml"},
+			{Rel: "alternate", Href: base + (&url.URL{Path: dirURL}).String()},
+		},
+		Entries: make([]atomEntry, 0, len(files)),
+	}
+	if len(files) > 0 {
+		feed.Updated = files[0].ModTime.UTC().Format(time.RFC3339)
+	}
+	for _, f := range files {
+		fileURL := base + (&url.URL{Path: path.Join(dirURL, f.Path)}).String()
+		feed.Entries = append(feed.Entries, atomEntry{
+			Title: f.Path,
+			// a file replaced by a new upload is a new entry.
+			ID:      fmt.Sprintf("%s#%d", fileURL, f.ModTime.UnixNano()),
+			Updated: f.ModTime.UTC().Format(time.RFC3339),
+			Links: []atomLink{
+				{Rel: "enclosure", Href: fileURL, Type: mime.TypeByExtension(path.Ext(f.Path)), Length: f.Size},
+				{Rel: "alternate", Href: fileURL},
+			},
+			Summary: fmt.Sprintf("%s (%d bytes)", f.Path, f.Size),
+		})
+	}
+	if s.EnableCORS {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+	w.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	fmt.Fprint(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		logger.WithError(err).Warn("failed to write the feed")
+	}
+}
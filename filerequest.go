@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fileRequestResponse describes a file request: a link to upload files into a folder without the token.
+type fileRequestResponse struct {
+	response
+	URL     string    `json:"url"`
+	Method  string    `json:"method"`
+	Folder  string    `json:"folder"`
+	Expires time.Time `json:"expires"`
+	MaxSize int64     `json:"max_size"`
+}
+
+// handleFileRequest serves POST /upload/request, which returns a signed link letting anyone who has it upload
+// files into a folder, until the link expires and as long as the folder holds less than its size cap.
+func (s Server) handleFileRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	if err := s.checkToken(r); err != nil {
+		respondError(w, err)
+		return
+	}
+	if err := s.checkWritable(); err != nil {
+		respondError(w, err)
+		return
+	}
+	folder := r.FormValue("folder")
+	rel, err := s.storedPath(folder)
+	if err == nil && isInternalName(strings.SplitN(rel[1:], "/", 2)[0]) {
+		err = withStatus(http.StatusBadRequest, fmt.Errorf("invalid folder name %q", folder))
+	}
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	ttl := s.FileRequestTTL
+	if v := r.FormValue("ttl"); v != "" {
+		if ttl, err = time.ParseDuration(v); err != nil || ttl <= 0 {
+			respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("invalid ttl %q", v)))
+			return
+		}
+	}
+	maxSize := s.MaxUploadSize
+	if v := r.FormValue("max_size"); v != "" {
+		if maxSize, err = strconv.ParseInt(v, 10, 64); err != nil || maxSize <= 0 {
+			respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("invalid max_size %q", v)))
+			return
+		}
+	}
+
+	params := url.Values{}
+	params.Set("folder", rel)
+	params.Set("max_size", strconv.FormatInt(maxSize, 10))
+	params.Set("nonce", newNonce())
+	expires := time.Now().Add(ttl)
+	signed := s.Signer.sign(http.MethodPost, "/upload", params, expires)
+	auditLog().WithFields(logrus.Fields{
+		"folder":  "/files" + rel,
+		"size":    maxSize,
+		"expires": expires.UTC().Format(time.RFC3339),
+		"remote":  r.RemoteAddr,
+	}).Info("file request created")
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, fileRequestResponse{
+		response: response{OK: true},
+		URL:      (&url.URL{Path: "/upload", RawQuery: signed.Encode()}).String(),
+		Method:   http.MethodPost,
+		Folder:   "/files" + rel,
+		Expires:  expires,
+		MaxSize:  maxSize,
+	})
+}
+
+// folderLocks serializes the uploads to the folders of file requests, so that each one sees the files stored by the
+// others when it checks the size cap. Locks are dropped once released by all.
+type folderLocks struct {
+	mu    sync.Mutex
+	locks map[string]*folderLock
+}
+
+type folderLock struct {
+	sync.Mutex
+	waiting int
+}
+
+func newFolderLocks() *folderLocks {
+	return &folderLocks{locks: map[string]*folderLock{}}
+}
+
+// lock locks folder, and returns the function unlocking it.
+func (l *folderLocks) lock(folder string) func() {
+	l.mu.Lock()
+	fl := l.locks[folder]
+	if fl == nil {
+		fl = &folderLock{}
+		l.locks[folder] = fl
+	}
+	fl.waiting++
+	l.mu.Unlock()
+	fl.Lock()
+	return func() {
+		fl.Unlock()
+		l.mu.Lock()
+		if fl.waiting--; fl.waiting == 0 {
+			delete(l.locks, folder)
+		}
+		l.mu.Unlock()
+	}
+}
+
+// fileRequestSpace returns the number of bytes which can still be uploaded to the folder of a file request link.
+func (s Server) fileRequestSpace(params url.Values) (int64, error) {
+	folder := params.Get("folder")
+	maxSize, _ := strconv.ParseInt(params.Get("max_size"), 10, 64)
+	used, err := s.homeUsage(folder)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if used >= maxSize {
+		return 0, withStatus(http.StatusInsufficientStorage, fmt.Errorf("%d bytes uploaded to \"/files%s\" out of %d: %w", used, folder, maxSize, errQuotaExceeded))
+	}
+	return maxSize - used, nil
+}
+
+// limitFileRequestBody limits the multipart body of an upload to a file request link to the space left in its
+// folder, so that an oversized upload is rejected while it arrives rather than once spooled. The other fields and
+// the headers of the parts are allowed for by MultipartMemory; the sizes of the files are checked exactly once
+// received, by handleFileRequestUpload.
+func (s Server) limitFileRequestBody(w http.ResponseWriter, r *http.Request, params url.Values) error {
+	if r.Method != http.MethodPost || params.Get("folder") == "" {
+		return nil
+	}
+	left, err := s.fileRequestSpace(params)
+	if err != nil {
+		return err
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, left+s.MultipartMemory)
+	return nil
+}
+
+// handleFileRequestUpload stores the files posted to a link returned by handleFileRequest in its folder, like the
+// home directory of a user, unless they would make the folder hold more than the size cap of the link.
+// The folder is locked from the check to the store, so that concurrent uploads cannot exceed it together.
+func (s Server) handleFileRequestUpload(w http.ResponseWriter, r *http.Request) {
+	params, err := s.Signer.verify(r)
+	if err != nil {
+		logger.WithError(err).WithField("path", r.URL.Path).Info("file request upload rejected")
+		respondError(w, err)
+		return
+	}
+	folder := params.Get("folder")
+	unlock := s.fileRequestLocks.lock(folder)
+	defer unlock()
+	left, err := s.fileRequestSpace(params)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	// the files have already been received by multipartForms, within limitFileRequestBody.
+	var size int64
+	for _, rcv := range multipartUploads(r) {
+		size += rcv.Size
+	}
+	if size > left {
+		respondError(w, withStatus(http.StatusInsufficientStorage, fmt.Errorf("%d bytes uploaded to \"/files%s\" with %d left: %w", size, folder, left, errQuotaExceeded)))
+		return
+	}
+	s.Home = folder
+	s.handlePost(w, r)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// newFileRequest returns the link of a file request into folder, capped to maxSize bytes.
+func newFileRequest(t *testing.T, s Server, folder string, maxSize int64) string {
+	r := httptest.NewRequest(http.MethodPost, "/upload/request?token=secret", strings.NewReader(fmt.Sprintf("folder=%s&max_size=%d", folder, maxSize)))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	s.handleFileRequest(w, r)
+	var resp fileRequestResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || !resp.OK {
+		t.Fatalf("%d %s", w.Code, w.Body)
+	}
+	return resp.URL
+}
+
+// postFile uploads a file of size bytes to the file request link, and returns the status and the bytes read of the body.
+func postFile(s Server, link string, name string, size int) (int, int64) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreateFormFile("file", name)
+	part.Write(bytes.Repeat([]byte("x"), size))
+	mw.Close()
+	cr := &countingReader{r: &body}
+	r := httptest.NewRequest(http.MethodPost, link, cr)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	s.multipartForms(s).ServeHTTP(w, r)
+	return w.Code, cr.n
+}
+
+func newFileRequestServer(t *testing.T) Server {
+	root, err := ioutil.TempDir("", "filerequest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	return NewServer(root, 1<<20, "secret", false, []string{http.MethodPost, http.MethodPut})
+}
+
+func TestFileRequestConcurrentUploads(t *testing.T) {
+	s := newFileRequestServer(t)
+	link := newFileRequest(t, s, "incoming", 2500)
+
+	var wg sync.WaitGroup
+	codes := make([]int, 10)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i], _ = postFile(s, link, fmt.Sprintf("%d.txt", i), 1000)
+		}(i)
+	}
+	wg.Wait()
+	stored := 0
+	for _, code := range codes {
+		switch code {
+		case http.StatusOK:
+			stored++
+		case http.StatusInsufficientStorage:
+		default:
+			t.Errorf("status %d", code)
+		}
+	}
+	if stored != 2 {
+		t.Errorf("%d uploads stored, want 2", stored)
+	}
+	if used, err := s.homeUsage("/incoming"); err != nil || used > 2500 {
+		t.Errorf("%d bytes in the folder, want at most 2500: %v", used, err)
+	}
+}
+
+func TestFileRequestUploadRejectedWhileStreaming(t *testing.T) {
+	s := newFileRequestServer(t)
+	s.MultipartMemory = 4096
+	link := newFileRequest(t, s, "incoming", 1000)
+
+	code, read := postFile(s, link, "large.bin", 512<<10)
+	if code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status %d, want 413", code)
+	}
+	if read > 64<<10 {
+		t.Errorf("%d bytes read of an upload over the cap", read)
+	}
+	if code, _ := postFile(s, link, "small.txt", 1000); code != http.StatusOK {
+		t.Errorf("status %d, want 200", code)
+	}
+	// the folder is full, so the body is not read at all.
+	code, read = postFile(s, link, "more.txt", 1)
+	if code != http.StatusInsufficientStorage || read != 0 {
+		t.Errorf("status %d with %d bytes read, want 507 without reading", code, read)
+	}
+	if _, err := os.Stat(filepath.Join(s.DocumentRoot, "incoming", "large.bin")); !os.IsNotExist(err) {
+		t.Errorf("upload over the cap stored")
+	}
+}
+
+func TestFolderLocks(t *testing.T) {
+	l := newFolderLocks()
+	unlock := l.lock("/incoming")
+	other := l.lock("/other")
+	locked := make(chan struct{})
+	go func() {
+		l.lock("/incoming")()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		t.Fatal("folder locked twice")
+	case <-time.After(50 * time.Millisecond):
+	}
+	unlock()
+	<-locked
+	other()
+	if len(l.locks) != 0 {
+		t.Errorf("%d locks left once released", len(l.locks))
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+
+	"github.com/sirupsen/logrus"
+)
+
+// folderResponse reports the files stored by a folder upload.
+type folderResponse struct {
+	response
+	Prefix string             `json:"prefix"`
+	Files  []uploadedResponse `json:"files"`
+}
+
+// handleFolderUpload stores the files of a multipart POST with several files, or with relative paths, as sent
+// by a browser for a folder (<input type="file" webkitdirectory>). The directory structure is recreated under
+// the "prefix" form field, and all files are published at once, as by a transaction.
+//
+// File names are kept as sent, rather than made by the naming scheme, so that the folder is stored as it is.
+func (s Server) handleFolderUpload(w http.ResponseWriter, r *http.Request, uploads []received, redirectTo string) {
+	prefix := cleanPrefix(s.inHome(toSlash(r.FormValue("prefix"))))
+	tx, err := s.newTransaction()
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	defer os.RemoveAll(tx.dir)
+	stored := make([]string, len(uploads))
+	for i, rcv := range uploads {
+		name := rcv.RelativePath
+		if name == "" {
+			name = rcv.Filename
+		}
+		if name == "" {
+			name = rcv.Digest
+		}
+		rel, err := s.storedPath(path.Join(prefix, name))
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		if _, ok := tx.Files[rel]; ok {
+			respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("\"/files%s\" is uploaded more than once", rel)))
+			return
+		}
+		if err := s.checkReceived(rel, &rcv); err != nil {
+			respondError(w, err)
+			return
+		}
+		stagedPath := path.Join(tx.dir, "files", stagedName(rel))
+		if err := s.commitFile(r.Context(), rcv.TempName, stagedPath); err != nil {
+			logFailure(tagUpload(r.Context(), logger.WithField("path", rel)), err, "failed to stage the uploaded content")
+			respondError(w, err)
+			return
+		}
+		tx.Files[rel] = rcv.Size
+		tx.digests[rel] = rcv.Digest
+		stored[i] = rel
+	}
+	if _, _, err := s.publish(r.Context(), tx, nil); err != nil {
+		respondError(w, err)
+		return
+	}
+	s.announceTransaction(r, tx)
+	tagUpload(r.Context(), auditLog()).WithFields(logrus.Fields{
+		"prefix": prefix,
+		"files":  len(uploads),
+	}).Info("folder uploaded by POST")
+	resp := folderResponse{response: response{OK: true}, Prefix: "/files" + prefix, Files: make([]uploadedResponse, len(uploads))}
+	for i, rel := range stored {
+		resp.Files[i] = s.newUploadedResponse("/files"+rel, uploads[i])
+		resp.Files[i].CID = s.pinIPFS(r.Context(), rel)
+	}
+	s.notifyCallback(r, resp)
+	if s.EnableCORS {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Expose-Headers", uploadIDHeader)
+	}
+	if redirectTo != "" {
+		location, _ := redirectURL(redirectTo, "/files"+prefix)
+		http.Redirect(w, r, location, http.StatusSeeOther)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, resp)
+}
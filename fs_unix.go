@@ -0,0 +1,40 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// isCrossDevice reports whether a rename failed because the source and the destination are on different devices.
+func isCrossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
+
+// syncDir flushes the entries of dir, such as a file renamed into it, to the disk.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
+
+// renameFile replaces dst with src atomically.
+func renameFile(src string, dst string) error {
+	return os.Rename(src, dst)
+}
+
+// toSlash converts the separators of a path given by a client; only slashes separate paths on this platform.
+func toSlash(p string) string {
+	return p
+}
+
+// checkName returns an error if name cannot be used as a file name on this platform.
+func checkName(name string) error {
+	return nil
+}
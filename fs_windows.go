@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// isCrossDevice reports whether a rename failed because the source and the destination are on different volumes.
+func isCrossDevice(err error) bool {
+	return errors.Is(err, windows.ERROR_NOT_SAME_DEVICE)
+}
+
+// syncDir does nothing on Windows, where directories cannot be flushed; NTFS journals renames by itself.
+func syncDir(dir string) error {
+	return nil
+}
+
+// renameFile replaces dst with src atomically. A file cannot be replaced while it is open without sharing deletion,
+// e.g. by a virus scanner or an indexer, so the rename is retried for a while.
+func renameFile(src string, dst string) error {
+	from, err := windows.UTF16PtrFromString(src)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: err}
+	}
+	to, err := windows.UTF16PtrFromString(dst)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: src, New: dst, Err: err}
+	}
+	wait := 10 * time.Millisecond
+	for i := 0; ; i++ {
+		err = windows.MoveFileEx(from, to, windows.MOVEFILE_REPLACE_EXISTING|windows.MOVEFILE_WRITE_THROUGH)
+		if err == nil {
+			return nil
+		}
+		if i == 6 || !(errors.Is(err, windows.ERROR_ACCESS_DENIED) || errors.Is(err, windows.ERROR_SHARING_VIOLATION)) {
+			return &os.LinkError{Op: "rename", Old: src, New: dst, Err: err}
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// toSlash converts the separators of a path given by a client, since backslashes separate paths on Windows.
+func toSlash(p string) string {
+	return strings.ReplaceAll(p, `\`, "/")
+}
+
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true, "COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true, "LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// checkName returns an error if name cannot be used as a file name on Windows: device names, with any extension,
+// names ending with a dot or a space, and names with characters Windows does not allow.
+func checkName(name string) error {
+	base := name
+	if i := strings.Index(base, "."); i >= 0 {
+		base = base[:i]
+	}
+	if reservedNames[strings.ToUpper(strings.TrimRight(base, " "))] {
+		return errReservedName
+	}
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return errReservedName
+	}
+	if strings.ContainsAny(name, `<>:"|?*`) {
+		return errReservedName
+	}
+	for _, c := range name {
+		if c < 32 {
+			return errReservedName
+		}
+	}
+	return nil
+}
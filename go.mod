@@ -5,5 +5,9 @@ go 1.14
 require (
 	github.com/konsorten/go-windows-terminal-sequences v1.0.2 // indirect
 	github.com/sirupsen/logrus v1.5.0
-	golang.org/x/sys v0.0.0-20200327173247-9dae0f8f5775 // indirect
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/sys v0.0.0-20200327173247-9dae0f8f5775
+	golang.org/x/text v0.3.0
+	gopkg.in/natefinch/lumberjack.v2 v2.0.0
+	lukechampine.com/blake3 v1.1.7
 )
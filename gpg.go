@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
+)
+
+var errBadSignature = errors.New("missing or invalid signature")
+
+const (
+	// signatureHeader carries the detached signature of a raw upload, base64-encoded, armored or not.
+	signatureHeader = "X-Signature"
+	// signatureField carries the detached signatures of the files of a multipart upload, in the same order.
+	signatureField = "signature"
+	// maxSignatureSize bounds a signature part of a multipart upload.
+	maxSignatureSize = 64 << 10
+)
+
+// signatureVerifier checks the detached OpenPGP signatures of uploads against a keyring.
+type signatureVerifier struct {
+	keyring openpgp.EntityList
+	// Patterns are matched as by matchUploadPattern against the paths of the files which must be signed;
+	// all files must be if it is empty.
+	Patterns []string
+}
+
+// newSignatureVerifier loads the public keys of the keyring file, armored as exported by gpg --armor --export, or not.
+func newSignatureVerifier(keyringFile string) (*signatureVerifier, error) {
+	b, err := ioutil.ReadFile(keyringFile)
+	if err != nil {
+		return nil, err
+	}
+	var keyring openpgp.EntityList
+	if isArmored(b) {
+		keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+	} else {
+		keyring, err = openpgp.ReadKeyRing(bytes.NewReader(b))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", keyringFile, err)
+	}
+	if len(keyring) == 0 {
+		return nil, fmt.Errorf("%s: no keys", keyringFile)
+	}
+	return &signatureVerifier{keyring: keyring}, nil
+}
+
+// verify checks that sig, armored or not, is a detached signature of signed by a key of the keyring, and returns the key.
+func (v *signatureVerifier) verify(signed io.Reader, sig []byte) (*openpgp.Entity, error) {
+	if isArmored(sig) {
+		return openpgp.CheckArmoredDetachedSignature(v.keyring, signed, bytes.NewReader(sig))
+	}
+	return openpgp.CheckDetachedSignature(v.keyring, signed, bytes.NewReader(sig))
+}
+
+func isArmored(b []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(b), []byte("-----BEGIN PGP"))
+}
+
+// signatureOf returns the signature sent in the header of r, if any.
+func signatureOf(r *http.Request) ([]byte, error) {
+	v := r.Header.Get(signatureHeader)
+	if v == "" {
+		return nil, nil
+	}
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, withStatus(http.StatusBadRequest, fmt.Errorf("invalid %s header: %v", signatureHeader, err))
+	}
+	return b, nil
+}
+
+// requires tells whether rel, a path relative to the document root, must be signed.
+func (v *signatureVerifier) requires(rel string) bool {
+	if len(v.Patterns) == 0 {
+		return true
+	}
+	for _, pattern := range v.Patterns {
+		if matchUploadPattern(pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSignature returns an error unless file, to be stored as rel, is signed by sig with a key of the keyring,
+// or need not be signed.
+func (s Server) checkSignature(rel string, file string, sig []byte) error {
+	v := s.Signatures
+	if v == nil || !v.requires(rel) {
+		return nil
+	}
+	entry := auditLog().WithField("path", "/files"+rel)
+	if len(sig) == 0 {
+		entry.Warn("unsigned upload rejected")
+		return withStatus(http.StatusForbidden, fmt.Errorf("\"/files%s\": %w: not signed", rel, errBadSignature))
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	signer, err := v.verify(f, sig)
+	if err != nil {
+		entry.WithError(err).Warn("badly signed upload rejected")
+		return withStatus(http.StatusForbidden, fmt.Errorf("\"/files%s\": %w: %v", rel, errBadSignature, err))
+	}
+	entry.WithFields(logrus.Fields{
+		"key":    signer.PrimaryKey.KeyIdString(),
+		"signer": strings.Join(identityNames(signer), ", "),
+	}).Info("upload signature verified")
+	return nil
+}
+
+// identityNames returns the user IDs of a key, like "Release Bot <release@example.com>".
+func identityNames(e *openpgp.Entity) []string {
+	names := make([]string, 0, len(e.Identities))
+	for name := range e.Identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
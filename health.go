@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	// probeSize is the size of the file written by the deep health check.
+	probeSize = 4096
+	// probeTimeout bounds the whole check, so that a hung disk fails it instead of hanging the monitoring.
+	probeTimeout = 10 * time.Second
+)
+
+// probeLock runs one deep health check at a time, so that frequent monitoring does not pile up writes.
+var probeLock sync.Mutex
+
+// probeStage is the result of a stage of the deep health check.
+type probeStage struct {
+	Stage      string  `json:"stage"`
+	DurationMS float64 `json:"duration_ms"`
+	Error      string  `json:"error,omitempty"`
+}
+
+type healthResponse struct {
+	response
+	DurationMS float64      `json:"duration_ms"`
+	Stages     []probeStage `json:"stages"`
+}
+
+// handleDeepHealth serves GET /healthz/deep: it writes a probe file through the same path as uploads, reads it back,
+// verifies its digest and deletes it, reporting the latency of each stage. It responds with 503 Service Unavailable
+// if any stage fails, so that monitoring detects a degraded disk and not only a dead process.
+func (s Server) handleDeepHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET,HEAD")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	probeLock.Lock()
+	defer probeLock.Unlock()
+	ctx, cancel := context.WithTimeout(r.Context(), probeTimeout)
+	defer cancel()
+
+	resp := healthResponse{response: response{OK: true}, Stages: []probeStage{}}
+	start := time.Now()
+	// run runs a stage unless one has failed.
+	run := func(stage string, fn func() error) {
+		if !resp.OK {
+			return
+		}
+		t := time.Now()
+		err := fn()
+		ps := probeStage{Stage: stage, DurationMS: float64(time.Since(t).Microseconds()) / 1000}
+		if err != nil {
+			ps.Error = err.Error()
+			resp.OK = false
+			logger.WithError(err).WithField("stage", stage).Warn("deep health check failed")
+		}
+		resp.Stages = append(resp.Stages, ps)
+	}
+
+	content := make([]byte, probeSize)
+	var rcv received
+	var dir string
+	run("writable", s.checkWritable)
+	run("write", func() (err error) {
+		if _, err = rand.Read(content); err != nil {
+			return err
+		}
+		rcv, err = s.spool(ctx, bytes.NewReader(content), received{})
+		return err
+	})
+	// the probe is committed into a staging directory, which is hidden from clients and removed on restart if left over.
+	run("commit", func() (err error) {
+		if dir, err = ioutil.TempDir(s.DocumentRoot, stagingPrefix); err != nil {
+			os.Remove(rcv.TempName)
+			return err
+		}
+		return s.commitFile(ctx, rcv.TempName, path.Join(dir, "probe"))
+	})
+	run("read", func() error {
+		h := s.Digests.hash()
+		f, err := os.Open(path.Join(dir, "probe"))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := copyBuffer(h, contextReader{ctx: ctx, r: f}); err != nil {
+			return err
+		}
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != rcv.Digest {
+			return fmt.Errorf("probe file read back with digest %s, but written with %s", sum, rcv.Digest)
+		}
+		return nil
+	})
+	if dir != "" {
+		// removed even if a stage failed, but only reported if all succeeded.
+		run("delete", func() error { return os.RemoveAll(dir) })
+		if !resp.OK {
+			os.RemoveAll(dir)
+		}
+	}
+	resp.DurationMS = float64(time.Since(start).Microseconds()) / 1000
+
+	w.Header().Set("Cache-Control", "no-store")
+	if resp.OK {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if r.Method == http.MethodGet {
+		writeJSON(w, resp)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var errLegalHold = errors.New("under legal hold")
+
+type metaResponse struct {
+	response
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	fileMeta
+}
+
+// checkLegalHold returns an error if rel, a path relative to the document root, is under legal hold.
+func (s Server) checkLegalHold(rel string) error {
+	if s.Meta == nil {
+		return nil
+	}
+	meta, err := s.Meta.get(rel)
+	if err != nil {
+		return err
+	}
+	if meta.LegalHold != nil {
+		auditLog().WithField("path", rel).Warn("change rejected by legal hold")
+		return withStatus(http.StatusForbidden, fmt.Errorf("\"/files%s\" is %w", rel, errLegalHold))
+	}
+	return nil
+}
+
+// handleMeta serves GET /meta/(filename), the metadata of a stored file.
+func (s Server) handleMeta(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET,HEAD")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	if err := s.checkToken(r); s.isAuthenticationRequired(r) && err != nil {
+		respondError(w, err)
+		return
+	}
+	rel := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/meta/"))
+	info, err := os.Stat(path.Join(s.DocumentRoot, rel))
+	if err != nil || info.IsDir() {
+		respondError(w, fmt.Errorf("\"/files%s\" is %w", rel, errNotFound))
+		return
+	}
+	var meta fileMeta
+	if s.Meta != nil {
+		if meta, err = s.Meta.get(rel); err != nil {
+			logger.WithError(err).WithField("path", rel).Error("failed to read metadata")
+			respondError(w, err)
+			return
+		}
+		// reports identify their reporters, so they are only listed to admins.
+		meta.Reports = nil
+	}
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, metaResponse{
+		response: response{OK: true},
+		Path:     "/files" + rel,
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+		fileMeta: meta,
+	})
+}
+
+// handleHold serves PUT /hold/(filename) to place a legal hold, and DELETE /hold/(filename) to remove it.
+func (s Server) handleHold(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "PUT,DELETE")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	if err := s.checkToken(r); err != nil {
+		respondError(w, err)
+		return
+	}
+	if s.Meta == nil {
+		respondError(w, withStatus(http.StatusNotImplemented, errNoMetadataStore))
+		return
+	}
+	rel := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/hold/"))
+	if info, err := os.Stat(path.Join(s.DocumentRoot, rel)); err != nil || info.IsDir() {
+		respondError(w, fmt.Errorf("\"/files%s\" is %w", rel, errNotFound))
+		return
+	}
+	placed := r.Method == http.MethodPut
+	err := s.Meta.update(rel, func(meta *fileMeta) {
+		if placed {
+			meta.LegalHold = &legalHold{Reason: r.FormValue("reason"), Since: time.Now(), By: r.RemoteAddr}
+		} else {
+			meta.LegalHold = nil
+		}
+	})
+	if err != nil {
+		logger.WithError(err).WithField("path", rel).Error("failed to update metadata")
+		respondError(w, err)
+		return
+	}
+	entry := auditLog().WithFields(logrus.Fields{
+		"path":   rel,
+		"remote": r.RemoteAddr,
+	})
+	if placed {
+		entry.WithField("reason", r.FormValue("reason")).Info("legal hold placed")
+	} else {
+		entry.Info("legal hold removed")
+	}
+	w.WriteHeader(http.StatusOK)
+	writeSuccess(w, "/files"+rel)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// homesDir is the directory, relative to the document root, holding the home directories of the users.
+const homesDir = "/home"
+
+// homeOf returns the home directory of the user name relative to the document root, or an empty string
+// if the name cannot be a directory name, or the user is anonymous and so has no home. Names come from tokens and
+// certificates, so one which would resolve to another directory than its own under homesDir, like "..", "." or
+// "team/alice", has no home either.
+func homeOf(name string) string {
+	if name == anonymousUser || name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\\x00") ||
+		checkName(name) != nil {
+		return ""
+	}
+	home := path.Join(homesDir, name)
+	if path.Dir(home) != homesDir {
+		return ""
+	}
+	return home
+}
+
+// isWithin tells whether urlPath is dir or under it.
+func isWithin(urlPath string, dir string) bool {
+	return urlPath == dir || strings.HasPrefix(urlPath, dir+"/")
+}
+
+// inHome returns name, as made for an upload, within the home directory of the user making it, if any.
+func (s Server) inHome(name string) string {
+	if s.Home == "" {
+		return name
+	}
+	return path.Join(s.Home, path.Clean("/"+name))
+}
+
+// homeUsage returns the total size of the files in the home directory home.
+func (s Server) homeUsage(home string) (int64, error) {
+	var total int64
+	err := filepath.Walk(filepath.Join(s.DocumentRoot, filepath.FromSlash(home)), func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// enterHome confines the user making r to their home directory, which is created if missing: paths under /files/
+// are taken relative to it, unless they are already within it, and files uploaded by POST are stored in it.
+// Uploads are limited to what is left of the quota. It returns the server and the request to serve r with;
+// the server token and the anonymous user are not confined.
+func (s Server) enterHome(r *http.Request) (Server, *http.Request, error) {
+	id, err := s.RBAC.identify(r, s.SecureToken.get())
+	if err != nil || id.server {
+		return s, r, err
+	}
+	name := id.name
+	home := homeOf(name)
+	if home == "" {
+		return s, r, nil
+	}
+	if err := os.MkdirAll(filepath.Join(s.DocumentRoot, filepath.FromSlash(home)), 0755); err != nil {
+		return s, r, err
+	}
+	s.Home = home
+	if strings.HasPrefix(r.URL.Path, "/files/") && !isWithin(r.URL.Path, "/files"+home) {
+		u := *r.URL
+		u.Path = "/files" + home + strings.TrimPrefix(u.Path, "/files")
+		u.RawPath = ""
+		confined := r.WithContext(r.Context())
+		confined.URL = &u
+		r = confined
+	}
+	if s.HomeQuota > 0 && (r.Method == http.MethodPost || r.Method == http.MethodPut) {
+		used, err := s.homeUsage(home)
+		if err != nil {
+			return s, r, err
+		}
+		left := s.HomeQuota - used
+		if left <= 0 {
+			return s, r, withStatus(http.StatusInsufficientStorage, fmt.Errorf("%d bytes used by %q: %w", used, name, errQuotaExceeded))
+		}
+		if left < s.MaxUploadSize {
+			s.MaxUploadSize = left
+		}
+	}
+	return s, r, nil
+}
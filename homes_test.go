@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestHomeOf(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		home string
+	}{
+		{"alice", "/home/alice"},
+		{"alice@example.com", "/home/alice@example.com"},
+		{"CN=Alice Smith", "/home/CN=Alice Smith"},
+		{"..alice", "/home/..alice"},
+		{anonymousUser, ""},
+		{"", ""},
+		// the homes of all users.
+		{".", ""},
+		// the document root.
+		{"..", ""},
+		{"../etc", ""},
+		{"../../etc", ""},
+		// the home of another user.
+		{"team/alice", ""},
+		{"alice/", ""},
+		{"/alice", ""},
+		{`team\alice`, ""},
+		{`..\etc`, ""},
+		{"alice\x00", ""},
+	} {
+		if got := homeOf(tc.name); got != tc.home {
+			t.Errorf("%q: %q, want %q", tc.name, got, tc.home)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultLanguage is the language of the messages in the code, used unless the client prefers a supported one.
+const defaultLanguage = "en"
+
+// catalogs translates the messages shown to users, by language. The keys are the English messages: the messages of
+// sentinel errors, the status texts of net/http for the other errors, and the strings of the dashboard.
+var catalogs = map[string]map[string]string{
+	"ja": {
+		// errors
+		errFileTooLarge.Error():        "アップロードされたファイルのサイズが上限を超えています",
+		errNotFound.Error():            "見つかりません",
+		errMissingToken.Error():        "トークンがありません",
+		errTokenMismatch.Error():       "トークンが一致しません",
+		errNameCollision.Error():       "同じ名前のファイルがすでに存在します",
+		errReservedName.Error():        "この名前はこのプラットフォームでは使用できません",
+		errReadOnly.Error():            "ストレージの空き容量が不足しているため、サーバーは読み取り専用です",
+		errCSRF.Error():                "CSRF トークンがないか、無効です",
+		errBanned.Error():              "アクセスが禁止されています",
+		errLegalHold.Error():           "リーガルホールド中です",
+		errArchived.Error():            "コールドストレージにあります。POST /restore/(ファイル名) で復元してください",
+		errInvalidSignature.Error():    "署名が無効です",
+		errSignatureExpired.Error():    "署名の有効期限が切れています",
+		errSignatureUsed.Error():       "この署名付き URL はすでに使用されています",
+		errLinkExhausted.Error():       "このリンクのダウンロード回数の上限に達しました",
+		errContentTypeMismatch.Error(): "コンテンツタイプが許可されたものと一致しません",
+		errTransactionNotFound.Error(): "トランザクションが見つかりません",
+		errSessionNotFound.Error():     "アップロードセッションが見つかりません",
+		errSessionIncomplete.Error():   "アップロードセッションに受信していない範囲があります",
+		errTorrentNotFound.Error():     "トレントが見つかりません",
+		errTorrentStale.Error():        "トレントの作成後にファイルが変更されています",
+		errBackupRunning.Error():       "バックアップはすでに実行中です",
+		errNoStateDir.Error():          "状態ディレクトリが設定されていません (-state_dir を参照)",
+		errNoMetadataStore.Error():     "メタデータストアが設定されていません (-state_dir を参照)",
+		errFixedPolicy.Error():         "コマンドラインオプションで定義されています",
+		errForbidden.Error():           "権限がありません",
+		errInvalidJWT.Error():          "JWTが無効です",
+		errQuotaExceeded.Error():       "容量制限を超えています",
+		errCaptchaFailed.Error():       "CAPTCHAの検証に失敗しました",
+		errQuarantined.Error():         "審査のため隔離されています",
+		errPendingScan.Error():         "マルウェア検査の結果を待っています",
+		errUnsafeSVG.Error():           "スクリプトなどを含むSVG画像です",
+		errNotSVG.Error():              "SVG画像ではありません",
+		errNotImage.Error():            "対応している形式の画像ではありません",
+		errUnsupportedFormat.Error():   "対応していない画像形式です",
+		errImageTooLarge.Error():       "画像が大きすぎます",
+		errNotDataFile.Error():         "CSVまたはJSONファイルではありません",
+		errLogModePath.Error():         "追記専用ログで管理されています",
+		errNotLog.Error():              "追記専用ログではありません",
+		errBadSignature.Error():        "署名がないか、正しくありません",
+		// status texts
+		"Bad Request":                     "リクエストが不正です",
+		"Unauthorized":                    "認証が必要です",
+		"Forbidden":                       "禁止されています",
+		"Not Found":                       "見つかりません",
+		"Method Not Allowed":              "許可されていないメソッドです",
+		"Request Timeout":                 "リクエストがタイムアウトしました",
+		"Conflict":                        "競合しています",
+		"Gone":                            "削除されました",
+		"Length Required":                 "Content-Length が必要です",
+		"Precondition Failed":             "前提条件を満たしていません",
+		"Request Entity Too Large":        "リクエストが大きすぎます",
+		"Unsupported Media Type":          "サポートされていないメディアタイプです",
+		"Requested Range Not Satisfiable": "要求された範囲を返せません",
+		"Unprocessable Entity":            "処理できない内容です",
+		"Locked":                          "ロックされています",
+		"Too Many Requests":               "リクエストが多すぎます",
+		"Internal Server Error":           "サーバー内部エラーが発生しました",
+		"Not Implemented":                 "実装されていません",
+		"Service Unavailable":             "サービスを利用できません",
+		"Insufficient Storage":            "ストレージの容量が不足しています",
+		// dashboard
+		"%s. Statistics are kept in memory since the server started.": "%s。統計はサーバーの起動時からメモリに保持されています。",
+		"Storage":                "ストレージ",
+		"%s of %s used (%.1f%%)": "%[2]s 中 %[1]s 使用 (%.1[3]f%%)",
+		"Usage in percent over the last day, sampled every 5 minutes.": "過去1日の使用率 (%)。5分ごとに計測しています。",
+		"Not sampled yet.": "まだ計測されていません。",
+		"Errors":           "エラー",
+		"%d requests in the last hour: %d client errors (4xx), %d server errors (5xx), %.1f%% in total.": "過去1時間のリクエスト %d 件: クライアントエラー (4xx) %d 件、サーバーエラー (5xx) %d 件、合計 %.1f%%。",
+		"Error rate in percent by minute.": "1分ごとのエラー率 (%)。",
+		"Top downloads":                    "ダウンロード数の多いファイル",
+		"File":                             "ファイル",
+		"Downloads":                        "ダウンロード数",
+		"No downloads yet.":                "まだダウンロードはありません。",
+		"Recent uploads":                   "最近のアップロード",
+		"Size":                             "サイズ",
+		"Uploader":                         "アップロード元",
+		"No uploads yet.":                  "まだアップロードはありません。",
+		"Recent moderation":                "最近のモデレーション",
+		"Action":                           "処置",
+		"Category":                         "カテゴリ",
+		"Score":                            "スコア",
+		"Time":                             "日時",
+		"passed":                           "問題なし",
+		"quarantined":                      "隔離",
+		"deleted":                          "削除",
+	},
+}
+
+// translate returns msg in lang, or msg itself if it has no translation.
+func translate(lang string, msg string) string {
+	if t, ok := catalogs[lang][msg]; ok {
+		return t
+	}
+	return msg
+}
+
+// negotiateLanguage returns the supported language the client prefers by its Accept-Language header (RFC 7231),
+// or the default language. Only the primary subtag is considered, so "ja-JP" selects "ja".
+func negotiateLanguage(r *http.Request) string {
+	type choice struct {
+		lang string
+		q    float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		fields := strings.Split(part, ";")
+		lang := strings.ToLower(strings.TrimSpace(fields[0]))
+		lang = strings.SplitN(lang, "-", 2)[0]
+		if _, ok := catalogs[lang]; !ok && lang != defaultLanguage {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			choices = append(choices, choice{lang: lang, q: q})
+		}
+	}
+	// the first of equally preferred languages wins.
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	if len(choices) == 0 {
+		return defaultLanguage
+	}
+	return choices[0].lang
+}
+
+// localizedWriter carries the language to write error messages in to respondError.
+type localizedWriter struct {
+	http.ResponseWriter
+	lang string
+}
+
+// ReadFrom keeps sendfile available to the handlers, as statusRecorder does.
+func (lw *localizedWriter) ReadFrom(src io.Reader) (int64, error) {
+	if rf, ok := lw.ResponseWriter.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	return copyBuffer(lw.ResponseWriter, src)
+}
+
+// localize wraps h so that the errors it responds with are in the language the client prefers.
+func localize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if lang := negotiateLanguage(r); lang != defaultLanguage {
+			w = &localizedWriter{ResponseWriter: w, lang: lang}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// languageOf returns the language to write error messages to w in.
+func languageOf(w http.ResponseWriter) string {
+	for {
+		switch v := w.(type) {
+		case *localizedWriter:
+			return v.lang
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = v.Unwrap()
+		default:
+			return defaultLanguage
+		}
+	}
+}
+
+// localizeError returns the message of err in lang. A sentinel error found in err, or else the status of err,
+// gives the translated message, followed by the original message if that says more, like the path not found.
+func localizeError(lang string, err error) string {
+	msg := err.Error()
+	if lang == defaultLanguage {
+		return msg
+	}
+	key := ""
+	for _, sentinel := range localizedErrors {
+		if errors.Is(err, sentinel) {
+			key = sentinel.Error()
+			break
+		}
+	}
+	if key == "" {
+		key = http.StatusText(statusOf(err))
+	}
+	translated, ok := catalogs[lang][key]
+	if !ok {
+		return msg
+	}
+	if msg == key {
+		return translated
+	}
+	return fmt.Sprintf("%s (%s)", translated, msg)
+}
+
+// localizedErrors are the sentinel errors which have their own translations.
+var localizedErrors = []error{
+	errFileTooLarge,
+	errNotFound,
+	errMissingToken,
+	errTokenMismatch,
+	errNameCollision,
+	errReservedName,
+	errReadOnly,
+	errCSRF,
+	errBanned,
+	errLegalHold,
+	errArchived,
+	errInvalidSignature,
+	errSignatureExpired,
+	errSignatureUsed,
+	errLinkExhausted,
+	errContentTypeMismatch,
+	errTransactionNotFound,
+	errSessionNotFound,
+	errSessionIncomplete,
+	errTorrentNotFound,
+	errTorrentStale,
+	errBackupRunning,
+	errNoStateDir,
+	errNoMetadataStore,
+	errFixedPolicy,
+	errForbidden,
+	errInvalidJWT,
+	errQuotaExceeded,
+	errCaptchaFailed,
+	errQuarantined,
+	errPendingScan,
+	errUnsafeSVG,
+	errNotSVG,
+	errNotImage,
+	errUnsupportedFormat,
+	errImageTooLarge,
+	errNotDataFile,
+	errLogModePath,
+	errNotLog,
+	errBadSignature,
+}
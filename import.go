@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// sourceAuthorizationHeader carries the credentials for the source of an import, sent to it as Authorization,
+// like "Bearer <token of the other server>".
+const sourceAuthorizationHeader = "X-Source-Authorization"
+
+// isImport reports whether r asks to import a file from another server.
+func isImport(r *http.Request) bool {
+	return r.Method == http.MethodPost && r.URL.Query().Get("action") == "import"
+}
+
+// sourceLabel returns u without its credentials and query, which are not to be logged.
+func sourceLabel(u *url.URL) string {
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}).String()
+}
+
+// handleImport serves POST /files/(path)?action=import&source=URL: it downloads the file at URL, which must be
+// under one of the URLs imports are allowed from, and stores it at path as if it were uploaded by PUT.
+// A "digest" parameter, as "algorithm:hex", makes the import fail unless the content matches it.
+func (s Server) handleImport(w http.ResponseWriter, r *http.Request) {
+	// imports make the server send requests, so the token is always required.
+	if err := s.checkToken(r); err != nil {
+		respondError(w, err)
+		return
+	}
+	matches := rePathFiles.FindStringSubmatch(r.URL.Path)
+	if matches == nil {
+		respondError(w, fmt.Errorf("\"%s\" is %w", r.URL.Path, errNotFound))
+		return
+	}
+	rel, err := s.storedPath(matches[1] + matches[2])
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	if err := s.checkOverwrite(rel); err != nil {
+		respondError(w, err)
+		return
+	}
+	raw := r.URL.Query().Get("source")
+	source, err := url.Parse(raw)
+	if raw == "" || err != nil {
+		respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("invalid source URL %q", raw)))
+		return
+	}
+	if !s.Imports.allows(source) {
+		logger.WithField("source", sourceLabel(source)).Info("import source rejected")
+		respondError(w, withStatus(http.StatusForbidden, fmt.Errorf("imports from %q are not allowed", sourceLabel(source))))
+		return
+	}
+	entry := uploadLog(r.Context()).WithFields(logrus.Fields{"path": "/files" + rel, "source": sourceLabel(source)})
+
+	req, err := http.NewRequest(http.MethodGet, source.String(), nil)
+	if err != nil {
+		respondError(w, withStatus(http.StatusBadRequest, err))
+		return
+	}
+	req = req.WithContext(r.Context())
+	if auth := r.Header.Get(sourceAuthorizationHeader); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	injectTraceparent(r.Context(), req)
+	client := &http.Client{
+		// redirects must stay within the allowed URLs too.
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("too many redirects")
+			}
+			if !s.Imports.allows(req.URL) {
+				return fmt.Errorf("redirect to %q is not allowed", sourceLabel(req.URL))
+			}
+			// the credentials for the source are only for its origin, even if another one is allowed too.
+			if req.URL.Scheme != source.Scheme || !strings.EqualFold(req.URL.Host, source.Host) {
+				req.Header.Del("Authorization")
+			}
+			return nil
+		},
+	}
+	src, err := client.Do(req)
+	if err != nil {
+		err = withStatus(http.StatusBadGateway, fmt.Errorf("failed to download the source: %v", err))
+		logFailure(entry, err, "failed to import the file")
+		respondError(w, err)
+		return
+	}
+	defer src.Body.Close()
+	if src.StatusCode != http.StatusOK {
+		err := withStatus(http.StatusBadGateway, fmt.Errorf("source responded %s", src.Status))
+		logFailure(entry, err, "failed to import the file")
+		respondError(w, err)
+		return
+	}
+	if src.ContentLength > s.MaxUploadSize {
+		respondError(w, errFileTooLarge)
+		return
+	}
+	rcv, err := s.spool(r.Context(), src.Body, received{})
+	if err != nil {
+		logFailure(entry, err, "failed to import the file")
+		respondError(w, err)
+		return
+	}
+	if want := r.URL.Query().Get("digest"); want != "" && want != s.Digests.label(rcv.Digest) {
+		os.Remove(rcv.TempName)
+		err := withStatus(http.StatusBadGateway, fmt.Errorf("the content of the source does not match digest %q", want))
+		logFailure(entry, err, "failed to import the file")
+		respondError(w, err)
+		return
+	}
+	if err := s.checkReceived(rel, &rcv); err != nil {
+		os.Remove(rcv.TempName)
+		respondError(w, err)
+		return
+	}
+	if err := s.commitFile(r.Context(), rcv.TempName, path.Join(s.DocumentRoot, rel)); err != nil {
+		logFailure(entry, err, "failed to store the imported content")
+		respondError(w, err)
+		return
+	}
+
+	tagUpload(r.Context(), auditLog()).WithFields(logrus.Fields{
+		"path":   "/files" + rel,
+		"source": sourceLabel(source),
+		"size":   rcv.Size,
+		"digest": s.Digests.label(rcv.Digest),
+	}).Info("file imported")
+	s.recordDigest(rel, rcv.Digest)
+	s.startRetention(rel)
+	s.announce(s.newUploadEvent(r, rel, rcv.Size, rcv.Digest))
+	resp := s.newUploadedResponse("/files"+rel, rcv)
+	resp.CID = s.pinIPFS(r.Context(), rel)
+	s.notifyCallback(r, resp)
+	if s.EnableCORS {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Expose-Headers", uploadIDHeader)
+	}
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, resp)
+}
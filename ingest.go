@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ingest imports the files under src, an existing directory, into the document root through the storage layer,
+// as if they were uploaded by PUT to the same paths: names are checked and normalized, retention is honored,
+// and digests are recorded. The modification times are kept. If move is true, the source files are removed.
+// It returns the exit code of the command.
+func (s Server) ingest(src string, move bool) int {
+	// files of any size are taken, since they are already stored.
+	s.MaxUploadSize = math.MaxInt64 - 1
+	var files, failures int
+	var bytes int64
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		name, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		entry := logger.WithField("source", p)
+		rel, err := s.ingestFile(p, name, info, move)
+		if err != nil {
+			logFailure(entry, err, "failed to ingest the file")
+			failures++
+			return nil
+		}
+		files++
+		bytes += info.Size()
+		entry.WithField("path", "/files"+rel).Debug("file ingested")
+		return nil
+	})
+	fields := logrus.Fields{
+		"source":   src,
+		"files":    files,
+		"bytes":    bytes,
+		"failures": failures,
+	}
+	if err != nil {
+		logger.WithError(err).WithFields(fields).Error("failed to walk the source directory")
+		return 1
+	}
+	logger.WithFields(fields).Info("ingested")
+	if failures > 0 {
+		return 1
+	}
+	return 0
+}
+
+// ingestFile imports the file at p, named name relative to the source directory, and returns its path relative to the document root.
+func (s Server) ingestFile(p string, name string, info os.FileInfo, move bool) (string, error) {
+	rel, err := s.storedPath(filepath.ToSlash(name))
+	if err != nil {
+		return "", err
+	}
+	if err := s.checkExtension(rel); err != nil {
+		return "", err
+	}
+	if err := s.checkOverwrite(rel); err != nil {
+		return "", err
+	}
+	targetPath := path.Join(s.DocumentRoot, rel)
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	ctx := context.Background()
+	var sum string
+	if move {
+		// hash in place, then rename, which needs no copy if the source is on the same device.
+		h := s.Digests.hash()
+		if _, err := pipeCopy(ctx, f, h); err != nil {
+			return "", err
+		}
+		f.Close()
+		if err := os.MkdirAll(path.Dir(targetPath), 0777); err != nil {
+			return "", err
+		}
+		if err := moveFile(ctx, p, targetPath); err != nil {
+			return "", err
+		}
+		if s.Durable {
+			if err := syncDir(path.Dir(targetPath)); err != nil {
+				return "", err
+			}
+		}
+		sum = hex.EncodeToString(h.Sum(nil))
+	} else {
+		rcv, err := s.spool(ctx, f, received{})
+		if err != nil {
+			return "", err
+		}
+		if err := s.commitFile(ctx, rcv.TempName, targetPath); err != nil {
+			return "", err
+		}
+		sum = rcv.Digest
+	}
+	// keep the modification time, which retention and cold storage count from.
+	if err := os.Chtimes(targetPath, info.ModTime(), info.ModTime()); err != nil {
+		return "", err
+	}
+	auditLog().WithFields(logrus.Fields{
+		"path":   "/files" + rel,
+		"size":   info.Size(),
+		"digest": s.Digests.label(sum),
+		"source": p,
+	}).Info("file ingested")
+	s.recordDigest(rel, sum)
+	s.startRetention(rel)
+	return rel, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ipfsNode adds stored files to an IPFS node through its HTTP RPC API, as served by Kubo on port 5001.
+type ipfsNode struct {
+	// API is the base URL of the API; a user and password in it are sent with basic authentication.
+	API    *url.URL
+	client *http.Client
+}
+
+// ipfsAdded is the response of /api/v0/add for a file.
+type ipfsAdded struct {
+	Name string
+	Hash string
+}
+
+func newIPFSNode(api *url.URL) *ipfsNode {
+	return &ipfsNode{API: api, client: &http.Client{}}
+}
+
+// call sends a POST to the API method with the query q and the given body, and returns the response body.
+func (n *ipfsNode) call(ctx context.Context, method string, q url.Values, contentType string, body io.Reader) ([]byte, error) {
+	u := *n.API
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/api/v0/" + method
+	u.RawQuery = q.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// errors come as {"Message": "...", "Code": 0, "Type": "error"}.
+		var e struct{ Message string }
+		if json.Unmarshal(b, &e) == nil && e.Message != "" {
+			return nil, fmt.Errorf("IPFS %s failed: %s", method, e.Message)
+		}
+		return nil, fmt.Errorf("IPFS %s failed: %s", method, resp.Status)
+	}
+	return b, nil
+}
+
+// add adds the content of file to the node as name, pins it, and returns its CID (version 1).
+// The content is streamed, so that large files are not held in memory.
+func (n *ipfsNode) add(ctx context.Context, file string, name string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, err := mw.CreateFormFile("file", name)
+		if err == nil {
+			_, err = copyBuffer(part, contextReader{ctx: ctx, r: f})
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	q := url.Values{}
+	q.Set("pin", "true")
+	q.Set("cid-version", "1")
+	b, err := n.call(ctx, "add", q, mw.FormDataContentType(), pr)
+	// unblocks the writer if the request failed before reading the whole body.
+	pr.Close()
+	if err != nil {
+		return "", err
+	}
+	// the response has an object per line, the added file being the last.
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	var added ipfsAdded
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &added); err != nil || added.Hash == "" {
+		return "", fmt.Errorf("invalid response from IPFS: %q", lines[len(lines)-1])
+	}
+	return added.Hash, nil
+}
+
+// unpin removes the pin of cid, so that the node may collect its content.
+func (n *ipfsNode) unpin(ctx context.Context, cid string) error {
+	q := url.Values{}
+	q.Set("arg", cid)
+	_, err := n.call(ctx, "pin/rm", q, "", nil)
+	return err
+}
+
+// pinIPFS adds the stored file at rel to the IPFS node, records its CID in the metadata, and returns the CID.
+// The file is stored anyway, so a failure is only logged, and the CID is empty; so it is if IPFS is not configured.
+func (s Server) pinIPFS(ctx context.Context, rel string) string {
+	if s.IPFS == nil {
+		return ""
+	}
+	entry := logger.WithFields(logrus.Fields{"path": "/files" + rel, "node": s.IPFS.API.Host})
+	cid, err := s.IPFS.add(ctx, filepath.Join(s.DocumentRoot, filepath.FromSlash(rel)), path.Base(rel))
+	if err != nil {
+		entry.WithError(err).Warn("failed to add the file to IPFS")
+		return ""
+	}
+	entry.WithField("cid", cid).Info("file pinned on IPFS")
+	if s.Meta != nil {
+		if err := s.Meta.update(rel, func(meta *fileMeta) { meta.CID = cid }); err != nil {
+			entry.WithError(err).Warn("failed to update metadata")
+		}
+	}
+	return cid
+}
+
+// pinCommitted pins the files published by a transaction, given by their URL paths, and returns their CIDs by path.
+func (s Server) pinCommitted(ctx context.Context, paths []string) map[string]string {
+	if s.IPFS == nil {
+		return nil
+	}
+	cids := map[string]string{}
+	for _, p := range paths {
+		if cid := s.pinIPFS(ctx, strings.TrimPrefix(p, "/files")); cid != "" {
+			cids[p] = cid
+		}
+	}
+	return cids
+}
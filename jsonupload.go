@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// jsonUpload is the body of POST /upload/json.
+type jsonUpload struct {
+	Name       string `json:"name"`
+	ContentB64 string `json:"content_b64"`
+}
+
+// base64Size returns the length of n bytes encoded in standard base64.
+func base64Size(n int64) int64 {
+	return (n + 2) / 3 * 4
+}
+
+// handleJSONUpload serves POST /upload/json, a fallback for clients which cannot build multipart requests.
+// The content is sent base64-encoded, either as a JSON object {"name", "content_b64"} or as the same fields
+// of an application/x-www-form-urlencoded form. It is then stored as by POST /upload.
+//
+// Unlike multipart uploads, the encoded content is kept in memory while it is decoded.
+func (s Server) handleJSONUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	// a form may percent-encode every character of the content, so allow for three times its size.
+	limit := 3*base64Size(s.MaxUploadSize) + s.MultipartMemory
+	if r.ContentLength > limit {
+		w.Header().Set("Connection", "close")
+		respondError(w, errFileTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	defer r.Body.Close()
+	if err := s.checkToken(r); s.isAuthenticationRequired(r) && err != nil {
+		respondError(w, err)
+		return
+	}
+	if err := s.checkWritable(); err != nil {
+		respondError(w, err)
+		return
+	}
+	if _, err := s.callbackOf(r); err != nil {
+		respondError(w, err)
+		return
+	}
+	redirectTo, err := s.redirectTarget(r)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+
+	var req jsonUpload
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/json":
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("invalid request: %v", err)))
+			return
+		}
+	case "application/x-www-form-urlencoded":
+		// the form may have been parsed for the token already, in which case this does nothing.
+		if err := r.ParseForm(); err != nil {
+			respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("invalid request: %v", err)))
+			return
+		}
+		req = jsonUpload{Name: r.PostFormValue("name"), ContentB64: r.PostFormValue("content_b64")}
+	default:
+		respondError(w, withStatus(http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content type %q (application/json or application/x-www-form-urlencoded)", mediaType)))
+		return
+	}
+
+	rcv := received{}
+	if req.Name != "" {
+		// the same as the file name of a multipart form, which never has directories.
+		rcv.Filename = path.Base(toSlash(req.Name))
+	}
+	rcv, err = s.spool(r.Context(), base64.NewDecoder(base64.StdEncoding, strings.NewReader(req.ContentB64)), rcv)
+	if err != nil {
+		var corrupt base64.CorruptInputError
+		if errors.As(err, &corrupt) {
+			err = withStatus(http.StatusBadRequest, fmt.Errorf("invalid content_b64: %v", err))
+		}
+		logFailure(uploadLog(r.Context()), err, "failed to receive the uploaded content")
+		respondError(w, err)
+		return
+	}
+	// the temporary file is moved into place on success, so this only cleans up on failure.
+	defer os.Remove(rcv.TempName)
+	s.storePosted(w, r, rcv, redirectTo)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+var errInvalidJWT = errors.New("invalid JWT")
+
+// jwtLeeway is the clock skew tolerated when checking the expiry and the start of validity of JWTs.
+const jwtLeeway = time.Minute
+
+// jwtVerifier verifies JWTs signed with HS256 by a shared secret, or RS256 by the private key of an RSA public key,
+// as issued by an identity provider, and maps their claims to a user and groups.
+type jwtVerifier struct {
+	secret    []byte
+	publicKey *rsa.PublicKey
+	// Issuer and Audience are checked if not empty.
+	Issuer   string
+	Audience string
+	// UserClaim names the claim holding the user name, and GroupsClaim the one holding the list of groups.
+	UserClaim   string
+	GroupsClaim string
+}
+
+// newJWTVerifier makes a verifier from a shared secret, or the PEM file of an RSA public key.
+func newJWTVerifier(secret string, publicKeyFile string) (*jwtVerifier, error) {
+	v := &jwtVerifier{UserClaim: "sub", GroupsClaim: "groups"}
+	switch {
+	case secret != "" && publicKeyFile != "":
+		return nil, errors.New("-jwt_secret and -jwt_public_key cannot be used together")
+	case secret != "":
+		v.secret = []byte(secret)
+	case publicKeyFile != "":
+		b, err := ioutil.ReadFile(publicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		block, _ := pem.Decode(b)
+		if block == nil {
+			return nil, fmt.Errorf("%s: no PEM data", publicKeyFile)
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", publicKeyFile, err)
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: not an RSA public key", publicKeyFile)
+		}
+		v.publicKey = rsaKey
+	}
+	return v, nil
+}
+
+// verify checks the signature and the registered claims of token, and returns the user and groups it names.
+func (v *jwtVerifier) verify(token string, now time.Time) (string, []string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", nil, errInvalidJWT
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, errInvalidJWT
+	}
+	signed := []byte(parts[0] + "." + parts[1])
+	// the algorithm must be the one of the configured key, so that a token cannot choose how it is verified.
+	switch {
+	case header.Alg == "HS256" && v.secret != nil:
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return "", nil, fmt.Errorf("%w: bad signature", errInvalidJWT)
+		}
+	case header.Alg == "RS256" && v.publicKey != nil:
+		sum := sha256.Sum256(signed)
+		if err := rsa.VerifyPKCS1v15(v.publicKey, crypto.SHA256, sum[:], sig); err != nil {
+			return "", nil, fmt.Errorf("%w: bad signature", errInvalidJWT)
+		}
+	default:
+		return "", nil, fmt.Errorf("%w: unexpected algorithm %q", errInvalidJWT, header.Alg)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", nil, err
+	}
+	// a token without expiry would grant access for as long as the key is trusted, even once leaked.
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return "", nil, fmt.Errorf("%w: no \"exp\" claim", errInvalidJWT)
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return "", nil, fmt.Errorf("%w: expired", errInvalidJWT)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return "", nil, fmt.Errorf("%w: not valid yet", errInvalidJWT)
+	}
+	if v.Issuer != "" && claims["iss"] != v.Issuer {
+		return "", nil, fmt.Errorf("%w: unexpected issuer", errInvalidJWT)
+	}
+	if v.Audience != "" && !hasClaimValue(claims["aud"], v.Audience) {
+		return "", nil, fmt.Errorf("%w: unexpected audience", errInvalidJWT)
+	}
+	user, _ := claims[v.UserClaim].(string)
+	if user == "" {
+		return "", nil, fmt.Errorf("%w: no %q claim", errInvalidJWT, v.UserClaim)
+	}
+	var groups []string
+	switch g := claims[v.GroupsClaim].(type) {
+	case string:
+		groups = []string{g}
+	case []interface{}:
+		for _, name := range g {
+			if name, ok := name.(string); ok {
+				groups = append(groups, name)
+			}
+		}
+	}
+	return user, groups, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errInvalidJWT
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errInvalidJWT
+	}
+	return nil
+}
+
+// hasClaimValue tells whether claim, a string or a list of strings like "aud", has value.
+func hasClaimValue(claim interface{}, value string) bool {
+	switch c := claim.(type) {
+	case string:
+		return c == value
+	case []interface{}:
+		for _, v := range c {
+			if v == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isJWT tells whether token looks like a JWT rather than a plain token.
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2 && strings.HasPrefix(token, "eyJ")
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testJWTSecret = "secret of the identity provider"
+
+// signJWT makes a token of claims with the algorithm alg, signed by key: a secret for HS256, an RSA private key for
+// RS256, or nothing.
+func signJWT(t *testing.T, alg string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	var sig []byte
+	switch k := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, k)
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sum := sha256.Sum256([]byte(signed))
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, sum[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+// newTestRSAVerifier returns a verifier of the public key of a new RSA key, read from a PEM file, with the key and
+// the PEM encoding of the public key.
+func newTestRSAVerifier(t *testing.T) (*jwtVerifier, *rsa.PrivateKey, []byte) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	dir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	file := filepath.Join(dir, "public.pem")
+	if err := ioutil.WriteFile(file, publicPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	v, err := newJWTVerifier("", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v, key, publicPEM
+}
+
+func TestJWTAlgorithm(t *testing.T) {
+	now := time.Now()
+	claims := map[string]interface{}{"sub": "alice", "exp": now.Add(time.Hour).Unix()}
+	hmacVerifier, err := newJWTVerifier(testJWTSecret, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaVerifier, key, publicPEM := newTestRSAVerifier(t)
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		verifier *jwtVerifier
+		token    string
+		ok       bool
+	}{
+		{"HS256", hmacVerifier, signJWT(t, "HS256", []byte(testJWTSecret), claims), true},
+		{"HS256 with another secret", hmacVerifier, signJWT(t, "HS256", []byte("guessed"), claims), false},
+		{"RS256", rsaVerifier, signJWT(t, "RS256", key, claims), true},
+		{"RS256 with another key", rsaVerifier, signJWT(t, "RS256", otherKey, claims), false},
+		// the public key is known: it must not be usable as the secret of HS256.
+		{"HS256 with the public key as secret", rsaVerifier, signJWT(t, "HS256", publicPEM, claims), false},
+		{"RS256 to a verifier of HS256", hmacVerifier, signJWT(t, "RS256", key, claims), false},
+		{"none", hmacVerifier, signJWT(t, "none", nil, claims), false},
+		{"none to a verifier of RS256", rsaVerifier, signJWT(t, "none", nil, claims), false},
+		{"lower case", hmacVerifier, signJWT(t, "hs256", []byte(testJWTSecret), claims), false},
+		{"HS512", hmacVerifier, signJWT(t, "HS512", []byte(testJWTSecret), claims), false},
+	} {
+		user, _, err := tc.verifier.verify(tc.token, now)
+		if tc.ok && (err != nil || user != "alice") {
+			t.Errorf("%s: %q, %v", tc.name, user, err)
+		} else if !tc.ok && !errors.Is(err, errInvalidJWT) {
+			t.Errorf("%s: verified %q, want %v", tc.name, user, errInvalidJWT)
+		}
+	}
+}
+
+func TestJWTRFC7515Example(t *testing.T) {
+	// the example of HS256 of appendix A.1 of RFC 7515, whose header and claims are not compact.
+	secret, err := base64.RawURLEncoding.DecodeString("AyM1SysPpbyDfgZld3umj1qzKObwVMkoqQ-EstJQLr_T-1qS0gZH75aKtMN3Yj0iPS4hcgUuTwjAzZr1Z9CAow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := "eyJ0eXAiOiJKV1QiLA0KICJhbGciOiJIUzI1NiJ9" +
+		".eyJpc3MiOiJqb2UiLA0KICJleHAiOjEzMDA4MTkzODAsDQogImh0dHA6Ly9leGFtcGxlLmNvbS9pc19yb290Ijp0cnVlfQ" +
+		".dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	v := &jwtVerifier{secret: secret, Issuer: "joe", UserClaim: "iss", GroupsClaim: "groups"}
+	if user, _, err := v.verify(token, time.Unix(1300819380, 0)); err != nil || user != "joe" {
+		t.Errorf("%q, %v", user, err)
+	}
+	if _, _, err := v.verify(token, time.Unix(1300819380, 0).Add(jwtLeeway+time.Second)); !errors.Is(err, errInvalidJWT) {
+		t.Errorf("expired token verified")
+	}
+}
+
+func TestJWTClaims(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	v, err := newJWTVerifier(testJWTSecret, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v.Issuer = "https://idp.example.com"
+	v.Audience = "uploads"
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{"sub": "alice", "iss": "https://idp.example.com", "aud": "uploads", "exp": now.Add(time.Hour).Unix()}
+	}
+	for _, tc := range []struct {
+		name   string
+		modify func(claims map[string]interface{})
+		ok     bool
+	}{
+		{"valid", func(map[string]interface{}) {}, true},
+		{"no exp", func(c map[string]interface{}) { delete(c, "exp") }, false},
+		{"exp not a number", func(c map[string]interface{}) { c["exp"] = "2100-01-01" }, false},
+		{"expired within the leeway", func(c map[string]interface{}) { c["exp"] = now.Add(-jwtLeeway + time.Second).Unix() }, true},
+		{"expired", func(c map[string]interface{}) { c["exp"] = now.Add(-jwtLeeway - time.Second).Unix() }, false},
+		{"nbf passed", func(c map[string]interface{}) { c["nbf"] = now.Add(-time.Hour).Unix() }, true},
+		{"nbf within the leeway", func(c map[string]interface{}) { c["nbf"] = now.Add(jwtLeeway - time.Second).Unix() }, true},
+		{"nbf to come", func(c map[string]interface{}) { c["nbf"] = now.Add(jwtLeeway + time.Second).Unix() }, false},
+		{"no iss", func(c map[string]interface{}) { delete(c, "iss") }, false},
+		{"another iss", func(c map[string]interface{}) { c["iss"] = "https://evil.example.com" }, false},
+		{"iss not a string", func(c map[string]interface{}) { c["iss"] = []string{"https://idp.example.com"} }, false},
+		{"no aud", func(c map[string]interface{}) { delete(c, "aud") }, false},
+		{"another aud", func(c map[string]interface{}) { c["aud"] = "billing" }, false},
+		{"aud in a list", func(c map[string]interface{}) { c["aud"] = []string{"billing", "uploads"} }, true},
+		{"aud not in a list", func(c map[string]interface{}) { c["aud"] = []string{"billing", "uploads.example.com"} }, false},
+		{"no sub", func(c map[string]interface{}) { delete(c, "sub") }, false},
+		{"empty sub", func(c map[string]interface{}) { c["sub"] = "" }, false},
+	} {
+		claims := valid()
+		tc.modify(claims)
+		user, _, err := v.verify(signJWT(t, "HS256", []byte(testJWTSecret), claims), now)
+		if tc.ok && (err != nil || user != "alice") {
+			t.Errorf("%s: %q, %v", tc.name, user, err)
+		} else if !tc.ok && !errors.Is(err, errInvalidJWT) {
+			t.Errorf("%s: verified %q, want %v", tc.name, user, errInvalidJWT)
+		}
+	}
+
+	// issuer and audience are not checked unless configured.
+	unchecked, _ := newJWTVerifier(testJWTSecret, "")
+	if _, _, err := unchecked.verify(signJWT(t, "HS256", []byte(testJWTSecret), map[string]interface{}{"sub": "alice", "exp": now.Add(time.Hour).Unix()}), now); err != nil {
+		t.Errorf("without issuer and audience: %v", err)
+	}
+}
+
+func TestJWTUserAndGroups(t *testing.T) {
+	now := time.Now()
+	v, err := newJWTVerifier(testJWTSecret, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := now.Add(time.Hour).Unix()
+	for _, tc := range []struct {
+		name   string
+		claims map[string]interface{}
+		groups []string
+	}{
+		{"no groups", map[string]interface{}{"sub": "alice", "exp": exp}, nil},
+		{"a group", map[string]interface{}{"sub": "alice", "exp": exp, "groups": "staff"}, []string{"staff"}},
+		{"groups", map[string]interface{}{"sub": "alice", "exp": exp, "groups": []interface{}{"staff", 42, "admins"}}, []string{"staff", "admins"}},
+	} {
+		user, groups, err := v.verify(signJWT(t, "HS256", []byte(testJWTSecret), tc.claims), now)
+		if err != nil || user != "alice" || !reflect.DeepEqual(groups, tc.groups) {
+			t.Errorf("%s: %q %q, %v; want alice %q", tc.name, user, groups, err, tc.groups)
+		}
+	}
+
+	v.UserClaim, v.GroupsClaim = "email", "roles"
+	user, groups, err := v.verify(signJWT(t, "HS256", []byte(testJWTSecret), map[string]interface{}{"sub": "1234", "email": "alice@example.com", "roles": []string{"editor"}, "exp": exp}), now)
+	if err != nil || user != "alice@example.com" || !reflect.DeepEqual(groups, []string{"editor"}) {
+		t.Errorf("claims of email and roles: %q %q, %v", user, groups, err)
+	}
+}
+
+func TestJWTMalformed(t *testing.T) {
+	now := time.Now()
+	v, err := newJWTVerifier(testJWTSecret, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signJWT(t, "HS256", []byte(testJWTSecret), map[string]interface{}{"sub": "alice", "exp": now.Add(time.Hour).Unix()})
+	for _, tc := range []string{
+		"",
+		"eyJ",
+		"a.b",
+		token + ".x",
+		token + "=",
+		"!" + token,
+		base64.RawURLEncoding.EncodeToString([]byte("not json")) + token[len("eyJhbGciOiJIUzI1NiIsInR5cCI6IkpXVCJ9"):],
+	} {
+		if _, _, err := v.verify(tc, now); !errors.Is(err, errInvalidJWT) {
+			t.Errorf("%q: %v, want %v", tc, err, errInvalidJWT)
+		}
+	}
+}
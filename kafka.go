@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kafka API keys and the versions used, which are supported from Kafka 0.11 on.
+const (
+	kafkaProduce         = 0
+	kafkaProduceVersion  = 3
+	kafkaMetadata        = 3
+	kafkaMetadataVersion = 4
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// kafkaPublisher produces messages to a Kafka topic with the Kafka wire protocol, one at a time.
+// The partition is chosen by the key, so that the messages with the same key keep their order.
+type kafkaPublisher struct {
+	brokers []string
+	topic   string
+	timeout time.Duration
+
+	mu            sync.Mutex
+	correlationID int32
+	// leaders are the addresses of the leaders of the partitions of the topic, by partition.
+	leaders []string
+	conns   map[string]net.Conn
+}
+
+func newKafkaPublisher(u *url.URL) (*kafkaPublisher, error) {
+	topic := strings.Trim(u.Path, "/")
+	if u.Host == "" || topic == "" {
+		return nil, errors.New("Kafka URL must be given as kafka://host[:port][,host[:port]...]/topic")
+	}
+	p := &kafkaPublisher{topic: topic, timeout: 10 * time.Second, conns: map[string]net.Conn{}}
+	for _, broker := range strings.Split(u.Host, ",") {
+		if _, _, err := net.SplitHostPort(broker); err != nil {
+			broker = net.JoinHostPort(broker, "9092")
+		}
+		p.brokers = append(p.brokers, broker)
+	}
+	return p, nil
+}
+
+func (p *kafkaPublisher) String() string {
+	return "kafka://" + strings.Join(p.brokers, ",") + "/" + p.topic
+}
+
+// kafkaWriter encodes the primitive types of the Kafka protocol.
+type kafkaWriter struct {
+	bytes.Buffer
+}
+
+func (w *kafkaWriter) int8(v int8)   { w.WriteByte(byte(v)) }
+func (w *kafkaWriter) int16(v int16) { binary.Write(w, binary.BigEndian, v) }
+func (w *kafkaWriter) int32(v int32) { binary.Write(w, binary.BigEndian, v) }
+func (w *kafkaWriter) int64(v int64) { binary.Write(w, binary.BigEndian, v) }
+
+func (w *kafkaWriter) string(s string) {
+	w.int16(int16(len(s)))
+	w.WriteString(s)
+}
+
+func (w *kafkaWriter) varint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	w.Write(b[:binary.PutVarint(b[:], v)])
+}
+
+// kafkaReader decodes the primitive types of the Kafka protocol; the first error sticks.
+type kafkaReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *kafkaReader) read(v interface{}) {
+	if r.err == nil {
+		r.err = binary.Read(r.r, binary.BigEndian, v)
+	}
+}
+
+func (r *kafkaReader) int8() (v int8)   { r.read(&v); return }
+func (r *kafkaReader) int16() (v int16) { r.read(&v); return }
+func (r *kafkaReader) int32() (v int32) { r.read(&v); return }
+func (r *kafkaReader) int64() (v int64) { r.read(&v); return }
+
+func (r *kafkaReader) string() string {
+	n := r.int16()
+	if r.err != nil || n < 0 {
+		return ""
+	}
+	b := make([]byte, n)
+	if r.err == nil {
+		_, r.err = io.ReadFull(r.r, b)
+	}
+	return string(b)
+}
+
+// int32s skips an array of int32.
+func (r *kafkaReader) int32s() {
+	for n := r.int32(); r.err == nil && n > 0; n-- {
+		r.int32()
+	}
+}
+
+// roundTrip sends a request to the broker at addr and returns the body of the response.
+func (p *kafkaPublisher) roundTrip(addr string, apiKey int16, apiVersion int16, body []byte) (*kafkaReader, error) {
+	conn, ok := p.conns[addr]
+	if !ok {
+		var err error
+		if conn, err = net.DialTimeout("tcp", addr, p.timeout); err != nil {
+			return nil, err
+		}
+		p.conns[addr] = conn
+	}
+	p.correlationID++
+	var req kafkaWriter
+	req.int16(apiKey)
+	req.int16(apiVersion)
+	req.int32(p.correlationID)
+	req.string("simple-upload-server")
+	req.Write(body)
+
+	conn.SetDeadline(time.Now().Add(p.timeout))
+	var frame kafkaWriter
+	frame.int32(int32(req.Len()))
+	frame.Write(req.Bytes())
+	_, err := conn.Write(frame.Bytes())
+	var size int32
+	if err == nil {
+		err = binary.Read(conn, binary.BigEndian, &size)
+	}
+	resp := make([]byte, size)
+	if err == nil {
+		_, err = io.ReadFull(bufio.NewReader(conn), resp)
+	}
+	if err == nil && (len(resp) < 4 || int32(binary.BigEndian.Uint32(resp)) != p.correlationID) {
+		err = errors.New("unexpected response from Kafka broker")
+	}
+	if err != nil {
+		conn.Close()
+		delete(p.conns, addr)
+		return nil, err
+	}
+	return &kafkaReader{r: bytes.NewReader(resp[4:])}, nil
+}
+
+// refreshMetadata finds the leaders of the partitions of the topic from any of the brokers.
+func (p *kafkaPublisher) refreshMetadata() error {
+	var body kafkaWriter
+	body.int32(1)
+	body.string(p.topic)
+	body.int8(1) // allow_auto_topic_creation
+	var lastErr error
+	for _, broker := range p.brokers {
+		r, err := p.roundTrip(broker, kafkaMetadata, kafkaMetadataVersion, body.Bytes())
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		r.int32() // throttle_time_ms
+		brokers := map[int32]string{}
+		for n := r.int32(); r.err == nil && n > 0; n-- {
+			id := r.int32()
+			host := r.string()
+			port := r.int32()
+			r.string() // rack
+			brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		}
+		r.string() // cluster_id
+		r.int32()  // controller_id
+		var leaders []string
+		for n := r.int32(); r.err == nil && n > 0; n-- {
+			topicErr := r.int16()
+			name := r.string()
+			r.int8() // is_internal
+			for m := r.int32(); r.err == nil && m > 0; m-- {
+				r.int16() // error_code
+				partition := r.int32()
+				leader := r.int32()
+				r.int32s() // replica_nodes
+				r.int32s() // isr_nodes
+				if name != p.topic {
+					continue
+				}
+				for int(partition) >= len(leaders) {
+					leaders = append(leaders, "")
+				}
+				leaders[partition] = brokers[leader]
+			}
+			if name == p.topic && topicErr != 0 {
+				lastErr = fmt.Errorf("Kafka error %d for topic %q", topicErr, p.topic)
+			}
+		}
+		if r.err != nil {
+			lastErr = r.err
+			continue
+		}
+		if len(leaders) == 0 {
+			if lastErr == nil {
+				lastErr = fmt.Errorf("Kafka topic %q has no partitions", p.topic)
+			}
+			continue
+		}
+		p.leaders = leaders
+		return nil
+	}
+	return lastErr
+}
+
+// recordBatch encodes a record batch (magic 2) holding a single record.
+func recordBatch(key []byte, value []byte, now time.Time) []byte {
+	var record kafkaWriter
+	record.int8(0)   // attributes
+	record.varint(0) // timestamp_delta
+	record.varint(0) // offset_delta
+	record.varint(int64(len(key)))
+	record.Write(key)
+	record.varint(int64(len(value)))
+	record.Write(value)
+	record.varint(0) // headers
+
+	// the part of the batch covered by the CRC.
+	var tail kafkaWriter
+	tail.int16(0) // attributes
+	tail.int32(0) // last_offset_delta
+	ms := now.UnixNano() / int64(time.Millisecond)
+	tail.int64(ms) // first_timestamp
+	tail.int64(ms) // max_timestamp
+	tail.int64(-1) // producer_id
+	tail.int16(-1) // producer_epoch
+	tail.int32(-1) // base_sequence
+	tail.int32(1)  // records
+	tail.varint(int64(record.Len()))
+	tail.Write(record.Bytes())
+
+	var batch kafkaWriter
+	batch.int64(0)                             // base_offset
+	batch.int32(int32(4 + 1 + 4 + tail.Len())) // batch_length, from partition_leader_epoch on
+	batch.int32(-1)                            // partition_leader_epoch
+	batch.int8(2)                              // magic
+	batch.int32(int32(crc32.Checksum(tail.Bytes(), castagnoli)))
+	batch.Write(tail.Bytes())
+	return batch.Bytes()
+}
+
+func (p *kafkaPublisher) publish(key string, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.leaders == nil {
+		if err := p.refreshMetadata(); err != nil {
+			return err
+		}
+	}
+	partition := int32(crc32.ChecksumIEEE([]byte(key)) % uint32(len(p.leaders)))
+	leader := p.leaders[partition]
+	if leader == "" {
+		p.leaders = nil
+		return fmt.Errorf("Kafka partition %d of %q has no leader", partition, p.topic)
+	}
+
+	var body kafkaWriter
+	body.int16(-1) // transactional_id
+	body.int16(1)  // acks
+	body.int32(int32(p.timeout / time.Millisecond))
+	body.int32(1)
+	body.string(p.topic)
+	body.int32(1)
+	body.int32(partition)
+	records := recordBatch([]byte(key), payload, time.Now())
+	body.int32(int32(len(records)))
+	body.Write(records)
+	r, err := p.roundTrip(leader, kafkaProduce, kafkaProduceVersion, body.Bytes())
+	if err != nil {
+		// the leader may have moved.
+		p.leaders = nil
+		return err
+	}
+	var errorCode int16
+	for n := r.int32(); r.err == nil && n > 0; n-- {
+		r.string() // name
+		for m := r.int32(); r.err == nil && m > 0; m-- {
+			r.int32() // index
+			if code := r.int16(); code != 0 {
+				errorCode = code
+			}
+			r.int64() // base_offset
+			r.int64() // log_append_time
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	if errorCode != 0 {
+		p.leaders = nil
+		return fmt.Errorf("Kafka error %d producing to %q", errorCode, p.topic)
+	}
+	return nil
+}
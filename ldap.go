@@ -0,0 +1,708 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BER tags of the LDAP messages used, as in RFC 4511.
+const (
+	berBoolean     = 0x01
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berEnumerated  = 0x0a
+	berSequence    = 0x30
+
+	ldapBindRequest      = 0x60
+	ldapBindResponse     = 0x61
+	ldapSearchRequest    = 0x63
+	ldapSearchResultItem = 0x64
+	ldapSearchResultDone = 0x65
+	ldapExtendedRequest  = 0x77
+	ldapExtendedResponse = 0x78
+	// ldapSimpleAuth is the password of a bind request, [0] of AuthenticationChoice.
+	ldapSimpleAuth = 0x80
+	// ldapRequestName is the OID of an extended request, [0] of ExtendedRequest.
+	ldapRequestName = 0x80
+)
+
+const (
+	ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+	// Result codes.
+	ldapSuccess            = 0
+	ldapInvalidCredentials = 49
+
+	// ldapTimeout bounds the authentication of a user, from the service bind to the user bind.
+	ldapTimeout = 10 * time.Second
+	// maxLDAPMessage is the size of the largest message read from the server.
+	maxLDAPMessage = 1 << 20
+	// maxLDAPSessions is the number of authentications cached, beyond which the expired ones are dropped.
+	maxLDAPSessions = 10000
+)
+
+// ber encodes a value of tag with the concatenation of contents.
+func ber(tag byte, contents ...[]byte) []byte {
+	n := 0
+	for _, c := range contents {
+		n += len(c)
+	}
+	b := []byte{tag}
+	if n < 0x80 {
+		b = append(b, byte(n))
+	} else {
+		var length []byte
+		for m := n; m > 0; m >>= 8 {
+			length = append([]byte{byte(m)}, length...)
+		}
+		b = append(append(b, 0x80|byte(len(length))), length...)
+	}
+	for _, c := range contents {
+		b = append(b, c...)
+	}
+	return b
+}
+
+// berInt encodes n, which must not be negative, as an integer or enumerated of tag.
+func berInt(tag byte, n int) []byte {
+	b := []byte{byte(n)}
+	for n >>= 8; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	// keep it positive.
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return ber(tag, b)
+}
+
+func berString(tag byte, s string) []byte {
+	return ber(tag, []byte(s))
+}
+
+func berBool(v bool) []byte {
+	if v {
+		return ber(berBoolean, []byte{0xff})
+	}
+	return ber(berBoolean, []byte{0})
+}
+
+// berValue is a decoded value, with the encoding of its contents.
+type berValue struct {
+	tag  byte
+	data []byte
+}
+
+// int decodes v as an integer or enumerated.
+func (v berValue) int() int {
+	n := 0
+	for _, b := range v.data {
+		n = n<<8 | int(b)
+	}
+	return n
+}
+
+// readBER reads a value; long lengths are accepted, as some servers always use them.
+func readBER(r *bufio.Reader) (berValue, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return berValue{}, err
+	}
+	b, err := r.ReadByte()
+	if err != nil {
+		return berValue{}, err
+	}
+	n := int(b)
+	if b&0x80 != 0 {
+		if b&0x7f > 4 {
+			return berValue{}, errors.New("invalid LDAP message length")
+		}
+		n = 0
+		for i := 0; i < int(b&0x7f); i++ {
+			if b, err = r.ReadByte(); err != nil {
+				return berValue{}, err
+			}
+			n = n<<8 | int(b)
+		}
+	}
+	if n > maxLDAPMessage {
+		return berValue{}, fmt.Errorf("LDAP message of %d bytes is too large", n)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return berValue{}, err
+	}
+	return berValue{tag: tag, data: data}, nil
+}
+
+// children decodes the values contained by v, a constructed value.
+func (v berValue) children() ([]berValue, error) {
+	var values []berValue
+	r := bufio.NewReader(bytes.NewReader(v.data))
+	for {
+		child, err := readBER(r)
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid LDAP message: %v", err)
+		}
+		values = append(values, child)
+	}
+}
+
+// ldapResultError is an LDAP result other than success.
+type ldapResultError struct {
+	code    int
+	message string
+}
+
+func (e *ldapResultError) Error() string {
+	if e.message == "" {
+		return fmt.Sprintf("LDAP result %d", e.code)
+	}
+	return fmt.Sprintf("LDAP result %d: %s", e.code, e.message)
+}
+
+// ldapResult checks an LDAPResult: resultCode, matchedDN, diagnosticMessage.
+func ldapResult(op berValue) error {
+	fields, err := op.children()
+	if err != nil {
+		return err
+	}
+	if len(fields) < 3 || fields[0].tag != berEnumerated {
+		return errors.New("invalid LDAP result")
+	}
+	if code := fields[0].int(); code != ldapSuccess {
+		return &ldapResultError{code: code, message: string(fields[2].data)}
+	}
+	return nil
+}
+
+// escapeLDAPFilter escapes s to be a value in a search filter, as RFC 4515 requires.
+func escapeLDAPFilter(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '*', '(', ')', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// unescapeLDAPFilter decodes the \XX escapes of a value in a search filter.
+func unescapeLDAPFilter(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("invalid escape in filter value %q", s)
+		}
+		c, err := hex.DecodeString(s[i+1 : i+3])
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in filter value %q", s)
+		}
+		b.Write(c)
+		i += 2
+	}
+	return b.String(), nil
+}
+
+// compileLDAPFilter encodes a search filter given as a string, like "(&(objectClass=person)(uid=alice))".
+// Extensible matches are not supported.
+func compileLDAPFilter(s string) ([]byte, error) {
+	b, rest, err := parseLDAPFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("invalid filter %q: unexpected %q", s, rest)
+	}
+	return b, nil
+}
+
+// parseLDAPFilter encodes the filter at the start of s, and returns what follows it.
+func parseLDAPFilter(s string) ([]byte, string, error) {
+	if !strings.HasPrefix(s, "(") || len(s) < 2 {
+		return nil, "", fmt.Errorf("invalid filter %q: must be in parentheses", s)
+	}
+	switch s[1] {
+	case '&', '|':
+		tag := byte(0xa0)
+		if s[1] == '|' {
+			tag = 0xa1
+		}
+		var filters [][]byte
+		rest := s[2:]
+		for !strings.HasPrefix(rest, ")") {
+			f, r, err := parseLDAPFilter(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			filters, rest = append(filters, f), r
+		}
+		return ber(tag, filters...), rest[1:], nil
+	case '!':
+		f, rest, err := parseLDAPFilter(s[2:])
+		if err != nil {
+			return nil, "", err
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, "", fmt.Errorf("invalid filter %q: unclosed negation", s)
+		}
+		return ber(0xa2, f), rest[1:], nil
+	}
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", fmt.Errorf("invalid filter %q: unclosed item", s)
+	}
+	item, rest := s[1:end], s[end+1:]
+	eq := strings.IndexByte(item, '=')
+	if eq <= 0 {
+		return nil, "", fmt.Errorf("invalid filter item %q", item)
+	}
+	attr, value := item[:eq], item[eq+1:]
+	tag := byte(0xa3)
+	switch attr[len(attr)-1] {
+	case '>':
+		tag, attr = 0xa5, attr[:len(attr)-1]
+	case '<':
+		tag, attr = 0xa6, attr[:len(attr)-1]
+	case '~':
+		tag, attr = 0xa8, attr[:len(attr)-1]
+	case ':':
+		return nil, "", fmt.Errorf("invalid filter item %q: extensible matches are not supported", item)
+	}
+	if tag == 0xa3 && value == "*" {
+		return berString(0x87, attr), rest, nil
+	}
+	if tag == 0xa3 && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		var subs [][]byte
+		for i, p := range parts {
+			if p == "" {
+				continue
+			}
+			v, err := unescapeLDAPFilter(p)
+			if err != nil {
+				return nil, "", err
+			}
+			// initial, any or final.
+			choice := byte(0x81)
+			switch i {
+			case 0:
+				choice = 0x80
+			case len(parts) - 1:
+				choice = 0x82
+			}
+			subs = append(subs, berString(choice, v))
+		}
+		return ber(0xa4, berString(berOctetString, attr), ber(berSequence, subs...)), rest, nil
+	}
+	v, err := unescapeLDAPFilter(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return ber(tag, berString(berOctetString, attr), berString(berOctetString, v)), rest, nil
+}
+
+// ldapEntry is an entry found by a search, with the values of the attributes asked for.
+type ldapEntry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// ldapConn is a connection to an LDAP server.
+type ldapConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	id   int
+}
+
+// send sends the request op, and returns its message ID.
+func (c *ldapConn) send(op []byte) (int, error) {
+	c.id++
+	_, err := c.conn.Write(ber(berSequence, berInt(berInteger, c.id), op))
+	return c.id, err
+}
+
+// receive reads the next response to the request id, and returns its protocolOp.
+func (c *ldapConn) receive(id int) (berValue, error) {
+	for {
+		msg, err := readBER(c.r)
+		if err != nil {
+			return berValue{}, err
+		}
+		fields, err := msg.children()
+		if err != nil {
+			return berValue{}, err
+		}
+		if len(fields) < 2 || fields[0].tag != berInteger {
+			return berValue{}, errors.New("invalid LDAP message")
+		}
+		// unsolicited notifications, like a notice of disconnection, have ID 0.
+		if fields[0].int() == 0 {
+			if err := ldapResult(fields[1]); err != nil {
+				return berValue{}, err
+			}
+			continue
+		}
+		if fields[0].int() == id {
+			return fields[1], nil
+		}
+	}
+}
+
+// bind authenticates the connection as dn with password; both empty bind anonymously.
+func (c *ldapConn) bind(dn string, password string) error {
+	id, err := c.send(ber(ldapBindRequest, berInt(berInteger, 3), berString(berOctetString, dn), berString(ldapSimpleAuth, password)))
+	if err != nil {
+		return err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapBindResponse {
+		return errors.New("invalid LDAP bind response")
+	}
+	return ldapResult(op)
+}
+
+// startTLS asks the server to start TLS on the connection, which the caller then does.
+func (c *ldapConn) startTLS() error {
+	id, err := c.send(ber(ldapExtendedRequest, berString(ldapRequestName, ldapStartTLSOID)))
+	if err != nil {
+		return err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if op.tag != ldapExtendedResponse {
+		return errors.New("invalid LDAP extended response")
+	}
+	return ldapResult(op)
+}
+
+// search returns up to 2 entries under base matching filter, with the values of attr.
+func (c *ldapConn) search(base string, filter []byte, attr string) ([]ldapEntry, error) {
+	id, err := c.send(ber(ldapSearchRequest,
+		berString(berOctetString, base),
+		berInt(berEnumerated, 2), // wholeSubtree
+		berInt(berEnumerated, 0), // neverDerefAliases
+		berInt(berInteger, 2),    // sizeLimit, to tell unique entries
+		berInt(berInteger, int(ldapTimeout/time.Second)),
+		berBool(false),
+		filter,
+		ber(berSequence, berString(berOctetString, attr)),
+	))
+	if err != nil {
+		return nil, err
+	}
+	var entries []ldapEntry
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case ldapSearchResultDone:
+			err := ldapResult(op)
+			// sizeLimitExceeded: more than one entry matches, which the caller tells.
+			if re, ok := err.(*ldapResultError); ok && re.code == 4 {
+				err = nil
+			}
+			return entries, err
+		case ldapSearchResultItem:
+			fields, err := op.children()
+			if err != nil || len(fields) < 2 {
+				return nil, errors.New("invalid LDAP search result")
+			}
+			entry := ldapEntry{DN: string(fields[0].data), Attributes: map[string][]string{}}
+			attrs, err := fields[1].children()
+			if err != nil {
+				return nil, err
+			}
+			for _, a := range attrs {
+				parts, err := a.children()
+				if err != nil || len(parts) < 2 {
+					return nil, errors.New("invalid LDAP attribute")
+				}
+				values, err := parts[1].children()
+				if err != nil {
+					return nil, err
+				}
+				name := strings.ToLower(string(parts[0].data))
+				for _, v := range values {
+					entry.Attributes[name] = append(entry.Attributes[name], string(v.data))
+				}
+			}
+			entries = append(entries, entry)
+		}
+		// references to other servers are not followed.
+	}
+}
+
+// ldapCN returns the value of the first RDN of dn if it is a common name, like "admins" for
+// "CN=admins,OU=Groups,DC=example,DC=org", or else dn itself.
+func ldapCN(dn string) string {
+	if len(dn) < 3 || !strings.EqualFold(dn[:3], "cn=") {
+		return dn
+	}
+	var b strings.Builder
+	for i := 3; i < len(dn); i++ {
+		switch c := dn[i]; {
+		case c == '\\' && i+2 < len(dn) && isHexPair(dn[i+1:i+3]):
+			v, _ := hex.DecodeString(dn[i+1 : i+3])
+			b.Write(v)
+			i += 2
+		case c == '\\' && i+1 < len(dn):
+			b.WriteByte(dn[i+1])
+			i++
+		case c == ',' || c == '+':
+			return b.String()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func isHexPair(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+type ldapSession struct {
+	groups  []string
+	expires time.Time
+}
+
+// ldapAuthenticator authenticates users by their directory password, with a bind to an LDAP server or Active
+// Directory, and maps the groups they are a member of to groups of the access control model.
+// The user entry is searched for with a service account, then bound to with the password.
+type ldapAuthenticator struct {
+	addr      string
+	tls       bool
+	StartTLS  bool
+	tlsConfig *tls.Config
+	// BindDN and bindPassword are of the service account searching for users; both empty search anonymously.
+	BindDN       string
+	bindPassword string
+	// BaseDN is where users are searched for, with UserFilter, in which %s is replaced by the user name.
+	BaseDN     string
+	UserFilter string
+	// GroupAttribute holds the DNs of the groups of a user entry, whose common names are the groups of the user.
+	GroupAttribute string
+	// TTL is how long a successful authentication is remembered, so that requests do not each make a bind.
+	TTL time.Duration
+	// pool keeps idle connections.
+	pool chan *ldapConn
+
+	mu       sync.Mutex
+	sessions map[string]ldapSession
+}
+
+// newLDAPAuthenticator makes an authenticator for the server at rawURL, ldap://host[:port] or ldaps://host[:port],
+// searching for users as bindDN with bindPassword, and keeping up to poolSize idle connections. caFile, if not empty,
+// has the CAs to verify the server with instead of the system ones.
+func newLDAPAuthenticator(rawURL string, bindDN string, bindPassword string, caFile string, poolSize int) (*ldapAuthenticator, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Hostname() == "" {
+		return nil, fmt.Errorf("LDAP server %q must be given as ldap://host[:port] or ldaps://host[:port]", rawURL)
+	}
+	a := &ldapAuthenticator{
+		addr:           u.Host,
+		tls:            u.Scheme == "ldaps",
+		tlsConfig:      &tls.Config{ServerName: u.Hostname()},
+		BindDN:         bindDN,
+		bindPassword:   bindPassword,
+		UserFilter:     "(uid=%s)",
+		GroupAttribute: "memberOf",
+		TTL:            5 * time.Minute,
+		pool:           make(chan *ldapConn, poolSize),
+		sessions:       map[string]ldapSession{},
+	}
+	if u.Port() == "" {
+		port := "389"
+		if a.tls {
+			port = "636"
+		}
+		a.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		a.tlsConfig.RootCAs = x509.NewCertPool()
+		if !a.tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates", caFile)
+		}
+	}
+	return a, nil
+}
+
+// userFilter returns the filter finding the entry of user.
+func (a *ldapAuthenticator) userFilter(user string) ([]byte, error) {
+	return compileLDAPFilter(strings.ReplaceAll(a.UserFilter, "%s", escapeLDAPFilter(user)))
+}
+
+// dial connects to the server, over TLS with ldaps:// or StartTLS.
+func (a *ldapAuthenticator) dial() (*ldapConn, error) {
+	conn, err := net.DialTimeout("tcp", a.addr, ldapTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(ldapTimeout))
+	c := &ldapConn{conn: conn, r: bufio.NewReader(conn)}
+	if a.StartTLS && !a.tls {
+		if err := c.startTLS(); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to start TLS: %v", err)
+		}
+	}
+	if a.tls || a.StartTLS {
+		tc := tls.Client(conn, a.tlsConfig)
+		if err := tc.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		c.conn, c.r = tc, bufio.NewReader(tc)
+	}
+	return c, nil
+}
+
+// get returns an idle connection, or a new one; reused tells which, since idle connections may have been closed
+// by the server.
+func (a *ldapAuthenticator) get() (c *ldapConn, reused bool, err error) {
+	select {
+	case c := <-a.pool:
+		return c, true, nil
+	default:
+		c, err := a.dial()
+		return c, false, err
+	}
+}
+
+// put keeps c for later, or closes it if enough connections are idle.
+func (a *ldapAuthenticator) put(c *ldapConn) {
+	select {
+	case a.pool <- c:
+	default:
+		c.conn.Close()
+	}
+}
+
+func ldapSessionKey(user string, password string) string {
+	sum := sha256.Sum256([]byte(user + "\x00" + password))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticate checks password of user against the directory, and returns the groups of the user.
+// Wrong credentials are reported as errTokenMismatch, and failures to ask the server with 503.
+func (a *ldapAuthenticator) authenticate(user string, password string) ([]string, error) {
+	// a bind without password is anonymous, and would succeed.
+	if user == "" || password == "" {
+		return nil, errTokenMismatch
+	}
+	key := ldapSessionKey(user, password)
+	now := time.Now()
+	a.mu.Lock()
+	session, ok := a.sessions[key]
+	a.mu.Unlock()
+	if ok && now.Before(session.expires) {
+		return session.groups, nil
+	}
+	var groups []string
+	for attempt := 0; ; attempt++ {
+		c, reused, err := a.get()
+		if err == nil {
+			groups, err = a.authenticateOn(c, user, password)
+			var re *ldapResultError
+			if err == nil || errors.Is(err, errTokenMismatch) || errors.As(err, &re) {
+				a.put(c)
+			} else {
+				c.conn.Close()
+				// the server may have closed the idle connection.
+				if reused && attempt == 0 {
+					continue
+				}
+			}
+		}
+		if errors.Is(err, errTokenMismatch) {
+			return nil, err
+		}
+		if err != nil {
+			return nil, withStatus(http.StatusServiceUnavailable, fmt.Errorf("failed to authenticate with LDAP: %v", err))
+		}
+		break
+	}
+	if a.TTL > 0 {
+		a.mu.Lock()
+		if len(a.sessions) >= maxLDAPSessions {
+			for k, s := range a.sessions {
+				if !now.Before(s.expires) {
+					delete(a.sessions, k)
+				}
+			}
+			if len(a.sessions) >= maxLDAPSessions {
+				a.sessions = map[string]ldapSession{}
+			}
+		}
+		a.sessions[key] = ldapSession{groups: groups, expires: now.Add(a.TTL)}
+		a.mu.Unlock()
+	}
+	return groups, nil
+}
+
+// authenticateOn binds c as the service account, searches for the entry of user, and binds it with password.
+func (a *ldapAuthenticator) authenticateOn(c *ldapConn, user string, password string) ([]string, error) {
+	c.conn.SetDeadline(time.Now().Add(ldapTimeout))
+	if err := c.bind(a.BindDN, a.bindPassword); err != nil {
+		return nil, fmt.Errorf("failed to bind as the service account: %v", err)
+	}
+	filter, err := a.userFilter(user)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := c.search(a.BaseDN, filter, a.GroupAttribute)
+	if err != nil {
+		return nil, err
+	}
+	// unknown and ambiguous users are rejected like wrong passwords.
+	if len(entries) != 1 {
+		return nil, errTokenMismatch
+	}
+	if err := c.bind(entries[0].DN, password); err != nil {
+		if re, ok := err.(*ldapResultError); ok && re.code == ldapInvalidCredentials {
+			return nil, errTokenMismatch
+		}
+		return nil, err
+	}
+	groups := []string{}
+	for _, dn := range entries[0].Attributes[strings.ToLower(a.GroupAttribute)] {
+		groups = append(groups, ldapCN(dn))
+	}
+	return groups, nil
+}
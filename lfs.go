@@ -0,0 +1,314 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// lfsMediaType is the media type of the requests and responses of the Git LFS API.
+	lfsMediaType = "application/vnd.git-lfs+json"
+	// maxLFSBatchSize bounds the batch requests.
+	maxLFSBatchSize = 4 << 20
+	// lfsActionTTL is how long clients are told the actions of a batch are valid, in seconds.
+	lfsActionTTL = 3600
+)
+
+var errLFSPath = errors.New("managed by the Git LFS server")
+
+var (
+	// reLFS matches the endpoints of a repository, whose LFS URL is /lfs/(repo), or that of the git remote
+	// /lfs/(repo).git followed by /info/lfs as git-lfs derives it.
+	reLFS    = regexp.MustCompile(`^/lfs/(.+?)(?:\.git/info/lfs)?/(objects/batch|objects/verify|objects/[0-9a-f]{64}|locks.*)$`)
+	reLFSOid = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// lfsObject is an object of a batch request or response.
+type lfsObject struct {
+	Oid           string                `json:"oid"`
+	Size          int64                 `json:"size"`
+	Authenticated bool                  `json:"authenticated,omitempty"`
+	Actions       map[string]*lfsAction `json:"actions,omitempty"`
+	Error         *lfsObjectError       `json:"error,omitempty"`
+}
+
+type lfsAction struct {
+	Href      string            `json:"href"`
+	Header    map[string]string `json:"header,omitempty"`
+	ExpiresIn int               `json:"expires_in,omitempty"`
+}
+
+type lfsObjectError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// respondLFSError writes err as the Git LFS API does, with a challenge for the credentials git-lfs asks git for.
+func respondLFSError(w http.ResponseWriter, err error) {
+	status := statusOf(err)
+	if status == http.StatusUnauthorized {
+		w.Header().Set("LFS-Authenticate", `Basic realm="simple-upload-server"`)
+		w.Header().Set("WWW-Authenticate", `Basic realm="simple-upload-server"`)
+	}
+	w.Header().Set("Content-Type", lfsMediaType)
+	w.WriteHeader(status)
+	writeJSON(w, struct {
+		Message string `json:"message"`
+	}{err.Error()})
+}
+
+// checkLFSPath returns an error if rel, a path relative to the document root, is a file of the Git LFS server,
+// which uploads must not replace.
+func (s Server) checkLFSPath(rel string) error {
+	if s.LFS != "" && matchPrefix(rel, s.LFS) {
+		return withStatus(http.StatusForbidden, fmt.Errorf("\"/files%s\" is %w", rel, errLFSPath))
+	}
+	return nil
+}
+
+// lfsObjectFile returns the file of the object oid, stored like git-lfs does locally, as objects/(oid[0:2])/(oid[2:4])/(oid).
+func (s Server) lfsObjectFile(oid string) string {
+	return filepath.Join(s.DocumentRoot, filepath.FromSlash(s.LFS), "objects", oid[0:2], oid[2:4], oid)
+}
+
+// authorizeLFS checks the credentials of r. git-lfs sends them with Basic authentication, whose password is taken
+// as the token. Uploads always require the token, and downloads if downloads of files do.
+func (s Server) authorizeLFS(r *http.Request, upload bool) error {
+	r = withBasicToken(r)
+	required := upload || s.isAuthenticationRequired(&http.Request{Method: http.MethodGet})
+	if err := s.checkToken(r); required && err != nil {
+		return err
+	}
+	return nil
+}
+
+// handleLFS serves the Git LFS API under /lfs/(repo), over objects shared by all repositories:
+//
+//	POST /lfs/(repo)/objects/batch    tells which objects to upload or where to download them from
+//	PUT /lfs/(repo)/objects/(oid)     uploads an object, checked against its oid
+//	GET /lfs/(repo)/objects/(oid)     downloads an object
+//	POST /lfs/(repo)/objects/verify   checks that an object was uploaded whole
+//
+// Locking is not supported.
+func (s Server) handleLFS(w http.ResponseWriter, r *http.Request) {
+	m := reLFS.FindStringSubmatch(r.URL.Path)
+	var err error
+	switch {
+	case m == nil:
+		err = withStatus(http.StatusNotFound, fmt.Errorf("%s is not an LFS endpoint", r.URL.Path))
+	case strings.HasPrefix(m[2], "locks"):
+		err = withStatus(http.StatusNotFound, errors.New("locking is not supported"))
+	case m[2] == "objects/batch":
+		err = s.handleLFSBatch(w, r, strings.TrimSuffix(r.URL.Path, "/objects/batch"))
+	case m[2] == "objects/verify":
+		err = s.handleLFSVerify(w, r)
+	default:
+		err = s.handleLFSObject(w, r, strings.TrimPrefix(m[2], "objects/"))
+	}
+	if err != nil {
+		logFailure(logger.WithFields(logrus.Fields{"path": r.URL.Path, "method": r.Method}), err, "LFS request failed")
+		respondLFSError(w, err)
+	}
+}
+
+// handleLFSBatch answers a batch request with the actions to take on each object: uploading those which are
+// missing, or downloading those which exist, from base, the URL of the repository.
+func (s Server) handleLFSBatch(w http.ResponseWriter, r *http.Request, base string) error {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		return withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method))
+	}
+	var req struct {
+		Operation string      `json:"operation"`
+		Transfers []string    `json:"transfers"`
+		Objects   []lfsObject `json:"objects"`
+		HashAlgo  string      `json:"hash_algo"`
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxLFSBatchSize+1))
+	if err != nil {
+		return err
+	}
+	if len(b) > maxLFSBatchSize {
+		return withStatus(http.StatusRequestEntityTooLarge, fmt.Errorf("batch exceeds %d bytes", maxLFSBatchSize))
+	}
+	if err := json.Unmarshal(b, &req); err != nil {
+		return withStatus(http.StatusBadRequest, fmt.Errorf("invalid batch request: %v", err))
+	}
+	if req.Operation != "upload" && req.Operation != "download" {
+		return withStatus(http.StatusUnprocessableEntity, fmt.Errorf("unknown operation %q", req.Operation))
+	}
+	if req.HashAlgo != "" && req.HashAlgo != "sha256" {
+		return withStatus(http.StatusConflict, fmt.Errorf("unsupported hash algorithm %q, only sha256 is supported", req.HashAlgo))
+	}
+	if len(req.Transfers) > 0 {
+		basic := false
+		for _, t := range req.Transfers {
+			basic = basic || t == "basic"
+		}
+		if !basic {
+			return withStatus(http.StatusUnprocessableEntity, errors.New("only the basic transfer adapter is supported"))
+		}
+	}
+	upload := req.Operation == "upload"
+	if err := s.authorizeLFS(r, upload); err != nil {
+		return err
+	}
+	if upload {
+		if err := s.checkWritable(); err != nil {
+			return err
+		}
+	}
+
+	// the transfers are authorized as the batch was.
+	var header map[string]string
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		header = map[string]string{"Authorization": auth}
+	}
+	href := func(p string) *lfsAction {
+		return &lfsAction{Href: requestBaseURL(r) + base + p, Header: header, ExpiresIn: lfsActionTTL}
+	}
+	objects := make([]lfsObject, 0, len(req.Objects))
+	for _, o := range req.Objects {
+		o = lfsObject{Oid: o.Oid, Size: o.Size, Authenticated: header != nil}
+		var info os.FileInfo
+		if reLFSOid.MatchString(o.Oid) {
+			if fi, err := os.Stat(s.lfsObjectFile(o.Oid)); err == nil {
+				info = fi
+			}
+		}
+		switch {
+		case !reLFSOid.MatchString(o.Oid) || o.Size < 0:
+			o.Error = &lfsObjectError{Code: http.StatusUnprocessableEntity, Message: "invalid oid or size"}
+		case !upload && info == nil:
+			o.Error = &lfsObjectError{Code: http.StatusNotFound, Message: "object does not exist"}
+		case !upload:
+			o.Size = info.Size()
+			o.Actions = map[string]*lfsAction{"download": href("/objects/" + o.Oid)}
+		case info != nil && info.Size() == o.Size:
+			// uploaded already, by this repository or another.
+		case o.Size > s.MaxUploadSize:
+			o.Error = &lfsObjectError{Code: http.StatusUnprocessableEntity, Message: errFileTooLarge.Error()}
+		default:
+			o.Actions = map[string]*lfsAction{"upload": href("/objects/" + o.Oid), "verify": href("/objects/verify")}
+		}
+		objects = append(objects, o)
+	}
+	w.Header().Set("Content-Type", lfsMediaType)
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, struct {
+		Transfer string      `json:"transfer"`
+		Objects  []lfsObject `json:"objects"`
+		HashAlgo string      `json:"hash_algo"`
+	}{"basic", objects, "sha256"})
+	return nil
+}
+
+// handleLFSObject serves the transfers of the object oid: GET and HEAD download it, and PUT uploads it.
+func (s Server) handleLFSObject(w http.ResponseWriter, r *http.Request, oid string) error {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if err := s.authorizeLFS(r, false); err != nil {
+			return err
+		}
+		f, err := os.Open(s.lfsObjectFile(oid))
+		if os.IsNotExist(err) {
+			return withStatus(http.StatusNotFound, fmt.Errorf("object %s %w", oid, errNotFound))
+		} else if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Cache-Control", "max-age=31536000, immutable")
+		http.ServeContent(w, r, "", info.ModTime(), f)
+		return nil
+	case http.MethodPut:
+		if err := s.authorizeLFS(r, true); err != nil {
+			return err
+		}
+		if err := s.checkWritable(); err != nil {
+			return err
+		}
+		return s.putLFSObject(w, r, oid)
+	}
+	w.Header().Set("Allow", "GET,HEAD,PUT")
+	return withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method))
+}
+
+// putLFSObject stores the body of r as the object oid once its digest is verified.
+func (s Server) putLFSObject(w http.ResponseWriter, r *http.Request, oid string) error {
+	if r.ContentLength > s.MaxUploadSize {
+		return withStatus(http.StatusRequestEntityTooLarge, errFileTooLarge)
+	}
+	tempFile, err := ioutil.TempFile(s.spoolDir(), "upload_")
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := copyBuffer(io.MultiWriter(tempFile, h), io.LimitReader(r.Body, s.MaxUploadSize+1))
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && n > s.MaxUploadSize {
+		err = withStatus(http.StatusRequestEntityTooLarge, errFileTooLarge)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); err == nil && sum != oid {
+		err = withStatus(http.StatusUnprocessableEntity, fmt.Errorf("content has oid %s, not %s", sum, oid))
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	dst := s.lfsObjectFile(oid)
+	if fileExists(dst) {
+		os.Remove(tempFile.Name())
+	} else if err := s.commitFile(r.Context(), tempFile.Name(), dst); err != nil {
+		return err
+	}
+	tagUpload(r.Context(), auditLog()).WithFields(logrus.Fields{"path": r.URL.Path, "oid": oid, "size": n, "remote": clientIP(r)}).Info("LFS object uploaded")
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// handleLFSVerify serves the verification of an upload, which succeeds if the object has the size the client expects.
+func (s Server) handleLFSVerify(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		return withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method))
+	}
+	if err := s.authorizeLFS(r, true); err != nil {
+		return err
+	}
+	var o lfsObject
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxLFSBatchSize)).Decode(&o); err != nil || !reLFSOid.MatchString(o.Oid) {
+		return withStatus(http.StatusUnprocessableEntity, errors.New("invalid oid"))
+	}
+	info, err := os.Stat(s.lfsObjectFile(o.Oid))
+	if os.IsNotExist(err) {
+		return withStatus(http.StatusNotFound, fmt.Errorf("object %s %w", o.Oid, errNotFound))
+	} else if err != nil {
+		return err
+	}
+	if info.Size() != o.Size {
+		return withStatus(http.StatusUnprocessableEntity, fmt.Errorf("object %s has %d bytes, not %d", o.Oid, info.Size(), o.Size))
+	}
+	w.Header().Set("Content-Type", lfsMediaType)
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, "{}\n")
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// logOptions configures where and how the logger writes.
+type logOptions struct {
+	Format string
+	// File is the path to write logs to in addition to stderr; nothing is written to a file if empty.
+	File string
+	// MaxSize is the size in megabytes at which the log file is rotated.
+	MaxSize int
+	// MaxAge is the number of days to retain rotated files; they are kept forever if 0.
+	MaxAge int
+	// MaxBackups is the number of rotated files to retain; all of them are kept if 0.
+	MaxBackups int
+}
+
+// configureLogger applies opts to l.
+func configureLogger(l *logrus.Logger, opts logOptions) error {
+	switch opts.Format {
+	case "text":
+		l.Formatter = &logrus.TextFormatter{}
+	case "json":
+		l.Formatter = &logrus.JSONFormatter{}
+	default:
+		return fmt.Errorf("unknown log format %q", opts.Format)
+	}
+	if opts.File != "" {
+		l.Out = io.MultiWriter(os.Stderr, &lumberjack.Logger{
+			Filename:   opts.File,
+			MaxSize:    opts.MaxSize,
+			MaxAge:     opts.MaxAge,
+			MaxBackups: opts.MaxBackups,
+		})
+	}
+	return nil
+}
+
+// auditLog returns an entry for events which change stored files; they are tagged so that they can be shipped separately.
+func auditLog() *logrus.Entry {
+	return logger.WithField("log", "audit")
+}
+
+// accessLog wraps h to log every request.
+func accessLog(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		entry := logger.WithFields(logrus.Fields{
+			"log":      "access",
+			"remote":   r.RemoteAddr,
+			"method":   r.Method,
+			"path":     r.URL.Path,
+			"status":   rec.status,
+			"size":     rec.written,
+			"duration": time.Since(start).Seconds(),
+			"agent":    r.UserAgent(),
+		})
+		// the upload ID is given by tagUploads, further down the chain.
+		if id := rec.Header().Get(uploadIDHeader); id != "" {
+			entry = entry.WithField("upload_id", id)
+		}
+		entry.Info("request")
+	})
+}
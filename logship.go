@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxLogBatch bounds the body of a request shipping logs, as sent, compressed or not.
+	maxLogBatch = 16 << 20
+	// maxPendingLogs bounds the bodies of the requests being received at once; further requests are asked to retry.
+	maxPendingLogs = 64 << 20
+	// logRetryAfter is how long clients are asked to wait before retrying when too many logs are pending.
+	logRetryAfter = 2 * time.Second
+	// logDayFormat names the directory of the files of a day.
+	logDayFormat = "2006-01-02"
+)
+
+var (
+	errLogIngestPath = errors.New("managed by the log ingestion")
+	errLogsBusy      = errors.New("too many logs are being received, retry later")
+)
+
+// logIngest appends the logs shipped to /logs/(app) to hourly files under Prefix: the lines received in an hour
+// are stored as (app)/(day)/(hour).log.gz, each request as a gzip member, so that the file stays a valid gzip stream.
+type logIngest struct {
+	// Prefix is the path of the log files relative to the document root, like "/logs".
+	Prefix string
+	// MaxSize is the size from which the file of an hour is rotated to (hour).1.log.gz, (hour).2.log.gz...; 0 never rotates.
+	MaxSize int64
+	// MaxAge is the number of days the files of an application are kept; 0 keeps them forever.
+	MaxAge int
+
+	mu sync.Mutex
+	// pending is the size of the bodies being received.
+	pending int64
+	apps    map[string]*logFile
+}
+
+// logFile is the file of an application which logs are currently appended to.
+type logFile struct {
+	mu    sync.Mutex
+	hour  time.Time
+	index int
+}
+
+func newLogIngest(prefix string) *logIngest {
+	return &logIngest{Prefix: cleanPrefix(prefix), apps: map[string]*logFile{}}
+}
+
+// reserve accounts for size bytes being received, or reports false if that would exceed maxPendingLogs.
+func (l *logIngest) reserve(size int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.pending+size > maxPendingLogs {
+		return false
+	}
+	l.pending += size
+	return true
+}
+
+func (l *logIngest) release(size int64) {
+	l.mu.Lock()
+	l.pending -= size
+	l.mu.Unlock()
+}
+
+func (l *logIngest) file(app string) *logFile {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.apps[app]
+	if !ok {
+		f = &logFile{}
+		l.apps[app] = f
+	}
+	return f
+}
+
+// checkLogIngestPath returns an error if rel, a path relative to the document root, is a file of the log ingestion,
+// which uploads must not replace.
+func (s Server) checkLogIngestPath(rel string) error {
+	if s.Logs != nil && matchPrefix(rel, s.Logs.Prefix) {
+		return withStatus(http.StatusForbidden, fmt.Errorf("\"/files%s\" is %w", rel, errLogIngestPath))
+	}
+	return nil
+}
+
+// handleLogs serves POST /logs/(app), which appends line-delimited logs, compressed with gzip if sent with
+// Content-Encoding: gzip, to the file of the current hour of app. It is meant for log shippers like the HTTP output
+// of Fluent Bit, and asks them to retry with 503 Service Unavailable when too many logs are being received.
+func (s Server) handleLogs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	if err := s.checkToken(withBasicToken(r)); s.isAuthenticationRequired(r) && err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="simple-upload-server"`)
+		respondError(w, err)
+		return
+	}
+	if err := s.checkWritable(); err != nil {
+		respondError(w, err)
+		return
+	}
+	app := strings.TrimPrefix(r.URL.Path, "/logs/")
+	if err := checkName(app); err != nil || strings.Contains(app, "/") || isInternalName(app) {
+		respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("invalid application name %q", app)))
+		return
+	}
+	// the size must be known up front to account for it.
+	size := r.ContentLength
+	if size < 0 {
+		respondError(w, withStatus(http.StatusLengthRequired, errors.New("Content-Length is required")))
+		return
+	}
+	if size > maxLogBatch {
+		respondError(w, errFileTooLarge)
+		return
+	}
+	if !s.Logs.reserve(size) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(logRetryAfter.Seconds())))
+		respondError(w, withStatus(http.StatusServiceUnavailable, errLogsBusy))
+		return
+	}
+	defer s.Logs.release(size)
+
+	entry := logger.WithFields(logrus.Fields{"path": r.URL.Path, "remote": clientIP(r)})
+	temp, lines, err := s.receiveLogs(r)
+	if temp != "" {
+		defer os.Remove(temp)
+	}
+	if err != nil {
+		logFailure(entry, err, "failed to receive logs")
+		respondError(w, err)
+		return
+	}
+	rel := ""
+	if lines > 0 {
+		if rel, err = s.appendLogs(app, temp, time.Now()); err != nil {
+			logFailure(entry, err, "failed to store logs")
+			respondError(w, err)
+			return
+		}
+	}
+	entry.WithFields(logrus.Fields{"app": app, "lines": lines, "file": rel}).Debug("logs received")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// receiveLogs compresses the lines of the body of r into a gzip member in a temporary file, and returns its name
+// along with the number of lines. A last line without a line feed is terminated.
+func (s Server) receiveLogs(r *http.Request) (string, int, error) {
+	var body io.Reader = r.Body
+	switch encoding := r.Header.Get("Content-Encoding"); encoding {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return "", 0, withStatus(http.StatusBadRequest, fmt.Errorf("invalid gzip body: %v", err))
+		}
+		defer gz.Close()
+		body = gz
+	default:
+		return "", 0, withStatus(http.StatusUnsupportedMediaType, fmt.Errorf("unsupported Content-Encoding %q", encoding))
+	}
+	f, err := ioutil.TempFile(s.spoolDir(), "logs_")
+	if err != nil {
+		return "", 0, err
+	}
+	gz := gzip.NewWriter(f)
+	lines, err := copyLines(gz, io.LimitReader(body, s.MaxUploadSize+1), s.MaxUploadSize)
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return f.Name(), lines, err
+}
+
+// copyLines copies the lines read from src to dst, terminating the last one, and returns the number of lines.
+// More than limit bytes are an error, and so are the errors reading src, which are the client's.
+func copyLines(dst io.Writer, src io.Reader, limit int64) (int, error) {
+	br := bufio.NewReaderSize(src, 64<<10)
+	var lines int
+	var size int64
+	for {
+		line, err := br.ReadSlice('\n')
+		if len(line) > 0 {
+			size += int64(len(line))
+			if size > limit {
+				return lines, errFileTooLarge
+			}
+			if _, werr := dst.Write(line); werr != nil {
+				return lines, werr
+			}
+			if line[len(line)-1] == '\n' {
+				lines++
+			} else if err == io.EOF {
+				lines++
+				if _, werr := dst.Write([]byte{'\n'}); werr != nil {
+					return lines, werr
+				}
+			}
+		}
+		switch {
+		case err == io.EOF:
+			return lines, nil
+		case err == bufio.ErrBufferFull:
+			// a line longer than the buffer continues.
+		case err != nil:
+			return lines, withStatus(http.StatusBadRequest, fmt.Errorf("failed to read the logs: %v", err))
+		}
+	}
+}
+
+// appendLogs appends the gzip member in temp to the file of the hour of now of app, and returns its path relative
+// to the document root. The file is truncated back if the member cannot be written whole.
+func (s Server) appendLogs(app string, temp string, now time.Time) (string, error) {
+	l := s.Logs
+	lf := l.file(app)
+	lf.mu.Lock()
+	defer lf.mu.Unlock()
+
+	hour := now.UTC().Truncate(time.Hour)
+	if !hour.Equal(lf.hour) {
+		lf.hour = hour
+		lf.index = 0
+		s.expireLogs(app, hour)
+	}
+	dir := path.Join(l.Prefix, app, hour.Format(logDayFormat))
+	if err := os.MkdirAll(filepath.Join(s.DocumentRoot, filepath.FromSlash(dir)), 0777); err != nil {
+		return "", err
+	}
+	var rel string
+	for {
+		name := fmt.Sprintf("%02d.log.gz", hour.Hour())
+		if lf.index > 0 {
+			name = fmt.Sprintf("%02d.%d.log.gz", hour.Hour(), lf.index)
+		}
+		rel = path.Join(dir, name)
+		info, err := os.Stat(filepath.Join(s.DocumentRoot, filepath.FromSlash(rel)))
+		if err != nil || l.MaxSize <= 0 || info.Size() < l.MaxSize {
+			break
+		}
+		lf.index++
+	}
+
+	src, err := os.Open(temp)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	// snapshots copy log files up to the size they have, so they must not see half an append.
+	s.publishLock.RLock()
+	defer s.publishLock.RUnlock()
+	f, err := os.OpenFile(filepath.Join(s.DocumentRoot, filepath.FromSlash(rel)), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return "", err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		if _, err = copyBuffer(f, src); err != nil {
+			f.Truncate(info.Size())
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return rel, err
+}
+
+// expireLogs removes the directories of the days of app older than MaxAge days before hour.
+func (s Server) expireLogs(app string, hour time.Time) {
+	if s.Logs.MaxAge <= 0 {
+		return
+	}
+	dir := path.Join(s.Logs.Prefix, app)
+	infos, err := ioutil.ReadDir(filepath.Join(s.DocumentRoot, filepath.FromSlash(dir)))
+	if err != nil {
+		return
+	}
+	oldest := hour.AddDate(0, 0, -s.Logs.MaxAge).Format(logDayFormat)
+	for _, info := range infos {
+		if _, err := time.Parse(logDayFormat, info.Name()); err != nil || !info.IsDir() || info.Name() >= oldest {
+			continue
+		}
+		rel := path.Join(dir, info.Name())
+		files, err := ioutil.ReadDir(filepath.Join(s.DocumentRoot, filepath.FromSlash(rel)))
+		if err != nil {
+			logger.WithError(err).WithField("path", rel).Warn("failed to remove expired logs")
+			continue
+		}
+		kept := 0
+		for _, f := range files {
+			if !s.expireLog(path.Join(rel, f.Name())) {
+				kept++
+			}
+		}
+		if kept > 0 {
+			logger.WithFields(logrus.Fields{"path": rel, "kept": kept}).Info("expired logs removed, except those on hold or retained")
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.DocumentRoot, filepath.FromSlash(rel))); err != nil {
+			logger.WithError(err).WithField("path", rel).Warn("failed to remove expired logs")
+			continue
+		}
+		logger.WithField("path", rel).Info("expired logs removed")
+	}
+}
+
+// expireLog removes the expired log file rel, unless it is on legal hold or still retained, and reports whether it did.
+func (s Server) expireLog(rel string) bool {
+	if err := s.checkLegalHold(rel); err != nil {
+		return false
+	}
+	if err := s.checkRetention(rel); err != nil {
+		return false
+	}
+	s.publishLock.Lock()
+	err := os.Remove(filepath.Join(s.DocumentRoot, filepath.FromSlash(rel)))
+	s.publishLock.Unlock()
+	if err != nil {
+		logger.WithError(err).WithField("path", rel).Warn("failed to remove expired logs")
+		return false
+	}
+	s.forget(rel)
+	return true
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExpireLogsKeepsHeldAndRetainedFiles(t *testing.T) {
+	root, err := ioutil.TempDir("", "logs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	s := NewServer(filepath.Join(root, "files"), 1024, "secret", false, nil)
+	s.Logs = newLogIngest("/logs")
+	s.Logs.MaxAge = 7
+	s.Policies = newPolicyStore(policies{{Prefix: "/logs/audit", Retention: 24 * time.Hour}})
+	if s.Meta, err = newMetaStore(filepath.Join(root, "meta")); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	files := []string{
+		"/logs/web/2026-10-01/00.log.gz",
+		"/logs/web/2026-10-01/01.log.gz",
+		"/logs/web/2026-10-02/00.log.gz",
+		"/logs/audit/2026-10-01/00.log.gz",
+		"/logs/web/2026-10-15/00.log.gz",
+	}
+	for _, rel := range files {
+		name := filepath.Join(s.DocumentRoot, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte("logs"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Meta.update("/logs/web/2026-10-01/01.log.gz", func(meta *fileMeta) {
+		meta.LegalHold = &legalHold{Reason: "litigation", Since: now}
+	}); err != nil {
+		t.Fatal(err)
+	}
+	s.expireLogs("web", now)
+	s.expireLogs("audit", now)
+
+	for _, tc := range []struct {
+		rel  string
+		kept bool
+	}{
+		{"/logs/web/2026-10-01/00.log.gz", false},
+		{"/logs/web/2026-10-01/01.log.gz", true},
+		{"/logs/web/2026-10-02", false},
+		{"/logs/audit/2026-10-01/00.log.gz", true},
+		{"/logs/web/2026-10-15/00.log.gz", true},
+	} {
+		_, err := os.Stat(filepath.Join(s.DocumentRoot, filepath.FromSlash(tc.rel)))
+		if kept := err == nil; kept != tc.kept {
+			t.Errorf("%s: kept %v, want %v", tc.rel, kept, tc.kept)
+		}
+	}
+}
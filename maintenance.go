@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxThrottledRead bounds a read of a throttled reader, so that the rate is smooth.
+const maxThrottledRead = 64 << 10
+
+// maintenanceWindow is a daily period of local time, like 22:00-06:00, which may span midnight.
+type maintenanceWindow struct {
+	// start and end are minutes since midnight.
+	start, end int
+}
+
+// parseMaintenanceWindow parses a window given as "HH:MM-HH:MM".
+func parseMaintenanceWindow(def string) (maintenanceWindow, error) {
+	var h1, m1, h2, m2 int
+	if n, err := fmt.Sscanf(def, "%d:%d-%d:%d", &h1, &m1, &h2, &m2); err != nil || n != 4 {
+		return maintenanceWindow{}, fmt.Errorf("maintenance window %q must be given as HH:MM-HH:MM", def)
+	}
+	if h1 < 0 || h1 > 24 || h2 < 0 || h2 > 24 || m1 < 0 || m1 > 59 || m2 < 0 || m2 > 59 {
+		return maintenanceWindow{}, fmt.Errorf("invalid time in maintenance window %q", def)
+	}
+	w := maintenanceWindow{start: h1*60 + m1, end: h2*60 + m2}
+	if w.start == w.end || w.start > 24*60 || w.end > 24*60 {
+		return maintenanceWindow{}, fmt.Errorf("invalid maintenance window %q", def)
+	}
+	return w, nil
+}
+
+func (w maintenanceWindow) contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.start < w.end {
+		return minute >= w.start && minute < w.end
+	}
+	return minute >= w.start || minute < w.end
+}
+
+// maintenance confines the background jobs moving data, backups and tiering, to time windows and a bandwidth cap,
+// so that they do not compete with the traffic of users. A nil *maintenance confines nothing.
+type maintenance struct {
+	// Windows are the periods in which scheduled jobs run; they run at any time if empty.
+	Windows []maintenanceWindow
+	// Bandwidth is the rate in bytes per second shared by the jobs; 0 is unlimited.
+	Bandwidth int64
+
+	mu sync.Mutex
+	// next is when the next byte may be sent.
+	next time.Time
+}
+
+// confinedKey marks the context of a scheduled job, which pauses when its window closes.
+type confinedKey struct{}
+
+// confined returns ctx for a scheduled job.
+func confined(ctx context.Context) context.Context {
+	return context.WithValue(ctx, confinedKey{}, true)
+}
+
+// isOpen reports whether t is within a window.
+func (m *maintenance) isOpen(t time.Time) bool {
+	if m == nil || len(m.Windows) == 0 {
+		return true
+	}
+	for _, w := range m.Windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextOpening returns the first time after t when a window opens.
+func (m *maintenance) nextOpening(t time.Time) time.Time {
+	var next time.Time
+	for _, w := range m.Windows {
+		start := time.Date(t.Year(), t.Month(), t.Day(), w.start/60, w.start%60, 0, 0, t.Location())
+		if !start.After(t) {
+			start = start.AddDate(0, 0, 1)
+		}
+		if next.IsZero() || start.Before(next) {
+			next = start
+		}
+	}
+	return next
+}
+
+// wait blocks until a window is open, or ctx is done.
+func (m *maintenance) wait(ctx context.Context, job string) error {
+	for !m.isOpen(time.Now()) {
+		next := m.nextOpening(time.Now())
+		logger.WithFields(logrus.Fields{"job": job, "until": next.Format(time.RFC3339)}).Info("waiting for the maintenance window")
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return nil
+}
+
+// pause blocks the scheduled job of ctx until a window is open, or ctx is done. Jobs requested by hand do not pause.
+func (m *maintenance) pause(ctx context.Context, job string) error {
+	if confined, _ := ctx.Value(confinedKey{}).(bool); !confined {
+		return nil
+	}
+	return m.wait(ctx, job)
+}
+
+// throttle blocks until n more bytes can be sent within the bandwidth, or ctx is done.
+func (m *maintenance) throttle(ctx context.Context, n int) error {
+	if m == nil || m.Bandwidth <= 0 || n <= 0 {
+		return nil
+	}
+	m.mu.Lock()
+	now := time.Now()
+	if m.next.Before(now) {
+		m.next = now
+	}
+	delay := m.next.Sub(now)
+	m.next = m.next.Add(time.Duration(n) * time.Second / time.Duration(m.Bandwidth))
+	m.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// reader returns r limited to the bandwidth.
+func (m *maintenance) reader(ctx context.Context, r io.Reader) io.Reader {
+	if m == nil || m.Bandwidth <= 0 {
+		return r
+	}
+	return throttledReader{ctx: ctx, r: r, m: m}
+}
+
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	m   *maintenance
+}
+
+func (t throttledReader) Read(p []byte) (int, error) {
+	if len(p) > maxThrottledRead {
+		p = p[:maxThrottledRead]
+	}
+	n, err := t.r.Read(p)
+	if throttleErr := t.m.throttle(t.ctx, n); throttleErr != nil {
+		return n, throttleErr
+	}
+	return n, err
+}
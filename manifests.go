@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// manifestName and manifestIndexName are the files generated in each directory with -manifests.
+	manifestName      = "manifest.json"
+	manifestIndexName = "index.html"
+	// manifestDelay is how long changes are collected before the manifests are regenerated, so that a burst
+	// of uploads to a directory regenerates it once.
+	manifestDelay = 2 * time.Second
+)
+
+var errManifestName = errors.New("reserved for the directory manifest")
+
+// dirManifest lists the files of a directory with their digests, and its subdirectories with the digests
+// of their own manifests, so that a whole tree can be verified from the manifest at its top.
+type dirManifest struct {
+	Dir   string           `json:"dir"`
+	Files []manifestEntry  `json:"files"`
+	Dirs  []manifestSubdir `json:"dirs"`
+}
+
+type manifestSubdir struct {
+	Path string `json:"path"`
+	// Digest is the digest of the manifest of the subdirectory, as "algorithm:hex".
+	Digest string `json:"digest"`
+}
+
+// manifestWriter collects the directories whose manifests must be regenerated.
+// A nil *manifestWriter collects nothing.
+type manifestWriter struct {
+	mu      sync.Mutex
+	pending map[string]bool
+	wake    chan struct{}
+}
+
+func newManifestWriter() *manifestWriter {
+	return &manifestWriter{pending: map[string]bool{}, wake: make(chan struct{}, 1)}
+}
+
+// changed marks the directory of urlPath, a changed file under /files, and its parents for regeneration.
+func (m *manifestWriter) changed(urlPath string) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	for dir := path.Dir(path.Clean("/" + strings.TrimPrefix(urlPath, "/files"))); ; dir = path.Dir(dir) {
+		m.pending[dir] = true
+		if dir == "/" {
+			break
+		}
+	}
+	m.mu.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// take returns the directories marked for regeneration, the deepest first, since a manifest depends on those below.
+func (m *manifestWriter) take() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	dirs := make([]string, 0, len(m.pending))
+	for dir := range m.pending {
+		dirs = append(dirs, dir)
+	}
+	m.pending = map[string]bool{}
+	depth := func(dir string) int {
+		if dir == "/" {
+			return 0
+		}
+		return strings.Count(dir, "/")
+	}
+	sort.Slice(dirs, func(i, j int) bool {
+		if di, dj := depth(dirs[i]), depth(dirs[j]); di != dj {
+			return di > dj
+		}
+		return dirs[i] < dirs[j]
+	})
+	return dirs
+}
+
+// isManifestName reports whether rel, a path relative to the document root, is a generated manifest.
+func (s Server) isManifestName(rel string) bool {
+	if s.Manifests == nil {
+		return false
+	}
+	name := path.Base(rel)
+	return name == manifestName || name == manifestIndexName
+}
+
+// checkManifestName returns an error if rel is the name of a generated manifest, which uploads must not replace.
+func (s Server) checkManifestName(rel string) error {
+	if s.isManifestName(rel) {
+		return withStatus(http.StatusForbidden, fmt.Errorf("\"/files%s\" is %w", rel, errManifestName))
+	}
+	return nil
+}
+
+// serveManifestIndex serves the index of the directory addressed by r, as /files/(dir)/ or /files/(dir)/index.html,
+// unlike http.FileServer which redirects the latter to the former, and has no route for the former here.
+// It returns false if there is no index to serve.
+func (s Server) serveManifestIndex(w http.ResponseWriter, r *http.Request) bool {
+	if !strings.HasSuffix(r.URL.Path, "/") && path.Base(r.URL.Path) != manifestIndexName {
+		return false
+	}
+	rel := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/files"))
+	if path.Base(rel) != manifestIndexName {
+		rel = path.Join(rel, manifestIndexName)
+	}
+	if isInternalName(strings.SplitN(strings.TrimPrefix(rel, "/"), "/", 2)[0]) {
+		return false
+	}
+	s.publishLock.RLock()
+	f, err := os.Open(filepath.Join(s.DocumentRoot, filepath.FromSlash(rel)))
+	s.publishLock.RUnlock()
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	http.ServeContent(w, r, manifestIndexName, info.ModTime(), f)
+	return true
+}
+
+// writeManifests generates the manifests of all directories, then regenerates those of the directories
+// which change. It never returns.
+func (s Server) writeManifests() {
+	var dirs []string
+	err := filepath.Walk(s.DocumentRoot, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		if p != s.DocumentRoot && isInternalName(info.Name()) {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(s.DocumentRoot, p)
+		if err != nil {
+			return err
+		}
+		dirs = append(dirs, path.Clean("/"+filepath.ToSlash(rel)))
+		return nil
+	})
+	if err != nil {
+		logger.WithError(err).Warn("failed to list the directories to generate manifests for")
+	}
+	// walked parents first, so generated children first.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		s.writeManifest(dirs[i])
+	}
+	for range s.Manifests.wake {
+		time.Sleep(manifestDelay)
+		for _, dir := range s.Manifests.take() {
+			s.writeManifest(dir)
+		}
+	}
+}
+
+// writeManifest regenerates the manifest and index of dir, relative to the document root, logging failures.
+// Those of a directory left empty are removed, and so is the directory if empty directories are pruned.
+func (s Server) writeManifest(dir string) {
+	m, err := s.makeManifest(dir)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		logger.WithError(err).WithField("dir", dir).Warn("failed to make the manifest")
+		return
+	}
+	root := filepath.Join(s.DocumentRoot, filepath.FromSlash(dir))
+	if len(m.Files) == 0 && len(m.Dirs) == 0 && dir != "/" {
+		for _, name := range []string{manifestName, manifestIndexName} {
+			if err := os.Remove(filepath.Join(root, name)); err != nil && !os.IsNotExist(err) {
+				logger.WithError(err).WithField("dir", dir).Warn("failed to remove the manifest")
+			}
+		}
+		s.removeEmptyDirs(dir)
+		return
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		logger.WithError(err).WithField("dir", dir).Warn("failed to make the manifest")
+		return
+	}
+	var index bytes.Buffer
+	if err := manifestIndexTemplate.Execute(&index, m); err != nil {
+		logger.WithError(err).WithField("dir", dir).Warn("failed to make the manifest index")
+		return
+	}
+	for name, content := range map[string][]byte{manifestName: append(b, '\n'), manifestIndexName: index.Bytes()} {
+		if err := writeFileAtomically(filepath.Join(root, name), content); err != nil {
+			logger.WithError(err).WithFields(logrus.Fields{"dir": dir, "file": name}).Warn("failed to write the manifest")
+		}
+	}
+}
+
+// makeManifest lists the files and subdirectories of dir, relative to the document root.
+func (s Server) makeManifest(dir string) (dirManifest, error) {
+	m := dirManifest{Dir: path.Join("/files", dir), Files: []manifestEntry{}, Dirs: []manifestSubdir{}}
+	root := filepath.Join(s.DocumentRoot, filepath.FromSlash(dir))
+	infos, err := ioutil.ReadDir(root)
+	if err != nil {
+		return m, err
+	}
+	for _, info := range infos {
+		name := info.Name()
+		p := filepath.Join(root, name)
+		switch {
+		case isInternalName(name):
+		case info.IsDir():
+			sub := filepath.Join(p, manifestName)
+			subInfo, err := os.Stat(sub)
+			if os.IsNotExist(err) {
+				// an empty directory has no manifest.
+				continue
+			} else if err != nil {
+				return m, err
+			}
+			sum, err := s.Digests.of(sub, subInfo)
+			if err != nil {
+				return m, err
+			}
+			m.Dirs = append(m.Dirs, manifestSubdir{Path: name, Digest: s.Digests.label(sum)})
+		case info.Mode().IsRegular() && !s.isManifestName(name):
+			sum, err := s.Digests.of(p, info)
+			if err != nil {
+				return m, err
+			}
+			m.Files = append(m.Files, manifestEntry{Path: name, Size: info.Size(), ModTime: info.ModTime().UTC(), Digest: s.Digests.label(sum)})
+		}
+	}
+	return m, nil
+}
+
+// writeFileAtomically replaces file by content, so that readers see either the old or the new content.
+func writeFileAtomically(file string, content []byte) error {
+	tempFile, err := ioutil.TempFile(filepath.Dir(file), ".manifest_")
+	if err != nil {
+		return err
+	}
+	if _, err := tempFile.Write(content); err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	if err := os.Chmod(tempFile.Name(), 0644); err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	return renameFile(tempFile.Name(), file)
+}
+
+var manifestIndexTemplate = template.Must(template.New("index").Funcs(template.FuncMap{
+	"href": func(name string) string { return (&url.URL{Path: name}).String() },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Index of {{.Dir}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 1em 0.2em 0; text-align: left; }
+td.n { text-align: right; }
+code { font-size: 0.85em; color: #555; }
+</style>
+</head>
+<body>
+<h1>Index of {{.Dir}}</h1>
+<p><a href="manifest.json">manifest.json</a> lists these files with their digests.</p>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th><th>Digest</th></tr>
+{{if ne .Dir "/files"}}<tr><td><a href="../">../</a></td><td></td><td></td><td></td></tr>
+{{end}}{{range .Dirs}}<tr><td><a href="{{href .Path}}/">{{.Path}}/</a></td><td></td><td></td><td></td></tr>
+{{end}}{{range .Files}}<tr><td><a href="{{href .Path}}">{{.Path}}</a></td><td class="n">{{.Size}}</td><td>{{.ModTime.Format "2006-01-02 15:04:05 UTC"}}</td><td><code>{{.Digest}}</code></td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
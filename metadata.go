@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var errNoMetadataStore = errors.New("metadata store is not configured (see -state_dir)")
+
+// fileMeta is what the server records about a stored file besides its content.
+type fileMeta struct {
+	LegalHold *legalHold `json:"legal_hold,omitempty"`
+	Cold      *coldStub  `json:"cold,omitempty"`
+	// Reports are the reports of the file as abusive, pending review.
+	Reports    []abuseReport `json:"reports,omitempty"`
+	Quarantine *quarantine   `json:"quarantine,omitempty"`
+	// Moderation is the outcome of the moderation of the file by the moderation API.
+	Moderation *moderationResult `json:"moderation,omitempty"`
+	// Scan is the analysis of the file by the sandbox; the file cannot be downloaded while it is pending.
+	Scan *sandboxScan `json:"scan,omitempty"`
+	// Stored is when the content was stored, which its retention counts from: the modification time of the file
+	// may be older, e.g. when it is kept by ingestion.
+	Stored *time.Time `json:"stored,omitempty"`
+	// Digest is the digest of the content when it was stored, as "algorithm:hex".
+	Digest string `json:"digest,omitempty"`
+	// CID identifies the content on IPFS, if it was added there.
+	CID string `json:"cid,omitempty"`
+	// Filename is the name the file was uploaded with, if it is stored under another one, like a UUID.
+	Filename string `json:"filename,omitempty"`
+	// LegacySHA256 is the hex SHA-256 digest recorded by older versions; it is read into Digest.
+	LegacySHA256 string `json:"sha256,omitempty"`
+}
+
+// legalHold blocks changes to a file regardless of other policies.
+type legalHold struct {
+	Reason string    `json:"reason,omitempty"`
+	Since  time.Time `json:"since"`
+	By     string    `json:"by,omitempty"`
+}
+
+// metaStore persists fileMeta as a JSON file per stored file, in a tree mirroring the document root.
+type metaStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func newMetaStore(dir string) (*metaStore, error) {
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return nil, err
+	}
+	return &metaStore{dir: dir}, nil
+}
+
+func (m *metaStore) file(rel string) string {
+	return filepath.Join(m.dir, filepath.FromSlash(path.Clean("/"+rel))+".json")
+}
+
+// get returns the metadata of rel, a path relative to the document root. It is empty if nothing is recorded.
+func (m *metaStore) get(rel string) (fileMeta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.read(rel)
+}
+
+func (m *metaStore) read(rel string) (fileMeta, error) {
+	var meta fileMeta
+	b, err := ioutil.ReadFile(m.file(rel))
+	if os.IsNotExist(err) {
+		return meta, nil
+	} else if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(b, &meta)
+	if meta.LegacySHA256 != "" {
+		if meta.Digest == "" {
+			meta.Digest = digestSHA256 + ":" + meta.LegacySHA256
+		}
+		meta.LegacySHA256 = ""
+	}
+	return meta, err
+}
+
+// remove forgets the metadata of rel.
+func (m *metaStore) remove(rel string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	err := os.Remove(m.file(rel))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// recordDigest records the hex digest of a newly stored file, if metadata is kept.
+func (s Server) recordDigest(rel string, sum string) {
+	s.Digests.remember(path.Join(s.DocumentRoot, rel), sum)
+	if s.Meta == nil {
+		return
+	}
+	// the name of the previous content, if any, does not describe the new one.
+	err := s.Meta.update(rel, func(meta *fileMeta) {
+		meta.Digest = s.Digests.label(sum)
+		meta.Filename = ""
+	})
+	if err != nil {
+		logger.WithError(err).WithField("path", rel).Warn("failed to update metadata")
+	}
+}
+
+// recordFilename records filename, the name the file at rel was uploaded with, if it is stored under another one,
+// so that it is downloaded under that name. It must be called after recordDigest.
+func (s Server) recordFilename(rel string, filename string) {
+	if s.Meta == nil || filename == "" || filename == path.Base(rel) {
+		return
+	}
+	if err := s.Meta.update(rel, func(meta *fileMeta) { meta.Filename = filename }); err != nil {
+		logger.WithError(err).WithField("path", rel).Warn("failed to update metadata")
+	}
+}
+
+// setContentDisposition names the file at rel with the name it was uploaded with, if it is stored under another one,
+// so that browsers save it under that name rather than, e.g., its UUID. It is still displayed inline.
+func (s Server) setContentDisposition(w http.ResponseWriter, rel string) {
+	if s.Meta == nil {
+		return
+	}
+	meta, err := s.Meta.get(rel)
+	if err != nil || meta.Filename == "" {
+		return
+	}
+	if v := mime.FormatMediaType("inline", map[string]string{"filename": meta.Filename}); v != "" {
+		w.Header().Set("Content-Disposition", v)
+	}
+}
+
+// update changes the metadata of rel with fn and saves it.
+func (m *metaStore) update(rel string, fn func(*fileMeta)) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	meta, err := m.read(rel)
+	if err != nil {
+		return err
+	}
+	fn(&meta)
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	file := m.file(rel)
+	if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+		return err
+	}
+	// write to a temporary file and rename it, so that a crash never leaves broken metadata.
+	tempFile, err := ioutil.TempFile(filepath.Dir(file), ".meta_")
+	if err != nil {
+		return err
+	}
+	if _, err := tempFile.Write(b); err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return err
+	}
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	return renameFile(tempFile.Name(), file)
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// moderationQueueSize bounds the uploads waiting for moderation; uploads beyond are left unmoderated.
+	moderationQueueSize = 1000
+	// moderationTimeout bounds each call of the moderation API.
+	moderationTimeout = time.Minute
+	// recentModerations is the number of moderated files shown on the dashboard.
+	recentModerations = 20
+)
+
+const (
+	moderationPassed      = "passed"
+	moderationQuarantined = "quarantined"
+	moderationDeleted     = "deleted"
+)
+
+// moderationResult is the outcome of the moderation of a file, recorded in its metadata.
+type moderationResult struct {
+	Scores map[string]float64 `json:"scores"`
+	Action string             `json:"action"`
+	// Category is the category whose score led to the action, if any.
+	Category string    `json:"category,omitempty"`
+	At       time.Time `json:"at"`
+}
+
+// moderationEvent is a moderated file, as shown on the dashboard.
+type moderationEvent struct {
+	Path string
+	moderationResult
+}
+
+// scoreLimits maps categories to the score above which a file is acted on; the limit of "*" applies to any category.
+type scoreLimits map[string]float64
+
+// parseScoreLimits parses limits given as "0.8" for any category, or "nudity=0.7,violence=0.9".
+func parseScoreLimits(def string) (scoreLimits, error) {
+	limits := scoreLimits{}
+	for _, item := range strings.Split(def, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		category, value := "*", item
+		if i := strings.Index(item, "="); i >= 0 {
+			category, value = strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+		}
+		limit, err := strconv.ParseFloat(value, 64)
+		if err != nil || category == "" {
+			return nil, fmt.Errorf("invalid score limit %q (score or category=score)", item)
+		}
+		limits[category] = limit
+	}
+	return limits, nil
+}
+
+// exceeded returns the category with the highest score over its limit, if any.
+func (l scoreLimits) exceeded(scores map[string]float64) (string, bool) {
+	categories := make([]string, 0, len(scores))
+	for category := range scores {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	found, best := "", 0.0
+	for _, category := range categories {
+		limit, ok := l[category]
+		if !ok {
+			limit, ok = l["*"]
+		}
+		if ok && scores[category] > limit && (found == "" || scores[category] > best) {
+			found, best = category, scores[category]
+		}
+	}
+	return found, found != ""
+}
+
+// moderator sends uploaded images and text to an external moderation API, and quarantines or deletes
+// the files whose scores exceed the configured limits.
+//
+// The content of a file is posted as is, with its Content-Type, to URL, which responds with the scores
+// of the file by category, between 0 and 1:
+//
+//	{"scores": {"nudity": 0.02, "violence": 0.91}}
+type moderator struct {
+	URL   string
+	Token string
+	// Types are the media types of the files to moderate, like "image/*".
+	Types []string
+	// MaxSize is the size of the largest file sent; larger files are not moderated.
+	MaxSize    int64
+	Quarantine scoreLimits
+	Delete     scoreLimits
+
+	queue  chan uploadEvent
+	client *http.Client
+}
+
+func newModerator(url string) *moderator {
+	return &moderator{
+		URL:    url,
+		queue:  make(chan uploadEvent, moderationQueueSize),
+		client: &http.Client{Timeout: moderationTimeout},
+	}
+}
+
+// enqueue queues the uploaded file e for moderation. It returns right away.
+func (m *moderator) enqueue(e uploadEvent) {
+	if m == nil {
+		return
+	}
+	select {
+	case m.queue <- e:
+	default:
+		logger.WithField("path", e.Path).Warn("moderation queue full, file left unmoderated")
+	}
+}
+
+// contentType returns the media type of the file at name, by its extension or else its content.
+func contentType(name string) (string, error) {
+	if t := mime.TypeByExtension(path.Ext(name)); t != "" {
+		return t, nil
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	return http.DetectContentType(head[:n]), nil
+}
+
+// accepts tells whether files of media type t are moderated.
+func (m *moderator) accepts(t string) bool {
+	base, _, err := mime.ParseMediaType(t)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range m.Types {
+		if ok, _ := path.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// score posts the file at name, of media type t and the given size, to the moderation API and returns its scores.
+func (m *moderator) score(ctx context.Context, name string, t string, size int64) (map[string]float64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	req, err := http.NewRequest(http.MethodPost, m.URL, f)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = size
+	req.Header.Set("Content-Type", t)
+	if m.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+m.Token)
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("moderation API responded %s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+	var result struct {
+		Scores map[string]float64 `json:"scores"`
+	}
+	if err := json.Unmarshal(b, &result); err != nil {
+		return nil, fmt.Errorf("invalid response of the moderation API: %v", err)
+	}
+	return result.Scores, nil
+}
+
+// moderate moderates the files queued by announce. It never returns.
+func (s Server) moderate() {
+	for e := range s.Moderation.queue {
+		if err := s.moderateFile(strings.TrimPrefix(e.Path, "/files")); err != nil {
+			logger.WithError(err).WithField("path", e.Path).Warn("failed to moderate the file")
+		}
+	}
+}
+
+// moderateFile has rel, a path relative to the document root, scored by the moderation API, and acts on the result.
+// Files under legal hold are quarantined rather than deleted.
+func (s Server) moderateFile(rel string) error {
+	m := s.Moderation
+	name := path.Join(s.DocumentRoot, rel)
+	info, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Size() > m.MaxSize {
+		return nil
+	}
+	t, err := contentType(name)
+	if err != nil || !m.accepts(t) {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), moderationTimeout)
+	defer cancel()
+	scores, err := m.score(ctx, name, t, info.Size())
+	if err != nil {
+		return err
+	}
+
+	result := moderationResult{Scores: scores, Action: moderationPassed, At: time.Now()}
+	if category, ok := m.Delete.exceeded(scores); ok {
+		result.Action, result.Category = moderationDeleted, category
+		if err := s.checkLegalHold(rel); err != nil {
+			result.Action = moderationQuarantined
+		}
+	} else if category, ok := m.Quarantine.exceeded(scores); ok {
+		result.Action, result.Category = moderationQuarantined, category
+	}
+	entry := auditLog().WithFields(logrus.Fields{
+		"path":     rel,
+		"action":   result.Action,
+		"category": result.Category,
+	})
+	if result.Category != "" {
+		entry = entry.WithField("score", scores[result.Category])
+	}
+
+	switch result.Action {
+	case moderationDeleted:
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+		s.forget(rel)
+		s.removeEmptyDirs(path.Dir(rel))
+		s.emit(fileEvent{Type: eventDelete, Path: "/files" + rel, Actor: "moderation"})
+		entry.Warn("file deleted by moderation")
+	case moderationQuarantined:
+		reason := fmt.Sprintf("moderation: %s %.2f", result.Category, scores[result.Category])
+		if err := s.updateModeration(rel, func(meta *fileMeta) {
+			meta.Moderation = &result
+			if meta.Quarantine == nil {
+				meta.Quarantine = &quarantine{Reason: reason, Since: result.At}
+			}
+		}); err != nil {
+			return err
+		}
+		entry.Warn("file quarantined by moderation")
+	default:
+		if err := s.updateModeration(rel, func(meta *fileMeta) { meta.Moderation = &result }); err != nil {
+			return err
+		}
+		entry.Info("file passed moderation")
+	}
+	s.Stats.addModeration(moderationEvent{Path: "/files" + rel, moderationResult: result})
+	return nil
+}
+
+// updateModeration records the moderation of rel in its metadata, if metadata is kept.
+func (s Server) updateModeration(rel string, fn func(*fileMeta)) error {
+	if s.Meta == nil {
+		return nil
+	}
+	return s.Meta.update(rel, fn)
+}
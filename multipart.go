@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultMultipartMemory limits the form fields of a multipart request besides the file, which are kept in memory.
+const defaultMultipartMemory = 1 << 20
+
+// maxMultipartFiles limits the number of files in a single multipart request, e.g. a folder upload.
+const maxMultipartFiles = 10000
+
+type multipartKey struct{}
+
+// multipartForms wraps h so that the body of a multipart request is read as a stream before h is served:
+// the "file" parts are spooled straight to the spool directory, as by receive, and the other fields,
+// up to MultipartMemory bytes in total, are made available by r.FormValue.
+//
+// r.ParseMultipartForm, which r.FormValue would call otherwise, keeps parts of up to 32 MB in memory and the rest
+// in the system temporary directory, so concurrent uploads of medium-size files each held that much memory.
+//
+// Uploads are authenticated before their files are received: by the credentials sent outside of the body
+// before it is read, or else by the token field as soon as it is read, so that the files sent after it are not.
+func (s Server) multipartForms(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a validation only has the file described by its parameters, so a body sent anyway is not read.
+		if !isMultipart(r) || (r.Method != http.MethodPost && r.Method != http.MethodPut) || isValidateOnly(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if s.authenticatesUpload(r) && s.hasCredentials(r) {
+			if err := s.authenticate(r); err != nil {
+				w.Header().Set("Connection", "close")
+				respondError(w, err)
+				return
+			}
+		} else if r.URL.Query().Get("signature") != "" {
+			params, err := s.Signer.verify(r)
+			if err == nil {
+				err = s.limitFileRequestBody(w, r, params)
+			}
+			if err != nil {
+				w.Header().Set("Connection", "close")
+				respondError(w, err)
+				return
+			}
+		}
+		uploads, err := s.readMultipart(r)
+		if err != nil {
+			// the rest of the body is never read, so don't try to reuse the connection.
+			w.Header().Set("Connection", "close")
+			logFailure(logger.WithField("path", r.URL.Path), err, "failed to read the multipart request")
+			respondError(w, err)
+			return
+		}
+		// the files are moved into place if the upload succeeds, so this only cleans up otherwise.
+		defer removeUploads(uploads)
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), multipartKey{}, uploads)))
+	})
+}
+
+// multipartUploads returns the files of a multipart request spooled by multipartForms, in the order they were sent.
+func multipartUploads(r *http.Request) []received {
+	uploads, _ := r.Context().Value(multipartKey{}).([]received)
+	return uploads
+}
+
+// authenticatesUpload reports whether r is an upload which Server.ServeHTTP authenticates with checkToken.
+// Signed uploads are authorized by their signature instead.
+func (s Server) authenticatesUpload(r *http.Request) bool {
+	if r.URL.Path != "/upload" && !strings.HasPrefix(r.URL.Path, "/files/") {
+		return false
+	}
+	return r.URL.Query().Get("signature") == "" && s.isAuthenticationRequired(r)
+}
+
+func removeUploads(uploads []received) {
+	for _, rcv := range uploads {
+		os.Remove(rcv.TempName)
+	}
+}
+
+// partFilename returns the file name of a part as sent, unlike part.FileName, which drops the directories.
+// Browsers send relative paths, like "photos/2020/a.jpg", for files of a folder.
+func partFilename(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return part.FileName()
+	}
+	return strings.TrimPrefix(path.Clean("/"+toSlash(params["filename"])), "/")
+}
+
+// readMultipart reads the body of a multipart request. The "file" parts are spooled and returned.
+// Files in other parts are not kept, but count against the upload limit.
+//
+// The relative path of a file within a folder is taken from its file name, or from the webkitRelativePath field,
+// which may be repeated in the same order as the files.
+func (s Server) readMultipart(r *http.Request) (uploads []received, err error) {
+	defer func() {
+		if err != nil {
+			removeUploads(uploads)
+			uploads = nil
+		}
+	}()
+	// parse the query into r.Form first; the body is left alone since it is not URL-encoded.
+	if err := r.ParseForm(); err != nil {
+		return nil, withStatus(http.StatusBadRequest, err)
+	}
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	values := url.Values{}
+	// without other credentials, the token field is checked once read, wherever it is in the form.
+	authenticated := !s.authenticatesUpload(r) || s.hasCredentials(r)
+	memory := s.MultipartMemory
+	discarded := int64(0)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return uploads, err
+		}
+		name := part.FormName()
+		// signatures are small, and kept in memory like the other fields even when sent as files.
+		if part.FileName() != "" && name != signatureField {
+			if name == "file" {
+				if len(uploads) >= maxMultipartFiles {
+					return uploads, withStatus(http.StatusRequestEntityTooLarge, fmt.Errorf("too many files (at most %d)", maxMultipartFiles))
+				}
+				rcv := received{Filename: part.FileName()}
+				if filename := partFilename(part); strings.Contains(filename, "/") {
+					rcv.RelativePath = filename
+				}
+				logger.WithFields(logrus.Fields{
+					"filename": partFilename(part),
+					"header":   part.Header,
+				}).Debug("receiving the file part")
+				rcv, err := s.spool(r.Context(), part, rcv)
+				if err != nil {
+					return uploads, err
+				}
+				uploads = append(uploads, rcv)
+				continue
+			}
+			n, err := io.Copy(ioutil.Discard, io.LimitReader(part, s.MaxUploadSize-discarded+1))
+			if err != nil {
+				return uploads, err
+			}
+			if discarded += n; discarded > s.MaxUploadSize {
+				return uploads, errFileTooLarge
+			}
+			continue
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(part, memory+1))
+		if err != nil {
+			return uploads, err
+		}
+		if memory -= int64(len(b)); memory < 0 {
+			return uploads, multipart.ErrMessageTooLarge
+		}
+		if name == "token" && !authenticated {
+			form := r.WithContext(r.Context())
+			form.Form = url.Values{"token": {string(b)}}
+			if err := s.authenticate(form); err != nil {
+				return uploads, err
+			}
+			authenticated = true
+		}
+		values.Add(name, string(b))
+	}
+	if signatures := values[signatureField]; len(signatures) == len(uploads) {
+		for i, sig := range signatures {
+			uploads[i].Signature = []byte(sig)
+		}
+	} else if len(signatures) > 0 {
+		return uploads, withStatus(http.StatusBadRequest, fmt.Errorf("%d signatures for %d files", len(signatures), len(uploads)))
+	}
+	if relativePaths := values["webkitRelativePath"]; len(relativePaths) == len(uploads) {
+		for i, p := range relativePaths {
+			if p != "" {
+				uploads[i].RelativePath = strings.TrimPrefix(path.Clean("/"+toSlash(p)), "/")
+			}
+		}
+	}
+	// as r.ParseMultipartForm would, so that r.FormValue does not try to parse the body again.
+	r.MultipartForm = &multipart.Form{Value: values, File: map[string][]*multipart.FileHeader{}}
+	for k, vs := range values {
+		r.PostForm[k] = append(r.PostForm[k], vs...)
+		r.Form[k] = append(vs, r.Form[k]...)
+	}
+	return uploads, nil
+}
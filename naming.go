@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// naming strategies for files uploaded by POST
+const (
+	namingOriginal  = "original"
+	namingUUID      = "uuid"
+	namingHash      = "hash"
+	namingTimestamp = "timestamp"
+	namingTemplate  = "template"
+)
+
+// collision handling for name-based strategies
+const (
+	collisionOverwrite = "overwrite"
+	collisionRename    = "rename"
+	collisionReject    = "reject"
+)
+
+// maxRenameAttempts bounds the search for a free name.
+const maxRenameAttempts = 1000
+
+var errNameCollision = errors.New("a file with the same name already exists")
+
+// naming decides the names of files uploaded by POST.
+type naming struct {
+	Strategy string
+	// Template is used with the "template" strategy. It may contain {name}, {base}, {ext}, {uuid}, {hash}, {timestamp} and {date}.
+	Template string
+	// Collision decides what happens when the name derived from the original name is taken:
+	// "overwrite" it, "rename" the new file with a numeric suffix, or "reject" the upload.
+	// UUIDs are regenerated, and files named by hash are kept as they are since their content is the same.
+	Collision string
+}
+
+func (n naming) validate() error {
+	switch n.Strategy {
+	case namingOriginal, namingUUID, namingHash, namingTimestamp:
+	case namingTemplate:
+		if n.Template == "" {
+			return errors.New("naming template is empty")
+		}
+	default:
+		return fmt.Errorf("unknown naming strategy %q", n.Strategy)
+	}
+	switch n.Collision {
+	case collisionOverwrite, collisionRename, collisionReject:
+	default:
+		return fmt.Errorf("unknown collision handling %q", n.Collision)
+	}
+	return nil
+}
+
+// name returns the name to store the uploaded content as. hash is the hex digest of the content, and exists reports whether a name is taken.
+// If keep is true, the content is already stored under the name and need not be written again.
+func (n naming) name(original string, hash string, exists func(string) bool) (name string, keep bool, err error) {
+	switch n.Strategy {
+	case namingHash:
+		return hash, exists(hash), nil
+	case namingUUID:
+		for i := 0; i < maxRenameAttempts; i++ {
+			if name = newUUID(); !exists(name) {
+				return name, false, nil
+			}
+		}
+		return "", false, errNameCollision
+	}
+
+	if original == "" {
+		original = hash
+	}
+	switch n.Strategy {
+	case namingTimestamp:
+		name = time.Now().UTC().Format("20060102T150405Z") + "-" + original
+	case namingTemplate:
+		name = expandNameTemplate(n.Template, original, hash)
+	default:
+		name = original
+	}
+	if !exists(name) {
+		return name, false, nil
+	}
+	switch n.Collision {
+	case collisionReject:
+		return "", false, errNameCollision
+	case collisionRename:
+		ext := path.Ext(name)
+		base := strings.TrimSuffix(name, ext)
+		for i := 1; i <= maxRenameAttempts; i++ {
+			candidate := fmt.Sprintf("%s-%d%s", base, i, ext)
+			if !exists(candidate) {
+				return candidate, false, nil
+			}
+		}
+		return "", false, errNameCollision
+	}
+	return name, false, nil
+}
+
+func expandNameTemplate(template string, original string, hash string) string {
+	now := time.Now().UTC()
+	ext := path.Ext(original)
+	return strings.NewReplacer(
+		"{name}", original,
+		"{base}", strings.TrimSuffix(original, ext),
+		"{ext}", ext,
+		"{uuid}", newUUID(),
+		"{hash}", hash,
+		"{timestamp}", now.Format("20060102T150405Z"),
+		"{date}", now.Format("2006-01-02"),
+	).Replace(template)
+}
+
+// newUUID generates a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsPublisher publishes messages to a NATS subject with the core NATS text protocol.
+// It connects on first use, and again after the connection is lost.
+type natsPublisher struct {
+	addr    string
+	subject string
+	user    *url.Userinfo
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newNATSPublisher(u *url.URL) (*natsPublisher, error) {
+	subject := strings.Trim(u.Path, "/")
+	if u.Host == "" || subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return nil, errors.New("NATS URL must be given as nats://[user:password@]host[:port]/subject")
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	return &natsPublisher{addr: addr, subject: subject, user: u.User}, nil
+}
+
+func (p *natsPublisher) String() string {
+	return "nats://" + p.addr + "/" + p.subject
+}
+
+// connect opens a connection, and waits for the server to acknowledge CONNECT, so that authentication errors are reported.
+func (p *natsPublisher) connect() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", p.addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected greeting from NATS server: %q, %v", line, err)
+	}
+	options := map[string]interface{}{"verbose": false, "pedantic": false, "name": "simple-upload-server", "lang": "go"}
+	if p.user != nil {
+		options["user"] = p.user.Username()
+		if password, ok := p.user.Password(); ok {
+			options["pass"] = password
+		}
+	}
+	b, _ := json.Marshal(options)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", b); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "PONG" {
+			break
+		}
+		if strings.HasPrefix(line, "-ERR") {
+			conn.Close()
+			return nil, errors.New("NATS server: " + line)
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	go p.serve(conn, r)
+	return conn, nil
+}
+
+// serve answers the keep-alive pings of the server until the connection is closed.
+func (p *natsPublisher) serve(conn net.Conn, r *bufio.Reader) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		line = strings.TrimSpace(line)
+		if line == "PING" {
+			p.mu.Lock()
+			_, err = conn.Write([]byte("PONG\r\n"))
+			p.mu.Unlock()
+		} else if strings.HasPrefix(line, "-ERR") {
+			logger.WithField("error", line).Warn("NATS server reported an error")
+		}
+		if err != nil {
+			break
+		}
+	}
+	p.mu.Lock()
+	if p.conn == conn {
+		p.conn = nil
+	}
+	p.mu.Unlock()
+	conn.Close()
+}
+
+func (p *natsPublisher) publish(key string, payload []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn == nil {
+		// connect does not need the lock, but holding it keeps publications in order.
+		conn, err := p.connect()
+		if err != nil {
+			return err
+		}
+		p.conn = conn
+	}
+	p.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := fmt.Fprintf(p.conn, "PUB %s %d\r\n%s\r\n", p.subject, len(payload), payload)
+	if err != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+	return err
+}
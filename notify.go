@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// chatKinds maps the supported chat services to the field of the JSON payload their incoming webhooks take the message in.
+var chatKinds = map[string]string{
+	"slack":   "text",
+	"teams":   "text",
+	"discord": "content",
+}
+
+// defaultChatTemplate is the message announcing an upload, unless -notify_template is given.
+const defaultChatTemplate = "New file {url} ({size} bytes) uploaded by {uploader}"
+
+// chatChannel announces the uploads matching Pattern to the incoming webhook of a chat channel.
+type chatChannel struct {
+	// Pattern is matched against the path of a file, like "/releases/*/*.tar.gz", or against its name if it has no slash, like "*.apk".
+	Pattern string
+	Kind    string
+	URL     string
+}
+
+// parseChatChannel parses a channel given as "pattern=kind:url", like "/releases/*=slack:https://hooks.slack.com/services/...".
+func parseChatChannel(def string) (chatChannel, error) {
+	i := strings.Index(def, "=")
+	j := strings.Index(def, ":")
+	if i <= 0 || j < i {
+		return chatChannel{}, fmt.Errorf("notification %q must be given as pattern=kind:url", def)
+	}
+	c := chatChannel{Pattern: def[:i], Kind: def[i+1 : j], URL: def[j+1:]}
+	if _, err := path.Match(c.Pattern, ""); err != nil {
+		return c, fmt.Errorf("invalid pattern %q in notification %q", c.Pattern, def)
+	}
+	if _, ok := chatKinds[c.Kind]; !ok {
+		return c, fmt.Errorf("unknown chat service %q in notification %q (slack, teams or discord)", c.Kind, def)
+	}
+	if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return c, fmt.Errorf("invalid webhook URL in notification %q", def)
+	}
+	return c, nil
+}
+
+// matchUploadPattern reports whether rel, a path relative to the document root, matches pattern:
+// a pattern with a slash is matched against the path, and one without against the file name.
+func matchUploadPattern(pattern string, rel string) bool {
+	if !strings.Contains(pattern, "/") {
+		ok, _ := path.Match(pattern, path.Base(rel))
+		return ok
+	}
+	ok, _ := path.Match(pattern, rel)
+	return ok
+}
+
+// chatNotifier announces uploads to chat channels.
+type chatNotifier struct {
+	Channels []chatChannel
+	// Template is the message, where {path}, {name}, {url}, {size}, {digest}, {uploader} and {upload_id} are replaced.
+	Template string
+}
+
+// uploadEvent describes a stored file to announce.
+type uploadEvent struct {
+	Path     string
+	URL      string
+	Size     int64
+	Digest   string
+	Uploader string
+	// UploadID is the ID of the upload which stored the file.
+	UploadID string
+}
+
+// newUploadEvent describes rel, a path relative to the document root, stored by r.
+func (s Server) newUploadEvent(r *http.Request, rel string, size int64, sum string) uploadEvent {
+	return uploadEvent{
+		Path:     "/files" + rel,
+		URL:      requestBaseURL(r) + (&url.URL{Path: "/files" + rel}).String(),
+		Size:     size,
+		Digest:   s.Digests.label(sum),
+		Uploader: clientIP(r),
+		UploadID: uploadIDOf(r.Context()),
+	}
+}
+
+func (n *chatNotifier) message(e uploadEvent) string {
+	return strings.NewReplacer(
+		"{path}", e.Path,
+		"{name}", path.Base(e.Path),
+		"{url}", e.URL,
+		"{size}", strconv.FormatInt(e.Size, 10),
+		"{digest}", e.Digest,
+		"{uploader}", e.Uploader,
+		"{upload_id}", e.UploadID,
+	).Replace(n.Template)
+}
+
+// announce posts a message about the upload to the chat channels matching it, emails it, publishes its event
+// and queues it for moderation and the sandbox as configured.
+// It returns right away.
+func (s Server) announce(e uploadEvent) {
+	s.Stats.addUpload(e)
+	s.emit(fileEvent{Type: eventUpload, Path: e.Path, Size: e.Size, Digest: e.Digest, Actor: e.Uploader, UploadID: e.UploadID})
+	s.sendEmails(e)
+	s.Moderation.enqueue(e)
+	s.holdForScan(e)
+	if s.Chat == nil {
+		return
+	}
+	rel := strings.TrimPrefix(e.Path, "/files")
+	for _, c := range s.Chat.Channels {
+		if !matchUploadPattern(c.Pattern, rel) {
+			continue
+		}
+		payload := map[string]string{chatKinds[c.Kind]: s.Chat.message(e)}
+		go func(c chatChannel) {
+			if err := postJSON(context.Background(), c.URL, payload); err != nil {
+				logger.WithError(err).WithFields(logrus.Fields{
+					"upload_id": e.UploadID,
+					"path":      e.Path,
+					"pattern":   c.Pattern,
+					"chat":      c.Kind,
+				}).Warn("failed to send the chat notification")
+			}
+		}(c)
+	}
+}
+
+// announceTransaction announces the files published by tx on behalf of r.
+func (s Server) announceTransaction(r *http.Request, tx *transaction) {
+	for rel, size := range tx.Files {
+		s.announce(s.newUploadEvent(r, rel, size, tx.digests[rel]))
+	}
+}
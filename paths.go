@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/text/unicode/norm"
+)
+
+// handling of names which differ from existing ones only in case
+const (
+	caseCollisionAllow  = ""
+	caseCollisionReject = "reject"
+	caseCollisionRename = "rename"
+)
+
+var (
+	errReservedName = errors.New("the name cannot be used on this platform")
+	errPathTooDeep  = errors.New("the path is nested too deep")
+	errNameTooLong  = errors.New("the name is too long")
+	errPathTooLong  = errors.New("the path is too long")
+)
+
+// pathLimits bounds the paths which can be stored; zero values are unlimited.
+type pathLimits struct {
+	// MaxDepth is the number of directories a file can be nested in.
+	MaxDepth int
+	// MaxNameLength is the length in bytes of each name in a path.
+	MaxNameLength int
+	// MaxLength is the length in bytes of a path relative to the document root, without the leading slash.
+	MaxLength int
+}
+
+// check returns an error if rel, a clean path relative to the document root, exceeds the limits.
+func (l pathLimits) check(rel string) error {
+	if l.MaxLength > 0 && len(rel)-1 > l.MaxLength {
+		return withStatus(http.StatusBadRequest, fmt.Errorf("%q: %w (%d bytes, at most %d)", rel, errPathTooLong, len(rel)-1, l.MaxLength))
+	}
+	names := strings.Split(rel[1:], "/")
+	if l.MaxDepth > 0 && len(names)-1 > l.MaxDepth {
+		return withStatus(http.StatusBadRequest, fmt.Errorf("%q: %w (%d directories, at most %d)", rel, errPathTooDeep, len(names)-1, l.MaxDepth))
+	}
+	if l.MaxNameLength > 0 {
+		for _, name := range names {
+			if len(name) > l.MaxNameLength {
+				return withStatus(http.StatusBadRequest, fmt.Errorf("%q: %w (%d bytes, at most %d)", name, errNameTooLong, len(name), l.MaxNameLength))
+			}
+		}
+	}
+	return nil
+}
+
+// storedPath cleans p, a path given by a client, into a path relative to the document root,
+// and returns an error if it cannot be stored on this platform or exceeds the path limits.
+// Names are normalized to NFC if configured, and checked against existing names which differ only in case.
+func (s Server) storedPath(p string) (string, error) {
+	rel := path.Clean("/" + toSlash(p))
+	if rel == "/" {
+		return "", withStatus(http.StatusBadRequest, fmt.Errorf("invalid file name %q", p))
+	}
+	if s.NormalizeNames {
+		rel = norm.NFC.String(rel)
+	}
+	if err := s.PathLimits.check(rel); err != nil {
+		return "", err
+	}
+	names := strings.Split(rel[1:], "/")
+	for _, name := range names {
+		if err := checkName(name); err != nil {
+			return "", withStatus(http.StatusBadRequest, fmt.Errorf("%q: %w", name, err))
+		}
+	}
+	if s.CaseCollision == caseCollisionAllow {
+		return rel, nil
+	}
+	dir := "/"
+	for i, name := range names {
+		existing := s.caseVariant(dir, name)
+		if existing != "" {
+			if s.CaseCollision == caseCollisionReject {
+				logger.WithFields(logrus.Fields{
+					"path":     rel,
+					"existing": path.Join(dir, existing),
+				}).Info("case-insensitive name collision")
+				return "", fmt.Errorf("%q collides with %q: %w", path.Join(dir, name), path.Join(dir, existing), errNameCollision)
+			}
+			if i < len(names)-1 {
+				// put the file in the existing directory, rather than a second one which only differs in case.
+				name = existing
+			} else {
+				renamed, err := s.renameCaseVariant(dir, name)
+				if err != nil {
+					return "", err
+				}
+				name = renamed
+			}
+		}
+		dir = path.Join(dir, name)
+	}
+	return dir, nil
+}
+
+// caseVariant returns the name of an entry of dir, relative to the document root, which equals name
+// except in case or normalization, or an empty string if there is none.
+func (s Server) caseVariant(dir string, name string) string {
+	entries, err := ioutil.ReadDir(path.Join(s.DocumentRoot, dir))
+	if err != nil {
+		return ""
+	}
+	normalized := norm.NFC.String(name)
+	for _, e := range entries {
+		existing := e.Name()
+		if existing != name && strings.EqualFold(norm.NFC.String(existing), normalized) {
+			return existing
+		}
+	}
+	return ""
+}
+
+// renameCaseVariant adds a numeric suffix to name until no entry of dir differs from it only in case.
+func (s Server) renameCaseVariant(dir string, name string) (string, error) {
+	ext := path.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; i <= maxRenameAttempts; i++ {
+		candidate := fmt.Sprintf("%s-%d%s", base, i, ext)
+		if s.caseVariant(dir, candidate) == "" {
+			if _, err := os.Stat(path.Join(s.DocumentRoot, dir, candidate)); err != nil {
+				return candidate, nil
+			}
+		}
+	}
+	return "", errNameCollision
+}
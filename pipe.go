@@ -0,0 +1,118 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// handlePipe serves GET /pipe/(dir), streaming the files under dir as an uncompressed tar, e.g. to restore it by
+//
+//	curl http://server/pipe/dir | tar -x
+func (s Server) handlePipe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	if err := s.checkToken(r); s.isAuthenticationRequired(r) && err != nil {
+		respondError(w, err)
+		return
+	}
+	dir := path.Clean("/" + toSlash(strings.TrimPrefix(r.URL.Path, "/pipe")))
+	root := path.Join(s.DocumentRoot, dir)
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		respondError(w, fmt.Errorf("\"%s\" is %w", dir, errNotFound))
+		return
+	}
+
+	name := path.Base(dir)
+	if dir == "/" {
+		name = "files"
+	}
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.tar\"", name))
+	w.WriteHeader(http.StatusOK)
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && isInternalName(info.Name()) {
+			return filepath.SkipDir
+		}
+		if p == root || !(info.IsDir() || info.Mode().IsRegular()) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			if err := s.checkQuarantine(path.Join(dir, filepath.ToSlash(rel))); errors.Is(err, errQuarantined) || errors.Is(err, errPendingScan) {
+				logger.WithField("path", path.Join(dir, filepath.ToSlash(rel))).Info("quarantined file left out of the tar stream")
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+		if info.Mode().IsRegular() && s.Tiering != nil {
+			stored := path.Join(dir, filepath.ToSlash(rel))
+			stub, err := s.coldStubOf(stored)
+			if err != nil {
+				return err
+			}
+			if stub != nil {
+				if !s.Tiering.Transparent {
+					logger.WithField("path", stored).Info("file in cold storage left out of the tar stream")
+					return nil
+				}
+				if err := s.restore(r.Context(), stored, stub); err != nil {
+					return err
+				}
+				if info, err = os.Stat(p); err != nil {
+					return err
+				}
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if !info.Mode().IsRegular() {
+			return tw.WriteHeader(hdr)
+		}
+		s.publishLock.RLock()
+		f, err := os.Open(p)
+		s.publishLock.RUnlock()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		// the size in the header must match, so the file is read as it was when it was listed.
+		hdr.Size = info.Size()
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = copyBuffer(tw, io.LimitReader(f, info.Size()))
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		// the status has been sent, so the only way to tell the client is to break the stream.
+		logger.WithError(err).WithField("dir", dir).Error("failed to stream the directory")
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+const (
+	pipelineChunkSize = 1 << 20
+	pipelineChunks    = 4
+)
+
+type chunk struct {
+	buf     []byte
+	n       int
+	pending sync.WaitGroup
+}
+
+// pipeCopy copies src to all stages in a single pass. Each stage runs in its own goroutine and receives
+// the chunks in order, so that slow stages, such as hashing and writing to the disk, overlap instead of adding up.
+// It returns the number of bytes read and the first error of src or any stage, or of ctx once it is done:
+// a client disconnecting or a deadline passing stops the copy at the next chunk instead of the end of the content.
+func pipeCopy(ctx context.Context, src io.Reader, stages ...io.Writer) (int64, error) {
+	free := make(chan *chunk, pipelineChunks)
+	for i := 0; i < pipelineChunks; i++ {
+		free <- &chunk{buf: *chunkBuffers.Get().(*[]byte)}
+	}
+	defer func() {
+		// every chunk is back once all stages are done.
+		for i := 0; i < pipelineChunks; i++ {
+			c := <-free
+			chunkBuffers.Put(&c.buf)
+		}
+	}()
+
+	var mu sync.Mutex
+	var firstErr error
+	fail := func(err error) {
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+	}
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+
+	var workers sync.WaitGroup
+	queues := make([]chan *chunk, len(stages))
+	for i, stage := range stages {
+		queues[i] = make(chan *chunk, pipelineChunks)
+		workers.Add(1)
+		go func(stage io.Writer, queue chan *chunk) {
+			defer workers.Done()
+			broken := false
+			for c := range queue {
+				if !broken && ctx.Err() != nil {
+					fail(ctx.Err())
+					broken = true
+				}
+				if !broken {
+					if _, err := stage.Write(c.buf[:c.n]); err != nil {
+						fail(err)
+						broken = true
+					}
+				}
+				c.pending.Done()
+			}
+		}(stage, queues[i])
+	}
+
+	var total int64
+	for !failed() {
+		var c *chunk
+		select {
+		case c = <-free:
+		case <-ctx.Done():
+			fail(ctx.Err())
+			continue
+		}
+		n, err := fill(contextReader{ctx: ctx, r: src}, c.buf)
+		if n > 0 {
+			c.n = n
+			total += int64(n)
+			c.pending.Add(len(stages))
+			for _, queue := range queues {
+				queue <- c
+			}
+			// recycle the chunk once every stage is done with it.
+			go func(c *chunk) {
+				c.pending.Wait()
+				free <- c
+			}(c)
+		} else {
+			free <- c
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fail(err)
+		}
+	}
+	for _, queue := range queues {
+		close(queue)
+	}
+	workers.Wait()
+	return total, firstErr
+}
+
+// contextReader fails reads once ctx is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(b)
+}
+
+// fill reads from src until buf is full or an error occurs. Unlike io.ReadFull, it returns errors of src as they are.
+func fill(src io.Reader, buf []byte) (n int, err error) {
+	for n < len(buf) && err == nil {
+		var m int
+		m, err = src.Read(buf[n:])
+		n += m
+	}
+	return n, err
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// policy holds the rules applied to the files under a path prefix.
+type policy struct {
+	// Prefix is a path relative to the document root, like "/archive".
+	Prefix string
+	// Retention makes files write-once: they cannot be overwritten or deleted until this duration has elapsed since the upload.
+	Retention time.Duration
+	// Artifacts makes files immutable once uploaded, and keeps their checksum files next to them, as in a Maven repository.
+	Artifacts bool
+	// Extensions, if not empty, are the only extensions of the files which can be stored, in lowercase without the dot,
+	// like "jpg" or "tar.gz".
+	Extensions []string
+	// SVG, if not empty, is what is done with the SVG images with scripts or event handlers: "sanitize" removes them,
+	// and "reject" rejects the image.
+	SVG string
+	// Log, if not nil, makes the directories under the prefix append-only logs, whose content is appended to in segments.
+	Log *logMode
+}
+
+// policies finds the policy for a path by the longest matching prefix.
+type policies []policy
+
+// matchPrefix reports whether rel is prefix itself or under it.
+func matchPrefix(rel string, prefix string) bool {
+	if prefix == "/" {
+		return true
+	}
+	return rel == prefix || strings.HasPrefix(rel, prefix+"/")
+}
+
+// cleanPrefix normalizes a path prefix given in configuration.
+func cleanPrefix(prefix string) string {
+	return path.Clean("/" + prefix)
+}
+
+// lookup returns the policy applying to rel, a path relative to the document root.
+func (ps policies) lookup(rel string) (policy, bool) {
+	found := -1
+	for i, p := range ps {
+		if matchPrefix(rel, p.Prefix) && (found < 0 || len(p.Prefix) > len(ps[found].Prefix)) {
+			found = i
+		}
+	}
+	if found < 0 {
+		return policy{}, false
+	}
+	return ps[found], true
+}
+
+// set adds p, replacing the policy for the same prefix if any.
+func (ps policies) set(p policy) policies {
+	for i := range ps {
+		if ps[i].Prefix == p.Prefix {
+			ps[i] = p
+			return ps
+		}
+	}
+	return append(ps, p)
+}
+
+// parseRetention parses a retention rule given as "prefix=duration", like "/archive=8760h".
+func parseRetention(def string) (policy, error) {
+	i := strings.LastIndex(def, "=")
+	if i <= 0 {
+		return policy{}, fmt.Errorf("retention %q must be given as prefix=duration", def)
+	}
+	d, err := time.ParseDuration(def[i+1:])
+	if err != nil {
+		return policy{}, fmt.Errorf("invalid retention period in %q: %v", def, err)
+	}
+	return policy{Prefix: cleanPrefix(def[:i]), Retention: d}, nil
+}
+
+// parseExtensions parses an extension allowlist given as "prefix=ext,...", like "/images=jpg,png,webp".
+func parseExtensions(def string) (policy, error) {
+	i := strings.LastIndex(def, "=")
+	if i <= 0 {
+		return policy{}, fmt.Errorf("extensions %q must be given as prefix=ext,...", def)
+	}
+	exts, err := cleanExtensions(strings.Split(def[i+1:], ","))
+	if err != nil {
+		return policy{}, fmt.Errorf("invalid extensions in %q: %v", def, err)
+	}
+	return policy{Prefix: cleanPrefix(def[:i]), Extensions: exts}, nil
+}
+
+// cleanExtensions normalizes the extensions of an allowlist, given with or without the dot.
+func cleanExtensions(exts []string) ([]string, error) {
+	var cleaned []string
+	for _, ext := range exts {
+		ext = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(ext), "."))
+		if ext == "" {
+			continue
+		}
+		if strings.ContainsAny(ext, "/\\") || strings.HasSuffix(ext, ".") {
+			return nil, fmt.Errorf("invalid extension %q", ext)
+		}
+		cleaned = append(cleaned, ext)
+	}
+	if len(cleaned) == 0 {
+		return nil, errors.New("no extension")
+	}
+	return cleaned, nil
+}
+
+// errExtensionNotAllowed reports a file whose extension is not in the allowlist of its prefix.
+type errExtensionNotAllowed struct {
+	path    string
+	allowed []string
+}
+
+func (e errExtensionNotAllowed) Error() string {
+	return fmt.Sprintf("the extension of \"%s\" is not allowed there (allowed: %s)", e.path, strings.Join(e.allowed, ", "))
+}
+
+// checkExtension returns an error if rel, a path relative to the document root, does not have an extension
+// allowed under its prefix.
+func (s Server) checkExtension(rel string) error {
+	p, ok := s.Policies.lookup(rel)
+	if !ok || len(p.Extensions) == 0 {
+		return nil
+	}
+	name := strings.ToLower(path.Base(rel))
+	for _, ext := range p.Extensions {
+		if strings.HasSuffix(name, "."+ext) {
+			return nil
+		}
+	}
+	return withStatus(http.StatusUnsupportedMediaType, errExtensionNotAllowed{path: "/files" + rel, allowed: p.Extensions})
+}
+
+// errRetained reports a file which cannot be changed until the retention period elapses.
+type errRetained struct {
+	path  string
+	until time.Time
+}
+
+func (e errRetained) Error() string {
+	return fmt.Sprintf("\"%s\" is retained until %s", e.path, e.until.UTC().Format(time.RFC3339))
+}
+
+// checkOverwrite returns an error if rel, a path relative to the document root, exists and must not be replaced or removed.
+func (s Server) checkOverwrite(rel string) error {
+	if err := s.checkManifestName(rel); err != nil {
+		return err
+	}
+	if err := s.checkRepoName(rel); err != nil {
+		return err
+	}
+	if err := s.checkRegistryPath(rel); err != nil {
+		return err
+	}
+	if err := s.checkLFSPath(rel); err != nil {
+		return err
+	}
+	if err := s.checkTFStatePath(rel); err != nil {
+		return err
+	}
+	if err := s.checkLogIngestPath(rel); err != nil {
+		return err
+	}
+	if err := s.checkLogModePath(rel); err != nil {
+		return err
+	}
+	if err := s.checkLegalHold(rel); err != nil {
+		return err
+	}
+	if err := s.checkImmutable(rel); err != nil {
+		return err
+	}
+	return s.checkRetention(rel)
+}
+
+// checkRetention returns an error if rel, a path relative to the document root, exists and is still retained.
+func (s Server) checkRetention(rel string) error {
+	p, ok := s.Policies.lookup(rel)
+	if !ok || p.Retention <= 0 {
+		return nil
+	}
+	info, err := os.Stat(path.Join(s.DocumentRoot, rel))
+	if err != nil {
+		return nil
+	}
+	stored := info.ModTime()
+	if s.Meta != nil {
+		if meta, err := s.Meta.get(rel); err == nil && meta.Stored != nil {
+			stored = *meta.Stored
+		}
+	}
+	until := stored.Add(p.Retention)
+	if time.Now().Before(until) {
+		auditLog().WithFields(logrus.Fields{
+			"path":  rel,
+			"until": until.UTC().Format(time.RFC3339),
+		}).Warn("change rejected by retention")
+		return withStatus(http.StatusForbidden, errRetained{path: "/files" + rel, until: until})
+	}
+	return nil
+}
+
+// startRetention records when a newly stored file was stored, which its retention counts from, if metadata is
+// kept, and records its retention in the audit log.
+func (s Server) startRetention(rel string) {
+	now := time.Now()
+	if s.Meta != nil {
+		if err := s.Meta.update(rel, func(meta *fileMeta) { meta.Stored = &now }); err != nil {
+			logger.WithError(err).WithField("path", rel).Warn("failed to update metadata")
+		}
+	}
+	if p, ok := s.Policies.lookup(rel); ok && p.Retention > 0 {
+		auditLog().WithFields(logrus.Fields{
+			"path":  rel,
+			"until": now.Add(p.Retention).UTC().Format(time.RFC3339),
+		}).Info("file retained")
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRetentionCountsFromStorage(t *testing.T) {
+	root, err := ioutil.TempDir("", "retention")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	s := NewServer(filepath.Join(root, "files"), 1024, "secret", false, nil)
+	s.Policies = newPolicyStore(policies{{Prefix: "/archive", Retention: 24 * time.Hour}})
+	if s.Meta, err = newMetaStore(filepath.Join(root, "meta")); err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(s.DocumentRoot, "archive", "report.pdf")
+	if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte("report"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// the file is stored now, with the modification time it had at its source, two days ago.
+	s.startRetention("/archive/report.pdf")
+	old := time.Now().Add(-48 * time.Hour)
+	if err := os.Chtimes(name, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.checkOverwrite("/archive/report.pdf"); statusOf(err) != http.StatusForbidden {
+		t.Fatalf("checkOverwrite of a file stored now: %v, want 403", err)
+	}
+
+	// without metadata, the modification time is all there is.
+	s.Meta = nil
+	if err := s.checkOverwrite("/archive/report.pdf"); err != nil {
+		t.Fatalf("checkOverwrite without metadata: %v", err)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var errFixedPolicy = errors.New("defined by command line options")
+
+// policyStore keeps the policies given by command line options and those set through /admin/policies.
+// The latter are saved into a file in the state directory, so that they survive restarts.
+type policyStore struct {
+	mu sync.RWMutex
+	// fixed are given by command line options, and cannot be changed at runtime.
+	fixed policies
+	saved policies
+	// file is where saved is persisted, or empty if it is not.
+	file string
+}
+
+func newPolicyStore(fixed policies) *policyStore {
+	return &policyStore{fixed: fixed}
+}
+
+// policyJSON is how a policy is represented by the API and in the policy file.
+type policyJSON struct {
+	Prefix string `json:"prefix"`
+	// Retention is a duration, like "8760h".
+	Retention string `json:"retention,omitempty"`
+	Artifacts bool   `json:"artifacts,omitempty"`
+	// Extensions are the only extensions of the files allowed under the prefix, if any.
+	Extensions []string `json:"extensions,omitempty"`
+	// SVG is "sanitize" or "reject", for SVG images with active content.
+	SVG string `json:"svg,omitempty"`
+	// Log makes the prefix a directory of append-only logs.
+	Log *logModeJSON `json:"log,omitempty"`
+	// Source is "flag" or "api".
+	Source string `json:"source,omitempty"`
+}
+
+// logModeJSON is how a log mode is represented in a policy.
+type logModeJSON struct {
+	// SegmentSize is in bytes, and SegmentAge a duration, like "1h".
+	SegmentSize int64  `json:"segment_size,omitempty"`
+	SegmentAge  string `json:"segment_age,omitempty"`
+}
+
+func (p policy) toJSON(source string) policyJSON {
+	j := policyJSON{Prefix: p.Prefix, Artifacts: p.Artifacts, Extensions: p.Extensions, SVG: p.SVG, Source: source}
+	if p.Retention > 0 {
+		j.Retention = p.Retention.String()
+	}
+	if p.Log != nil {
+		j.Log = &logModeJSON{SegmentSize: p.Log.SegmentSize}
+		if p.Log.SegmentAge > 0 {
+			j.Log.SegmentAge = p.Log.SegmentAge.String()
+		}
+	}
+	return j
+}
+
+func (j policyJSON) policy() (policy, error) {
+	p := policy{Prefix: cleanPrefix(toSlash(j.Prefix)), Artifacts: j.Artifacts, SVG: j.SVG}
+	if p.SVG != "" && p.SVG != svgSanitize && p.SVG != svgReject {
+		return p, fmt.Errorf("invalid SVG policy %q (sanitize or reject)", j.SVG)
+	}
+	if j.Retention != "" {
+		d, err := time.ParseDuration(j.Retention)
+		if err != nil || d < 0 {
+			return p, fmt.Errorf("invalid retention period %q", j.Retention)
+		}
+		p.Retention = d
+	}
+	if len(j.Extensions) > 0 {
+		exts, err := cleanExtensions(j.Extensions)
+		if err != nil {
+			return p, err
+		}
+		p.Extensions = exts
+	}
+	if j.Log != nil {
+		if j.Log.SegmentSize < 0 {
+			return p, fmt.Errorf("invalid segment size %d", j.Log.SegmentSize)
+		}
+		p.Log = &logMode{SegmentSize: j.Log.SegmentSize}
+		if j.Log.SegmentAge != "" {
+			d, err := time.ParseDuration(j.Log.SegmentAge)
+			if err != nil || d < 0 {
+				return p, fmt.Errorf("invalid segment age %q", j.Log.SegmentAge)
+			}
+			p.Log.SegmentAge = d
+		}
+	}
+	return p, nil
+}
+
+// load reads the saved policies from file, and saves later changes there. A missing file is not an error.
+func (ps *policyStore) load(file string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.file = file
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var defs []policyJSON
+	if err := json.Unmarshal(b, &defs); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	for _, def := range defs {
+		p, err := def.policy()
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		ps.saved = ps.saved.set(p)
+	}
+	return nil
+}
+
+// save writes the saved policies to the file; it must be called with mu held.
+func (ps *policyStore) save() error {
+	defs := make([]policyJSON, 0, len(ps.saved))
+	for _, p := range ps.saved {
+		defs = append(defs, p.toJSON(""))
+	}
+	b, err := json.MarshalIndent(defs, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write to a temporary file and rename it, so that a crash never leaves a broken file.
+	tempFile, err := ioutil.TempFile(filepath.Dir(ps.file), ".policies_")
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Write(b)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = renameFile(tempFile.Name(), ps.file)
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+	}
+	return err
+}
+
+// lookup returns the policy applying to rel, a path relative to the document root.
+// Fixed policies take precedence over saved ones for the same prefix.
+func (ps *policyStore) lookup(rel string) (policy, bool) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	p, ok := ps.fixed.lookup(rel)
+	if q, found := ps.saved.lookup(rel); found && (!ok || len(q.Prefix) > len(p.Prefix)) {
+		return q, true
+	}
+	return p, ok
+}
+
+// list returns all policies, fixed ones first.
+func (ps *policyStore) list() []policyJSON {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	defs := make([]policyJSON, 0, len(ps.fixed)+len(ps.saved))
+	for _, p := range ps.fixed {
+		defs = append(defs, p.toJSON("flag"))
+	}
+	for _, p := range ps.saved {
+		defs = append(defs, p.toJSON("api"))
+	}
+	return defs
+}
+
+// get returns the policy for exactly prefix.
+func (ps *policyStore) get(prefix string) (policyJSON, bool) {
+	for _, def := range ps.list() {
+		if def.Prefix == prefix {
+			return def, true
+		}
+	}
+	return policyJSON{}, false
+}
+
+// set adds or replaces a saved policy. If create is true, it fails when a policy for the prefix exists.
+func (ps *policyStore) set(p policy, create bool) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.file == "" {
+		return withStatus(http.StatusNotImplemented, errNoStateDir)
+	}
+	for _, q := range ps.fixed {
+		if q.Prefix == p.Prefix {
+			return withStatus(http.StatusForbidden, fmt.Errorf("policy for %q is %w", p.Prefix, errFixedPolicy))
+		}
+	}
+	if create {
+		for _, q := range ps.saved {
+			if q.Prefix == p.Prefix {
+				return withStatus(http.StatusConflict, fmt.Errorf("policy for %q already exists", p.Prefix))
+			}
+		}
+	}
+	previous := append(policies{}, ps.saved...)
+	ps.saved = ps.saved.set(p)
+	if err := ps.save(); err != nil {
+		ps.saved = previous
+		return err
+	}
+	return nil
+}
+
+// remove deletes the saved policy for prefix.
+func (ps *policyStore) remove(prefix string) error {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.file == "" {
+		return withStatus(http.StatusNotImplemented, errNoStateDir)
+	}
+	for _, q := range ps.fixed {
+		if q.Prefix == prefix {
+			return withStatus(http.StatusForbidden, fmt.Errorf("policy for %q is %w", prefix, errFixedPolicy))
+		}
+	}
+	for i, q := range ps.saved {
+		if q.Prefix == prefix {
+			previous := ps.saved
+			ps.saved = append(append(policies{}, ps.saved[:i]...), ps.saved[i+1:]...)
+			if err := ps.save(); err != nil {
+				ps.saved = previous
+				return err
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("policy for %q is %w", prefix, errNotFound)
+}
+
+type policiesResponse struct {
+	response
+	Policies []policyJSON `json:"policies"`
+}
+
+type policyResponse struct {
+	response
+	policyJSON
+}
+
+// handlePolicies serves the policy API:
+//
+//	GET /admin/policies             lists all policies
+//	POST /admin/policies            creates a policy given as JSON
+//	GET /admin/policies/(prefix)    returns the policy for the prefix
+//	PUT /admin/policies/(prefix)    creates or replaces the policy for the prefix
+//	DELETE /admin/policies/(prefix) removes the policy for the prefix
+//
+// Policies given by command line options are listed, but cannot be changed.
+func (s Server) handlePolicies(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/admin/policies" {
+		switch r.Method {
+		case http.MethodGet:
+			w.WriteHeader(http.StatusOK)
+			writeJSON(w, policiesResponse{response: response{OK: true}, Policies: s.Policies.list()})
+		case http.MethodPost:
+			s.setPolicy(w, r, "", true)
+		default:
+			w.Header().Set("Allow", "GET,POST")
+			respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		}
+		return
+	}
+	prefix := cleanPrefix(strings.TrimPrefix(r.URL.Path, "/admin/policies/"))
+	switch r.Method {
+	case http.MethodGet:
+		def, ok := s.Policies.get(prefix)
+		if !ok {
+			respondError(w, fmt.Errorf("policy for %q is %w", prefix, errNotFound))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		writeJSON(w, policyResponse{response: response{OK: true}, policyJSON: def})
+	case http.MethodPut:
+		s.setPolicy(w, r, prefix, false)
+	case http.MethodDelete:
+		if err := s.Policies.remove(prefix); err != nil {
+			respondError(w, err)
+			return
+		}
+		auditLog().WithFields(logrus.Fields{
+			"prefix": prefix,
+			"remote": r.RemoteAddr,
+		}).Info("policy removed")
+		w.WriteHeader(http.StatusOK)
+		writeJSON(w, response{OK: true})
+	default:
+		w.Header().Set("Allow", "GET,PUT,DELETE")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+	}
+}
+
+// setPolicy stores the policy given as JSON in the request body. The prefix in the URL, if any, overrides the body.
+func (s Server) setPolicy(w http.ResponseWriter, r *http.Request, prefix string, create bool) {
+	var def policyJSON
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&def); err != nil {
+		respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("invalid request: %v", err)))
+		return
+	}
+	if prefix != "" {
+		def.Prefix = prefix
+	} else if def.Prefix == "" {
+		respondError(w, withStatus(http.StatusBadRequest, errors.New("missing prefix")))
+		return
+	}
+	p, err := def.policy()
+	if err != nil {
+		respondError(w, withStatus(http.StatusBadRequest, err))
+		return
+	}
+	if err := s.Policies.set(p, create); err != nil {
+		logFailure(logger.WithField("prefix", p.Prefix), err, "failed to set the policy")
+		respondError(w, err)
+		return
+	}
+	auditLog().WithFields(logrus.Fields{
+		"prefix":     p.Prefix,
+		"retention":  p.Retention.String(),
+		"artifacts":  p.Artifacts,
+		"extensions": p.Extensions,
+		"svg":        p.SVG,
+		"log":        p.Log != nil,
+		"remote":     r.RemoteAddr,
+	}).Info("policy set")
+	status := http.StatusOK
+	if create {
+		status = http.StatusCreated
+	}
+	w.WriteHeader(status)
+	writeJSON(w, policyResponse{response: response{OK: true}, policyJSON: p.toJSON("api")})
+}
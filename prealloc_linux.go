@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"syscall"
+)
+
+// preallocate reserves size bytes of disk space for f with fallocate(2), so that ranges written later in any order
+// land in contiguous extents. Filesystems which cannot allocate ahead get a sparse file of the same size instead.
+func preallocate(f *os.File, size int64) error {
+	if size == 0 {
+		return nil
+	}
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, syscall.EOPNOTSUPP), errors.Is(err, syscall.ENOSYS):
+		return f.Truncate(size)
+	case errors.Is(err, syscall.ENOSPC):
+		return withStatus(http.StatusInsufficientStorage, err)
+	}
+	return err
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os"
+
+// preallocate extends f to size bytes. Space is not reserved ahead on this platform: the file is sparse where
+// the filesystem supports it, and allocated as ranges are written.
+func preallocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var errContentTypeMismatch = errors.New("content type does not match the authorized one")
+
+// authorizedResponse describes a one-time upload URL.
+type authorizedResponse struct {
+	response
+	URL         string    `json:"url"`
+	Method      string    `json:"method"`
+	Expires     time.Time `json:"expires"`
+	MaxSize     int64     `json:"max_size"`
+	ContentType string    `json:"content_type,omitempty"`
+}
+
+// handleAuthorize serves POST /upload/authorize, which checks an intended upload against the server's rules
+// and returns a one-time signed URL to PUT it to, so that browsers can upload without knowing the token.
+func (s Server) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	if err := s.checkToken(r); err != nil {
+		respondError(w, err)
+		return
+	}
+	if err := s.checkWritable(); err != nil {
+		respondError(w, err)
+		return
+	}
+	filename := r.FormValue("filename")
+	rel, err := s.storedPath(filename)
+	if err == nil && isInternalName(strings.SplitN(rel[1:], "/", 2)[0]) {
+		err = withStatus(http.StatusBadRequest, fmt.Errorf("invalid file name %q", filename))
+	}
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	maxSize := s.MaxUploadSize
+	if v := r.FormValue("size"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size < 0 {
+			respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("invalid size %q", v)))
+			return
+		}
+		if size > s.MaxUploadSize {
+			respondError(w, errFileTooLarge)
+			return
+		}
+		maxSize = size
+	}
+	if err := s.checkExtension(rel); err != nil {
+		respondError(w, err)
+		return
+	}
+	if err := s.checkOverwrite(rel); err != nil {
+		respondError(w, err)
+		return
+	}
+
+	params := url.Values{}
+	params.Set("nonce", newNonce())
+	params.Set("max_size", strconv.FormatInt(maxSize, 10))
+	contentType := r.FormValue("type")
+	if contentType != "" {
+		params.Set("type", contentType)
+	}
+	urlPath := "/files" + rel
+	expires := time.Now().Add(s.AuthorizeTTL)
+	signed := s.Signer.sign(http.MethodPut, urlPath, params, expires)
+	auditLog().WithFields(logrus.Fields{
+		"path":    urlPath,
+		"size":    maxSize,
+		"expires": expires.UTC().Format(time.RFC3339),
+		"remote":  r.RemoteAddr,
+	}).Info("upload authorized")
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, authorizedResponse{
+		response:    response{OK: true},
+		URL:         (&url.URL{Path: urlPath, RawQuery: signed.Encode()}).String(),
+		Method:      http.MethodPut,
+		Expires:     expires,
+		MaxSize:     maxSize,
+		ContentType: contentType,
+	})
+}
+
+// handleSignedPut stores a file by PUT to a URL returned by handleAuthorize, within the authorized constraints.
+func (s Server) handleSignedPut(w http.ResponseWriter, r *http.Request) {
+	params, err := s.Signer.verify(r)
+	if err == nil {
+		expires, _ := strconv.ParseInt(params.Get("expires"), 10, 64)
+		err = s.Signer.consume(params.Get("nonce"), time.Unix(expires, 0))
+	}
+	if err != nil {
+		logger.WithError(err).WithField("path", r.URL.Path).Info("signed upload rejected")
+		respondError(w, err)
+		return
+	}
+	if t := params.Get("type"); t != "" && r.Header.Get("Content-Type") != t {
+		respondError(w, withStatus(http.StatusBadRequest, errContentTypeMismatch))
+		return
+	}
+	if maxSize, err := strconv.ParseInt(params.Get("max_size"), 10, 64); err == nil && maxSize < s.MaxUploadSize {
+		s.MaxUploadSize = maxSize
+	}
+	s.handlePut(w, r)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// precompressedVariants are the encodings of the variants of a file which can be served instead of it, by preference,
+// with the suffixes of their names: file.ext.br and file.ext.gz for file.ext.
+var precompressedVariants = []struct {
+	encoding, suffix string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header of r accepts coding, by name or by "*".
+func acceptsEncoding(r *http.Request, coding string) bool {
+	accepted := false
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(params[0]))
+		if name != coding && name != "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 && strings.ToLower(kv[0]) == "q" {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		// the coding by name takes precedence over "*".
+		if name == coding {
+			return q > 0
+		}
+		accepted = q > 0
+	}
+	return accepted
+}
+
+// servePrecompressed serves the pre-compressed variant of the regular file rel, a path relative to the document root,
+// with its Content-Encoding, if there is one the client accepts, and reports whether it did, as nginx's gzip_static.
+func (s Server) servePrecompressed(w http.ResponseWriter, r *http.Request, rel string) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	file := filepath.Join(s.DocumentRoot, filepath.FromSlash(rel))
+	info, err := os.Stat(file)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	varied := false
+	for _, v := range precompressedVariants {
+		variant := rel + v.suffix
+		vinfo, err := os.Stat(file + v.suffix)
+		// an empty variant may be the stub of a file moved to cold storage.
+		if err != nil || !vinfo.Mode().IsRegular() || vinfo.Size() == 0 || s.checkQuarantine(variant) != nil {
+			continue
+		}
+		// caches must keep the variants apart, whether this client gets one or not.
+		if !varied {
+			w.Header().Add("Vary", "Accept-Encoding")
+			varied = true
+		}
+		if !acceptsEncoding(r, v.encoding) {
+			continue
+		}
+		s.publishLock.RLock()
+		f, err := os.Open(file + v.suffix)
+		s.publishLock.RUnlock()
+		if err != nil {
+			continue
+		}
+		defer f.Close()
+		// the type is the one of the original, which the variant would be sniffed as something else than.
+		contentType := mime.TypeByExtension(path.Ext(rel))
+		if contentType == "" {
+			contentType = sniffContentType(file)
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Encoding", v.encoding)
+		w.Header().Del("ETag")
+		if etag := s.etagOf(variant, vinfo); etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+		coalesceRanges(r, vinfo.Size())
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		http.ServeContent(rec, r, path.Base(rel), vinfo.ModTime(), f)
+		s.countGet(r, rel, rec.status)
+		return true
+	}
+	return false
+}
+
+// sniffContentType returns the type of the content of file, as net/http detects it.
+func sniffContentType(file string) string {
+	f, err := os.Open(file)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer f.Close()
+	buf := make([]byte, 512)
+	n, _ := f.Read(buf)
+	return http.DetectContentType(buf[:n])
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	// maxSessionChunks is the number of the last ranges received which a session keeps the throughput of.
+	maxSessionChunks = 20
+	// speedWindow is the number of the last ranges the current speed of a session is measured over.
+	speedWindow = 5
+)
+
+// sessionChunk is the transfer of a range of an upload session.
+type sessionChunk struct {
+	Range   byteRange `json:"range"`
+	Started time.Time `json:"started"`
+	// Duration is how long the range took to be received, in seconds.
+	Duration float64 `json:"duration"`
+	// Speed is the throughput of the range, in bytes per second.
+	Speed float64 `json:"speed"`
+}
+
+// sessionTransfer records the throughput of the ranges received by an upload session, including those sent again.
+type sessionTransfer struct {
+	// Bytes is the number of bytes received since Started, up to Ended; they are absent until a range is received.
+	Bytes   int64      `json:"bytes"`
+	Started *time.Time `json:"started,omitempty"`
+	Ended   *time.Time `json:"ended,omitempty"`
+	// Chunks are the last ranges received, the latest last.
+	Chunks []sessionChunk `json:"chunks"`
+}
+
+// record adds the transfer of r, from started to ended.
+func (t *sessionTransfer) record(r byteRange, started, ended time.Time) {
+	n := r.End - r.Start
+	chunk := sessionChunk{Range: r, Started: started, Duration: ended.Sub(started).Seconds()}
+	if chunk.Duration > 0 {
+		chunk.Speed = float64(n) / chunk.Duration
+	}
+	t.Chunks = append(t.Chunks, chunk)
+	if len(t.Chunks) > maxSessionChunks {
+		t.Chunks = append([]sessionChunk{}, t.Chunks[len(t.Chunks)-maxSessionChunks:]...)
+	}
+	t.Bytes += n
+	if t.Started == nil || started.Before(*t.Started) {
+		t.Started = &started
+	}
+	if t.Ended == nil || ended.After(*t.Ended) {
+		t.Ended = &ended
+	}
+}
+
+// sessionProgress is computed from the transfer of an upload session when it is reported.
+type sessionProgress struct {
+	// Percent is the share of the bytes received so far.
+	Percent float64 `json:"percent"`
+	// AverageSpeed is the throughput since the first range, in bytes per second, pauses included.
+	AverageSpeed float64 `json:"average_speed"`
+	// CurrentSpeed is the throughput of the last ranges, in bytes per second, concurrent ones together.
+	CurrentSpeed float64 `json:"current_speed"`
+	// ETA is the estimated number of seconds until all bytes are received at the current speed;
+	// it is absent until a range has been received.
+	ETA *float64 `json:"eta,omitempty"`
+}
+
+// progress reports the progress of the session.
+func (u *uploadSession) progress() sessionProgress {
+	p := sessionProgress{Percent: 100}
+	if u.Size > 0 {
+		p.Percent = float64(u.Received) * 100 / float64(u.Size)
+	}
+	t := u.Transfer
+	if t.Started != nil && t.Ended != nil {
+		if elapsed := t.Ended.Sub(*t.Started).Seconds(); elapsed > 0 {
+			p.AverageSpeed = float64(t.Bytes) / elapsed
+		}
+		p.CurrentSpeed = currentSpeed(t.Chunks)
+	}
+	remaining := u.Size - u.Received
+	speed := p.CurrentSpeed
+	if speed == 0 {
+		speed = p.AverageSpeed
+	}
+	switch {
+	case remaining == 0:
+		eta := 0.0
+		p.ETA = &eta
+	case speed > 0:
+		eta := float64(remaining) / speed
+		p.ETA = &eta
+	}
+	return p
+}
+
+// currentSpeed returns the throughput of the last chunks together, in bytes per second.
+func currentSpeed(chunks []sessionChunk) float64 {
+	if len(chunks) == 0 {
+		return 0
+	}
+	if len(chunks) > speedWindow {
+		chunks = chunks[len(chunks)-speedWindow:]
+	}
+	var n int64
+	first, last := chunks[0].Started, time.Time{}
+	for _, c := range chunks {
+		n += c.Range.End - c.Range.Start
+		if c.Started.Before(first) {
+			first = c.Started
+		}
+		if end := c.Started.Add(time.Duration(c.Duration * float64(time.Second))); end.After(last) {
+			last = end
+		}
+	}
+	if elapsed := last.Sub(first).Seconds(); elapsed > 0 {
+		return float64(n) / elapsed
+	}
+	return 0
+}
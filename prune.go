@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// pruneOptions controls the removal of directories left empty in the document root.
+type pruneOptions struct {
+	// KeepDepth keeps directories up to this depth, e.g. 1 keeps the top-level directories.
+	KeepDepth int
+	// Protected are path prefixes, like "/incoming", under which directories are never removed.
+	Protected []string
+}
+
+// keeps reports whether dir, a directory relative to the document root, must be kept even if empty.
+func (o pruneOptions) keeps(dir string) bool {
+	if dir == "/" || isInternalName(strings.SplitN(dir[1:], "/", 2)[0]) {
+		return true
+	}
+	if strings.Count(dir, "/") <= o.KeepDepth {
+		return true
+	}
+	for _, prefix := range o.Protected {
+		if matchPrefix(dir, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// removeEmptyDirs removes dir, a directory relative to the document root, and then its parents, as long as they are empty.
+// It must be called with publishLock held, so that no upload is creating a file in them meanwhile.
+func (s Server) removeEmptyDirs(dir string) {
+	if s.Prune == nil {
+		return
+	}
+	for ; !s.Prune.keeps(dir); dir = path.Dir(dir) {
+		// a directory which is not empty is not removed.
+		if err := os.Remove(filepath.Join(s.DocumentRoot, filepath.FromSlash(dir))); err != nil {
+			return
+		}
+		logger.WithField("path", dir).Debug("removed an empty directory")
+	}
+}
+
+// pruneEmptyDirs removes all empty directories in the document root, deepest first, and returns how many.
+// The tree is walked without the lock, which is only held to remove each directory.
+func (s Server) pruneEmptyDirs() (int, error) {
+	var dirs []string
+	err := filepath.Walk(s.DocumentRoot, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.DocumentRoot, p)
+		if err != nil {
+			return err
+		}
+		if rel != "." && isInternalName(info.Name()) {
+			return filepath.SkipDir
+		}
+		dirs = append(dirs, path.Clean("/"+filepath.ToSlash(rel)))
+		return nil
+	})
+	if err != nil {
+		logger.WithError(err).Warn("failed to look for empty directories")
+		return 0, err
+	}
+	removed := 0
+	// the walk is in lexical order, so children come before their parents in reverse.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if s.Prune.keeps(dirs[i]) {
+			continue
+		}
+		s.publishLock.Lock()
+		err := os.Remove(filepath.Join(s.DocumentRoot, filepath.FromSlash(dirs[i])))
+		s.publishLock.Unlock()
+		if err == nil {
+			removed++
+		}
+	}
+	if removed > 0 {
+		logger.WithField("count", removed).Info("removed empty directories")
+	}
+	return removed, nil
+}
+
+// pruneEmptyDirsPeriodically calls pruneEmptyDirs at every interval, to remove the directories emptied
+// outside of the server. It never returns.
+func (s Server) pruneEmptyDirsPeriodically(interval time.Duration) {
+	for {
+		s.pruneEmptyDirs()
+		time.Sleep(interval)
+	}
+}
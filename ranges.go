@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// coalesceRanges rewrites the Range header of r asking for several ranges of a file of size bytes so that
+// overlapping and adjacent ranges are merged, in ascending order. Download accelerators and PDF viewers often ask
+// for ranges which overlap, and net/http sends the whole file instead of multipart/byteranges when the ranges add up
+// to more than the file. Headers which are not valid multi-range requests are left for net/http to handle.
+func coalesceRanges(r *http.Request, size int64) {
+	header := r.Header.Get("Range")
+	if !strings.HasPrefix(header, "bytes=") || !strings.Contains(header, ",") {
+		return
+	}
+	ranges, ok := parseByteRanges(strings.TrimPrefix(header, "bytes="), size)
+	if !ok || len(ranges) < 2 {
+		return
+	}
+	merged := mergeRanges(ranges)
+	specs := make([]string, len(merged))
+	for i, br := range merged {
+		specs[i] = fmt.Sprintf("%d-%d", br.Start, br.End-1)
+	}
+	r.Header.Set("Range", "bytes="+strings.Join(specs, ","))
+}
+
+// parseByteRanges resolves the ranges of a Range header without its "bytes=" unit against a file of size bytes,
+// skipping those which cannot be satisfied, as net/http does. It reports false on a syntax error.
+func parseByteRanges(spec string, size int64) ([]byteRange, bool) {
+	var ranges []byteRange
+	for _, ra := range strings.Split(spec, ",") {
+		ra = strings.TrimSpace(ra)
+		if ra == "" {
+			continue
+		}
+		i := strings.Index(ra, "-")
+		if i < 0 {
+			return nil, false
+		}
+		first, last := strings.TrimSpace(ra[:i]), strings.TrimSpace(ra[i+1:])
+		if first == "" {
+			// a suffix range, like "-500" for the last 500 bytes.
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, false
+			}
+			if n > size {
+				n = size
+			}
+			if n > 0 {
+				ranges = append(ranges, byteRange{Start: size - n, End: size})
+			}
+			continue
+		}
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil, false
+		}
+		end := size
+		if last != "" {
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < start {
+				return nil, false
+			}
+			if n+1 < end {
+				end = n + 1
+			}
+		}
+		if start < size {
+			ranges = append(ranges, byteRange{Start: start, End: end})
+		}
+	}
+	return ranges, true
+}
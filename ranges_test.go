@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseByteRanges(t *testing.T) {
+	const size = 1000
+	for _, tc := range []struct {
+		spec   string
+		ranges []byteRange
+		ok     bool
+	}{
+		{"0-99", []byteRange{{0, 100}}, true},
+		{"0-99,200-299", []byteRange{{0, 100}, {200, 300}}, true},
+		{" 0 - 99 , 200-299 ", []byteRange{{0, 100}, {200, 300}}, true},
+		{"900-", []byteRange{{900, 1000}}, true},
+		{"-100", []byteRange{{900, 1000}}, true},
+		// the end is clamped to the size.
+		{"900-2000", []byteRange{{900, 1000}}, true},
+		{"-2000", []byteRange{{0, 1000}}, true},
+		// ranges which cannot be satisfied are skipped.
+		{"1000-1099,0-9", []byteRange{{0, 10}}, true},
+		{"-0,0-9", []byteRange{{0, 10}}, true},
+		{"1000-", nil, true},
+		// empty ranges are ignored.
+		{"0-9,,20-29,", []byteRange{{0, 10}, {20, 30}}, true},
+		{"", nil, true},
+		{"5", nil, false},
+		{"9-5", nil, false},
+		{"a-9", nil, false},
+		{"0-b", nil, false},
+		{"-", nil, false},
+		{"--5", nil, false},
+		{"-5-", nil, false},
+		{"0-9,x", nil, false},
+	} {
+		ranges, ok := parseByteRanges(tc.spec, size)
+		if ok != tc.ok || !reflect.DeepEqual(ranges, tc.ranges) {
+			t.Errorf("%q: %v %v, want %v %v", tc.spec, ranges, ok, tc.ranges, tc.ok)
+		}
+	}
+}
+
+func TestMergeRanges(t *testing.T) {
+	for _, tc := range []struct {
+		ranges []byteRange
+		want   []byteRange
+	}{
+		{[]byteRange{{0, 10}}, []byteRange{{0, 10}}},
+		{[]byteRange{{0, 10}, {20, 30}}, []byteRange{{0, 10}, {20, 30}}},
+		{[]byteRange{{20, 30}, {0, 10}}, []byteRange{{0, 10}, {20, 30}}},
+		// overlapping.
+		{[]byteRange{{0, 10}, {5, 15}}, []byteRange{{0, 15}}},
+		// adjacent: 0-9 and 10-19.
+		{[]byteRange{{0, 10}, {10, 20}}, []byteRange{{0, 20}}},
+		// contained.
+		{[]byteRange{{0, 100}, {10, 20}, {30, 40}}, []byteRange{{0, 100}}},
+		{[]byteRange{{10, 20}, {0, 100}}, []byteRange{{0, 100}}},
+		// identical.
+		{[]byteRange{{0, 10}, {0, 10}, {0, 10}}, []byteRange{{0, 10}}},
+		// chained, out of order.
+		{[]byteRange{{40, 50}, {0, 10}, {25, 41}, {9, 26}, {60, 70}}, []byteRange{{0, 50}, {60, 70}}},
+		// one past the end of the previous one is not adjacent.
+		{[]byteRange{{0, 10}, {11, 20}}, []byteRange{{0, 10}, {11, 20}}},
+	} {
+		in := fmt.Sprint(tc.ranges)
+		if got := mergeRanges(tc.ranges); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: %v, want %v", in, got, tc.want)
+		}
+	}
+}
+
+func TestCoalesceRanges(t *testing.T) {
+	const size = 1000
+	for _, tc := range []struct {
+		header string
+		want   string
+	}{
+		{"bytes=0-99,50-149", "bytes=0-149"},
+		{"bytes=500-599,0-99,50-149", "bytes=0-149,500-599"},
+		{"bytes=0-99,100-199", "bytes=0-199"},
+		{"bytes=0-,-100", "bytes=0-999"},
+		{"bytes=-100,800-899", "bytes=800-999"},
+		{"bytes=0-9,20-29", "bytes=0-9,20-29"},
+		// ranges which cannot be satisfied are dropped along.
+		{"bytes=0-99,50-149,5000-", "bytes=0-149"},
+		// left to net/http: single ranges, other units, invalid or unsatisfiable ranges.
+		{"bytes=0-99", "bytes=0-99"},
+		{"items=0-9,5-14", "items=0-9,5-14"},
+		{"bytes=0-99,x", "bytes=0-99,x"},
+		{"bytes=0-99,1000-1099", "bytes=0-99,1000-1099"},
+		{"bytes=1000-1099,2000-2099", "bytes=1000-1099,2000-2099"},
+		{"", ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/files/a.pdf", nil)
+		if tc.header != "" {
+			r.Header.Set("Range", tc.header)
+		}
+		coalesceRanges(r, size)
+		if got := r.Header.Get("Range"); got != tc.want {
+			t.Errorf("%q: %q, want %q", tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestOverlappingRangesServedAsMultipart(t *testing.T) {
+	root, err := ioutil.TempDir("", "ranges")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	content := make([]byte, 10000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "a.pdf"), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(root, 1024, "", false, nil)
+
+	// the ranges add up to more than the file, which net/http would answer with all of it.
+	r := httptest.NewRequest(http.MethodGet, "/files/a.pdf", nil)
+	r.Header.Set("Range", "bytes=0-7999,2000-9999,100-199,9000-9499")
+	w := httptest.NewRecorder()
+	s.handleGet(w, r)
+	if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), content) {
+		t.Fatalf("%d with %d bytes, want 206 with the whole file", w.Code, w.Body.Len())
+	}
+	if got := w.Header().Get("Content-Range"); got != "bytes 0-9999/10000" {
+		t.Errorf("Content-Range %q", got)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/files/a.pdf", nil)
+	r.Header.Set("Range", "bytes=5000-5999,0-999,500-1499,5500-6499,9000-")
+	w = httptest.NewRecorder()
+	s.handleGet(w, r)
+	mediaType, params, err := mime.ParseMediaType(w.Header().Get("Content-Type"))
+	if w.Code != http.StatusPartialContent || err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("%d %q, want 206 multipart/byteranges", w.Code, w.Header().Get("Content-Type"))
+	}
+	mr := multipart.NewReader(w.Body, params["boundary"])
+	for _, want := range []byteRange{{0, 1500}, {5000, 6500}, {9000, 10000}} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, wantRange := part.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-%d/10000", want.Start, want.End-1); got != wantRange {
+			t.Errorf("Content-Range %q, want %q", got, wantRange)
+		}
+		if !bytes.Equal(body, content[want.Start:want.End]) {
+			t.Errorf("part %v has the wrong content", want)
+		}
+	}
+	if _, err := mr.NextPart(); err == nil {
+		t.Errorf("more parts than the merged ranges")
+	}
+}
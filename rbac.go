@@ -0,0 +1,634 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var errForbidden = errors.New("forbidden")
+
+// anonymousUser is the user whose permissions apply to requests without credentials.
+const anonymousUser = "anonymous"
+
+// Kinds of the entities of the access control model, as named in the admin API.
+const (
+	kindRoles  = "roles"
+	kindGroups = "groups"
+	kindUsers  = "users"
+)
+
+// permission grants requests by the given methods, or any method if empty, to URL paths under Prefix, e.g. "/files/team-a/".
+// The prefix is a whole path: "/files/team-a" grants /files/team-a/ but not /files/team-ab/. Granting GET also grants HEAD.
+type permission struct {
+	Methods []string `json:"methods,omitempty"`
+	Prefix  string   `json:"prefix"`
+}
+
+func (p permission) allows(method string, urlPath string) bool {
+	if !matchPrefix(urlPath, strings.TrimSuffix(p.Prefix, "/")) {
+		return false
+	}
+	if len(p.Methods) == 0 {
+		return true
+	}
+	for _, m := range p.Methods {
+		if m == "*" || strings.EqualFold(m, method) || (method == http.MethodHead && strings.EqualFold(m, http.MethodGet)) {
+			return true
+		}
+	}
+	return false
+}
+
+type role struct {
+	Name        string       `json:"name"`
+	Permissions []permission `json:"permissions"`
+}
+
+type group struct {
+	Name  string   `json:"name"`
+	Roles []string `json:"roles"`
+}
+
+type user struct {
+	Name   string   `json:"name"`
+	Roles  []string `json:"roles,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	// Tokens are the SHA-256 digests of the tokens of the user, in hex; tokens are only shown when they are created.
+	Tokens []string `json:"tokens,omitempty"`
+}
+
+// rbacModel is how the access control model is represented by the API and in the file.
+type rbacModel struct {
+	Roles  []role  `json:"roles"`
+	Groups []group `json:"groups"`
+	Users  []user  `json:"users"`
+}
+
+// rbacStore authorizes requests by the roles of the user making them, granted directly or through groups,
+// instead of requiring the token for some methods. Users are identified by their own tokens, by JWTs, by their
+// directory passwords, by the common name of their TLS client certificates, or by their sessions of the web UI. The model is managed through the admin API, and saved
+// into a file in the state directory.
+type rbacStore struct {
+	mu     sync.RWMutex
+	roles  map[string]role
+	groups map[string]group
+	users  map[string]user
+	// byToken maps the digests of the tokens to the names of the users.
+	byToken map[string]string
+	file    string
+	// JWT verifies bearer JWTs; it is nil if they are not accepted.
+	JWT *jwtVerifier
+	// LDAP checks the directory passwords of users sent by Basic authentication; it is nil if they are not accepted.
+	LDAP *ldapAuthenticator
+	// SAML signs users in to the web UI with an identity provider; it is nil if disabled.
+	SAML *samlProvider
+	// Homes confines users to their home directories, where they may make any request.
+	Homes bool
+}
+
+func newRBACStore() *rbacStore {
+	return &rbacStore{roles: map[string]role{}, groups: map[string]group{}, users: map[string]user{}, byToken: map[string]string{}}
+}
+
+func tokenDigest(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// load reads the model from file, and saves later changes there. A missing file is not an error.
+func (rs *rbacStore) load(file string) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.file = file
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var m rbacModel
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	rs.set(m)
+	return nil
+}
+
+// set replaces the model by m; it must be called with mu held.
+func (rs *rbacStore) set(m rbacModel) {
+	rs.roles, rs.groups, rs.users, rs.byToken = map[string]role{}, map[string]group{}, map[string]user{}, map[string]string{}
+	for _, r := range m.Roles {
+		rs.roles[r.Name] = r
+	}
+	for _, g := range m.Groups {
+		rs.groups[g.Name] = g
+	}
+	for _, u := range m.Users {
+		rs.users[u.Name] = u
+		for _, digest := range u.Tokens {
+			rs.byToken[digest] = u.Name
+		}
+	}
+}
+
+// model returns the whole model, sorted by name; it must be called with mu held.
+func (rs *rbacStore) model() rbacModel {
+	m := rbacModel{Roles: []role{}, Groups: []group{}, Users: []user{}}
+	for _, r := range rs.roles {
+		m.Roles = append(m.Roles, r)
+	}
+	for _, g := range rs.groups {
+		m.Groups = append(m.Groups, g)
+	}
+	for _, u := range rs.users {
+		m.Users = append(m.Users, u)
+	}
+	sort.Slice(m.Roles, func(i, j int) bool { return m.Roles[i].Name < m.Roles[j].Name })
+	sort.Slice(m.Groups, func(i, j int) bool { return m.Groups[i].Name < m.Groups[j].Name })
+	sort.Slice(m.Users, func(i, j int) bool { return m.Users[i].Name < m.Users[j].Name })
+	return m
+}
+
+// save writes the model to the file; it must be called with mu held.
+func (rs *rbacStore) save() error {
+	b, err := json.MarshalIndent(rs.model(), "", "  ")
+	if err != nil {
+		return err
+	}
+	// write to a temporary file and rename it, so that a crash never leaves a broken file.
+	tempFile, err := ioutil.TempFile(filepath.Dir(rs.file), ".rbac_")
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Write(b)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = renameFile(tempFile.Name(), rs.file)
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+	}
+	return err
+}
+
+// permitted tells whether the user name, also in the given groups, may make a request by method to urlPath.
+// It must be called with mu held.
+func (rs *rbacStore) permitted(name string, groups []string, method string, urlPath string) bool {
+	if home := homeOf(name); rs.Homes && home != "" && (isWithin(urlPath, "/files"+home) || urlPath == "/upload") {
+		return true
+	}
+	var roles []string
+	u := rs.users[name]
+	roles = append(roles, u.Roles...)
+	for _, g := range append(append([]string{}, u.Groups...), groups...) {
+		roles = append(roles, rs.groups[g].Roles...)
+	}
+	for _, r := range roles {
+		for _, p := range rs.roles[r].Permissions {
+			if p.allows(method, urlPath) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// identity is who makes a request: a user, with the groups given by its credentials besides those of the user,
+// or the holder of the server token, which grants any request.
+type identity struct {
+	name   string
+	groups []string
+	server bool
+}
+
+// identify returns who makes r. Requests without credentials are made by the anonymous user, if there is one.
+func (rs *rbacStore) identify(r *http.Request, serverToken string) (identity, error) {
+	token := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); token == "" && strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
+	hasCert := r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+	login, password, hasLogin := r.BasicAuth()
+	hasLogin = hasLogin && rs.LDAP != nil
+	var session webSession
+	hasSession := false
+	if rs.SAML != nil {
+		session, hasSession = rs.SAML.session(r)
+	}
+	// the form is only parsed without other credentials, since parsing it consumes the body of a form-encoded PUT.
+	if token == "" && !hasCert && !hasLogin && !hasSession {
+		token = r.FormValue("token")
+	}
+	// the directory is asked without holding the lock.
+	if token == "" && hasLogin {
+		groups, err := rs.LDAP.authenticate(login, password)
+		if err != nil {
+			if errors.Is(err, errTokenMismatch) {
+				recordAuthFailure(r, err)
+			}
+			return identity{}, err
+		}
+		return identity{name: login, groups: groups}, nil
+	}
+
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	switch {
+	case token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(serverToken)) == 1:
+		return identity{server: true}, nil
+	case token != "" && rs.JWT != nil && isJWT(token):
+		name, groups, err := rs.JWT.verify(token, time.Now())
+		if err != nil {
+			recordAuthFailure(r, errTokenMismatch)
+		}
+		return identity{name: name, groups: groups}, err
+	case token != "":
+		name, ok := rs.byToken[tokenDigest(token)]
+		if !ok {
+			recordAuthFailure(r, errTokenMismatch)
+			return identity{}, errTokenMismatch
+		}
+		return identity{name: name}, nil
+	case hasCert:
+		// certificates naming their subject only by alternative names identify nobody.
+		name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		if name == "" {
+			recordAuthFailure(r, errTokenMismatch)
+			return identity{}, errTokenMismatch
+		}
+		return identity{name: name}, nil
+	case hasSession:
+		return identity{name: session.user, groups: session.groups}, nil
+	}
+	if _, ok := rs.users[anonymousUser]; !ok {
+		recordAuthFailure(r, errMissingToken)
+		return identity{}, errMissingToken
+	}
+	return identity{name: anonymousUser}, nil
+}
+
+// authorize identifies the user making r, and checks that the user may make it.
+func (rs *rbacStore) authorize(r *http.Request, serverToken string) error {
+	id, err := rs.identify(r, serverToken)
+	if err != nil || id.server {
+		return err
+	}
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	if !rs.permitted(id.name, id.groups, r.Method, r.URL.Path) {
+		return withStatus(http.StatusForbidden, fmt.Errorf("%s %s by %q is %w", r.Method, r.URL.Path, id.name, errForbidden))
+	}
+	return nil
+}
+
+// validate checks that the entity of kind given as JSON in body, named name, refers only to existing roles and groups.
+// It must be called with mu held.
+func (rs *rbacStore) validate(kind string, name string, body []byte) (interface{}, error) {
+	var v interface{}
+	var refs []string
+	var groupRefs []string
+	switch kind {
+	case kindRoles:
+		r := role{}
+		if err := json.Unmarshal(body, &r); err != nil {
+			return nil, withStatus(http.StatusBadRequest, err)
+		}
+		r.Name = name
+		for i, p := range r.Permissions {
+			if !strings.HasPrefix(p.Prefix, "/") {
+				return nil, withStatus(http.StatusBadRequest, fmt.Errorf("prefix %q of a permission must start with /", p.Prefix))
+			}
+			for j, m := range p.Methods {
+				r.Permissions[i].Methods[j] = strings.ToUpper(m)
+			}
+		}
+		v = r
+	case kindGroups:
+		g := group{}
+		if err := json.Unmarshal(body, &g); err != nil {
+			return nil, withStatus(http.StatusBadRequest, err)
+		}
+		g.Name = name
+		refs = g.Roles
+		v = g
+	case kindUsers:
+		u := user{}
+		if err := json.Unmarshal(body, &u); err != nil {
+			return nil, withStatus(http.StatusBadRequest, err)
+		}
+		u.Name = name
+		// tokens are only changed through /tokens, so that they are not lost by updating the roles of a user.
+		u.Tokens = rs.users[name].Tokens
+		refs, groupRefs = u.Roles, u.Groups
+		v = u
+	}
+	for _, r := range refs {
+		if _, ok := rs.roles[r]; !ok {
+			return nil, withStatus(http.StatusBadRequest, fmt.Errorf("role %q is %w", r, errNotFound))
+		}
+	}
+	for _, g := range groupRefs {
+		if _, ok := rs.groups[g]; !ok {
+			return nil, withStatus(http.StatusBadRequest, fmt.Errorf("group %q is %w", g, errNotFound))
+		}
+	}
+	return v, nil
+}
+
+// inUse returns what refers to the role or group name, which then cannot be removed; it must be called with mu held.
+func (rs *rbacStore) inUse(kind string, name string) string {
+	for _, g := range rs.groups {
+		for _, r := range g.Roles {
+			if kind == kindRoles && r == name {
+				return "group " + g.Name
+			}
+		}
+	}
+	for _, u := range rs.users {
+		for _, ref := range u.Roles {
+			if kind == kindRoles && ref == name {
+				return "user " + u.Name
+			}
+		}
+		for _, ref := range u.Groups {
+			if kind == kindGroups && ref == name {
+				return "user " + u.Name
+			}
+		}
+	}
+	return ""
+}
+
+// update applies fn to the model, saves it, and restores it if saving fails.
+func (rs *rbacStore) update(fn func() error) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if rs.file == "" {
+		return withStatus(http.StatusNotImplemented, errNoStateDir)
+	}
+	previous := rs.model()
+	if err := fn(); err != nil {
+		rs.set(previous)
+		return err
+	}
+	if err := rs.save(); err != nil {
+		rs.set(previous)
+		return err
+	}
+	return nil
+}
+
+// get returns the entity of kind named name.
+func (rs *rbacStore) get(kind string, name string) (interface{}, bool) {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	var v interface{}
+	var ok bool
+	switch kind {
+	case kindRoles:
+		v, ok = rs.roles[name]
+	case kindGroups:
+		v, ok = rs.groups[name]
+	case kindUsers:
+		v, ok = rs.users[name]
+	}
+	return v, ok
+}
+
+// list returns the entities of kind.
+func (rs *rbacStore) list(kind string) interface{} {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	m := rs.model()
+	switch kind {
+	case kindRoles:
+		return m.Roles
+	case kindGroups:
+		return m.Groups
+	}
+	return m.Users
+}
+
+// put creates or replaces the entity of kind named name, given as JSON in body.
+func (rs *rbacStore) put(kind string, name string, body []byte) error {
+	return rs.update(func() error {
+		v, err := rs.validate(kind, name, body)
+		if err != nil {
+			return err
+		}
+		switch v := v.(type) {
+		case role:
+			rs.roles[name] = v
+		case group:
+			rs.groups[name] = v
+		case user:
+			rs.users[name] = v
+		}
+		return nil
+	})
+}
+
+// remove deletes the entity of kind named name. Roles and groups cannot be removed while they are assigned.
+func (rs *rbacStore) remove(kind string, name string) error {
+	return rs.update(func() error {
+		switch kind {
+		case kindRoles:
+			if _, ok := rs.roles[name]; !ok {
+				return fmt.Errorf("role %q is %w", name, errNotFound)
+			}
+		case kindGroups:
+			if _, ok := rs.groups[name]; !ok {
+				return fmt.Errorf("group %q is %w", name, errNotFound)
+			}
+		case kindUsers:
+			u, ok := rs.users[name]
+			if !ok {
+				return fmt.Errorf("user %q is %w", name, errNotFound)
+			}
+			for _, digest := range u.Tokens {
+				delete(rs.byToken, digest)
+			}
+			delete(rs.users, name)
+			return nil
+		}
+		if by := rs.inUse(kind, name); by != "" {
+			return withStatus(http.StatusConflict, fmt.Errorf("%s %q is assigned to %s", strings.TrimSuffix(kind, "s"), name, by))
+		}
+		delete(rs.roles, name)
+		delete(rs.groups, name)
+		return nil
+	})
+}
+
+// createToken generates a new token for the user name and returns it; only its digest is kept.
+func (rs *rbacStore) createToken(name string) (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+	err := rs.update(func() error {
+		u, ok := rs.users[name]
+		if !ok {
+			return fmt.Errorf("user %q is %w", name, errNotFound)
+		}
+		digest := tokenDigest(token)
+		u.Tokens = append(append([]string{}, u.Tokens...), digest)
+		rs.users[name] = u
+		rs.byToken[digest] = name
+		return nil
+	})
+	return token, err
+}
+
+// revokeTokens removes all tokens of the user name.
+func (rs *rbacStore) revokeTokens(name string) error {
+	return rs.update(func() error {
+		u, ok := rs.users[name]
+		if !ok {
+			return fmt.Errorf("user %q is %w", name, errNotFound)
+		}
+		for _, digest := range u.Tokens {
+			delete(rs.byToken, digest)
+		}
+		u.Tokens = nil
+		rs.users[name] = u
+		return nil
+	})
+}
+
+// withClientCAs makes config request TLS client certificates and verify them with cas, if any; it returns config.
+func withClientCAs(config *tls.Config, cas *x509.CertPool) *tls.Config {
+	if cas != nil {
+		config.ClientCAs = cas
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config
+}
+
+type rbacListResponse struct {
+	response
+	Items interface{} `json:"items"`
+}
+
+type rbacItemResponse struct {
+	response
+	Item interface{} `json:"item"`
+}
+
+type tokenResponse struct {
+	response
+	User  string `json:"user"`
+	Token string `json:"token"`
+}
+
+// handleRBAC serves the admin API of the access control model, where kind is roles, groups or users:
+//
+//	GET /admin/(kind)                    lists the roles, groups or users
+//	GET /admin/(kind)/(name)             returns one
+//	PUT /admin/(kind)/(name)             creates or replaces one given as JSON
+//	DELETE /admin/(kind)/(name)          removes one; roles and groups must not be assigned anymore
+//	POST /admin/users/(name)/tokens      creates a token for the user, which is only shown in the response
+//	DELETE /admin/users/(name)/tokens    revokes all tokens of the user
+func (s Server) handleRBAC(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/admin/")
+	kind := rest
+	name := ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		kind, name = rest[:i], rest[i+1:]
+	}
+	entry := auditLog().WithFields(logrus.Fields{"kind": kind, "name": name, "remote": r.RemoteAddr})
+
+	if kind == kindUsers && strings.HasSuffix(name, "/tokens") {
+		name = strings.TrimSuffix(name, "/tokens")
+		switch r.Method {
+		case http.MethodPost:
+			token, err := s.RBAC.createToken(name)
+			if err != nil {
+				respondError(w, err)
+				return
+			}
+			entry.WithField("name", name).Info("user token created")
+			w.WriteHeader(http.StatusCreated)
+			writeJSON(w, tokenResponse{response: response{OK: true}, User: name, Token: token})
+		case http.MethodDelete:
+			if err := s.RBAC.revokeTokens(name); err != nil {
+				respondError(w, err)
+				return
+			}
+			entry.WithField("name", name).Info("user tokens revoked")
+			w.WriteHeader(http.StatusOK)
+			writeJSON(w, response{OK: true})
+		default:
+			w.Header().Set("Allow", "POST,DELETE")
+			respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		}
+		return
+	}
+
+	if name == "" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		writeJSON(w, rbacListResponse{response: response{OK: true}, Items: s.RBAC.list(kind)})
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		v, ok := s.RBAC.get(kind, name)
+		if !ok {
+			respondError(w, fmt.Errorf("%s %q is %w", strings.TrimSuffix(kind, "s"), name, errNotFound))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		writeJSON(w, rbacItemResponse{response: response{OK: true}, Item: v})
+	case http.MethodPut:
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		if err := s.RBAC.put(kind, name, body); err != nil {
+			respondError(w, err)
+			return
+		}
+		entry.WithField("definition", string(body)).Info(strings.TrimSuffix(kind, "s") + " set")
+		v, _ := s.RBAC.get(kind, name)
+		w.WriteHeader(http.StatusOK)
+		writeJSON(w, rbacItemResponse{response: response{OK: true}, Item: v})
+	case http.MethodDelete:
+		if err := s.RBAC.remove(kind, name); err != nil {
+			respondError(w, err)
+			return
+		}
+		entry.Info(strings.TrimSuffix(kind, "s") + " removed")
+		w.WriteHeader(http.StatusOK)
+		writeJSON(w, response{OK: true})
+	default:
+		w.Header().Set("Allow", "GET,PUT,DELETE")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+	}
+}
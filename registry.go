@@ -0,0 +1,729 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxManifestSize bounds the image manifests pushed to the registry.
+	maxManifestSize = 4 << 20
+	// registryUploadTTL is how long an unfinished blob upload is kept after its last chunk.
+	registryUploadTTL = 24 * time.Hour
+	// defaultManifestType is the media type of manifests pushed without one.
+	defaultManifestType = "application/vnd.oci.image.manifest.v1+json"
+)
+
+var errRegistryPath = errors.New("managed by the container registry")
+
+var (
+	reRegistryName       = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*$`)
+	reRegistryTag        = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]{0,127}$`)
+	reRegistryDigest     = regexp.MustCompile(`^sha256:([a-f0-9]{64})$`)
+	reRegistryUpload     = regexp.MustCompile(`^/v2/(.+)/blobs/uploads/([a-f0-9-]*)$`)
+	reRegistryBlob       = regexp.MustCompile(`^/v2/(.+)/blobs/([^/]+)$`)
+	reRegistryManifest   = regexp.MustCompile(`^/v2/(.+)/manifests/([^/]+)$`)
+	reRegistryTags       = regexp.MustCompile(`^/v2/(.+)/tags/list$`)
+	reRegistryContentRng = regexp.MustCompile(`^(?:bytes )?(\d+)-(\d+)$`)
+)
+
+// registryError is an error of the OCI Distribution API, reported with one of its codes, like BLOB_UNKNOWN.
+type registryError struct {
+	status  int
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *registryError) Error() string {
+	return e.Message
+}
+
+func newRegistryError(status int, code string, format string, args ...interface{}) *registryError {
+	return &registryError{status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// respondRegistryError writes err as the API does, with errors of the server translated to its codes.
+func respondRegistryError(w http.ResponseWriter, err error) {
+	var re *registryError
+	if !errors.As(err, &re) {
+		status := statusOf(err)
+		code := map[int]string{
+			http.StatusUnauthorized:          "UNAUTHORIZED",
+			http.StatusForbidden:             "DENIED",
+			http.StatusNotFound:              "NAME_UNKNOWN",
+			http.StatusRequestEntityTooLarge: "SIZE_INVALID",
+			http.StatusBadRequest:            "BLOB_UPLOAD_INVALID",
+		}[status]
+		if code == "" {
+			code = "UNKNOWN"
+		}
+		re = &registryError{status: status, Code: code, Message: err.Error()}
+	}
+	if re.status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="simple-upload-server"`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(re.status)
+	json.NewEncoder(w).Encode(struct {
+		Errors []*registryError `json:"errors"`
+	}{[]*registryError{re}})
+}
+
+// registryUpload is a blob being pushed in chunks.
+type registryUpload struct {
+	// mu serializes the chunks of the upload.
+	mu      sync.Mutex
+	Name    string
+	file    string
+	size    int64
+	updated time.Time
+}
+
+// registry serves the OCI Distribution API, the protocol of docker push and pull, over files under Prefix:
+//
+//	blobs/sha256/(hex)                                    the blobs, shared by all repositories
+//	repositories/(name)/_manifests/revisions/sha256/(hex) the media type of each manifest of a repository
+//	repositories/(name)/_manifests/tags/(tag)             the digest of the manifest a tag points to
+//
+// Manifests are stored as blobs too.
+type registry struct {
+	// Prefix is the path of the registry files relative to the document root, like "/registry".
+	Prefix string
+
+	mu      sync.Mutex
+	uploads map[string]*registryUpload
+}
+
+func newRegistry(prefix string) *registry {
+	return &registry{Prefix: cleanPrefix(prefix), uploads: map[string]*registryUpload{}}
+}
+
+// checkRegistryPath returns an error if rel, a path relative to the document root, is a file of the registry,
+// which uploads must not replace.
+func (s Server) checkRegistryPath(rel string) error {
+	if s.Registry != nil && matchPrefix(rel, s.Registry.Prefix) {
+		return withStatus(http.StatusForbidden, fmt.Errorf("\"/files%s\" is %w", rel, errRegistryPath))
+	}
+	return nil
+}
+
+func (s Server) registryFile(elem ...string) string {
+	return filepath.Join(append([]string{s.DocumentRoot, filepath.FromSlash(s.Registry.Prefix)}, elem...)...)
+}
+
+func (s Server) blobFile(digest string) string {
+	return s.registryFile("blobs", "sha256", strings.TrimPrefix(digest, "sha256:"))
+}
+
+func (s Server) manifestsDir(name string) string {
+	return s.registryFile("repositories", filepath.FromSlash(name), "_manifests")
+}
+
+// authorizeRegistry checks the credentials of r. Docker sends them with Basic authentication, whose password
+// is taken as the token. Pushes always require the token, and pulls if downloads do.
+func (s Server) authorizeRegistry(r *http.Request) error {
+	r = withBasicToken(r)
+	required := true
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		// the version check must be challenged for docker login to send credentials at all.
+		required = r.URL.Path == "/v2/" || s.isAuthenticationRequired(r)
+	}
+	if err := s.checkToken(r); required && err != nil {
+		return err
+	}
+	return nil
+}
+
+// handleRegistry serves the OCI Distribution API under /v2/.
+func (s Server) handleRegistry(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Docker-Distribution-API-Version", "registry/2.0")
+	if err := s.authorizeRegistry(r); err != nil {
+		respondRegistryError(w, err)
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		if err := s.checkWritable(); err != nil {
+			respondRegistryError(w, err)
+			return
+		}
+	}
+	var err error
+	switch p := r.URL.Path; {
+	case p == "/v2/":
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "{}\n")
+	case p == "/v2/_catalog":
+		err = s.handleCatalog(w, r)
+	case reRegistryUpload.MatchString(p):
+		m := reRegistryUpload.FindStringSubmatch(p)
+		err = s.handleBlobUpload(w, r, m[1], m[2])
+	case reRegistryBlob.MatchString(p):
+		m := reRegistryBlob.FindStringSubmatch(p)
+		err = s.handleBlob(w, r, m[1], m[2])
+	case reRegistryManifest.MatchString(p):
+		m := reRegistryManifest.FindStringSubmatch(p)
+		err = s.handleImageManifest(w, r, m[1], m[2])
+	case reRegistryTags.MatchString(p):
+		err = s.handleTags(w, r, reRegistryTags.FindStringSubmatch(p)[1])
+	default:
+		err = newRegistryError(http.StatusNotFound, "NAME_UNKNOWN", "%s is not an API endpoint", p)
+	}
+	if err != nil {
+		// the errors of the API are those of the client.
+		if re := (*registryError)(nil); !errors.As(err, &re) {
+			logFailure(logger.WithFields(logrus.Fields{"path": r.URL.Path, "method": r.Method}), err, "registry request failed")
+		}
+		respondRegistryError(w, err)
+	}
+}
+
+func checkRepositoryName(name string) error {
+	if !reRegistryName.MatchString(name) || len(name) > 255 {
+		return newRegistryError(http.StatusBadRequest, "NAME_INVALID", "invalid repository name %q", name)
+	}
+	return nil
+}
+
+func checkDigest(digest string) error {
+	if !reRegistryDigest.MatchString(digest) {
+		return newRegistryError(http.StatusBadRequest, "DIGEST_INVALID", "unsupported or invalid digest %q, only sha256 is supported", digest)
+	}
+	return nil
+}
+
+func methodNotAllowed(w http.ResponseWriter, r *http.Request, allow string) error {
+	w.Header().Set("Allow", allow)
+	return newRegistryError(http.StatusMethodNotAllowed, "UNSUPPORTED", "%s", errMethodNotAllowed(r.Method))
+}
+
+// handleBlob serves GET and HEAD /v2/(name)/blobs/(digest).
+func (s Server) handleBlob(w http.ResponseWriter, r *http.Request, name string, digest string) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return methodNotAllowed(w, r, "GET,HEAD")
+	}
+	if err := checkRepositoryName(name); err != nil {
+		return err
+	}
+	if err := checkDigest(digest); err != nil {
+		return err
+	}
+	f, err := os.Open(s.blobFile(digest))
+	if os.IsNotExist(err) {
+		return newRegistryError(http.StatusNotFound, "BLOB_UNKNOWN", "blob %s is unknown", digest)
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "max-age=31536000, immutable")
+	http.ServeContent(w, r, "", info.ModTime(), f)
+	return nil
+}
+
+// handleBlobUpload serves the pushes of blobs:
+//
+//	POST /v2/(name)/blobs/uploads/                 starts an upload, or mounts a blob with mount and from,
+//	                                               or pushes it whole with digest
+//	PATCH /v2/(name)/blobs/uploads/(id)            appends a chunk
+//	PUT /v2/(name)/blobs/uploads/(id)?digest=(d)   appends the last chunk, if any, and stores the blob
+//	GET /v2/(name)/blobs/uploads/(id)              reports the size received
+//	DELETE /v2/(name)/blobs/uploads/(id)           cancels the upload
+func (s Server) handleBlobUpload(w http.ResponseWriter, r *http.Request, name string, id string) error {
+	if err := checkRepositoryName(name); err != nil {
+		return err
+	}
+	if id == "" {
+		if r.Method != http.MethodPost {
+			return methodNotAllowed(w, r, "POST")
+		}
+		return s.startBlobUpload(w, r, name)
+	}
+	reg := s.Registry
+	reg.mu.Lock()
+	u, ok := reg.uploads[id]
+	reg.mu.Unlock()
+	if !ok || u.Name != name {
+		return newRegistryError(http.StatusNotFound, "BLOB_UPLOAD_UNKNOWN", "upload %s is unknown", id)
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet:
+		setUploadHeaders(w, name, id, u.size)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	case http.MethodPatch:
+		if err := s.appendChunk(r, u); err != nil {
+			return err
+		}
+		setUploadHeaders(w, name, id, u.size)
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	case http.MethodPut:
+		digest := r.URL.Query().Get("digest")
+		if err := checkDigest(digest); err != nil {
+			return err
+		}
+		if err := s.appendChunk(r, u); err != nil {
+			return err
+		}
+		if err := s.storeBlob(r, u.file, digest); err != nil {
+			return err
+		}
+		reg.mu.Lock()
+		delete(reg.uploads, id)
+		reg.mu.Unlock()
+		w.Header().Set("Location", "/v2/"+name+"/blobs/"+digest)
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	case http.MethodDelete:
+		reg.mu.Lock()
+		delete(reg.uploads, id)
+		reg.mu.Unlock()
+		os.Remove(u.file)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return methodNotAllowed(w, r, "GET,PATCH,PUT,DELETE")
+}
+
+func setUploadHeaders(w http.ResponseWriter, name string, id string, size int64) {
+	w.Header().Set("Location", "/v2/"+name+"/blobs/uploads/"+id)
+	w.Header().Set("Docker-Upload-UUID", id)
+	end := size - 1
+	if end < 0 {
+		end = 0
+	}
+	w.Header().Set("Range", fmt.Sprintf("0-%d", end))
+	w.Header().Set("Content-Length", "0")
+}
+
+func (s Server) startBlobUpload(w http.ResponseWriter, r *http.Request, name string) error {
+	q := r.URL.Query()
+	if mount := q.Get("mount"); mount != "" && checkDigest(mount) == nil {
+		// blobs are shared by all repositories, so a mount only has to find the blob.
+		if fileExists(s.blobFile(mount)) {
+			w.Header().Set("Location", "/v2/"+name+"/blobs/"+mount)
+			w.Header().Set("Docker-Content-Digest", mount)
+			w.WriteHeader(http.StatusCreated)
+			return nil
+		}
+	}
+	s.Registry.expireUploads()
+	tempFile, err := ioutil.TempFile(s.spoolDir(), "upload_")
+	if err != nil {
+		return err
+	}
+	tempFile.Close()
+	u := &registryUpload{Name: name, file: tempFile.Name(), updated: time.Now()}
+	if digest := q.Get("digest"); digest != "" {
+		// a monolithic push of the whole blob.
+		if err := checkDigest(digest); err != nil {
+			os.Remove(u.file)
+			return err
+		}
+		if err := s.appendChunk(r, u); err != nil {
+			os.Remove(u.file)
+			return err
+		}
+		if err := s.storeBlob(r, u.file, digest); err != nil {
+			return err
+		}
+		w.Header().Set("Location", "/v2/"+name+"/blobs/"+digest)
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.WriteHeader(http.StatusCreated)
+		return nil
+	}
+	id := newUUID()
+	s.Registry.mu.Lock()
+	s.Registry.uploads[id] = u
+	s.Registry.mu.Unlock()
+	setUploadHeaders(w, name, id, 0)
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// expireUploads drops the uploads abandoned for registryUploadTTL.
+func (reg *registry) expireUploads() {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	for id, u := range reg.uploads {
+		if time.Since(u.updated) > registryUploadTTL {
+			os.Remove(u.file)
+			delete(reg.uploads, id)
+		}
+	}
+}
+
+// appendChunk appends the body of r to the upload u. A Content-Range must start where the upload is.
+func (s Server) appendChunk(r *http.Request, u *registryUpload) error {
+	if cr := r.Header.Get("Content-Range"); cr != "" {
+		m := reRegistryContentRng.FindStringSubmatch(cr)
+		if m == nil {
+			return newRegistryError(http.StatusRequestedRangeNotSatisfiable, "BLOB_UPLOAD_INVALID", "invalid Content-Range %q", cr)
+		}
+		if start, _ := strconv.ParseInt(m[1], 10, 64); start != u.size {
+			return newRegistryError(http.StatusRequestedRangeNotSatisfiable, "BLOB_UPLOAD_INVALID", "chunk starts at %d, not at %d", start, u.size)
+		}
+	}
+	f, err := os.OpenFile(u.file, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	remaining := s.MaxUploadSize - u.size
+	n, err := copyBuffer(f, io.LimitReader(r.Body, remaining+1))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if n > remaining {
+		return newRegistryError(http.StatusRequestEntityTooLarge, "SIZE_INVALID", "%s", errFileTooLarge)
+	}
+	u.size += n
+	u.updated = time.Now()
+	return nil
+}
+
+// storeBlob moves the received file into the blobs once its digest is verified. The file is removed on failure.
+func (s Server) storeBlob(r *http.Request, file string, digest string) error {
+	sum, err := hashFile(file, sha256.New())
+	if err != nil {
+		os.Remove(file)
+		return err
+	}
+	if "sha256:"+sum != digest {
+		os.Remove(file)
+		return newRegistryError(http.StatusBadRequest, "DIGEST_INVALID", "content has digest sha256:%s, not %s", sum, digest)
+	}
+	if fileExists(s.blobFile(digest)) {
+		os.Remove(file)
+		return nil
+	}
+	return s.commitFile(r.Context(), file, s.blobFile(digest))
+}
+
+// imageManifest is what the registry reads of a manifest or an index, to check that what it refers to exists.
+type imageManifest struct {
+	MediaType string `json:"mediaType"`
+	Config    *struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Layers []struct {
+		Digest string   `json:"digest"`
+		URLs   []string `json:"urls"`
+	} `json:"layers"`
+	Manifests []struct {
+		Digest string `json:"digest"`
+	} `json:"manifests"`
+}
+
+// resolveReference returns the digest of the manifest reference, a tag or digest, names in repository name.
+func (s Server) resolveReference(name string, reference string) (string, error) {
+	unknown := newRegistryError(http.StatusNotFound, "MANIFEST_UNKNOWN", "manifest %s:%s is unknown", name, reference)
+	if strings.Contains(reference, ":") {
+		if err := checkDigest(reference); err != nil {
+			return "", err
+		}
+		if !fileExists(filepath.Join(s.manifestsDir(name), "revisions", "sha256", strings.TrimPrefix(reference, "sha256:"))) {
+			return "", unknown
+		}
+		return reference, nil
+	}
+	if !reRegistryTag.MatchString(reference) {
+		return "", newRegistryError(http.StatusBadRequest, "TAG_INVALID", "invalid tag %q", reference)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(s.manifestsDir(name), "tags", reference))
+	if os.IsNotExist(err) {
+		return "", unknown
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// handleImageManifest serves GET, HEAD, PUT and DELETE /v2/(name)/manifests/(reference), a tag or digest.
+// Deleting a digest deletes the tags pointing to it; blobs are never deleted.
+func (s Server) handleImageManifest(w http.ResponseWriter, r *http.Request, name string, reference string) error {
+	if err := checkRepositoryName(name); err != nil {
+		return err
+	}
+	dir := s.manifestsDir(name)
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		digest, err := s.resolveReference(name, reference)
+		if err != nil {
+			return err
+		}
+		mediaType, err := ioutil.ReadFile(filepath.Join(dir, "revisions", "sha256", strings.TrimPrefix(digest, "sha256:")))
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(s.blobFile(digest))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", string(mediaType))
+		w.Header().Set("Docker-Content-Digest", digest)
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			copyBuffer(w, f)
+		}
+		return nil
+	case http.MethodPut:
+		return s.putImageManifest(w, r, name, reference)
+	case http.MethodDelete:
+		digest, err := s.resolveReference(name, reference)
+		if err != nil {
+			return err
+		}
+		tags, err := s.tagsOf(name)
+		if err != nil {
+			return err
+		}
+		for tag, target := range tags {
+			if tag == reference || (target == digest && strings.Contains(reference, ":")) {
+				if err := os.Remove(filepath.Join(dir, "tags", tag)); err != nil {
+					return err
+				}
+			}
+		}
+		if strings.Contains(reference, ":") {
+			if err := os.Remove(filepath.Join(dir, "revisions", "sha256", strings.TrimPrefix(digest, "sha256:"))); err != nil {
+				return err
+			}
+		}
+		auditLog().WithFields(logrus.Fields{"repository": name, "reference": reference, "remote": clientIP(r)}).Info("image manifest deleted")
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	}
+	return methodNotAllowed(w, r, "GET,HEAD,PUT,DELETE")
+}
+
+func (s Server) putImageManifest(w http.ResponseWriter, r *http.Request, name string, reference string) error {
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxManifestSize+1))
+	if err != nil {
+		return err
+	}
+	if len(b) > maxManifestSize {
+		return newRegistryError(http.StatusRequestEntityTooLarge, "SIZE_INVALID", "manifest exceeds %d bytes", maxManifestSize)
+	}
+	var m imageManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return newRegistryError(http.StatusBadRequest, "MANIFEST_INVALID", "invalid manifest: %v", err)
+	}
+	sum := sha256.Sum256(b)
+	digest := fmt.Sprintf("sha256:%x", sum)
+	isDigest := strings.Contains(reference, ":")
+	if isDigest && reference != digest {
+		return newRegistryError(http.StatusBadRequest, "DIGEST_INVALID", "manifest has digest %s, not %s", digest, reference)
+	}
+	if !isDigest && !reRegistryTag.MatchString(reference) {
+		return newRegistryError(http.StatusBadRequest, "TAG_INVALID", "invalid tag %q", reference)
+	}
+	var refs []string
+	if m.Config != nil {
+		refs = append(refs, m.Config.Digest)
+	}
+	for _, layer := range m.Layers {
+		// foreign layers are fetched from their URLs.
+		if len(layer.URLs) == 0 {
+			refs = append(refs, layer.Digest)
+		}
+	}
+	for _, ref := range refs {
+		if checkDigest(ref) != nil || !fileExists(s.blobFile(ref)) {
+			return newRegistryError(http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", "blob %s is unknown", ref)
+		}
+	}
+	for _, child := range m.Manifests {
+		if _, err := s.resolveReference(name, child.Digest); err != nil {
+			return newRegistryError(http.StatusBadRequest, "MANIFEST_BLOB_UNKNOWN", "manifest %s is unknown", child.Digest)
+		}
+	}
+	mediaType := r.Header.Get("Content-Type")
+	if mediaType == "" {
+		mediaType = m.MediaType
+	}
+	if mediaType == "" {
+		mediaType = defaultManifestType
+	}
+
+	if !fileExists(s.blobFile(digest)) {
+		if err := os.MkdirAll(filepath.Dir(s.blobFile(digest)), 0777); err != nil {
+			return err
+		}
+		if err := writeFileAtomically(s.blobFile(digest), b); err != nil {
+			return err
+		}
+	}
+	dir := s.manifestsDir(name)
+	files := []struct{ name, content string }{{filepath.Join(dir, "revisions", "sha256", fmt.Sprintf("%x", sum)), mediaType}}
+	if !isDigest {
+		files = append(files, struct{ name, content string }{filepath.Join(dir, "tags", reference), digest})
+	}
+	for _, f := range files {
+		if err := os.MkdirAll(filepath.Dir(f.name), 0777); err != nil {
+			return err
+		}
+		if err := writeFileAtomically(f.name, []byte(f.content)); err != nil {
+			return err
+		}
+	}
+	tagUpload(r.Context(), auditLog()).WithFields(logrus.Fields{
+		"repository": name,
+		"reference":  reference,
+		"digest":     digest,
+		"remote":     clientIP(r),
+	}).Info("image manifest pushed")
+	w.Header().Set("Location", "/v2/"+name+"/manifests/"+digest)
+	w.Header().Set("Docker-Content-Digest", digest)
+	w.WriteHeader(http.StatusCreated)
+	return nil
+}
+
+// tagsOf returns the digests the tags of repository name point to, by tag.
+func (s Server) tagsOf(name string) (map[string]string, error) {
+	dir := filepath.Join(s.manifestsDir(name), "tags")
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return map[string]string{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	tags := map[string]string{}
+	for _, info := range infos {
+		if !reRegistryTag.MatchString(info.Name()) {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		tags[info.Name()] = strings.TrimSpace(string(b))
+	}
+	return tags, nil
+}
+
+// paginate returns the names after last, up to n if n is given, and sets the Link header to the next page if any.
+func paginate(w http.ResponseWriter, r *http.Request, names []string) ([]string, error) {
+	sort.Strings(names)
+	q := r.URL.Query()
+	if last := q.Get("last"); last != "" {
+		i := sort.SearchStrings(names, last)
+		if i < len(names) && names[i] == last {
+			i++
+		}
+		names = names[i:]
+	}
+	if n := q.Get("n"); n != "" {
+		limit, err := strconv.Atoi(n)
+		if err != nil || limit < 0 {
+			return nil, newRegistryError(http.StatusBadRequest, "PAGINATION_NUMBER_INVALID", "invalid n %q", n)
+		}
+		if limit < len(names) {
+			names = names[:limit]
+			next := url.Values{"n": {n}, "last": {names[len(names)-1]}}
+			w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", r.URL.Path, next.Encode()))
+		}
+	}
+	return names, nil
+}
+
+// handleTags serves GET /v2/(name)/tags/list.
+func (s Server) handleTags(w http.ResponseWriter, r *http.Request, name string) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return methodNotAllowed(w, r, "GET,HEAD")
+	}
+	if err := checkRepositoryName(name); err != nil {
+		return err
+	}
+	if !fileExists(s.manifestsDir(name)) {
+		return newRegistryError(http.StatusNotFound, "NAME_UNKNOWN", "repository %s is unknown", name)
+	}
+	tags, err := s.tagsOf(name)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(tags))
+	for tag := range tags {
+		names = append(names, tag)
+	}
+	if names, err = paginate(w, r, names); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, struct {
+		Name string   `json:"name"`
+		Tags []string `json:"tags"`
+	}{name, names})
+	return nil
+}
+
+// handleCatalog serves GET /v2/_catalog, the list of repositories.
+func (s Server) handleCatalog(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return methodNotAllowed(w, r, "GET,HEAD")
+	}
+	root := s.registryFile("repositories")
+	names := []string{}
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == root {
+			return filepath.SkipDir
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == "_manifests" {
+			rel, err := filepath.Rel(root, filepath.Dir(p))
+			if err != nil {
+				return err
+			}
+			names = append(names, filepath.ToSlash(rel))
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if names, err = paginate(w, r, names); err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, struct {
+		Repositories []string `json:"repositories"`
+	}{names})
+	return nil
+}
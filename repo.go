@@ -0,0 +1,391 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+const (
+	// repoDelay is how long changes are collected before the metadata of a repository is regenerated,
+	// so that uploading a batch of packages regenerates it once.
+	repoDelay = 2 * time.Second
+	// repoKeyName is the public key of the signing key, published at the top of each repository.
+	repoKeyName = "repo.asc"
+)
+
+var errRepoMetadata = errors.New("generated repository metadata")
+
+// debMetadataNames are the files generated at the top of a repository for apt.
+var debMetadataNames = []string{"Packages", "Packages.gz", "Release", "Release.gpg", "InRelease"}
+
+// repoPackage is a package file of a repository, with what its metadata needs.
+type repoPackage struct {
+	// Path is the path of the package relative to the top of its repository.
+	Path    string
+	Size    int64
+	ModTime time.Time
+	MD5     string
+	SHA1    string
+	SHA256  string
+	// Deb is the control paragraph of a Debian package, and RPM the header of an RPM package.
+	Deb *debControl
+	RPM *rpmPackage
+}
+
+// packageRepos serves directories as Debian and RPM package repositories, whose metadata is regenerated
+// when packages are uploaded or removed, so that apt and dnf install the uploads directly.
+// A nil *packageRepos serves none.
+type packageRepos struct {
+	// Prefixes are the paths of the repositories relative to the document root, like "/debian".
+	Prefixes []string
+	// signer signs the metadata; it is nil if the metadata is not signed.
+	signer *openpgp.Entity
+
+	mu      sync.Mutex
+	pending map[string]bool
+	wake    chan struct{}
+	// cache keeps the parsed packages by path relative to the document root, while their size and mtime are unchanged.
+	cache map[string]*repoPackage
+}
+
+func newPackageRepos(prefixes []string) *packageRepos {
+	r := &packageRepos{pending: map[string]bool{}, wake: make(chan struct{}, 1), cache: map[string]*repoPackage{}}
+	for _, prefix := range prefixes {
+		if prefix = strings.TrimSpace(prefix); prefix != "" {
+			r.Prefixes = append(r.Prefixes, path.Clean("/"+prefix))
+		}
+	}
+	return r
+}
+
+// loadSigningKey loads the private key the metadata is signed with from keyFile, armored as exported
+// by gpg --armor --export-secret-keys, and without a passphrase.
+func (r *packageRepos) loadSigningKey(keyFile string) error {
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	keyring, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("%s: %v", keyFile, err)
+	}
+	for _, e := range keyring {
+		if e.PrivateKey == nil {
+			continue
+		}
+		if e.PrivateKey.Encrypted {
+			return fmt.Errorf("%s: the private key is protected by a passphrase", keyFile)
+		}
+		r.signer = e
+		return nil
+	}
+	return fmt.Errorf("%s: no private key", keyFile)
+}
+
+// repoOf returns the prefix of the repository rel, a path relative to the document root, is in.
+func (r *packageRepos) repoOf(rel string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	for _, prefix := range r.Prefixes {
+		if prefix == "/" || rel == prefix || strings.HasPrefix(rel, prefix+"/") {
+			return prefix, true
+		}
+	}
+	return "", false
+}
+
+// isPackage reports whether name is that of a package file.
+func isPackage(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	return ext == ".deb" || ext == ".rpm"
+}
+
+// changed marks the repository of urlPath, a changed file under /files, for regeneration if it is a package.
+func (r *packageRepos) changed(urlPath string) {
+	rel := path.Clean("/" + strings.TrimPrefix(urlPath, "/files"))
+	prefix, ok := r.repoOf(rel)
+	if !ok || !isPackage(rel) {
+		return
+	}
+	r.mu.Lock()
+	r.pending[prefix] = true
+	r.mu.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (r *packageRepos) take() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	prefixes := make([]string, 0, len(r.pending))
+	for prefix := range r.pending {
+		prefixes = append(prefixes, prefix)
+	}
+	r.pending = map[string]bool{}
+	sort.Strings(prefixes)
+	return prefixes
+}
+
+// isMetadata reports whether rel, a path relative to the document root, is generated repository metadata.
+func (r *packageRepos) isMetadata(rel string) bool {
+	prefix, ok := r.repoOf(rel)
+	if !ok {
+		return false
+	}
+	inRepo := strings.TrimPrefix(strings.TrimPrefix(rel, prefix), "/")
+	if inRepo == "repodata" || strings.HasPrefix(inRepo, "repodata/") || inRepo == repoKeyName {
+		return true
+	}
+	for _, name := range debMetadataNames {
+		if inRepo == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkRepoName returns an error if rel is generated repository metadata, which uploads must not replace.
+func (s Server) checkRepoName(rel string) error {
+	if s.Repos.isMetadata(rel) {
+		return withStatus(http.StatusForbidden, fmt.Errorf("\"/files%s\" is %w", rel, errRepoMetadata))
+	}
+	return nil
+}
+
+// writeRepos generates the metadata of all repositories, then regenerates that of the repositories
+// whose packages change. It never returns.
+func (s Server) writeRepos() {
+	for _, prefix := range s.Repos.Prefixes {
+		s.writeRepo(prefix)
+	}
+	for range s.Repos.wake {
+		time.Sleep(repoDelay)
+		for _, prefix := range s.Repos.take() {
+			s.writeRepo(prefix)
+		}
+	}
+}
+
+// writeRepo regenerates the metadata of the repository at prefix, logging failures.
+// The metadata of a format is only written if the repository has packages of that format, or had.
+func (s Server) writeRepo(prefix string) {
+	entry := logger.WithField("repository", prefix)
+	root := filepath.Join(s.DocumentRoot, filepath.FromSlash(prefix))
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return
+	}
+	debs, rpms, err := s.repoPackages(prefix)
+	if err != nil {
+		entry.WithError(err).Warn("failed to read the packages of the repository")
+		return
+	}
+	if s.Repos.signer != nil {
+		if err := s.writeRepoKey(root); err != nil {
+			entry.WithError(err).Warn("failed to write the public key of the repository")
+		}
+	}
+	if len(debs) > 0 || fileExists(filepath.Join(root, "Packages")) {
+		if err := s.writeDebRepo(root, debs); err != nil {
+			entry.WithError(err).Warn("failed to write the Debian repository metadata")
+		} else {
+			entry.WithField("packages", len(debs)).Info("Debian repository metadata written")
+		}
+	}
+	if len(rpms) > 0 || fileExists(filepath.Join(root, "repodata", "repomd.xml")) {
+		if err := s.writeRPMRepo(root, rpms); err != nil {
+			entry.WithError(err).Warn("failed to write the RPM repository metadata")
+		} else {
+			entry.WithField("packages", len(rpms)).Info("RPM repository metadata written")
+		}
+	}
+	s.Manifests.changed(path.Join("/files", prefix, "Packages"))
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
+}
+
+// repoPackages reads the packages of the repository at prefix, skipping those which cannot be read.
+func (s Server) repoPackages(prefix string) (debs []*repoPackage, rpms []*repoPackage, err error) {
+	root := filepath.Join(s.DocumentRoot, filepath.FromSlash(prefix))
+	seen := map[string]bool{}
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p != root && (isInternalName(info.Name()) || (info.IsDir() && info.Name() == "repodata")) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || !isPackage(info.Name()) {
+			return nil
+		}
+		inRepo, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel := path.Join(prefix, filepath.ToSlash(inRepo))
+		seen[rel] = true
+		pkg, err := s.Repos.readPackage(rel, p, info)
+		if err != nil {
+			logger.WithError(err).WithField("path", rel).Warn("skipping unreadable package")
+			return nil
+		}
+		pkg.Path = filepath.ToSlash(inRepo)
+		if pkg.Deb != nil {
+			debs = append(debs, pkg)
+		} else {
+			rpms = append(rpms, pkg)
+		}
+		return nil
+	})
+	s.Repos.mu.Lock()
+	for rel := range s.Repos.cache {
+		if repo, _ := s.Repos.repoOf(rel); repo == prefix && !seen[rel] {
+			delete(s.Repos.cache, rel)
+		}
+	}
+	s.Repos.mu.Unlock()
+	return debs, rpms, err
+}
+
+// readPackage parses the package at name, rel relative to the document root, unless it is cached.
+func (r *packageRepos) readPackage(rel string, name string, info os.FileInfo) (*repoPackage, error) {
+	r.mu.Lock()
+	cached := r.cache[rel]
+	r.mu.Unlock()
+	if cached != nil && cached.Size == info.Size() && cached.ModTime.Equal(info.ModTime()) {
+		return cached, nil
+	}
+	pkg := &repoPackage{Size: info.Size(), ModTime: info.ModTime()}
+	var err error
+	if strings.ToLower(path.Ext(name)) == ".deb" {
+		pkg.Deb, err = readDebControl(name)
+	} else {
+		pkg.RPM, err = readRPMHeader(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := pkg.hash(name); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.cache[rel] = pkg
+	r.mu.Unlock()
+	return pkg, nil
+}
+
+// hash sets the digests of the package at name.
+func (pkg *repoPackage) hash(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	md5Sum, sha1Sum, sha256Sum := md5.New(), sha1.New(), sha256.New()
+	if _, err := io.Copy(io.MultiWriter(md5Sum, sha1Sum, sha256Sum), f); err != nil {
+		return err
+	}
+	pkg.MD5 = hex.EncodeToString(md5Sum.Sum(nil))
+	pkg.SHA1 = hex.EncodeToString(sha1Sum.Sum(nil))
+	pkg.SHA256 = hex.EncodeToString(sha256Sum.Sum(nil))
+	return nil
+}
+
+// writeRepoKey publishes the public key the metadata of the repository at root is signed with.
+func (s Server) writeRepoKey(root string) error {
+	var b bytes.Buffer
+	w, err := armor.Encode(&b, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return err
+	}
+	if err := s.Repos.signer.Serialize(w); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	b.WriteByte('\n')
+	return writeFileAtomically(filepath.Join(root, repoKeyName), b.Bytes())
+}
+
+// detachSign returns the armored detached signature of content, like gpg --armor --detach-sign.
+func (r *packageRepos) detachSign(content []byte) ([]byte, error) {
+	var b bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&b, r.signer, bytes.NewReader(content), nil); err != nil {
+		return nil, err
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+// clearSign returns content with its signature inline, like gpg --clearsign.
+func (r *packageRepos) clearSign(content []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := clearsign.Encode(&b, r.signer.PrivateKey, nil)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+// gzipped returns content compressed with gzip.
+func gzipped(content []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	if _, err := w.Write(content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// writeRepoFiles writes the files of the metadata of a repository, by path relative to root, in order.
+func writeRepoFiles(root string, names []string, files map[string][]byte) error {
+	for _, name := range names {
+		file := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			return err
+		}
+		if err := writeFileAtomically(file, files[name]); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
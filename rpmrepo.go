@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	rpmLeadSize = 96
+	// maxRPMHeaderSize bounds the headers of an RPM package.
+	maxRPMHeaderSize = 64 << 20
+)
+
+var errBadRPM = errors.New("invalid RPM package")
+
+// The tags of the RPM header read for the repository metadata.
+const (
+	rpmTagName            = 1000
+	rpmTagVersion         = 1001
+	rpmTagRelease         = 1002
+	rpmTagEpoch           = 1003
+	rpmTagSummary         = 1004
+	rpmTagDescription     = 1005
+	rpmTagBuildTime       = 1006
+	rpmTagBuildHost       = 1007
+	rpmTagSize            = 1009
+	rpmTagVendor          = 1011
+	rpmTagLicense         = 1014
+	rpmTagPackager        = 1015
+	rpmTagGroup           = 1016
+	rpmTagURL             = 1020
+	rpmTagArch            = 1022
+	rpmTagFileModes       = 1030
+	rpmTagSourceRPM       = 1044
+	rpmTagArchiveSize     = 1046
+	rpmTagProvideName     = 1047
+	rpmTagRequireFlags    = 1048
+	rpmTagRequireName     = 1049
+	rpmTagRequireVersion  = 1050
+	rpmTagConflictFlags   = 1053
+	rpmTagConflictName    = 1054
+	rpmTagConflictVersion = 1055
+	rpmTagObsoleteName    = 1090
+	rpmTagProvideFlags    = 1112
+	rpmTagProvideVersion  = 1113
+	rpmTagObsoleteFlags   = 1114
+	rpmTagObsoleteVersion = 1115
+	rpmTagDirIndexes      = 1116
+	rpmTagBaseNames       = 1117
+	rpmTagDirNames        = 1118
+)
+
+// The types of the values of the RPM header.
+const (
+	rpmTypeInt8        = 2
+	rpmTypeInt16       = 3
+	rpmTypeInt32       = 4
+	rpmTypeString      = 6
+	rpmTypeStringArray = 8
+	rpmTypeI18NString  = 9
+)
+
+type rpmIndexEntry struct {
+	Type, Offset, Count uint32
+}
+
+// rpmHeader is a header structure of an RPM package: an index of tags into a store of values.
+type rpmHeader struct {
+	index map[uint32]rpmIndexEntry
+	store []byte
+}
+
+// readRPMHeaderStructure reads a header structure from r, returning its size.
+func readRPMHeaderStructure(r io.Reader) (*rpmHeader, int64, error) {
+	intro := make([]byte, 16)
+	if _, err := io.ReadFull(r, intro); err != nil {
+		return nil, 0, fmt.Errorf("%w: truncated header", errBadRPM)
+	}
+	if !bytes.Equal(intro[:3], []byte{0x8e, 0xad, 0xe8}) {
+		return nil, 0, fmt.Errorf("%w: bad header magic", errBadRPM)
+	}
+	count, size := binary.BigEndian.Uint32(intro[8:]), binary.BigEndian.Uint32(intro[12:])
+	if int64(count)*16+int64(size) > maxRPMHeaderSize {
+		return nil, 0, fmt.Errorf("%w: header too large", errBadRPM)
+	}
+	entries := make([]byte, count*16)
+	if _, err := io.ReadFull(r, entries); err != nil {
+		return nil, 0, fmt.Errorf("%w: truncated header", errBadRPM)
+	}
+	h := &rpmHeader{index: map[uint32]rpmIndexEntry{}, store: make([]byte, size)}
+	if _, err := io.ReadFull(r, h.store); err != nil {
+		return nil, 0, fmt.Errorf("%w: truncated header", errBadRPM)
+	}
+	for i := uint32(0); i < count; i++ {
+		e := entries[i*16:]
+		h.index[binary.BigEndian.Uint32(e)] = rpmIndexEntry{
+			Type:   binary.BigEndian.Uint32(e[4:]),
+			Offset: binary.BigEndian.Uint32(e[8:]),
+			Count:  binary.BigEndian.Uint32(e[12:]),
+		}
+	}
+	return h, 16 + int64(count)*16 + int64(size), nil
+}
+
+// strings returns the strings of tag, of which a string or I18N string has the first.
+func (h *rpmHeader) strings(tag uint32) []string {
+	e, ok := h.index[tag]
+	if !ok || int(e.Offset) > len(h.store) {
+		return nil
+	}
+	n := int(e.Count)
+	switch e.Type {
+	case rpmTypeString:
+		n = 1
+	case rpmTypeStringArray, rpmTypeI18NString:
+	default:
+		return nil
+	}
+	values := make([]string, 0, n)
+	b := h.store[e.Offset:]
+	for i := 0; i < n; i++ {
+		end := bytes.IndexByte(b, 0)
+		if end < 0 {
+			break
+		}
+		values = append(values, string(b[:end]))
+		b = b[end+1:]
+	}
+	return values
+}
+
+func (h *rpmHeader) string(tag uint32) string {
+	if values := h.strings(tag); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// ints returns the integers of tag.
+func (h *rpmHeader) ints(tag uint32) []int64 {
+	e, ok := h.index[tag]
+	if !ok {
+		return nil
+	}
+	sizes := map[uint32]int{rpmTypeInt8: 1, rpmTypeInt16: 2, rpmTypeInt32: 4}
+	size, ok := sizes[e.Type]
+	if !ok || int(e.Offset)+size*int(e.Count) > len(h.store) {
+		return nil
+	}
+	values := make([]int64, e.Count)
+	for i := range values {
+		b := h.store[int(e.Offset)+i*size:]
+		switch size {
+		case 1:
+			values[i] = int64(b[0])
+		case 2:
+			values[i] = int64(binary.BigEndian.Uint16(b))
+		case 4:
+			values[i] = int64(binary.BigEndian.Uint32(b))
+		}
+	}
+	return values
+}
+
+func (h *rpmHeader) int(tag uint32) int64 {
+	if values := h.ints(tag); len(values) > 0 {
+		return values[0]
+	}
+	return 0
+}
+
+// rpmPackage is what the repository metadata says of an RPM package.
+type rpmPackage struct {
+	Name, Arch, Epoch, Version, Release   string
+	Summary, Description                  string
+	Packager, URL, License, Vendor        string
+	Group, BuildHost, SourceRPM           string
+	BuildTime, InstalledSize, ArchiveSize int64
+	// HeaderStart and HeaderEnd are the offsets of the main header in the file.
+	HeaderStart, HeaderEnd                   int64
+	Provides, Requires, Conflicts, Obsoletes []rpmEntry
+	Files                                    []rpmFile
+}
+
+type rpmFile struct {
+	Type string `xml:"type,attr,omitempty"`
+	Path string `xml:",chardata"`
+}
+
+type rpmEntry struct {
+	Name    string `xml:"name,attr"`
+	Flags   string `xml:"flags,attr,omitempty"`
+	Epoch   string `xml:"epoch,attr,omitempty"`
+	Version string `xml:"ver,attr,omitempty"`
+	Release string `xml:"rel,attr,omitempty"`
+	Pre     string `xml:"pre,attr,omitempty"`
+}
+
+// readRPMHeader reads the main header of the RPM package at name: the lead, then the signature header,
+// padded to 8 bytes, then the main header.
+func readRPMHeader(name string) (*rpmPackage, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	lead := make([]byte, rpmLeadSize)
+	if _, err := io.ReadFull(f, lead); err != nil || !bytes.Equal(lead[:4], []byte{0xed, 0xab, 0xee, 0xdb}) {
+		return nil, fmt.Errorf("%w: no RPM lead", errBadRPM)
+	}
+	_, sigSize, err := readRPMHeaderStructure(f)
+	if err != nil {
+		return nil, err
+	}
+	if pad := (8 - sigSize%8) % 8; pad > 0 {
+		if _, err := io.CopyN(ioutil.Discard, f, pad); err != nil {
+			return nil, fmt.Errorf("%w: truncated", errBadRPM)
+		}
+	}
+	start := rpmLeadSize + sigSize + (8-sigSize%8)%8
+	h, size, err := readRPMHeaderStructure(f)
+	if err != nil {
+		return nil, err
+	}
+	p := &rpmPackage{
+		Name:          h.string(rpmTagName),
+		Arch:          h.string(rpmTagArch),
+		Epoch:         "0",
+		Version:       h.string(rpmTagVersion),
+		Release:       h.string(rpmTagRelease),
+		Summary:       h.string(rpmTagSummary),
+		Description:   h.string(rpmTagDescription),
+		Packager:      h.string(rpmTagPackager),
+		URL:           h.string(rpmTagURL),
+		License:       h.string(rpmTagLicense),
+		Vendor:        h.string(rpmTagVendor),
+		Group:         h.string(rpmTagGroup),
+		BuildHost:     h.string(rpmTagBuildHost),
+		SourceRPM:     h.string(rpmTagSourceRPM),
+		BuildTime:     h.int(rpmTagBuildTime),
+		InstalledSize: h.int(rpmTagSize),
+		ArchiveSize:   h.int(rpmTagArchiveSize),
+		HeaderStart:   start,
+		HeaderEnd:     start + size,
+	}
+	if p.Name == "" || p.Version == "" {
+		return nil, fmt.Errorf("%w: no name or version", errBadRPM)
+	}
+	if _, ok := h.index[rpmTagEpoch]; ok {
+		p.Epoch = strconv.FormatInt(h.int(rpmTagEpoch), 10)
+	}
+	p.Provides = rpmEntries(h, rpmTagProvideName, rpmTagProvideFlags, rpmTagProvideVersion)
+	for _, e := range rpmEntries(h, rpmTagRequireName, rpmTagRequireFlags, rpmTagRequireVersion) {
+		// rpmlib features are not packages, and so are left out like createrepo does.
+		if !strings.HasPrefix(e.Name, "rpmlib(") {
+			p.Requires = append(p.Requires, e)
+		}
+	}
+	p.Conflicts = rpmEntries(h, rpmTagConflictName, rpmTagConflictFlags, rpmTagConflictVersion)
+	p.Obsoletes = rpmEntries(h, rpmTagObsoleteName, rpmTagObsoleteFlags, rpmTagObsoleteVersion)
+
+	dirs, bases, dirIndexes, modes := h.strings(rpmTagDirNames), h.strings(rpmTagBaseNames), h.ints(rpmTagDirIndexes), h.ints(rpmTagFileModes)
+	for i, base := range bases {
+		if i >= len(dirIndexes) || int(dirIndexes[i]) >= len(dirs) {
+			break
+		}
+		file := rpmFile{Path: dirs[dirIndexes[i]] + base}
+		if i < len(modes) && modes[i]&0170000 == 040000 {
+			file.Type = "dir"
+		}
+		p.Files = append(p.Files, file)
+	}
+	return p, nil
+}
+
+// rpmEntries returns the dependencies whose names, flags and versions are under the given tags.
+func rpmEntries(h *rpmHeader, nameTag, flagsTag, versionTag uint32) []rpmEntry {
+	names, flags, versions := h.strings(nameTag), h.ints(flagsTag), h.strings(versionTag)
+	entries := make([]rpmEntry, 0, len(names))
+	for i, name := range names {
+		e := rpmEntry{Name: name}
+		var flag int64
+		if i < len(flags) {
+			flag = flags[i]
+		}
+		// the comparison is in the less (2), greater (4) and equal (8) bits.
+		e.Flags = map[int64]string{2: "LT", 4: "GT", 8: "EQ", 10: "LE", 12: "GE"}[flag&0x0e]
+		if e.Flags != "" && i < len(versions) && versions[i] != "" {
+			e.Epoch, e.Version, e.Release = splitEVR(versions[i])
+		}
+		// prerequisites and requirements of scriptlets run before installation.
+		if flag&(1<<6|1<<9|1<<10) != 0 {
+			e.Pre = "1"
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// splitEVR splits a version like "1:2.3-4" into its epoch, version and release.
+func splitEVR(evr string) (epoch, version, release string) {
+	epoch = "0"
+	if i := strings.Index(evr, ":"); i >= 0 {
+		epoch, evr = evr[:i], evr[i+1:]
+	}
+	version = evr
+	if i := strings.LastIndex(evr, "-"); i >= 0 {
+		version, release = evr[:i], evr[i+1:]
+	}
+	return epoch, version, release
+}
+
+// isPrimaryFile reports whether file is listed in primary.xml, not only in filelists.xml, as createrepo does
+// for the files most often required by path.
+func isPrimaryFile(file string) bool {
+	return strings.HasPrefix(file, "/etc/") || strings.Contains(file, "bin/") || file == "/usr/lib/sendmail"
+}
+
+const (
+	rpmCommonNS    = "http://linux.duke.edu/metadata/common"
+	rpmNS          = "http://linux.duke.edu/metadata/rpm"
+	rpmFilelistsNS = "http://linux.duke.edu/metadata/filelists"
+	rpmRepoNS      = "http://linux.duke.edu/metadata/repo"
+)
+
+type rpmVersion struct {
+	Epoch   string `xml:"epoch,attr"`
+	Version string `xml:"ver,attr"`
+	Release string `xml:"rel,attr"`
+}
+
+type rpmChecksum struct {
+	Type  string `xml:"type,attr"`
+	PkgID string `xml:"pkgid,attr,omitempty"`
+	Value string `xml:",chardata"`
+}
+
+type rpmLocation struct {
+	Href string `xml:"href,attr"`
+}
+
+type rpmPrimary struct {
+	XMLName  xml.Name `xml:"metadata"`
+	NS       string   `xml:"xmlns,attr"`
+	RPMNS    string   `xml:"xmlns:rpm,attr"`
+	Count    int      `xml:"packages,attr"`
+	Packages []rpmPrimaryPackage
+}
+
+type rpmPrimaryPackage struct {
+	XMLName     xml.Name    `xml:"package"`
+	Type        string      `xml:"type,attr"`
+	Name        string      `xml:"name"`
+	Arch        string      `xml:"arch"`
+	Version     rpmVersion  `xml:"version"`
+	Checksum    rpmChecksum `xml:"checksum"`
+	Summary     string      `xml:"summary"`
+	Description string      `xml:"description"`
+	Packager    string      `xml:"packager"`
+	URL         string      `xml:"url"`
+	Time        struct {
+		File  int64 `xml:"file,attr"`
+		Build int64 `xml:"build,attr"`
+	} `xml:"time"`
+	Size struct {
+		Package   int64 `xml:"package,attr"`
+		Installed int64 `xml:"installed,attr"`
+		Archive   int64 `xml:"archive,attr"`
+	} `xml:"size"`
+	Location rpmLocation `xml:"location"`
+	Format   struct {
+		License     string `xml:"rpm:license"`
+		Vendor      string `xml:"rpm:vendor"`
+		Group       string `xml:"rpm:group"`
+		BuildHost   string `xml:"rpm:buildhost"`
+		SourceRPM   string `xml:"rpm:sourcerpm"`
+		HeaderRange struct {
+			Start int64 `xml:"start,attr"`
+			End   int64 `xml:"end,attr"`
+		} `xml:"rpm:header-range"`
+		Provides  *rpmDependencies `xml:"rpm:provides"`
+		Requires  *rpmDependencies `xml:"rpm:requires"`
+		Conflicts *rpmDependencies `xml:"rpm:conflicts"`
+		Obsoletes *rpmDependencies `xml:"rpm:obsoletes"`
+		Files     []rpmFile        `xml:"file"`
+	} `xml:"format"`
+}
+
+type rpmDependencies struct {
+	Entries []rpmEntry `xml:"rpm:entry"`
+}
+
+type rpmFilelists struct {
+	XMLName  xml.Name `xml:"filelists"`
+	NS       string   `xml:"xmlns,attr"`
+	Count    int      `xml:"packages,attr"`
+	Packages []rpmFilelistsPackage
+}
+
+type rpmFilelistsPackage struct {
+	XMLName xml.Name   `xml:"package"`
+	PkgID   string     `xml:"pkgid,attr"`
+	Name    string     `xml:"name,attr"`
+	Arch    string     `xml:"arch,attr"`
+	Version rpmVersion `xml:"version"`
+	Files   []rpmFile  `xml:"file"`
+}
+
+type rpmRepomd struct {
+	XMLName  xml.Name `xml:"repomd"`
+	NS       string   `xml:"xmlns,attr"`
+	RPMNS    string   `xml:"xmlns:rpm,attr"`
+	Revision int64    `xml:"revision"`
+	Data     []rpmRepomdData
+}
+
+type rpmRepomdData struct {
+	XMLName      xml.Name    `xml:"data"`
+	Type         string      `xml:"type,attr"`
+	Checksum     rpmChecksum `xml:"checksum"`
+	OpenChecksum rpmChecksum `xml:"open-checksum"`
+	Location     rpmLocation `xml:"location"`
+	Timestamp    int64       `xml:"timestamp"`
+	Size         int         `xml:"size"`
+	OpenSize     int         `xml:"open-size"`
+}
+
+func dependencies(entries []rpmEntry) *rpmDependencies {
+	if len(entries) == 0 {
+		return nil
+	}
+	return &rpmDependencies{Entries: entries}
+}
+
+func marshalXML(v interface{}) ([]byte, error) {
+	b, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(append([]byte(xml.Header), b...), '\n'), nil
+}
+
+// writeRPMRepo writes the repodata of the repository at root, as createrepo would, for dnf and yum with
+// baseurl=http://host/files/rpm. The files are named after their digests, so that clients never mix
+// old and new ones; repomd.xml is signed as repomd.xml.asc if a signing key is configured.
+func (s Server) writeRPMRepo(root string, rpms []*repoPackage) error {
+	sort.Slice(rpms, func(i, j int) bool {
+		if rpms[i].RPM.Name != rpms[j].RPM.Name {
+			return rpms[i].RPM.Name < rpms[j].RPM.Name
+		}
+		return rpms[i].Path < rpms[j].Path
+	})
+	primary := rpmPrimary{NS: rpmCommonNS, RPMNS: rpmNS, Count: len(rpms)}
+	filelists := rpmFilelists{NS: rpmFilelistsNS, Count: len(rpms)}
+	for _, pkg := range rpms {
+		p := pkg.RPM
+		version := rpmVersion{Epoch: p.Epoch, Version: p.Version, Release: p.Release}
+		entry := rpmPrimaryPackage{
+			Type:        "rpm",
+			Name:        p.Name,
+			Arch:        p.Arch,
+			Version:     version,
+			Checksum:    rpmChecksum{Type: "sha256", PkgID: "YES", Value: pkg.SHA256},
+			Summary:     p.Summary,
+			Description: p.Description,
+			Packager:    p.Packager,
+			URL:         p.URL,
+			Location:    rpmLocation{Href: pkg.Path},
+		}
+		entry.Time.File, entry.Time.Build = pkg.ModTime.Unix(), p.BuildTime
+		entry.Size.Package, entry.Size.Installed, entry.Size.Archive = pkg.Size, p.InstalledSize, p.ArchiveSize
+		format := &entry.Format
+		format.License, format.Vendor, format.Group, format.BuildHost, format.SourceRPM = p.License, p.Vendor, p.Group, p.BuildHost, p.SourceRPM
+		format.HeaderRange.Start, format.HeaderRange.End = p.HeaderStart, p.HeaderEnd
+		format.Provides, format.Requires = dependencies(p.Provides), dependencies(p.Requires)
+		format.Conflicts, format.Obsoletes = dependencies(p.Conflicts), dependencies(p.Obsoletes)
+		for _, file := range p.Files {
+			if isPrimaryFile(file.Path) {
+				format.Files = append(format.Files, file)
+			}
+		}
+		primary.Packages = append(primary.Packages, entry)
+		filelists.Packages = append(filelists.Packages, rpmFilelistsPackage{PkgID: pkg.SHA256, Name: p.Name, Arch: p.Arch, Version: version, Files: p.Files})
+	}
+
+	now := time.Now().Unix()
+	repomd := rpmRepomd{NS: rpmRepoNS, RPMNS: rpmNS, Revision: now}
+	files := map[string][]byte{}
+	var names []string
+	for _, data := range []struct {
+		kind string
+		v    interface{}
+	}{{"primary", primary}, {"filelists", filelists}} {
+		open, err := marshalXML(data.v)
+		if err != nil {
+			return err
+		}
+		compressed, err := gzipped(open)
+		if err != nil {
+			return err
+		}
+		sum, openSum := sha256.Sum256(compressed), sha256.Sum256(open)
+		name := fmt.Sprintf("repodata/%s-%s.xml.gz", hex.EncodeToString(sum[:]), data.kind)
+		files[name] = compressed
+		names = append(names, name)
+		repomd.Data = append(repomd.Data, rpmRepomdData{
+			Type:         data.kind,
+			Checksum:     rpmChecksum{Type: "sha256", Value: hex.EncodeToString(sum[:])},
+			OpenChecksum: rpmChecksum{Type: "sha256", Value: hex.EncodeToString(openSum[:])},
+			Location:     rpmLocation{Href: name},
+			Timestamp:    now,
+			Size:         len(compressed),
+			OpenSize:     len(open),
+		})
+	}
+	b, err := marshalXML(repomd)
+	if err != nil {
+		return err
+	}
+	files["repodata/repomd.xml"] = b
+	names = append(names, "repodata/repomd.xml")
+	if s.Repos.signer != nil {
+		if files["repodata/repomd.xml.asc"], err = s.Repos.detachSign(b); err != nil {
+			return err
+		}
+		names = append(names, "repodata/repomd.xml.asc")
+	}
+	if err := writeRepoFiles(root, names, files); err != nil {
+		return err
+	}
+	// the data files of previous generations are removed once an hour old, so that clients which fetched
+	// the previous repomd.xml can still fetch them.
+	infos, err := ioutil.ReadDir(filepath.Join(root, "repodata"))
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		name := "repodata/" + info.Name()
+		if _, ok := files[name]; !ok && strings.HasSuffix(name, ".xml.gz") && info.ModTime().Before(time.Now().Add(-time.Hour)) {
+			os.Remove(filepath.Join(root, filepath.FromSlash(name)))
+		}
+	}
+	return nil
+}
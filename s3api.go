@@ -0,0 +1,937 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// s3UploadTTL is how long an unfinished multipart upload is kept after its last part.
+	s3UploadTTL = 24 * time.Hour
+	// maxS3RequestSize bounds the XML documents sent to the S3 API.
+	maxS3RequestSize = 1 << 20
+	// maxS3Keys is the most keys listed or deleted at once.
+	maxS3Keys = 1000
+	// s3Owner is the owner of all buckets and objects.
+	s3Owner = "simple-upload-server"
+	// s3EmptyETag is the ETag of empty objects, like the directories listed as objects.
+	s3EmptyETag = "\"d41d8cd98f00b204e9800998ecf8427e\""
+)
+
+// s3APIError is an error of the S3 API, reported with one of its codes, like NoSuchKey.
+type s3APIError struct {
+	status  int
+	Code    string
+	Message string
+}
+
+func (e *s3APIError) Error() string {
+	return e.Message
+}
+
+func newS3APIError(status int, code string, format string, args ...interface{}) *s3APIError {
+	return &s3APIError{status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// respondS3Error writes err as S3 does, with errors of the server translated to its codes.
+func respondS3Error(w http.ResponseWriter, r *http.Request, err error) {
+	var e *s3APIError
+	if !errors.As(err, &e) {
+		status := statusOf(err)
+		if status == http.StatusUnauthorized {
+			status = http.StatusForbidden
+		}
+		code := map[int]string{
+			http.StatusBadRequest:            "InvalidArgument",
+			http.StatusForbidden:             "AccessDenied",
+			http.StatusNotFound:              "NoSuchKey",
+			http.StatusMethodNotAllowed:      "MethodNotAllowed",
+			http.StatusConflict:              "OperationAborted",
+			http.StatusRequestEntityTooLarge: "EntityTooLarge",
+			http.StatusUnsupportedMediaType:  "InvalidArgument",
+			http.StatusServiceUnavailable:    "ServiceUnavailable",
+			http.StatusInsufficientStorage:   "ServiceUnavailable",
+		}[status]
+		if code == "" {
+			code = "InternalError"
+		}
+		e = &s3APIError{status: status, Code: code, Message: err.Error()}
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(e.status)
+		return
+	}
+	writeS3XML(w, e.status, struct {
+		XMLName   xml.Name `xml:"Error"`
+		Code      string
+		Message   string
+		Resource  string
+		RequestID string `xml:"RequestId"`
+	}{Code: e.Code, Message: e.Message, Resource: r.URL.Path, RequestID: w.Header().Get("X-Amz-Request-Id")})
+}
+
+func writeS3XML(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(v)
+}
+
+// s3Upload is an object being uploaded in parts.
+type s3Upload struct {
+	// mu serializes the changes of the parts.
+	mu      sync.Mutex
+	rel     string
+	dir     string
+	parts   map[int]s3Part
+	updated time.Time
+}
+
+// s3Part is a part of a multipart upload, stored in the staging directory of the upload as (number).
+type s3Part struct {
+	md5  []byte
+	size int64
+}
+
+// s3API serves a subset of the S3 API over the document root, whose top-level directories are the buckets:
+// ListBuckets, CreateBucket, HeadBucket, DeleteBucket, ListObjects and ListObjectsV2, PutObject, CopyObject,
+// GetObject, HeadObject, DeleteObject, DeleteObjects and multipart uploads. Requests are addressed path-style,
+// and signed with Signature Version 4.
+type s3API struct {
+	// AccessKey is the access key ID of the API, whose secret key is the token.
+	AccessKey string
+
+	mu      sync.Mutex
+	uploads map[string]*s3Upload
+}
+
+func newS3API(accessKey string) *s3API {
+	return &s3API{AccessKey: accessKey, uploads: map[string]*s3Upload{}}
+}
+
+// serveS3 wraps h so that requests signed with Signature Version 4 are served by the S3 API, whatever their path.
+func (s Server) serveS3(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isS3Request(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		s.handleS3(w, r)
+	})
+}
+
+func (s Server) handleS3(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("X-Amz-Request-Id", newUUID())
+	sig, err := s.verifyS3Signature(r, time.Now())
+	if err == nil && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		err = s.checkWritable()
+	}
+	if err == nil {
+		bucket, key := splitS3Path(r.URL.Path)
+		switch {
+		case bucket == "":
+			err = s.handleS3Service(w, r)
+		case key == "":
+			err = s.handleS3Bucket(w, r, bucket)
+		default:
+			err = s.handleS3Object(w, r, sig, bucket, key)
+		}
+	}
+	if err != nil {
+		// the errors of the API are those of the client.
+		if e := (*s3APIError)(nil); !errors.As(err, &e) {
+			logFailure(logger.WithFields(logrus.Fields{"path": r.URL.Path, "method": r.Method}), err, "S3 request failed")
+		}
+		respondS3Error(w, r, err)
+	}
+}
+
+// splitS3Path splits the path of a request into the bucket and the key.
+func splitS3Path(p string) (string, string) {
+	parts := strings.SplitN(strings.TrimPrefix(p, "/"), "/", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func s3MethodNotAllowed(r *http.Request) error {
+	return newS3APIError(http.StatusMethodNotAllowed, "MethodNotAllowed", "%s", errMethodNotAllowed(r.Method))
+}
+
+// bucketDir returns the directory of bucket, or an error if there is no such bucket.
+func (s Server) bucketDir(bucket string) (string, error) {
+	if checkName(bucket) != nil || isInternalName(bucket) {
+		return "", newS3APIError(http.StatusBadRequest, "InvalidBucketName", "invalid bucket name %q", bucket)
+	}
+	dir := filepath.Join(s.DocumentRoot, bucket)
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return dir, newS3APIError(http.StatusNotFound, "NoSuchBucket", "bucket %s does not exist", bucket)
+	}
+	return dir, nil
+}
+
+// objectPath returns the path of the object key of bucket relative to the document root. Keys with "." or ".."
+// segments are rejected rather than cleaned, which could name an object of another bucket.
+func (s Server) objectPath(bucket string, key string) (string, error) {
+	for _, name := range strings.Split(strings.TrimSuffix(key, "/"), "/") {
+		if name == "." || name == ".." {
+			return "", newS3APIError(http.StatusBadRequest, "InvalidArgument", "invalid key %q", key)
+		}
+	}
+	rel, err := s.storedPath(path.Join(bucket, key))
+	if err != nil {
+		return "", newS3APIError(http.StatusBadRequest, "InvalidArgument", "%v", err)
+	}
+	return rel, nil
+}
+
+// handleS3Service serves GET /, the list of buckets.
+func (s Server) handleS3Service(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return s3MethodNotAllowed(r)
+	}
+	infos, err := ioutil.ReadDir(s.DocumentRoot)
+	if err != nil {
+		return err
+	}
+	type bucket struct {
+		Name         string
+		CreationDate string
+	}
+	var result struct {
+		XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+		Owner   struct{ ID, DisplayName string }
+		Buckets []bucket `xml:"Buckets>Bucket"`
+	}
+	result.Owner.ID, result.Owner.DisplayName = s3Owner, s3Owner
+	for _, info := range infos {
+		if info.IsDir() && !isInternalName(info.Name()) {
+			result.Buckets = append(result.Buckets, bucket{info.Name(), info.ModTime().UTC().Format(time.RFC3339)})
+		}
+	}
+	writeS3XML(w, http.StatusOK, result)
+	return nil
+}
+
+// handleS3Bucket serves the operations on a bucket: HEAD, PUT and DELETE, GET to list the objects,
+// and POST ?delete to delete several objects.
+func (s Server) handleS3Bucket(w http.ResponseWriter, r *http.Request, bucket string) error {
+	q := r.URL.Query()
+	if r.Method == http.MethodPut {
+		if checkName(bucket) != nil || isInternalName(bucket) {
+			return newS3APIError(http.StatusBadRequest, "InvalidBucketName", "invalid bucket name %q", bucket)
+		}
+		if err := os.MkdirAll(filepath.Join(s.DocumentRoot, bucket), 0777); err != nil {
+			return err
+		}
+		auditLog().WithFields(logrus.Fields{"bucket": bucket, "remote": clientIP(r)}).Info("bucket created by S3 API")
+		w.Header().Set("Location", "/"+bucket)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	dir, err := s.bucketDir(bucket)
+	if err != nil {
+		return err
+	}
+	switch r.Method {
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+		return nil
+	case http.MethodDelete:
+		if entries, err := ioutil.ReadDir(dir); err != nil {
+			return err
+		} else if len(entries) > 0 {
+			return newS3APIError(http.StatusConflict, "BucketNotEmpty", "bucket %s is not empty", bucket)
+		}
+		if err := os.Remove(dir); err != nil {
+			return err
+		}
+		auditLog().WithFields(logrus.Fields{"bucket": bucket, "remote": clientIP(r)}).Info("bucket deleted by S3 API")
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	case http.MethodPost:
+		if _, ok := q["delete"]; ok {
+			return s.deleteS3Objects(w, r, bucket)
+		}
+	case http.MethodGet:
+		switch {
+		case q["location"] != nil:
+			writeS3XML(w, http.StatusOK, struct {
+				XMLName xml.Name `xml:"LocationConstraint"`
+			}{})
+			return nil
+		case q["versioning"] != nil:
+			writeS3XML(w, http.StatusOK, struct {
+				XMLName xml.Name `xml:"VersioningConfiguration"`
+			}{})
+			return nil
+		}
+		for name := range q {
+			if !s3ListParameters[name] && !strings.HasPrefix(name, "X-Amz-") {
+				return newS3APIError(http.StatusNotImplemented, "NotImplemented", "?%s is not implemented", name)
+			}
+		}
+		return s.listS3Objects(w, r, bucket, dir)
+	}
+	return s3MethodNotAllowed(r)
+}
+
+// s3ListParameters are the query parameters of ListObjects and ListObjectsV2.
+var s3ListParameters = map[string]bool{
+	"list-type": true, "prefix": true, "delimiter": true, "max-keys": true, "encoding-type": true, "x-id": true,
+	"continuation-token": true, "start-after": true, "fetch-owner": true, "marker": true,
+}
+
+// s3Entry is an object listed in a bucket. Empty directories are listed as objects whose key ends with a slash,
+// as S3 consoles create them.
+type s3Entry struct {
+	Key  string
+	info os.FileInfo
+}
+
+// s3Entries returns the objects of the bucket in dir whose keys start with prefix, sorted by key.
+func (s Server) s3Entries(bucket string, dir string, prefix string) ([]s3Entry, error) {
+	root := filepath.Join(dir, filepath.FromSlash(prefix[:strings.LastIndex(prefix, "/")+1]))
+	var entries []s3Entry
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == root {
+			return filepath.SkipDir
+		} else if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		switch {
+		case info.IsDir() && p != dir:
+			if f, err := os.Open(p); err == nil {
+				names, _ := f.Readdirnames(1)
+				f.Close()
+				if len(names) == 0 && strings.HasPrefix(key+"/", prefix) {
+					entries = append(entries, s3Entry{key + "/", info})
+				}
+			}
+		case info.Mode().IsRegular() && strings.HasPrefix(key, prefix):
+			entries = append(entries, s3Entry{key, info})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// files are walked in the order of their names in each directory, which is not that of the keys.
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries, nil
+}
+
+// listS3Objects serves GET /(bucket), ListObjectsV2 with list-type=2 and ListObjects otherwise.
+func (s Server) listS3Objects(w http.ResponseWriter, r *http.Request, bucket string, dir string) error {
+	q := r.URL.Query()
+	v2 := q.Get("list-type") == "2"
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	maxKeys := maxS3Keys
+	if v := q.Get("max-keys"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return newS3APIError(http.StatusBadRequest, "InvalidArgument", "invalid max-keys %q", v)
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+	after := q.Get("marker")
+	if v2 {
+		after = q.Get("start-after")
+		if token := q.Get("continuation-token"); token != "" {
+			b, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				return newS3APIError(http.StatusBadRequest, "InvalidArgument", "invalid continuation-token")
+			}
+			after = string(b)
+		}
+	}
+	entries, err := s.s3Entries(bucket, dir, prefix)
+	if err != nil {
+		return err
+	}
+
+	type object struct {
+		Key          string
+		LastModified string
+		ETag         string
+		Size         int64
+		StorageClass string
+	}
+	var objects []object
+	var prefixes []string
+	truncated, last := false, ""
+	for _, e := range entries {
+		key := e.Key
+		if key <= after {
+			continue
+		}
+		commonPrefix := ""
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			commonPrefix = key[:len(prefix)+i+len(delimiter)]
+			if commonPrefix <= after || (len(prefixes) > 0 && prefixes[len(prefixes)-1] == commonPrefix) {
+				continue
+			}
+		}
+		if len(objects)+len(prefixes) == maxKeys {
+			truncated = true
+			break
+		}
+		if commonPrefix != "" {
+			prefixes = append(prefixes, commonPrefix)
+			last = commonPrefix
+			continue
+		}
+		etag, size := s3EmptyETag, int64(0)
+		if e.info.Mode().IsRegular() {
+			etag, size = s.etagOf(path.Join("/", bucket, key), e.info), e.info.Size()
+		}
+		objects = append(objects, object{key, e.info.ModTime().UTC().Format(time.RFC3339), etag, size, "STANDARD"})
+		last = key
+	}
+
+	encode := func(s string) string { return s }
+	if q.Get("encoding-type") == "url" {
+		encode = url.QueryEscape
+	}
+	for i := range objects {
+		objects[i].Key = encode(objects[i].Key)
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	common := make([]commonPrefix, 0, len(prefixes))
+	for _, p := range prefixes {
+		common = append(common, commonPrefix{encode(p)})
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		Name                  string
+		Prefix                string
+		Delimiter             string `xml:",omitempty"`
+		MaxKeys               int
+		EncodingType          string `xml:",omitempty"`
+		IsTruncated           bool
+		Marker                *string `xml:",omitempty"`
+		NextMarker            string  `xml:",omitempty"`
+		KeyCount              *int    `xml:",omitempty"`
+		ContinuationToken     string  `xml:",omitempty"`
+		NextContinuationToken string  `xml:",omitempty"`
+		StartAfter            string  `xml:",omitempty"`
+		Contents              []object
+		CommonPrefixes        []commonPrefix
+	}{
+		Name:           bucket,
+		Prefix:         encode(prefix),
+		Delimiter:      encode(delimiter),
+		MaxKeys:        maxKeys,
+		EncodingType:   q.Get("encoding-type"),
+		IsTruncated:    truncated,
+		Contents:       objects,
+		CommonPrefixes: common,
+	}
+	if v2 {
+		count := len(objects) + len(prefixes)
+		result.KeyCount = &count
+		result.ContinuationToken = q.Get("continuation-token")
+		result.StartAfter = encode(q.Get("start-after"))
+		if truncated {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		}
+	} else {
+		marker := encode(q.Get("marker"))
+		result.Marker = &marker
+		if truncated {
+			result.NextMarker = encode(last)
+		}
+	}
+	writeS3XML(w, http.StatusOK, result)
+	return nil
+}
+
+// handleS3Object serves the operations on the object key of bucket.
+func (s Server) handleS3Object(w http.ResponseWriter, r *http.Request, sig *s3Signature, bucket string, key string) error {
+	if _, err := s.bucketDir(bucket); err != nil {
+		return err
+	}
+	rel, err := s.objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+	q := r.URL.Query()
+	uploadID := q.Get("uploadId")
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if uploadID != "" {
+			return newS3APIError(http.StatusNotImplemented, "NotImplemented", "ListParts is not implemented")
+		}
+		return s.getS3Object(w, r, rel, key)
+	case http.MethodPut:
+		if uploadID != "" {
+			return s.putS3Part(w, r, sig, rel, uploadID)
+		}
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			return s.copyS3Object(w, r, rel, source)
+		}
+		return s.putS3Object(w, r, sig, rel, key)
+	case http.MethodPost:
+		if _, ok := q["uploads"]; ok {
+			return s.createS3Upload(w, r, bucket, key, rel)
+		}
+		if uploadID != "" {
+			return s.completeS3Upload(w, r, bucket, key, rel, uploadID)
+		}
+	case http.MethodDelete:
+		if uploadID != "" {
+			return s.abortS3Upload(w, rel, uploadID)
+		}
+		if strings.HasSuffix(key, "/") {
+			// only empty directories are listed as objects.
+			os.Remove(filepath.Join(s.DocumentRoot, filepath.FromSlash(rel)))
+		} else if err := s.removeS3Object(r, rel); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return s3MethodNotAllowed(r)
+}
+
+// s3ResponseHeaders are the query parameters of GetObject overriding the headers of the response.
+var s3ResponseHeaders = map[string]string{
+	"response-content-type":        "Content-Type",
+	"response-content-language":    "Content-Language",
+	"response-expires":             "Expires",
+	"response-cache-control":       "Cache-Control",
+	"response-content-disposition": "Content-Disposition",
+	"response-content-encoding":    "Content-Encoding",
+}
+
+// getS3Object serves GET and HEAD of an object, with its ETag as served under /files.
+func (s Server) getS3Object(w http.ResponseWriter, r *http.Request, rel string, key string) error {
+	if s.Tiering != nil && s.serveCold(w, r, rel) {
+		return nil
+	}
+	if err := s.checkQuarantine(rel); err != nil {
+		return err
+	}
+	noSuchKey := newS3APIError(http.StatusNotFound, "NoSuchKey", "the specified key does not exist")
+	f, err := os.Open(filepath.Join(s.DocumentRoot, filepath.FromSlash(rel)))
+	if os.IsNotExist(err) {
+		return noSuchKey
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		if !strings.HasSuffix(key, "/") {
+			return noSuchKey
+		}
+		w.Header().Set("ETag", s3EmptyETag)
+		w.Header().Set("Content-Type", "application/x-directory")
+		http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(nil))
+		return nil
+	}
+	for param, header := range s3ResponseHeaders {
+		if v := r.URL.Query().Get(param); v != "" {
+			w.Header().Set(header, v)
+		}
+	}
+	if etag := s.etagOf(rel, info); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	coalesceRanges(r, info.Size())
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	http.ServeContent(rec, r, path.Base(rel), info.ModTime(), f)
+	s.countGet(r, rel, rec.status)
+	return nil
+}
+
+// receiveS3Object stores the payload of r into a temporary file, checked against its Content-MD5 if any,
+// and returns it with its MD5 digest.
+func (s Server) receiveS3Object(r *http.Request, sig *s3Signature) (received, []byte, error) {
+	size := r.ContentLength
+	if decoded, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64); err == nil {
+		size = decoded
+	}
+	if size > s.MaxUploadSize {
+		return received{}, nil, errFileTooLarge
+	}
+	body, err := s3Payload(r, sig)
+	if err != nil {
+		return received{}, nil, err
+	}
+	h := md5.New()
+	rcv, err := s.spool(r.Context(), io.TeeReader(body, h), received{})
+	if err != nil {
+		return received{}, nil, err
+	}
+	sum := h.Sum(nil)
+	if want := r.Header.Get("Content-MD5"); want != "" && want != base64.StdEncoding.EncodeToString(sum) {
+		os.Remove(rcv.TempName)
+		return received{}, nil, newS3APIError(http.StatusBadRequest, "BadDigest", "the content does not match Content-MD5")
+	}
+	return rcv, sum, nil
+}
+
+// storeS3Object moves the received file into place as rel, like an upload. The file is removed on failure.
+func (s Server) storeS3Object(r *http.Request, rel string, rcv received) error {
+	if err := s.checkReceived(rel, &rcv); err != nil {
+		os.Remove(rcv.TempName)
+		return err
+	}
+	if err := s.commitFile(r.Context(), rcv.TempName, path.Join(s.DocumentRoot, rel)); err != nil {
+		return err
+	}
+	tagUpload(r.Context(), auditLog()).WithFields(logrus.Fields{
+		"path":   "/files" + rel,
+		"size":   rcv.Size,
+		"digest": s.Digests.label(rcv.Digest),
+	}).Info("file uploaded by S3 API")
+	s.recordDigest(rel, rcv.Digest)
+	s.startRetention(rel)
+	s.announce(s.newUploadEvent(r, rel, rcv.Size, rcv.Digest))
+	s.pinIPFS(r.Context(), rel)
+	return nil
+}
+
+// putS3Object serves PutObject. A key ending with a slash creates a directory.
+func (s Server) putS3Object(w http.ResponseWriter, r *http.Request, sig *s3Signature, rel string, key string) error {
+	if strings.HasSuffix(key, "/") {
+		if err := os.MkdirAll(filepath.Join(s.DocumentRoot, filepath.FromSlash(rel)), 0777); err != nil {
+			return err
+		}
+		w.Header().Set("ETag", s3EmptyETag)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	if err := s.checkOverwrite(rel); err != nil {
+		return err
+	}
+	rcv, sum, err := s.receiveS3Object(r, sig)
+	if err != nil {
+		return err
+	}
+	if err := s.storeS3Object(r, rel, rcv); err != nil {
+		return err
+	}
+	w.Header().Set("ETag", "\""+hex.EncodeToString(sum)+"\"")
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// copyS3Object serves CopyObject, from the object named by the X-Amz-Copy-Source header, as /(bucket)/(key).
+func (s Server) copyS3Object(w http.ResponseWriter, r *http.Request, rel string, source string) error {
+	source, err := url.PathUnescape(strings.SplitN(source, "?", 2)[0])
+	if err != nil {
+		return newS3APIError(http.StatusBadRequest, "InvalidArgument", "invalid x-amz-copy-source")
+	}
+	bucket, key := splitS3Path("/" + strings.TrimPrefix(source, "/"))
+	if _, err := s.bucketDir(bucket); err != nil {
+		return err
+	}
+	src, err := s.objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+	if err := s.checkQuarantine(src); err != nil {
+		return err
+	}
+	if err := s.checkOverwrite(rel); err != nil {
+		return err
+	}
+	f, err := os.Open(filepath.Join(s.DocumentRoot, filepath.FromSlash(src)))
+	if err != nil {
+		return newS3APIError(http.StatusNotFound, "NoSuchKey", "the source key does not exist")
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || !info.Mode().IsRegular() {
+		return newS3APIError(http.StatusNotFound, "NoSuchKey", "the source key does not exist")
+	}
+	h := md5.New()
+	rcv, err := s.spool(r.Context(), io.TeeReader(f, h), received{})
+	if err != nil {
+		return err
+	}
+	if err := s.storeS3Object(r, rel, rcv); err != nil {
+		return err
+	}
+	writeS3XML(w, http.StatusOK, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		ETag         string
+		LastModified string
+	}{ETag: "\"" + hex.EncodeToString(h.Sum(nil)) + "\"", LastModified: time.Now().UTC().Format(time.RFC3339)})
+	return nil
+}
+
+// removeS3Object deletes the object rel, if it exists, like a deletion through the other APIs.
+func (s Server) removeS3Object(r *http.Request, rel string) error {
+	if err := s.checkOverwrite(rel); err != nil {
+		return err
+	}
+	name := path.Join(s.DocumentRoot, rel)
+	if info, err := os.Stat(name); err != nil || !info.Mode().IsRegular() {
+		// deleting a missing object succeeds, as on S3.
+		return nil
+	}
+	s.publishLock.Lock()
+	err := os.Remove(name)
+	if err == nil {
+		s.removeEmptyDirs(path.Dir(rel))
+	}
+	s.publishLock.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	s.forget(rel)
+	auditLog().WithFields(logrus.Fields{"path": "/files" + rel, "remote": clientIP(r)}).Info("file deleted by S3 API")
+	s.emit(fileEvent{Type: eventDelete, Path: "/files" + rel, Actor: clientIP(r)})
+	return nil
+}
+
+// deleteS3Objects serves DeleteObjects, POST /(bucket)?delete.
+func (s Server) deleteS3Objects(w http.ResponseWriter, r *http.Request, bucket string) error {
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxS3RequestSize+1))
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Quiet   bool
+		Objects []struct {
+			Key string
+		} `xml:"Object"`
+	}
+	if len(b) > maxS3RequestSize || xml.Unmarshal(b, &req) != nil || len(req.Objects) > maxS3Keys {
+		return newS3APIError(http.StatusBadRequest, "MalformedXML", "invalid Delete document")
+	}
+	if want := r.Header.Get("Content-MD5"); want != "" {
+		if sum := md5.Sum(b); want != base64.StdEncoding.EncodeToString(sum[:]) {
+			return newS3APIError(http.StatusBadRequest, "BadDigest", "the content does not match Content-MD5")
+		}
+	}
+	type deleteError struct {
+		Key, Code, Message string
+	}
+	var result struct {
+		XMLName xml.Name `xml:"DeleteResult"`
+		Deleted []struct{ Key string }
+		Errors  []deleteError `xml:"Error"`
+	}
+	for _, o := range req.Objects {
+		rel, err := s.objectPath(bucket, o.Key)
+		if err == nil {
+			err = s.removeS3Object(r, rel)
+		}
+		if err != nil {
+			var e *s3APIError
+			if !errors.As(err, &e) {
+				e = &s3APIError{Code: "AccessDenied", Message: err.Error()}
+				if statusOf(err) >= http.StatusInternalServerError {
+					e.Code = "InternalError"
+				}
+			}
+			result.Errors = append(result.Errors, deleteError{o.Key, e.Code, e.Message})
+		} else if !req.Quiet {
+			result.Deleted = append(result.Deleted, struct{ Key string }{o.Key})
+		}
+	}
+	writeS3XML(w, http.StatusOK, result)
+	return nil
+}
+
+// createS3Upload serves CreateMultipartUpload. The parts are stored in a staging directory in the document root
+// until the upload is completed.
+func (s Server) createS3Upload(w http.ResponseWriter, r *http.Request, bucket string, key string, rel string) error {
+	if err := s.checkExtension(rel); err != nil {
+		return err
+	}
+	if err := s.checkOverwrite(rel); err != nil {
+		return err
+	}
+	s.S3.expireUploads()
+	dir, err := ioutil.TempDir(s.DocumentRoot, stagingPrefix+"s3_")
+	if err != nil {
+		return err
+	}
+	id := strings.TrimPrefix(filepath.Base(dir), stagingPrefix)
+	s.S3.mu.Lock()
+	s.S3.uploads[id] = &s3Upload{rel: rel, dir: dir, parts: map[int]s3Part{}, updated: time.Now()}
+	s.S3.mu.Unlock()
+	writeS3XML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Bucket   string
+		Key      string
+		UploadID string `xml:"UploadId"`
+	}{Bucket: bucket, Key: key, UploadID: id})
+	return nil
+}
+
+// expireUploads drops the multipart uploads abandoned for s3UploadTTL.
+func (api *s3API) expireUploads() {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	for id, u := range api.uploads {
+		if time.Since(u.updated) > s3UploadTTL {
+			os.RemoveAll(u.dir)
+			delete(api.uploads, id)
+		}
+	}
+}
+
+func (api *s3API) upload(rel string, id string) (*s3Upload, error) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	u, ok := api.uploads[id]
+	if !ok || u.rel != rel {
+		return nil, newS3APIError(http.StatusNotFound, "NoSuchUpload", "the specified upload does not exist")
+	}
+	return u, nil
+}
+
+// putS3Part serves UploadPart.
+func (s Server) putS3Part(w http.ResponseWriter, r *http.Request, sig *s3Signature, rel string, id string) error {
+	n, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || n < 1 || n > 10000 {
+		return newS3APIError(http.StatusBadRequest, "InvalidArgument", "partNumber must be between 1 and 10000")
+	}
+	u, err := s.S3.upload(rel, id)
+	if err != nil {
+		return err
+	}
+	rcv, sum, err := s.receiveS3Object(r, sig)
+	if err != nil {
+		return err
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if err := moveFile(r.Context(), rcv.TempName, filepath.Join(u.dir, strconv.Itoa(n))); err != nil {
+		os.Remove(rcv.TempName)
+		return err
+	}
+	u.parts[n] = s3Part{md5: sum, size: rcv.Size}
+	u.updated = time.Now()
+	w.Header().Set("ETag", "\""+hex.EncodeToString(sum)+"\"")
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// completeS3Upload serves CompleteMultipartUpload, which stores the parts listed, in order, as the object.
+func (s Server) completeS3Upload(w http.ResponseWriter, r *http.Request, bucket string, key string, rel string, id string) error {
+	u, err := s.S3.upload(rel, id)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxS3RequestSize+1))
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if len(b) > maxS3RequestSize || xml.Unmarshal(b, &req) != nil || len(req.Parts) == 0 {
+		return newS3APIError(http.StatusBadRequest, "MalformedXML", "invalid CompleteMultipartUpload document")
+	}
+	if err := s.checkOverwrite(rel); err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	var readers []io.Reader
+	var sums []byte
+	var size int64
+	for i, p := range req.Parts {
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			return newS3APIError(http.StatusBadRequest, "InvalidPartOrder", "the parts must be listed in ascending order")
+		}
+		part, ok := u.parts[p.PartNumber]
+		if !ok || strings.Trim(p.ETag, "\"") != hex.EncodeToString(part.md5) {
+			return newS3APIError(http.StatusBadRequest, "InvalidPart", "part %d was not uploaded, or has another ETag", p.PartNumber)
+		}
+		if size += part.size; size > s.MaxUploadSize {
+			return errFileTooLarge
+		}
+		f, err := os.Open(filepath.Join(u.dir, strconv.Itoa(p.PartNumber)))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		readers = append(readers, f)
+		sums = append(sums, part.md5...)
+	}
+	rcv, err := s.spool(r.Context(), io.MultiReader(readers...), received{})
+	if err != nil {
+		return err
+	}
+	if err := s.storeS3Object(r, rel, rcv); err != nil {
+		return err
+	}
+	s.S3.mu.Lock()
+	delete(s.S3.uploads, id)
+	s.S3.mu.Unlock()
+	os.RemoveAll(u.dir)
+	// the ETag of a multipart object is the MD5 digest of the digests of its parts, with their number.
+	sum := md5.Sum(sums)
+	writeS3XML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Location string
+		Bucket   string
+		Key      string
+		ETag     string
+	}{
+		Location: requestBaseURL(r) + (&url.URL{Path: "/" + bucket + "/" + key}).String(),
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     fmt.Sprintf("\"%x-%d\"", sum, len(req.Parts)),
+	})
+	return nil
+}
+
+// abortS3Upload serves AbortMultipartUpload.
+func (s Server) abortS3Upload(w http.ResponseWriter, rel string, id string) error {
+	u, err := s.S3.upload(rel, id)
+	if err != nil {
+		return err
+	}
+	s.S3.mu.Lock()
+	delete(s.S3.uploads, id)
+	s.S3.mu.Unlock()
+	u.mu.Lock()
+	os.RemoveAll(u.dir)
+	u.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// s3MaxSkew is how far the date of a signed request may be from the clock of the server.
+	s3MaxSkew = 15 * time.Minute
+	// s3MaxPresignedExpiry is the longest validity of a presigned URL, as on S3.
+	s3MaxPresignedExpiry = 7 * 24 * time.Hour
+	// s3DateFormat is the format of the dates of signed requests.
+	s3DateFormat = "20060102T150405Z"
+)
+
+var reS3Credential = regexp.MustCompile(`^([^/]+)/(\d{8})/([^/]+)/([^/]+)/aws4_request$`)
+
+// s3Checksums are the hashes of the x-amz-checksum-(algorithm) headers and trailers, by algorithm.
+var s3Checksums = map[string]func() hash.Hash{
+	"crc32":     func() hash.Hash { return crc32.NewIEEE() },
+	"crc32c":    func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+	"crc64nvme": func() hash.Hash { return crc64.New(crc64.MakeTable(0x9a6c9329ac4bc9b5)) },
+	"sha1":      sha1.New,
+	"sha256":    sha256.New,
+}
+
+// s3Signature is the verified signature of a request to the S3 API, which the chunks of a streamed payload
+// are signed after.
+type s3Signature struct {
+	key       []byte
+	amzDate   string
+	scope     string
+	signature string
+	// payload is the digest of the payload the request was signed with, or how it is sent.
+	payload string
+}
+
+// isS3Request reports whether r is signed with Signature Version 4, in its headers or as a presigned URL.
+func isS3Request(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") || r.URL.Query().Get("X-Amz-Algorithm") == "AWS4-HMAC-SHA256"
+}
+
+// verifyS3Signature checks that r is signed with the access key of the S3 API and the token as secret key, at a date
+// valid at now.
+func (s Server) verifyS3Signature(r *http.Request, now time.Time) (*s3Signature, error) {
+	q := r.URL.Query()
+	var credential, signedHeaders string
+	sig := &s3Signature{}
+	validity := s3MaxSkew
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		fields := map[string]string{}
+		for _, f := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+			if kv := strings.SplitN(strings.TrimSpace(f), "=", 2); len(kv) == 2 {
+				fields[kv[0]] = kv[1]
+			}
+		}
+		credential, signedHeaders, sig.signature = fields["Credential"], fields["SignedHeaders"], fields["Signature"]
+		sig.amzDate = r.Header.Get("X-Amz-Date")
+		if sig.payload = r.Header.Get("X-Amz-Content-Sha256"); sig.payload == "" {
+			return nil, newS3APIError(http.StatusBadRequest, "InvalidRequest", "missing required header x-amz-content-sha256")
+		}
+	} else {
+		credential, signedHeaders, sig.signature = q.Get("X-Amz-Credential"), q.Get("X-Amz-SignedHeaders"), q.Get("X-Amz-Signature")
+		sig.amzDate = q.Get("X-Amz-Date")
+		sig.payload = "UNSIGNED-PAYLOAD"
+		seconds, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+		if err != nil || seconds < 0 || time.Duration(seconds)*time.Second > s3MaxPresignedExpiry {
+			return nil, newS3APIError(http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Expires must be a number of seconds up to a week")
+		}
+		validity = time.Duration(seconds) * time.Second
+	}
+	m := reS3Credential.FindStringSubmatch(credential)
+	if m == nil || signedHeaders == "" || sig.signature == "" {
+		return nil, newS3APIError(http.StatusBadRequest, "AuthorizationHeaderMalformed", "the authorization is malformed")
+	}
+	if m[1] != s.S3.AccessKey {
+		recordAuthFailure(r, errTokenMismatch)
+		return nil, newS3APIError(http.StatusForbidden, "InvalidAccessKeyId", "the access key ID %q does not exist", m[1])
+	}
+	date, err := time.Parse(s3DateFormat, sig.amzDate)
+	if err != nil || date.Format("20060102") != m[2] {
+		return nil, newS3APIError(http.StatusBadRequest, "AuthorizationHeaderMalformed", "invalid X-Amz-Date %q", sig.amzDate)
+	}
+	if now.Before(date.Add(-s3MaxSkew)) || now.After(date.Add(validity)) {
+		if r.Header.Get("Authorization") != "" {
+			return nil, newS3APIError(http.StatusForbidden, "RequestTimeTooSkewed", "the difference between the request time and the server's time is too large")
+		}
+		return nil, newS3APIError(http.StatusForbidden, "AccessDenied", "request has expired")
+	}
+
+	var headers strings.Builder
+	for _, name := range strings.Split(signedHeaders, ";") {
+		var value string
+		switch name {
+		case "host":
+			value = r.Host
+		case "content-length":
+			value = strconv.FormatInt(r.ContentLength, 10)
+		default:
+			value = strings.Join(strings.Fields(strings.Join(r.Header[http.CanonicalHeaderKey(name)], ",")), " ")
+		}
+		headers.WriteString(name + ":" + value + "\n")
+	}
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		canonicalPath(r.URL),
+		canonicalQuery(q),
+		headers.String(),
+		signedHeaders,
+		sig.payload,
+	}, "\n")
+	sig.scope = strings.TrimPrefix(credential, m[1]+"/")
+	sig.key = signingKey(s.SecureToken.get(), m[2], m[3], m[4])
+	want := hex.EncodeToString(hmacSHA256(sig.key, stringToSign(sig.amzDate, sig.scope, canonicalRequest)))
+	if !hmac.Equal([]byte(want), []byte(sig.signature)) {
+		recordAuthFailure(r, errTokenMismatch)
+		return nil, newS3APIError(http.StatusForbidden, "SignatureDoesNotMatch", "the request signature does not match the one calculated with the token")
+	}
+	return sig, nil
+}
+
+// s3Payload returns the content of the body of r, decoded if sent in aws-chunked encoding. Reading it fails at its end
+// if it does not match the digest, chunk signatures or checksum it was sent with.
+func s3Payload(r *http.Request, sig *s3Signature) (io.Reader, error) {
+	var body io.Reader = r.Body
+	switch p := sig.payload; {
+	case p == "UNSIGNED-PAYLOAD":
+	case len(p) == 64:
+		body = &verifyingReader{r: body, hash: sha256.New(), want: p, encode: hex.EncodeToString,
+			err: newS3APIError(http.StatusBadRequest, "XAmzContentSHA256Mismatch", "the content does not match x-amz-content-sha256")}
+	case p == "STREAMING-AWS4-HMAC-SHA256-PAYLOAD", p == "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER", p == "STREAMING-UNSIGNED-PAYLOAD-TRAILER":
+		c := &awsChunkedReader{r: bufio.NewReader(body), prev: sig.signature}
+		if strings.HasPrefix(p, "STREAMING-AWS4-HMAC-SHA256-PAYLOAD") {
+			c.sig = sig
+		}
+		if strings.HasSuffix(p, "-TRAILER") {
+			c.trailer = strings.ToLower(r.Header.Get("X-Amz-Trailer"))
+			newHash, ok := s3Checksums[strings.TrimPrefix(c.trailer, "x-amz-checksum-")]
+			if !ok {
+				return nil, newS3APIError(http.StatusBadRequest, "InvalidRequest", "unsupported trailer %q", c.trailer)
+			}
+			c.checksum = newHash()
+		}
+		body = c
+	default:
+		return nil, newS3APIError(http.StatusBadRequest, "InvalidArgument", "unsupported x-amz-content-sha256 %q", p)
+	}
+	for algorithm, newHash := range s3Checksums {
+		if want := r.Header.Get("X-Amz-Checksum-" + algorithm); want != "" {
+			body = &verifyingReader{r: body, hash: newHash(), want: want, encode: base64.StdEncoding.EncodeToString,
+				err: newS3APIError(http.StatusBadRequest, "BadDigest", "the content does not match x-amz-checksum-%s", algorithm)}
+		}
+	}
+	return body, nil
+}
+
+// verifyingReader reads r, and fails with err at its end if its content does not have the digest want.
+type verifyingReader struct {
+	r      io.Reader
+	hash   hash.Hash
+	want   string
+	encode func([]byte) string
+	err    error
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF && v.encode(v.hash.Sum(nil)) != v.want {
+		return n, v.err
+	}
+	return n, err
+}
+
+// awsChunkedReader decodes the aws-chunked encoding of streamed payloads: chunks prefixed with their size in hex,
+// and the signature chaining them to the request if signed, followed by a trailing checksum if any.
+type awsChunkedReader struct {
+	r *bufio.Reader
+	// sig is the signature of the request, nil if chunks are unsigned.
+	sig *s3Signature
+	// trailer is the name of the trailing checksum header, if any, and checksum hashes the content for it.
+	trailer  string
+	checksum hash.Hash
+	// prev is the signature the next chunk is chained to.
+	prev      string
+	chunkSig  string
+	chunkHash hash.Hash
+	remaining int64
+	inChunk   bool
+	err       error
+}
+
+func errBadChunk(format string, args ...interface{}) error {
+	return newS3APIError(http.StatusBadRequest, "IncompleteBody", "invalid aws-chunked payload: "+format, args...)
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.remaining == 0 {
+		if c.err = c.nextChunk(); c.err != nil {
+			return 0, c.err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.remaining -= int64(n)
+	c.chunkHash.Write(p[:n])
+	if c.checksum != nil {
+		c.checksum.Write(p[:n])
+	}
+	if err == io.EOF {
+		err = errBadChunk("truncated")
+	}
+	c.err = err
+	return n, err
+}
+
+func (c *awsChunkedReader) readLine() (string, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err == io.EOF && len(line) == 0 {
+		return "", io.EOF
+	} else if err != nil && err != io.EOF {
+		return "", errBadChunk("%v", err)
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// nextChunk reads the header of the next chunk, after verifying the current one. It returns io.EOF after the last.
+func (c *awsChunkedReader) nextChunk() error {
+	if c.inChunk {
+		// the data of a chunk is followed by CRLF.
+		if line, err := c.readLine(); err != nil || line != "" {
+			return errBadChunk("chunk longer than its size")
+		}
+		if err := c.verifyChunk(); err != nil {
+			return err
+		}
+	}
+	line, err := c.readLine()
+	if err != nil {
+		return errBadChunk("truncated")
+	}
+	sizeHex, ext := line, ""
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		sizeHex, ext = line[:i], line[i+1:]
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeHex), 16, 64)
+	if err != nil || size < 0 {
+		return errBadChunk("bad chunk size %q", sizeHex)
+	}
+	if c.sig != nil {
+		if !strings.HasPrefix(ext, "chunk-signature=") {
+			return errBadChunk("unsigned chunk")
+		}
+		c.chunkSig = strings.TrimPrefix(ext, "chunk-signature=")
+	}
+	c.chunkHash = sha256.New()
+	c.remaining = size
+	c.inChunk = true
+	if size > 0 {
+		return nil
+	}
+	// the last chunk is empty, and followed by the trailer if any.
+	if err := c.verifyChunk(); err != nil {
+		return err
+	}
+	if err := c.readTrailer(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// verifyChunk checks the signature of the chunk just read, chained to the previous one.
+func (c *awsChunkedReader) verifyChunk() error {
+	c.inChunk = false
+	if c.sig == nil {
+		return nil
+	}
+	sts := "AWS4-HMAC-SHA256-PAYLOAD\n" + c.sig.amzDate + "\n" + c.sig.scope + "\n" + c.prev + "\n" + emptySHA256 + "\n" + hex.EncodeToString(c.chunkHash.Sum(nil))
+	if !hmac.Equal([]byte(hex.EncodeToString(hmacSHA256(c.sig.key, sts))), []byte(c.chunkSig)) {
+		return newS3APIError(http.StatusForbidden, "SignatureDoesNotMatch", "the chunk signature does not match")
+	}
+	c.prev = c.chunkSig
+	return nil
+}
+
+// readTrailer reads the trailing headers after the last chunk, and checks the trailing checksum and its signature.
+func (c *awsChunkedReader) readTrailer() error {
+	var trailers bytes.Buffer
+	value, signature := "", ""
+	for {
+		line, err := c.readLine()
+		if err == io.EOF || line == "" {
+			break
+		} else if err != nil {
+			return err
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			return errBadChunk("bad trailer %q", line)
+		}
+		name := strings.ToLower(strings.TrimSpace(kv[0]))
+		switch name {
+		case "x-amz-trailer-signature":
+			signature = strings.TrimSpace(kv[1])
+		case c.trailer:
+			value = strings.TrimSpace(kv[1])
+			fallthrough
+		default:
+			trailers.WriteString(name + ":" + strings.TrimSpace(kv[1]) + "\n")
+		}
+	}
+	if c.trailer == "" {
+		return nil
+	}
+	if c.sig != nil {
+		sum := sha256.Sum256(trailers.Bytes())
+		sts := "AWS4-HMAC-SHA256-TRAILER\n" + c.sig.amzDate + "\n" + c.sig.scope + "\n" + c.prev + "\n" + hex.EncodeToString(sum[:])
+		if !hmac.Equal([]byte(hex.EncodeToString(hmacSHA256(c.sig.key, sts))), []byte(signature)) {
+			return newS3APIError(http.StatusForbidden, "SignatureDoesNotMatch", "the trailer signature does not match")
+		}
+	}
+	if value != base64.StdEncoding.EncodeToString(c.checksum.Sum(nil)) {
+		return newS3APIError(http.StatusBadRequest, "BadDigest", "the content does not match %s", c.trailer)
+	}
+	return nil
+}
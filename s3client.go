@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// s3Client is a minimal client of the S3 API, enough to store, fetch, list and delete objects in a bucket.
+// Credentials are taken from the environment variables AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+type s3Client struct {
+	bucket string
+	// endpoint is the URL of an S3-compatible service, e.g. MinIO, addressed path-style; it is nil for AWS.
+	endpoint *url.URL
+	// storageClass is the storage class of the objects stored, like STANDARD_IA, or empty for the default one.
+	storageClass string
+	signer       sigV4
+	client       *http.Client
+}
+
+func newS3Client(bucket string, region string, endpoint string) (*s3Client, error) {
+	if region == "" {
+		region = os.Getenv("AWS_REGION")
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	c := &s3Client{
+		bucket: bucket,
+		signer: sigV4{
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+			Region:       region,
+			Service:      "s3",
+		},
+		client: &http.Client{},
+	}
+	if c.signer.AccessKey == "" || c.signer.SecretKey == "" {
+		return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to access S3")
+	}
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+		}
+		c.endpoint = u
+	}
+	return c, nil
+}
+
+func (c *s3Client) objectURL(key string) *url.URL {
+	if c.endpoint != nil {
+		return &url.URL{Scheme: c.endpoint.Scheme, Host: c.endpoint.Host, Path: "/" + c.bucket + "/" + key}
+	}
+	return &url.URL{Scheme: "https", Host: c.bucket + ".s3." + c.signer.Region + ".amazonaws.com", Path: "/" + key}
+}
+
+// s3Error is the error document returned by S3.
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// do sends a signed request for key. The response is returned only if it succeeded.
+func (c *s3Client) do(ctx context.Context, method string, key string, query url.Values, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	u := c.objectURL(key)
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = size
+	if method == http.MethodPut && c.storageClass != "" {
+		req.Header.Set("X-Amz-Storage-Class", c.storageClass)
+	}
+	if payloadHash == "" {
+		payloadHash = emptySHA256
+	}
+	c.signer.sign(req, payloadHash, time.Now())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		var e s3Error
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if xml.Unmarshal(b, &e) == nil && e.Code != "" {
+			return nil, fmt.Errorf("S3 %s %s: %s: %s", method, key, e.Code, e.Message)
+		}
+		return nil, fmt.Errorf("S3 %s %s: %s", method, key, resp.Status)
+	}
+	return resp, nil
+}
+
+// put stores the content of body, whose size and hex SHA-256 digest are given, as key.
+// If the digest is not known, the payload is sent unsigned.
+func (c *s3Client) put(ctx context.Context, key string, body io.Reader, size int64, sum string) error {
+	if sum == "" {
+		sum = "UNSIGNED-PAYLOAD"
+	}
+	resp, err := c.do(ctx, http.MethodPut, key, nil, body, size, sum)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *s3Client) get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := c.do(ctx, http.MethodGet, key, nil, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *s3Client) remove(ctx context.Context, key string) error {
+	resp, err := c.do(ctx, http.MethodDelete, key, nil, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// list returns the keys starting with prefix.
+func (c *s3Client) list(ctx context.Context, prefix string) ([]string, error) {
+	var keys []string
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := c.do(ctx, http.MethodGet, "", query, nil, 0, "")
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range result.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// parseS3URL splits a URL like s3://bucket/prefix into the bucket and the prefix, which ends with a slash unless empty.
+func parseS3URL(u *url.URL) (string, string) {
+	prefix := strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return u.Host, prefix
+}
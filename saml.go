@@ -0,0 +1,557 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SAML 2.0 namespaces, bindings and values.
+const (
+	samlProtocolNS      = "urn:oasis:names:tc:SAML:2.0:protocol"
+	samlAssertionNS     = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlRedirectBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	samlPostBinding     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+	samlStatusSuccess   = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	samlBearer          = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	samlNameIDFormat    = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+)
+
+const (
+	// samlLoginTTL is how long a user has to sign in at the identity provider.
+	samlLoginTTL = 10 * time.Minute
+	// samlClockSkew is tolerated between the clocks of the identity provider and the server.
+	samlClockSkew = time.Minute
+	// maxSAMLResponse is the size of the largest form carrying a SAML response.
+	maxSAMLResponse = 1 << 20
+	// samlLoginCookie binds a sign-in in progress to the browser which started it, so that a response obtained by
+	// someone else cannot sign the browser in as them.
+	samlLoginCookie = "sus_saml_login"
+	// maxSAMLLogins is the number of sign-ins in progress, beyond which new ones are refused.
+	maxSAMLLogins = 10000
+)
+
+var errSAMLRejected = errors.New("SAML response rejected")
+
+// samlIdPMetadata is the part of the metadata of an identity provider the server uses.
+type samlIdPMetadata struct {
+	EntityID      string `xml:"entityID,attr"`
+	KeyDescriptor []struct {
+		Use          string   `xml:"use,attr"`
+		Certificates []string `xml:"KeyInfo>X509Data>X509Certificate"`
+	} `xml:"IDPSSODescriptor>KeyDescriptor"`
+	SingleSignOnService []struct {
+		Binding  string `xml:"Binding,attr"`
+		Location string `xml:"Location,attr"`
+	} `xml:"IDPSSODescriptor>SingleSignOnService"`
+}
+
+// samlSPMetadata is the metadata of the server as a service provider, served at /saml/metadata.
+type samlSPMetadata struct {
+	XMLName         xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityID        string   `xml:"entityID,attr"`
+	SPSSODescriptor struct {
+		AuthnRequestsSigned        bool   `xml:"AuthnRequestsSigned,attr"`
+		WantAssertionsSigned       bool   `xml:"WantAssertionsSigned,attr"`
+		ProtocolSupportEnumeration string `xml:"protocolSupportEnumeration,attr"`
+		NameIDFormat               string `xml:"NameIDFormat"`
+		AssertionConsumerService   struct {
+			Binding   string `xml:"Binding,attr"`
+			Location  string `xml:"Location,attr"`
+			Index     int    `xml:"index,attr"`
+			IsDefault bool   `xml:"isDefault,attr"`
+		} `xml:"AssertionConsumerService"`
+	} `xml:"SPSSODescriptor"`
+}
+
+// samlAuthnRequest asks the identity provider to sign the user in.
+type samlAuthnRequest struct {
+	XMLName                     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	ID                          string   `xml:"ID,attr"`
+	Version                     string   `xml:"Version,attr"`
+	IssueInstant                string   `xml:"IssueInstant,attr"`
+	Destination                 string   `xml:"Destination,attr"`
+	AssertionConsumerServiceURL string   `xml:"AssertionConsumerServiceURL,attr"`
+	ProtocolBinding             string   `xml:"ProtocolBinding,attr"`
+	Issuer                      struct {
+		XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+		Value   string   `xml:",chardata"`
+	}
+	NameIDPolicy struct {
+		AllowCreate bool `xml:"AllowCreate,attr"`
+	} `xml:"NameIDPolicy"`
+}
+
+// samlLogin is a sign-in in progress, to be completed by a response to its request.
+type samlLogin struct {
+	returnTo string
+	expires  time.Time
+	// browser is the digest of the value of samlLoginCookie set in the browser which started the sign-in.
+	browser string
+}
+
+// webSession is a user signed in to the web UI, identified by the session cookie.
+type webSession struct {
+	user    string
+	groups  []string
+	expires time.Time
+}
+
+// samlProvider signs users in to the web UI with a SAML 2.0 identity provider, as a service provider using
+// the HTTP-Redirect binding for requests and the HTTP-POST binding for responses, whose assertions must be signed.
+// Signed-in users are kept in memory, so they sign in again after a restart.
+type samlProvider struct {
+	idpEntityID string
+	ssoURL      string
+	certs       []*x509.Certificate
+	// BaseURL is the public URL of the server, which the identity provider sends responses to.
+	BaseURL  string
+	EntityID string
+	// UserAttribute names the attribute holding the user name, or is empty for the NameID of the subject;
+	// GroupsAttribute names the attribute holding the groups of the user.
+	UserAttribute   string
+	GroupsAttribute string
+	SessionTTL      time.Duration
+
+	mu     sync.Mutex
+	logins map[string]samlLogin
+	// sessions are by digest of the session cookie.
+	sessions map[string]webSession
+}
+
+// newSAMLProvider makes a service provider at baseURL for the identity provider described by the metadata file.
+func newSAMLProvider(metadataFile string, baseURL string) (*samlProvider, error) {
+	if u, err := url.Parse(baseURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, errors.New("-saml_url must be the public URL of the server, like https://files.example.org")
+	}
+	b, err := ioutil.ReadFile(metadataFile)
+	if err != nil {
+		return nil, err
+	}
+	var md samlIdPMetadata
+	if err := xml.Unmarshal(b, &md); err != nil {
+		return nil, fmt.Errorf("%s: %v", metadataFile, err)
+	}
+	p := &samlProvider{
+		idpEntityID:     md.EntityID,
+		BaseURL:         strings.TrimSuffix(baseURL, "/"),
+		GroupsAttribute: "groups",
+		SessionTTL:      8 * time.Hour,
+		logins:          map[string]samlLogin{},
+		sessions:        map[string]webSession{},
+	}
+	p.EntityID = p.BaseURL + "/saml/metadata"
+	for _, sso := range md.SingleSignOnService {
+		if sso.Binding == samlRedirectBinding {
+			p.ssoURL = sso.Location
+		}
+	}
+	for _, kd := range md.KeyDescriptor {
+		if kd.Use != "" && kd.Use != "signing" {
+			continue
+		}
+		for _, c := range kd.Certificates {
+			der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(c), ""))
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid certificate: %v", metadataFile, err)
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid certificate: %v", metadataFile, err)
+			}
+			p.certs = append(p.certs, cert)
+		}
+	}
+	switch {
+	case p.idpEntityID == "":
+		return nil, fmt.Errorf("%s: not the metadata of an identity provider (EntityDescriptor)", metadataFile)
+	case p.ssoURL == "":
+		return nil, fmt.Errorf("%s: no single sign-on service with the HTTP-Redirect binding", metadataFile)
+	case len(p.certs) == 0:
+		return nil, fmt.Errorf("%s: no signing certificate", metadataFile)
+	}
+	return p, nil
+}
+
+func (p *samlProvider) acsURL() string {
+	return p.BaseURL + "/saml/acs"
+}
+
+// metadata returns the metadata of the server as a service provider.
+func (p *samlProvider) metadata() ([]byte, error) {
+	var md samlSPMetadata
+	md.EntityID = p.EntityID
+	sp := &md.SPSSODescriptor
+	sp.WantAssertionsSigned = true
+	sp.ProtocolSupportEnumeration = samlProtocolNS
+	sp.NameIDFormat = samlNameIDFormat
+	sp.AssertionConsumerService.Binding = samlPostBinding
+	sp.AssertionConsumerService.Location = p.acsURL()
+	sp.AssertionConsumerService.IsDefault = true
+	b, err := xml.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
+
+// loginURL starts a sign-in, returning to returnTo once completed, and returns the URL of the identity provider
+// to send the user to, and the value of samlLoginCookie to set in the browser, which must send it back with the response.
+func (p *samlProvider) loginURL(returnTo string, now time.Time) (string, string, error) {
+	req := samlAuthnRequest{
+		ID:                          "_" + newNonce(),
+		Version:                     "2.0",
+		IssueInstant:                now.UTC().Format(time.RFC3339),
+		Destination:                 p.ssoURL,
+		AssertionConsumerServiceURL: p.acsURL(),
+		ProtocolBinding:             samlPostBinding,
+	}
+	req.Issuer.Value = p.EntityID
+	req.NameIDPolicy.AllowCreate = true
+	b, err := xml.Marshal(req)
+	if err != nil {
+		return "", "", err
+	}
+	var deflated bytes.Buffer
+	fw, _ := flate.NewWriter(&deflated, flate.DefaultCompression)
+	fw.Write(b)
+	fw.Close()
+	u, err := url.Parse(p.ssoURL)
+	if err != nil {
+		return "", "", err
+	}
+	q := u.Query()
+	q.Set("SAMLRequest", base64.StdEncoding.EncodeToString(deflated.Bytes()))
+	u.RawQuery = q.Encode()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, l := range p.logins {
+		if now.After(l.expires) {
+			delete(p.logins, id)
+		}
+	}
+	if len(p.logins) >= maxSAMLLogins {
+		return "", "", withStatus(http.StatusServiceUnavailable, errors.New("too many sign-ins in progress"))
+	}
+	browser := newNonce() + newNonce()
+	p.logins[req.ID] = samlLogin{returnTo: returnTo, expires: now.Add(samlLoginTTL), browser: tokenDigest(browser)}
+	return u.String(), browser, nil
+}
+
+// rejectSAML returns the reason a response is rejected for.
+func rejectSAML(format string, args ...interface{}) error {
+	return withStatus(http.StatusForbidden, fmt.Errorf("%w: %s", errSAMLRejected, fmt.Sprintf(format, args...)))
+}
+
+// samlTime checks that now is within the validity from notBefore to notOnOrAfter, either of which may be empty.
+func samlTime(notBefore string, notOnOrAfter string, now time.Time) error {
+	if notBefore != "" {
+		t, err := time.Parse(time.RFC3339Nano, notBefore)
+		if err != nil || now.Add(samlClockSkew).Before(t) {
+			return rejectSAML("not valid before %s", notBefore)
+		}
+	}
+	if notOnOrAfter != "" {
+		t, err := time.Parse(time.RFC3339Nano, notOnOrAfter)
+		if err != nil || !now.Add(-samlClockSkew).Before(t) {
+			return rejectSAML("expired on %s", notOnOrAfter)
+		}
+	}
+	return nil
+}
+
+// attributeValues returns the values of the attribute name in the assertion.
+func attributeValues(assertion *xmlNode, name string) []string {
+	var values []string
+	for _, st := range assertion.elements(samlAssertionNS, "AttributeStatement") {
+		for _, a := range st.elements(samlAssertionNS, "Attribute") {
+			if a.attr("Name") != name && a.attr("FriendlyName") != name {
+				continue
+			}
+			for _, v := range a.elements(samlAssertionNS, "AttributeValue") {
+				if s := strings.TrimSpace(v.content()); s != "" {
+					values = append(values, s)
+				}
+			}
+		}
+	}
+	return values
+}
+
+// consume checks a response of the identity provider, given as the SAMLResponse form field, sent by the browser
+// with the value browser of samlLoginCookie, and returns the user it signs in, with its groups, and where to
+// return to. Each request can only be responded to once, and only in the browser which sent it.
+func (p *samlProvider) consume(encoded string, browser string, now time.Time) (webSession, string, error) {
+	b, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+	if err != nil {
+		return webSession{}, "", rejectSAML("invalid encoding")
+	}
+	resp, err := parseXMLDocument(b)
+	if err != nil {
+		return webSession{}, "", rejectSAML("%v", err)
+	}
+	if !resp.is(samlProtocolNS, "Response") {
+		return webSession{}, "", rejectSAML("not a response")
+	}
+	if dest := resp.attr("Destination"); dest != "" && dest != p.acsURL() {
+		return webSession{}, "", rejectSAML("sent to %q", dest)
+	}
+	inResponseTo := resp.attr("InResponseTo")
+	p.mu.Lock()
+	login, ok := p.logins[inResponseTo]
+	delete(p.logins, inResponseTo)
+	p.mu.Unlock()
+	if !ok || now.After(login.expires) {
+		return webSession{}, "", rejectSAML("not a response to a sign-in in progress")
+	}
+	if subtle.ConstantTimeCompare([]byte(tokenDigest(browser)), []byte(login.browser)) != 1 {
+		return webSession{}, "", rejectSAML("not a response to a sign-in started by this browser")
+	}
+	var status string
+	if s := resp.element(samlProtocolNS, "Status"); s != nil {
+		if code := s.element(samlProtocolNS, "StatusCode"); code != nil {
+			status = code.attr("Value")
+		}
+	}
+	if status != samlStatusSuccess {
+		return webSession{}, "", rejectSAML("the identity provider responded %q", status)
+	}
+	if len(resp.elements(samlAssertionNS, "EncryptedAssertion")) > 0 {
+		return webSession{}, "", rejectSAML("encrypted assertions are not supported")
+	}
+	assertion := resp.element(samlAssertionNS, "Assertion")
+	if assertion == nil {
+		return webSession{}, "", rejectSAML("not exactly one assertion")
+	}
+	// the assertion is trusted if it is signed, or if the whole response is.
+	responseSigned := resp.element(xmldsigNS, "Signature") != nil
+	if responseSigned {
+		if err := verifyXMLSignature(resp, p.certs); err != nil {
+			return webSession{}, "", rejectSAML("%v", err)
+		}
+	}
+	if !responseSigned || assertion.element(xmldsigNS, "Signature") != nil {
+		if err := verifyXMLSignature(assertion, p.certs); err != nil {
+			return webSession{}, "", rejectSAML("%v", err)
+		}
+	}
+
+	if issuer := assertion.element(samlAssertionNS, "Issuer"); issuer == nil || strings.TrimSpace(issuer.content()) != p.idpEntityID {
+		return webSession{}, "", rejectSAML("not issued by %q", p.idpEntityID)
+	}
+	subject := assertion.element(samlAssertionNS, "Subject")
+	if subject == nil {
+		return webSession{}, "", rejectSAML("no subject")
+	}
+	confirmed := false
+	for _, sc := range subject.elements(samlAssertionNS, "SubjectConfirmation") {
+		data := sc.element(samlAssertionNS, "SubjectConfirmationData")
+		if sc.attr("Method") != samlBearer || data == nil {
+			continue
+		}
+		if data.attr("Recipient") == p.acsURL() && data.attr("InResponseTo") == inResponseTo &&
+			data.attr("NotOnOrAfter") != "" && samlTime(data.attr("NotBefore"), data.attr("NotOnOrAfter"), now) == nil {
+			confirmed = true
+		}
+	}
+	if !confirmed {
+		return webSession{}, "", rejectSAML("the subject is not confirmed for %s", p.acsURL())
+	}
+	if conditions := assertion.element(samlAssertionNS, "Conditions"); conditions != nil {
+		if err := samlTime(conditions.attr("NotBefore"), conditions.attr("NotOnOrAfter"), now); err != nil {
+			return webSession{}, "", err
+		}
+		for _, ar := range conditions.elements(samlAssertionNS, "AudienceRestriction") {
+			allowed := false
+			for _, a := range ar.elements(samlAssertionNS, "Audience") {
+				allowed = allowed || strings.TrimSpace(a.content()) == p.EntityID
+			}
+			if !allowed {
+				return webSession{}, "", rejectSAML("not meant for %q", p.EntityID)
+			}
+		}
+	}
+
+	session := webSession{groups: attributeValues(assertion, p.GroupsAttribute), expires: now.Add(p.SessionTTL)}
+	if p.UserAttribute == "" {
+		if nameID := subject.element(samlAssertionNS, "NameID"); nameID != nil {
+			session.user = strings.TrimSpace(nameID.content())
+		}
+	} else if values := attributeValues(assertion, p.UserAttribute); len(values) > 0 {
+		session.user = values[0]
+	}
+	if session.user == "" {
+		return webSession{}, "", rejectSAML("no user name")
+	}
+	return session, login.returnTo, nil
+}
+
+// session returns the user signed in with the session cookie of r, if any.
+func (p *samlProvider) session(r *http.Request) (webSession, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil || cookie.Value == "" {
+		return webSession{}, false
+	}
+	key := tokenDigest(cookie.Value)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	s, ok := p.sessions[key]
+	if ok && time.Now().After(s.expires) {
+		delete(p.sessions, key)
+		return webSession{}, false
+	}
+	return s, ok
+}
+
+// startSession signs the user of s in, setting the session cookie.
+func (p *samlProvider) startSession(w http.ResponseWriter, r *http.Request, s webSession) {
+	token := newNonce() + newNonce()
+	p.mu.Lock()
+	now := time.Now()
+	for key, other := range p.sessions {
+		if now.After(other.expires) {
+			delete(p.sessions, key)
+		}
+	}
+	p.sessions[tokenDigest(token)] = s
+	p.mu.Unlock()
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    token,
+		Path:     "/",
+		Expires:  s.expires,
+		Secure:   strings.HasPrefix(p.BaseURL, "https://"),
+		HttpOnly: true,
+		// sent when following links from other sites, but not with their requests changing anything.
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// setLoginCookie sets samlLoginCookie to value for maxAge seconds, or removes it if maxAge is negative.
+func (p *samlProvider) setLoginCookie(w http.ResponseWriter, value string, maxAge int) {
+	cookie := &http.Cookie{
+		Name:     samlLoginCookie,
+		Value:    value,
+		Path:     "/saml/",
+		MaxAge:   maxAge,
+		Secure:   strings.HasPrefix(p.BaseURL, "https://"),
+		HttpOnly: true,
+	}
+	if cookie.Secure {
+		// the identity provider posts the response from its own site, with which Lax cookies are not sent.
+		cookie.SameSite = http.SameSiteNoneMode
+	}
+	http.SetCookie(w, cookie)
+}
+
+// endSession signs out the user of the session cookie of r.
+func (p *samlProvider) endSession(w http.ResponseWriter, r *http.Request) (webSession, bool) {
+	s, ok := p.session(r)
+	if cookie, err := r.Cookie(sessionCookie); err == nil {
+		p.mu.Lock()
+		delete(p.sessions, tokenDigest(cookie.Value))
+		p.mu.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: "", Path: "/", MaxAge: -1})
+	return s, ok
+}
+
+// safeReturnPath returns target if it is a path on this server, and else "/files/".
+func safeReturnPath(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") || strings.HasPrefix(target, "/\\") {
+		return "/files/"
+	}
+	return target
+}
+
+// acceptsHTML tells whether r comes from a browser navigating to a page.
+func acceptsHTML(r *http.Request) bool {
+	return r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// handleSAML serves the endpoints of the service provider: GET /saml/metadata, GET /saml/login?return=(path),
+// which sends the user to the identity provider, POST /saml/acs, where the identity provider sends the user back,
+// and POST /saml/logout.
+func (s Server) handleSAML(w http.ResponseWriter, r *http.Request) {
+	p := s.RBAC.SAML
+	method := http.MethodGet
+	switch r.URL.Path {
+	case "/saml/metadata":
+		if r.Method != http.MethodGet {
+			break
+		}
+		b, err := p.metadata()
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/samlmetadata+xml")
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
+		return
+	case "/saml/login":
+		if r.Method != http.MethodGet {
+			break
+		}
+		target, browser, err := p.loginURL(safeReturnPath(r.URL.Query().Get("return")), time.Now())
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		p.setLoginCookie(w, browser, int(samlLoginTTL/time.Second))
+		w.Header().Set("Cache-Control", "no-store")
+		http.Redirect(w, r, target, http.StatusSeeOther)
+		return
+	case "/saml/acs":
+		method = http.MethodPost
+		if r.Method != http.MethodPost {
+			break
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxSAMLResponse)
+		browser := ""
+		if cookie, err := r.Cookie(samlLoginCookie); err == nil {
+			browser = cookie.Value
+		}
+		p.setLoginCookie(w, "", -1)
+		session, returnTo, err := p.consume(r.PostFormValue("SAMLResponse"), browser, time.Now())
+		if err != nil {
+			logFailure(logger.WithField("remote", clientIP(r)), err, "SAML sign-in rejected")
+			respondError(w, err)
+			return
+		}
+		p.startSession(w, r, session)
+		auditLog().WithFields(logrus.Fields{"user": session.user, "groups": session.groups, "remote": clientIP(r)}).Info("user signed in with SAML")
+		http.Redirect(w, r, returnTo, http.StatusSeeOther)
+		return
+	case "/saml/logout":
+		method = http.MethodPost
+		if r.Method != http.MethodPost {
+			break
+		}
+		if session, ok := p.endSession(w, r); ok {
+			auditLog().WithFields(logrus.Fields{"user": session.user, "remote": clientIP(r)}).Info("user signed out")
+		}
+		w.WriteHeader(http.StatusOK)
+		writeJSON(w, response{OK: true})
+		return
+	default:
+		respondError(w, fmt.Errorf("\"%s\" is %w", r.URL.Path, errNotFound))
+		return
+	}
+	w.Header().Set("Allow", method)
+	respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testIdPEntityID = "https://idp.example.com"
+	testSPURL       = "https://files.example.org"
+)
+
+// testIdP signs SAML documents as an identity provider would.
+type testIdP struct {
+	key  *rsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func newTestIdP(t *testing.T) testIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testIdP{key: key, cert: cert}
+}
+
+func (idp testIdP) provider() *samlProvider {
+	return &samlProvider{
+		idpEntityID:     testIdPEntityID,
+		ssoURL:          testIdPEntityID + "/sso",
+		certs:           []*x509.Certificate{idp.cert},
+		BaseURL:         testSPURL,
+		EntityID:        testSPURL + "/saml/metadata",
+		GroupsAttribute: "groups",
+		SessionTTL:      time.Hour,
+		logins:          map[string]samlLogin{},
+		sessions:        map[string]webSession{},
+	}
+}
+
+// signature returns an enveloped signature of the element with the given ID, whose canonical form is canonical.
+// The canonical forms are written out rather than computed, so that they check the canonicalization too.
+func (idp testIdP) signature(t *testing.T, id string, canonical string) string {
+	digest := sha256.Sum256([]byte(canonical))
+	signedInfo := `<ds:SignedInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#">` +
+		`<ds:CanonicalizationMethod Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"></ds:CanonicalizationMethod>` +
+		`<ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"></ds:SignatureMethod>` +
+		`<ds:Reference URI="#` + id + `"><ds:Transforms>` +
+		`<ds:Transform Algorithm="http://www.w3.org/2000/09/xmldsig#enveloped-signature"></ds:Transform>` +
+		`<ds:Transform Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"></ds:Transform></ds:Transforms>` +
+		`<ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"></ds:DigestMethod>` +
+		`<ds:DigestValue>` + base64.StdEncoding.EncodeToString(digest[:]) + `</ds:DigestValue></ds:Reference></ds:SignedInfo>`
+	hashed := sha256.Sum256([]byte(signedInfo))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SignedInfo inherits the namespace from Signature in the document, and declares it in its canonical form.
+	return `<ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#">` +
+		strings.Replace(signedInfo, ` xmlns:ds="http://www.w3.org/2000/09/xmldsig#"`, "", 1) +
+		`<ds:SignatureValue>` + base64.StdEncoding.EncodeToString(sig) + `</ds:SignatureValue></ds:Signature>`
+}
+
+// testAssertion returns the canonical form of an assertion with the given ID for user, answering the request inResponseTo.
+func testAssertion(id string, user string, inResponseTo string, now time.Time) string {
+	return fmt.Sprintf(`<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="%s" IssueInstant="%s" Version="2.0">`+
+		`<saml:Issuer>%s</saml:Issuer>`+
+		`<saml:Subject><saml:NameID>%s</saml:NameID>`+
+		`<saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">`+
+		`<saml:SubjectConfirmationData InResponseTo="%s" NotOnOrAfter="%s" Recipient="%s/saml/acs"></saml:SubjectConfirmationData>`+
+		`</saml:SubjectConfirmation></saml:Subject>`+
+		`<saml:Conditions NotBefore="%s" NotOnOrAfter="%s"><saml:AudienceRestriction>`+
+		`<saml:Audience>%s/saml/metadata</saml:Audience></saml:AudienceRestriction></saml:Conditions></saml:Assertion>`,
+		id, now.UTC().Format(time.RFC3339), testIdPEntityID, user, inResponseTo, now.Add(5*time.Minute).UTC().Format(time.RFC3339),
+		testSPURL, now.Add(-time.Minute).UTC().Format(time.RFC3339), now.Add(5*time.Minute).UTC().Format(time.RFC3339), testSPURL)
+}
+
+// signedAssertion returns the assertion given by its canonical form with its signature, after its Issuer.
+func (idp testIdP) signedAssertion(t *testing.T, id string, canonical string) string {
+	return strings.Replace(canonical, "</saml:Issuer>", "</saml:Issuer>"+idp.signature(t, id, canonical), 1)
+}
+
+// testResponse returns a response to the request inResponseTo carrying the given assertions.
+func testResponse(inResponseTo string, assertions ...string) string {
+	return fmt.Sprintf(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" Destination="%s/saml/acs" ID="_response" InResponseTo="%s" Version="2.0">`+
+		`<saml:Issuer>%s</saml:Issuer>`+
+		`<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"></samlp:StatusCode></samlp:Status>`+
+		`%s</samlp:Response>`, testSPURL, inResponseTo, testIdPEntityID, strings.Join(assertions, ""))
+}
+
+// startTestLogin starts a sign-in with s, and returns the ID of its request and the value of its cookie.
+func startTestLogin(t *testing.T, s Server) (string, string) {
+	w := httptest.NewRecorder()
+	s.handleSAML(w, httptest.NewRequest(http.MethodGet, "/saml/login?return=/files/", nil))
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("GET /saml/login: status %d", w.Code)
+	}
+	var browser string
+	for _, c := range w.Result().Cookies() {
+		if c.Name == samlLoginCookie {
+			browser = c.Value
+		}
+	}
+	if browser == "" {
+		t.Fatalf("GET /saml/login: no %s cookie", samlLoginCookie)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deflated, err := base64.StdEncoding.DecodeString(location.Query().Get("SAMLRequest"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req samlAuthnRequest
+	if err := xml.Unmarshal(b, &req); err != nil {
+		t.Fatal(err)
+	}
+	return req.ID, browser
+}
+
+func postTestResponse(s Server, response string, browser string) *httptest.ResponseRecorder {
+	form := url.Values{"SAMLResponse": {base64.StdEncoding.EncodeToString([]byte(response))}}
+	r := httptest.NewRequest(http.MethodPost, "/saml/acs", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if browser != "" {
+		r.AddCookie(&http.Cookie{Name: samlLoginCookie, Value: browser})
+	}
+	w := httptest.NewRecorder()
+	s.handleSAML(w, r)
+	return w
+}
+
+func TestSAMLSignInIsBoundToTheBrowser(t *testing.T) {
+	idp := newTestIdP(t)
+	s := Server{RBAC: newRBACStore()}
+	s.RBAC.SAML = idp.provider()
+
+	// a response to a sign-in started by someone else is not accepted in another browser.
+	_, otherBrowser := startTestLogin(t, s)
+	for _, browser := range []string{"", otherBrowser} {
+		id, _ := startTestLogin(t, s)
+		response := testResponse(id, idp.signedAssertion(t, "_a1", testAssertion("_a1", "mallory", id, time.Now())))
+		w := postTestResponse(s, response, browser)
+		if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "this browser") {
+			t.Errorf("POST /saml/acs with cookie %q: status %d, want 403: %s", browser, w.Code, w.Body)
+		}
+	}
+
+	id, browser := startTestLogin(t, s)
+	response := testResponse(id, idp.signedAssertion(t, "_a2", testAssertion("_a2", "alice", id, time.Now())))
+	w := postTestResponse(s, response, browser)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("POST /saml/acs: status %d, want 303: %s", w.Code, w.Body)
+	}
+	signedIn := false
+	for _, c := range w.Result().Cookies() {
+		signedIn = signedIn || (c.Name == sessionCookie && c.Value != "")
+	}
+	if !signedIn {
+		t.Error("POST /saml/acs: no session cookie")
+	}
+	// each request is answered once.
+	if w := postTestResponse(s, response, browser); w.Code != http.StatusForbidden {
+		t.Errorf("POST /saml/acs again: status %d, want 403", w.Code)
+	}
+}
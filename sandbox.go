@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var errPendingScan = errors.New("pending a malware scan")
+
+const (
+	// sandboxQueueSize bounds the uploads waiting to be submitted; uploads beyond stay pending until they time out.
+	sandboxQueueSize = 1000
+	// sandboxSubmitTimeout bounds each submission to the analysis service.
+	sandboxSubmitTimeout = 5 * time.Minute
+	// maxSandboxVerdict is the size of the largest verdict posted back by the analysis service.
+	maxSandboxVerdict = 64 * 1024
+)
+
+// Statuses of a scan.
+const (
+	scanPending   = "pending"
+	scanClean     = "clean"
+	scanMalicious = "malicious"
+	scanTimedOut  = "timed_out"
+)
+
+// Actions on the files found malicious, or whose scan timed out.
+const (
+	scanRelease    = "release"
+	scanQuarantine = "quarantine"
+	scanDelete     = "delete"
+)
+
+// sandboxScan is the analysis of a file by the sandbox, recorded in its metadata.
+type sandboxScan struct {
+	Status string `json:"status"`
+	// Reason is what the analysis service found, like the name of the malware.
+	Reason    string    `json:"reason,omitempty"`
+	Submitted time.Time `json:"submitted"`
+	Deadline  time.Time `json:"deadline"`
+	// At is when the status was last changed, and By what changed it: the sandbox, the timeout or an admin.
+	At time.Time `json:"at"`
+	By string    `json:"by,omitempty"`
+	// KeyDigest is the digest of the key of the callback URL, which only the analysis service is given.
+	KeyDigest string `json:"key_digest,omitempty"`
+}
+
+// pendingScan is a file waiting for its verdict.
+type pendingScan struct {
+	rel      string
+	deadline time.Time
+}
+
+// sandboxSubmission is a file to submit to the analysis service, with the key of its callback URL.
+type sandboxSubmission struct {
+	uploadEvent
+	key string
+}
+
+// sandbox submits uploaded files to an external analysis service, like a malware sandbox detonating them,
+// and keeps them from being downloaded until the service posts its verdict back or the time runs out.
+//
+// The content of a file is posted as is, with its Content-Type, to URL, with the URL to post the verdict to
+// in the X-Callback-URL header. The verdict is posted as:
+//
+//	{"verdict": "malicious", "reason": "Trojan.GenericKD"}
+type sandbox struct {
+	URL   string
+	Token string
+	// Timeout is how long a file waits for its verdict before OnTimeout is applied.
+	Timeout     time.Duration
+	OnMalicious string
+	OnTimeout   string
+
+	queue  chan sandboxSubmission
+	client *http.Client
+
+	mu sync.Mutex
+	// pending are by digest of the key of their callback URL.
+	pending map[string]pendingScan
+}
+
+func newSandbox(url string) *sandbox {
+	return &sandbox{
+		URL:         url,
+		Timeout:     time.Hour,
+		OnMalicious: scanQuarantine,
+		OnTimeout:   scanQuarantine,
+		queue:       make(chan sandboxSubmission, sandboxQueueSize),
+		client:      &http.Client{Timeout: sandboxSubmitTimeout},
+		pending:     map[string]pendingScan{},
+	}
+}
+
+// holdForScan marks the uploaded file e pending a scan, so that it cannot be downloaded, and queues it
+// for submission to the analysis service. It returns right away.
+func (s Server) holdForScan(e uploadEvent) {
+	sb := s.Sandbox
+	if sb == nil {
+		return
+	}
+	rel := strings.TrimPrefix(e.Path, "/files")
+	key := newNonce() + newNonce()
+	now := time.Now()
+	scan := sandboxScan{Status: scanPending, Submitted: now, Deadline: now.Add(sb.Timeout), At: now, KeyDigest: tokenDigest(key)}
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	err := s.Meta.update(rel, func(meta *fileMeta) {
+		// a file uploaded again is scanned again, and the verdict on its previous content is no longer accepted.
+		if meta.Scan != nil {
+			delete(sb.pending, meta.Scan.KeyDigest)
+		}
+		meta.Scan = &scan
+	})
+	if err != nil {
+		logger.WithError(err).WithField("path", e.Path).Error("failed to mark the file pending a scan")
+		return
+	}
+	sb.pending[scan.KeyDigest] = pendingScan{rel: rel, deadline: scan.Deadline}
+	select {
+	case sb.queue <- sandboxSubmission{uploadEvent: e, key: key}:
+	default:
+		logger.WithField("path", e.Path).Warn("sandbox queue full, file left pending until its scan times out")
+	}
+}
+
+// submit posts the file at name to the analysis service, to post its verdict back to callback.
+func (sb *sandbox) submit(ctx context.Context, name string, callback string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	t, err := contentType(name)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, sb.URL, f)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.ContentLength = info.Size()
+	req.Header.Set("Content-Type", t)
+	req.Header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": path.Base(name)}))
+	req.Header.Set("X-Callback-URL", callback)
+	if sb.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+sb.Token)
+	}
+	resp, err := sb.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("analysis service responded %s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+	return nil
+}
+
+// detonate submits the files queued by holdForScan to the analysis service. It never returns.
+func (s Server) detonate() {
+	for sub := range s.Sandbox.queue {
+		entry := logger.WithField("path", sub.Path)
+		callback, err := url.Parse(sub.URL)
+		if err != nil {
+			entry.WithError(err).Warn("failed to submit the file to the sandbox")
+			continue
+		}
+		callback.Path, callback.RawPath, callback.RawQuery = "/sandbox/callback/"+sub.key, "", ""
+		name := path.Join(s.DocumentRoot, strings.TrimPrefix(sub.Path, "/files"))
+		for attempt := 1; ; attempt++ {
+			ctx, cancel := context.WithTimeout(context.Background(), sandboxSubmitTimeout)
+			err = s.Sandbox.submit(ctx, name, callback.String())
+			cancel()
+			if err == nil {
+				entry.Debug("file submitted to the sandbox")
+				break
+			}
+			if os.IsNotExist(err) || attempt == callbackAttempts {
+				entry.WithError(err).Warn("failed to submit the file to the sandbox, left pending until its scan times out")
+				break
+			}
+			entry.WithError(err).Info("failed to submit the file to the sandbox, retrying")
+			time.Sleep(time.Duration(attempt) * 5 * time.Second)
+		}
+	}
+}
+
+// loadPendingScans finds the files left pending a scan by a previous run, so that their verdicts are still accepted
+// and their scans time out.
+func (s Server) loadPendingScans() error {
+	sb := s.Sandbox
+	return filepath.Walk(s.Meta.dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(p, ".json") || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		var meta fileMeta
+		if json.Unmarshal(b, &meta) != nil || meta.Scan == nil || meta.Scan.Status != scanPending {
+			return nil
+		}
+		rel, err := filepath.Rel(s.Meta.dir, strings.TrimSuffix(p, ".json"))
+		if err != nil {
+			return err
+		}
+		sb.mu.Lock()
+		sb.pending[meta.Scan.KeyDigest] = pendingScan{rel: "/" + filepath.ToSlash(rel), deadline: meta.Scan.Deadline}
+		sb.mu.Unlock()
+		return nil
+	})
+}
+
+// expireScans applies the timeout action to the files whose verdict is overdue. It never returns.
+func (s Server) expireScans() {
+	sb := s.Sandbox
+	interval := time.Minute
+	if sb.Timeout < 10*time.Minute {
+		interval = sb.Timeout / 10
+	}
+	for range time.Tick(interval) {
+		now := time.Now()
+		sb.mu.Lock()
+		overdue := map[string]pendingScan{}
+		for digest, p := range sb.pending {
+			if now.After(p.deadline) {
+				overdue[digest] = p
+			}
+		}
+		sb.mu.Unlock()
+		for digest, p := range overdue {
+			err := s.settleScan(p.rel, digest, scanTimedOut, fmt.Sprintf("no verdict within %s", sb.Timeout), "timeout")
+			if err != nil && !errors.Is(err, errNotFound) {
+				logger.WithError(err).WithField("path", "/files"+p.rel).Warn("failed to time out the scan")
+			}
+		}
+	}
+}
+
+// settleScan records the verdict of the scan of rel, a path relative to the document root, and acts on it:
+// malicious files and those whose scan timed out are quarantined or deleted as configured. Files under legal hold
+// are quarantined rather than deleted.
+// The verdict is only accepted for the scan whose callback key has the given digest, unless the digest is empty.
+func (s Server) settleScan(rel string, digest string, status string, reason string, by string) error {
+	sb := s.Sandbox
+	if digest != "" {
+		sb.mu.Lock()
+		delete(sb.pending, digest)
+		sb.mu.Unlock()
+	}
+	action := scanRelease
+	switch status {
+	case scanMalicious:
+		action = sb.OnMalicious
+	case scanTimedOut:
+		action = sb.OnTimeout
+	}
+	if action == scanDelete && s.checkLegalHold(rel) != nil {
+		action = scanQuarantine
+	}
+	name := path.Join(s.DocumentRoot, rel)
+	if _, err := os.Stat(name); err != nil {
+		return fmt.Errorf("\"/files%s\" is %w", rel, errNotFound)
+	}
+	var scan sandboxScan
+	overridden := ""
+	err := s.Meta.update(rel, func(meta *fileMeta) {
+		if meta.Scan == nil || (digest != "" && (meta.Scan.Status != scanPending || meta.Scan.KeyDigest != digest)) {
+			return
+		}
+		overridden = meta.Scan.KeyDigest
+		meta.Scan.Status, meta.Scan.Reason, meta.Scan.At, meta.Scan.By, meta.Scan.KeyDigest = status, reason, time.Now(), by, ""
+		scan = *meta.Scan
+		if action == scanQuarantine && meta.Quarantine == nil {
+			meta.Quarantine = &quarantine{Reason: fmt.Sprintf("scan %s: %s", status, reason), Since: scan.At, By: "sandbox"}
+		} else if action == scanRelease && meta.Quarantine != nil && meta.Quarantine.By == "sandbox" {
+			// a file found clean after all is released from the quarantine of its scan, but not from others.
+			meta.Quarantine = nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if digest == "" && overridden != "" {
+		sb.mu.Lock()
+		delete(sb.pending, overridden)
+		sb.mu.Unlock()
+	}
+	if scan.Status == "" {
+		// the file was uploaded again, or its scan was settled by an admin.
+		return fmt.Errorf("scan of \"/files%s\" is %w", rel, errNotFound)
+	}
+	entry := auditLog().WithFields(logrus.Fields{
+		"path":   rel,
+		"status": status,
+		"reason": reason,
+		"action": action,
+		"by":     by,
+	})
+	switch action {
+	case scanDelete:
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+		s.forget(rel)
+		s.removeEmptyDirs(path.Dir(rel))
+		s.emit(fileEvent{Type: eventDelete, Path: "/files" + rel, Actor: "sandbox"})
+		entry.Warn("file deleted after its scan")
+	case scanQuarantine:
+		entry.Warn("file quarantined after its scan")
+	default:
+		entry.Info("file released after its scan")
+	}
+	s.Purger.changed("/files" + rel)
+	return nil
+}
+
+// pendingScans returns the files pending a scan, the most overdue first.
+func (sb *sandbox) pendingScans() []pendingScanEntry {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	files := make([]pendingScanEntry, 0, len(sb.pending))
+	for _, p := range sb.pending {
+		files = append(files, pendingScanEntry{Path: "/files" + p.rel, Deadline: p.deadline})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].Deadline.Equal(files[j].Deadline) {
+			return files[i].Deadline.Before(files[j].Deadline)
+		}
+		return files[i].Path < files[j].Path
+	})
+	return files
+}
+
+type pendingScanEntry struct {
+	Path     string    `json:"path"`
+	Deadline time.Time `json:"deadline"`
+}
+
+type pendingScansResponse struct {
+	response
+	Files []pendingScanEntry `json:"files"`
+}
+
+// sandboxVerdict is posted back by the analysis service, or by an admin overriding it.
+type sandboxVerdict struct {
+	Verdict string `json:"verdict"`
+	Reason  string `json:"reason"`
+}
+
+// parseVerdict reads the verdict posted in r, as JSON or as form fields.
+func parseVerdict(w http.ResponseWriter, r *http.Request) (sandboxVerdict, error) {
+	var v sandboxVerdict
+	r.Body = http.MaxBytesReader(w, r.Body, maxSandboxVerdict)
+	if t, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); t == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			return v, withStatus(http.StatusBadRequest, fmt.Errorf("invalid verdict: %v", err))
+		}
+	} else {
+		v.Verdict, v.Reason = r.FormValue("verdict"), r.FormValue("reason")
+	}
+	if v.Verdict != scanClean && v.Verdict != scanMalicious {
+		return v, withStatus(http.StatusBadRequest, fmt.Errorf("invalid verdict %q (clean or malicious)", v.Verdict))
+	}
+	return v, nil
+}
+
+// handleSandboxCallback serves POST /sandbox/callback/(key), where the analysis service posts its verdict.
+// The key, given only to the service with the file, authenticates the verdict.
+func (s Server) handleSandboxCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	digest := tokenDigest(strings.TrimPrefix(r.URL.Path, "/sandbox/callback/"))
+	s.Sandbox.mu.Lock()
+	p, ok := s.Sandbox.pending[digest]
+	s.Sandbox.mu.Unlock()
+	if !ok {
+		respondError(w, fmt.Errorf("scan is %w", errNotFound))
+		return
+	}
+	v, err := parseVerdict(w, r)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	if err := s.settleScan(p.rel, digest, v.Verdict, v.Reason, "sandbox"); err != nil {
+		logFailure(logger.WithField("path", "/files"+p.rel), err, "failed to record the verdict of the sandbox")
+		respondError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	writeSuccess(w, "/files"+p.rel)
+}
+
+// handleScans serves GET /admin/scans, listing the files pending a scan, and POST /admin/scans/(filename)
+// with a verdict, which overrides the sandbox, whether the file is pending or not.
+func (s Server) handleScans(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/admin/scans" || r.URL.Path == "/admin/scans/" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		writeJSON(w, pendingScansResponse{response: response{OK: true}, Files: s.Sandbox.pendingScans()})
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	rel, err := s.storedFile(r.URL.Path, "/admin/scans/")
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	v, err := parseVerdict(w, r)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	// an override of a file never scanned starts its record.
+	if err := s.Meta.update(rel, func(meta *fileMeta) {
+		if meta.Scan == nil {
+			meta.Scan = &sandboxScan{Status: scanPending}
+		}
+	}); err != nil {
+		respondError(w, err)
+		return
+	}
+	if err := s.settleScan(rel, "", v.Verdict, v.Reason, r.RemoteAddr); err != nil {
+		logFailure(logger.WithField("path", "/files"+rel), err, "failed to override the scan")
+		respondError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	writeSuccess(w, "/files"+rel)
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefixes of option values which refer to a secret in a secret store, rather than being the secret:
+//
+//	vault:secret/data/upload#token   the field token of the secret at that path in HashiCorp Vault (KV version 1 or 2)
+//	awssm:upload/prod#token          the field token of the JSON secret upload/prod in AWS Secrets Manager, or the whole secret without #field
+//	awskms:AQICAHh...                the plaintext of a ciphertext encrypted with AWS KMS, in base64
+const (
+	vaultPrefix  = "vault:"
+	awsSMPrefix  = "awssm:"
+	awsKMSPrefix = "awskms:"
+)
+
+// secretOptions are the options which may refer to a secret store. The certificate and key are the PEM contents, not paths.
+var secretOptions = []string{"token", "admin_token", "signing_key", "smtp_password", "jwt_secret", "captcha_secret", "moderation_token", "cert", "key"}
+
+// secretFetchTimeout bounds each request to a secret store.
+const secretFetchTimeout = 30 * time.Second
+
+func isSecretRef(value string) bool {
+	return strings.HasPrefix(value, vaultPrefix) || strings.HasPrefix(value, awsSMPrefix) || strings.HasPrefix(value, awsKMSPrefix)
+}
+
+// secretValue holds a secret which may be replaced while the server runs, when it is refreshed from a secret store.
+type secretValue struct {
+	mu    sync.RWMutex
+	value string
+}
+
+func newSecretValue(value string) *secretValue {
+	return &secretValue{value: value}
+}
+
+func (v *secretValue) get() string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return v.value
+}
+
+func (v *secretValue) set(value string) {
+	v.mu.Lock()
+	v.value = value
+	v.mu.Unlock()
+}
+
+// secretStore fetches the options which refer to secret stores on startup, and again periodically, so that
+// rotated secrets take effect without a restart.
+type secretStore struct {
+	vault *vaultClient
+	// refs are the references by option name, and fetched the values last fetched.
+	refs    map[string]string
+	fetched map[string]string
+	// bound are the values in use, by option name, which are updated when a refreshed secret changes.
+	bound map[string]*secretValue
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// newSecretStore makes a store fetching from Vault at vaultAddr with vaultToken; Vault is not used if vaultAddr is empty.
+func newSecretStore(vaultAddr string, vaultToken string) (*secretStore, error) {
+	st := &secretStore{refs: map[string]string{}, fetched: map[string]string{}, bound: map[string]*secretValue{}}
+	if vaultAddr != "" {
+		u, err := url.Parse(vaultAddr)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid Vault address %q", vaultAddr)
+		}
+		if vaultToken == "" {
+			return nil, errors.New("a Vault token is required to read secrets from Vault")
+		}
+		st.vault = &vaultClient{Addr: u, token: vaultToken, client: &http.Client{}}
+	}
+	return st, nil
+}
+
+// resolve fetches the options of fs which refer to a secret store. The options other than the certificate and the key
+// are set to the fetched secrets, whose sources are recorded in configSources.
+func (st *secretStore) resolve(ctx context.Context, fs *flag.FlagSet) error {
+	for _, option := range secretOptions {
+		ref := fs.Lookup(option).Value.String()
+		if !isSecretRef(ref) {
+			continue
+		}
+		value, err := st.fetch(ctx, ref)
+		if err != nil {
+			return fmt.Errorf("-%s: %v", option, err)
+		}
+		st.refs[option] = ref
+		st.fetched[option] = value
+		if option == "cert" || option == "key" {
+			continue
+		}
+		configSources[option] = ref
+		if err := fs.Set(option, value); err != nil {
+			return fmt.Errorf("-%s: %v", option, err)
+		}
+	}
+	if st.fromStore("cert") || st.fromStore("key") {
+		cert, err := st.loadCertificate(fs.Lookup("cert").Value.String(), fs.Lookup("key").Value.String())
+		if err != nil {
+			return err
+		}
+		st.cert = cert
+	}
+	return nil
+}
+
+// fromStore tells whether option was fetched from a secret store.
+func (st *secretStore) fromStore(option string) bool {
+	_, ok := st.refs[option]
+	return ok
+}
+
+// bind makes v follow the secret of option when it is refreshed; it is a no-op unless option was fetched from a secret store.
+func (st *secretStore) bind(option string, v *secretValue) {
+	if st.fromStore(option) {
+		st.bound[option] = v
+	}
+}
+
+// pem returns the PEM content of the certificate or key option: the fetched secret, or the content of the file.
+func (st *secretStore) pem(option string, value string) ([]byte, error) {
+	if st.fromStore(option) {
+		return []byte(st.fetched[option]), nil
+	}
+	return ioutil.ReadFile(value)
+}
+
+// loadCertificate loads the TLS key pair given by the cert and key options, either of which may come from a secret store.
+func (st *secretStore) loadCertificate(certFile string, keyFile string) (*tls.Certificate, error) {
+	certPEM, err := st.pem("cert", certFile)
+	if err != nil {
+		return nil, fmt.Errorf("-cert: %v", err)
+	}
+	keyPEM, err := st.pem("key", keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("-key: %v", err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("-cert/-key: %v", err)
+	}
+	return &cert, nil
+}
+
+// tlsConfig returns a TLS configuration serving the certificate fetched from the secret store, which follows its rotations.
+func (st *secretStore) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			st.mu.RLock()
+			defer st.mu.RUnlock()
+			return st.cert, nil
+		},
+	}
+}
+
+// refresh renews the Vault token and fetches the secrets again every interval, updating those which changed.
+// Failures are logged, and the secrets in use are kept. It never returns.
+func (st *secretStore) refresh(interval time.Duration, certFile string, keyFile string) {
+	for {
+		time.Sleep(interval)
+		if st.vault != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), secretFetchTimeout)
+			if err := st.vault.renewSelf(ctx); err != nil {
+				logger.WithError(err).Warn("failed to renew the Vault token")
+			}
+			cancel()
+		}
+		certChanged := false
+		for option, ref := range st.refs {
+			ctx, cancel := context.WithTimeout(context.Background(), secretFetchTimeout)
+			value, err := st.fetch(ctx, ref)
+			cancel()
+			if err != nil {
+				logger.WithError(err).WithField("option", option).Warn("failed to refresh a secret")
+				continue
+			}
+			if value == st.fetched[option] {
+				continue
+			}
+			st.fetched[option] = value
+			if option == "cert" || option == "key" {
+				certChanged = true
+			} else if v, ok := st.bound[option]; ok {
+				v.set(value)
+				logger.WithField("option", option).Info("secret rotated")
+			} else {
+				logger.WithField("option", option).Warn("secret changed, but is only read on startup")
+			}
+		}
+		if certChanged {
+			if cert, err := st.loadCertificate(certFile, keyFile); err != nil {
+				logger.WithError(err).Warn("failed to load the rotated TLS certificate, so the previous one is kept")
+			} else {
+				st.mu.Lock()
+				st.cert = cert
+				st.mu.Unlock()
+				logger.Info("TLS certificate rotated")
+			}
+		}
+	}
+}
+
+// fetch returns the secret ref refers to.
+func (st *secretStore) fetch(ctx context.Context, ref string) (string, error) {
+	switch {
+	case strings.HasPrefix(ref, vaultPrefix):
+		if st.vault == nil {
+			return "", errors.New("-vault_addr is required to read secrets from Vault")
+		}
+		p, field := splitSecretField(strings.TrimPrefix(ref, vaultPrefix))
+		if field == "" {
+			return "", fmt.Errorf("%s: the field of the secret must be given after #", ref)
+		}
+		return st.vault.read(ctx, p, field)
+	case strings.HasPrefix(ref, awsSMPrefix):
+		id, field := splitSecretField(strings.TrimPrefix(ref, awsSMPrefix))
+		return awsSecret(ctx, id, field)
+	case strings.HasPrefix(ref, awsKMSPrefix):
+		return awsDecrypt(ctx, strings.TrimPrefix(ref, awsKMSPrefix))
+	}
+	return ref, nil
+}
+
+// splitSecretField splits "path#field" into its path and field, which is empty if not given.
+func splitSecretField(s string) (string, string) {
+	if i := strings.LastIndex(s, "#"); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// vaultClient reads secrets from HashiCorp Vault through its HTTP API, authenticated with a token.
+type vaultClient struct {
+	Addr   *url.URL
+	token  string
+	client *http.Client
+}
+
+// call sends a request to the API at path, e.g. "secret/data/upload", and decodes the response into out.
+func (v *vaultClient) call(ctx context.Context, method string, path string, out interface{}) error {
+	u := *v.Addr
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/" + strings.TrimPrefix(path, "/")
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if ns := os.Getenv("VAULT_NAMESPACE"); ns != "" {
+		req.Header.Set("X-Vault-Namespace", ns)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// errors come as {"errors": ["..."]}.
+		var e struct{ Errors []string }
+		if json.Unmarshal(b, &e) == nil && len(e.Errors) > 0 {
+			return fmt.Errorf("Vault %s failed: %s", path, strings.Join(e.Errors, "; "))
+		}
+		return fmt.Errorf("Vault %s failed: %s", path, resp.Status)
+	}
+	return json.Unmarshal(b, out)
+}
+
+// read returns the field of the secret at path. Secrets of the KV version 2 engine have their fields under data.data,
+// and those of version 1 directly under data.
+func (v *vaultClient) read(ctx context.Context, path string, field string) (string, error) {
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := v.call(ctx, http.MethodGet, path, &secret); err != nil {
+		return "", err
+	}
+	data := secret.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+	value, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("Vault secret %s has no field %q", path, field)
+	}
+	return value, nil
+}
+
+// renewSelf extends the lease of the token, so that it does not expire while the server runs. Tokens which are not
+// renewable, like root tokens, make it fail.
+func (v *vaultClient) renewSelf(ctx context.Context) error {
+	var renewed struct{}
+	return v.call(ctx, http.MethodPost, "auth/token/renew-self", &renewed)
+}
+
+// awsCall calls target of an AWS service speaking the JSON protocol, e.g. "secretsmanager.GetSecretValue",
+// with the credentials and region of the environment like the S3 client. AWS_ENDPOINT_URL overrides the endpoint.
+func awsCall(ctx context.Context, service string, target string, in interface{}, out interface{}) error {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	signer := sigV4{
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		Region:       region,
+		Service:      service,
+	}
+	if signer.AccessKey == "" || signer.SecretKey == "" {
+		return fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set to access %s", service)
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL")
+	if endpoint == "" {
+		endpoint = "https://" + service + "." + region + ".amazonaws.com/"
+	}
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+	sum := sha256.Sum256(body)
+	signer.sign(req, hex.EncodeToString(sum[:]), time.Now())
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		// errors come as {"__type": "...", "message": "..."}.
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(b, &e) == nil && e.Type != "" {
+			return fmt.Errorf("%s failed: %s: %s", target, e.Type, e.Message)
+		}
+		return fmt.Errorf("%s failed: %s", target, resp.Status)
+	}
+	return json.Unmarshal(b, out)
+}
+
+// awsSecret returns the secret id from AWS Secrets Manager, or its field if it is a JSON object and field is not empty.
+func awsSecret(ctx context.Context, id string, field string) (string, error) {
+	var out struct {
+		SecretString string
+	}
+	if err := awsCall(ctx, "secretsmanager", "secretsmanager.GetSecretValue", map[string]string{"SecretId": id}, &out); err != nil {
+		return "", err
+	}
+	if field == "" {
+		return out.SecretString, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(out.SecretString), &fields); err != nil {
+		return "", fmt.Errorf("AWS secret %s is not a JSON object, so it has no field %q", id, field)
+	}
+	value, ok := fields[field].(string)
+	if !ok {
+		return "", fmt.Errorf("AWS secret %s has no field %q", id, field)
+	}
+	return value, nil
+}
+
+// awsDecrypt returns the plaintext of a ciphertext encrypted by AWS KMS, given in base64 as output by the AWS CLI.
+func awsDecrypt(ctx context.Context, ciphertext string) (string, error) {
+	var out struct {
+		Plaintext string
+	}
+	if err := awsCall(ctx, "kms", "TrentService.Decrypt", map[string]string{"CiphertextBlob": ciphertext}, &out); err != nil {
+		return "", err
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(out.Plaintext)
+	if err != nil {
+		return "", fmt.Errorf("invalid plaintext from AWS KMS: %v", err)
+	}
+	return string(plaintext), nil
+}
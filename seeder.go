@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Messages of the peer wire protocol (BEP 3).
+const (
+	btChoke         = 0
+	btUnchoke       = 1
+	btInterested    = 2
+	btNotInterested = 3
+	btHave          = 4
+	btBitfield      = 5
+	btRequest       = 6
+	btPiece         = 7
+	btCancel        = 8
+)
+
+const (
+	btProtocol = "BitTorrent protocol"
+	// btMaxBlock is the longest block a peer may request; clients request 16 KiB.
+	btMaxBlock = 128 << 10
+	// btIdleTimeout closes connections to peers which send nothing, not even keep-alives, for this long.
+	btIdleTimeout = 3 * time.Minute
+	// btMaxPeers bounds the number of peers served at once.
+	btMaxPeers = 100
+	// the tracker is asked again after announceRetry if it fails, and after its interval or defaultAnnounceInterval otherwise.
+	announceRetry           = 5 * time.Minute
+	defaultAnnounceInterval = 30 * time.Minute
+)
+
+// seed accepts peers on the torrent port and serves them the pieces of the seeded files, which are all complete.
+// It never returns.
+func (s Server) seed() {
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(s.Torrents.Port))
+	if err != nil {
+		logger.WithError(err).WithField("port", s.Torrents.Port).Error("failed to listen for BitTorrent peers")
+		return
+	}
+	logger.WithField("port", s.Torrents.Port).Info("seeding torrents")
+	slots := make(chan struct{}, btMaxPeers)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			logger.WithError(err).Warn("failed to accept a BitTorrent peer")
+			time.Sleep(time.Second)
+			continue
+		}
+		select {
+		case slots <- struct{}{}:
+			go func() {
+				defer func() { <-slots }()
+				s.servePeer(conn)
+			}()
+		default:
+			conn.Close()
+		}
+	}
+}
+
+// servePeer serves one peer until it disconnects.
+func (s Server) servePeer(conn net.Conn) {
+	defer conn.Close()
+	entry := logger.WithField("peer", conn.RemoteAddr().String())
+	r := bufio.NewReader(conn)
+
+	conn.SetReadDeadline(time.Now().Add(btIdleTimeout))
+	var hs [68]byte
+	if _, err := io.ReadFull(r, hs[:]); err != nil {
+		return
+	}
+	if hs[0] != byte(len(btProtocol)) || string(hs[1:20]) != btProtocol {
+		return
+	}
+	var hash [20]byte
+	copy(hash[:], hs[28:48])
+	t, ok := s.Torrents.byInfoHash(hash)
+	if !ok || !s.isCurrent(t) {
+		return
+	}
+	entry = entry.WithField("path", t.Path)
+	f, err := os.Open(filepath.Join(s.DocumentRoot, filepath.FromSlash(t.rel)))
+	if err != nil {
+		entry.WithError(err).Warn("failed to open the seeded file")
+		return
+	}
+	defer f.Close()
+
+	reply := make([]byte, 0, 68)
+	reply = append(reply, byte(len(btProtocol)))
+	reply = append(reply, btProtocol...)
+	reply = append(reply, make([]byte, 8)...)
+	reply = append(reply, hash[:]...)
+	reply = append(reply, s.Torrents.peerID[:]...)
+	if _, err := conn.Write(reply); err != nil {
+		return
+	}
+	// all pieces are available.
+	pieces := len(t.Pieces) / sha1.Size
+	bitfield := make([]byte, (pieces+7)/8)
+	for i := 0; i < pieces; i++ {
+		bitfield[i/8] |= 0x80 >> uint(i%8)
+	}
+	if err := writePeerMessage(conn, btBitfield, bitfield); err != nil {
+		return
+	}
+
+	block := make([]byte, btMaxBlock)
+	for {
+		conn.SetReadDeadline(time.Now().Add(btIdleTimeout))
+		id, payload, err := readPeerMessage(r)
+		if err != nil {
+			if err != io.EOF {
+				entry.WithError(err).Debug("BitTorrent peer disconnected")
+			}
+			return
+		}
+		switch id {
+		case btInterested:
+			// peers are never choked; the number of peers is bounded instead.
+			if err := writePeerMessage(conn, btUnchoke, nil); err != nil {
+				return
+			}
+		case btRequest:
+			if len(payload) != 12 {
+				return
+			}
+			index := int64(binary.BigEndian.Uint32(payload[0:4]))
+			begin := int64(binary.BigEndian.Uint32(payload[4:8]))
+			length := int64(binary.BigEndian.Uint32(payload[8:12]))
+			offset := index*t.PieceLength + begin
+			if length == 0 || length > btMaxBlock || begin+length > t.PieceLength || offset+length > t.Size {
+				entry.WithFields(logrus.Fields{"index": index, "begin": begin, "length": length}).Debug("invalid BitTorrent request")
+				return
+			}
+			if _, err := f.ReadAt(block[:length], offset); err != nil {
+				entry.WithError(err).Warn("failed to read the seeded file")
+				return
+			}
+			msg := make([]byte, 8, 8+length)
+			copy(msg, payload[:8])
+			if err := writePeerMessage(conn, btPiece, append(msg, block[:length]...)); err != nil {
+				return
+			}
+			atomic.AddInt64(&t.uploaded, length)
+		case -1, btChoke, btUnchoke, btNotInterested, btHave, btBitfield, btCancel:
+			// keep-alives, and messages which do not matter to a seeder; requests are answered at once, so there is nothing to cancel.
+		}
+	}
+}
+
+// readPeerMessage reads a message of the peer wire protocol; a keep-alive has the id -1.
+func readPeerMessage(r io.Reader) (int, []byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n == 0 {
+		return -1, nil, nil
+	}
+	// bitfields of the largest torrents are the longest messages a seeder receives.
+	if n > 1<<20 {
+		return 0, nil, fmt.Errorf("message of %d bytes is too long", n)
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return 0, nil, err
+	}
+	return int(msg[0]), msg[1:], nil
+}
+
+func writePeerMessage(w io.Writer, id byte, payload []byte) error {
+	msg := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(msg, uint32(1+len(payload)))
+	msg[4] = id
+	_, err := w.Write(append(msg, payload...))
+	return err
+}
+
+// announce tells the tracker about the seeded torrents as they become due. It never returns.
+func (ts *torrentStore) announce() {
+	for {
+		now := time.Now()
+		type announcement struct {
+			t     *torrent
+			event string
+		}
+		var due []announcement
+		ts.mu.Lock()
+		for _, t := range ts.byPath {
+			if !t.nextAnnounce.After(now) {
+				a := announcement{t: t}
+				if !t.announced {
+					a.event = "started"
+				}
+				due = append(due, a)
+			}
+		}
+		ts.mu.Unlock()
+		for _, a := range due {
+			t := a.t
+			next := now.Add(announceRetry)
+			if interval, err := ts.announceTo(t, a.event); err != nil {
+				logger.WithError(err).WithField("path", t.Path).Warn("failed to announce the torrent")
+			} else {
+				next = now.Add(interval)
+			}
+			ts.mu.Lock()
+			t.nextAnnounce = next
+			ts.mu.Unlock()
+		}
+		time.Sleep(time.Minute)
+	}
+}
+
+// announceTo sends an announce request for t to the tracker with the given event, which may be empty,
+// and returns the interval the tracker asks to be announced again after.
+func (ts *torrentStore) announceTo(t *torrent, event string) (time.Duration, error) {
+	u, err := url.Parse(ts.Announce)
+	if err != nil {
+		return 0, err
+	}
+	q := u.Query()
+	q.Set("info_hash", string(t.hash[:]))
+	q.Set("peer_id", string(ts.peerID[:]))
+	q.Set("port", strconv.Itoa(ts.Port))
+	q.Set("uploaded", strconv.FormatInt(atomic.LoadInt64(&t.uploaded), 10))
+	q.Set("downloaded", "0")
+	q.Set("left", "0")
+	q.Set("compact", "1")
+	if event != "" {
+		q.Set("event", event)
+	}
+	u.RawQuery = q.Encode()
+	resp, err := ts.client.Get(u.String())
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("tracker responded with %s", resp.Status)
+	}
+	v, err := bdecode(bytes.TrimSpace(b))
+	if err != nil {
+		return 0, fmt.Errorf("invalid tracker response: %v", err)
+	}
+	dict, ok := v.(map[string]interface{})
+	if !ok {
+		return 0, errors.New("invalid tracker response")
+	}
+	if reason, ok := dict["failure reason"].(string); ok {
+		return 0, fmt.Errorf("tracker refused: %s", reason)
+	}
+	if event == "started" {
+		ts.mu.Lock()
+		t.announced = true
+		ts.mu.Unlock()
+	}
+	if interval, ok := dict["interval"].(int64); ok && interval > 0 {
+		return time.Duration(interval) * time.Second, nil
+	}
+	return defaultAnnounceInterval, nil
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	errLogModePath = errors.New("managed by an append-only log")
+	errNotLog      = errors.New("not an append-only log")
+)
+
+// segmentTimeFormat is the time of the first append to a segment in its name.
+const segmentTimeFormat = "20060102T150405Z"
+
+// logMode makes the directories under a prefix append-only logs: the data appended to a log is stored in
+// segments, numbered in sequence, and the current segment is rotated when an append would take it beyond
+// SegmentSize bytes, or when SegmentAge has elapsed since its first append. 0 never rotates by that measure.
+type logMode struct {
+	SegmentSize int64
+	SegmentAge  time.Duration
+}
+
+// parseLogMode parses a log mode given as "prefix=size,age", like "/telemetry=16777216,1h".
+func parseLogMode(def string) (policy, error) {
+	i := strings.LastIndex(def, "=")
+	fields := strings.Split(def[i+1:], ",")
+	if i <= 0 || len(fields) != 2 {
+		return policy{}, fmt.Errorf("log mode %q must be given as prefix=size,age", def)
+	}
+	size, err := strconv.ParseInt(strings.TrimSpace(fields[0]), 10, 64)
+	if err != nil || size < 0 {
+		return policy{}, fmt.Errorf("invalid segment size in %q", def)
+	}
+	age, err := time.ParseDuration(strings.TrimSpace(fields[1]))
+	if err != nil || age < 0 {
+		return policy{}, fmt.Errorf("invalid segment age in %q", def)
+	}
+	return policy{Prefix: cleanPrefix(def[:i]), Log: &logMode{SegmentSize: size, SegmentAge: age}}, nil
+}
+
+// segment is a file of an append-only log.
+type segment struct {
+	Seq  int64  `json:"seq"`
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Start is the time of the first append to the segment, to the second, and End the time of the last one.
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Sealed reports that nothing will be appended to the segment anymore.
+	Sealed bool `json:"sealed"`
+}
+
+func segmentName(seq int64, start time.Time) string {
+	return fmt.Sprintf("%016d-%s.log", seq, start.UTC().Format(segmentTimeFormat))
+}
+
+// parseSegmentName returns the sequence number and the start time of the segment named name.
+func parseSegmentName(name string) (int64, time.Time, bool) {
+	parts := strings.SplitN(strings.TrimSuffix(name, ".log"), "-", 2)
+	if len(parts) != 2 || !strings.HasSuffix(name, ".log") {
+		return 0, time.Time{}, false
+	}
+	seq, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	start, err := time.Parse(segmentTimeFormat, parts[1])
+	if err != nil {
+		return 0, time.Time{}, false
+	}
+	return seq, start, true
+}
+
+// rotates tells whether appending size bytes at now starts a new segment after cur.
+func (m logMode) rotates(cur segment, size int64, now time.Time) bool {
+	return (m.SegmentSize > 0 && cur.Size > 0 && cur.Size+size > m.SegmentSize) ||
+		(m.SegmentAge > 0 && now.Sub(cur.Start) >= m.SegmentAge)
+}
+
+// segmentLogs keeps the current segment of the logs appended to, by path relative to the document root.
+type segmentLogs struct {
+	mu   sync.Mutex
+	logs map[string]*segmentLog
+}
+
+type segmentLog struct {
+	mu sync.Mutex
+	// current is the last segment, once the log has been listed; nil before.
+	current *segment
+}
+
+func newSegmentLogs() *segmentLogs {
+	return &segmentLogs{logs: map[string]*segmentLog{}}
+}
+
+func (sl *segmentLogs) log(rel string) *segmentLog {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	l, ok := sl.logs[rel]
+	if !ok {
+		l = &segmentLog{}
+		sl.logs[rel] = l
+	}
+	return l
+}
+
+// logModeOf returns the log under a prefix in log mode that urlPath, a path under /files/, names, if any.
+func (s Server) logModeOf(urlPath string) (string, logMode, bool) {
+	if !strings.HasPrefix(urlPath, "/files/") {
+		return "", logMode{}, false
+	}
+	rel := path.Clean("/" + toSlash(strings.TrimPrefix(urlPath, "/files/")))
+	mode, ok := s.logModeAt(rel)
+	return rel, mode, ok
+}
+
+// logModeAt returns the log mode of the prefix of rel, a path relative to the document root, if it is in log mode.
+func (s Server) logModeAt(rel string) (logMode, bool) {
+	p, ok := s.Policies.lookup(rel)
+	if !ok || p.Log == nil {
+		return logMode{}, false
+	}
+	return *p.Log, true
+}
+
+// checkLogModePath returns an error if rel, a path relative to the document root, is under a prefix in log mode,
+// whose segments uploads must not replace.
+func (s Server) checkLogModePath(rel string) error {
+	if _, ok := s.logModeAt(rel); ok {
+		return withStatus(http.StatusForbidden, fmt.Errorf("\"/files%s\" is %w", rel, errLogModePath))
+	}
+	return nil
+}
+
+// listSegments lists the segments of the log rel in sequence, sealing all but the last one, which is sealed once
+// it is too old to be appended to.
+func (s Server) listSegments(rel string, mode logMode, now time.Time) ([]segment, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(s.DocumentRoot, filepath.FromSlash(rel)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var segments []segment
+	for _, info := range infos {
+		seq, start, ok := parseSegmentName(info.Name())
+		if !ok || !info.Mode().IsRegular() {
+			continue
+		}
+		segments = append(segments, segment{
+			Seq:   seq,
+			Path:  path.Join(rel, info.Name()),
+			Size:  info.Size(),
+			Start: start,
+			End:   info.ModTime().UTC(),
+		})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].Seq < segments[j].Seq })
+	for i := range segments {
+		segments[i].Sealed = i < len(segments)-1 || (mode.SegmentAge > 0 && now.Sub(segments[i].Start) >= mode.SegmentAge)
+	}
+	return segments, nil
+}
+
+// appendSegment appends the content of temp, size bytes, to the current segment of the log rel, rotating it as
+// mode says, and returns the segment with the offset the content was appended at. The segment is truncated back
+// if the content cannot be written whole.
+func (s Server) appendSegment(rel string, mode logMode, temp string, size int64, now time.Time) (segment, int64, error) {
+	l := s.Segments.log(rel)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	dir := filepath.Join(s.DocumentRoot, filepath.FromSlash(rel))
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return segment{}, 0, err
+	}
+	if l.current == nil {
+		segments, err := s.listSegments(rel, mode, now)
+		if err != nil {
+			return segment{}, 0, err
+		}
+		if len(segments) > 0 {
+			l.current = &segments[len(segments)-1]
+		}
+	}
+	cur := l.current
+	if cur == nil || mode.rotates(*cur, size, now) {
+		var seq int64 = 1
+		if cur != nil {
+			seq = cur.Seq + 1
+		}
+		start := now.UTC().Truncate(time.Second)
+		cur = &segment{Seq: seq, Path: path.Join(rel, segmentName(seq, start)), Start: start}
+	}
+
+	src, err := os.Open(temp)
+	if err != nil {
+		return segment{}, 0, err
+	}
+	defer src.Close()
+	// snapshots copy segments up to the size they have, so they must not see half an append.
+	s.publishLock.RLock()
+	defer s.publishLock.RUnlock()
+	f, err := os.OpenFile(filepath.Join(s.DocumentRoot, filepath.FromSlash(cur.Path)), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return segment{}, 0, err
+	}
+	info, err := f.Stat()
+	if err == nil {
+		if _, err = copyBuffer(f, src); err != nil {
+			f.Truncate(info.Size())
+		}
+	}
+	if err == nil && s.Durable {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return segment{}, 0, err
+	}
+	next := *cur
+	next.Size = info.Size() + size
+	next.End = now.UTC()
+	l.current = &next
+	return next, info.Size(), nil
+}
+
+type appendResponse struct {
+	response
+	// Path is the segment the content was appended to.
+	Path    string `json:"path"`
+	Segment int64  `json:"segment"`
+	// Offset is where the content starts in the segment, and Size its size.
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+// handleAppend serves PATCH /files/(log), and POST with a body which is not a form, under a prefix in log mode:
+// the body is appended to the current segment of the log, and is authorized as an upload.
+func (s Server) handleAppend(w http.ResponseWriter, r *http.Request, rel string, mode logMode) {
+	ar := r.Clone(r.Context())
+	ar.Method = http.MethodPost
+	if err := s.checkToken(ar); s.isAuthenticationRequired(ar) && err != nil {
+		respondError(w, err)
+		return
+	}
+	if err := s.checkWritable(); err != nil {
+		respondError(w, err)
+		return
+	}
+	if isInternalName(strings.SplitN(strings.TrimPrefix(rel, "/"), "/", 2)[0]) || checkName(path.Base(rel)) != nil {
+		respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("invalid log name \"/files%s\"", rel)))
+		return
+	}
+	if info, err := os.Stat(filepath.Join(s.DocumentRoot, filepath.FromSlash(rel))); err == nil && !info.IsDir() {
+		respondError(w, withStatus(http.StatusConflict, fmt.Errorf("\"/files%s\" is %w", rel, errNotLog)))
+		return
+	}
+
+	entry := logger.WithFields(logrus.Fields{"path": "/files" + rel, "remote": clientIP(r)})
+	temp, err := ioutil.TempFile(s.spoolDir(), "append_")
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	defer os.Remove(temp.Name())
+	size, err := copyBuffer(temp, io.LimitReader(r.Body, s.MaxUploadSize+1))
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && size > s.MaxUploadSize {
+		err = errFileTooLarge
+	}
+	if err == nil && size == 0 {
+		err = withStatus(http.StatusBadRequest, errors.New("nothing to append"))
+	}
+	if err != nil {
+		logFailure(entry, err, "failed to receive the content to append")
+		respondError(w, err)
+		return
+	}
+	seg, offset, err := s.appendSegment(rel, mode, temp.Name(), size, time.Now())
+	if err != nil {
+		logFailure(entry, err, "failed to append to the log")
+		respondError(w, err)
+		return
+	}
+	entry.WithFields(logrus.Fields{"segment": seg.Seq, "offset": offset, "size": size}).Debug("appended to the log")
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, appendResponse{
+		response: response{OK: true},
+		Path:     "/files" + seg.Path,
+		Segment:  seg.Seq,
+		Offset:   offset,
+		Size:     size,
+	})
+}
+
+type segmentsResponse struct {
+	response
+	Path     string    `json:"path"`
+	Segments []segment `json:"segments"`
+}
+
+// handleSegments serves GET /segments/(log)?from=...&to=..., listing the segments of the log with appends between
+// the times given in RFC 3339, if any. With read=true, the content of the segments is sent instead, one after another.
+func (s Server) handleSegments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET,HEAD")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	rel := path.Clean("/" + toSlash(strings.TrimPrefix(r.URL.Path, "/segments/")))
+	if err := s.checkDownload(r, rel); err != nil {
+		respondError(w, err)
+		return
+	}
+	if s.EnableCORS {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+	mode, ok := s.logModeAt(rel)
+	if !ok || isInternalName(strings.SplitN(strings.TrimPrefix(rel, "/"), "/", 2)[0]) {
+		respondError(w, withStatus(http.StatusNotFound, fmt.Errorf("\"/files%s\" is %w", rel, errNotLog)))
+		return
+	}
+	var from, to time.Time
+	for name, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := r.URL.Query().Get(name); v != "" {
+			var err error
+			if *t, err = time.Parse(time.RFC3339, v); err != nil {
+				respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("invalid %s time %q (RFC 3339)", name, v)))
+				return
+			}
+		}
+	}
+	segments, err := s.listSegments(rel, mode, time.Now())
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	// segments overlap the range if their first append is not after it, and their last one not before it; the start
+	// is truncated to the second, so the range is too.
+	selected := []segment{}
+	for _, seg := range segments {
+		if (from.IsZero() || !seg.End.Before(from)) && (to.IsZero() || !seg.Start.After(to)) {
+			seg.Path = "/files" + seg.Path
+			selected = append(selected, seg)
+		}
+	}
+	if r.URL.Query().Get("read") != "true" {
+		w.WriteHeader(http.StatusOK)
+		writeJSON(w, segmentsResponse{response: response{OK: true}, Path: "/files" + rel, Segments: selected})
+		return
+	}
+
+	// the segments are sent as large as they were listed, so that the length is known up front.
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	var length int64
+	for _, seg := range selected {
+		s.publishLock.RLock()
+		f, err := os.Open(filepath.Join(s.DocumentRoot, filepath.FromSlash(strings.TrimPrefix(seg.Path, "/files"))))
+		s.publishLock.RUnlock()
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		files = append(files, f)
+		length += seg.Size
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	if len(selected) > 0 {
+		w.Header().Set("X-Segments", fmt.Sprintf("%d-%d", selected[0].Seq, selected[len(selected)-1].Seq))
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	for i, f := range files {
+		if _, err := copyBuffer(w, io.LimitReader(f, selected[i].Size)); err != nil {
+			logger.WithError(err).WithField("path", selected[i].Path).Info("failed to send a segment")
+			return
+		}
+	}
+}
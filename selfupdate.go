@@ -0,0 +1,379 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// defaultUpdateRepo is the GitHub repository whose releases the selfupdate command installs.
+	defaultUpdateRepo = "salykin/go-simple-upload-server"
+	// maxReleaseAsset bounds a downloaded release asset.
+	maxReleaseAsset = 256 << 20
+	// maxReleaseMetadata bounds the release description, the checksums and the signature.
+	maxReleaseMetadata = 1 << 20
+)
+
+var (
+	errNoReleaseAsset  = errors.New("no release asset")
+	errUnsignedRelease = errors.New("no keyring to verify the signature of the release with; pass -keyring, or -insecure to install it unverified")
+)
+
+// githubRelease is the part of a release returned by the GitHub API used by the selfupdate command.
+type githubRelease struct {
+	TagName string        `json:"tag_name"`
+	Assets  []githubAsset `json:"assets"`
+}
+
+type githubAsset struct {
+	Name string `json:"name"`
+	URL  string `json:"browser_download_url"`
+}
+
+// selfUpdate replaces the running binary by the one of a release on GitHub, for instances installed by hand.
+// The release must have a binary for this platform, named with its OS and architecture like
+// go-simple-upload-server_linux_amd64, optionally as a .tar.gz archive, and a checksums.txt file listing its SHA-256
+// digest, as made by sha256sum. checksums.txt must have a detached OpenPGP signature by a key of the keyring,
+// as checksums.txt.sig or checksums.txt.asc.
+type selfUpdate struct {
+	API     string
+	Repo    string
+	Tag     string
+	Keyring *signatureVerifier
+	// Insecure installs releases without a keyring, verified against their checksums only, which protects from
+	// corrupted downloads but not from tampered releases.
+	Insecure bool
+	// Force installs the release even if it is the running version.
+	Force  bool
+	client *http.Client
+}
+
+// runSelfUpdate runs the selfupdate command with its own options.
+func runSelfUpdate(args []string) int {
+	fs := flag.NewFlagSet("selfupdate", flag.ContinueOnError)
+	api := fs.String("api", "https://api.github.com", "URL of the GitHub API")
+	repo := fs.String("repo", defaultUpdateRepo, "GitHub repository to install releases from")
+	tag := fs.String("tag", "", "tag of the release to install (default: the latest release)")
+	keyring := fs.String("keyring", "", "path to the OpenPGP keyring checksums.txt must be signed with")
+	insecure := fs.Bool("insecure", false, "if true, install the release without -keyring, verified against its checksums only")
+	check := fs.Bool("check", false, "if true, only report whether a newer release is available")
+	force := fs.Bool("force", false, "if true, install the release even if it is the running version")
+	timeout := fs.Duration("timeout", 10*time.Minute, "time limit of the update")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage:\n  %s selfupdate [options]\n\nOptions:\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	u := selfUpdate{
+		API:      strings.TrimSuffix(*api, "/"),
+		Repo:     *repo,
+		Tag:      *tag,
+		Insecure: *insecure,
+		Force:    *force,
+		client:   &http.Client{},
+	}
+	if *keyring != "" {
+		v, err := newSignatureVerifier(*keyring)
+		if err != nil {
+			logger.WithError(err).Error("failed to load the keyring")
+			return 2
+		}
+		u.Keyring = v
+	} else if *insecure {
+		logger.Warn("no -keyring given, so the release is only verified against its checksums")
+	} else if !*check {
+		logger.WithError(errUnsignedRelease).Error("refusing to update")
+		return 2
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	release, err := u.release(ctx)
+	if err != nil {
+		logger.WithError(err).Error("failed to look up the release")
+		return 1
+	}
+	current := currentVersion().Version
+	entry := logger.WithFields(logrus.Fields{"current": current, "release": release.TagName})
+	if sameVersion(current, release.TagName) && !u.Force {
+		entry.Info("already up to date")
+		return 0
+	}
+	if *check {
+		entry.Info("a different release is available")
+		return 0
+	}
+	if err := u.install(ctx, release); err != nil {
+		entry.WithError(err).Error("failed to update")
+		return 1
+	}
+	entry.Info("updated; restart the server to run the new version")
+	return 0
+}
+
+// sameVersion compares versions with or without a leading "v".
+func sameVersion(a string, b string) bool {
+	return strings.TrimPrefix(a, "v") == strings.TrimPrefix(b, "v")
+}
+
+// get fetches url, up to limit bytes, into w.
+func (u selfUpdate) get(ctx context.Context, url string, w io.Writer, limit int64) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", "simple-upload-server/"+currentVersion().Version)
+	if strings.HasPrefix(url, u.API+"/") {
+		req.Header.Set("Accept", "application/vnd.github.v3+json")
+		// a token raises the rate limit of the API.
+		if token := os.Getenv("GITHUB_TOKEN"); token != "" {
+			req.Header.Set("Authorization", "token "+token)
+		}
+	}
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	n, err := io.Copy(w, io.LimitReader(resp.Body, limit+1))
+	if err == nil && n > limit {
+		err = fmt.Errorf("%s: larger than %d bytes", url, limit)
+	}
+	return err
+}
+
+// release looks up the release to install.
+func (u selfUpdate) release(ctx context.Context) (githubRelease, error) {
+	url := fmt.Sprintf("%s/repos/%s/releases/latest", u.API, u.Repo)
+	if u.Tag != "" {
+		url = fmt.Sprintf("%s/repos/%s/releases/tags/%s", u.API, u.Repo, u.Tag)
+	}
+	var b bytes.Buffer
+	var release githubRelease
+	if err := u.get(ctx, url, &b, maxReleaseMetadata); err != nil {
+		return release, err
+	}
+	if err := json.Unmarshal(b.Bytes(), &release); err != nil {
+		return release, fmt.Errorf("%s: %v", url, err)
+	}
+	return release, nil
+}
+
+// asset returns the asset of the release named name, or the first one for which match is true if name is empty.
+func (r githubRelease) asset(name string, match func(string) bool) (githubAsset, error) {
+	for _, a := range r.Assets {
+		if a.Name == name || (name == "" && match(a.Name)) {
+			return a, nil
+		}
+	}
+	if name == "" {
+		name = "for " + runtime.GOOS + "/" + runtime.GOARCH
+	}
+	return githubAsset{}, fmt.Errorf("%w %s in %s", errNoReleaseAsset, name, r.TagName)
+}
+
+// isPlatformAsset reports whether name is the binary of a release for this platform, or an archive of it.
+func isPlatformAsset(name string) bool {
+	lower := strings.ToLower(name)
+	found := false
+	for _, platform := range []string{runtime.GOOS + "_" + runtime.GOARCH, runtime.GOOS + "-" + runtime.GOARCH} {
+		// linux_arm must not match linux_arm64.
+		if i := strings.Index(lower, platform); i >= 0 {
+			rest := lower[i+len(platform):]
+			found = found || rest == "" || strings.ContainsAny(rest[:1], "._-")
+		}
+	}
+	if !found {
+		return false
+	}
+	for _, ext := range []string{".sha256", ".sig", ".asc", ".txt", ".zip"} {
+		if strings.HasSuffix(lower, ext) {
+			return false
+		}
+	}
+	return true
+}
+
+// install downloads the binary of release, verifies it, and swaps it with the running one.
+func (u selfUpdate) install(ctx context.Context, release githubRelease) error {
+	if u.Keyring == nil && !u.Insecure {
+		return errUnsignedRelease
+	}
+	binary, err := release.asset("", isPlatformAsset)
+	if err != nil {
+		return err
+	}
+	checksums, err := release.asset("checksums.txt", nil)
+	if err != nil {
+		return err
+	}
+	var sums bytes.Buffer
+	if err := u.get(ctx, checksums.URL, &sums, maxReleaseMetadata); err != nil {
+		return err
+	}
+	if u.Keyring != nil {
+		if err := u.verifyChecksums(ctx, release, sums.Bytes()); err != nil {
+			return err
+		}
+	}
+	want, err := releaseChecksum(sums.Bytes(), binary.Name)
+	if err != nil {
+		return err
+	}
+
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to locate the running binary: %v", err)
+	}
+	// the new binary is downloaded next to the running one, so that it is renamed into place.
+	f, err := ioutil.TempFile(filepath.Dir(exe), ".selfupdate_")
+	if err != nil {
+		return err
+	}
+	temp := f.Name()
+	defer os.Remove(temp)
+	h := sha256.New()
+	err = u.get(ctx, binary.URL, io.MultiWriter(f, h), maxReleaseAsset)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("%s: checksum mismatch: got %s, want %s", binary.Name, got, want)
+	}
+	logger.WithFields(logrus.Fields{"asset": binary.Name, "sha256": want}).Info("release downloaded and verified")
+	if strings.HasSuffix(strings.ToLower(binary.Name), ".tar.gz") || strings.HasSuffix(strings.ToLower(binary.Name), ".tgz") {
+		if err := extractBinary(temp); err != nil {
+			return fmt.Errorf("%s: %v", binary.Name, err)
+		}
+	}
+	if err := os.Chmod(temp, 0755); err != nil {
+		return err
+	}
+	// a binary for another platform or a broken one fails to run.
+	out, err := exec.CommandContext(ctx, temp, "version").Output()
+	if err != nil {
+		return fmt.Errorf("the new binary does not run: %v", err)
+	}
+	logger.WithField("version", strings.TrimSpace(string(out))).Info("new binary checked")
+	return swapBinary(exe, temp)
+}
+
+// verifyChecksums checks the detached signature of the checksums of release against the keyring.
+func (u selfUpdate) verifyChecksums(ctx context.Context, release githubRelease, sums []byte) error {
+	sigAsset, err := release.asset("checksums.txt.sig", nil)
+	if errors.Is(err, errNoReleaseAsset) {
+		sigAsset, err = release.asset("checksums.txt.asc", nil)
+	}
+	if err != nil {
+		return err
+	}
+	var sig bytes.Buffer
+	if err := u.get(ctx, sigAsset.URL, &sig, maxReleaseMetadata); err != nil {
+		return err
+	}
+	signer, err := u.Keyring.verify(bytes.NewReader(sums), sig.Bytes())
+	if err != nil {
+		return fmt.Errorf("%s: %w: %v", sigAsset.Name, errBadSignature, err)
+	}
+	logger.WithFields(logrus.Fields{
+		"key":    signer.PrimaryKey.KeyIdString(),
+		"signer": strings.Join(identityNames(signer), ", "),
+	}).Info("release signature verified")
+	return nil
+}
+
+// releaseChecksum returns the SHA-256 digest of name listed in sums, as written by sha256sum.
+func releaseChecksum(sums []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			if b, err := hex.DecodeString(fields[0]); err != nil || len(b) != sha256.Size {
+				return "", fmt.Errorf("invalid checksum of %s", name)
+			}
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("no checksum of %s", name)
+}
+
+// extractBinary replaces the .tar.gz archive in file by the executable file it contains.
+func extractBinary(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return errors.New("no executable file in the archive")
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg || (hdr.Mode&0111 == 0 && !strings.HasSuffix(strings.ToLower(hdr.Name), ".exe")) {
+			continue
+		}
+		b, err := ioutil.ReadAll(io.LimitReader(tr, maxReleaseAsset))
+		if err != nil {
+			return err
+		}
+		f.Close()
+		return ioutil.WriteFile(file, b, 0755)
+	}
+}
+
+// swapBinary moves the binary in temp to exe, keeping the previous one as exe.old to roll back to.
+// The running binary is renamed rather than replaced, which Windows does not allow.
+func swapBinary(exe string, temp string) error {
+	old := exe + ".old"
+	os.Remove(old)
+	if err := os.Rename(exe, old); err != nil {
+		return err
+	}
+	if err := renameFile(temp, exe); err != nil {
+		if rollbackErr := os.Rename(old, exe); rollbackErr != nil {
+			logger.WithError(rollbackErr).WithField("path", old).Error("failed to restore the previous binary")
+		}
+		return err
+	}
+	logger.WithFields(logrus.Fields{"path": exe, "previous": old}).Info("binary replaced")
+	return nil
+}
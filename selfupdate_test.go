@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+func newTestEntity(t *testing.T, name string) *openpgp.Entity {
+	e, err := openpgp.NewEntity(name, "", name+"@example.com", &packet.Config{RSABits: 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestSelfUpdateVerifiesSignature(t *testing.T) {
+	releaseKey, otherKey := newTestEntity(t, "release"), newTestEntity(t, "other")
+	binaryName := "go-simple-upload-server_" + runtime.GOOS + "_" + runtime.GOARCH
+	// the checksum does not match the binary, so that installing stops right after the verification.
+	sums := []byte(strings.Repeat("0", 64) + "  " + binaryName + "\n")
+	sign := func(signer *openpgp.Entity, signed []byte, armored bool) []byte {
+		var sig bytes.Buffer
+		var err error
+		if armored {
+			err = openpgp.ArmoredDetachSign(&sig, signer, bytes.NewReader(signed), nil)
+		} else {
+			err = openpgp.DetachSign(&sig, signer, bytes.NewReader(signed), nil)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig.Bytes()
+	}
+
+	for _, tc := range []struct {
+		name     string
+		sigName  string
+		sig      []byte
+		keyring  bool
+		insecure bool
+		err      error
+		fetched  bool
+	}{
+		{"no keyring", "checksums.txt.sig", sign(releaseKey, sums, false), false, false, errUnsignedRelease, false},
+		{"insecure", "", nil, false, true, nil, true},
+		{"signed", "checksums.txt.sig", sign(releaseKey, sums, false), true, false, nil, true},
+		{"armored", "checksums.txt.asc", sign(releaseKey, sums, true), true, false, nil, true},
+		// a keyring given with -insecure is still used.
+		{"insecure with keyring", "", nil, true, true, errNoReleaseAsset, true},
+		{"unsigned", "", nil, true, false, errNoReleaseAsset, true},
+		{"other key", "checksums.txt.sig", sign(otherKey, sums, false), true, false, errBadSignature, true},
+		{"other content", "checksums.txt.sig", sign(releaseKey, []byte("other"), false), true, false, errBadSignature, true},
+	} {
+		fetched := false
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fetched = true
+			switch r.URL.Path {
+			case "/" + binaryName:
+				w.Write([]byte("binary"))
+			case "/checksums.txt":
+				w.Write(sums)
+			case "/" + tc.sigName:
+				w.Write(tc.sig)
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		release := githubRelease{TagName: "v2.0.0", Assets: []githubAsset{
+			{Name: binaryName, URL: ts.URL + "/" + binaryName},
+			{Name: "checksums.txt", URL: ts.URL + "/checksums.txt"},
+		}}
+		if tc.sigName != "" {
+			release.Assets = append(release.Assets, githubAsset{Name: tc.sigName, URL: ts.URL + "/" + tc.sigName})
+		}
+		u := selfUpdate{API: ts.URL, Insecure: tc.insecure, client: ts.Client()}
+		if tc.keyring {
+			u.Keyring = &signatureVerifier{keyring: openpgp.EntityList{releaseKey}}
+		}
+
+		err := u.install(context.Background(), release)
+		ts.Close()
+		if tc.err == nil {
+			if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+				t.Errorf("%s: %v, want the binary verified against its checksum", tc.name, err)
+			}
+		} else if !errors.Is(err, tc.err) {
+			t.Errorf("%s: %v, want %v", tc.name, err, tc.err)
+		}
+		if fetched != tc.fetched {
+			t.Errorf("%s: fetched %v, want %v", tc.name, fetched, tc.fetched)
+		}
+	}
+}
+
+func TestRunSelfUpdateRequiresKeyring(t *testing.T) {
+	// refused before the release is looked up.
+	if code := runSelfUpdate([]string{"-api", "http://127.0.0.1:1"}); code != 2 {
+		t.Errorf("exit code %d, want 2", code)
+	}
+}
@@ -1,16 +1,18 @@
 package main
 
 import (
-	"crypto/sha1"
+	"context"
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
 	"path"
+	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -27,197 +29,399 @@ var (
 type Server struct {
 	DocumentRoot string
 	// MaxUploadSize limits the size of the uploaded content, specified with "byte".
-	MaxUploadSize    int64
-	SecureToken      string
+	MaxUploadSize int64
+	// SecureToken is replaced while the server runs if it is refreshed from a secret store.
+	SecureToken      *secretValue
 	EnableCORS       bool
 	ProtectedMethods []string
+	// PublicRead makes GET, HEAD and OPTIONS never require the token, and every other method always, instead of ProtectedMethods.
+	PublicRead bool
+	// Naming decides the names of files uploaded by POST.
+	Naming naming
+	// SmartFolders are virtual directories under /files/ listing the files which match their queries.
+	SmartFolders []smartFolder
+	// Policies are the rules applied to files under path prefixes.
+	Policies *policyStore
+	// Segments keeps the current segments of the append-only logs under the prefixes in log mode.
+	Segments *segmentLogs
+	// RBAC authorizes requests by the roles of users instead of ProtectedMethods; it is nil if disabled.
+	RBAC *rbacStore
+	// Home is the home directory of the user making the request, relative to the document root, in the copy
+	// serving a request confined to it; it is empty otherwise.
+	Home string
+	// HomeQuota limits the total size of the files in a home directory (unlimited if 0).
+	HomeQuota int64
+	// Captcha verifies the CAPTCHA responses required with uploads without credentials; it is nil if not required.
+	Captcha *captchaVerifier
+	// Authz is the external authorization service every request must be allowed by; it is nil if disabled.
+	Authz *authorizer
+	// QuarantineReports is the number of clients reporting a file as abusive which quarantines it (never if 0).
+	QuarantineReports int
+	// Moderation has uploaded files checked by a moderation API; it is nil if they are not.
+	Moderation *moderator
+	// Sandbox keeps uploaded files pending until an analysis service finds them clean; it is nil if it does not.
+	Sandbox *sandbox
+	// Converter serves images converted into other formats; it is nil if it does not.
+	Converter *imageConverter
+	// Signatures checks the signatures uploads must have; it is nil if none is required.
+	Signatures *signatureVerifier
+	// Manifests keeps a manifest of the files in each directory; it is nil if none is kept.
+	Manifests *manifestWriter
+	// Repos serves directories as Debian and RPM package repositories; it is nil if none is served.
+	Repos *packageRepos
+	// Registry serves the files under a prefix as a container registry; it is nil if none is served.
+	Registry *registry
+	// S3 serves the document root through the S3 API; it is nil if it is not served.
+	S3 *s3API
+	// TFStates serves the files under a prefix as Terraform states; it is nil if none is served.
+	TFStates *tfStates
+	// Logs appends the logs shipped to /logs/ to files under a prefix; it is nil if logs are not received.
+	Logs *logIngest
+	// LFS is the path of the directory of the Git LFS objects relative to the document root, empty if Git LFS is not served.
+	LFS string
+	// Prune removes the directories left empty by deletions, if not nil.
+	Prune *pruneOptions
+	// Mail emails uploads, if not nil.
+	Mail *mailer
+	// Chat announces uploads to chat channels, if not nil.
+	Chat *chatNotifier
+	// Events publishes changes to files to a message broker, if not nil.
+	Events *eventBus
+	// SurrogateKeys tags downloads with Surrogate-Key and Cache-Tag headers, for caching proxies and CDNs.
+	SurrogateKeys bool
+	// Purger purges changed files from caching proxies and CDNs, if not nil.
+	Purger *cachePurger
+	// AMQP stores the files sent to a message queue, if not nil.
+	AMQP *amqpIngest
+	// Stats collects the statistics of the dashboard, if not nil.
+	Stats *dashboardStats
+	// Callbacks are the URLs clients may ask to be called back at when their upload is processed.
+	Callbacks urlAllowlist
+	// Redirects are the absolute URLs forms may ask to be sent back to after an upload.
+	Redirects urlAllowlist
+	// Imports are the URLs files may be imported from with POST /files/(path)?action=import.
+	Imports urlAllowlist
+	// StateDir keeps the server's state; it is empty if not configured.
+	StateDir string
+	// Meta stores metadata of files; it is nil if no state directory is configured.
+	Meta *metaStore
+	// Storage watches the free space; it is nil if no watermark is configured.
+	Storage *storageMonitor
+	// Tiering moves idle files to cold storage; it is nil if disabled.
+	Tiering *tiering
+	// NormalizeNames normalizes file names to Unicode NFC.
+	NormalizeNames bool
+	// CaseCollision is what to do with a name which differs from an existing one only in case: "" to allow it,
+	// "reject" the upload, or "rename" it.
+	CaseCollision string
+	// Precompressed serves the .br or .gz variant stored next to a file instead of it, to clients which accept it.
+	Precompressed bool
+	// PathLimits bounds the depth and the length of the paths of stored files.
+	PathLimits pathLimits
+	// MultipartMemory limits the form fields of a multipart request besides the file, which are kept in memory.
+	MultipartMemory int64
+	// Durable makes uploads synced to the disk before they are reported as stored.
+	Durable bool
+	// SpoolDir keeps uploads in progress; the document root is used if empty.
+	SpoolDir string
+	// Signer signs URLs granting uploads without the token.
+	Signer *signer
+	// AuthorizeTTL is how long URLs returned by /upload/authorize are valid.
+	AuthorizeTTL time.Duration
+	// FileRequestTTL is how long links returned by /upload/request are valid unless they ask otherwise.
+	FileRequestTTL time.Duration
+	// ShareLinkTTL is how long links returned by /share are valid unless they ask otherwise.
+	ShareLinkTTL time.Duration
+	Transactions *transactions
+	// Sessions keeps the files preallocated for uploads in ranges.
+	Sessions *uploadSessions
+	// Torrents keeps the files seeded by BitTorrent; it is nil if disabled.
+	Torrents *torrentStore
+	// IPFS is the node stored files are added to; it is nil if disabled.
+	IPFS *ipfsNode
+	// Backups pushes backups to a remote target on a schedule; it is nil if disabled.
+	Backups *backups
+	// Tasks runs the scheduled tasks.
+	Tasks *scheduler
+	// Maintenance confines backups and tiering to time windows and a bandwidth cap; it is nil if unconfined.
+	Maintenance *maintenance
+	// Digests caches the digests of stored files.
+	Digests *digests
+	// ETag is how ETags of files are made: "strong" from their digests, or "weak" from their size and modification time.
+	ETag string
+	// publishLock is held exclusively while a transaction is committed or a snapshot is taken,
+	// and shared while files are stored or opened to be served.
+	publishLock *sync.RWMutex
+	// fileRequestLocks serializes the uploads to each folder of a file request.
+	fileRequestLocks *folderLocks
 }
 
 // NewServer creates a new simple-upload server.
 func NewServer(documentRoot string, maxUploadSize int64, token string, enableCORS bool, protectedMethods []string) Server {
+	secureToken := newSecretValue(token)
 	return Server{
 		DocumentRoot:     documentRoot,
 		MaxUploadSize:    maxUploadSize,
-		SecureToken:      token,
+		SecureToken:      secureToken,
 		EnableCORS:       enableCORS,
 		ProtectedMethods: protectedMethods,
+		Naming:           naming{Strategy: namingOriginal, Collision: collisionOverwrite},
+		// URLs are signed with the token unless given another key, and so follow its rotations.
+		Signer:           newSigner(secureToken),
+		AuthorizeTTL:     15 * time.Minute,
+		FileRequestTTL:   7 * 24 * time.Hour,
+		ShareLinkTTL:     7 * 24 * time.Hour,
+		Transactions:     newTransactions(time.Hour),
+		Sessions:         newUploadSessions(24 * time.Hour),
+		Policies:         newPolicyStore(nil),
+		Segments:         newSegmentLogs(),
+		Digests:          newDigests(digestSHA256),
+		MultipartMemory:  defaultMultipartMemory,
+		ETag:             etagStrong,
+		publishLock:      &sync.RWMutex{},
+		fileRequestLocks: newFolderLocks(),
 	}
 }
 
 func (s Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	if s.SurrogateKeys && strings.HasPrefix(r.URL.Path, "/files/") {
+		// errors are tagged too, so that a cached 404 goes once the file is uploaded.
+		setSurrogateKeys(w, cleanFilesPath(r.URL.Path))
+	}
+	if f, within, ok := s.smartFolderOf(r.URL.Path); ok {
+		s.handleSmartFolder(w, r, f, within)
+		return
+	}
+	if s.Manifests != nil && s.serveManifestIndex(w, r) {
+		return
+	}
 	if !rePathFiles.MatchString(r.URL.Path) {
-		w.WriteHeader(http.StatusNotFound)
-		writeError(w, fmt.Errorf("\"%s\" is not found", r.URL.Path))
+		respondError(w, fmt.Errorf("\"%s\" is %w", r.URL.Path, errNotFound))
 		return
 	}
 	if s.EnableCORS {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 	}
-	http.StripPrefix("/files/", http.FileServer(http.Dir(s.DocumentRoot))).ServeHTTP(w, r)
+	if isInternalName(strings.SplitN(strings.TrimPrefix(r.URL.Path, "/files/"), "/", 2)[0]) {
+		respondError(w, fmt.Errorf("\"%s\" is %w", r.URL.Path, errNotFound))
+		return
+	}
+	rel := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/files/"))
+	if s.Tiering != nil && s.serveCold(w, r, rel) {
+		return
+	}
+	if err := s.checkQuarantine(rel); err != nil {
+		respondError(w, err)
+		return
+	}
+	if s.serveChecksum(w, r, rel) {
+		return
+	}
+	s.setETag(w, rel)
+	s.setContentDisposition(w, rel)
+	if s.Precompressed && s.servePrecompressed(w, r, rel) {
+		return
+	}
+	if info, err := os.Stat(filepath.Join(s.DocumentRoot, filepath.FromSlash(rel))); err == nil && info.Mode().IsRegular() {
+		coalesceRanges(r, info.Size())
+	}
+	root := lockedFileSystem{fs: http.Dir(s.DocumentRoot), lock: s.publishLock}
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	http.StripPrefix("/files/", http.FileServer(root)).ServeHTTP(rec, r)
+	s.countGet(r, rel, rec.status)
 }
 
 func (s Server) handlePost(w http.ResponseWriter, r *http.Request) {
-	srcFile, info, err := r.FormFile("file")
+	if !isMultipart(r) {
+		respondError(w, http.ErrNotMultipart)
+		return
+	}
+	redirectTo, err := s.redirectTarget(r)
 	if err != nil {
-		logger.WithError(err).Error("failed to acquire the uploaded content")
-		w.WriteHeader(http.StatusInternalServerError)
-		writeError(w, err)
+		respondError(w, err)
 		return
 	}
-	defer srcFile.Close()
-	logger.Debug(info)
-	size, err := getSize(srcFile)
+	rcv, err := s.receive(w, r)
 	if err != nil {
-		logger.WithError(err).Error("failed to get the size of the uploaded content")
-		w.WriteHeader(http.StatusInternalServerError)
-		writeError(w, err)
+		logFailure(uploadLog(r.Context()), err, "failed to receive the uploaded content")
+		respondError(w, err)
 		return
 	}
-	if size > s.MaxUploadSize {
-		logger.WithField("size", size).Info("file size exceeded")
-		w.WriteHeader(http.StatusRequestEntityTooLarge)
-		writeError(w, errors.New("uploaded file size exceeds the limit"))
+	// the temporary file is moved into place on success, so this only cleans up on failure.
+	defer os.Remove(rcv.TempName)
+	if uploads := multipartUploads(r); len(uploads) > 1 || rcv.RelativePath != "" {
+		s.handleFolderUpload(w, r, uploads, redirectTo)
 		return
 	}
+	s.storePosted(w, r, rcv, redirectTo)
+}
 
-	body, err := ioutil.ReadAll(srcFile)
+// redirectTarget returns the URL an HTML form asks to be sent back to after the upload, if any: a relative URL,
+// or one allowed by Redirects, so that the server cannot be used to send people to any site.
+func (s Server) redirectTarget(r *http.Request) (string, error) {
+	redirectTo := r.FormValue("redirect")
+	if redirectTo == "" {
+		redirectTo = r.FormValue("success_action_redirect")
+	}
+	if redirectTo == "" {
+		return "", nil
+	}
+	u, err := url.Parse(redirectTo)
 	if err != nil {
-		logger.WithError(err).Error("failed to read the uploaded content")
-		w.WriteHeader(http.StatusInternalServerError)
-		writeError(w, err)
-		return
+		logger.WithError(err).WithField("redirect", redirectTo).Info("invalid redirect URL")
+		return "", withStatus(http.StatusBadRequest, fmt.Errorf("invalid redirect URL: %v", err))
 	}
-	filename := info.Filename
-	if filename == "" {
-		filename = fmt.Sprintf("%x", sha1.Sum(body))
+	if !isRelativeURL(redirectTo, u) && !s.Redirects.allows(u) {
+		logger.WithField("redirect", redirectTo).Info("redirect URL rejected")
+		return "", withStatus(http.StatusBadRequest, fmt.Errorf("redirect URL %q is not allowed", redirectTo))
 	}
+	return redirectTo, nil
+}
 
-	dstPath := path.Join(s.DocumentRoot, filename)
-	dstFile, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+// isRelativeURL reports whether raw, parsed as u, stays on the same site: it has neither scheme nor host, and does
+// not start with // or a backslash, which browsers take as the start of a host.
+func isRelativeURL(raw string, u *url.URL) bool {
+	raw = strings.TrimLeft(raw, " ")
+	return u.Scheme == "" && u.Host == "" && u.Opaque == "" &&
+		!strings.HasPrefix(raw, "//") && !strings.HasPrefix(raw, "/\\") && !strings.HasPrefix(raw, "\\")
+}
+
+// storePosted stores the content received by POST under a name given by the naming scheme.
+func (s Server) storePosted(w http.ResponseWriter, r *http.Request, rcv received, redirectTo string) {
+	rel, stored, err := s.storeReceived(r.Context(), &rcv)
 	if err != nil {
-		logger.WithError(err).WithField("path", dstPath).Error("failed to open the file")
-		w.WriteHeader(http.StatusInternalServerError)
-		writeError(w, err)
+		respondError(w, err)
 		return
 	}
-	defer dstFile.Close()
-	if written, err := dstFile.Write(body); err != nil {
-		logger.WithError(err).WithField("path", dstPath).Error("failed to write the content")
-		w.WriteHeader(http.StatusInternalServerError)
-		writeError(w, err)
-		return
-	} else if int64(written) != size {
-		logger.WithFields(logrus.Fields{
-			"size":    size,
-			"written": written,
-		}).Error("uploaded file size and written size differ")
-		w.WriteHeader(http.StatusInternalServerError)
-		writeError(w, fmt.Errorf("the size of uploaded content is %d, but %d bytes written", size, written))
+	if stored {
+		s.announce(s.newUploadEvent(r, rel, rcv.Size, rcv.Digest))
+	}
+	s.respondUploaded(w, r, path.Join(s.DocumentRoot, rel), rcv, redirectTo)
+}
+
+// storeReceived names the received content and moves it into place, unless the naming keeps an existing file
+// with the same content. It returns the path of the file relative to the document root, and whether it was stored.
+// rcv is updated if its content is changed on the way, like a sanitized SVG image.
+func (s Server) storeReceived(ctx context.Context, rcv *received) (string, bool, error) {
+	filename, keep, err := s.Naming.name(rcv.Filename, rcv.Digest, func(name string) bool {
+		_, err := os.Stat(path.Join(s.DocumentRoot, path.Clean("/"+s.inHome(name))))
+		return err == nil
+	})
+	if err == errNameCollision {
+		uploadLog(ctx).WithField("filename", rcv.Filename).Info("file name collision")
+		return "", false, err
+	} else if err != nil {
+		uploadLog(ctx).WithError(err).Error("failed to name the uploaded content")
+		return "", false, err
+	}
+
+	// names may contain slashes when made from a template, but must never escape the document root.
+	rel, err := s.storedPath(s.inHome(filename))
+	if err != nil {
+		return "", false, err
+	}
+	if keep {
+		return rel, false, nil
+	}
+	if err := s.checkOverwrite(rel); err != nil {
+		return "", false, err
+	}
+	if err := s.checkReceived(rel, rcv); err != nil {
+		return "", false, err
 	}
+	dstPath := path.Join(s.DocumentRoot, rel)
+	if err := s.commitFile(ctx, rcv.TempName, dstPath); err != nil {
+		logFailure(uploadLog(ctx).WithField("path", dstPath), err, "failed to store the uploaded content")
+		return "", false, err
+	}
+	s.recordDigest(rel, rcv.Digest)
+	s.recordFilename(rel, rcv.Filename)
+	s.startRetention(rel)
+	return rel, true, nil
+}
+
+// respondUploaded reports the file stored by POST to the client.
+func (s Server) respondUploaded(w http.ResponseWriter, r *http.Request, dstPath string, rcv received, redirectTo string) {
 	uploadedURL := strings.TrimPrefix(dstPath, s.DocumentRoot)
 	if !strings.HasPrefix(uploadedURL, "/") {
 		uploadedURL = "/" + uploadedURL
 	}
 	uploadedURL = "/files" + uploadedURL
-	logger.WithFields(logrus.Fields{
-		"path": dstPath,
-		"url":  uploadedURL,
-		"size": size,
+	tagUpload(r.Context(), auditLog()).WithFields(logrus.Fields{
+		"path":   dstPath,
+		"url":    uploadedURL,
+		"size":   rcv.Size,
+		"digest": s.Digests.label(rcv.Digest),
 	}).Info("file uploaded by POST")
 	if s.EnableCORS {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Expose-Headers", uploadIDHeader)
+	}
+	resp := s.newUploadedResponse(uploadedURL, rcv)
+	resp.CID = s.pinIPFS(r.Context(), strings.TrimPrefix(uploadedURL, "/files"))
+	s.notifyCallback(r, resp)
+	if redirectTo != "" {
+		location, _ := redirectURL(redirectTo, uploadedURL)
+		http.Redirect(w, r, location, http.StatusSeeOther)
+		return
 	}
 	w.WriteHeader(http.StatusOK)
-	writeSuccess(w, uploadedURL)
+	writeJSON(w, resp)
 }
 
 func (s Server) handlePut(w http.ResponseWriter, r *http.Request) {
 	matches := rePathFiles.FindStringSubmatch(r.URL.Path)
 	if matches == nil {
 		logger.WithField("path", r.URL.Path).Info("invalid path")
-		w.WriteHeader(http.StatusNotFound)
-		writeError(w, fmt.Errorf("\"%s\" is not found", r.URL.Path))
+		respondError(w, fmt.Errorf("\"%s\" is %w", r.URL.Path, errNotFound))
 		return
 	}
-	targetDir := path.Join(s.DocumentRoot, matches[1])
-	targetFilename := matches[2]
-	targetPath := path.Join(targetDir, targetFilename)
-
-	// We have to create a new temporary file in the same device to avoid "invalid cross-device link" on renaming.
-	// Here is the easiest solution: create it in the same directory.
-	tempFile, err := ioutil.TempFile(s.DocumentRoot, "upload_")
+	rel, err := s.storedPath(matches[1] + matches[2])
 	if err != nil {
-		logger.WithError(err).Error("failed to create a temporary file")
-		w.WriteHeader(http.StatusInternalServerError)
-		writeError(w, err)
+		respondError(w, err)
 		return
 	}
-	defer r.Body.Close()
-	srcFile, info, err := r.FormFile("file")
-	if err != nil {
-		logger.WithError(err).WithField("path", targetPath).Error("failed to acquire the uploaded content")
-		w.WriteHeader(http.StatusInternalServerError)
-		writeError(w, err)
+	targetPath := path.Join(s.DocumentRoot, rel)
+	if err := s.checkOverwrite(rel); err != nil {
+		respondError(w, err)
 		return
 	}
-	defer srcFile.Close()
-	// dump headers for the file
-	logger.Debug(info.Header)
 
-	size, err := getSize(srcFile)
+	defer r.Body.Close()
+	rcv, err := s.receive(w, r)
 	if err != nil {
-		logger.WithError(err).WithField("path", targetPath).Error("failed to get the size of the uploaded content")
-		w.WriteHeader(http.StatusInternalServerError)
-		writeError(w, err)
-		return
-	}
-	if size > s.MaxUploadSize {
-		logger.WithFields(logrus.Fields{
-			"path": targetPath,
-			"size": size,
-		}).Info("file size exceeded")
-		w.WriteHeader(http.StatusRequestEntityTooLarge)
-		writeError(w, errors.New("uploaded file size exceeds the limit"))
+		logFailure(uploadLog(r.Context()).WithField("path", targetPath), err, "failed to receive the uploaded content")
+		respondError(w, err)
 		return
 	}
-
-	n, err := io.Copy(tempFile, srcFile)
-	if err != nil {
-		logger.WithError(err).WithField("path", tempFile.Name()).Error("failed to write body to the file")
-		w.WriteHeader(http.StatusInternalServerError)
-		writeError(w, err)
+	if err := s.checkReceived(rel, &rcv); err != nil {
+		os.Remove(rcv.TempName)
+		respondError(w, err)
 		return
 	}
-	// excplicitly close file to flush, then rename from temp name to actual name in atomic file
-	// operation if on linux or other unix-like OS (windows hosts should look into https://github.com/natefinch/atomic
-	// package for atomic file write operations)
-	tempFile.Close()
-	
-	if err := os.MkdirAll(targetDir, 0777); err != nil {
-		os.Remove(tempFile.Name())
-		logger.WithError(err).WithField("path", targetPath).Error("failed to create directories")
-		w.WriteHeader(http.StatusInternalServerError)
-		writeError(w, err)
-		return
-        }
-	
-	if err := os.Rename(tempFile.Name(), targetPath); err != nil {
-		os.Remove(tempFile.Name())
-		logger.WithError(err).WithField("path", targetPath).Error("failed to rename temp file to final filename for upload")
-		w.WriteHeader(http.StatusInternalServerError)
-		writeError(w, err)
+	if err := s.commitFile(r.Context(), rcv.TempName, targetPath); err != nil {
+		logFailure(uploadLog(r.Context()).WithField("path", targetPath), err, "failed to store the uploaded content")
+		respondError(w, err)
 		return
 	}
 
-	logger.WithFields(logrus.Fields{
-		"path": r.URL.Path,
-		"size": n,
+	tagUpload(r.Context(), auditLog()).WithFields(logrus.Fields{
+		"path":   "/files" + rel,
+		"size":   rcv.Size,
+		"digest": s.Digests.label(rcv.Digest),
 	}).Info("file uploaded by PUT")
+	s.recordDigest(rel, rcv.Digest)
+	s.startRetention(rel)
+	s.announce(s.newUploadEvent(r, rel, rcv.Size, rcv.Digest))
+	resp := s.newUploadedResponse("/files"+rel, rcv)
+	resp.CID = s.pinIPFS(r.Context(), rel)
+	s.notifyCallback(r, resp)
 	if s.EnableCORS {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Expose-Headers", uploadIDHeader)
 	}
 	w.WriteHeader(http.StatusOK)
-	writeSuccess(w, r.URL.Path)
+	writeJSON(w, resp)
 }
 
 func (s Server) handleOptions(w http.ResponseWriter, r *http.Request) {
@@ -225,34 +429,95 @@ func (s Server) handleOptions(w http.ResponseWriter, r *http.Request) {
 	if rePathFiles.MatchString(r.URL.Path) {
 		allowedMethods = []string{http.MethodPut, http.MethodGet, http.MethodHead}
 	} else if rePathUpload.MatchString(r.URL.Path) {
-		allowedMethods = []string{http.MethodPost}
+		allowedMethods = []string{http.MethodPost, http.MethodHead}
+		s.setCapabilityHeaders(w)
 	} else {
-		w.WriteHeader(http.StatusNotFound)
-		writeError(w, errors.New("not found"))
+		respondError(w, errNotFound)
 		return
 	}
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Access-Control-Allow-Methods", strings.Join(allowedMethods, ","))
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, "+uploadIDHeader)
 	w.WriteHeader(http.StatusNoContent)
 }
 
 func (s Server) checkToken(r *http.Request) error {
+	defer addPhase(r.Context(), phaseAuth, time.Now())
+	if s.RBAC != nil {
+		return s.RBAC.authorize(r, s.SecureToken.get())
+	}
 	// first, try to get the token from the query strings
 	token := r.URL.Query().Get("token")
+	// then as a bearer token, for clients like Maven which cannot add it to the URL.
+	if auth := r.Header.Get("Authorization"); token == "" && strings.HasPrefix(auth, "Bearer ") {
+		token = strings.TrimPrefix(auth, "Bearer ")
+	}
 	// if token is not found, check the form parameter.
 	if token == "" {
 		token = r.FormValue("token")
 	}
 	if token == "" {
+		recordAuthFailure(r, errMissingToken)
 		return errMissingToken
 	}
-	if token != s.SecureToken {
+	if token != s.SecureToken.get() {
+		recordAuthFailure(r, errTokenMismatch)
 		return errTokenMismatch
 	}
 	return nil
 }
 
+// checkDownload authorizes r, made to an endpoint serving a view of the file rel, like a download of the file.
+func (s Server) checkDownload(r *http.Request, rel string) error {
+	fr := r.Clone(r.Context())
+	fr.URL.Path = "/files" + rel
+	fr.Method = http.MethodGet
+	if err := s.checkToken(fr); s.isAuthenticationRequired(fr) && err != nil {
+		return err
+	}
+	return nil
+}
+
+// withBasicToken returns r with the password of its Basic authentication, if any, as the bearer token,
+// for clients like docker, git and terraform which only send credentials that way.
+func withBasicToken(r *http.Request) *http.Request {
+	_, password, ok := r.BasicAuth()
+	if !ok {
+		return r
+	}
+	clone := *r
+	clone.Header = r.Header.Clone()
+	clone.Header.Set("Authorization", "Bearer "+password)
+	return &clone
+}
+
+// hasCredentials reports whether r carries credentials outside of its body: the token in the URL, a bearer token,
+// a client certificate, or a directory user and password with LDAP.
+func (s Server) hasCredentials(r *http.Request) bool {
+	return r.URL.Query().Get("token") != "" ||
+		strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") ||
+		(r.TLS != nil && len(r.TLS.VerifiedChains) > 0) ||
+		(s.RBAC != nil && s.RBAC.LDAP != nil && strings.HasPrefix(r.Header.Get("Authorization"), "Basic "))
+}
+
+// authenticate checks the credentials of r without authorizing it, which is left to checkToken since the path may
+// still change, e.g. into the home of the user.
+func (s Server) authenticate(r *http.Request) error {
+	if s.RBAC != nil {
+		_, err := s.RBAC.identify(r, s.SecureToken.get())
+		return err
+	}
+	return s.checkToken(r)
+}
+
 func (s Server) isAuthenticationRequired(r *http.Request) bool {
+	// with access control, every request is authorized, if only as made by the anonymous user.
+	if s.RBAC != nil {
+		return true
+	}
+	if s.PublicRead {
+		return r.Method != http.MethodGet && r.Method != http.MethodHead && r.Method != http.MethodOptions
+	}
 	for _, m := range s.ProtectedMethods {
 		if m == r.Method {
 			return true
@@ -262,24 +527,122 @@ func (s Server) isAuthenticationRequired(r *http.Request) bool {
 }
 
 func (s Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut && r.URL.Query().Get("signature") != "" {
+		if err := s.checkWritable(); err != nil {
+			respondError(w, err)
+			return
+		}
+		if _, err := s.callbackOf(r); err != nil {
+			respondError(w, err)
+			return
+		}
+		s.handleSignedPut(w, r)
+		return
+	}
+	if r.Method == http.MethodPost && r.URL.Query().Get("signature") != "" {
+		if err := s.checkWritable(); err != nil {
+			respondError(w, err)
+			return
+		}
+		s.handleFileRequestUpload(w, r)
+		return
+	}
+	if r.Method == http.MethodGet && r.URL.Query().Get("signature") != "" {
+		// a signed download link, as sent by email, grants the download without the token.
+		params, err := s.Signer.verify(r)
+		if err != nil {
+			logger.WithError(err).WithField("path", r.URL.Path).Info("signed download rejected")
+			respondError(w, err)
+			return
+		}
+		// and so does a share link, as many times as it allows.
+		if params.Get("max_downloads") != "" {
+			s.handleSharedDownload(w, r, params)
+			return
+		}
+		s.handleGet(w, r)
+		return
+	}
+	if s.RBAC != nil && s.RBAC.Homes {
+		var err error
+		if s, r, err = s.enterHome(r); err != nil {
+			respondError(w, err)
+			return
+		}
+	}
+	if r.Method == http.MethodPatch || (r.Method == http.MethodPost && !isMultipart(r)) {
+		// appends to logs are authorized as uploads, whatever their method.
+		if rel, mode, ok := s.logModeOf(r.URL.Path); ok {
+			s.handleAppend(w, r, rel, mode)
+			return
+		}
+	}
 	if err := s.checkToken(r); s.isAuthenticationRequired(r) && err != nil {
-		w.WriteHeader(http.StatusUnauthorized)
-		writeError(w, err)
+		// lets browsers ask for the directory credentials,
+		if s.RBAC != nil && s.RBAC.LDAP != nil && statusOf(err) == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Basic realm="simple-upload-server"`)
+		}
+		// and sends them to sign in with SAML.
+		if s.RBAC != nil && s.RBAC.SAML != nil && statusOf(err) == http.StatusUnauthorized && acceptsHTML(r) {
+			http.Redirect(w, r, "/saml/login?return="+url.QueryEscape(r.URL.RequestURI()), http.StatusSeeOther)
+			return
+		}
+		respondError(w, err)
 		return
 	}
 
 	switch r.Method {
 	case http.MethodGet, http.MethodHead:
+		if r.Method == http.MethodHead && rePathUpload.MatchString(r.URL.Path) {
+			s.setCapabilityHeaders(w)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
 		s.handleGet(w, r)
-	case http.MethodPost:
-		s.handlePost(w, r)
-	case http.MethodPut:
-		s.handlePut(w, r)
+	case http.MethodPost, http.MethodPut:
+		if err := s.checkWritable(); err != nil {
+			respondError(w, err)
+			return
+		}
+		if _, err := s.callbackOf(r); err != nil {
+			respondError(w, err)
+			return
+		}
+		if isImport(r) {
+			s.handleImport(w, r)
+			return
+		}
+		if isValidateOnly(r) {
+			s.handleValidateOnly(w, r)
+			return
+		}
+		if s.Captcha != nil && s.isAnonymous(r) {
+			if err := s.Captcha.verify(r.Context(), r); err != nil {
+				logFailure(logger.WithFields(logrus.Fields{"path": r.URL.Path, "remote": clientIP(r)}), err, "CAPTCHA rejected")
+				respondError(w, err)
+				return
+			}
+		}
+		if r.Method == http.MethodPost {
+			s.handlePost(w, r)
+		} else {
+			s.handlePut(w, r)
+		}
 	case http.MethodOptions:
 		s.handleOptions(w, r)
+	case "PURGE":
+		if s.Purger == nil {
+			respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+			return
+		}
+		// purges always require the token.
+		if err := s.checkToken(r); err != nil {
+			respondError(w, err)
+			return
+		}
+		s.handlePurge(w, r)
 	default:
 		w.Header().Add("Allow", "GET,HEAD,POST,PUT")
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		writeError(w, fmt.Errorf("method \"%s\" is not allowed", r.Method))
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
 	}
 }
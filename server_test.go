@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestRedirectTarget(t *testing.T) {
+	allowed, err := parseURLAllowlist([]string{"https://example.com/uploaded"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Server{Redirects: allowed}
+	for _, tc := range []struct {
+		redirect string
+		ok       bool
+	}{
+		{"", true},
+		{"/done.html", true},
+		{"done.html?x=1", true},
+		{"https://example.com/uploaded", true},
+		{"https://example.com/uploaded/thanks.html", true},
+		{"https://example.com/elsewhere", false},
+		{"https://evil.test/", false},
+		{"//evil.test/", false},
+		{" //evil.test/", false},
+		{"/\\evil.test/", false},
+		{"\\\\evil.test/", false},
+		{"javascript:alert(1)", false},
+		{"https://example.com/uploaded/../elsewhere", false},
+	} {
+		r := httptest.NewRequest("POST", "/upload?redirect="+url.QueryEscape(tc.redirect), nil)
+		got, err := s.redirectTarget(r)
+		if (err == nil) != tc.ok {
+			t.Errorf("redirectTarget(%q) = %q, %v; want ok %v", tc.redirect, got, err, tc.ok)
+		}
+		if err == nil && got != tc.redirect {
+			t.Errorf("redirectTarget(%q) = %q", tc.redirect, got)
+		}
+	}
+}
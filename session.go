@@ -0,0 +1,578 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// sessionContentName is the name of the preallocated file in the staging directory of an upload session.
+	sessionContentName = "content"
+	// sessionStateName is the name of the file keeping the state of an upload session in its staging directory,
+	// so that the session survives a restart.
+	sessionStateName = "session.json"
+)
+
+var (
+	rePathSessionFile   = regexp.MustCompile(`^/upload/sessions/files(/.*)?(/[^/]+)$`)
+	rePathSession       = regexp.MustCompile(`^/upload/sessions/([^/]+)$`)
+	rePathSessionCommit = regexp.MustCompile(`^/upload/sessions/([^/]+)/commit$`)
+	reContentRange      = regexp.MustCompile(`^bytes (\d+)-(\d+)/(\d+|\*)$`)
+
+	errSessionNotFound   = errors.New("upload session not found")
+	errSessionIncomplete = errors.New("upload session has missing ranges")
+)
+
+// byteRange is a range of bytes from Start up to, but not including, End.
+type byteRange struct {
+	Start, End int64
+}
+
+// MarshalText writes the range inclusively, as in Content-Range, e.g. "0-1023".
+func (b byteRange) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("%d-%d", b.Start, b.End-1)), nil
+}
+
+// UnmarshalText reads a range written by MarshalText.
+func (b *byteRange) UnmarshalText(text []byte) error {
+	var last int64
+	if _, err := fmt.Sscanf(string(text), "%d-%d", &b.Start, &last); err != nil {
+		return fmt.Errorf("invalid range %q", text)
+	}
+	b.End = last + 1
+	return nil
+}
+
+// uploadSession is a file of a declared size, preallocated in a staging directory and filled by ranged PUTs.
+type uploadSession struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+	// Received is the number of bytes received so far, in Ranges.
+	Received int64       `json:"received"`
+	Ranges   []byteRange `json:"ranges"`
+	Created  time.Time   `json:"created"`
+	Updated  time.Time   `json:"updated"`
+	// Transfer records the throughput of the ranges received, for the progress of the session.
+	Transfer sessionTransfer `json:"transfer"`
+	rel      string
+	dir      string
+	// writing is the number of ranges being written; committing is set while the session is being committed.
+	writing    int
+	committing bool
+}
+
+// uploadSessions keeps the open upload sessions.
+type uploadSessions struct {
+	mu   sync.Mutex
+	byID map[string]*uploadSession
+	// timeout is how long a session is kept without any range written.
+	timeout time.Duration
+}
+
+type sessionResponse struct {
+	response
+	*uploadSession
+	Progress sessionProgress `json:"progress"`
+}
+
+func newSessionResponse(u *uploadSession) sessionResponse {
+	return sessionResponse{response: response{OK: true}, uploadSession: u, Progress: u.progress()}
+}
+
+func newUploadSessions(timeout time.Duration) *uploadSessions {
+	return &uploadSessions{byID: map[string]*uploadSession{}, timeout: timeout}
+}
+
+// contentPath returns the path of the preallocated file.
+func (u *uploadSession) contentPath() string {
+	return filepath.Join(u.dir, sessionContentName)
+}
+
+// mergeRanges sorts ranges and merges the adjacent or overlapping ones, in place.
+func mergeRanges(ranges []byteRange) []byteRange {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	merged := ranges[:1]
+	for _, next := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if next.Start <= last.End {
+			if next.End > last.End {
+				last.End = next.End
+			}
+			continue
+		}
+		merged = append(merged, next)
+	}
+	return merged
+}
+
+// statePath returns the path of the file keeping the state of the session.
+func (u *uploadSession) statePath() string {
+	return filepath.Join(u.dir, sessionStateName)
+}
+
+// save writes the state of the session into its staging directory. It is called with the lock of the sessions held,
+// once the ranges it lists are written, so that a restored session never claims bytes it did not receive.
+func (u *uploadSession) save() error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomically(u.statePath(), b)
+}
+
+// complete reports whether all bytes have been received.
+func (u *uploadSession) complete() bool {
+	return u.Received == u.Size
+}
+
+// add records that r has been written, merging it with the adjacent or overlapping ranges.
+func (u *uploadSession) add(r byteRange) {
+	merged := mergeRanges(append(u.Ranges, r))
+	u.Ranges = merged
+	u.Received = 0
+	for _, r := range merged {
+		u.Received += r.End - r.Start
+	}
+	u.Updated = time.Now()
+}
+
+// restore loads the sessions left in the staging directories of root by a previous run. The staging directories
+// of the sessions which cannot be restored are removed.
+func (s *uploadSessions) restore(root string) {
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		logger.WithError(err).Warn("failed to look for upload sessions to restore")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range entries {
+		if !e.IsDir() || !isInternalName(e.Name()) {
+			continue
+		}
+		dir := filepath.Join(root, e.Name())
+		b, err := ioutil.ReadFile(filepath.Join(dir, sessionStateName))
+		if os.IsNotExist(err) {
+			continue
+		}
+		u := &uploadSession{}
+		if err == nil {
+			err = json.Unmarshal(b, u)
+		}
+		if err == nil {
+			err = u.restored(dir)
+		}
+		if err != nil {
+			logger.WithError(err).WithField("path", e.Name()).Warn("failed to restore an upload session, removing it")
+			os.RemoveAll(dir)
+			continue
+		}
+		s.byID[u.ID] = u
+		logger.WithFields(logrus.Fields{
+			"session":  u.ID,
+			"path":     u.Path,
+			"received": u.Received,
+			"size":     u.Size,
+		}).Info("upload session restored")
+	}
+}
+
+// restored checks a session read from the staging directory dir, and fills in what is not saved.
+func (u *uploadSession) restored(dir string) error {
+	if u.ID != strings.TrimPrefix(filepath.Base(dir), stagingPrefix) || !strings.HasPrefix(u.Path, "/files/") {
+		return errors.New("the session does not belong to its staging directory")
+	}
+	u.dir = dir
+	u.rel = path.Clean(strings.TrimPrefix(u.Path, "/files"))
+	info, err := os.Stat(u.contentPath())
+	if err != nil {
+		return err
+	}
+	if info.Size() != u.Size {
+		return fmt.Errorf("the content has %d bytes instead of %d", info.Size(), u.Size)
+	}
+	if u.Ranges == nil {
+		u.Ranges = []byteRange{}
+	}
+	if u.Transfer.Chunks == nil {
+		u.Transfer.Chunks = []sessionChunk{}
+	}
+	u.Received = 0
+	for _, r := range u.Ranges {
+		if r.Start < 0 || r.End > u.Size || r.End <= r.Start {
+			return fmt.Errorf("invalid range %d-%d", r.Start, r.End-1)
+		}
+		u.Received += r.End - r.Start
+	}
+	return nil
+}
+
+// expire aborts the sessions to which nothing has been written for longer than the timeout. It never returns.
+func (s *uploadSessions) expire() {
+	for range time.Tick(time.Minute) {
+		s.mu.Lock()
+		for id, u := range s.byID {
+			if u.writing == 0 && !u.committing && time.Since(u.Updated) > s.timeout {
+				logger.WithField("session", id).Info("upload session expired")
+				os.RemoveAll(u.dir)
+				delete(s.byID, id)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s Server) handleUploadSession(w http.ResponseWriter, r *http.Request) {
+	// sessions always change stored files, so the token is always required.
+	if err := s.checkToken(r); err != nil {
+		respondError(w, err)
+		return
+	}
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		if err := s.checkWritable(); err != nil {
+			respondError(w, err)
+			return
+		}
+	}
+	if m := rePathSessionFile.FindStringSubmatch(r.URL.Path); m != nil && r.Method == http.MethodPost {
+		rel, err := s.storedPath(m[1] + m[2])
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		s.beginUploadSession(w, r, rel)
+		return
+	}
+	if m := rePathSessionCommit.FindStringSubmatch(r.URL.Path); m != nil && r.Method == http.MethodPost {
+		s.commitUploadSession(w, r, m[1])
+		return
+	}
+	if m := rePathSession.FindStringSubmatch(r.URL.Path); m != nil {
+		switch r.Method {
+		case http.MethodGet:
+			s.Sessions.mu.Lock()
+			defer s.Sessions.mu.Unlock()
+			u, ok := s.Sessions.byID[m[1]]
+			if !ok {
+				respondError(w, withStatus(http.StatusNotFound, errSessionNotFound))
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			writeJSON(w, newSessionResponse(u))
+		case http.MethodPut:
+			s.writeSessionRange(w, r, m[1])
+		case http.MethodDelete:
+			s.abortUploadSession(w, r, m[1])
+		default:
+			w.Header().Set("Allow", "GET,PUT,DELETE")
+			respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		}
+		return
+	}
+	respondError(w, fmt.Errorf("\"%s\" is %w", r.URL.Path, errNotFound))
+}
+
+// beginUploadSession preallocates a file of the size given by the "size" parameter, to be stored at rel once filled.
+func (s Server) beginUploadSession(w http.ResponseWriter, r *http.Request, rel string) {
+	v := r.URL.Query().Get("size")
+	size, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || size < 0 {
+		respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("invalid size %q", v)))
+		return
+	}
+	if size > s.MaxUploadSize {
+		respondError(w, errFileTooLarge)
+		return
+	}
+	if err := s.checkExtension(rel); err != nil {
+		respondError(w, err)
+		return
+	}
+	if err := s.checkOverwrite(rel); err != nil {
+		respondError(w, err)
+		return
+	}
+	// the staging directory is in the document root, so that the allocated file is renamed into place as it is.
+	dir, err := ioutil.TempDir(s.DocumentRoot, stagingPrefix)
+	if err != nil {
+		logger.WithError(err).Error("failed to create a staging directory")
+		respondError(w, err)
+		return
+	}
+	now := time.Now()
+	u := &uploadSession{
+		ID:       strings.TrimPrefix(filepath.Base(dir), stagingPrefix),
+		Path:     "/files" + rel,
+		Size:     size,
+		Ranges:   []byteRange{},
+		Transfer: sessionTransfer{Chunks: []sessionChunk{}},
+		Created:  now,
+		Updated:  now,
+		rel:      rel,
+		dir:      dir,
+	}
+	f, err := os.Create(u.contentPath())
+	if err == nil {
+		err = preallocate(f, size)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err == nil {
+		err = u.save()
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		logFailure(logger.WithFields(logrus.Fields{"path": u.Path, "size": size}), err, "failed to preallocate the upload")
+		respondError(w, err)
+		return
+	}
+	s.Sessions.mu.Lock()
+	s.Sessions.byID[u.ID] = u
+	s.Sessions.mu.Unlock()
+	// the ranges and the commit of the session are logged under its ID.
+	w.Header().Set(uploadIDHeader, u.ID)
+	logger.WithFields(logrus.Fields{
+		"upload_id": u.ID,
+		"session":   u.ID,
+		"path":      u.Path,
+		"size":      size,
+	}).Info("upload session started")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, newSessionResponse(u))
+}
+
+// parseContentRange parses the Content-Range header of a ranged PUT into a range of a file of the given size.
+func parseContentRange(header string, size int64) (byteRange, error) {
+	m := reContentRange.FindStringSubmatch(header)
+	if m == nil {
+		return byteRange{}, withStatus(http.StatusBadRequest, fmt.Errorf("invalid Content-Range %q", header))
+	}
+	start, err1 := strconv.ParseInt(m[1], 10, 64)
+	last, err2 := strconv.ParseInt(m[2], 10, 64)
+	if err1 != nil || err2 != nil || last < start {
+		return byteRange{}, withStatus(http.StatusBadRequest, fmt.Errorf("invalid Content-Range %q", header))
+	}
+	if last >= size || (m[3] != "*" && m[3] != strconv.FormatInt(size, 10)) {
+		return byteRange{}, withStatus(http.StatusRequestedRangeNotSatisfiable, fmt.Errorf("Content-Range %q is outside of the %d bytes of the file", header, size))
+	}
+	return byteRange{Start: start, End: last + 1}, nil
+}
+
+// offsetWriter writes sequentially to f from an offset.
+type offsetWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (o *offsetWriter) Write(b []byte) (int, error) {
+	n, err := o.f.WriteAt(b, o.off)
+	o.off += int64(n)
+	return n, err
+}
+
+// writeSessionRange writes the body of a PUT into the file of a session, at the range given by Content-Range.
+// Ranges may be written in any order, concurrently, and again.
+func (s Server) writeSessionRange(w http.ResponseWriter, r *http.Request, id string) {
+	defer r.Body.Close()
+	s.Sessions.mu.Lock()
+	u, ok := s.Sessions.byID[id]
+	busy := ok && u.committing
+	if ok && !busy {
+		u.writing++
+	}
+	s.Sessions.mu.Unlock()
+	if !ok {
+		respondError(w, withStatus(http.StatusNotFound, errSessionNotFound))
+		return
+	}
+	if busy {
+		respondError(w, withStatus(http.StatusConflict, fmt.Errorf("upload session %s is being committed", id)))
+		return
+	}
+	defer func() {
+		s.Sessions.mu.Lock()
+		u.writing--
+		s.Sessions.mu.Unlock()
+	}()
+
+	br, err := parseContentRange(r.Header.Get("Content-Range"), u.Size)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	length := br.End - br.Start
+	if r.ContentLength >= 0 && r.ContentLength != length {
+		respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("Content-Length %d does not match the %d bytes of Content-Range", r.ContentLength, length)))
+		return
+	}
+	entry := uploadLog(r.Context()).WithFields(logrus.Fields{"session": id, "range": r.Header.Get("Content-Range")})
+	f, err := os.OpenFile(u.contentPath(), os.O_WRONLY, 0)
+	if err != nil {
+		logFailure(entry, err, "failed to open the upload session")
+		respondError(w, err)
+		return
+	}
+	defer f.Close()
+	started := time.Now()
+	n, err := copyBuffer(&offsetWriter{f: f, off: br.Start}, contextReader{ctx: r.Context(), r: io.LimitReader(r.Body, length)})
+	if err == nil && n < length {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == nil && s.Durable {
+		err = f.Sync()
+	}
+	if err != nil {
+		logFailure(entry, err, "failed to write the range")
+		respondError(w, err)
+		return
+	}
+
+	s.Sessions.mu.Lock()
+	u.add(br)
+	u.Transfer.record(br, started, time.Now())
+	if err := u.save(); err != nil {
+		// the range is written anyway; it is only lost if the server restarts before the next one.
+		logFailure(entry, err, "failed to save the upload session")
+	}
+	status := *u
+	status.Ranges = append([]byteRange{}, u.Ranges...)
+	status.Transfer.Chunks = append([]sessionChunk{}, u.Transfer.Chunks...)
+	s.Sessions.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, newSessionResponse(&status))
+}
+
+// commitUploadSession moves the filled file of a session into place, once all of its ranges have been received.
+func (s Server) commitUploadSession(w http.ResponseWriter, r *http.Request, id string) {
+	s.Sessions.mu.Lock()
+	u, ok := s.Sessions.byID[id]
+	var err error
+	switch {
+	case !ok:
+		err = withStatus(http.StatusNotFound, errSessionNotFound)
+	case u.committing:
+		err = withStatus(http.StatusConflict, fmt.Errorf("upload session %s is being committed", id))
+	case u.writing > 0:
+		err = withStatus(http.StatusConflict, fmt.Errorf("upload session %s has ranges being written", id))
+	case !u.complete():
+		err = withStatus(http.StatusConflict, fmt.Errorf("%w: %d of %d bytes received", errSessionIncomplete, u.Received, u.Size))
+	default:
+		u.committing = true
+	}
+	s.Sessions.mu.Unlock()
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	committed := false
+	defer func() {
+		s.Sessions.mu.Lock()
+		defer s.Sessions.mu.Unlock()
+		if committed {
+			delete(s.Sessions.byID, id)
+			os.RemoveAll(u.dir)
+		} else {
+			// the session is kept, so that the commit can be retried.
+			u.committing = false
+			u.Updated = time.Now()
+		}
+	}()
+
+	entry := uploadLog(r.Context()).WithFields(logrus.Fields{"session": id, "path": u.Path})
+	if err := s.checkOverwrite(u.rel); err != nil {
+		respondError(w, err)
+		return
+	}
+	// the signature of the whole content comes with the commit.
+	sig, err := signatureOf(r)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	rcv := received{TempName: u.contentPath(), Size: u.Size, Signature: sig}
+	if err := s.checkReceived(u.rel, &rcv); err != nil {
+		respondError(w, err)
+		return
+	}
+	// the ranges came in any order, so the content can only be hashed now.
+	sum, err := hashFile(u.contentPath(), s.Digests.hash())
+	if err != nil {
+		logFailure(entry, err, "failed to hash the upload session")
+		respondError(w, err)
+		return
+	}
+	// unlike commitFile, the file is kept on failure.
+	targetPath := path.Join(s.DocumentRoot, u.rel)
+	err = os.MkdirAll(path.Dir(targetPath), 0777)
+	if err == nil {
+		s.publishLock.RLock()
+		err = renameFile(u.contentPath(), targetPath)
+		s.publishLock.RUnlock()
+	}
+	if err == nil && s.Durable {
+		err = syncDir(path.Dir(targetPath))
+	}
+	if err != nil {
+		logFailure(entry, err, "failed to store the uploaded content")
+		respondError(w, err)
+		return
+	}
+	committed = true
+
+	rcv.Digest = sum
+	tagUpload(r.Context(), auditLog()).WithFields(logrus.Fields{
+		"session": id,
+		"path":    u.Path,
+		"size":    rcv.Size,
+		"digest":  s.Digests.label(sum),
+	}).Info("file uploaded by session")
+	s.recordDigest(u.rel, sum)
+	s.startRetention(u.rel)
+	s.announce(s.newUploadEvent(r, u.rel, rcv.Size, sum))
+	resp := s.newUploadedResponse(u.Path, rcv)
+	resp.CID = s.pinIPFS(r.Context(), u.rel)
+	s.notifyCallback(r, resp)
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, resp)
+}
+
+func (s Server) abortUploadSession(w http.ResponseWriter, r *http.Request, id string) {
+	s.Sessions.mu.Lock()
+	u, ok := s.Sessions.byID[id]
+	busy := ok && u.committing
+	if ok && !busy {
+		delete(s.Sessions.byID, id)
+	}
+	s.Sessions.mu.Unlock()
+	if !ok {
+		respondError(w, withStatus(http.StatusNotFound, errSessionNotFound))
+		return
+	}
+	if busy {
+		respondError(w, withStatus(http.StatusConflict, fmt.Errorf("upload session %s is being committed", id)))
+		return
+	}
+	if err := os.RemoveAll(u.dir); err != nil {
+		uploadLog(r.Context()).WithError(err).WithField("session", id).Warn("failed to remove the staging directory")
+	}
+	uploadLog(r.Context()).WithField("session", id).Info("upload session aborted")
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, response{OK: true})
+}
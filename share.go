@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// shareResponse describes a share link: a signed download link which can be used a limited number of times.
+type shareResponse struct {
+	response
+	URL          string    `json:"url"`
+	Path         string    `json:"path"`
+	Expires      time.Time `json:"expires"`
+	MaxDownloads int       `json:"max_downloads"`
+	Delete       bool      `json:"delete,omitempty"`
+}
+
+// handleShare serves POST /share, which returns a signed link to download a file without the token, at most
+// max_downloads times, after which the file is deleted if delete is true.
+func (s Server) handleShare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	if err := s.checkToken(r); err != nil {
+		respondError(w, err)
+		return
+	}
+	filename := strings.TrimPrefix(toSlash(r.FormValue("path")), "/files/")
+	rel := path.Clean("/" + filename)
+	if rel == "/" || isInternalName(strings.SplitN(rel[1:], "/", 2)[0]) {
+		respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("invalid file name %q", filename)))
+		return
+	}
+	if info, err := os.Stat(filepath.Join(s.DocumentRoot, filepath.FromSlash(rel))); err != nil || !info.Mode().IsRegular() {
+		respondError(w, fmt.Errorf("\"/files%s\" is %w", rel, errNotFound))
+		return
+	}
+	ttl := s.ShareLinkTTL
+	if v := r.FormValue("ttl"); v != "" {
+		var err error
+		if ttl, err = time.ParseDuration(v); err != nil || ttl <= 0 {
+			respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("invalid ttl %q", v)))
+			return
+		}
+	}
+	maxDownloads := 1
+	if v := r.FormValue("max_downloads"); v != "" {
+		var err error
+		if maxDownloads, err = strconv.Atoi(v); err != nil || maxDownloads < 1 {
+			respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("invalid max_downloads %q", v)))
+			return
+		}
+	}
+	burn := r.FormValue("delete") == "true"
+	if burn {
+		// a file which must be kept would outlive the link anyway.
+		if err := s.checkOverwrite(rel); err != nil {
+			respondError(w, err)
+			return
+		}
+	}
+
+	params := url.Values{}
+	params.Set("max_downloads", strconv.Itoa(maxDownloads))
+	if burn {
+		params.Set("delete", "true")
+	}
+	params.Set("nonce", newNonce())
+	urlPath := "/files" + rel
+	expires := time.Now().Add(ttl)
+	signed := s.Signer.sign(http.MethodGet, urlPath, params, expires)
+	auditLog().WithFields(logrus.Fields{
+		"path":          urlPath,
+		"max_downloads": maxDownloads,
+		"delete":        burn,
+		"expires":       expires.UTC().Format(time.RFC3339),
+		"remote":        r.RemoteAddr,
+	}).Info("share link created")
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, shareResponse{
+		response:     response{OK: true},
+		URL:          (&url.URL{Path: urlPath, RawQuery: signed.Encode()}).String(),
+		Path:         urlPath,
+		Expires:      expires,
+		MaxDownloads: maxDownloads,
+		Delete:       burn,
+	})
+}
+
+// handleSharedDownload serves a download by a link returned by handleShare, with its signed params, if it has not
+// been used up. Only complete downloads of the whole file count, and the file is deleted after the last one if
+// the link says so.
+func (s Server) handleSharedDownload(w http.ResponseWriter, r *http.Request, params url.Values) {
+	nonce := params.Get("nonce")
+	maxDownloads, _ := strconv.Atoi(params.Get("max_downloads"))
+	expires, _ := strconv.ParseInt(params.Get("expires"), 10, 64)
+	n, err := s.Signer.countDownload(nonce, maxDownloads, time.Unix(expires, 0))
+	if err != nil {
+		logger.WithError(err).WithField("path", r.URL.Path).Info("shared download rejected")
+		respondError(w, err)
+		return
+	}
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	s.handleGet(rec, r)
+	// only the whole file counts: not a HEAD, a range, a 304 or a transfer the client aborted.
+	complete := r.Method == http.MethodGet && rec.status == http.StatusOK &&
+		w.Header().Get("Content-Length") == strconv.FormatInt(rec.written, 10)
+	if !complete {
+		s.Signer.uncountDownload(nonce)
+		return
+	}
+	if n == maxDownloads && params.Get("delete") == "true" {
+		s.burn(r, path.Clean("/"+strings.TrimPrefix(r.URL.Path, "/files/")))
+	}
+}
+
+// burn deletes the file rel after the last download by its share link.
+func (s Server) burn(r *http.Request, rel string) {
+	if err := s.checkOverwrite(rel); err != nil {
+		logger.WithError(err).WithField("path", "/files"+rel).Warn("failed to delete the file after its last download")
+		return
+	}
+	name := filepath.Join(s.DocumentRoot, filepath.FromSlash(rel))
+	s.publishLock.Lock()
+	err := os.Remove(name)
+	if err == nil {
+		s.removeEmptyDirs(path.Dir(rel))
+	}
+	s.publishLock.Unlock()
+	if err != nil {
+		logger.WithError(err).WithField("path", "/files"+rel).Warn("failed to delete the file after its last download")
+		return
+	}
+	s.forget(rel)
+	auditLog().WithFields(logrus.Fields{"path": "/files" + rel, "remote": clientIP(r)}).Info("file deleted after its last download")
+	s.emit(fileEvent{Type: eventDelete, Path: "/files" + rel, Actor: clientIP(r)})
+}
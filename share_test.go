@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSharedDownloadCountsCompleteDownloads(t *testing.T) {
+	root, err := ioutil.TempDir("", "share")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := ioutil.WriteFile(filepath.Join(root, "offer.pdf"), []byte("0123456789"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(root, 1024, "secret", false, nil)
+	params := url.Values{"max_downloads": {"1"}, "nonce": {newNonce()}}
+	signed := s.Signer.sign(http.MethodGet, "/files/offer.pdf", params, time.Now().Add(time.Hour))
+
+	download := func(method string, header http.Header) int {
+		r := httptest.NewRequest(method, "/files/offer.pdf?"+signed.Encode(), nil)
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		s.handleSharedDownload(w, r, signed)
+		return w.Code
+	}
+	for _, tc := range []struct {
+		method string
+		header http.Header
+		want   int
+	}{
+		{http.MethodHead, nil, http.StatusOK},
+		{http.MethodGet, http.Header{"Range": {"bytes=0-3"}}, http.StatusPartialContent},
+		{http.MethodGet, http.Header{"If-Modified-Since": {time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}}, http.StatusNotModified},
+		{http.MethodGet, nil, http.StatusOK},
+		{http.MethodGet, nil, http.StatusGone},
+	} {
+		if got := download(tc.method, tc.header); got != tc.want {
+			t.Errorf("%s %v: status %d, want %d", tc.method, tc.header, got, tc.want)
+		}
+	}
+}
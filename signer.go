@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	errInvalidSignature = errors.New("invalid signature")
+	errSignatureExpired = errors.New("signature expired")
+	errSignatureUsed    = errors.New("signed URL already used")
+	errLinkExhausted    = errors.New("download limit of the link reached")
+)
+
+// signer signs URLs with HMAC-SHA256, so that they grant a request without the token until they expire.
+type signer struct {
+	// key is read at every signature, so that URLs signed with a key which has been rotated are no longer valid.
+	key *secretValue
+
+	mu sync.Mutex
+	// used keeps the nonces of one-time URLs which have been used, until they expire.
+	used map[string]time.Time
+	// downloads counts the downloads by links limited in number, by nonce, until they expire.
+	downloads map[string]downloadCount
+	// file keeps the used nonces and the counts across restarts, if set by load.
+	file string
+}
+
+type downloadCount struct {
+	n     int
+	until time.Time
+}
+
+// signerState is the saved state of a signer: the expiries of used nonces and the download counts, in Unix time.
+type signerState struct {
+	Used      map[string]int64             `json:"used"`
+	Downloads map[string]downloadCountJSON `json:"downloads"`
+}
+
+type downloadCountJSON struct {
+	N     int   `json:"n"`
+	Until int64 `json:"until"`
+}
+
+func newSigner(key *secretValue) *signer {
+	return &signer{key: key, used: map[string]time.Time{}, downloads: map[string]downloadCount{}}
+}
+
+// load reads the saved state from file, and saves later changes there. A missing file is not an error.
+func (s *signer) load(file string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.file = file
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var state signerState
+	if err := json.Unmarshal(b, &state); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	for nonce, until := range state.Used {
+		s.used[nonce] = time.Unix(until, 0)
+	}
+	for nonce, c := range state.Downloads {
+		s.downloads[nonce] = downloadCount{n: c.N, until: time.Unix(c.Until, 0)}
+	}
+	return nil
+}
+
+// save writes the state to the file, if any; it must be called with mu held.
+func (s *signer) save() error {
+	if s.file == "" {
+		return nil
+	}
+	state := signerState{Used: map[string]int64{}, Downloads: map[string]downloadCountJSON{}}
+	for nonce, until := range s.used {
+		state.Used[nonce] = until.Unix()
+	}
+	for nonce, c := range s.downloads {
+		state.Downloads[nonce] = downloadCountJSON{N: c.n, Until: c.until.Unix()}
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file and rename it, so that a crash never leaves a broken file.
+	tempFile, err := ioutil.TempFile(filepath.Dir(s.file), ".signer_")
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Write(b)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = renameFile(tempFile.Name(), s.file)
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+	}
+	return err
+}
+
+func (s *signer) mac(method string, urlPath string, params url.Values) string {
+	h := hmac.New(sha256.New, []byte(s.key.get()))
+	h.Write([]byte(method + "\n" + urlPath + "\n" + params.Encode()))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// sign returns params with the expiry and the signature for a request by method to urlPath.
+func (s *signer) sign(method string, urlPath string, params url.Values, expires time.Time) url.Values {
+	signed := url.Values{}
+	for k, v := range params {
+		signed[k] = v
+	}
+	signed.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	signed.Set("signature", s.mac(method, urlPath, signed))
+	return signed
+}
+
+// verify checks the signature in the query of r, and returns the signed parameters.
+func (s *signer) verify(r *http.Request) (url.Values, error) {
+	params := r.URL.Query()
+	signature := params.Get("signature")
+	params.Del("signature")
+	params.Del("token")
+	if !hmac.Equal([]byte(signature), []byte(s.mac(r.Method, r.URL.Path, params))) {
+		return nil, withStatus(http.StatusForbidden, errInvalidSignature)
+	}
+	expires, err := strconv.ParseInt(params.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return nil, withStatus(http.StatusForbidden, errSignatureExpired)
+	}
+	return params, nil
+}
+
+// consume marks a one-time nonce as used, valid until the given time.
+func (s *signer) consume(nonce string, until time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for n, t := range s.used {
+		if now.After(t) {
+			delete(s.used, n)
+		}
+	}
+	if _, ok := s.used[nonce]; ok {
+		return withStatus(http.StatusForbidden, errSignatureUsed)
+	}
+	s.used[nonce] = until
+	if err := s.save(); err != nil {
+		// a nonce which is not saved could be used again after a restart.
+		delete(s.used, nonce)
+		return err
+	}
+	return nil
+}
+
+// countDownload counts a download by the link with nonce, valid until the given time, and returns how many there
+// have been with it, or an error if there have already been max.
+func (s *signer) countDownload(nonce string, max int, until time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for n, c := range s.downloads {
+		if now.After(c.until) {
+			delete(s.downloads, n)
+		}
+	}
+	c := s.downloads[nonce]
+	if c.n >= max {
+		return c.n, withStatus(http.StatusGone, errLinkExhausted)
+	}
+	s.downloads[nonce] = downloadCount{n: c.n + 1, until: until}
+	if err := s.save(); err != nil {
+		// a count which is not saved could be used again after a restart.
+		s.downloads[nonce] = c
+		return c.n, err
+	}
+	return c.n + 1, nil
+}
+
+// uncountDownload takes back a download counted by countDownload which failed.
+func (s *signer) uncountDownload(nonce string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.downloads[nonce]; ok && c.n > 0 {
+		s.downloads[nonce] = downloadCount{n: c.n - 1, until: c.until}
+		if err := s.save(); err != nil {
+			logger.WithError(err).Warn("failed to save the download counts of share links")
+		}
+	}
+}
+
+// newNonce returns a random string to make a signed URL unique.
+func newNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
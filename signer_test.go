@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSignerDownloadCountsSurviveRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "signer.json")
+	until := time.Now().Add(time.Hour)
+	s := newSigner(newSecretValue("secret"))
+	if err := s.load(file); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.countDownload("a", 2, until); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.countDownload("a", 2, until); err != nil {
+		t.Fatal(err)
+	}
+	s.uncountDownload("a")
+
+	s = newSigner(newSecretValue("secret"))
+	if err := s.load(file); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := s.countDownload("a", 2, until); err != nil || n != 2 {
+		t.Fatalf("countDownload after a restart = %d, %v, want 2", n, err)
+	}
+	if _, err := s.countDownload("a", 2, until); statusOf(err) != http.StatusGone {
+		t.Fatalf("countDownload beyond the limit after a restart: %v, want 410", err)
+	}
+}
+
+func TestSignerNoncesSurviveRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "signer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "signer.json")
+	s := newSigner(newSecretValue("secret"))
+	if err := s.load(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.consume("a", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newSigner(newSecretValue("secret"))
+	if err := s.load(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.consume("a", time.Now().Add(time.Hour)); statusOf(err) != http.StatusForbidden {
+		t.Fatalf("consume of a used nonce after a restart: %v, want 403", err)
+	}
+	if err := s.consume("b", time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignerFollowsTokenRotation(t *testing.T) {
+	s := NewServer("", 1024, "old", false, nil)
+	signedRequest := func() *http.Request {
+		params := s.Signer.sign(http.MethodGet, "/files/a.txt", url.Values{"nonce": {"n"}}, time.Now().Add(time.Hour))
+		return httptest.NewRequest(http.MethodGet, "/files/a.txt?"+params.Encode(), nil)
+	}
+	before := signedRequest()
+	if _, err := s.Signer.verify(before); err != nil {
+		t.Fatal(err)
+	}
+
+	s.SecureToken.set("new")
+	if _, err := s.Signer.verify(before); statusOf(err) != http.StatusForbidden {
+		t.Errorf("URL signed with the previous token: %v, want 403", err)
+	}
+	if _, err := s.Signer.verify(signedRequest()); err != nil {
+		t.Errorf("URL signed with the new token: %v", err)
+	}
+
+	// a signing key of its own is not affected by the token.
+	key := newSecretValue("key")
+	s.Signer = newSigner(key)
+	signed := signedRequest()
+	s.SecureToken.set("newer")
+	if _, err := s.Signer.verify(signed); err != nil {
+		t.Errorf("URL signed with -signing_key after the token was rotated: %v", err)
+	}
+	key.set("rotated key")
+	if _, err := s.Signer.verify(signed); statusOf(err) != http.StatusForbidden {
+		t.Errorf("URL signed with the previous signing key: %v, want 403", err)
+	}
+}
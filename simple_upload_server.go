@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"crypto/rand"
 
@@ -15,6 +22,19 @@ import (
 var logger *logrus.Logger
 
 func run(args []string) int {
+	// commands without a document root take options of their own.
+	if len(args) > 1 && args[1] == "version" {
+		return printVersion(os.Stdout)
+	}
+	if len(args) > 1 && args[1] == "selfupdate" {
+		return runSelfUpdate(args[2:])
+	}
+	// subcommands are given before the flags, e.g. "ingest -state_dir state src root".
+	command := ""
+	if len(args) > 1 && (args[1] == "ingest" || args[1] == "check-config") {
+		command = args[1]
+		args = append(args[:1:1], args[2:]...)
+	}
 	bindAddress := flag.String("ip", "0.0.0.0", "IP address to bind")
 	listenPort := flag.Int("port", 25478, "port number to listen on")
 	tlsListenPort := flag.Int("tlsport", 25443, "port number to listen on with TLS")
@@ -22,12 +42,222 @@ func run(args []string) int {
 	maxUploadSize := flag.Int64("upload_limit", 5242880, "max size of uploaded file (byte)")
 	tokenFlag := flag.String("token", "", "specify the security token (it is automatically generated if empty)")
 	protectedMethodFlag := flag.String("protected_method", "GET,POST,HEAD,PUT", "specify methods intended to be protect by the security token")
+	publicRead := flag.Bool("public_read", false, "if true, GET, HEAD and OPTIONS never require the token while every other method does, instead of -protected_method")
 	logLevelFlag := flag.String("loglevel", "info", "logging level")
+	logFormat := flag.String("log_format", "text", "logging format (text or json)")
+	logFile := flag.String("log_file", "", "path to write logs to in addition to stderr")
+	logMaxSize := flag.Int("log_max_size", 100, "size in megabytes at which the log file is rotated")
+	logMaxAge := flag.Int("log_max_age", 0, "days to retain rotated log files (0 retains them forever)")
+	logMaxBackups := flag.Int("log_max_backups", 0, "number of rotated log files to retain (0 retains all)")
+	envelopeFlag := flag.String("response_envelope", envelopeCurrent, "envelope of upload and error responses for clients which do not ask for one: current, or legacy for {\"ok\", \"path\"} and {\"ok\", \"error\"} only")
 	certFile := flag.String("cert", "", "path to certificate file")
 	keyFile := flag.String("key", "", "path to key file")
+	namingStrategy := flag.String("naming", "original", "naming strategy for files uploaded by POST (original, uuid, hash, timestamp or template)")
+	namingTemplate := flag.String("naming_template", "", "template of file names for \"template\" naming strategy (e.g. {date}/{uuid}{ext})")
+	namingCollision := flag.String("naming_collision", "overwrite", "what to do when the name of a file uploaded by POST is taken (overwrite, rename or reject)")
+	robotsFile := flag.String("robots", "", "path to robots.txt to serve (default: disallow all)")
+	faviconFile := flag.String("favicon", "", "path to favicon.ico to serve (default: 204 No Content)")
+	var smartFolderFlags stringsFlag
+	flag.Var(&smartFolderFlags, "smart_folder", "virtual directory given as name=query, e.g. \"_recent=recent:100\" (can be repeated)")
+	var retentionFlags stringsFlag
+	flag.Var(&retentionFlags, "worm", "make files under a path prefix write-once for a retention period, given as prefix=duration (can be repeated)")
+	var artifactFlags stringsFlag
+	flag.Var(&artifactFlags, "artifacts", "serve a path prefix as an artifact repository, whose files are immutable and have checksum files (can be repeated)")
+	var extensionFlags stringsFlag
+	flag.Var(&extensionFlags, "allow_extensions", "allow only files with the given extensions under a path prefix, given as prefix=ext,..., like /images=jpg,png,webp (can be repeated)")
+	var logModeFlags stringsFlag
+	flag.Var(&logModeFlags, "log_mode", "make the directories under a path prefix append-only logs, appended to by PATCH or POST in segments rotated by size in bytes or age, given as prefix=size,age, like /telemetry=16777216,1h (can be repeated)")
+	var svgFlags stringsFlag
+	flag.Var(&svgFlags, "svg", "remove scripts and event handlers from the SVG images uploaded under a path prefix, or reject such images, given as prefix=sanitize or prefix=reject (can be repeated)")
+	stateDir := flag.String("state_dir", "", "directory to keep the server's state, such as file metadata, in")
+	highWatermark := flag.Float64("high_watermark", 0, "storage usage in percent at which an alert is raised (disabled if 0)")
+	lowWatermark := flag.Float64("low_watermark", 0, "storage usage in percent below which the alert is resolved (default: the high watermark)")
+	watermarkReadOnly := flag.Bool("watermark_readonly", false, "if true, reject writes while the storage usage is above the high watermark")
+	watermarkInterval := flag.Duration("watermark_interval", time.Minute, "interval to check the storage usage")
+	alertWebhook := flag.String("alert_webhook", "", "URL to send storage alerts to as JSON")
+	coldDir := flag.String("cold_dir", "", "directory, or s3://bucket/prefix, to move files which are not accessed for -cold_after to (requires -state_dir)")
+	coldAfter := flag.Duration("cold_after", 30*24*time.Hour, "duration without access after which files are moved to cold storage")
+	coldInterval := flag.Duration("cold_interval", time.Hour, "interval to look for files to move to cold storage")
+	coldRestore := flag.String("cold_restore", "transparent", "how files in cold storage are restored (transparent on GET, or explicit by POST /restore/)")
+	signingKey := flag.String("signing_key", "", "key to sign upload URLs with (default: the token)")
+	authorizeTTL := flag.Duration("authorize_ttl", 15*time.Minute, "duration for which URLs returned by /upload/authorize are valid")
+	shareLinkTTL := flag.Duration("share_link_ttl", 7*24*time.Hour, "default duration for which links returned by /share allow downloads")
+	fileRequestTTL := flag.Duration("file_request_ttl", 7*24*time.Hour, "default duration for which links returned by /upload/request accept uploads")
+	spoolDir := flag.String("spool_dir", "", "directory to keep uploads in progress in, preferably on a fast local disk (default: the document root)")
+	normalizeNames := flag.Bool("normalize_names", false, "if true, normalize file names to Unicode NFC")
+	caseCollision := flag.String("case_collision", "", "what to do when a name differs from an existing one only in case (reject or rename; allowed if empty)")
+	precompressed := flag.Bool("precompressed", false, "if true, serve file.ext.br or file.ext.gz instead of file.ext to clients which accept the encoding, as nginx's gzip_static")
+	maxPathDepth := flag.Int("max_path_depth", 0, "maximum number of directories a stored file can be nested in (0: unlimited)")
+	maxNameLength := flag.Int("max_name_length", 0, "maximum length in bytes of each name in the path of a stored file (0: unlimited)")
+	maxPathLength := flag.Int("max_path_length", 0, "maximum length in bytes of the path of a stored file (0: unlimited)")
+	multipartMemory := flag.Int64("multipart_memory", defaultMultipartMemory, "max total size in bytes of the form fields of a multipart upload besides the file, which are kept in memory")
+	uploadTimeout := flag.Duration("upload_timeout", 0, "duration after which uploads in progress are abandoned (disabled if 0)")
+	durable := flag.Bool("durable", false, "if true, sync uploaded files and their directories to the disk before responding")
+	slowDuration := flag.Duration("slow_duration", 0, "log requests taking longer than this as slow (disabled if 0)")
+	slowRate := flag.Int64("slow_rate", 0, "log requests transferring fewer bytes per second than this as slow (disabled if 0)")
+	slowMinSize := flag.Int64("slow_min_size", 1024*1024, "size in bytes under which the transfer rate of a request is not checked")
+	digest := flag.String("digest", digestSHA256, "algorithm to hash content with, for names, ETags and comparisons (sha256 or blake3)")
+	etag := flag.String("etag", etagStrong, "how ETags of files are made: strong (content hash) or weak (size and modification time; avoids hashing large files)")
+	txTimeout := flag.Duration("tx_timeout", time.Hour, "duration after which uncommitted transactions are aborted")
+	sessionTimeout := flag.Duration("session_timeout", 24*time.Hour, "duration after which upload sessions without any range written are aborted")
+	var callbackFlags stringsFlag
+	var importFlags stringsFlag
+	var redirectFlags stringsFlag
+	flag.Var(&redirectFlags, "redirect_allow", "URL prefix, like https://example.com/uploaded, which forms may give as redirect parameter to be sent back to after an upload; relative URLs are always allowed (can be repeated)")
+	flag.Var(&importFlags, "import_allow", "URL prefix, like https://other-server/files/, which files may be imported from with POST /files/(path)?action=import (can be repeated)")
+	flag.Var(&callbackFlags, "callback_allow", "URL prefix which clients may give as callback parameter to be notified when their upload is processed (can be repeated)")
+	pruneDirs := flag.Bool("prune_empty_dirs", false, "remove directories left empty by deletions, and sweep for empty directories periodically")
+	pruneKeepDepth := flag.Int("prune_keep_depth", 0, "never remove empty directories up to this depth, e.g. 1 keeps top-level directories")
+	var pruneProtectFlags stringsFlag
+	flag.Var(&pruneProtectFlags, "prune_protect", "path prefix under which empty directories are never removed (can be repeated)")
+	pruneInterval := flag.Duration("prune_interval", time.Hour, "interval to sweep for empty directories with -prune_empty_dirs")
+	var notifyFlags stringsFlag
+	flag.Var(&notifyFlags, "notify", "announce uploads matching a pattern to a chat channel, given as pattern=kind:webhook_url with kind slack, teams or discord (can be repeated)")
+	notifyTemplate := flag.String("notify_template", defaultChatTemplate, "message announcing an upload, with {path}, {name}, {url}, {size}, {digest} and {uploader} replaced")
+	smtpServer := flag.String("smtp_server", "", "host:port of the SMTP server to send email notifications through")
+	smtpUser := flag.String("smtp_user", "", "user name to authenticate to the SMTP server (no authentication if empty)")
+	smtpPassword := flag.String("smtp_password", "", "password to authenticate to the SMTP server")
+	smtpFrom := flag.String("smtp_from", "", "sender address of email notifications")
+	var emailFlags stringsFlag
+	flag.Var(&emailFlags, "email_notify", "email uploads matching a pattern, given as pattern=address,address... (can be repeated)")
+	emailAttachLimit := flag.Int64("email_attach_limit", 1<<20, "size up to which an uploaded file is attached to email notifications (byte); larger files are linked")
+	emailLinkTTL := flag.Duration("email_link_ttl", 7*24*time.Hour, "validity of the signed download links in email notifications")
+	amqpURL := flag.String("amqp_ingest", "", "AMQP broker to consume uploads from, as amqp[s]://user:password@host[:port]/vhost (e.g. RabbitMQ)")
+	amqpQueue := flag.String("amqp_queue", "uploads", "queue to consume uploads from with -amqp_ingest")
+	ipfsAPI := flag.String("ipfs_api", "", "IPFS node to add and pin uploaded files to, by its HTTP RPC API (e.g. http://127.0.0.1:5001); the CID is returned in upload responses")
+	torrentAnnounce := flag.String("torrent_announce", "", "HTTP(S) tracker to announce seeded files to; enables seeding files by BitTorrent, which are chosen by POST /torrents/files/(path)")
+	torrentPort := flag.Int("torrent_port", 6881, "port number to serve BitTorrent peers on with -torrent_announce")
+	convertEnabled := flag.Bool("convert", false, "if true, serve images converted into other formats under /convert/, like /convert/photo.jpg?format=webp")
+	convertCacheDir := flag.String("convert_cache", "", "directory to cache converted images in (convert in -state_dir if empty; not cached without either)")
+	convertCacheSize := flag.Int64("convert_cache_size", 1024*1024*1024, "max size of the cache of converted images (byte)")
+	convertMaxPixels := flag.Int64("convert_max_pixels", 16*1024*1024, "max number of pixels of the images to convert (unlimited if 0)")
+	var imageEncoderFlags stringsFlag
+	flag.Var(&imageEncoderFlags, "image_encoder", "command converting {in}, a PNG image, into {out} in a format, given as format=command, like \"avif=avifenc -q {quality} {in} {out}\" (can be repeated)")
+	surrogateKeys := flag.Bool("surrogate_keys", false, "if true, tag downloads with Surrogate-Key and Cache-Tag headers for caching proxies and CDNs (implied by -purge)")
+	var purgeFlags stringsFlag
+	flag.Var(&purgeFlags, "purge", "purge changed files from a cache: varnish://host[:port][/path], fastly://token@service_id or cloudflare://token@zone_id (can be repeated)")
+	events := flag.String("events", "", "publish upload, delete, archive and restore events as JSON to a NATS subject (nats://[user:password@]host[:port]/subject) or Kafka topic (kafka://host[:port][,host[:port]...]/topic)")
+	var tripwireFlags stringsFlag
+	flag.Var(&tripwireFlags, "tripwire", "path pattern which bans clients requesting it, e.g. /wp-login.php or /.env* (can be repeated)")
+	banDuration := flag.Duration("ban_duration", time.Hour, "duration for which clients are banned")
+	banAuthFailures := flag.Int("ban_auth_failures", 0, "number of authentication failures within -ban_window after which a client is banned (disabled if 0)")
+	banWindow := flag.Duration("ban_window", 10*time.Minute, "window in which authentication failures are counted")
+	banMaxDuration := flag.Duration("ban_max_duration", 24*time.Hour, "max duration of repeated bans for authentication failures, which double each time")
+	banExempt := flag.String("ban_exempt", "", "comma-separated networks (CIDR) or IP addresses of trusted clients which are never banned")
+	trustedProxies := flag.String("trusted_proxies", "", "comma-separated networks (CIDR) or IP addresses of reverse proxies whose X-Forwarded-For header tells the client")
+	authLogFile := flag.String("auth_log", "", "path to write authentication failures to in a fixed format, e.g. for fail2ban")
 	corsEnabled := flag.Bool("cors", false, "if true, add ACAO header to support CORS")
-	flag.Parse()
+	accessLogEnabled := flag.Bool("access_log", false, "if true, log every request")
+	syslogAddr := flag.String("syslog", "", "syslog server to send access and audit logs to (udp://, tcp:// or tls://host:port)")
+	otlpEndpoint := flag.String("otlp_endpoint", "", "OTLP/HTTP endpoint to export traces to (e.g. http://localhost:4318/v1/traces)")
+	otlpService := flag.String("otlp_service", "simple-upload-server", "service name reported in traces")
+	adminToken := flag.String("admin_token", "", "token for the admin endpoints (/debug/...); they are disabled on the main port if empty")
+	adminPort := flag.Int("admin_port", 0, "port number to serve the admin endpoints on separately (disabled if 0)")
+	adminIP := flag.String("admin_ip", "127.0.0.1", "IP address to bind -admin_port to, which must be a loopback address unless -admin_token is given")
+	vaultAddr := flag.String("vault_addr", os.Getenv("VAULT_ADDR"), "address of the HashiCorp Vault server to read vault: secrets from")
+	vaultToken := flag.String("vault_token", os.Getenv("VAULT_TOKEN"), "token to authenticate to Vault with")
+	rbacEnabled := flag.Bool("rbac", false, "if true, authorize requests by the roles of users managed through /admin/users, /admin/groups and /admin/roles instead of -protected_method (requires -state_dir)")
+	jwtSecret := flag.String("jwt_secret", "", "shared secret to verify bearer JWTs signed with HS256 with, identifying users with -rbac")
+	jwtPublicKey := flag.String("jwt_public_key", "", "PEM file of the RSA public key to verify bearer JWTs signed with RS256 with, identifying users with -rbac")
+	jwtIssuer := flag.String("jwt_issuer", "", "issuer (iss) JWTs must have (not checked if empty)")
+	jwtAudience := flag.String("jwt_audience", "", "audience (aud) JWTs must have (not checked if empty)")
+	jwtUserClaim := flag.String("jwt_user_claim", "sub", "claim of JWTs holding the user name")
+	jwtGroupsClaim := flag.String("jwt_groups_claim", "groups", "claim of JWTs holding the groups of the user")
+	ldapURL := flag.String("ldap_url", "", "LDAP or Active Directory server to check the passwords of users sent by Basic authentication with -rbac, as ldap://host[:port] or ldaps://host[:port] (disabled if empty)")
+	ldapStartTLS := flag.Bool("ldap_starttls", false, "if true, start TLS on ldap:// connections")
+	ldapCA := flag.String("ldap_ca", "", "PEM file of the CAs to verify the LDAP server with (default: the system CAs)")
+	ldapBindDN := flag.String("ldap_bind_dn", "", "DN of the service account to search for users as (anonymous if empty)")
+	ldapBindPassword := flag.String("ldap_bind_password", "", "password of the LDAP service account")
+	ldapBaseDN := flag.String("ldap_base_dn", "", "DN to search for users under, like ou=people,dc=example,dc=org")
+	ldapUserFilter := flag.String("ldap_user_filter", "(uid=%s)", "filter finding the entry of a user, where %s is the user name; (sAMAccountName=%s) for Active Directory")
+	ldapGroupAttribute := flag.String("ldap_group_attribute", "memberOf", "attribute of user entries holding the DNs of their groups, whose common names are groups of -rbac")
+	ldapPoolSize := flag.Int("ldap_pool_size", 4, "number of idle connections to the LDAP server to keep")
+	ldapCacheTTL := flag.Duration("ldap_cache_ttl", 5*time.Minute, "how long a successful LDAP authentication is remembered (not remembered if 0)")
+	samlMetadata := flag.String("saml_idp_metadata", "", "metadata file of a SAML 2.0 identity provider to sign users in to the web UI with -rbac (disabled if empty)")
+	samlURL := flag.String("saml_url", "", "public URL of the server, like https://files.example.org, which the SAML identity provider sends users back to")
+	samlEntityID := flag.String("saml_entity_id", "", "entity ID of the server as a SAML service provider (default: -saml_url followed by /saml/metadata)")
+	samlUserAttribute := flag.String("saml_user_attribute", "", "SAML attribute holding the user name (default: the NameID of the subject)")
+	samlGroupsAttribute := flag.String("saml_groups_attribute", "groups", "SAML attribute holding the groups of the user")
+	samlSessionTTL := flag.Duration("saml_session_ttl", 8*time.Hour, "how long users stay signed in to the web UI")
+	homesEnabled := flag.Bool("homes", false, "if true, confine each user to the home directory /files/home/(user) with -rbac")
+	homeQuota := flag.Int64("home_quota", 0, "max total size of the files in a home directory (byte; unlimited if 0)")
+	captchaProvider := flag.String("captcha", "", "require a CAPTCHA with uploads without credentials, verified with hcaptcha or turnstile (disabled if empty)")
+	captchaSecret := flag.String("captcha_secret", "", "secret key to verify CAPTCHAs with")
+	captchaVerifyURL := flag.String("captcha_verify_url", "", "URL to verify CAPTCHAs at (default: the provider's siteverify endpoint)")
+	authzKind := flag.String("authz", "", "authorize every request with an external service: opa or webhook (disabled if empty)")
+	authzURL := flag.String("authz_url", "", "URL to ask the authorization service at, like http://localhost:8181/v1/data/upload/allow for OPA")
+	authzToken := flag.String("authz_token", "", "bearer token to call the authorization service with")
+	authzCacheTTL := flag.Duration("authz_cache_ttl", time.Minute, "how long decisions of the authorization service are cached (not cached if 0)")
+	authzFailOpen := flag.Bool("authz_fail_open", false, "if true, allow requests when the authorization service cannot be asked, instead of refusing them with 503")
+	quarantineReports := flag.Int("quarantine_reports", 0, "number of clients reporting a file as abusive to quarantine it pending review (disabled if 0; requires -state_dir)")
+	moderationURL := flag.String("moderation_url", "", "URL of a moderation API to send uploaded files to for scoring (disabled if empty)")
+	moderationToken := flag.String("moderation_token", "", "bearer token to call the moderation API with")
+	moderationTypes := flag.String("moderation_types", "image/*,text/*", "comma-separated media types of the files to moderate")
+	moderationMaxSize := flag.Int64("moderation_max_size", 10*1024*1024, "max size of the files to moderate (byte)")
+	moderationQuarantine := flag.String("moderation_quarantine", "", "scores above which files are quarantined, as score or category=score,... (never if empty)")
+	moderationDelete := flag.String("moderation_delete", "", "scores above which files are deleted, as score or category=score,... (never if empty)")
+	sandboxURL := flag.String("sandbox_url", "", "URL of an analysis service to submit uploaded files to, keeping them from being downloaded until found clean (disabled if empty; requires -state_dir)")
+	sandboxToken := flag.String("sandbox_token", "", "bearer token to submit files to the analysis service with")
+	sandboxTimeout := flag.Duration("sandbox_timeout", time.Hour, "how long a file waits for the verdict of the analysis service")
+	sandboxMalicious := flag.String("sandbox_malicious", scanQuarantine, "what to do with the files found malicious: quarantine or delete")
+	sandboxOnTimeout := flag.String("sandbox_on_timeout", scanQuarantine, "what to do with the files without a verdict in time: release, quarantine or delete")
+	gpgKeyring := flag.String("gpg_keyring", "", "OpenPGP keyring file whose keys uploads must be signed with (disabled if empty)")
+	gpgPaths := flag.String("gpg_paths", "", "comma-separated patterns of the paths of the files which must be signed, like /packages/* or *.deb (all if empty)")
+	packageRepos := flag.String("package_repos", "", "comma-separated paths of the directories served as Debian and RPM package repositories, like /debian,/rpm (none if empty)")
+	packageRepoKey := flag.String("package_repo_key", "", "armored OpenPGP private key, without passphrase, signing the metadata of the package repositories (unsigned if empty)")
+	registryPrefix := flag.String("registry", "", "path of the directory holding the images pushed to the container registry served under /v2/ (disabled if empty)")
+	lfsPrefix := flag.String("lfs", "", "path of the directory holding the Git LFS objects served under /lfs/ (disabled if empty)")
+	s3AccessKey := flag.String("s3_access_key", "", "access key ID of the S3 API served to requests signed with Signature Version 4, whose secret key is the token (disabled if empty)")
+	logIngestPrefix := flag.String("log_ingest", "", "path of the directory holding the logs shipped to /logs/ (disabled if empty)")
+	logIngestMaxSize := flag.Int("log_ingest_max_size", 0, "size in megabytes from which the file of an hour of shipped logs is rotated (0 never rotates)")
+	logIngestMaxAge := flag.Int("log_ingest_max_age", 0, "days to retain shipped logs (0 retains them forever)")
+	tfstatePrefix := flag.String("tfstate", "", "path of the directory holding the Terraform states served under /tfstate/ (disabled if empty)")
+	manifestsEnabled := flag.Bool("manifests", false, "if true, keep a manifest.json and an index.html listing the files with their digests in each directory")
+	clientCA := flag.String("client_ca", "", "PEM file of the CAs to verify TLS client certificates with, whose common names identify users with -rbac")
+	secretsRefresh := flag.Duration("secrets_refresh", time.Hour, "interval to renew the Vault token and fetch the secrets from secret stores again (disabled if 0)")
+	redirectPort := flag.Int("redirect_port", 0, "port number to redirect plain HTTP to HTTPS on (disabled if 0)")
+	acmeDomainsFlag := flag.String("acme_domains", "", "comma-separated domains to obtain certificates for from Let's Encrypt")
+	acmeCache := flag.String("acme_cache", "acme-cache", "directory to cache certificates obtained from Let's Encrypt")
+	acmeEmail := flag.String("acme_email", "", "contact email address for the Let's Encrypt account")
+	acmeHTTPPort := flag.Int("acme_http_port", 80, "port number to serve HTTP-01 challenges and redirects to HTTPS on")
+	backupSchedule := flag.String("backup_schedule", "", "cron expression of when to take backups, e.g. \"30 2 * * *\" (disabled if empty)")
+	backupTarget := flag.String("backup_target", "", "where to push backups to (s3://bucket/prefix or http(s)://host/files/dir?token=... of another upload server)")
+	backupKeep := flag.Int("backup_keep", 7, "number of backups to retain at the target")
+	var taskFlags stringsFlag
+	flag.Var(&taskFlags, "task", "task to run on a schedule, given as a cron expression followed by backup, prune, tiering, scrub, usage, or shell and a command, e.g. \"0 3 * * 0 scrub\" (can be repeated)")
+	var maintenanceWindowFlags stringsFlag
+	flag.Var(&maintenanceWindowFlags, "maintenance_window", "daily period of local time in which scheduled backups and tiering run, given as HH:MM-HH:MM, e.g. 22:00-06:00 (can be repeated; any time if not given)")
+	maintenanceBandwidth := flag.Int64("maintenance_bandwidth", 0, "bytes per second shared by backups and tiering (unlimited if 0)")
+	taskTimeout := flag.Duration("task_timeout", time.Hour, "time limit of a run of a scheduled task (unlimited if 0)")
+	ingestMove := flag.Bool("ingest_move", false, "if true, ingest moves the files instead of copying them")
+	flag.Usage = usage
+	flag.CommandLine.Parse(args[1:])
+	sources, err := applyEnv(flag.CommandLine, os.LookupEnv)
+	if err != nil {
+		logger.WithError(err).Error("invalid options in the environment")
+		return 2
+	}
+	configSources = sources
+	secrets, err := newSecretStore(*vaultAddr, *vaultToken)
+	if err != nil {
+		logger.WithError(err).Error("invalid secret store options")
+		return 2
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), secretFetchTimeout)
+	err = secrets.resolve(ctx, flag.CommandLine)
+	cancel()
+	if err != nil {
+		logger.WithError(err).Error("failed to fetch secrets")
+		return 1
+	}
 	serverRoot := flag.Arg(0)
+	ingestSource := ""
+	if command == "ingest" {
+		ingestSource, serverRoot = flag.Arg(0), flag.Arg(1)
+	}
+	if serverRoot == "" {
+		serverRoot = os.Getenv(envPrefix + "DOCUMENT_ROOT")
+	}
 	if len(serverRoot) == 0 {
 		flag.Usage()
 		return 2
@@ -37,8 +267,26 @@ func run(args []string) int {
 	} else {
 		logger.Level = logLevel
 	}
+	if err := configureLogger(logger, logOptions{
+		Format:     *logFormat,
+		File:       *logFile,
+		MaxSize:    *logMaxSize,
+		MaxAge:     *logMaxAge,
+		MaxBackups: *logMaxBackups,
+	}); err != nil {
+		logger.WithError(err).Error("failed to configure logging")
+		return 2
+	}
+	if *syslogAddr != "" {
+		hook, err := newSyslogHook(*syslogAddr, "simple-upload-server")
+		if err != nil {
+			logger.WithError(err).Error("failed to configure syslog")
+			return 2
+		}
+		logger.AddHook(hook)
+	}
 	token := *tokenFlag
-	if token == "" {
+	if token == "" && command != "check-config" {
 		count := 10
 		b := make([]byte, count)
 		if _, err := rand.Read(b); err != nil {
@@ -48,20 +296,792 @@ func run(args []string) int {
 		token = fmt.Sprintf("%x", b)
 		logger.WithField("token", token).Warn("token generated")
 	}
+	if *otlpEndpoint != "" {
+		tracer = newTracer(*otlpEndpoint, *otlpService)
+		logger.WithField("endpoint", *otlpEndpoint).Info("exporting traces")
+	}
+	envelope, err := parseEnvelope(*envelopeFlag)
+	if err != nil {
+		logger.WithError(err).Error("failed to configure responses")
+		return 2
+	}
 	protectedMethods := []string{}
-	for _, method := range strings.Split((*protectedMethodFlag), ",") {
-		if strings.EqualFold("POST", method) {
-			protectedMethods = append(protectedMethods, http.MethodPost)
-		} else if strings.EqualFold("PUT", method) {
-			protectedMethods = append(protectedMethods, http.MethodPut)
-		} else if strings.EqualFold("OPTIONS", method) {
-			protectedMethods = append(protectedMethods, http.MethodOptions)
+	if *publicRead {
+		// every method but GET, HEAD and OPTIONS requires the token; these are the ones changing files, as advertised.
+		protectedMethods = append(protectedMethods, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete)
+	} else {
+		for _, method := range strings.Split((*protectedMethodFlag), ",") {
+			if strings.EqualFold("POST", method) {
+				protectedMethods = append(protectedMethods, http.MethodPost)
+			} else if strings.EqualFold("PUT", method) {
+				protectedMethods = append(protectedMethods, http.MethodPut)
+			} else if strings.EqualFold("OPTIONS", method) {
+				protectedMethods = append(protectedMethods, http.MethodOptions)
+			}
+		}
+	}
+	acmeDomains := []string{}
+	for _, domain := range strings.Split(*acmeDomainsFlag, ",") {
+		if domain = strings.TrimSpace(domain); domain != "" {
+			acmeDomains = append(acmeDomains, domain)
 		}
 	}
-	tlsEnabled := *certFile != "" && *keyFile != ""
+	acmeEnabled := len(acmeDomains) > 0
+	tlsEnabled := (*certFile != "" && *keyFile != "") || acmeEnabled
 	server := NewServer(serverRoot, *maxUploadSize, token, *corsEnabled, protectedMethods)
-	http.Handle("/upload", server)
-	http.Handle("/files/", server)
+	server.PublicRead = *publicRead
+	server.Naming = naming{Strategy: *namingStrategy, Template: *namingTemplate, Collision: *namingCollision}
+	if err := server.Naming.validate(); err != nil {
+		logger.WithError(err).Error("invalid naming options")
+		return 2
+	}
+	var fixedPolicies policies
+	for _, def := range retentionFlags {
+		p, err := parseRetention(def)
+		if err != nil {
+			logger.WithError(err).Error("invalid retention")
+			return 2
+		}
+		fixedPolicies = fixedPolicies.set(p)
+	}
+	for _, prefix := range artifactFlags {
+		p, _ := fixedPolicies.lookup(cleanPrefix(prefix))
+		if p.Prefix != cleanPrefix(prefix) {
+			p = policy{Prefix: cleanPrefix(prefix)}
+		}
+		p.Artifacts = true
+		fixedPolicies = fixedPolicies.set(p)
+	}
+	for _, def := range extensionFlags {
+		allowlist, err := parseExtensions(def)
+		if err != nil {
+			logger.WithError(err).Error("invalid extension allowlist")
+			return 2
+		}
+		p, _ := fixedPolicies.lookup(allowlist.Prefix)
+		if p.Prefix != allowlist.Prefix {
+			p = policy{Prefix: allowlist.Prefix}
+		}
+		p.Extensions = allowlist.Extensions
+		fixedPolicies = fixedPolicies.set(p)
+	}
+	for _, def := range svgFlags {
+		svg, err := parseSVGPolicy(def)
+		if err != nil {
+			logger.WithError(err).Error("invalid SVG policy")
+			return 2
+		}
+		p, _ := fixedPolicies.lookup(svg.Prefix)
+		if p.Prefix != svg.Prefix {
+			p = policy{Prefix: svg.Prefix}
+		}
+		p.SVG = svg.SVG
+		fixedPolicies = fixedPolicies.set(p)
+	}
+	for _, def := range logModeFlags {
+		log, err := parseLogMode(def)
+		if err != nil {
+			logger.WithError(err).Error("invalid log mode")
+			return 2
+		}
+		p, _ := fixedPolicies.lookup(log.Prefix)
+		if p.Prefix != log.Prefix {
+			p = policy{Prefix: log.Prefix}
+		}
+		p.Log = log.Log
+		fixedPolicies = fixedPolicies.set(p)
+	}
+	server.Policies = newPolicyStore(fixedPolicies)
+	callbacks, err := parseURLAllowlist(callbackFlags)
+	if err != nil {
+		logger.WithError(err).Error("invalid callback allowlist")
+		return 2
+	}
+	server.Callbacks = callbacks
+	redirects, err := parseURLAllowlist(redirectFlags)
+	if err != nil {
+		logger.WithError(err).Error("invalid redirect allowlist")
+		return 2
+	}
+	server.Redirects = redirects
+	imports, err := parseURLAllowlist(importFlags)
+	if err != nil {
+		logger.WithError(err).Error("invalid import allowlist")
+		return 2
+	}
+	server.Imports = imports
+	if len(notifyFlags) > 0 {
+		chat := &chatNotifier{Template: *notifyTemplate}
+		for _, def := range notifyFlags {
+			c, err := parseChatChannel(def)
+			if err != nil {
+				logger.WithError(err).Error("invalid notification")
+				return 2
+			}
+			chat.Channels = append(chat.Channels, c)
+		}
+		server.Chat = chat
+	}
+	if len(emailFlags) > 0 {
+		if *smtpServer == "" || *smtpFrom == "" {
+			logger.Error("-email_notify requires -smtp_server and -smtp_from")
+			return 2
+		}
+		m := &mailer{
+			Addr:        *smtpServer,
+			User:        *smtpUser,
+			Password:    *smtpPassword,
+			From:        *smtpFrom,
+			AttachLimit: *emailAttachLimit,
+			LinkTTL:     *emailLinkTTL,
+		}
+		for _, def := range emailFlags {
+			rule, err := parseEmailRule(def)
+			if err != nil {
+				logger.WithError(err).Error("invalid email notification")
+				return 2
+			}
+			m.Rules = append(m.Rules, rule)
+		}
+		server.Mail = m
+	}
+	if *events != "" {
+		publisher, err := parseEventTarget(*events)
+		if err != nil {
+			logger.WithError(err).Error("invalid event target")
+			return 2
+		}
+		server.Events = newEventBus(publisher)
+		go server.Events.run()
+	}
+	if len(purgeFlags) > 0 {
+		targets := []purgeTarget{}
+		for _, def := range purgeFlags {
+			target, err := parsePurgeTarget(def)
+			if err != nil {
+				logger.WithError(err).Error("invalid purge target")
+				return 2
+			}
+			targets = append(targets, target)
+		}
+		server.Purger = newCachePurger(targets)
+		go server.Purger.run()
+	}
+	server.SurrogateKeys = *surrogateKeys || server.Purger != nil
+	server.Stats = newDashboardStats(serverRoot)
+	go server.Stats.sampleUsage(usageSampleInterval)
+	if *amqpURL != "" {
+		u, err := url.Parse(*amqpURL)
+		if err != nil || (u.Scheme != "amqp" && u.Scheme != "amqps") || u.Host == "" {
+			logger.WithField("url", *amqpURL).Error("-amqp_ingest must be an amqp:// or amqps:// URL")
+			return 2
+		}
+		server.AMQP = &amqpIngest{URL: u, Queue: *amqpQueue, client: &http.Client{}}
+	}
+	if *ipfsAPI != "" {
+		u, err := url.Parse(*ipfsAPI)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			logger.WithField("url", *ipfsAPI).Error("-ipfs_api must be an http:// or https:// URL")
+			return 2
+		}
+		server.IPFS = newIPFSNode(u)
+	}
+	if *torrentAnnounce != "" {
+		u, err := url.Parse(*torrentAnnounce)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			logger.WithField("url", *torrentAnnounce).Error("-torrent_announce must be an http:// or https:// URL")
+			return 2
+		}
+		server.Torrents = newTorrentStore(*torrentAnnounce, *torrentPort)
+		if *stateDir != "" {
+			if err := server.Torrents.load(filepath.Join(*stateDir, "torrents.json")); err != nil {
+				logger.WithError(err).Error("failed to load the torrents")
+				return 1
+			}
+		}
+	}
+	if *pruneDirs {
+		if *pruneInterval <= 0 {
+			logger.WithField("prune_interval", *pruneInterval).Error("-prune_interval must be positive")
+			return 2
+		}
+		prune := &pruneOptions{KeepDepth: *pruneKeepDepth}
+		for _, prefix := range pruneProtectFlags {
+			prune.Protected = append(prune.Protected, cleanPrefix(prefix))
+		}
+		server.Prune = prune
+	}
+	if _, ok := digestAlgorithms[*digest]; !ok {
+		logger.WithField("digest", *digest).Error("-digest must be sha256 or blake3")
+		return 2
+	}
+	server.Digests = newDigests(*digest)
+	server.StateDir = *stateDir
+	if *stateDir != "" {
+		meta, err := newMetaStore(filepath.Join(*stateDir, "meta"))
+		if err != nil {
+			logger.WithError(err).Error("failed to open the metadata store")
+			return 1
+		}
+		server.Meta = meta
+		if err := server.Policies.load(filepath.Join(*stateDir, "policies.json")); err != nil {
+			logger.WithError(err).Error("failed to load the policies")
+			return 1
+		}
+	}
+	if *rbacEnabled {
+		if *stateDir == "" {
+			logger.Error("-rbac requires -state_dir")
+			return 2
+		}
+		server.RBAC = newRBACStore()
+		server.RBAC.Homes = *homesEnabled
+		server.HomeQuota = *homeQuota
+		if err := server.RBAC.load(filepath.Join(*stateDir, "rbac.json")); err != nil {
+			logger.WithError(err).Error("failed to load the users")
+			return 1
+		}
+		if *jwtSecret != "" || *jwtPublicKey != "" {
+			verifier, err := newJWTVerifier(*jwtSecret, *jwtPublicKey)
+			if err != nil {
+				logger.WithError(err).Error("invalid JWT options")
+				return 2
+			}
+			verifier.Issuer, verifier.Audience = *jwtIssuer, *jwtAudience
+			verifier.UserClaim, verifier.GroupsClaim = *jwtUserClaim, *jwtGroupsClaim
+			server.RBAC.JWT = verifier
+		}
+		if *ldapURL != "" {
+			authenticator, err := newLDAPAuthenticator(*ldapURL, *ldapBindDN, *ldapBindPassword, *ldapCA, *ldapPoolSize)
+			if err != nil {
+				logger.WithError(err).Error("invalid LDAP options")
+				return 2
+			}
+			authenticator.StartTLS, authenticator.BaseDN = *ldapStartTLS, *ldapBaseDN
+			authenticator.UserFilter, authenticator.GroupAttribute = *ldapUserFilter, *ldapGroupAttribute
+			authenticator.TTL = *ldapCacheTTL
+			if _, err := authenticator.userFilter("user"); err != nil {
+				logger.WithError(err).Error("invalid -ldap_user_filter")
+				return 2
+			}
+			server.RBAC.LDAP = authenticator
+		}
+		if *samlMetadata != "" {
+			provider, err := newSAMLProvider(*samlMetadata, *samlURL)
+			if err != nil {
+				logger.WithError(err).Error("invalid SAML options")
+				return 2
+			}
+			if *samlEntityID != "" {
+				provider.EntityID = *samlEntityID
+			}
+			provider.UserAttribute, provider.GroupsAttribute = *samlUserAttribute, *samlGroupsAttribute
+			provider.SessionTTL = *samlSessionTTL
+			server.RBAC.SAML = provider
+		}
+	}
+	if *captchaProvider != "" {
+		verifier, err := newCaptchaVerifier(*captchaProvider, *captchaSecret, *captchaVerifyURL)
+		if err != nil {
+			logger.WithError(err).Error("invalid CAPTCHA options")
+			return 2
+		}
+		server.Captcha = verifier
+	}
+	if *authzKind != "" {
+		authz, err := newAuthorizer(*authzKind, *authzURL, *authzToken, *authzCacheTTL, *authzFailOpen)
+		if err != nil {
+			logger.WithError(err).Error("invalid authorization options")
+			return 2
+		}
+		server.Authz = authz
+	}
+	if *quarantineReports > 0 && server.Meta == nil {
+		logger.Error("-quarantine_reports requires -state_dir")
+		return 2
+	}
+	server.QuarantineReports = *quarantineReports
+	if *gpgKeyring != "" {
+		verifier, err := newSignatureVerifier(*gpgKeyring)
+		if err != nil {
+			logger.WithError(err).Error("failed to load the keyring")
+			return 2
+		}
+		for _, pattern := range strings.Split(*gpgPaths, ",") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				verifier.Patterns = append(verifier.Patterns, pattern)
+			}
+		}
+		server.Signatures = verifier
+	}
+	if *manifestsEnabled {
+		server.Manifests = newManifestWriter()
+	}
+	if *registryPrefix != "" {
+		server.Registry = newRegistry(*registryPrefix)
+	}
+	if *s3AccessKey != "" {
+		server.S3 = newS3API(*s3AccessKey)
+	}
+	if *tfstatePrefix != "" {
+		server.TFStates = newTFStates(*tfstatePrefix)
+	}
+	if *logIngestPrefix != "" {
+		logs := newLogIngest(*logIngestPrefix)
+		logs.MaxSize = int64(*logIngestMaxSize) << 20
+		logs.MaxAge = *logIngestMaxAge
+		server.Logs = logs
+	}
+	if *lfsPrefix != "" {
+		server.LFS = cleanPrefix(*lfsPrefix)
+	}
+	if *packageRepos != "" {
+		server.Repos = newPackageRepos(strings.Split(*packageRepos, ","))
+		if *packageRepoKey != "" {
+			if err := server.Repos.loadSigningKey(*packageRepoKey); err != nil {
+				logger.WithError(err).Error("failed to load the repository signing key")
+				return 2
+			}
+		}
+	}
+	if *moderationURL != "" {
+		m := newModerator(*moderationURL)
+		m.Token = *moderationToken
+		m.Types = strings.Split(*moderationTypes, ",")
+		m.MaxSize = *moderationMaxSize
+		var err error
+		if m.Quarantine, err = parseScoreLimits(*moderationQuarantine); err != nil {
+			logger.WithError(err).Error("invalid -moderation_quarantine")
+			return 2
+		}
+		if m.Delete, err = parseScoreLimits(*moderationDelete); err != nil {
+			logger.WithError(err).Error("invalid -moderation_delete")
+			return 2
+		}
+		server.Moderation = m
+	}
+	if *sandboxURL != "" {
+		if server.Meta == nil {
+			logger.Error("-sandbox_url requires -state_dir")
+			return 2
+		}
+		if *sandboxMalicious != scanQuarantine && *sandboxMalicious != scanDelete {
+			logger.WithField("sandbox_malicious", *sandboxMalicious).Error("-sandbox_malicious must be quarantine or delete")
+			return 2
+		}
+		if *sandboxOnTimeout != scanRelease && *sandboxOnTimeout != scanQuarantine && *sandboxOnTimeout != scanDelete {
+			logger.WithField("sandbox_on_timeout", *sandboxOnTimeout).Error("-sandbox_on_timeout must be release, quarantine or delete")
+			return 2
+		}
+		if *sandboxTimeout <= 0 {
+			logger.Error("-sandbox_timeout must be positive")
+			return 2
+		}
+		sb := newSandbox(*sandboxURL)
+		sb.Token = *sandboxToken
+		sb.Timeout = *sandboxTimeout
+		sb.OnMalicious = *sandboxMalicious
+		sb.OnTimeout = *sandboxOnTimeout
+		server.Sandbox = sb
+		if err := server.loadPendingScans(); err != nil {
+			logger.WithError(err).Error("failed to load the files pending a scan")
+			return 2
+		}
+	}
+	if *convertEnabled {
+		c := newImageConverter(*convertMaxPixels)
+		for _, def := range imageEncoderFlags {
+			format, e, err := parseImageEncoder(def)
+			if err != nil {
+				logger.WithError(err).Error("invalid -image_encoder")
+				return 2
+			}
+			c.Encoders[format] = e
+		}
+		cacheDir := *convertCacheDir
+		if cacheDir == "" && *stateDir != "" {
+			cacheDir = filepath.Join(*stateDir, "convert")
+		}
+		if cacheDir != "" {
+			if c.cache, err = newConvertCache(cacheDir, *convertCacheSize); err != nil {
+				logger.WithError(err).Error("failed to open the cache of converted images")
+				return 1
+			}
+		}
+		server.Converter = c
+	} else if len(imageEncoderFlags) > 0 {
+		logger.Error("-image_encoder requires -convert")
+		return 2
+	}
+	if *homesEnabled && !*rbacEnabled {
+		logger.Error("-homes requires -rbac")
+		return 2
+	}
+	var clientCAs *x509.CertPool
+	if *clientCA != "" {
+		b, err := ioutil.ReadFile(*clientCA)
+		if err != nil {
+			logger.WithError(err).Error("failed to read -client_ca")
+			return 2
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(b) {
+			logger.WithField("client_ca", *clientCA).Error("-client_ca has no PEM certificates")
+			return 2
+		}
+	}
+	if *highWatermark > 0 {
+		low := *lowWatermark
+		if low <= 0 {
+			low = *highWatermark
+		}
+		if low > *highWatermark {
+			logger.WithFields(logrus.Fields{
+				"high": *highWatermark,
+				"low":  low,
+			}).Error("the low watermark must not exceed the high watermark")
+			return 2
+		}
+		server.Storage = &storageMonitor{
+			dir:      serverRoot,
+			High:     *highWatermark,
+			Low:      low,
+			ReadOnly: *watermarkReadOnly,
+			AlertURL: *alertWebhook,
+		}
+		if command != "check-config" {
+			go server.Storage.run(*watermarkInterval)
+		}
+	}
+	if len(maintenanceWindowFlags) > 0 || *maintenanceBandwidth != 0 {
+		if *maintenanceBandwidth < 0 {
+			logger.WithField("maintenance_bandwidth", *maintenanceBandwidth).Error("-maintenance_bandwidth must not be negative")
+			return 2
+		}
+		server.Maintenance = &maintenance{Bandwidth: *maintenanceBandwidth}
+		for _, def := range maintenanceWindowFlags {
+			w, err := parseMaintenanceWindow(def)
+			if err != nil {
+				logger.WithError(err).Error("invalid maintenance window")
+				return 2
+			}
+			server.Maintenance.Windows = append(server.Maintenance.Windows, w)
+		}
+	}
+	server.Tasks, err = newScheduler(taskFlags, *taskTimeout)
+	if err != nil {
+		logger.WithError(err).Error("invalid task")
+		return 2
+	}
+	if *coldDir != "" {
+		if server.Meta == nil {
+			logger.Error("-cold_dir requires -state_dir")
+			return 2
+		}
+		if *coldRestore != "transparent" && *coldRestore != "explicit" {
+			logger.WithField("cold_restore", *coldRestore).Error("-cold_restore must be transparent or explicit")
+			return 2
+		}
+		backend, err := parseColdBackend(*coldDir)
+		if err != nil {
+			logger.WithError(err).Error("invalid -cold_dir")
+			return 2
+		}
+		server.Tiering = newTiering(backend, *coldAfter, *coldRestore == "transparent")
+		// a tiering task replaces the sweep at every interval.
+		if !server.Tasks.has(taskTiering) {
+			go server.runTiering(*coldInterval)
+		}
+	}
+	signingSecret := server.SecureToken
+	if *signingKey != "" {
+		signingSecret = newSecretValue(*signingKey)
+		server.Signer = newSigner(signingSecret)
+	}
+	if *stateDir != "" {
+		if err := server.Signer.load(filepath.Join(*stateDir, "signer.json")); err != nil {
+			logger.WithError(err).Error("failed to load the state of signed URLs")
+			return 1
+		}
+	}
+	server.AuthorizeTTL = *authorizeTTL
+	server.FileRequestTTL = *fileRequestTTL
+	server.ShareLinkTTL = *shareLinkTTL
+	if *spoolDir != "" {
+		if err := os.MkdirAll(*spoolDir, 0777); err != nil {
+			logger.WithError(err).Error("failed to create the spool directory")
+			return 1
+		}
+		server.SpoolDir = *spoolDir
+	}
+	switch *caseCollision {
+	case caseCollisionAllow, caseCollisionReject, caseCollisionRename:
+	default:
+		logger.WithField("case_collision", *caseCollision).Error("-case_collision must be reject or rename")
+		return 2
+	}
+	server.NormalizeNames = *normalizeNames
+	server.CaseCollision = *caseCollision
+	if *maxPathDepth < 0 || *maxNameLength < 0 || *maxPathLength < 0 {
+		logger.Error("-max_path_depth, -max_name_length and -max_path_length must not be negative")
+		return 2
+	}
+	server.Precompressed = *precompressed
+	server.PathLimits = pathLimits{MaxDepth: *maxPathDepth, MaxNameLength: *maxNameLength, MaxLength: *maxPathLength}
+	server.Durable = *durable
+	if *multipartMemory <= 0 {
+		logger.WithField("multipart_memory", *multipartMemory).Error("-multipart_memory must be positive")
+		return 2
+	}
+	server.MultipartMemory = *multipartMemory
+	if *etag != etagStrong && *etag != etagWeak {
+		logger.WithField("etag", *etag).Error("-etag must be strong or weak")
+		return 2
+	}
+	server.ETag = *etag
+	if command == "ingest" {
+		return server.ingest(ingestSource, *ingestMove)
+	}
+	if *backupSchedule != "" || (*backupTarget != "" && server.Tasks.has(taskBackup)) {
+		var schedule cronSchedule
+		if *backupSchedule != "" {
+			if schedule, err = parseCron(*backupSchedule); err != nil {
+				logger.WithError(err).Error("invalid backup schedule")
+				return 2
+			}
+		}
+		target, err := parseBackupTarget(*backupTarget)
+		if err != nil {
+			logger.WithError(err).Error("invalid backup target")
+			return 2
+		}
+		if *backupKeep < 1 {
+			logger.WithField("backup_keep", *backupKeep).Error("-backup_keep must be at least 1")
+			return 2
+		}
+		server.Backups = newBackups(target, schedule, *backupKeep)
+	}
+	server.Transactions = newTransactions(*txTimeout)
+	go server.Transactions.expire()
+	server.Sessions = newUploadSessions(*sessionTimeout)
+	go server.Sessions.expire()
+	// a prune task replaces the sweep at every interval.
+	if server.Prune != nil && !server.Tasks.has(taskPrune) {
+		go server.pruneEmptyDirsPeriodically(*pruneInterval)
+	}
+	if err := server.checkTasks(); err != nil {
+		logger.WithError(err).Error("invalid task")
+		return 2
+	}
+	for _, def := range smartFolderFlags {
+		f, err := parseSmartFolder(def)
+		if err != nil {
+			logger.WithError(err).Error("invalid smart folder")
+			return 2
+		}
+		server.SmartFolders = append(server.SmartFolders, f)
+	}
+	robots, err := newStaticContent("robots.txt", *robotsFile, []byte(defaultRobotsTxt))
+	if err != nil {
+		logger.WithError(err).Error("failed to load robots.txt")
+		return 2
+	}
+	favicon, err := newStaticContent("favicon.ico", *faviconFile, nil)
+	if err != nil {
+		logger.WithError(err).Error("failed to load favicon")
+		return 2
+	}
+	exempt, err := parseNetworks(*banExempt)
+	if err != nil {
+		logger.WithError(err).Error("invalid -ban_exempt")
+		return 2
+	}
+	proxies, err := parseNetworks(*trustedProxies)
+	if err != nil {
+		logger.WithError(err).Error("invalid -trusted_proxies")
+		return 2
+	}
+	banOpts := banOptions{
+		Tripwires:   tripwireFlags,
+		Duration:    *banDuration,
+		MaxDuration: *banMaxDuration,
+		MaxFailures: *banAuthFailures,
+		Window:      *banWindow,
+		Exempt:      exempt,
+	}
+	if *authLogFile != "" {
+		f, err := os.OpenFile(*authLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			logger.WithError(err).Error("failed to open the auth log")
+			return 1
+		}
+		defer f.Close()
+		banOpts.AuthLog = f
+	}
+	// authentication failures are logged even if nobody is banned.
+	bans, err := newBanList(banOpts)
+	if err != nil {
+		logger.WithError(err).Error("invalid ban options")
+		return 2
+	}
+	if *adminPort > 0 && *adminToken == "" && !isLoopback(*adminIP) {
+		// nothing else would stop anyone who can reach the port from managing the server.
+		logger.WithField("admin_ip", *adminIP).Error("-admin_port is only served without -admin_token on a loopback address")
+		return 2
+	}
+	if command == "check-config" {
+		return checkConfig(os.Stdout, server, secrets)
+	}
+	cleanStaging(serverRoot)
+	server.Sessions.restore(serverRoot)
+	adminSecret := newSecretValue(*adminToken)
+	secrets.bind("token", server.SecureToken)
+	secrets.bind("admin_token", adminSecret)
+	if signingSecret != server.SecureToken {
+		secrets.bind("signing_key", signingSecret)
+	}
+	if len(secrets.refs) > 0 && *secretsRefresh > 0 {
+		go secrets.refresh(*secretsRefresh, *certFile, *keyFile)
+	}
+	// started once the server is configured, since it gets a copy.
+	if server.AMQP != nil {
+		go server.consumeAMQP(server.AMQP)
+	}
+	if server.Moderation != nil {
+		go server.moderate()
+	}
+	if server.Sandbox != nil {
+		go server.detonate()
+		go server.expireScans()
+	}
+	if server.Manifests != nil {
+		go server.writeManifests()
+	}
+	if server.Repos != nil {
+		go server.writeRepos()
+	}
+	if server.Torrents != nil {
+		go server.seed()
+		go server.Torrents.announce()
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/robots.txt", robots)
+	mux.Handle("/favicon.ico", favicon)
+	mux.Handle("/upload", server)
+	mux.Handle("/files/", server)
+	mux.HandleFunc("/upload/authorize", server.handleAuthorize)
+	mux.HandleFunc("/upload/request", server.handleFileRequest)
+	mux.HandleFunc("/share", server.handleShare)
+	mux.HandleFunc("/upload/check", server.handleUploadCheck)
+	mux.HandleFunc("/upload/json", server.handleJSONUpload)
+	mux.HandleFunc("/upload/sessions/", server.handleUploadSession)
+	mux.HandleFunc("/csrf", handleCSRF)
+	mux.HandleFunc("/capabilities", server.handleCapabilities)
+	mux.HandleFunc("/version", server.handleVersion)
+	mux.HandleFunc("/feeds.atom", server.handleFeed)
+	mux.HandleFunc("/feeds/", server.handleFeed)
+	mux.HandleFunc("/meta/", server.handleMeta)
+	mux.HandleFunc("/hold/", server.handleHold)
+	mux.HandleFunc("/report/", server.handleReport)
+	if server.Tiering != nil {
+		mux.HandleFunc("/restore/", server.handleRestore)
+	}
+	mux.HandleFunc("/pipe/", server.handlePipe)
+	mux.HandleFunc("/data/", server.handleData)
+	mux.HandleFunc("/segments/", server.handleSegments)
+	mux.HandleFunc("/sync/manifest/", server.handleSyncManifest)
+	mux.HandleFunc("/sync/apply/", server.handleSyncApply)
+	mux.HandleFunc("/tx", server.handleTransaction)
+	mux.HandleFunc("/tx/", server.handleTransaction)
+	if server.Registry != nil {
+		mux.HandleFunc("/v2/", server.handleRegistry)
+	}
+	if server.LFS != "" {
+		mux.HandleFunc("/lfs/", server.handleLFS)
+	}
+	if server.TFStates != nil {
+		mux.HandleFunc("/tfstate/", server.handleTFState)
+	}
+	if server.Logs != nil {
+		mux.HandleFunc("/logs/", server.handleLogs)
+	}
+	if server.Torrents != nil {
+		mux.HandleFunc("/torrents", server.handleTorrent)
+		mux.HandleFunc("/torrents/", server.handleTorrent)
+	}
+	if server.RBAC != nil && server.RBAC.SAML != nil {
+		mux.HandleFunc("/saml/", server.handleSAML)
+	}
+	if server.Sandbox != nil {
+		mux.HandleFunc("/sandbox/callback/", server.handleSandboxCallback)
+	}
+	if server.Converter != nil {
+		mux.HandleFunc("/convert/", server.handleConvert)
+	}
+	adminMux := newAdminMux()
+	adminMux.HandleFunc("/admin/snapshot", server.handleSnapshot)
+	adminMux.HandleFunc("/admin/policies", server.handlePolicies)
+	adminMux.HandleFunc("/admin/policies/", server.handlePolicies)
+	adminMux.HandleFunc("/admin/reports", server.handleReports)
+	adminMux.HandleFunc("/admin/reports/", server.handleReports)
+	adminMux.HandleFunc("/admin/quarantine/", server.handleQuarantine)
+	if server.Sandbox != nil {
+		adminMux.HandleFunc("/admin/scans", server.handleScans)
+		adminMux.HandleFunc("/admin/scans/", server.handleScans)
+	}
+	if server.RBAC != nil {
+		for _, kind := range []string{kindRoles, kindGroups, kindUsers} {
+			adminMux.HandleFunc("/admin/"+kind, server.handleRBAC)
+			adminMux.HandleFunc("/admin/"+kind+"/", server.handleRBAC)
+		}
+	}
+	adminMux.HandleFunc("/dashboard", server.handleDashboard)
+	adminMux.HandleFunc("/healthz/deep", server.handleDeepHealth)
+	if server.Backups != nil {
+		adminMux.HandleFunc("/admin/backups", server.handleBackups)
+		if *backupSchedule != "" {
+			go server.runBackups()
+		}
+	}
+	if server.Purger != nil {
+		adminMux.HandleFunc("/admin/purge", server.handlePurge)
+	}
+	adminMux.HandleFunc("/admin/tasks", server.handleTasks)
+	adminMux.HandleFunc("/admin/tasks/", server.handleTasks)
+	server.runTasks()
+	if *adminToken != "" {
+		mux.Handle("/debug/", requireAdmin(adminSecret, adminMux))
+		mux.Handle("/admin/", requireAdmin(adminSecret, adminMux))
+		mux.Handle("/dashboard", requireAdmin(adminSecret, adminMux))
+		mux.Handle("/healthz/", requireAdmin(adminSecret, adminMux))
+	}
+	var handler http.Handler = csrfProtect(mux)
+	if server.S3 != nil {
+		handler = server.serveS3(handler)
+	}
+	handler = server.multipartForms(handler)
+	if *uploadTimeout > 0 {
+		handler = uploadDeadline(handler, *uploadTimeout)
+	}
+	go bans.expire()
+	adminMux.HandleFunc("/admin/bans", bans.handleBans)
+	adminMux.HandleFunc("/admin/bans/", bans.handleBans)
+	if server.Authz != nil {
+		handler = server.authorizeExternally(handler)
+	}
+	handler = bans.guard(handler)
+	handler = tagUploads(handler)
+	handler = countResponses(handler, server.Stats)
+	handler = slowLog(handler, mux, slowLogOptions{Duration: *slowDuration, Rate: *slowRate, MinSize: *slowMinSize})
+	if *accessLogEnabled {
+		handler = accessLog(handler)
+	}
+	handler = withEnvelopes(handler, envelope)
+	handler = localize(handler)
+	handler = traceHandler(handler, mux)
+	if len(proxies) > 0 {
+		handler = trustProxies(handler, proxies)
+	}
 
 	errors := make(chan error)
 
@@ -76,12 +1096,38 @@ func run(args []string) int {
 			"cors":             *corsEnabled,
 		}).Info("start listening")
 
-		if err := http.ListenAndServe(fmt.Sprintf("%s:%d", *bindAddress, *listenPort), nil); err != nil {
+		if err := http.ListenAndServe(fmt.Sprintf("%s:%d", *bindAddress, *listenPort), handler); err != nil {
 			errors <- err
 		}
 	}()
 
-	if tlsEnabled {
+	if tlsEnabled && acmeEnabled {
+		certManager := newCertManager(acmeDomains, *acmeCache, *acmeEmail)
+		go func() {
+			logger.WithFields(logrus.Fields{
+				"domains": acmeDomains,
+				"cache":   *acmeCache,
+				"port":    *tlsListenPort,
+			}).Info("start listening TLS with Let's Encrypt certificates")
+
+			tlsServer := &http.Server{
+				Addr:      fmt.Sprintf("%s:%d", *bindAddress, *tlsListenPort),
+				Handler:   handler,
+				TLSConfig: withClientCAs(certManager.TLSConfig(), clientCAs),
+			}
+			if err := tlsServer.ListenAndServeTLS("", ""); err != nil {
+				errors <- err
+			}
+		}()
+		go func() {
+			logger.WithField("port", *acmeHTTPPort).Info("start listening for ACME challenges")
+
+			handler := certManager.HTTPHandler(redirectHTTPS(*tlsListenPort))
+			if err := http.ListenAndServe(fmt.Sprintf("%s:%d", *bindAddress, *acmeHTTPPort), handler); err != nil {
+				errors <- err
+			}
+		}()
+	} else if tlsEnabled {
 		go func() {
 			logger.WithFields(logrus.Fields{
 				"cert": *certFile,
@@ -89,21 +1135,71 @@ func run(args []string) int {
 				"port": *tlsListenPort,
 			}).Info("start listening TLS")
 
-			if err := http.ListenAndServeTLS(fmt.Sprintf("%s:%d", *bindAddress, *tlsListenPort), *certFile, *keyFile, nil); err != nil {
+			tlsServer := &http.Server{
+				Addr:      fmt.Sprintf("%s:%d", *bindAddress, *tlsListenPort),
+				Handler:   handler,
+				TLSConfig: withClientCAs(&tls.Config{}, clientCAs),
+			}
+			cert, key := *certFile, *keyFile
+			if secrets.fromStore("cert") || secrets.fromStore("key") {
+				// the certificate comes from a secret store, and is replaced when it is rotated there.
+				tlsServer.TLSConfig = withClientCAs(secrets.tlsConfig(), clientCAs)
+				cert, key = "", ""
+			}
+			if err := tlsServer.ListenAndServeTLS(cert, key); err != nil {
+				errors <- err
+			}
+		}()
+	}
+
+	if tlsEnabled && *redirectPort > 0 {
+		go func() {
+			logger.WithFields(logrus.Fields{
+				"port":    *redirectPort,
+				"tlsport": *tlsListenPort,
+			}).Info("start redirecting HTTP to HTTPS")
+
+			if err := http.ListenAndServe(fmt.Sprintf("%s:%d", *bindAddress, *redirectPort), redirectHTTPS(*tlsListenPort)); err != nil {
 				errors <- err
 			}
 		}()
+	} else if *redirectPort > 0 {
+		logger.WithField("port", *redirectPort).Warn("TLS is not enabled, so HTTPS redirect is disabled")
 	}
 
-	err := <-errors
+	if *adminPort > 0 {
+		go func() {
+			logger.WithFields(logrus.Fields{"ip": *adminIP, "port": *adminPort}).Info("start listening for admin")
+
+			if err := http.ListenAndServe(fmt.Sprintf("%s:%d", *adminIP, *adminPort), localize(requireAdmin(adminSecret, adminMux))); err != nil {
+				errors <- err
+			}
+		}()
+	}
+
+	err = <-errors
 	logger.WithError(err).Info("closing server")
 
 	return 0
 }
 
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage:\n")
+	fmt.Fprintf(out, "  %s [options] <document root>\n", os.Args[0])
+	fmt.Fprintf(out, "  %s ingest [options] <source directory> <document root>\n", os.Args[0])
+	fmt.Fprintf(out, "  %s check-config [options] <document root>\n", os.Args[0])
+	fmt.Fprintf(out, "  %s selfupdate [selfupdate options]\n", os.Args[0])
+	fmt.Fprintf(out, "  %s version\n", os.Args[0])
+	fmt.Fprintf(out, "\nOptions:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(out, "\nOptions not given are read from the environment variables %s<OPTION>, e.g. %s,\n", envPrefix, envVar("upload_limit"))
+	fmt.Fprintf(out, "or from the file named by %s<OPTION>_FILE; the document root from %sDOCUMENT_ROOT.\n", envPrefix, envPrefix)
+}
+
 func main() {
 	logger = logrus.New()
-	logger.Info("starting up simple-upload-server")
+	logger.WithField("version", currentVersion().Version).Info("starting up simple-upload-server")
 
 	result := run(os.Args)
 	os.Exit(result)
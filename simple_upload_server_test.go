@@ -0,0 +1,16 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestMain(m *testing.M) {
+	// the logger is made by main, which tests do not run.
+	logger = logrus.New()
+	logger.Out = ioutil.Discard
+	os.Exit(m.Run())
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// request phases timed for the slow log
+const (
+	phaseAuth     = "auth"
+	phaseRead     = "read"
+	phaseWrite    = "write"
+	phaseFinalize = "finalize"
+)
+
+var (
+	bytesReceivedMetric = expvar.NewMap("bytes_received")
+	bytesSentMetric     = expvar.NewMap("bytes_sent")
+	slowRequestsMetric  = expvar.NewMap("slow_requests")
+)
+
+// slowLogOptions are the thresholds of requests to log as slow.
+type slowLogOptions struct {
+	// Duration is the longest acceptable duration of a request; 0 disables the check.
+	Duration time.Duration
+	// Rate is the lowest acceptable transfer rate in bytes per second; 0 disables the check.
+	Rate int64
+	// MinSize is the transfer size under which the rate is not checked, since small requests are dominated by latency.
+	MinSize int64
+}
+
+type phasesKey struct{}
+
+// phases accumulates the time a request spends in each phase.
+type phases struct {
+	mu sync.Mutex
+	d  map[string]time.Duration
+}
+
+// addPhase adds the time since start to a phase of the request of ctx.
+func addPhase(ctx context.Context, name string, start time.Time) {
+	p, ok := ctx.Value(phasesKey{}).(*phases)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	p.d[name] += time.Since(start)
+	p.mu.Unlock()
+}
+
+// timedReader adds the time blocked in Read to a phase.
+type timedReader struct {
+	io.ReadCloser
+	ctx   context.Context
+	phase string
+	n     int64
+}
+
+func (t *timedReader) Read(b []byte) (int, error) {
+	start := time.Now()
+	n, err := t.ReadCloser.Read(b)
+	addPhase(t.ctx, t.phase, start)
+	t.n += int64(n)
+	return n, err
+}
+
+// timedWriter adds the time blocked in Write to a phase.
+type timedWriter struct {
+	io.Writer
+	ctx   context.Context
+	phase string
+}
+
+func (t timedWriter) Write(b []byte) (int, error) {
+	start := time.Now()
+	n, err := t.Writer.Write(b)
+	addPhase(t.ctx, t.phase, start)
+	return n, err
+}
+
+// slowLog wraps h to account the bytes transferred by route, and to log requests slower than the thresholds
+// with the time spent in each phase, which tells slow clients (read) from slow storage (write, finalize).
+// Requests are grouped by the patterns of mux they match, so that arbitrary paths do not add metrics.
+func slowLog(h http.Handler, mux *http.ServeMux, opts slowLogOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		p := &phases{d: map[string]time.Duration{}}
+		ctx := context.WithValue(r.Context(), phasesKey{}, p)
+		body := &timedReader{ReadCloser: r.Body, ctx: ctx, phase: phaseRead}
+		r = r.WithContext(ctx)
+		r.Body = body
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "other"
+		}
+		bytesReceivedMetric.Add(route, body.n)
+		bytesSentMetric.Add(route, rec.written)
+		duration := time.Since(start)
+		size := body.n + rec.written
+		rate := int64(float64(size) / duration.Seconds())
+		slow := opts.Duration > 0 && duration > opts.Duration
+		if opts.Rate > 0 && size >= opts.MinSize && rate < opts.Rate {
+			slow = true
+		}
+		if !slow {
+			return
+		}
+		slowRequestsMetric.Add(route, 1)
+		fields := logrus.Fields{
+			"remote":   r.RemoteAddr,
+			"method":   r.Method,
+			"path":     r.URL.Path,
+			"status":   rec.status,
+			"received": body.n,
+			"sent":     rec.written,
+			"duration": duration.Seconds(),
+			"rate":     rate,
+		}
+		p.mu.Lock()
+		for name, d := range p.d {
+			fields["phase_"+name] = d.Seconds()
+		}
+		p.mu.Unlock()
+		logger.WithFields(fields).Warn("slow request")
+	})
+}
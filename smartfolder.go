@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// smartFolder is a virtual directory listing the files which match a query.
+//
+// A query is a space-separated list of terms, all of which must match:
+//
+//	recent:N      the N most recently modified files
+//	mime:TYPE     files whose content type (by extension) matches TYPE, e.g. image/*
+//	ext:EXT       files with the extension EXT, e.g. .pdf
+//	name:GLOB     files whose name matches GLOB
+//	under:DIR     files under DIR
+//	newer:DUR     files modified within DUR, e.g. 24h
+type smartFolder struct {
+	Name   string
+	Query  string
+	recent int
+	terms  []func(rel string, info os.FileInfo) bool
+}
+
+// smartFile is a file matching a smart folder query.
+type smartFile struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// parseSmartFolder parses a definition given as "name=query".
+func parseSmartFolder(def string) (smartFolder, error) {
+	i := strings.Index(def, "=")
+	if i <= 0 {
+		return smartFolder{}, fmt.Errorf("smart folder %q must be given as name=query", def)
+	}
+	f := smartFolder{Name: def[:i], Query: def[i+1:]}
+	if strings.Contains(f.Name, "/") {
+		return f, fmt.Errorf("smart folder name %q must not contain slashes", f.Name)
+	}
+	for _, term := range strings.Fields(f.Query) {
+		j := strings.Index(term, ":")
+		if j <= 0 {
+			return f, fmt.Errorf("invalid term %q in smart folder %q", term, f.Name)
+		}
+		key, value := term[:j], term[j+1:]
+		switch key {
+		case "recent":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return f, fmt.Errorf("invalid count %q in smart folder %q", value, f.Name)
+			}
+			f.recent = n
+		case "mime":
+			f.terms = append(f.terms, func(rel string, info os.FileInfo) bool {
+				mediaType, _, _ := mime.ParseMediaType(mime.TypeByExtension(path.Ext(rel)))
+				ok, _ := path.Match(value, mediaType)
+				return ok
+			})
+		case "ext":
+			f.terms = append(f.terms, func(rel string, info os.FileInfo) bool {
+				return strings.EqualFold(path.Ext(rel), value)
+			})
+		case "name":
+			if _, err := path.Match(value, ""); err != nil {
+				return f, fmt.Errorf("invalid pattern %q in smart folder %q", value, f.Name)
+			}
+			f.terms = append(f.terms, func(rel string, info os.FileInfo) bool {
+				ok, _ := path.Match(value, path.Base(rel))
+				return ok
+			})
+		case "under":
+			prefix := strings.Trim(value, "/") + "/"
+			f.terms = append(f.terms, func(rel string, info os.FileInfo) bool {
+				return strings.HasPrefix(rel, prefix)
+			})
+		case "newer":
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return f, fmt.Errorf("invalid duration %q in smart folder %q", value, f.Name)
+			}
+			f.terms = append(f.terms, func(rel string, info os.FileInfo) bool {
+				return time.Since(info.ModTime()) <= d
+			})
+		default:
+			return f, fmt.Errorf("unknown term %q in smart folder %q", key, f.Name)
+		}
+	}
+	return f, nil
+}
+
+// files evaluates the query over the files under root, newest first.
+func (f smartFolder) files(root string) ([]smartFile, error) {
+	result := []smartFile{}
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && isInternalName(info.Name()) {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		for _, term := range f.terms {
+			if !term(rel, info) {
+				return nil
+			}
+		}
+		result = append(result, smartFile{Path: rel, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ModTime.After(result[j].ModTime)
+	})
+	if f.recent > 0 && len(result) > f.recent {
+		result = result[:f.recent]
+	}
+	return result, nil
+}
+
+// smartFolderOf returns the smart folder addressed by a path under /files/ and the path within it.
+// For a user confined to a home directory, smart folders are within it, and only list the files there.
+func (s Server) smartFolderOf(urlPath string) (smartFolder, string, bool) {
+	if !strings.HasPrefix(urlPath, "/files"+s.Home+"/") {
+		return smartFolder{}, "", false
+	}
+	rest := strings.TrimPrefix(urlPath, "/files"+s.Home+"/")
+	name := rest
+	within := ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		name, within = rest[:i], rest[i+1:]
+	}
+	for _, f := range s.SmartFolders {
+		if f.Name == name {
+			return f, within, true
+		}
+	}
+	return smartFolder{}, "", false
+}
+
+// handleSmartFolder lists a smart folder, or serves a file in it.
+func (s Server) handleSmartFolder(w http.ResponseWriter, r *http.Request, f smartFolder, within string) {
+	base := "/files" + s.Home + "/" + f.Name + "/"
+	if !strings.HasPrefix(r.URL.Path, base) {
+		http.Redirect(w, r, base, http.StatusMovedPermanently)
+		return
+	}
+	root := filepath.Join(s.DocumentRoot, filepath.FromSlash(s.Home))
+	files, err := f.files(root)
+	if err != nil {
+		logger.WithError(err).WithField("folder", f.Name).Error("failed to evaluate the smart folder")
+		respondError(w, err)
+		return
+	}
+	if s.EnableCORS {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+	if within == "" {
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			writeJSON(w, files)
+			return
+		}
+		// the same format as directory listings of http.FileServer
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, "<pre>\n")
+		for _, file := range files {
+			fmt.Fprintf(w, "<a href=\"%s\">%s</a>\n", (&url.URL{Path: file.Path}).String(), html.EscapeString(file.Path))
+		}
+		fmt.Fprintf(w, "</pre>\n")
+		return
+	}
+	for _, file := range files {
+		if file.Path == within {
+			if err := s.checkQuarantine(path.Join("/", s.Home, file.Path)); err != nil {
+				respondError(w, err)
+				return
+			}
+			http.ServeFile(w, r, filepath.Join(root, filepath.FromSlash(file.Path)))
+			return
+		}
+	}
+	respondError(w, fmt.Errorf("\"%s\" is %w", r.URL.Path, errNotFound))
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var errNoStateDir = errors.New("state directory is not configured (see -state_dir)")
+
+type snapshotResponse struct {
+	response
+	Path  string `json:"path"`
+	Files int    `json:"files"`
+}
+
+// appendedFile is a file of a snapshot which may be appended to in place, with the size it had when it was taken.
+type appendedFile struct {
+	rel  string
+	size int64
+}
+
+// linkTree makes dst a copy of the tree under src by hard links, which take no space and no time to copy the content.
+// Files are copied instead where links are not possible, e.g. across devices. The staging directories of the server
+// are skipped. The files for which appended is true, given their paths relative to src as "/dir/name", are linked
+// too, but returned with their sizes, so that they can be copied up to that size once changes may go on.
+func linkTree(src string, dst string, appended func(rel string) bool) (int, []appendedFile, error) {
+	files := 0
+	var toCopy []appendedFile
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && p != src && isInternalName(info.Name()) {
+			return filepath.SkipDir
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0777)
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		files++
+		if appended != nil && appended("/"+filepath.ToSlash(rel)) {
+			toCopy = append(toCopy, appendedFile{rel: rel, size: info.Size()})
+		}
+		if err := os.Link(p, target); err == nil {
+			return nil
+		}
+		return copyFile(p, target, info)
+	})
+	return files, toCopy, err
+}
+
+// copyFile copies src to dst, keeping the modification time.
+func copyFile(src string, dst string, info os.FileInfo) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = copyBuffer(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(dst, info.ModTime(), info.ModTime())
+	}
+	return err
+}
+
+// detachAppended replaces the links to the files of dir appended to in place by copies of their first bytes, as
+// many as they had when the snapshot was taken, so that the snapshot does not change with them.
+func detachAppended(dir string, files []appendedFile) error {
+	for _, af := range files {
+		target := filepath.Join(dir, af.rel)
+		in, err := os.Open(target)
+		if err != nil {
+			return err
+		}
+		info, err := in.Stat()
+		if err != nil {
+			in.Close()
+			return err
+		}
+		out, err := ioutil.TempFile(filepath.Dir(target), stagingPrefix+"append_")
+		if err != nil {
+			in.Close()
+			return err
+		}
+		n, err := copyBuffer(out, io.LimitReader(in, af.size))
+		in.Close()
+		if err == nil && n < af.size {
+			err = fmt.Errorf("%s: shrank from %d to %d bytes", af.rel, af.size, n)
+		}
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Chmod(out.Name(), info.Mode().Perm())
+		}
+		if err == nil {
+			err = os.Chtimes(out.Name(), info.ModTime(), info.ModTime())
+		}
+		if err == nil {
+			err = renameFile(out.Name(), target)
+		}
+		if err != nil {
+			os.Remove(out.Name())
+			return err
+		}
+	}
+	return nil
+}
+
+// appendsInPlace reports whether the file rel, a path relative to the document root, may be appended to in place,
+// like the segments of logs and shipped logs, rather than replaced.
+func (s Server) appendsInPlace(rel string) bool {
+	if _, ok := s.logModeAt(rel); ok {
+		return true
+	}
+	return s.Logs != nil && matchPrefix(rel, s.Logs.Prefix)
+}
+
+// moveTree moves the tree src to dst, or copies it if dst is on another device, leaving src to be removed.
+func moveTree(src string, dst string) error {
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	_, _, err := linkTree(src, dst, nil)
+	return err
+}
+
+// stageSnapshot makes a consistent copy of the document root and the metadata in a new staging directory of the
+// document root, as "files" and "meta". Changes are only held off while the files are linked, which takes a moment
+// even for large trees; the files appended to in place are then copied up to the size they had meanwhile.
+func (s Server) stageSnapshot() (string, int, error) {
+	dir, err := ioutil.TempDir(s.DocumentRoot, stagingPrefix+"snapshot_")
+	if err != nil {
+		return "", 0, err
+	}
+	metaDir := ""
+	if s.Meta != nil {
+		// the metadata is linked next to it, since it may be on another device than the document root.
+		if metaDir, err = ioutil.TempDir(filepath.Dir(s.Meta.dir), stagingPrefix+"snapshot_"); err != nil {
+			os.RemoveAll(dir)
+			return "", 0, err
+		}
+		defer os.RemoveAll(metaDir)
+	}
+	files, appended, err := s.linkSnapshot(filepath.Join(dir, "files"), metaDir)
+	if err == nil {
+		err = detachAppended(filepath.Join(dir, "files"), appended)
+	}
+	if err == nil && metaDir != "" {
+		err = moveTree(metaDir, filepath.Join(dir, "meta"))
+	}
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", files, err
+	}
+	return dir, files, nil
+}
+
+// linkSnapshot links the document root into filesDir and the metadata into metaDir, if any, holding off changes.
+func (s Server) linkSnapshot(filesDir string, metaDir string) (int, []appendedFile, error) {
+	s.publishLock.Lock()
+	defer s.publishLock.Unlock()
+	files, appended, err := linkTree(s.DocumentRoot, filesDir, s.appendsInPlace)
+	if err != nil || metaDir == "" {
+		return files, appended, err
+	}
+	s.Meta.mu.Lock()
+	defer s.Meta.mu.Unlock()
+	// the metadata is replaced rather than changed in place, so links keep it as it is.
+	_, _, err = linkTree(s.Meta.dir, metaDir, nil)
+	return files, appended, err
+}
+
+// snapshot makes a consistent copy of the document root and the metadata in dir, as "files" and "meta".
+// It is staged in the document root, and moved to dir, or copied there without holding off changes if dir is
+// on another device.
+func (s Server) snapshot(dir string) (int, error) {
+	staging, files, err := s.stageSnapshot()
+	if err != nil {
+		return files, err
+	}
+	defer os.RemoveAll(staging)
+	if err := os.MkdirAll(filepath.Dir(dir), 0777); err != nil {
+		return files, err
+	}
+	return files, moveTree(staging, dir)
+}
+
+// handleSnapshot serves the admin endpoint /admin/snapshot: GET streams a snapshot as a tar,
+// and POST keeps it in the state directory, under snapshots/.
+func (s Server) handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.streamSnapshot(w, r)
+	case http.MethodPost:
+		if s.StateDir == "" {
+			respondError(w, withStatus(http.StatusNotImplemented, errNoStateDir))
+			return
+		}
+		dir := filepath.Join(s.StateDir, "snapshots", time.Now().UTC().Format("20060102T150405.000Z"))
+		files, err := s.snapshot(dir)
+		if err != nil {
+			logger.WithError(err).WithField("dir", dir).Error("failed to take a snapshot")
+			os.RemoveAll(dir)
+			respondError(w, err)
+			return
+		}
+		auditLog().WithFields(logrus.Fields{
+			"dir":   dir,
+			"files": files,
+		}).Info("snapshot taken")
+		w.WriteHeader(http.StatusOK)
+		writeJSON(w, snapshotResponse{response: response{OK: true}, Path: dir, Files: files})
+	default:
+		w.Header().Set("Allow", "GET,POST")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+	}
+}
+
+func (s Server) streamSnapshot(w http.ResponseWriter, r *http.Request) {
+	// the staged snapshot is streamed without holding off changes.
+	dir, files, err := s.stageSnapshot()
+	if err != nil {
+		logger.WithError(err).Error("failed to take a snapshot")
+		respondError(w, err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	auditLog().WithField("files", files).Info("snapshot exported")
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"snapshot-%s.tar\"", time.Now().UTC().Format("20060102T150405Z")))
+	w.WriteHeader(http.StatusOK)
+	tw := tar.NewWriter(w)
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil || p == dir || !(info.IsDir() || info.Mode().IsRegular()) {
+			return err
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if info.IsDir() {
+			hdr.Name += "/"
+			return tw.WriteHeader(hdr)
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err = copyBuffer(tw, io.LimitReader(f, info.Size()))
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		// the status has been sent, so the only way to tell the client is to break the stream.
+		logger.WithError(err).Error("failed to stream the snapshot")
+		panic(http.ErrAbortHandler)
+	}
+}
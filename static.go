@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+// defaultRobotsTxt keeps crawlers away from every file.
+const defaultRobotsTxt = "User-agent: *\nDisallow: /\n"
+
+// staticContent serves a fixed content without authentication.
+type staticContent struct {
+	name        string
+	contentType string
+	body        []byte
+	modTime     time.Time
+}
+
+// newStaticContent creates a static content loaded from file, or fallback if file is empty.
+func newStaticContent(name string, file string, fallback []byte) (staticContent, error) {
+	c := staticContent{name: name, body: fallback, modTime: time.Now()}
+	if file != "" {
+		body, err := ioutil.ReadFile(file)
+		if err != nil {
+			return c, err
+		}
+		c.body = body
+		c.contentType = mime.TypeByExtension(filepath.Ext(file))
+	}
+	if c.contentType == "" {
+		c.contentType = mime.TypeByExtension(filepath.Ext(name))
+	}
+	return c, nil
+}
+
+func (c staticContent) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET,HEAD")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	// nothing is configured, so tell clients there is nothing instead of responding 404.
+	if c.body == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if c.contentType != "" {
+		w.Header().Set("Content-Type", c.contentType)
+	}
+	http.ServeContent(w, r, c.name, c.modTime, bytes.NewReader(c.body))
+}
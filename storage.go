@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// forget drops what the server keeps about rel, a path relative to the document root, once the file is deleted.
+func (s Server) forget(rel string) {
+	if s.Meta != nil {
+		if meta, err := s.Meta.get(rel); err == nil {
+			if meta.Cold != nil && s.Tiering != nil {
+				if err := s.Tiering.backend.remove(context.Background(), rel); err != nil {
+					logger.WithError(err).WithField("path", rel).Warn("failed to remove the cold copy")
+				}
+			}
+			if meta.CID != "" && s.IPFS != nil {
+				if err := s.IPFS.unpin(context.Background(), meta.CID); err != nil {
+					logger.WithError(err).WithField("path", rel).Warn("failed to unpin the file from IPFS")
+				}
+			}
+		}
+		if err := s.Meta.remove(rel); err != nil {
+			logger.WithError(err).WithField("path", rel).Warn("failed to remove metadata")
+		}
+	}
+	if s.Tiering != nil {
+		s.Tiering.forget(rel)
+	}
+	if s.Torrents != nil {
+		if _, err := s.Torrents.remove(rel); err != nil {
+			logger.WithError(err).WithField("path", rel).Warn("failed to stop seeding the file")
+		}
+	}
+	s.Digests.forget(path.Join(s.DocumentRoot, rel))
+}
+
+// uploadDeadline wraps h so that uploads by POST and PUT are abandoned after d, like a disconnected client.
+func uploadDeadline(h http.Handler, d time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodPut {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// spoolDir returns the directory for uploads in progress.
+func (s Server) spoolDir() string {
+	if s.SpoolDir != "" {
+		return s.SpoolDir
+	}
+	return s.DocumentRoot
+}
+
+// received describes the content of a request stored into a temporary file.
+type received struct {
+	TempName string
+	// Filename is the name given by the client in a multipart form.
+	Filename string
+	// RelativePath is the path of the file within a folder uploaded in a multipart form, if any.
+	RelativePath string
+	Size         int64
+	// Digest is the hex digest of the content, made with the configured algorithm.
+	Digest string
+	// Signature is the detached OpenPGP signature of the content sent with it, if any.
+	Signature []byte
+}
+
+// receive stores the content of a request into a new temporary file in the spool directory, hashing it on the way.
+// The caller is responsible for moving or removing the file.
+func (s Server) receive(w http.ResponseWriter, r *http.Request) (received, error) {
+	// multipart requests carry the content in the "file" field; anything else is taken as the raw content,
+	// which allows clients to stream a body of unknown length with chunked transfer encoding.
+	if isMultipart(r) {
+		// the file part has been spooled by multipartForms as the body was read.
+		uploads := multipartUploads(r)
+		if len(uploads) == 0 {
+			return received{}, http.ErrMissingFile
+		}
+		rcv := uploads[0]
+		if len(rcv.Signature) == 0 {
+			sig, err := signatureOf(r)
+			if err != nil {
+				return received{}, err
+			}
+			rcv.Signature = sig
+		}
+		return rcv, nil
+	}
+	if r.ContentLength > s.MaxUploadSize {
+		return received{}, errFileTooLarge
+	}
+	sig, err := signatureOf(r)
+	if err != nil {
+		return received{}, err
+	}
+	rcv, err := s.spool(r.Context(), r.Body, received{Signature: sig})
+	if err == errFileTooLarge {
+		// the rest of the body is never read, so don't try to reuse the connection.
+		w.Header().Set("Connection", "close")
+	}
+	return rcv, err
+}
+
+// spool copies src into a new temporary file in the spool directory, hashing it on the way, and fills rcv.
+func (s Server) spool(ctx context.Context, src io.Reader, rcv received) (received, error) {
+	// the spool directory is the document root by default, so that the file can simply be renamed into place;
+	// otherwise commitFile copies it over if it is on another device.
+	tempFile, err := ioutil.TempFile(s.spoolDir(), "upload_")
+	if err != nil {
+		return rcv, err
+	}
+
+	// read one byte more than the limit, so that an oversized body is detected as it arrives.
+	// The content is hashed while it is written, rather than read again afterwards.
+	h := s.Digests.hash()
+	var n int64
+	err = traceStorage(ctx, "storage.write", tempFile.Name(), func() (err error) {
+		disk := timedWriter{Writer: tempFile, ctx: ctx, phase: phaseWrite}
+		n, err = pipeCopy(ctx, io.LimitReader(src, s.MaxUploadSize+1), disk, h)
+		return err
+	})
+	if err == nil && n <= s.MaxUploadSize && s.Durable {
+		err = traceStorage(ctx, "storage.sync", tempFile.Name(), tempFile.Sync)
+	}
+	if err != nil {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return rcv, err
+	}
+	if n > s.MaxUploadSize {
+		tempFile.Close()
+		os.Remove(tempFile.Name())
+		return rcv, errFileTooLarge
+	}
+	// explicitly close the file to flush it, so that it can be renamed into place (see renameFile).
+	if err := tempFile.Close(); err != nil {
+		os.Remove(tempFile.Name())
+		return rcv, err
+	}
+	rcv.TempName = tempFile.Name()
+	rcv.Size = n
+	rcv.Digest = hex.EncodeToString(h.Sum(nil))
+	return rcv, nil
+}
+
+// commitFile moves the temporary file to targetPath, creating the directories on the way.
+// The temporary file is removed on failure, or if ctx is done, e.g. because the client has gone.
+func (s Server) commitFile(ctx context.Context, tempName string, targetPath string) error {
+	if err := ctx.Err(); err != nil {
+		os.Remove(tempName)
+		return err
+	}
+	defer addPhase(ctx, phaseFinalize, time.Now())
+	targetDir := path.Dir(targetPath)
+	if err := traceStorage(ctx, "storage.mkdir", targetDir, func() error {
+		return os.MkdirAll(targetDir, 0777)
+	}); err != nil {
+		os.Remove(tempName)
+		return err
+	}
+	if err := traceStorage(ctx, "storage.rename", targetPath, func() error {
+		// shared with other uploads, but not with snapshots.
+		s.publishLock.RLock()
+		defer s.publishLock.RUnlock()
+		err := moveFile(ctx, tempName, targetPath)
+		if os.IsNotExist(err) {
+			// the directory may have been removed as empty since it was created (see pruneEmptyDirs).
+			if err = os.MkdirAll(targetDir, 0777); err == nil {
+				err = moveFile(ctx, tempName, targetPath)
+			}
+		}
+		return err
+	}); err != nil {
+		os.Remove(tempName)
+		return err
+	}
+	if s.Durable {
+		return traceStorage(ctx, "storage.sync", targetDir, func() error {
+			return syncDir(targetDir)
+		})
+	}
+	return nil
+}
+
+// moveFile renames src to dst. If they are on different devices, src is copied to a temporary file next to dst,
+// which is synced and renamed into place, so that dst never has partial content. The copy stops if ctx is done.
+func moveFile(ctx context.Context, src string, dst string) error {
+	err := renameFile(src, dst)
+	if err == nil || !isCrossDevice(err) {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tempFile, err := ioutil.TempFile(filepath.Dir(dst), "upload_")
+	if err != nil {
+		return err
+	}
+	_, err = copyBuffer(tempFile, contextReader{ctx: ctx, r: in})
+	if err == nil {
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = renameFile(tempFile.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	errUnsafeSVG = errors.New("SVG image with active content")
+	errNotSVG    = errors.New("not an SVG image")
+)
+
+// What is done with the SVG images uploaded under a prefix.
+const (
+	svgSanitize = "sanitize"
+	svgReject   = "reject"
+)
+
+const xhtmlNS = "http://www.w3.org/1999/xhtml"
+
+// svgUnsafeElements are removed from SVG images with their content, by lowercase local name in any namespace:
+// they run scripts, or embed documents which can.
+var svgUnsafeElements = map[string]bool{
+	"script":        true,
+	"foreignobject": true,
+	"handler":       true,
+	"listener":      true,
+	"iframe":        true,
+	"frame":         true,
+	"embed":         true,
+	"object":        true,
+	"applet":        true,
+	"meta":          true,
+	"base":          true,
+	"form":          true,
+}
+
+// svgAnimations can change other attributes, which makes them unsafe when they change event handlers or links.
+var svgAnimations = map[string]bool{
+	"set":              true,
+	"animate":          true,
+	"animatetransform": true,
+	"animatemotion":    true,
+}
+
+// svgURLAttributes hold URLs, or values animated into URLs, which are removed if they run scripts.
+var svgURLAttributes = map[string]bool{
+	"href":       true,
+	"src":        true,
+	"action":     true,
+	"formaction": true,
+	"data":       true,
+	"base":       true,
+	"to":         true,
+	"from":       true,
+	"by":         true,
+	"values":     true,
+}
+
+// svgSafeDataURLs are the media types of the data: URLs left in SVG images.
+var svgSafeDataURLs = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+// parseSVGPolicy parses an SVG policy given as "prefix=sanitize" or "prefix=reject".
+func parseSVGPolicy(def string) (policy, error) {
+	i := strings.LastIndex(def, "=")
+	if i <= 0 || (def[i+1:] != svgSanitize && def[i+1:] != svgReject) {
+		return policy{}, fmt.Errorf("SVG policy %q must be given as prefix=sanitize or prefix=reject", def)
+	}
+	return policy{Prefix: cleanPrefix(def[:i]), SVG: def[i+1:]}, nil
+}
+
+// isScriptURL tells whether v, the value of a URL attribute, has a URL running a script when followed.
+func isScriptURL(v string) bool {
+	// browsers ignore whitespace and control characters in schemes.
+	v = strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return unicode.ToLower(r)
+	}, v)
+	if strings.Contains(v, "javascript:") || strings.Contains(v, "vbscript:") {
+		return true
+	}
+	for i := strings.Index(v, "data:"); i >= 0; i = strings.Index(v, "data:") {
+		v = v[i+len("data:"):]
+		safe := false
+		for _, t := range svgSafeDataURLs {
+			safe = safe || strings.HasPrefix(v, t+";") || strings.HasPrefix(v, t+",")
+		}
+		if !safe {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeSVG copies the SVG image read from src to dst, removing scripts, event handlers and whatever else
+// can run scripts in a browser, and returns what was removed, if anything. Processing instructions other than
+// the XML declaration and the DTD are removed too; custom entities are not supported.
+func sanitizeSVG(src io.Reader, dst io.Writer) ([]string, error) {
+	d := xml.NewDecoder(src)
+	w := bufio.NewWriter(dst)
+	removed := map[string]bool{}
+	// open are the names of the open elements, and scopes the namespaces they declare by prefix.
+	var open []xml.Name
+	var scopes []map[string]string
+	lookupNS := func(prefix string) string {
+		for i := len(scopes) - 1; i >= 0; i-- {
+			if uri, ok := scopes[i][prefix]; ok {
+				return uri
+			}
+		}
+		return ""
+	}
+	// skipped is the depth within a removed element.
+	skipped := 0
+	root := true
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if skipped > 0 {
+				skipped++
+				continue
+			}
+			if root && t.Name.Local != "svg" {
+				return nil, errNotSVG
+			} else if !root && len(open) == 0 {
+				return nil, errors.New("more than one root element")
+			}
+			root = false
+			ns := map[string]string{}
+			for _, a := range t.Attr {
+				if a.Name.Space == "" && a.Name.Local == "xmlns" {
+					ns[""] = a.Value
+				} else if a.Name.Space == "xmlns" {
+					ns[a.Name.Local] = a.Value
+				}
+			}
+			open, scopes = append(open, t.Name), append(scopes, ns)
+			local := strings.ToLower(t.Name.Local)
+			unsafe := svgUnsafeElements[local] || lookupNS(t.Name.Space) == xhtmlNS
+			if svgAnimations[local] {
+				for _, a := range t.Attr {
+					target := strings.ToLower(strings.TrimSpace(a.Value))
+					if a.Name.Local == "attributeName" && (strings.HasPrefix(target, "on") || strings.TrimPrefix(target, "xlink:") == "href") {
+						unsafe = true
+					}
+				}
+			}
+			if unsafe {
+				removed[t.Name.Local+" element"] = true
+				open, scopes = open[:len(open)-1], scopes[:len(scopes)-1]
+				skipped = 1
+				continue
+			}
+			w.WriteString("<" + qualifiedName(t.Name.Space, t.Name.Local))
+			for _, a := range t.Attr {
+				name := strings.ToLower(a.Name.Local)
+				if a.Name.Space != "xmlns" && (strings.HasPrefix(name, "on") || (svgURLAttributes[name] && isScriptURL(a.Value))) {
+					removed[a.Name.Local+" attribute"] = true
+					continue
+				}
+				w.WriteString(" " + qualifiedName(a.Name.Space, a.Name.Local) + `="` + escapeC14NAttr(a.Value) + `"`)
+			}
+			w.WriteString(">")
+		case xml.EndElement:
+			if skipped > 0 {
+				skipped--
+				continue
+			}
+			if len(open) == 0 || open[len(open)-1] != t.Name {
+				return nil, fmt.Errorf("unexpected end element %s", t.Name.Local)
+			}
+			open, scopes = open[:len(open)-1], scopes[:len(scopes)-1]
+			w.WriteString("</" + qualifiedName(t.Name.Space, t.Name.Local) + ">")
+		case xml.CharData:
+			if skipped == 0 {
+				w.WriteString(escapeC14NText(string(t)))
+			}
+		case xml.Comment:
+			if skipped == 0 {
+				w.WriteString("<!--" + string(t) + "-->")
+			}
+		case xml.ProcInst:
+			if t.Target == "xml" {
+				w.WriteString("<?xml " + string(t.Inst) + "?>")
+			} else if skipped == 0 {
+				// like xml-stylesheet, which can apply XSLT running scripts.
+				removed["<?"+t.Target+"?> processing instruction"] = true
+			}
+		}
+	}
+	if root {
+		return nil, errNotSVG
+	} else if len(open) > 0 || skipped > 0 {
+		return nil, errors.New("incomplete document")
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	found := make([]string, 0, len(removed))
+	for what := range removed {
+		found = append(found, what)
+	}
+	sort.Strings(found)
+	return found, nil
+}
+
+// svgKind tells whether file, received to be stored as rel, is an SVG image, and whether it is compressed (.svgz).
+// Images are recognized by their extension, or by their content if served as XML, which browsers render as well.
+func svgKind(rel string, file string) (isSVG bool, compressed bool, sure bool) {
+	ext := strings.ToLower(path.Ext(rel))
+	switch ext {
+	case ".svg":
+		return true, false, true
+	case ".svgz":
+		return true, true, true
+	}
+	if t := mime.TypeByExtension(ext); t != "" && !strings.Contains(t, "xml") {
+		return false, false, true
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return false, false, false
+	}
+	defer f.Close()
+	head := make([]byte, 1024)
+	n, _ := io.ReadFull(f, head)
+	if t := http.DetectContentType(head[:n]); !strings.Contains(t, "xml") && !strings.HasPrefix(t, "text/plain") {
+		return false, false, true
+	}
+	return bytes.Contains(bytes.ToLower(head[:n]), []byte("<svg")), false, false
+}
+
+// checkSVG applies the SVG policy of rel, a path relative to the document root, to the content received for it:
+// SVG images with active content are rejected, or replaced with their sanitized version, updating the size and
+// digest of rcv. Images without are stored as they are.
+func (s Server) checkSVG(rel string, rcv *received) error {
+	p, ok := s.Policies.lookup(rel)
+	if !ok || p.SVG == "" {
+		return nil
+	}
+	isSVG, compressed, sure := svgKind(rel, rcv.TempName)
+	if !isSVG {
+		return nil
+	}
+	in, err := os.Open(rcv.TempName)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := ioutil.TempFile(filepath.Dir(rcv.TempName), "upload_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	var src io.Reader = in
+	var dst io.Writer = out
+	var zw *gzip.Writer
+	if compressed {
+		zr, err := gzip.NewReader(in)
+		if err != nil {
+			return withStatus(http.StatusUnsupportedMediaType, fmt.Errorf("\"/files%s\" is %w: %v", rel, errNotSVG, err))
+		}
+		src, zw = zr, gzip.NewWriter(out)
+		dst = zw
+	}
+	removed, err := sanitizeSVG(src, dst)
+	if err != nil {
+		if !sure {
+			// XML documents which are not valid SVG images are not rendered as such either.
+			return nil
+		}
+		if !errors.Is(err, errNotSVG) {
+			err = fmt.Errorf("%w: %v", errNotSVG, err)
+		}
+		return withStatus(http.StatusUnsupportedMediaType, fmt.Errorf("\"/files%s\" is %w", rel, err))
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	entry := auditLog().WithFields(logrus.Fields{"path": "/files" + rel, "removed": removed})
+	if p.SVG == svgReject {
+		entry.Warn("SVG image with active content rejected")
+		return withStatus(http.StatusUnsupportedMediaType, fmt.Errorf("\"/files%s\" is an %w (%s)", rel, errUnsafeSVG, strings.Join(removed, ", ")))
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return err
+		}
+	}
+	if s.Durable {
+		if err := out.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	in.Close()
+	if err := renameFile(out.Name(), rcv.TempName); err != nil {
+		return err
+	}
+	info, err := os.Stat(rcv.TempName)
+	if err != nil {
+		return err
+	}
+	sum, err := hashFile(rcv.TempName, s.Digests.hash())
+	if err != nil {
+		return err
+	}
+	rcv.Size, rcv.Digest = info.Size(), sum
+	entry.Info("SVG image sanitized")
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// manifestEntry describes a stored file in a sync manifest.
+type manifestEntry struct {
+	// Path is relative to the synchronized directory.
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	// Digest is the digest of the content as "algorithm:hex".
+	Digest string `json:"digest"`
+}
+
+type manifestResponse struct {
+	response
+	Dir   string          `json:"dir"`
+	Files []manifestEntry `json:"files"`
+}
+
+// syncRequest applies the changes of a sync client to a directory: the files staged in a transaction are stored,
+// and the files in Delete, relative to the directory, are deleted, all at once.
+type syncRequest struct {
+	Transaction string   `json:"transaction,omitempty"`
+	Delete      []string `json:"delete,omitempty"`
+}
+
+type syncResponse struct {
+	response
+	Paths   []string `json:"paths"`
+	Deleted []string `json:"deleted"`
+	// CIDs are the IPFS CIDs of the stored files by path, if they were added there.
+	CIDs map[string]string `json:"cids,omitempty"`
+}
+
+// syncDirOf returns the directory addressed by a sync URL, relative to the document root.
+func syncDirOf(urlPath string, prefix string) string {
+	return path.Clean("/" + toSlash(strings.TrimPrefix(urlPath, prefix)))
+}
+
+// handleSyncManifest serves GET /sync/manifest/(dir), listing the files under dir with their digests.
+func (s Server) handleSyncManifest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	if err := s.checkToken(r); s.isAuthenticationRequired(r) && err != nil {
+		respondError(w, err)
+		return
+	}
+	dir := syncDirOf(r.URL.Path, "/sync/manifest")
+	root := path.Join(s.DocumentRoot, dir)
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		respondError(w, fmt.Errorf("\"%s\" is %w", dir, errNotFound))
+		return
+	}
+	files := []manifestEntry{}
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && isInternalName(info.Name()) {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		sum, err := s.Digests.of(p, info)
+		if err != nil {
+			return err
+		}
+		files = append(files, manifestEntry{Path: filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime(), Digest: s.Digests.label(sum)})
+		return nil
+	})
+	if err != nil {
+		logger.WithError(err).WithField("dir", dir).Error("failed to make the sync manifest")
+		respondError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, manifestResponse{response: response{OK: true}, Dir: "/files" + dir, Files: files})
+}
+
+// handleSyncApply serves POST /sync/apply/(dir), which stores the files staged in a transaction under dir
+// and deletes the given files under dir at once.
+func (s Server) handleSyncApply(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	// syncing changes and deletes stored files, so the token is always required.
+	if err := s.checkToken(r); err != nil {
+		respondError(w, err)
+		return
+	}
+	if err := s.checkWritable(); err != nil {
+		respondError(w, err)
+		return
+	}
+	dir := syncDirOf(r.URL.Path, "/sync/apply")
+	var req syncRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<20)).Decode(&req); err != nil {
+		respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("invalid request: %v", err)))
+		return
+	}
+
+	var tx *transaction
+	if req.Transaction != "" {
+		var outside string
+		s.Transactions.mu.Lock()
+		tx = s.Transactions.byID[req.Transaction]
+		if tx != nil {
+			for rel := range tx.Files {
+				if !matchPrefix(rel, dir) {
+					outside = rel
+				}
+			}
+			if outside == "" {
+				delete(s.Transactions.byID, tx.ID)
+			}
+		}
+		s.Transactions.mu.Unlock()
+		if tx == nil {
+			respondError(w, withStatus(http.StatusNotFound, errTransactionNotFound))
+			return
+		}
+		if outside != "" {
+			respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("\"/files%s\" is not under \"/files%s\"", outside, dir)))
+			return
+		}
+	} else {
+		// deletions are made in a transaction too, to be able to undo them.
+		var err error
+		if tx, err = s.newTransaction(); err != nil {
+			respondError(w, err)
+			return
+		}
+	}
+	defer os.RemoveAll(tx.dir)
+
+	deletes := make([]string, 0, len(req.Delete))
+	for _, name := range req.Delete {
+		rel := path.Join(dir, path.Clean("/"+toSlash(name)))
+		if rel == dir || isInternalName(strings.SplitN(rel[1:], "/", 2)[0]) {
+			respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("invalid file name %q", name)))
+			return
+		}
+		deletes = append(deletes, rel)
+	}
+	paths, deleted, err := s.publish(r.Context(), tx, deletes)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	s.announceTransaction(r, tx)
+	for _, p := range deleted {
+		s.emit(fileEvent{Type: eventDelete, Path: p, Actor: clientIP(r)})
+	}
+	cids := s.pinCommitted(r.Context(), paths)
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, syncResponse{response: response{OK: true}, Paths: paths, Deleted: deleted, CIDs: cids})
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// syslogFacility is "local0".
+	syslogFacility = 16
+	// syslogSDID is the structured data ID carrying the fields of a log entry.
+	// 32473 is the private enterprise number reserved for documentation (RFC 5612).
+	syslogSDID = "fields@32473"
+
+	syslogQueueSize = 1024
+)
+
+// syslogHook forwards access and audit log entries to a remote syslog server in RFC 5424 format.
+// UDP sends one message per datagram; TCP and TLS use octet-counting framing (RFC 6587, RFC 5425).
+type syslogHook struct {
+	network  string
+	address  string
+	appName  string
+	hostname string
+	messages chan string
+	conn     net.Conn
+}
+
+// newSyslogHook creates a hook sending to addr, which is given as "udp://host:port", "tcp://host:port" or "tls://host:port".
+func newSyslogHook(addr string, appName string) (*syslogHook, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "udp", "tcp", "tls":
+	default:
+		return nil, fmt.Errorf("unsupported syslog transport %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("syslog address %q has no host", addr)
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+	h := &syslogHook{
+		network:  u.Scheme,
+		address:  u.Host,
+		appName:  appName,
+		hostname: hostname,
+		messages: make(chan string, syslogQueueSize),
+	}
+	go h.run()
+	return h, nil
+}
+
+// Levels implements logrus.Hook.
+func (h *syslogHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook. Messages are dropped if the queue is full, so that a slow syslog server never blocks requests.
+func (h *syslogHook) Fire(entry *logrus.Entry) error {
+	kind, _ := entry.Data["log"].(string)
+	if kind != "access" && kind != "audit" {
+		return nil
+	}
+	select {
+	case h.messages <- h.format(entry, kind):
+	default:
+	}
+	return nil
+}
+
+func (h *syslogHook) format(entry *logrus.Entry, msgID string) string {
+	keys := make([]string, 0, len(entry.Data))
+	for k := range entry.Data {
+		if k != "log" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	sd := "-"
+	if len(keys) > 0 {
+		params := make([]string, 0, len(keys))
+		for _, k := range keys {
+			params = append(params, fmt.Sprintf("%s=\"%s\"", k, escapeSDParam(fmt.Sprint(entry.Data[k]))))
+		}
+		sd = "[" + syslogSDID + " " + strings.Join(params, " ") + "]"
+	}
+	return fmt.Sprintf("<%d>1 %s %s %s %d %s %s %s",
+		syslogFacility*8+syslogSeverity(entry.Level),
+		entry.Time.Format(time.RFC3339Nano),
+		h.hostname,
+		h.appName,
+		os.Getpid(),
+		msgID,
+		sd,
+		entry.Message)
+}
+
+func (h *syslogHook) run() {
+	for msg := range h.messages {
+		if err := h.send(msg); err != nil {
+			// retry once with a fresh connection; stream connections may have been closed by the peer.
+			if h.conn != nil {
+				h.conn.Close()
+				h.conn = nil
+			}
+			if err := h.send(msg); err != nil {
+				fmt.Fprintf(os.Stderr, "failed to send a log to syslog: %v\n", err)
+			}
+		}
+	}
+}
+
+func (h *syslogHook) send(msg string) error {
+	if h.conn == nil {
+		var err error
+		switch h.network {
+		case "tls":
+			h.conn, err = tls.Dial("tcp", h.address, &tls.Config{})
+		default:
+			h.conn, err = net.DialTimeout(h.network, h.address, 10*time.Second)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if h.network != "udp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+	_, err := h.conn.Write([]byte(msg))
+	return err
+}
+
+func syslogSeverity(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel:
+		return 0
+	case logrus.FatalLevel:
+		return 2
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	default:
+		return 7
+	}
+}
+
+// escapeSDParam escapes a value of a structured data parameter as described in RFC 5424 section 6.3.3.
+func escapeSDParam(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// kinds of scheduled tasks
+const (
+	// taskBackup takes a backup to -backup_target.
+	taskBackup = "backup"
+	// taskPrune removes the empty directories, as -prune_empty_dirs does every -prune_interval.
+	taskPrune = "prune"
+	// taskTiering moves idle files to cold storage, as -cold_dir does every -cold_interval.
+	taskTiering = "tiering"
+	// taskScrub hashes the stored files again and reports those whose content no longer matches their digest.
+	taskScrub = "scrub"
+	// taskUsage counts the files and the bytes under each top-level directory.
+	taskUsage = "usage"
+	// taskShell runs a shell command in the document root.
+	taskShell = "shell"
+)
+
+const (
+	// maxTaskHistory is the number of runs of each task reported by /admin/tasks.
+	maxTaskHistory = 20
+	// maxTaskOutput bounds the output of a shell command kept in the history.
+	maxTaskOutput = 4096
+)
+
+var (
+	errTaskNotFound = errors.New("task not found")
+	errTaskRunning  = errors.New("the task is already running")
+)
+
+// task is a job run on a schedule, given as "(cron expression) (kind) [command]", like "0 3 * * 0 scrub"
+// or "*/10 * * * * shell /usr/local/bin/sync.sh".
+type task struct {
+	Name     string `json:"name"`
+	Kind     string `json:"kind"`
+	Command  string `json:"command,omitempty"`
+	schedule cronSchedule
+
+	mu      sync.Mutex
+	running bool
+	next    time.Time
+	history []taskRun
+}
+
+// taskRun is a run of a task.
+type taskRun struct {
+	Started  time.Time `json:"started"`
+	Duration float64   `json:"duration"`
+	// Scheduled is false for the runs requested by POST /admin/tasks/(name).
+	Scheduled bool   `json:"scheduled"`
+	Result    string `json:"result,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// scheduler runs tasks on their schedules, each one at most once at a time.
+type scheduler struct {
+	tasks []*task
+	// Timeout bounds a run of a task.
+	Timeout time.Duration
+}
+
+// parseTask parses a task given as "(cron expression) (kind) [command]".
+func parseTask(def string) (*task, error) {
+	fields := strings.Fields(def)
+	if len(fields) < len(cronFields)+1 {
+		return nil, fmt.Errorf("task %q must be given as a cron expression followed by the kind of task", def)
+	}
+	schedule, err := parseCron(strings.Join(fields[:len(cronFields)], " "))
+	if err != nil {
+		return nil, err
+	}
+	t := &task{Kind: fields[len(cronFields)], schedule: schedule}
+	t.Command = strings.Join(fields[len(cronFields)+1:], " ")
+	switch t.Kind {
+	case taskBackup, taskPrune, taskTiering, taskScrub, taskUsage:
+		if t.Command != "" {
+			return nil, fmt.Errorf("task %q: %s takes no command", def, t.Kind)
+		}
+	case taskShell:
+		if t.Command == "" {
+			return nil, fmt.Errorf("task %q: shell needs a command", def)
+		}
+	default:
+		return nil, fmt.Errorf("task %q: unknown kind %q (backup, prune, tiering, scrub, usage or shell)", def, t.Kind)
+	}
+	return t, nil
+}
+
+// newScheduler parses the tasks. Tasks are named by their kinds, numbered from the second one of a kind, like "shell-2".
+func newScheduler(defs []string, timeout time.Duration) (*scheduler, error) {
+	s := &scheduler{Timeout: timeout}
+	count := map[string]int{}
+	for _, def := range defs {
+		t, err := parseTask(def)
+		if err != nil {
+			return nil, err
+		}
+		count[t.Kind]++
+		t.Name = t.Kind
+		if n := count[t.Kind]; n > 1 {
+			t.Name = fmt.Sprintf("%s-%d", t.Kind, n)
+		}
+		s.tasks = append(s.tasks, t)
+	}
+	return s, nil
+}
+
+// has reports whether a task of the kind is scheduled.
+func (s *scheduler) has(kind string) bool {
+	for _, t := range s.tasks {
+		if t.Kind == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *scheduler) task(name string) *task {
+	for _, t := range s.tasks {
+		if t.Name == name {
+			return t
+		}
+	}
+	return nil
+}
+
+// checkTasks returns an error if a task needs a feature which is not configured.
+func (s Server) checkTasks() error {
+	needs := map[string]struct {
+		missing bool
+		option  string
+	}{
+		taskBackup:  {s.Backups == nil, "-backup_target"},
+		taskPrune:   {s.Prune == nil, "-prune_empty_dirs"},
+		taskTiering: {s.Tiering == nil, "-cold_dir"},
+		taskScrub:   {s.Meta == nil, "-state_dir"},
+	}
+	for _, t := range s.Tasks.tasks {
+		if need, ok := needs[t.Kind]; ok && need.missing {
+			return fmt.Errorf("task %s needs %s", t.Name, need.option)
+		}
+	}
+	return nil
+}
+
+// runTasks runs each task on its schedule. It returns at once.
+func (s Server) runTasks() {
+	for _, t := range s.Tasks.tasks {
+		go s.runTaskOnSchedule(t)
+	}
+}
+
+// runTaskOnSchedule runs t at the times of its schedule. A run which is due while the previous one is still going on
+// is skipped. It never returns, unless the schedule never matches.
+func (s Server) runTaskOnSchedule(t *task) {
+	for {
+		t.mu.Lock()
+		t.next = t.schedule.next(time.Now())
+		next := t.next
+		t.mu.Unlock()
+		if next.IsZero() {
+			logger.WithFields(logrus.Fields{"task": t.Name, "schedule": t.schedule.String()}).Warn("the task schedule never matches")
+			return
+		}
+		time.Sleep(time.Until(next))
+		if err := s.runTask(t, true); errors.Is(err, errTaskRunning) {
+			logger.WithField("task", t.Name).Warn("task skipped, since the previous run is still going on")
+		}
+	}
+}
+
+// runTask runs t now and records the run. It returns errTaskRunning if t is already running.
+func (s Server) runTask(t *task, scheduled bool) error {
+	t.mu.Lock()
+	if t.running {
+		t.mu.Unlock()
+		return withStatus(http.StatusConflict, errTaskRunning)
+	}
+	t.running = true
+	t.mu.Unlock()
+
+	ctx := context.Background()
+	// scheduled backups and tiering wait for the maintenance window, and pause when it closes.
+	if scheduled && (t.Kind == taskBackup || t.Kind == taskTiering) {
+		ctx = confined(ctx)
+		s.Maintenance.wait(ctx, t.Name)
+	}
+	run := taskRun{Started: time.Now(), Scheduled: scheduled}
+	if s.Tasks.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Tasks.Timeout)
+		defer cancel()
+	}
+	result, err := s.executeTask(ctx, t)
+	run.Duration = time.Since(run.Started).Seconds()
+	run.Result = result
+	entry := logger.WithFields(logrus.Fields{"task": t.Name, "duration": run.Duration, "result": result})
+	if err != nil {
+		run.Error = err.Error()
+		entry.WithError(err).Warn("task failed")
+	} else {
+		entry.Info("task done")
+	}
+
+	t.mu.Lock()
+	t.running = false
+	t.history = append([]taskRun{run}, t.history...)
+	if len(t.history) > maxTaskHistory {
+		t.history = t.history[:maxTaskHistory]
+	}
+	t.mu.Unlock()
+	return err
+}
+
+// executeTask does the work of t, and returns a summary of it.
+func (s Server) executeTask(ctx context.Context, t *task) (string, error) {
+	switch t.Kind {
+	case taskBackup:
+		run, err := s.backup(ctx)
+		return fmt.Sprintf("%d files, %d uploaded, %d pruned", run.Files, run.Uploaded, len(run.Pruned)), err
+	case taskPrune:
+		removed, err := s.pruneEmptyDirs()
+		return fmt.Sprintf("%d empty directories removed", removed), err
+	case taskTiering:
+		s.sweepTiering(ctx)
+		return "", ctx.Err()
+	case taskScrub:
+		return s.scrub(ctx)
+	case taskUsage:
+		return s.usage(ctx)
+	default:
+		return s.runShellTask(ctx, t)
+	}
+}
+
+// runShellTask runs the command of t with the shell, in the document root, and returns its output.
+func (s Server) runShellTask(ctx context.Context, t *task) (string, error) {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", t.Command)
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", t.Command)
+	}
+	cmd.Dir = s.DocumentRoot
+	cmd.Env = append(os.Environ(), envPrefix+"DOCUMENT_ROOT="+s.DocumentRoot, envPrefix+"TASK="+t.Name)
+	out, err := cmd.CombinedOutput()
+	out = bytes.TrimSpace(out)
+	if len(out) > maxTaskOutput {
+		out = append(out[:maxTaskOutput:maxTaskOutput], "..."...)
+	}
+	return string(out), err
+}
+
+// scrub hashes the files whose digest was recorded when they were stored, bypassing the cache of digests, and
+// reports those whose content changed since, e.g. by bit rot or by a change outside of the server.
+func (s Server) scrub(ctx context.Context) (string, error) {
+	var checked, corrupted int
+	err := filepath.Walk(s.DocumentRoot, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() && isInternalName(info.Name()) {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.DocumentRoot, p)
+		if err != nil {
+			return err
+		}
+		rel = path.Clean("/" + filepath.ToSlash(rel))
+		meta, err := s.Meta.get(rel)
+		if err != nil || meta.Digest == "" || meta.Cold != nil {
+			return nil
+		}
+		algorithm, want, err := parseDigest(meta.Digest)
+		if err != nil {
+			return nil
+		}
+		sum, err := hashFile(p, digestAlgorithms[algorithm]())
+		if err != nil {
+			logger.WithError(err).WithField("path", rel).Warn("failed to scrub a file")
+			return nil
+		}
+		checked++
+		if sum != want {
+			corrupted++
+			auditLog().WithFields(logrus.Fields{
+				"path":     rel,
+				"expected": meta.Digest,
+				"actual":   algorithm + ":" + sum,
+			}).Error("stored file does not match its digest")
+		}
+		return nil
+	})
+	if err == nil && corrupted > 0 {
+		err = fmt.Errorf("%d files do not match their digests", corrupted)
+	}
+	return fmt.Sprintf("%d files checked, %d corrupted", checked, corrupted), err
+}
+
+// usage counts the files and the bytes under each top-level directory of the document root, and logs them.
+func (s Server) usage(ctx context.Context) (string, error) {
+	type total struct {
+		files int64
+		bytes int64
+	}
+	totals := map[string]*total{}
+	var all total
+	err := filepath.Walk(s.DocumentRoot, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if info.IsDir() && isInternalName(info.Name()) {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.DocumentRoot, p)
+		if err != nil {
+			return err
+		}
+		top := "/"
+		if parts := strings.SplitN(filepath.ToSlash(rel), "/", 2); len(parts) == 2 {
+			top = "/" + parts[0]
+		}
+		t, ok := totals[top]
+		if !ok {
+			t = &total{}
+			totals[top] = t
+		}
+		t.files++
+		t.bytes += info.Size()
+		all.files++
+		all.bytes += info.Size()
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	for dir, t := range totals {
+		logger.WithFields(logrus.Fields{"path": dir, "files": t.files, "bytes": t.bytes}).Info("storage usage")
+	}
+	return fmt.Sprintf("%d files, %d bytes", all.files, all.bytes), nil
+}
+
+type taskStatus struct {
+	*task
+	Schedule string    `json:"schedule"`
+	Running  bool      `json:"running"`
+	Next     time.Time `json:"next"`
+	Runs     []taskRun `json:"runs"`
+}
+
+type tasksResponse struct {
+	response
+	Tasks []taskStatus `json:"tasks"`
+}
+
+// handleTasks serves the admin endpoint /admin/tasks: GET reports the tasks with their last runs,
+// and POST /admin/tasks/(name) runs a task now, in the background.
+func (s Server) handleTasks(w http.ResponseWriter, r *http.Request) {
+	name := strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/tasks"), "/")
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		resp := tasksResponse{response: response{OK: true}, Tasks: []taskStatus{}}
+		for _, t := range s.Tasks.tasks {
+			t.mu.Lock()
+			resp.Tasks = append(resp.Tasks, taskStatus{
+				task:     t,
+				Schedule: t.schedule.String(),
+				Running:  t.running,
+				Next:     t.next,
+				Runs:     append([]taskRun{}, t.history...),
+			})
+			t.mu.Unlock()
+		}
+		w.WriteHeader(http.StatusOK)
+		writeJSON(w, resp)
+	case r.Method == http.MethodPost && name != "":
+		t := s.Tasks.task(name)
+		if t == nil {
+			respondError(w, withStatus(http.StatusNotFound, fmt.Errorf("%w: %s", errTaskNotFound, name)))
+			return
+		}
+		t.mu.Lock()
+		running := t.running
+		t.mu.Unlock()
+		if running {
+			respondError(w, withStatus(http.StatusConflict, errTaskRunning))
+			return
+		}
+		auditLog().WithFields(logrus.Fields{"task": t.Name, "remote": clientIP(r)}).Info("task run requested")
+		go s.runTask(t, false)
+		w.WriteHeader(http.StatusAccepted)
+		writeJSON(w, response{OK: true})
+	case name == "":
+		w.Header().Set("Allow", "GET")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+	default:
+		w.Header().Set("Allow", "POST")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+	}
+}
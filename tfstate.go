@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// tfLockSuffix is appended to the file of a state to name the file of its lock.
+	tfLockSuffix = ".tflock"
+	// maxTFLockSize bounds the lock information sent by clients.
+	maxTFLockSize = 64 << 10
+)
+
+var errTFStatePath = errors.New("managed by the Terraform state backend")
+
+// tfLock is the lock information Terraform sends to lock a state, of which only the ID is interpreted;
+// the rest is kept to be shown to whoever finds the state locked.
+type tfLock struct {
+	ID string `json:"ID"`
+}
+
+// tfStates serves the Terraform and OpenTofu HTTP state backend over the files under Prefix: the state (name)
+// is stored as (name), and its lock as (name).tflock.
+type tfStates struct {
+	// Prefix is the path of the state files relative to the document root, like "/terraform".
+	Prefix string
+
+	// mu serializes the changes of states and locks.
+	mu sync.Mutex
+}
+
+func newTFStates(prefix string) *tfStates {
+	return &tfStates{Prefix: cleanPrefix(prefix)}
+}
+
+// checkTFStatePath returns an error if rel, a path relative to the document root, is a file of the state backend,
+// which uploads must not replace.
+func (s Server) checkTFStatePath(rel string) error {
+	if s.TFStates != nil && matchPrefix(rel, s.TFStates.Prefix) {
+		return withStatus(http.StatusForbidden, fmt.Errorf("\"/files%s\" is %w", rel, errTFStatePath))
+	}
+	return nil
+}
+
+// readTFLock returns the lock of the state file, or nil if it is not locked.
+func readTFLock(file string) ([]byte, *tfLock, error) {
+	b, err := ioutil.ReadFile(file + tfLockSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	var lock tfLock
+	if err := json.Unmarshal(b, &lock); err != nil {
+		return nil, nil, fmt.Errorf("invalid lock %s: %v", file+tfLockSuffix, err)
+	}
+	return b, &lock, nil
+}
+
+// respondTFLocked answers a request conflicting with the lock of a state with the lock information,
+// which Terraform shows to explain who holds it.
+func respondTFLocked(w http.ResponseWriter, status int, lock []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(lock)
+}
+
+// tfStateETag returns the entity tag of the state content b.
+func tfStateETag(b []byte) string {
+	sum := md5.Sum(b)
+	return "\"" + hex.EncodeToString(sum[:]) + "\""
+}
+
+// handleTFState serves the HTTP state backend of Terraform and OpenTofu under /tfstate/(name):
+//
+//	GET /tfstate/(name)               fetches the state
+//	POST /tfstate/(name)?ID=(lock)    updates the state, with the ID of the lock if locked
+//	DELETE /tfstate/(name)?ID=(lock)  deletes the state
+//	LOCK /tfstate/(name)              locks the state with the lock information in the body
+//	UNLOCK /tfstate/(name)            unlocks it, forcibly if the body is empty
+//
+// POST and DELETE /tfstate/(name)/lock lock and unlock the state too, for clients which cannot send other methods.
+// States always require the token, since they hold the secrets of the infrastructure.
+func (s Server) handleTFState(w http.ResponseWriter, r *http.Request) {
+	if err := s.checkToken(withBasicToken(r)); err != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="simple-upload-server"`)
+		respondError(w, err)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/tfstate/")
+	method := r.Method
+	if strings.HasSuffix(name, "/lock") {
+		name = strings.TrimSuffix(name, "/lock")
+		switch method {
+		case http.MethodPost, "LOCK":
+			method = "LOCK"
+		case http.MethodDelete, "UNLOCK":
+			method = "UNLOCK"
+		default:
+			w.Header().Set("Allow", "POST,DELETE,LOCK,UNLOCK")
+			respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+			return
+		}
+	}
+	rel, err := s.tfStatePath(name)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	if method != http.MethodGet && method != http.MethodHead {
+		if err := s.checkWritable(); err != nil {
+			respondError(w, err)
+			return
+		}
+	}
+	file := filepath.Join(s.DocumentRoot, filepath.FromSlash(rel))
+	entry := logger.WithFields(logrus.Fields{"path": r.URL.Path, "method": r.Method})
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		b, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			respondError(w, fmt.Errorf("state %q is %w", name, errNotFound))
+			return
+		} else if err != nil {
+			logFailure(entry, err, "failed to read the state")
+			respondError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("ETag", tfStateETag(b))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		if method == http.MethodGet {
+			w.Write(b)
+		}
+		return
+	case http.MethodPost, http.MethodPut, http.MethodDelete:
+		err = s.changeTFState(w, r, name, file)
+	case "LOCK":
+		err = s.lockTFState(w, r, name, file)
+	case "UNLOCK":
+		err = s.unlockTFState(w, r, name, file)
+	default:
+		w.Header().Set("Allow", "GET,HEAD,POST,PUT,DELETE,LOCK,UNLOCK")
+		err = withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method))
+	}
+	if err != nil {
+		logFailure(entry, err, "state request failed")
+		respondError(w, err)
+	}
+}
+
+// tfStatePath returns the path of the file of the state name, relative to the document root.
+func (s Server) tfStatePath(name string) (string, error) {
+	for _, elem := range strings.Split(name, "/") {
+		if err := checkName(elem); err != nil {
+			return "", withStatus(http.StatusBadRequest, fmt.Errorf("invalid state name %q: %w", name, err))
+		}
+	}
+	if strings.HasSuffix(name, tfLockSuffix) || path.Base(name) == "lock" {
+		return "", withStatus(http.StatusBadRequest, fmt.Errorf("invalid state name %q", name))
+	}
+	return path.Join(s.TFStates.Prefix, name), nil
+}
+
+// changeTFState serves POST, PUT and DELETE /tfstate/(name), which must send the ID of the lock if the state is
+// locked. An If-Match header makes the change conditional on the current state, and a Content-MD5 header,
+// as Terraform sends, is checked against the new state.
+func (s Server) changeTFState(w http.ResponseWriter, r *http.Request, name string, file string) error {
+	var b []byte
+	if r.Method != http.MethodDelete {
+		var err error
+		if b, err = ioutil.ReadAll(io.LimitReader(r.Body, s.MaxUploadSize+1)); err != nil {
+			return err
+		}
+		if int64(len(b)) > s.MaxUploadSize {
+			return withStatus(http.StatusRequestEntityTooLarge, errFileTooLarge)
+		}
+		if !json.Valid(b) {
+			return withStatus(http.StatusBadRequest, fmt.Errorf("state %q is not JSON", name))
+		}
+		if sum := r.Header.Get("Content-MD5"); sum != "" {
+			want := md5.Sum(b)
+			if sum != base64.StdEncoding.EncodeToString(want[:]) {
+				return withStatus(http.StatusBadRequest, errors.New("state does not match its Content-MD5"))
+			}
+		}
+	}
+
+	states := s.TFStates
+	states.mu.Lock()
+	defer states.mu.Unlock()
+	raw, lock, err := readTFLock(file)
+	if err != nil {
+		return err
+	}
+	if lock != nil && r.URL.Query().Get("ID") != lock.ID {
+		respondTFLocked(w, http.StatusLocked, raw)
+		return nil
+	}
+	if match := r.Header.Get("If-Match"); match != "" {
+		current, err := ioutil.ReadFile(file)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err != nil || (match != "*" && match != tfStateETag(current)) {
+			return withStatus(http.StatusPreconditionFailed, fmt.Errorf("state %q has changed", name))
+		}
+	}
+
+	entry := auditLog().WithFields(logrus.Fields{"state": name, "remote": clientIP(r)})
+	if r.Method == http.MethodDelete {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		entry.Info("Terraform state deleted")
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+		return err
+	}
+	if err := writeFileAtomically(file, b); err != nil {
+		return err
+	}
+	entry.WithField("size", len(b)).Info("Terraform state updated")
+	w.Header().Set("ETag", tfStateETag(b))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// lockTFState serves LOCK /tfstate/(name). Locking a state locked by another lock answers 423 Locked with it.
+func (s Server) lockTFState(w http.ResponseWriter, r *http.Request, name string, file string) error {
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxTFLockSize+1))
+	if err != nil {
+		return err
+	}
+	var lock tfLock
+	if len(b) > maxTFLockSize || json.Unmarshal(b, &lock) != nil || lock.ID == "" {
+		return withStatus(http.StatusBadRequest, errors.New("invalid lock information"))
+	}
+
+	states := s.TFStates
+	states.mu.Lock()
+	defer states.mu.Unlock()
+	raw, held, err := readTFLock(file)
+	if err != nil {
+		return err
+	}
+	if held != nil && held.ID != lock.ID {
+		respondTFLocked(w, http.StatusLocked, raw)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+		return err
+	}
+	if err := writeFileAtomically(file+tfLockSuffix, b); err != nil {
+		return err
+	}
+	auditLog().WithFields(logrus.Fields{"state": name, "lock": lock.ID, "remote": clientIP(r)}).Info("Terraform state locked")
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// unlockTFState serves UNLOCK /tfstate/(name), with the lock information of the lock to release. terraform force-unlock
+// sends none, which releases any lock.
+func (s Server) unlockTFState(w http.ResponseWriter, r *http.Request, name string, file string) error {
+	b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxTFLockSize+1))
+	if err != nil {
+		return err
+	}
+	var lock tfLock
+	if len(strings.TrimSpace(string(b))) > 0 {
+		if len(b) > maxTFLockSize || json.Unmarshal(b, &lock) != nil {
+			return withStatus(http.StatusBadRequest, errors.New("invalid lock information"))
+		}
+	}
+
+	states := s.TFStates
+	states.mu.Lock()
+	defer states.mu.Unlock()
+	raw, held, err := readTFLock(file)
+	if err != nil {
+		return err
+	}
+	if held == nil {
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+	if lock.ID != "" && lock.ID != held.ID {
+		respondTFLocked(w, http.StatusConflict, raw)
+		return nil
+	}
+	if err := os.Remove(file + tfLockSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	entry := auditLog().WithFields(logrus.Fields{"state": name, "lock": held.ID, "remote": clientIP(r), "forced": lock.ID == ""})
+	entry.Info("Terraform state unlocked")
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var errArchived = errors.New("in cold storage; restore it by POST /restore/(filename)")
+
+// coldStub is recorded for a file whose content was moved to cold storage.
+// The file itself is left behind empty, with its original modification time.
+type coldStub struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Since   time.Time `json:"since"`
+}
+
+// coldBackend keeps the content of files moved out of the document root, by their path relative to it.
+type coldBackend interface {
+	// put stores the size bytes of src as key.
+	put(ctx context.Context, key string, src io.Reader, size int64) error
+	get(ctx context.Context, key string) (io.ReadCloser, error)
+	remove(ctx context.Context, key string) error
+}
+
+// dirBackend is a coldBackend on a directory, typically on cheaper storage.
+type dirBackend struct {
+	dir string
+}
+
+func (b dirBackend) file(key string) string {
+	return filepath.Join(b.dir, filepath.FromSlash(path.Clean("/"+key)))
+}
+
+func (b dirBackend) put(ctx context.Context, key string, src io.Reader, size int64) error {
+	file := b.file(key)
+	if err := os.MkdirAll(filepath.Dir(file), 0777); err != nil {
+		return err
+	}
+	tempFile, err := ioutil.TempFile(filepath.Dir(file), ".cold_")
+	if err != nil {
+		return err
+	}
+	_, err = copyBuffer(tempFile, contextReader{ctx: ctx, r: src})
+	if err == nil {
+		// the content is removed from the document root right after, so it must be on the disk.
+		err = tempFile.Sync()
+	}
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = renameFile(tempFile.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+	}
+	return err
+}
+
+func (b dirBackend) get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(b.file(key))
+}
+
+func (b dirBackend) remove(ctx context.Context, key string) error {
+	err := os.Remove(b.file(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// s3Backend is a coldBackend on an S3 bucket, under a prefix, typically with a storage class cheaper than the default.
+type s3Backend struct {
+	client *s3Client
+	prefix string
+}
+
+func (b s3Backend) key(key string) string {
+	return b.prefix + strings.TrimPrefix(path.Clean("/"+key), "/")
+}
+
+func (b s3Backend) put(ctx context.Context, key string, src io.Reader, size int64) error {
+	return b.client.put(ctx, b.key(key), contextReader{ctx: ctx, r: src}, size, "")
+}
+
+func (b s3Backend) get(ctx context.Context, key string) (io.ReadCloser, error) {
+	return b.client.get(ctx, b.key(key))
+}
+
+func (b s3Backend) remove(ctx context.Context, key string) error {
+	return b.client.remove(ctx, b.key(key))
+}
+
+// parseColdBackend parses the value of -cold_dir: a directory, or s3://bucket/prefix with optional region, endpoint
+// and storage_class query parameters.
+func parseColdBackend(dir string) (coldBackend, error) {
+	if !strings.HasPrefix(dir, "s3://") {
+		return dirBackend{dir: dir}, nil
+	}
+	u, err := url.Parse(dir)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cold storage: %v", err)
+	}
+	bucket, prefix := parseS3URL(u)
+	if bucket == "" {
+		return nil, fmt.Errorf("cold storage %q has no bucket", dir)
+	}
+	q := u.Query()
+	class := strings.ToUpper(q.Get("storage_class"))
+	// objects of these classes must be restored by a request taking hours before they can be read.
+	if class == "GLACIER" || class == "DEEP_ARCHIVE" {
+		return nil, fmt.Errorf("cold storage %q: objects of storage class %s cannot be read back directly; use GLACIER_IR instead", dir, class)
+	}
+	client, err := newS3Client(bucket, q.Get("region"), q.Get("endpoint"))
+	if err != nil {
+		return nil, err
+	}
+	client.storageClass = class
+	return s3Backend{client: client, prefix: prefix}, nil
+}
+
+// tiering moves files which have not been accessed for a while to a cold backend.
+type tiering struct {
+	backend coldBackend
+	// After is how long a file must not be accessed to be moved.
+	After time.Duration
+	// Transparent restores files on GET; otherwise they must be restored explicitly.
+	Transparent bool
+
+	mu       sync.Mutex
+	accessed map[string]time.Time
+}
+
+func newTiering(backend coldBackend, after time.Duration, transparent bool) *tiering {
+	return &tiering{backend: backend, After: after, Transparent: transparent, accessed: map[string]time.Time{}}
+}
+
+// touch records an access to rel. Accesses are tracked in memory only, so after a restart files are
+// considered accessed when they were last modified.
+func (t *tiering) touch(rel string) {
+	t.mu.Lock()
+	t.accessed[rel] = time.Now()
+	t.mu.Unlock()
+}
+
+// forget drops the access recorded to rel, once it is archived or deleted.
+func (t *tiering) forget(rel string) {
+	t.mu.Lock()
+	delete(t.accessed, rel)
+	t.mu.Unlock()
+}
+
+// prune drops the accesses older than After, which files count as idle with or without, and so those to files
+// which have been deleted or moved since.
+func (t *tiering) prune(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for rel, at := range t.accessed {
+		if now.Sub(at) >= t.After {
+			delete(t.accessed, rel)
+		}
+	}
+}
+
+func (t *tiering) lastAccess(rel string, info os.FileInfo) time.Time {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if at, ok := t.accessed[rel]; ok && at.After(info.ModTime()) {
+		return at
+	}
+	return info.ModTime()
+}
+
+// runTiering moves idle files to cold storage every interval. It never returns.
+func (s Server) runTiering(interval time.Duration) {
+	for range time.Tick(interval) {
+		ctx := confined(context.Background())
+		if err := s.Maintenance.wait(ctx, "tiering"); err == nil {
+			s.sweepTiering(ctx)
+		}
+	}
+}
+
+// sweepTiering moves the files which have not been accessed for long enough to cold storage.
+func (s Server) sweepTiering(ctx context.Context) {
+	s.Tiering.prune(time.Now())
+	err := filepath.Walk(s.DocumentRoot, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && isInternalName(info.Name()) {
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(s.DocumentRoot, p)
+		if err != nil {
+			return err
+		}
+		rel = path.Clean("/" + filepath.ToSlash(rel))
+		meta, err := s.Meta.get(rel)
+		if err != nil {
+			logger.WithError(err).WithField("path", rel).Warn("failed to read metadata")
+			return nil
+		}
+		if meta.Cold != nil {
+			if isStub(info, meta.Cold) {
+				return nil
+			}
+			// the file was replaced since it was moved, so the cold copy is obsolete.
+			s.dropColdCopy(rel)
+		}
+		if time.Since(s.Tiering.lastAccess(rel, info)) < s.Tiering.After {
+			return nil
+		}
+		if err := s.Maintenance.pause(ctx, "tiering"); err != nil {
+			return err
+		}
+		if err := s.archive(ctx, rel, info); err != nil {
+			logger.WithError(err).WithField("path", rel).Error("failed to move the file to cold storage")
+		}
+		return nil
+	})
+	if err != nil {
+		logger.WithError(err).Warn("failed to look for files to move to cold storage")
+	}
+}
+
+func isStub(info os.FileInfo, stub *coldStub) bool {
+	return info.Size() == 0 && info.ModTime().Equal(stub.ModTime)
+}
+
+// archive moves the content of rel to the cold backend, leaving a stub behind.
+func (s Server) archive(ctx context.Context, rel string, info os.FileInfo) error {
+	target := path.Join(s.DocumentRoot, rel)
+	f, err := os.Open(target)
+	if err != nil {
+		return err
+	}
+	err = s.Tiering.backend.put(ctx, rel, s.Maintenance.reader(ctx, f), info.Size())
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	s.publishLock.Lock()
+	defer s.publishLock.Unlock()
+	current, err := os.Stat(target)
+	if err != nil || current.Size() != info.Size() || !current.ModTime().Equal(info.ModTime()) {
+		// changed while it was copied; try again next time.
+		s.Tiering.backend.remove(context.Background(), rel)
+		return err
+	}
+	s.Tiering.forget(rel)
+	stub := &coldStub{Size: info.Size(), ModTime: info.ModTime(), Since: time.Now()}
+	if err := s.Meta.update(rel, func(meta *fileMeta) { meta.Cold = stub }); err != nil {
+		s.Tiering.backend.remove(context.Background(), rel)
+		return err
+	}
+	// replace the file rather than truncating it, since snapshots may share its content by hard links.
+	stubFile, err := ioutil.TempFile(path.Dir(target), "upload_")
+	if err != nil {
+		return err
+	}
+	stubFile.Close()
+	err = os.Chtimes(stubFile.Name(), info.ModTime(), info.ModTime())
+	if err == nil {
+		err = renameFile(stubFile.Name(), target)
+	}
+	if err != nil {
+		os.Remove(stubFile.Name())
+		return err
+	}
+	logger.WithFields(logrus.Fields{
+		"path": rel,
+		"size": info.Size(),
+	}).Info("file moved to cold storage")
+	s.emit(fileEvent{Type: eventArchive, Path: "/files" + rel, Size: info.Size()})
+	return nil
+}
+
+// coldStubOf returns the stub of rel if its content is in cold storage.
+func (s Server) coldStubOf(rel string) (*coldStub, error) {
+	if s.Tiering == nil || s.Meta == nil {
+		return nil, nil
+	}
+	info, err := os.Stat(path.Join(s.DocumentRoot, rel))
+	if err != nil || info.IsDir() || info.Size() != 0 {
+		return nil, nil
+	}
+	meta, err := s.Meta.get(rel)
+	if err != nil || meta.Cold == nil || !isStub(info, meta.Cold) {
+		return nil, err
+	}
+	return meta.Cold, nil
+}
+
+// restore brings the content of rel back from the cold backend. It is abandoned if ctx is done.
+func (s Server) restore(ctx context.Context, rel string, stub *coldStub) error {
+	target := path.Join(s.DocumentRoot, rel)
+	src, err := s.Tiering.backend.get(ctx, rel)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tempFile, err := ioutil.TempFile(path.Dir(target), "restore_")
+	if err != nil {
+		return err
+	}
+	_, err = copyBuffer(tempFile, contextReader{ctx: ctx, r: src})
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(tempFile.Name(), stub.ModTime, stub.ModTime)
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+
+	s.publishLock.Lock()
+	defer s.publishLock.Unlock()
+	info, err := os.Stat(target)
+	if err != nil || !isStub(info, stub) {
+		// replaced or restored meanwhile.
+		os.Remove(tempFile.Name())
+		return nil
+	}
+	if err := renameFile(tempFile.Name(), target); err != nil {
+		os.Remove(tempFile.Name())
+		return err
+	}
+	s.dropColdCopy(rel)
+	logger.WithFields(logrus.Fields{
+		"path": rel,
+		"size": stub.Size,
+	}).Info("file restored from cold storage")
+	s.emit(fileEvent{Type: eventRestore, Path: "/files" + rel, Size: stub.Size})
+	return nil
+}
+
+// dropColdCopy forgets the cold copy of rel.
+func (s Server) dropColdCopy(rel string) {
+	if err := s.Meta.update(rel, func(meta *fileMeta) { meta.Cold = nil }); err != nil {
+		logger.WithError(err).WithField("path", rel).Warn("failed to update metadata")
+	}
+	if err := s.Tiering.backend.remove(context.Background(), rel); err != nil {
+		logger.WithError(err).WithField("path", rel).Warn("failed to remove the cold copy")
+	}
+}
+
+// serveCold handles a GET on a file in cold storage. It reports whether the response has been written;
+// otherwise the file has been restored and can be served.
+func (s Server) serveCold(w http.ResponseWriter, r *http.Request, rel string) bool {
+	// only accesses to files are recorded, so that requests for any path do not fill the memory.
+	if info, err := os.Stat(path.Join(s.DocumentRoot, rel)); err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	s.Tiering.touch(rel)
+	stub, err := s.coldStubOf(rel)
+	if err != nil {
+		logger.WithError(err).WithField("path", rel).Error("failed to read metadata")
+		respondError(w, err)
+		return true
+	}
+	if stub == nil {
+		return false
+	}
+	if !s.Tiering.Transparent {
+		respondError(w, withStatus(http.StatusConflict, fmt.Errorf("\"/files%s\" is %w", rel, errArchived)))
+		return true
+	}
+	if err := s.restore(r.Context(), rel, stub); err != nil {
+		logFailure(logger.WithField("path", rel), err, "failed to restore the file from cold storage")
+		respondError(w, err)
+		return true
+	}
+	return false
+}
+
+// handleRestore serves POST /restore/(filename) to bring a file back from cold storage.
+func (s Server) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	if err := s.checkToken(r); err != nil {
+		respondError(w, err)
+		return
+	}
+	rel := path.Clean("/" + strings.TrimPrefix(r.URL.Path, "/restore/"))
+	if info, err := os.Stat(path.Join(s.DocumentRoot, rel)); err != nil || info.IsDir() {
+		respondError(w, fmt.Errorf("\"/files%s\" is %w", rel, errNotFound))
+		return
+	}
+	s.Tiering.touch(rel)
+	stub, err := s.coldStubOf(rel)
+	if err == nil && stub != nil {
+		err = s.restore(r.Context(), rel, stub)
+	}
+	if err != nil {
+		logger.WithError(err).WithField("path", rel).Error("failed to restore the file from cold storage")
+		respondError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	writeSuccess(w, "/files"+rel)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-memory bucket, recording the storage class objects were put with.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	classes map[string]string
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") ||
+		(r.Header.Get("X-Amz-Storage-Class") != "" && !strings.Contains(r.Header.Get("Authorization"), "x-amz-storage-class")) {
+		http.Error(w, "unsigned", http.StatusForbidden)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil || int64(len(b)) != r.ContentLength {
+			http.Error(w, "incomplete", http.StatusBadRequest)
+			return
+		}
+		f.objects[r.URL.Path] = b
+		f.classes[r.URL.Path] = r.Header.Get("X-Amz-Storage-Class")
+	case http.MethodGet:
+		b, ok := f.objects[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("<Error><Code>NoSuchKey</Code><Message>The specified key does not exist.</Message></Error>"))
+			return
+		}
+		w.Write(b)
+	case http.MethodDelete:
+		delete(f.objects, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// withAWSCredentials sets the credentials read by newS3Client for the duration of the test.
+func withAWSCredentials(t *testing.T) {
+	for _, name := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"} {
+		name := name
+		saved, ok := os.LookupEnv(name)
+		os.Setenv(name, "test")
+		t.Cleanup(func() {
+			if ok {
+				os.Setenv(name, saved)
+			} else {
+				os.Unsetenv(name)
+			}
+		})
+	}
+}
+
+func TestS3ColdBackend(t *testing.T) {
+	withAWSCredentials(t)
+	bucket := &fakeS3{objects: map[string][]byte{}, classes: map[string]string{}}
+	ts := httptest.NewServer(bucket)
+	defer ts.Close()
+	backend, err := parseColdBackend("s3://cold/uploads/?storage_class=standard_ia&endpoint=" + ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root, err := ioutil.TempDir("", "tiering")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	s := NewServer(filepath.Join(root, "files"), 1024, "", false, nil)
+	if s.Meta, err = newMetaStore(filepath.Join(root, "meta")); err != nil {
+		t.Fatal(err)
+	}
+	s.Tiering = newTiering(backend, 0, true)
+	name := filepath.Join(s.DocumentRoot, "2024", "report.pdf")
+	if err := os.MkdirAll(filepath.Dir(name), 0777); err != nil {
+		t.Fatal(err)
+	}
+	content := bytes.Repeat([]byte("report"), 1000)
+	if err := ioutil.WriteFile(name, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.archive(context.Background(), "/2024/report.pdf", info); err != nil {
+		t.Fatal(err)
+	}
+	const key = "/cold/uploads/2024/report.pdf"
+	if !bytes.Equal(bucket.objects[key], content) {
+		t.Fatalf("objects %v, want %s", bucket.objects, key)
+	}
+	if got := bucket.classes[key]; got != "STANDARD_IA" {
+		t.Errorf("stored with storage class %q, want STANDARD_IA", got)
+	}
+	stub, err := s.coldStubOf("/2024/report.pdf")
+	if err != nil || stub == nil {
+		t.Fatalf("no stub after archiving: %v", err)
+	}
+
+	if err := s.restore(context.Background(), "/2024/report.pdf", stub); err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadFile(name); err != nil || !bytes.Equal(b, content) {
+		t.Errorf("restored %d bytes, want %d: %v", len(b), len(content), err)
+	}
+	if _, ok := bucket.objects[key]; ok {
+		t.Errorf("cold copy left after restoring")
+	}
+	if _, err := backend.get(context.Background(), "/2024/report.pdf"); err == nil || !strings.Contains(err.Error(), "NoSuchKey") {
+		t.Errorf("get of a removed copy: %v", err)
+	}
+}
+
+func TestParseColdBackend(t *testing.T) {
+	withAWSCredentials(t)
+	for _, tc := range []struct {
+		dir string
+		ok  bool
+	}{
+		{"/mnt/cold", true},
+		{"s3://cold", true},
+		{"s3://cold/prefix?region=eu-west-1&storage_class=GLACIER_IR", true},
+		{"s3:///prefix", false},
+		// objects of these classes cannot be read without restoring them first.
+		{"s3://cold?storage_class=GLACIER", false},
+		{"s3://cold?storage_class=deep_archive", false},
+		{"s3://cold?endpoint=localhost", false},
+	} {
+		if _, err := parseColdBackend(tc.dir); (err == nil) != tc.ok {
+			t.Errorf("%q: %v", tc.dir, err)
+		}
+	}
+}
+
+func TestTieringTracksAccessesToFilesOnly(t *testing.T) {
+	root, err := ioutil.TempDir("", "tiering")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	s := NewServer(filepath.Join(root, "files"), 1024, "", false, nil)
+	if s.Meta, err = newMetaStore(filepath.Join(root, "meta")); err != nil {
+		t.Fatal(err)
+	}
+	s.Tiering = newTiering(dirBackend{dir: filepath.Join(root, "cold")}, time.Hour, true)
+	if err := os.MkdirAll(filepath.Join(s.DocumentRoot, "dir"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(s.DocumentRoot, "a.txt"), []byte("a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	accessed := func() int {
+		s.Tiering.mu.Lock()
+		defer s.Tiering.mu.Unlock()
+		return len(s.Tiering.accessed)
+	}
+
+	for i := 0; i < 100; i++ {
+		s.handleGet(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, fmt.Sprintf("/files/missing/%d.txt", i), nil))
+	}
+	s.handleGet(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/files/dir", nil))
+	if n := accessed(); n != 0 {
+		t.Fatalf("%d accesses recorded to paths which are not files", n)
+	}
+	s.handleGet(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/files/a.txt", nil))
+	if n := accessed(); n != 1 {
+		t.Fatalf("%d accesses recorded, want 1", n)
+	}
+
+	// accesses recorded within After are kept.
+	s.Tiering.prune(time.Now().Add(time.Hour / 2))
+	if n := accessed(); n != 1 {
+		t.Errorf("%d accesses left after pruning, want 1", n)
+	}
+	s.Tiering.prune(time.Now().Add(time.Hour))
+	if n := accessed(); n != 0 {
+		t.Errorf("%d accesses left after pruning, want 0", n)
+	}
+
+	s.Tiering.touch("/a.txt")
+	info, err := os.Stat(filepath.Join(s.DocumentRoot, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.archive(context.Background(), "/a.txt", info); err != nil {
+		t.Fatal(err)
+	}
+	if n := accessed(); n != 0 {
+		t.Errorf("access to an archived file kept")
+	}
+}
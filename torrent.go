@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// pieces are at least minPieceLength long, and made longer up to maxPieceLength to keep about targetPieces pieces.
+	minPieceLength = 256 << 10
+	maxPieceLength = 16 << 20
+	targetPieces   = 2000
+)
+
+var (
+	rePathTorrent = regexp.MustCompile(`^/torrents/files(/.*)?(/[^/]+)$`)
+
+	errTorrentNotFound = errors.New("torrent not found")
+	errTorrentStale    = errors.New("file has changed since its torrent was made")
+)
+
+// torrent is a stored file seeded by BitTorrent.
+type torrent struct {
+	// uploaded is the number of bytes sent to peers, updated atomically.
+	uploaded int64
+
+	Path        string `json:"path"`
+	InfoHash    string `json:"info_hash"`
+	Size        int64  `json:"size"`
+	PieceLength int64  `json:"piece_length"`
+	// Pieces are the SHA-1 hashes of the pieces, one after another.
+	Pieces  []byte    `json:"-"`
+	ModTime time.Time `json:"mtime"`
+	Created time.Time `json:"created"`
+
+	rel  string
+	hash [20]byte
+	// nextAnnounce is when the torrent is announced to the tracker next; zero until the first announce succeeds.
+	nextAnnounce time.Time
+	announced    bool
+}
+
+// savedTorrent is a torrent as saved in the state directory, with its pieces.
+type savedTorrent struct {
+	*torrent
+	Pieces []byte `json:"pieces"`
+}
+
+// torrentStore keeps the seeded torrents, in a file of the state directory if there is one.
+type torrentStore struct {
+	// Announce is the URL of the tracker.
+	Announce string
+	// Port is the port peers connect to.
+	Port   int
+	peerID [20]byte
+	file   string
+	client *http.Client
+
+	mu     sync.Mutex
+	byPath map[string]*torrent
+	byHash map[[20]byte]*torrent
+}
+
+// torrentStatus is a torrent as listed by the API.
+type torrentStatus struct {
+	*torrent
+	Magnet   string `json:"magnet"`
+	Torrent  string `json:"torrent"`
+	Uploaded int64  `json:"uploaded"`
+}
+
+type torrentResponse struct {
+	response
+	torrentStatus
+}
+
+type torrentsResponse struct {
+	response
+	Torrents []torrentStatus `json:"torrents"`
+}
+
+func newTorrentStore(announce string, port int) *torrentStore {
+	ts := &torrentStore{
+		Announce: announce,
+		Port:     port,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		byPath:   map[string]*torrent{},
+		byHash:   map[[20]byte]*torrent{},
+	}
+	// Azureus-style peer ID, as most clients use.
+	copy(ts.peerID[:], "-SU0001-")
+	rand.Read(ts.peerID[8:])
+	return ts
+}
+
+// load reads the torrents saved in file, which is also where they are saved from now on.
+func (ts *torrentStore) load(file string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.file = file
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var list []savedTorrent
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("%s: %v", file, err)
+	}
+	for _, saved := range list {
+		t := saved.torrent
+		if t == nil {
+			return fmt.Errorf("%s: invalid torrent", file)
+		}
+		t.Pieces = saved.Pieces
+		h, err := hex.DecodeString(t.InfoHash)
+		if err != nil || len(h) != len(t.hash) {
+			return fmt.Errorf("%s: invalid info hash %q", file, t.InfoHash)
+		}
+		copy(t.hash[:], h)
+		t.rel = strings.TrimPrefix(t.Path, "/files")
+		ts.byPath[t.rel] = t
+		ts.byHash[t.hash] = t
+	}
+	return nil
+}
+
+// save writes the torrents to the file, if any; it must be called with mu held.
+func (ts *torrentStore) save() error {
+	if ts.file == "" {
+		return nil
+	}
+	list := make([]savedTorrent, 0, len(ts.byPath))
+	for _, t := range ts.byPath {
+		list = append(list, savedTorrent{torrent: t, Pieces: t.Pieces})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	b, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write to a temporary file and rename it, so that a crash never leaves a broken file.
+	tempFile, err := ioutil.TempFile(filepath.Dir(ts.file), ".torrents_")
+	if err != nil {
+		return err
+	}
+	_, err = tempFile.Write(b)
+	if closeErr := tempFile.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = renameFile(tempFile.Name(), ts.file)
+	}
+	if err != nil {
+		os.Remove(tempFile.Name())
+	}
+	return err
+}
+
+func (ts *torrentStore) add(t *torrent) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	previous, replaced := ts.byPath[t.rel]
+	if replaced {
+		delete(ts.byHash, previous.hash)
+	}
+	ts.byPath[t.rel] = t
+	ts.byHash[t.hash] = t
+	if err := ts.save(); err != nil {
+		delete(ts.byPath, t.rel)
+		delete(ts.byHash, t.hash)
+		if replaced {
+			ts.byPath[t.rel] = previous
+			ts.byHash[previous.hash] = previous
+		}
+		return err
+	}
+	return nil
+}
+
+// remove stops seeding rel, and returns the torrent which was seeded, if any.
+func (ts *torrentStore) remove(rel string) (*torrent, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t, ok := ts.byPath[rel]
+	if !ok {
+		return nil, nil
+	}
+	delete(ts.byPath, rel)
+	delete(ts.byHash, t.hash)
+	if err := ts.save(); err != nil {
+		ts.byPath[rel] = t
+		ts.byHash[t.hash] = t
+		return nil, err
+	}
+	return t, nil
+}
+
+func (ts *torrentStore) get(rel string) (*torrent, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t, ok := ts.byPath[rel]
+	return t, ok
+}
+
+func (ts *torrentStore) byInfoHash(hash [20]byte) (*torrent, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	t, ok := ts.byHash[hash]
+	return t, ok
+}
+
+// pieceLength chooses the length of the pieces of a file of the given size.
+func pieceLength(size int64) int64 {
+	n := int64(minPieceLength)
+	for n < maxPieceLength && size/n > targetPieces {
+		n *= 2
+	}
+	return n
+}
+
+// makeTorrent hashes the pieces of the file at rel. It takes a while for large files; it stops if ctx is done.
+func (s Server) makeTorrent(ctx context.Context, rel string) (*torrent, error) {
+	f, err := os.Open(filepath.Join(s.DocumentRoot, filepath.FromSlash(rel)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("\"%s\" is %w", "/files"+rel, errNotFound)
+		}
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, withStatus(http.StatusBadRequest, fmt.Errorf("\"%s\" is not a file", "/files"+rel))
+	}
+	t := &torrent{
+		Path:        "/files" + rel,
+		Size:        info.Size(),
+		PieceLength: pieceLength(info.Size()),
+		ModTime:     info.ModTime(),
+		Created:     time.Now(),
+		rel:         rel,
+	}
+	src := contextReader{ctx: ctx, r: f}
+	for {
+		h := sha1.New()
+		n, err := io.CopyN(h, src, t.PieceLength)
+		if n > 0 {
+			t.Pieces = h.Sum(t.Pieces)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	t.hash = sha1.Sum(bencode(t.info()))
+	t.InfoHash = hex.EncodeToString(t.hash[:])
+	return t, nil
+}
+
+// info returns the info dictionary of t, whose hash identifies the torrent.
+func (t *torrent) info() map[string]interface{} {
+	return map[string]interface{}{
+		"length":       t.Size,
+		"name":         path.Base(t.rel),
+		"piece length": t.PieceLength,
+		"pieces":       t.Pieces,
+	}
+}
+
+// metainfo returns the .torrent file of t. Unless downloads require the token, the file is also given as a web seed
+// (BEP 19) at baseURL, so that clients can fetch pieces over HTTP too.
+func (s Server) metainfo(t *torrent, baseURL string) []byte {
+	m := map[string]interface{}{
+		"announce":      s.Torrents.Announce,
+		"created by":    "simple-upload-server",
+		"creation date": t.Created.Unix(),
+		"info":          t.info(),
+	}
+	if !s.isAuthenticationRequired(&http.Request{Method: http.MethodGet}) {
+		m["url-list"] = baseURL + (&url.URL{Path: t.Path}).String()
+	}
+	return bencode(m)
+}
+
+// magnet returns the magnet link of t.
+func (s Server) magnet(t *torrent) string {
+	q := url.Values{}
+	q.Set("dn", path.Base(t.rel))
+	q.Set("xl", strconv.FormatInt(t.Size, 10))
+	q.Set("tr", s.Torrents.Announce)
+	return "magnet:?xt=urn:btih:" + t.InfoHash + "&" + q.Encode()
+}
+
+// isCurrent reports whether the file of t is unchanged since t was made.
+func (s Server) isCurrent(t *torrent) bool {
+	info, err := os.Stat(filepath.Join(s.DocumentRoot, filepath.FromSlash(t.rel)))
+	return err == nil && info.Size() == t.Size && info.ModTime().Equal(t.ModTime)
+}
+
+func (s Server) torrentStatus(t *torrent) torrentStatus {
+	return torrentStatus{
+		torrent:  t,
+		Magnet:   s.magnet(t),
+		Torrent:  (&url.URL{Path: "/torrents" + t.Path}).String(),
+		Uploaded: atomic.LoadInt64(&t.uploaded),
+	}
+}
+
+// handleTorrent serves the torrents API: POST /torrents/files/(path) starts seeding a file, GET serves its .torrent file,
+// and DELETE stops seeding it. GET /torrents lists the seeded files.
+func (s Server) handleTorrent(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead || s.isAuthenticationRequired(r) {
+		if err := s.checkToken(r); err != nil {
+			respondError(w, err)
+			return
+		}
+	}
+	if s.EnableCORS {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+	if r.URL.Path == "/torrents" || r.URL.Path == "/torrents/" {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+			return
+		}
+		s.Torrents.mu.Lock()
+		resp := torrentsResponse{response: response{OK: true}, Torrents: []torrentStatus{}}
+		for _, t := range s.Torrents.byPath {
+			resp.Torrents = append(resp.Torrents, s.torrentStatus(t))
+		}
+		s.Torrents.mu.Unlock()
+		sort.Slice(resp.Torrents, func(i, j int) bool { return resp.Torrents[i].Path < resp.Torrents[j].Path })
+		w.WriteHeader(http.StatusOK)
+		writeJSON(w, resp)
+		return
+	}
+	m := rePathTorrent.FindStringSubmatch(r.URL.Path)
+	if m == nil || isInternalName(strings.SplitN(strings.TrimPrefix(r.URL.Path, "/torrents/files/"), "/", 2)[0]) {
+		respondError(w, fmt.Errorf("\"%s\" is %w", r.URL.Path, errNotFound))
+		return
+	}
+	rel := path.Clean("/" + toSlash(m[1]+m[2]))
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		t, ok := s.Torrents.get(rel)
+		if !ok {
+			respondError(w, withStatus(http.StatusNotFound, errTorrentNotFound))
+			return
+		}
+		if !s.isCurrent(t) {
+			respondError(w, withStatus(http.StatusConflict, errTorrentStale))
+			return
+		}
+		b := s.metainfo(t, requestBaseURL(r))
+		w.Header().Set("Content-Type", "application/x-bittorrent")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(rel)+".torrent"))
+		w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(b)
+		}
+	case http.MethodPost:
+		t, err := s.makeTorrent(r.Context(), rel)
+		if err == nil {
+			err = s.Torrents.add(t)
+		}
+		if err != nil {
+			logFailure(logger.WithField("path", "/files"+rel), err, "failed to make the torrent")
+			respondError(w, err)
+			return
+		}
+		logger.WithFields(logrus.Fields{
+			"path":      t.Path,
+			"info_hash": t.InfoHash,
+			"pieces":    len(t.Pieces) / sha1.Size,
+		}).Info("seeding file")
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, torrentResponse{response: response{OK: true}, torrentStatus: s.torrentStatus(t)})
+	case http.MethodDelete:
+		t, err := s.Torrents.remove(rel)
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		if t == nil {
+			respondError(w, withStatus(http.StatusNotFound, errTorrentNotFound))
+			return
+		}
+		logger.WithField("path", t.Path).Info("stopped seeding file")
+		go s.Torrents.announceTo(t, "stopped")
+		w.WriteHeader(http.StatusOK)
+		writeJSON(w, response{OK: true})
+	default:
+		w.Header().Set("Allow", "GET,HEAD,POST,DELETE")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+	}
+}
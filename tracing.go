@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// span kinds defined by OTLP
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+// traceSampled is the "sampled" trace flag.
+const traceSampled = 0x01
+
+const (
+	traceBatchSize     = 128
+	traceFlushInterval = 5 * time.Second
+)
+
+// tracer is nil if tracing is disabled; every function below is a no-op in that case.
+var tracer *otlpTracer
+
+type spanContextKey struct{}
+
+// span is a unit of work reported to the OTLP collector.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]interface{}
+	err      error
+	// flags are the W3C trace flags, of which only "sampled" is known: the spans of traces which are not sampled
+	// are not exported. state is the tracestate header of the caller, passed on as received.
+	flags byte
+	state string
+}
+
+// otlpTracer exports finished spans to a collector with OTLP/HTTP using the JSON encoding.
+type otlpTracer struct {
+	endpoint string
+	service  string
+	client   *http.Client
+	spans    chan *span
+}
+
+func newTracer(endpoint string, service string) *otlpTracer {
+	t := &otlpTracer{
+		endpoint: endpoint,
+		service:  service,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		spans:    make(chan *span, traceBatchSize*8),
+	}
+	go t.run()
+	return t
+}
+
+func (t *otlpTracer) run() {
+	ticker := time.NewTicker(traceFlushInterval)
+	defer ticker.Stop()
+	batch := make([]*span, 0, traceBatchSize)
+	for {
+		select {
+		case sp := <-t.spans:
+			batch = append(batch, sp)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		if err := t.export(batch); err != nil {
+			logger.WithError(err).WithField("count", len(batch)).Warn("failed to export spans")
+		}
+		batch = batch[:0]
+	}
+}
+
+func (t *otlpTracer) export(spans []*span) error {
+	body, err := json.Marshal(t.encode(spans))
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector responded %s", resp.Status)
+	}
+	return nil
+}
+
+type otlpValue map[string]interface{}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+func otlpAttributes(attrs map[string]interface{}) []otlpAttribute {
+	result := make([]otlpAttribute, 0, len(attrs))
+	for k, v := range attrs {
+		var value otlpValue
+		switch v := v.(type) {
+		case int:
+			value = otlpValue{"intValue": strconv.Itoa(v)}
+		case int64:
+			value = otlpValue{"intValue": strconv.FormatInt(v, 10)}
+		case bool:
+			value = otlpValue{"boolValue": v}
+		default:
+			value = otlpValue{"stringValue": fmt.Sprint(v)}
+		}
+		result = append(result, otlpAttribute{Key: k, Value: value})
+	}
+	return result
+}
+
+func (t *otlpTracer) encode(spans []*span) interface{} {
+	encoded := make([]map[string]interface{}, 0, len(spans))
+	for _, sp := range spans {
+		e := map[string]interface{}{
+			"traceId":           hex.EncodeToString(sp.traceID[:]),
+			"spanId":            hex.EncodeToString(sp.spanID[:]),
+			"name":              sp.name,
+			"kind":              sp.kind,
+			"startTimeUnixNano": strconv.FormatInt(sp.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(sp.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(sp.attrs),
+		}
+		if sp.parentID != [8]byte{} {
+			e["parentSpanId"] = hex.EncodeToString(sp.parentID[:])
+		}
+		if sp.err != nil {
+			e["status"] = map[string]interface{}{"code": 2, "message": sp.err.Error()}
+		}
+		encoded = append(encoded, e)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]interface{}{"service.name": t.service}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]interface{}{"name": "simple-upload-server"},
+						"spans": encoded,
+					},
+				},
+			},
+		},
+	}
+}
+
+// startSpan starts a new span as a child of the span in ctx, if any.
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	return startSpanKind(ctx, name, spanKindInternal)
+}
+
+func startSpanKind(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	sp := &span{name: name, kind: kind, start: time.Now(), attrs: map[string]interface{}{}}
+	if parent, ok := ctx.Value(spanContextKey{}).(*span); ok {
+		sp.traceID = parent.traceID
+		sp.parentID = parent.spanID
+		sp.flags = parent.flags
+		sp.state = parent.state
+	} else {
+		rand.Read(sp.traceID[:])
+		sp.flags = traceSampled
+	}
+	rand.Read(sp.spanID[:])
+	return context.WithValue(ctx, spanContextKey{}, sp), sp
+}
+
+// SetAttribute records a key-value pair on the span.
+func (sp *span) SetAttribute(key string, value interface{}) {
+	if sp == nil {
+		return
+	}
+	sp.attrs[key] = value
+}
+
+// SetError marks the span as failed.
+func (sp *span) SetError(err error) {
+	if sp == nil {
+		return
+	}
+	sp.err = err
+}
+
+// End finishes the span and queues it for export, if its trace is sampled. Spans are dropped if the queue is full.
+func (sp *span) End() {
+	if sp == nil || tracer == nil || sp.flags&traceSampled == 0 {
+		return
+	}
+	sp.end = time.Now()
+	select {
+	case tracer.spans <- sp:
+	default:
+	}
+}
+
+// traceparent formats the span as W3C trace context.
+func (sp *span) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", hex.EncodeToString(sp.traceID[:]), hex.EncodeToString(sp.spanID[:]), sp.flags)
+}
+
+// parseTraceparent extracts the remote parent from a W3C "traceparent" header. Versions after 00 may add fields,
+// and flags, which are ignored.
+func parseTraceparent(header string) (*span, bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return nil, false
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return nil, false
+	}
+	parent := &span{flags: flags[0] & traceSampled}
+	if _, err := hex.Decode(parent.traceID[:], []byte(parts[1])); err != nil {
+		return nil, false
+	}
+	if _, err := hex.Decode(parent.spanID[:], []byte(parts[2])); err != nil {
+		return nil, false
+	}
+	if parent.traceID == [16]byte{} || parent.spanID == [8]byte{} {
+		return nil, false
+	}
+	return parent, true
+}
+
+// injectTraceparent propagates the span in ctx to an outgoing request.
+func injectTraceparent(ctx context.Context, req *http.Request) {
+	if sp, ok := ctx.Value(spanContextKey{}).(*span); ok {
+		req.Header.Set("traceparent", sp.traceparent())
+		if sp.state != "" {
+			req.Header.Set("tracestate", sp.state)
+		}
+	}
+}
+
+// traceHandler wraps h to record a server span for every request, continuing the caller's trace if given.
+// Spans are named by the method and the pattern of mux the request matches, like "GET /files/", so that their names
+// do not vary with paths.
+func traceHandler(h http.Handler, mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tracer == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+		ctx := r.Context()
+		if parent, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			parent.state = strings.Join(r.Header.Values("tracestate"), ",")
+			ctx = context.WithValue(ctx, spanContextKey{}, parent)
+		}
+		name := r.Method
+		_, route := mux.Handler(r)
+		if route != "" {
+			name += " " + route
+		}
+		ctx, sp := startSpanKind(ctx, name, spanKindServer)
+		defer sp.End()
+		if route != "" {
+			sp.SetAttribute("http.route", route)
+		}
+		sp.SetAttribute("http.method", r.Method)
+		sp.SetAttribute("http.target", r.URL.Path)
+		sp.SetAttribute("net.peer.addr", r.RemoteAddr)
+		w.Header().Set("traceparent", sp.traceparent())
+
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r.WithContext(ctx))
+		sp.SetAttribute("http.status_code", rec.status)
+		if rec.status >= http.StatusInternalServerError {
+			sp.SetError(fmt.Errorf("%s", http.StatusText(rec.status)))
+		}
+	})
+}
+
+// traceStorage runs a storage operation on path within its own span.
+func traceStorage(ctx context.Context, name string, path string, op func() error) error {
+	_, sp := startSpan(ctx, name)
+	sp.SetAttribute("path", path)
+	err := op()
+	sp.SetError(err)
+	sp.End()
+	return err
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const traceID, spanID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	for _, tc := range []struct {
+		header string
+		ok     bool
+		flags  byte
+	}{
+		{"00-" + traceID + "-" + spanID + "-01", true, traceSampled},
+		{"00-" + traceID + "-" + spanID + "-00", true, 0},
+		// flags other than "sampled" are not passed on.
+		{"00-" + traceID + "-" + spanID + "-03", true, traceSampled},
+		{"00-" + traceID + "-" + spanID + "-02", true, 0},
+		// later versions may add fields.
+		{"01-" + traceID + "-" + spanID + "-01-extra", true, traceSampled},
+		{"00-" + traceID + "-" + spanID + "-01-extra", false, 0},
+		{"ff-" + traceID + "-" + spanID + "-01", false, 0},
+		{"00-" + traceID + "-" + spanID, false, 0},
+		{"00-" + traceID + "-" + spanID + "-1", false, 0},
+		{"00-" + traceID + "-" + spanID + "-zz", false, 0},
+		{"00-00000000000000000000000000000000-" + spanID + "-01", false, 0},
+		{"00-" + traceID + "-0000000000000000-01", false, 0},
+		{"00-" + traceID[1:] + "-" + spanID + "-01", false, 0},
+		{"", false, 0},
+	} {
+		parent, ok := parseTraceparent(tc.header)
+		if ok != tc.ok {
+			t.Errorf("%q: %v, want %v", tc.header, ok, tc.ok)
+			continue
+		}
+		if ok && parent.flags != tc.flags {
+			t.Errorf("%q: flags %02x, want %02x", tc.header, parent.flags, tc.flags)
+		}
+	}
+}
+
+// withTestTracer installs a tracer whose spans are queued but not exported, for the duration of the test.
+func withTestTracer(t *testing.T) *otlpTracer {
+	saved := tracer
+	tracer = &otlpTracer{spans: make(chan *span, 16)}
+	t.Cleanup(func() { tracer = saved })
+	return tracer
+}
+
+func TestTraceHandler(t *testing.T) {
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	mux := http.NewServeMux()
+	var outgoing *http.Request
+	mux.HandleFunc("/files/", func(w http.ResponseWriter, r *http.Request) {
+		outgoing = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		injectTraceparent(r.Context(), outgoing)
+	})
+	tr := withTestTracer(t)
+	handler := traceHandler(mux, mux)
+
+	for _, tc := range []struct {
+		name        string
+		path        string
+		traceparent string
+		tracestate  string
+		exported    bool
+		spanName    string
+	}{
+		{"new trace", "/files/2024/report.pdf", "", "", true, "GET /files/"},
+		{"sampled", "/files/a/b.txt", "00-" + traceID + "-" + parentID + "-01", "vendor=opaque", true, "GET /files/"},
+		{"not sampled", "/files/a/b.txt", "00-" + traceID + "-" + parentID + "-00", "vendor=opaque", false, "GET /files/"},
+		{"no route", "/unknown/path", "", "", true, "GET"},
+	} {
+		outgoing = nil
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.traceparent != "" {
+			r.Header.Set("traceparent", tc.traceparent)
+			r.Header.Set("tracestate", tc.tracestate)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		flags := "-01"
+		if !tc.exported {
+			flags = "-00"
+		}
+		returned := w.Header().Get("traceparent")
+		if !strings.HasSuffix(returned, flags) {
+			t.Errorf("%s: traceparent %q returned, want flags %s", tc.name, returned, flags)
+		}
+		if tc.traceparent != "" && !strings.HasPrefix(returned, "00-"+traceID+"-") {
+			t.Errorf("%s: traceparent %q returned, not of the trace of the caller", tc.name, returned)
+		}
+		if outgoing != nil {
+			if got := outgoing.Header.Get("traceparent"); got != returned {
+				t.Errorf("%s: traceparent %q passed on, want %q", tc.name, got, returned)
+			}
+			if got := outgoing.Header.Get("tracestate"); got != tc.tracestate {
+				t.Errorf("%s: tracestate %q passed on, want %q", tc.name, got, tc.tracestate)
+			}
+		}
+
+		select {
+		case sp := <-tr.spans:
+			if !tc.exported {
+				t.Errorf("%s: span exported", tc.name)
+			} else if sp.name != tc.spanName || sp.attrs["http.target"] != tc.path {
+				t.Errorf("%s: span %q for %v, want %q for %s", tc.name, sp.name, sp.attrs["http.target"], tc.spanName, tc.path)
+			}
+			if tc.traceparent != "" && sp.traceparent()[3:35] != traceID {
+				t.Errorf("%s: span of another trace", tc.name)
+			}
+		default:
+			if tc.exported {
+				t.Errorf("%s: span not exported", tc.name)
+			}
+		}
+	}
+}
+
+func TestChildSpansInheritSampling(t *testing.T) {
+	tr := withTestTracer(t)
+	parent, _ := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	ctx := context.WithValue(context.Background(), spanContextKey{}, parent)
+	err := traceStorage(ctx, "storage.write", "/a.txt", func() error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case sp := <-tr.spans:
+		t.Errorf("span %q of a trace not sampled exported", sp.name)
+	default:
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// stagingPrefix is the prefix of the staging directories of transactions and upload sessions, which are created in the document root
+// to be able to rename files into place atomically. They are hidden from clients.
+const stagingPrefix = ".tx_"
+
+var (
+	rePathTransaction       = regexp.MustCompile(`^/tx/([^/]+)$`)
+	rePathTransactionFile   = regexp.MustCompile(`^/tx/([^/]+)/files(/.*)?(/[^/]+)$`)
+	rePathTransactionCommit = regexp.MustCompile(`^/tx/([^/]+)/commit$`)
+
+	errTransactionNotFound = errors.New("transaction not found")
+)
+
+// transaction is a set of files staged to be published together.
+type transaction struct {
+	ID      string           `json:"id"`
+	Created time.Time        `json:"created"`
+	Files   map[string]int64 `json:"files"`
+	dir     string
+	// digests are the hex digests of the staged files.
+	digests map[string]string
+}
+
+// transactions keeps the open transactions.
+type transactions struct {
+	mu      sync.Mutex
+	byID    map[string]*transaction
+	timeout time.Duration
+}
+
+type transactionResponse struct {
+	response
+	*transaction
+}
+
+type committedResponse struct {
+	response
+	Paths []string `json:"paths"`
+	// CIDs are the IPFS CIDs of the files by path, if they were added there.
+	CIDs map[string]string `json:"cids,omitempty"`
+}
+
+func newTransactions(timeout time.Duration) *transactions {
+	return &transactions{byID: map[string]*transaction{}, timeout: timeout}
+}
+
+// isInternalName reports whether a name in the document root belongs to the server itself.
+func isInternalName(name string) bool {
+	return strings.HasPrefix(name, stagingPrefix)
+}
+
+// stagedName names a staged file by a hash of its path, so that the staging directory stays flat.
+func stagedName(rel string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(rel)))
+}
+
+// cleanStaging removes staging directories left by a previous run, whose transactions are lost. The directories
+// of upload sessions are kept, to be restored.
+func cleanStaging(root string) {
+	entries, err := ioutil.ReadDir(root)
+	if err != nil {
+		logger.WithError(err).Warn("failed to look for stale staging directories")
+		return
+	}
+	for _, e := range entries {
+		if e.IsDir() && isInternalName(e.Name()) {
+			if _, err := os.Stat(filepath.Join(root, e.Name(), sessionStateName)); err == nil {
+				continue
+			}
+			logger.WithField("path", e.Name()).Info("removing stale staging directory")
+			os.RemoveAll(filepath.Join(root, e.Name()))
+		}
+	}
+}
+
+// expire aborts the transactions which are older than the timeout. It never returns.
+func (t *transactions) expire() {
+	for range time.Tick(time.Minute) {
+		t.mu.Lock()
+		for id, tx := range t.byID {
+			if time.Since(tx.Created) > t.timeout {
+				logger.WithField("transaction", id).Info("transaction expired")
+				os.RemoveAll(tx.dir)
+				delete(t.byID, id)
+			}
+		}
+		t.mu.Unlock()
+	}
+}
+
+func (s Server) handleTransaction(w http.ResponseWriter, r *http.Request) {
+	// transactions always change stored files, so the token is always required.
+	if err := s.checkToken(r); err != nil {
+		respondError(w, err)
+		return
+	}
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		if err := s.checkWritable(); err != nil {
+			respondError(w, err)
+			return
+		}
+	}
+	if r.URL.Path == "/tx" || r.URL.Path == "/tx/" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST")
+			respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+			return
+		}
+		s.beginTransaction(w, r)
+		return
+	}
+	if m := rePathTransactionFile.FindStringSubmatch(r.URL.Path); m != nil && r.Method == http.MethodPut {
+		rel, err := s.storedPath(m[2] + m[3])
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		s.stageFile(w, r, m[1], rel)
+		return
+	}
+	if m := rePathTransactionCommit.FindStringSubmatch(r.URL.Path); m != nil && r.Method == http.MethodPost {
+		s.commitTransaction(w, r, m[1])
+		return
+	}
+	if m := rePathTransaction.FindStringSubmatch(r.URL.Path); m != nil {
+		switch r.Method {
+		case http.MethodGet:
+			s.Transactions.mu.Lock()
+			defer s.Transactions.mu.Unlock()
+			tx, ok := s.Transactions.byID[m[1]]
+			if !ok {
+				respondError(w, withStatus(http.StatusNotFound, errTransactionNotFound))
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			writeJSON(w, transactionResponse{response: response{OK: true}, transaction: tx})
+		case http.MethodDelete:
+			s.abortTransaction(w, r, m[1])
+		default:
+			w.Header().Set("Allow", "GET,DELETE")
+			respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		}
+		return
+	}
+	respondError(w, fmt.Errorf("\"%s\" is %w", r.URL.Path, errNotFound))
+}
+
+// newTransaction creates a transaction with a new staging directory under the document root.
+func (s Server) newTransaction() (*transaction, error) {
+	dir, err := ioutil.TempDir(s.DocumentRoot, stagingPrefix)
+	if err != nil {
+		logger.WithError(err).Error("failed to create a staging directory")
+		return nil, err
+	}
+	return &transaction{
+		ID:      strings.TrimPrefix(filepath.Base(dir), stagingPrefix),
+		Created: time.Now(),
+		Files:   map[string]int64{},
+		dir:     dir,
+		digests: map[string]string{},
+	}, nil
+}
+
+func (s Server) beginTransaction(w http.ResponseWriter, r *http.Request) {
+	tx, err := s.newTransaction()
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	s.Transactions.mu.Lock()
+	s.Transactions.byID[tx.ID] = tx
+	s.Transactions.mu.Unlock()
+	w.Header().Set(uploadIDHeader, tx.ID)
+	logger.WithFields(logrus.Fields{"transaction": tx.ID, "upload_id": tx.ID}).Info("transaction started")
+	w.WriteHeader(http.StatusCreated)
+	writeJSON(w, transactionResponse{response: response{OK: true}, transaction: tx})
+}
+
+func (s Server) stageFile(w http.ResponseWriter, r *http.Request, id string, rel string) {
+	defer r.Body.Close()
+	s.Transactions.mu.Lock()
+	tx, ok := s.Transactions.byID[id]
+	s.Transactions.mu.Unlock()
+	if !ok {
+		respondError(w, withStatus(http.StatusNotFound, errTransactionNotFound))
+		return
+	}
+	if err := s.checkOverwrite(rel); err != nil {
+		respondError(w, err)
+		return
+	}
+	rcv, err := s.receive(w, r)
+	if err != nil {
+		logFailure(tagUpload(r.Context(), logger.WithField("transaction", id)), err, "failed to receive the staged content")
+		respondError(w, err)
+		return
+	}
+	if err := s.checkReceived(rel, &rcv); err != nil {
+		os.Remove(rcv.TempName)
+		respondError(w, err)
+		return
+	}
+	stagedPath := path.Join(tx.dir, "files", stagedName(rel))
+	if err := s.commitFile(r.Context(), rcv.TempName, stagedPath); err != nil {
+		logFailure(tagUpload(r.Context(), logger.WithField("transaction", id)), err, "failed to stage the uploaded content")
+		respondError(w, err)
+		return
+	}
+	s.Transactions.mu.Lock()
+	tx.Files[rel] = rcv.Size
+	tx.digests[rel] = rcv.Digest
+	s.Transactions.mu.Unlock()
+	uploadLog(r.Context()).WithFields(logrus.Fields{
+		"transaction": id,
+		"path":        rel,
+		"size":        rcv.Size,
+	}).Info("file staged")
+	w.WriteHeader(http.StatusOK)
+	writeSuccess(w, "/files"+rel)
+}
+
+// commitTransaction publishes all staged files at once (see publish).
+func (s Server) commitTransaction(w http.ResponseWriter, r *http.Request, id string) {
+	s.Transactions.mu.Lock()
+	tx, ok := s.Transactions.byID[id]
+	if ok {
+		delete(s.Transactions.byID, id)
+	}
+	s.Transactions.mu.Unlock()
+	if !ok {
+		respondError(w, withStatus(http.StatusNotFound, errTransactionNotFound))
+		return
+	}
+	defer os.RemoveAll(tx.dir)
+
+	paths, _, err := s.publish(r.Context(), tx, nil)
+	if err != nil {
+		respondError(w, err)
+		return
+	}
+	s.announceTransaction(r, tx)
+	cids := s.pinCommitted(r.Context(), paths)
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, committedResponse{response: response{OK: true}, Paths: paths, CIDs: cids})
+}
+
+// publish moves the staged files of tx into place and removes the files in deletes, paths relative to the document root.
+// Downloads are held off meanwhile, so that clients never observe a half-published set; if anything fails,
+// the changes made so far are undone. It returns the URL paths of the stored and the deleted files.
+func (s Server) publish(ctx context.Context, tx *transaction, deletes []string) ([]string, []string, error) {
+	rels := make([]string, 0, len(tx.Files))
+	for rel := range tx.Files {
+		rels = append(rels, rel)
+	}
+	sort.Strings(rels)
+	sort.Strings(deletes)
+
+	type move struct {
+		staged, target, backup string
+	}
+	moved := []move{}
+	rollback := func() {
+		for i := len(moved) - 1; i >= 0; i-- {
+			m := moved[i]
+			if m.staged != "" {
+				renameFile(m.target, m.staged)
+			}
+			if m.backup != "" {
+				renameFile(m.backup, m.target)
+			}
+		}
+	}
+	// backup keeps a replaced or deleted file until all changes are made, to be able to restore it.
+	backup := func(m *move, rel string) error {
+		if _, err := os.Stat(m.target); err != nil {
+			return nil
+		}
+		m.backup = path.Join(tx.dir, "backup", stagedName(rel))
+		if err := os.MkdirAll(path.Dir(m.backup), 0777); err != nil {
+			return err
+		}
+		return renameFile(m.target, m.backup)
+	}
+
+	s.publishLock.Lock()
+	defer s.publishLock.Unlock()
+	for _, rel := range append(append([]string{}, rels...), deletes...) {
+		if err := s.checkOverwrite(rel); err != nil {
+			uploadLog(ctx).WithError(err).WithField("transaction", tx.ID).Info("transaction rejected")
+			return nil, nil, err
+		}
+	}
+	for _, rel := range rels {
+		m := move{
+			staged: path.Join(tx.dir, "files", stagedName(rel)),
+			target: path.Join(s.DocumentRoot, rel),
+		}
+		err := os.MkdirAll(path.Dir(m.target), 0777)
+		if err == nil {
+			err = backup(&m, rel)
+		}
+		if err == nil {
+			if err = renameFile(m.staged, m.target); err != nil && m.backup != "" {
+				renameFile(m.backup, m.target)
+			}
+		}
+		if err != nil {
+			rollback()
+			uploadLog(ctx).WithError(err).WithFields(logrus.Fields{
+				"transaction": tx.ID,
+				"path":        rel,
+			}).Error("failed to commit the transaction, so it is rolled back")
+			return nil, nil, err
+		}
+		moved = append(moved, m)
+	}
+	deleted := []string{}
+	for _, rel := range deletes {
+		m := move{target: path.Join(s.DocumentRoot, rel)}
+		if info, err := os.Stat(m.target); err != nil || info.IsDir() {
+			continue
+		}
+		if err := backup(&m, rel); err != nil {
+			rollback()
+			uploadLog(ctx).WithError(err).WithFields(logrus.Fields{
+				"transaction": tx.ID,
+				"path":        rel,
+			}).Error("failed to commit the transaction, so it is rolled back")
+			return nil, nil, err
+		}
+		moved = append(moved, m)
+		deleted = append(deleted, rel)
+	}
+	if s.Durable {
+		for _, m := range moved {
+			if err := syncDir(path.Dir(m.target)); err != nil {
+				uploadLog(ctx).WithError(err).WithField("path", m.target).Error("failed to sync the directory")
+			}
+		}
+	}
+
+	paths := make([]string, 0, len(rels))
+	for _, rel := range rels {
+		paths = append(paths, "/files"+rel)
+		tagUpload(ctx, auditLog()).WithFields(logrus.Fields{
+			"transaction": tx.ID,
+			"path":        "/files" + rel,
+			"size":        tx.Files[rel],
+		}).Info("file uploaded by transaction")
+		s.recordDigest(rel, tx.digests[rel])
+		s.startRetention(rel)
+	}
+	deletedPaths := make([]string, 0, len(deleted))
+	for _, rel := range deleted {
+		deletedPaths = append(deletedPaths, "/files"+rel)
+		s.forget(rel)
+		tagUpload(ctx, auditLog()).WithFields(logrus.Fields{
+			"transaction": tx.ID,
+			"path":        "/files" + rel,
+		}).Info("file deleted by transaction")
+		s.removeEmptyDirs(path.Dir(rel))
+	}
+	return paths, deletedPaths, nil
+}
+
+func (s Server) abortTransaction(w http.ResponseWriter, r *http.Request, id string) {
+	s.Transactions.mu.Lock()
+	tx, ok := s.Transactions.byID[id]
+	if ok {
+		delete(s.Transactions.byID, id)
+	}
+	s.Transactions.mu.Unlock()
+	if !ok {
+		respondError(w, withStatus(http.StatusNotFound, errTransactionNotFound))
+		return
+	}
+	if err := os.RemoveAll(tx.dir); err != nil {
+		logger.WithError(err).WithField("transaction", id).Warn("failed to remove the staging directory")
+	}
+	uploadLog(r.Context()).WithField("transaction", id).Info("transaction aborted")
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, response{OK: true})
+}
+
+// lockedFileSystem opens files only while no transaction is being committed.
+type lockedFileSystem struct {
+	fs   http.FileSystem
+	lock *sync.RWMutex
+}
+
+func (l lockedFileSystem) Open(name string) (http.File, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.fs.Open(name)
+}
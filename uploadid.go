@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+
+	"github.com/sirupsen/logrus"
+)
+
+// uploadIDHeader carries the ID of an upload. Clients may send the ID of an upload they make in several requests,
+// so that all of them are logged under it; the server returns the ID it used.
+const uploadIDHeader = "X-Upload-Id"
+
+var reUploadID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type uploadIDKey struct{}
+
+// newUploadID returns a random upload ID.
+func newUploadID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withUploadID returns r carrying the upload ID id.
+func withUploadID(r *http.Request, id string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), uploadIDKey{}, id))
+}
+
+// uploadIDOf returns the upload ID carried by ctx, or "" if it is not an upload.
+func uploadIDOf(ctx context.Context) string {
+	id, _ := ctx.Value(uploadIDKey{}).(string)
+	return id
+}
+
+// tagUpload adds the upload ID carried by ctx, if any, to entry.
+func tagUpload(ctx context.Context, entry *logrus.Entry) *logrus.Entry {
+	if id := uploadIDOf(ctx); id != "" {
+		return entry.WithField("upload_id", id)
+	}
+	return entry
+}
+
+// uploadLog returns an entry for the request with ctx, tagged with its upload ID, if any.
+func uploadLog(ctx context.Context) *logrus.Entry {
+	return tagUpload(ctx, logrus.NewEntry(logger))
+}
+
+// requestUploadID returns the ID of the upload r is part of: the ID of its upload session or transaction, or else
+// the one sent by the client, or else a new one. Requests starting a session or a transaction get its ID once
+// it is created, and other requests which do not store anything get none.
+func requestUploadID(r *http.Request) string {
+	for _, re := range []*regexp.Regexp{rePathSession, rePathSessionCommit, rePathTransaction, rePathTransactionFile, rePathTransactionCommit} {
+		if m := re.FindStringSubmatch(r.URL.Path); m != nil {
+			return m[1]
+		}
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodPut && r.Method != http.MethodPatch {
+		return ""
+	}
+	if rePathSessionFile.MatchString(r.URL.Path) || r.URL.Path == "/tx" || r.URL.Path == "/tx/" {
+		return ""
+	}
+	if id := r.Header.Get(uploadIDHeader); reUploadID.MatchString(id) {
+		return id
+	}
+	return newUploadID()
+}
+
+// tagUploads wraps h to give every upload request its upload ID (see requestUploadID), returned in X-Upload-Id.
+func tagUploads(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id := requestUploadID(r); id != "" {
+			w.Header().Set(uploadIDHeader, id)
+			r = withUploadID(r, id)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
+	"mime"
 	"net/http"
-	"os"
+	"net/url"
+	"strings"
 )
 
 type response struct {
@@ -14,49 +18,134 @@ type response struct {
 type uploadedResponse struct {
 	response
 	Path string `json:"path"`
+	// Digest is the digest of the stored content as "algorithm:hex", if known.
+	Digest string `json:"digest,omitempty"`
+	Size   *int64 `json:"size,omitempty"`
+	// CID identifies the content on IPFS, if it was added there.
+	CID string `json:"cid,omitempty"`
 }
 
 func newUploadedResponse(path string) uploadedResponse {
 	return uploadedResponse{response: response{OK: true}, Path: path}
 }
 
+// newUploadedResponse reports the content received as stored at path.
+func (s Server) newUploadedResponse(path string, rcv received) uploadedResponse {
+	resp := newUploadedResponse(path)
+	resp.Digest = s.Digests.label(rcv.Digest)
+	resp.Size = &rcv.Size
+	return resp
+}
+
 type errorResponse struct {
 	response
 	Message string `json:"error"`
+	// AllowedExtensions lists the extensions allowed where a file with another one was rejected.
+	AllowedExtensions []string `json:"allowed_extensions,omitempty"`
 }
 
 func newErrorResponse(err error) errorResponse {
-	return errorResponse{response: response{OK: false}, Message: err.Error()}
+	resp := errorResponse{response: response{OK: false}, Message: err.Error()}
+	var notAllowed errExtensionNotAllowed
+	if errors.As(err, &notAllowed) {
+		resp.AllowedExtensions = notAllowed.allowed
+	}
+	return resp
 }
 
 func writeError(w http.ResponseWriter, err error) (int, error) {
-	body := newErrorResponse(err)
-	b, e := json.Marshal(body)
-	// if an error is occured on marshaling, write empty value as response.
-	if e != nil {
-		return w.Write([]byte{})
-	}
-	return w.Write(b)
+	resp := newErrorResponse(err)
+	resp.Message = localizeError(languageOf(w), err)
+	return writeJSON(w, resp)
 }
 
 func writeSuccess(w http.ResponseWriter, path string) (int, error) {
-	body := newUploadedResponse(path)
-	b, e := json.Marshal(body)
+	return writeJSON(w, newUploadedResponse(path))
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) (int, error) {
+	buf := jsonBuffers.Get().(*bytes.Buffer)
+	defer func() {
+		// don't keep the memory of large listings.
+		if buf.Cap() <= 64<<10 {
+			jsonBuffers.Put(buf)
+		}
+	}()
+	buf.Reset()
+	if isLegacy(w) {
+		v = legacyEnvelope(v)
+	}
+	e := json.NewEncoder(buf).Encode(v)
 	// if an error is occured on marshaling, write empty value as response.
 	if e != nil {
 		return w.Write([]byte{})
 	}
-	return w.Write(b)
+	// Encode ends the value with a newline, which json.Marshal does not.
+	return w.Write(buf.Bytes()[:buf.Len()-1])
 }
 
-func getSize(content io.Seeker) (int64, error) {
-	size, err := content.Seek(0, os.SEEK_END)
+// redirectURL returns target with the uploaded path appended as the "path" query parameter.
+func redirectURL(target, path string) (string, error) {
+	u, err := url.Parse(target)
 	if err != nil {
-		return 0, err
+		return "", err
 	}
-	_, err = content.Seek(0, io.SeekStart)
-	if err != nil {
-		return 0, err
+	q := u.Query()
+	q.Set("path", path)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// isMultipart reports whether the request body is a multipart form.
+func isMultipart(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// statusRecorder remembers the status code and the size of the response written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+// Unwrap returns the writer the recorder wraps.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+func (rec *statusRecorder) WriteHeader(code int) {
+	rec.status = code
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(b)
+	rec.written += int64(n)
+	return n, err
+}
+
+// ReadFrom lets the underlying writer copy files to the connection with sendfile, which wrapping it would otherwise defeat.
+func (rec *statusRecorder) ReadFrom(src io.Reader) (int64, error) {
+	var n int64
+	var err error
+	if rf, ok := rec.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = copyBuffer(rec.ResponseWriter, src)
 	}
-	return size, nil
+	rec.written += n
+	return n, err
+}
+
+// stringsFlag is a flag which may be given multiple times.
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sendfileWriter is a ResponseWriter which records what ReadFrom is called with, as net/http's does to use sendfile
+// if it is a file, or a file limited by io.LimitReader.
+type sendfileWriter struct {
+	header http.Header
+	body   bytes.Buffer
+	from   io.Reader
+}
+
+func (w *sendfileWriter) Header() http.Header         { return w.header }
+func (w *sendfileWriter) Write(b []byte) (int, error) { return w.body.Write(b) }
+func (w *sendfileWriter) WriteHeader(int)             {}
+
+func (w *sendfileWriter) ReadFrom(src io.Reader) (int64, error) {
+	w.from = src
+	return w.body.ReadFrom(src)
+}
+
+func TestDownloadsReachSendfile(t *testing.T) {
+	root, err := ioutil.TempDir("", "sendfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+	if err := ioutil.WriteFile(filepath.Join(root, "video.mp4"), content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(root, 1024, "", false, nil)
+
+	for _, tc := range []struct {
+		name string
+		wrap func(w http.ResponseWriter) http.ResponseWriter
+	}{
+		{"none", func(w http.ResponseWriter) http.ResponseWriter { return w }},
+		{"legacyWriter", func(w http.ResponseWriter) http.ResponseWriter { return &legacyWriter{ResponseWriter: w} }},
+		{"localizedWriter", func(w http.ResponseWriter) http.ResponseWriter {
+			return &localizedWriter{ResponseWriter: w, lang: "ja"}
+		}},
+		{"statusRecorder", func(w http.ResponseWriter) http.ResponseWriter {
+			return &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		}},
+		{"all", func(w http.ResponseWriter) http.ResponseWriter {
+			return &statusRecorder{ResponseWriter: &localizedWriter{ResponseWriter: &legacyWriter{ResponseWriter: w}, lang: "ja"}, status: http.StatusOK}
+		}},
+	} {
+		w := &sendfileWriter{header: http.Header{}}
+		s.handleGet(tc.wrap(w), httptest.NewRequest(http.MethodGet, "/files/video.mp4", nil))
+		if !bytes.Equal(w.body.Bytes(), content) {
+			t.Errorf("%s: wrong content of %d bytes", tc.name, w.body.Len())
+		}
+		from := w.from
+		if lr, ok := from.(*io.LimitedReader); ok {
+			from = lr.R
+		}
+		if _, ok := from.(*os.File); !ok {
+			t.Errorf("%s: ReadFrom called with %T, want a file", tc.name, w.from)
+		}
+	}
+}
+
+// withoutReadFrom hides the ReadFrom of a ResponseWriter, as wrappers not forwarding it do.
+type withoutReadFrom struct{ http.ResponseWriter }
+
+func benchmarkDownload(b *testing.B, wrap func(w http.ResponseWriter) http.ResponseWriter) {
+	root, err := ioutil.TempDir("", "sendfile")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	const size = 16 << 20
+	if err := ioutil.WriteFile(filepath.Join(root, "video.mp4"), make([]byte, size), 0600); err != nil {
+		b.Fatal(err)
+	}
+	s := NewServer(root, 1024, "", false, nil)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.handleGet(wrap(w), r)
+	}))
+	defer server.Close()
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		resp, err := http.Get(server.URL + "/files/video.mp4")
+		if err != nil {
+			b.Fatal(err)
+		}
+		n, err := io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+		if err != nil || n != size {
+			b.Fatalf("downloaded %d bytes: %v", n, err)
+		}
+	}
+}
+
+func BenchmarkStatusRecorderReadFrom(b *testing.B) {
+	benchmarkDownload(b, func(w http.ResponseWriter) http.ResponseWriter {
+		return &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	})
+}
+
+func BenchmarkStatusRecorderWithoutReadFrom(b *testing.B) {
+	benchmarkDownload(b, func(w http.ResponseWriter) http.ResponseWriter {
+		return &statusRecorder{ResponseWriter: withoutReadFrom{w}, status: http.StatusOK}
+	})
+}
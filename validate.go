@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Outcomes of a validated upload.
+const (
+	validationCreate    = "create"
+	validationOverwrite = "overwrite"
+	validationKeep      = "keep"
+)
+
+// validationResponse tells what an upload would do, without doing it.
+type validationResponse struct {
+	response
+	// Path is where the file would be stored. It is empty if the name depends on the content, and no digest is given.
+	Path string `json:"path,omitempty"`
+	// Action is "create", "overwrite" an existing file, or "keep" an existing file with the same content; empty with Path.
+	Action  string `json:"action,omitempty"`
+	MaxSize int64  `json:"max_size"`
+}
+
+// isValidateOnly reports whether r only asks to validate an upload, by the validate_only query parameter.
+func isValidateOnly(r *http.Request) bool {
+	v, _ := strconv.ParseBool(r.URL.Query().Get("validate_only"))
+	return v
+}
+
+// handleValidateOnly runs the checks of an upload by POST or PUT, authentication and writability having passed,
+// and responds with what the upload would do, or with the error it would fail with. Nothing is stored, and the body
+// is not read: the file is described by the query parameters "size" and, for POST, "filename" and "digest".
+func (s Server) handleValidateOnly(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if v := query.Get("size"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size < 0 {
+			respondError(w, withStatus(http.StatusBadRequest, fmt.Errorf("invalid size %q", v)))
+			return
+		}
+		if size > s.MaxUploadSize {
+			respondError(w, errFileTooLarge)
+			return
+		}
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(path.Join(s.DocumentRoot, path.Clean("/"+name)))
+		return err == nil
+	}
+	resp := validationResponse{response: response{OK: true}, MaxSize: s.MaxUploadSize}
+
+	var rel string
+	keep := false
+	if r.Method == http.MethodPut {
+		matches := rePathFiles.FindStringSubmatch(r.URL.Path)
+		if matches == nil {
+			respondError(w, fmt.Errorf("\"%s\" is %w", r.URL.Path, errNotFound))
+			return
+		}
+		var err error
+		if rel, err = s.storedPath(matches[1] + matches[2]); err != nil {
+			respondError(w, err)
+			return
+		}
+	} else {
+		filename := ""
+		if v := query.Get("filename"); v != "" {
+			// the same as the file name of a multipart form, which never has directories.
+			filename = path.Base(toSlash(v))
+		}
+		digest := strings.ToLower(query.Get("digest"))
+		if digest == "" && s.namesByContent(filename) {
+			// the name is only known once the content is.
+			w.WriteHeader(http.StatusOK)
+			writeJSON(w, resp)
+			return
+		}
+		name, kept, err := s.Naming.name(filename, digest, func(name string) bool { return exists(s.inHome(name)) })
+		if err != nil {
+			respondError(w, err)
+			return
+		}
+		if rel, err = s.storedPath(s.inHome(name)); err != nil {
+			respondError(w, err)
+			return
+		}
+		keep = kept
+	}
+
+	if !keep {
+		if err := s.checkExtension(rel); err != nil {
+			respondError(w, err)
+			return
+		}
+		if err := s.checkOverwrite(rel); err != nil {
+			respondError(w, err)
+			return
+		}
+	}
+	resp.Path = "/files" + rel
+	switch {
+	case keep:
+		resp.Action = validationKeep
+	case exists(rel):
+		resp.Action = validationOverwrite
+	default:
+		resp.Action = validationCreate
+	}
+	if s.EnableCORS {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, resp)
+}
+
+// namesByContent reports whether the name of a file posted with filename depends on its digest.
+func (s Server) namesByContent(filename string) bool {
+	switch s.Naming.Strategy {
+	case namingHash:
+		return true
+	case namingUUID:
+		return false
+	case namingTemplate:
+		if strings.Contains(s.Naming.Template, "{hash}") {
+			return true
+		}
+	}
+	return filename == ""
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// version and commit are set when building releases, like
+// go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD)".
+var (
+	version = "dev"
+	commit  = ""
+)
+
+// versionInfo describes the build of this binary.
+type versionInfo struct {
+	response
+	Version string `json:"version"`
+	Commit  string `json:"commit,omitempty"`
+	Go      string `json:"go"`
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+}
+
+func currentVersion() versionInfo {
+	v := versionInfo{
+		response: response{OK: true},
+		Version:  version,
+		Commit:   commit,
+		Go:       runtime.Version(),
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+	}
+	// binaries installed with go install carry the version of their module instead.
+	if info, ok := debug.ReadBuildInfo(); ok && v.Version == "dev" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		v.Version = info.Main.Version
+	}
+	return v
+}
+
+// handleVersion serves GET /version. It does not require the token.
+func (s Server) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET,HEAD")
+		respondError(w, withStatus(http.StatusMethodNotAllowed, errMethodNotAllowed(r.Method)))
+		return
+	}
+	if s.EnableCORS {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	}
+	w.WriteHeader(http.StatusOK)
+	writeJSON(w, currentVersion())
+}
+
+// printVersion writes the build of this binary as JSON, for the version command.
+func printVersion(out io.Writer) int {
+	b, err := json.Marshal(currentVersion())
+	if err != nil {
+		return 1
+	}
+	fmt.Fprintln(out, string(b))
+	return 0
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	errReadOnly = errors.New("the server is read-only because the storage is running out of space")
+
+	storageUsedMetric     = expvar.NewFloat("storage_used_percent")
+	storageReadOnlyMetric = expvar.NewInt("storage_read_only")
+	storageAlertsMetric   = expvar.NewInt("storage_alerts")
+)
+
+// storageMonitor watches the usage of the filesystem holding the document root.
+// When it reaches the high watermark, an alert is sent and optionally the server turns read-only;
+// once the usage drops below the low watermark, the alert is resolved and writes resume.
+type storageMonitor struct {
+	dir string
+	// High and Low are watermarks in percent of the filesystem size.
+	High float64
+	Low  float64
+	// ReadOnly makes the server reject writes above the high watermark.
+	ReadOnly bool
+	// AlertURL receives a JSON notification when a watermark is crossed, if not empty.
+	AlertURL string
+
+	readOnly int32
+	alerting bool
+}
+
+type storageAlert struct {
+	Event       string    `json:"event"`
+	Dir         string    `json:"dir"`
+	UsedPercent float64   `json:"used_percent"`
+	Total       uint64    `json:"total"`
+	Used        uint64    `json:"used"`
+	ReadOnly    bool      `json:"read_only"`
+	Time        time.Time `json:"time"`
+}
+
+// isReadOnly reports whether writes are currently rejected. A nil monitor never rejects writes.
+func (m *storageMonitor) isReadOnly() bool {
+	return m != nil && atomic.LoadInt32(&m.readOnly) == 1
+}
+
+// run checks the usage every interval. It never returns.
+func (m *storageMonitor) run(interval time.Duration) {
+	m.check()
+	for range time.Tick(interval) {
+		m.check()
+	}
+}
+
+func (m *storageMonitor) check() {
+	total, used, err := diskUsage(m.dir)
+	if err != nil {
+		logger.WithError(err).WithField("dir", m.dir).Warn("failed to get the storage usage")
+		return
+	}
+	if total == 0 {
+		return
+	}
+	percent := float64(used) * 100 / float64(total)
+	storageUsedMetric.Set(percent)
+
+	alert := storageAlert{Dir: m.dir, UsedPercent: percent, Total: total, Used: used, Time: time.Now()}
+	entry := logger.WithFields(logrus.Fields{
+		"dir":          m.dir,
+		"used_percent": percent,
+	})
+	switch {
+	case !m.alerting && percent >= m.High:
+		m.alerting = true
+		storageAlertsMetric.Add(1)
+		if m.ReadOnly {
+			atomic.StoreInt32(&m.readOnly, 1)
+			storageReadOnlyMetric.Set(1)
+		}
+		alert.Event = "storage.high_watermark"
+		entry.WithField("read_only", m.ReadOnly).Warn("storage usage reached the high watermark")
+	case m.alerting && percent < m.Low:
+		m.alerting = false
+		atomic.StoreInt32(&m.readOnly, 0)
+		storageReadOnlyMetric.Set(0)
+		alert.Event = "storage.low_watermark"
+		entry.Info("storage usage dropped below the low watermark")
+	default:
+		return
+	}
+	alert.ReadOnly = m.isReadOnly()
+	if m.AlertURL != "" {
+		if err := postJSON(context.Background(), m.AlertURL, alert); err != nil {
+			logger.WithError(err).WithField("url", m.AlertURL).Warn("failed to send the storage alert")
+		}
+	}
+}
+
+// checkWritable returns an error if the server does not accept writes now.
+func (s Server) checkWritable() error {
+	if s.Storage.isReadOnly() {
+		return errReadOnly
+	}
+	return nil
+}
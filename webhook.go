@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var webhookClient = &http.Client{Timeout: 30 * time.Second}
+
+// postJSON sends payload as JSON to url, propagating the trace in ctx.
+func postJSON(ctx context.Context, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, sp := startSpanKind(ctx, "POST "+url, spanKindClient)
+	defer sp.End()
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		sp.SetError(err)
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	injectTraceparent(ctx, req)
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		sp.SetError(err)
+		return err
+	}
+	defer resp.Body.Close()
+	sp.SetAttribute("http.status_code", resp.StatusCode)
+	if resp.StatusCode/100 != 2 {
+		err := fmt.Errorf("webhook responded %s", resp.Status)
+		sp.SetError(err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,501 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"sort"
+)
+
+// Lossless WebP (VP8L) bitstream, as specified by RFC 9649.
+const (
+	vp8lSignature     = 0x2f
+	vp8lMaxDimension  = 1 << 14
+	vp8lLengthCodes   = 24
+	vp8lDistanceCodes = 40
+	vp8lMaxCodeLength = 15
+	vp8lMaxLength     = 4096
+	// vp8lPlaneCodes are the distance codes for the neighborhood of a pixel; larger codes are distances plus this.
+	vp8lPlaneCodes = 120
+	// vp8lWindow bounds the distance of backward references, in pixels, and vp8lChain the candidates tried.
+	vp8lWindow = 1 << 18
+	vp8lChain  = 32
+	// vp8lBlockBits makes the blocks of the predictor transform 512 pixels wide, the largest allowed.
+	vp8lBlockBits = 9
+	// vp8lGradient is the predictor mode clamping L + T - TL, for the left, top and top-left pixels.
+	vp8lGradient = 12
+)
+
+// Transforms, by their type in the bitstream.
+const (
+	vp8lPredictorTransform     = 0
+	vp8lSubtractGreenTransform = 2
+)
+
+var errImageTooLarge = errors.New("image too large")
+
+// vp8lCodeLengthOrder is the order the lengths of the code length code are written in.
+var vp8lCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// vp8lWriter writes bits least significant first, as VP8L decoders read them.
+type vp8lWriter struct {
+	buf  []byte
+	bits uint64
+	n    uint
+}
+
+func (w *vp8lWriter) write(v uint32, n uint) {
+	w.bits |= uint64(v) << w.n
+	w.n += n
+	for w.n >= 8 {
+		w.buf = append(w.buf, byte(w.bits))
+		w.bits >>= 8
+		w.n -= 8
+	}
+}
+
+func (w *vp8lWriter) flush() {
+	if w.n > 0 {
+		w.buf = append(w.buf, byte(w.bits))
+		w.bits, w.n = 0, 0
+	}
+}
+
+// prefixCode is a canonical Huffman code, with its codes bit-reversed to be written as they are read.
+// The symbol of a code of a single symbol takes no bits.
+type prefixCode struct {
+	lengths []uint8
+	codes   []uint32
+}
+
+func (w *vp8lWriter) writeSymbol(c prefixCode, symbol int) {
+	w.write(c.codes[symbol], uint(c.lengths[symbol]))
+}
+
+// huffmanLengths returns the code lengths of a Huffman code for symbols occurring counts times, none longer
+// than limit. Rare symbols are counted as more frequent until the code fits. Codes have at least two symbols,
+// as decoders read no bits for codes of a single one.
+func huffmanLengths(counts []int, limit int) []uint8 {
+	lengths := make([]uint8, len(counts))
+	var leaves []int
+	for symbol, count := range counts {
+		if count > 0 {
+			leaves = append(leaves, symbol)
+		}
+	}
+	if len(leaves) < 2 {
+		lengths[0], lengths[1] = 1, 1
+		if len(leaves) == 1 && leaves[0] > 1 {
+			lengths[1], lengths[leaves[0]] = 0, 1
+		}
+		return lengths
+	}
+	for floor := 1; ; floor *= 2 {
+		weight := func(symbol int) int {
+			if counts[symbol] < floor {
+				return floor
+			}
+			return counts[symbol]
+		}
+		sort.SliceStable(leaves, func(i, j int) bool { return weight(leaves[i]) < weight(leaves[j]) })
+		// the leaves come first, then the nodes merged from them: both are in increasing weight, so the two
+		// lightest nodes not merged yet are at the head of either.
+		weights := make([]int, len(leaves), 2*len(leaves)-1)
+		parents := make([]int, 2*len(leaves)-1)
+		for i, symbol := range leaves {
+			weights[i] = weight(symbol)
+		}
+		leaf, merged := 0, len(leaves)
+		lightest := func() int {
+			if leaf < len(leaves) && (merged == len(weights) || weights[leaf] <= weights[merged]) {
+				leaf++
+				return leaf - 1
+			}
+			merged++
+			return merged - 1
+		}
+		for len(weights) < cap(weights) {
+			a, b := lightest(), lightest()
+			parents[a], parents[b] = len(weights), len(weights)
+			weights = append(weights, weights[a]+weights[b])
+		}
+		depths := make([]int, len(weights))
+		fits := true
+		for i := len(weights) - 2; i >= 0; i-- {
+			depths[i] = depths[parents[i]] + 1
+			fits = fits && depths[i] <= limit
+		}
+		if fits {
+			for i, symbol := range leaves {
+				lengths[symbol] = uint8(depths[i])
+			}
+			return lengths
+		}
+	}
+}
+
+// canonicalCodes assigns the codes of a canonical Huffman code with the given lengths.
+func canonicalCodes(lengths []uint8) []uint32 {
+	var counts [vp8lMaxCodeLength + 1]uint32
+	for _, l := range lengths {
+		counts[l]++
+	}
+	counts[0] = 0
+	var next [vp8lMaxCodeLength + 1]uint32
+	for l := 1; l <= vp8lMaxCodeLength; l++ {
+		next[l] = (next[l-1] + counts[l-1]) << 1
+	}
+	codes := make([]uint32, len(lengths))
+	for symbol, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		code := next[l]
+		next[l]++
+		for i := uint8(0); i < l; i++ {
+			codes[symbol] = codes[symbol]<<1 | code&1
+			code >>= 1
+		}
+	}
+	return codes
+}
+
+// writePrefixCode writes a prefix code for symbols occurring counts times, and returns it.
+func (w *vp8lWriter) writePrefixCode(counts []int) prefixCode {
+	var used []int
+	for symbol, count := range counts {
+		if count > 0 {
+			used = append(used, symbol)
+		}
+	}
+	if len(used) == 0 {
+		used = []int{0}
+	}
+	if len(used) <= 2 && used[len(used)-1] < 256 {
+		// a simple code, of one or two 8-bit symbols.
+		c := prefixCode{lengths: make([]uint8, len(counts)), codes: make([]uint32, len(counts))}
+		w.write(1, 1)
+		w.write(uint32(len(used)-1), 1)
+		if used[0] <= 1 {
+			w.write(0, 1)
+			w.write(uint32(used[0]), 1)
+		} else {
+			w.write(1, 1)
+			w.write(uint32(used[0]), 8)
+		}
+		if len(used) == 2 {
+			w.write(uint32(used[1]), 8)
+			c.lengths[used[0]], c.lengths[used[1]] = 1, 1
+			c.codes[used[1]] = 1
+		}
+		return c
+	}
+	lengths := huffmanLengths(counts, vp8lMaxCodeLength)
+	w.write(0, 1)
+	w.writeCodeLengths(lengths)
+	return prefixCode{lengths: lengths, codes: canonicalCodes(lengths)}
+}
+
+// writeCodeLengths writes the lengths of a normal prefix code, run-length encoded with the code length code:
+// 16 repeats the previous non-zero length 3 to 6 times, 17 and 18 repeat zeros 3 to 10 and 11 to 138 times.
+func (w *vp8lWriter) writeCodeLengths(lengths []uint8) {
+	type token struct{ symbol, extra int }
+	var tokens []token
+	for i := 0; i < len(lengths); {
+		run := 1
+		for i+run < len(lengths) && lengths[i+run] == lengths[i] {
+			run++
+		}
+		i += run
+		if lengths[i-run] == 0 {
+			for run >= 11 {
+				n := run
+				if n > 138 {
+					n = 138
+				}
+				tokens = append(tokens, token{18, n - 11})
+				run -= n
+			}
+			if run >= 3 {
+				tokens = append(tokens, token{17, run - 3})
+				run = 0
+			}
+		} else {
+			tokens = append(tokens, token{int(lengths[i-run]), 0})
+			for run--; run >= 3; {
+				n := run
+				if n > 6 {
+					n = 6
+				}
+				tokens = append(tokens, token{16, n - 3})
+				run -= n
+			}
+		}
+		for ; run > 0; run-- {
+			tokens = append(tokens, token{int(lengths[i-1]), 0})
+		}
+	}
+	counts := make([]int, len(vp8lCodeLengthOrder))
+	for _, t := range tokens {
+		counts[t.symbol]++
+	}
+	cl := huffmanLengths(counts, 7)
+	codes := canonicalCodes(cl)
+	n := len(vp8lCodeLengthOrder)
+	for n > 4 && cl[vp8lCodeLengthOrder[n-1]] == 0 {
+		n--
+	}
+	w.write(uint32(n-4), 4)
+	for _, symbol := range vp8lCodeLengthOrder[:n] {
+		w.write(uint32(cl[symbol]), 3)
+	}
+	// the lengths of all the symbols of the alphabet follow.
+	w.write(0, 1)
+	extraBits := map[int]uint{16: 2, 17: 3, 18: 7}
+	for _, t := range tokens {
+		w.write(codes[t.symbol], uint(cl[t.symbol]))
+		if bits, ok := extraBits[t.symbol]; ok {
+			w.write(uint32(t.extra), bits)
+		}
+	}
+}
+
+// vp8lPrefix returns the prefix code of v, a length or distance code, with its extra bits and their number.
+func vp8lPrefix(v int) (code int, extra uint32, bits uint) {
+	d := v - 1
+	if d < 4 {
+		return d, 0, 0
+	}
+	h := uint(0)
+	for d>>(h+1) != 0 {
+		h++
+	}
+	return int(2*h) + d>>(h-1)&1, uint32(d) & (1<<(h-1) - 1), h - 1
+}
+
+// vp8lToken is a literal pixel, or a backward reference of length pixels at the given distance code.
+type vp8lToken struct {
+	pixel    uint32
+	length   int
+	distance int
+}
+
+// backwardReferences encodes the pixels of an image width pixels wide with LZ77, using hash chains over pairs
+// of pixels.
+func backwardReferences(pixels []uint32, width int) []vp8lToken {
+	const hashBits = 16
+	head := make([]int32, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	chain := make([]int32, len(pixels))
+	hash := func(i int) uint32 {
+		return (pixels[i]*0x9e3779b1 ^ pixels[i+1]*0x85ebca6b) >> (32 - hashBits)
+	}
+	insert := func(i int) {
+		if i+1 < len(pixels) {
+			h := hash(i)
+			chain[i], head[h] = head[h], int32(i)
+		}
+	}
+	var tokens []vp8lToken
+	for i := 0; i < len(pixels); {
+		best, distance := 0, 0
+		if i+1 < len(pixels) {
+			limit := len(pixels) - i
+			if limit > vp8lMaxLength {
+				limit = vp8lMaxLength
+			}
+			candidate := head[hash(i)]
+			for tries := 0; candidate >= 0 && i-int(candidate) <= vp8lWindow && tries < vp8lChain; tries++ {
+				c := int(candidate)
+				n := 0
+				for n < limit && pixels[c+n] == pixels[i+n] {
+					n++
+				}
+				if n > best {
+					best, distance = n, i-c
+				}
+				if best == limit {
+					break
+				}
+				candidate = chain[c]
+			}
+		}
+		if best < 3 {
+			tokens = append(tokens, vp8lToken{pixel: pixels[i]})
+			insert(i)
+			i++
+			continue
+		}
+		// the pixels above and to the left have the shortest codes.
+		code := distance + vp8lPlaneCodes
+		if distance == width {
+			code = 1
+		} else if distance == 1 {
+			code = 2
+		}
+		tokens = append(tokens, vp8lToken{length: best, distance: code})
+		for end := i + best; i < end; i++ {
+			insert(i)
+		}
+	}
+	return tokens
+}
+
+// writeEntropyImage writes the pixels of an image width pixels wide, without a color cache. Only the main image
+// may have a meta prefix code, and it has none.
+func (w *vp8lWriter) writeEntropyImage(pixels []uint32, width int, main bool) {
+	tokens := backwardReferences(pixels, width)
+	green := make([]int, 256+vp8lLengthCodes)
+	red, blue, alpha := make([]int, 256), make([]int, 256), make([]int, 256)
+	distance := make([]int, vp8lDistanceCodes)
+	for _, t := range tokens {
+		if t.length == 0 {
+			green[t.pixel>>8&0xff]++
+			red[t.pixel>>16&0xff]++
+			blue[t.pixel&0xff]++
+			alpha[t.pixel>>24]++
+			continue
+		}
+		l, _, _ := vp8lPrefix(t.length)
+		d, _, _ := vp8lPrefix(t.distance)
+		green[256+l]++
+		distance[d]++
+	}
+	w.write(0, 1)
+	if main {
+		w.write(0, 1)
+	}
+	codes := [5]prefixCode{}
+	for i, counts := range [][]int{green, red, blue, alpha, distance} {
+		codes[i] = w.writePrefixCode(counts)
+	}
+	for _, t := range tokens {
+		if t.length == 0 {
+			w.writeSymbol(codes[0], int(t.pixel>>8&0xff))
+			w.writeSymbol(codes[1], int(t.pixel>>16&0xff))
+			w.writeSymbol(codes[2], int(t.pixel&0xff))
+			w.writeSymbol(codes[3], int(t.pixel>>24))
+			continue
+		}
+		code, extra, bits := vp8lPrefix(t.length)
+		w.writeSymbol(codes[0], 256+code)
+		w.write(extra, bits)
+		code, extra, bits = vp8lPrefix(t.distance)
+		w.writeSymbol(codes[4], code)
+		w.write(extra, bits)
+	}
+}
+
+// subPixels subtracts the channels of b from those of a, modulo 256.
+func subPixels(a, b uint32) uint32 {
+	var p uint32
+	for shift := uint(0); shift < 32; shift += 8 {
+		p |= ((a>>shift - b>>shift) & 0xff) << shift
+	}
+	return p
+}
+
+// clampAddSubtractFull predicts a pixel from its left, top and top-left neighbors as l + t - tl, by channel.
+func clampAddSubtractFull(l, t, tl uint32) uint32 {
+	var p uint32
+	for shift := uint(0); shift < 32; shift += 8 {
+		v := int(l>>shift&0xff) + int(t>>shift&0xff) - int(tl>>shift&0xff)
+		if v < 0 {
+			v = 0
+		} else if v > 255 {
+			v = 255
+		}
+		p |= uint32(v) << shift
+	}
+	return p
+}
+
+// encodeWebP writes img as a lossless WebP image. Green is subtracted from red and blue, and pixels are
+// predicted from their neighbors, before the residuals are compressed with LZ77 and Huffman codes.
+func encodeWebP(w io.Writer, img image.Image) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+	if width <= 0 || height <= 0 {
+		return errors.New("empty image")
+	}
+	if width > vp8lMaxDimension || height > vp8lMaxDimension {
+		return errImageTooLarge
+	}
+	nrgba := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(nrgba, nrgba.Bounds(), img, b.Min, draw.Src)
+	pixels := make([]uint32, width*height)
+	opaque := true
+	for i := range pixels {
+		p := nrgba.Pix[4*i : 4*i+4]
+		r, g, b, a := uint32(p[0]), uint32(p[1]), uint32(p[2]), uint32(p[3])
+		opaque = opaque && a == 0xff
+		pixels[i] = a<<24 | (r-g)&0xff<<16 | g<<8 | (b-g)&0xff
+	}
+	residuals := make([]uint32, len(pixels))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := y*width + x
+			var predicted uint32
+			switch {
+			case x == 0 && y == 0:
+				predicted = 0xff000000
+			case y == 0:
+				predicted = pixels[i-1]
+			case x == 0:
+				predicted = pixels[i-width]
+			default:
+				predicted = clampAddSubtractFull(pixels[i-1], pixels[i-width], pixels[i-width-1])
+			}
+			residuals[i] = subPixels(pixels[i], predicted)
+		}
+	}
+
+	bw := &vp8lWriter{}
+	bw.write(vp8lSignature, 8)
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	if opaque {
+		bw.write(0, 1)
+	} else {
+		bw.write(1, 1)
+	}
+	bw.write(0, 3)
+	bw.write(1, 1)
+	bw.write(vp8lSubtractGreenTransform, 2)
+	bw.write(1, 1)
+	bw.write(vp8lPredictorTransform, 2)
+	bw.write(vp8lBlockBits-2, 3)
+	blocksWide := (width + 1<<vp8lBlockBits - 1) >> vp8lBlockBits
+	blocksHigh := (height + 1<<vp8lBlockBits - 1) >> vp8lBlockBits
+	modes := make([]uint32, blocksWide*blocksHigh)
+	for i := range modes {
+		modes[i] = vp8lGradient << 8
+	}
+	bw.writeEntropyImage(modes, blocksWide, false)
+	bw.write(0, 1)
+	bw.writeEntropyImage(residuals, width, true)
+	bw.flush()
+
+	data := bw.buf
+	pad := len(data) & 1
+	header := make([]byte, 20)
+	copy(header, "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], uint32(4+8+len(data)+pad))
+	copy(header[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(header[16:], uint32(len(data)))
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if pad > 0 {
+		_, err := w.Write([]byte{0})
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,704 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The encoder is checked against a decoder written from RFC 9649, which is itself checked against images made by
+// libwebp, from golang.org/x/image: every transform and code of the format is decoded, not only those the encoder uses.
+
+// vp8lReader reads bits least significant first.
+type vp8lReader struct {
+	data []byte
+	pos  int
+	bits uint64
+	n    uint
+}
+
+var errVP8LTruncated = errors.New("truncated VP8L bitstream")
+
+func (r *vp8lReader) read(n uint) (uint32, error) {
+	for r.n < n {
+		if r.pos >= len(r.data) {
+			return 0, errVP8LTruncated
+		}
+		r.bits |= uint64(r.data[r.pos]) << r.n
+		r.pos++
+		r.n += 8
+	}
+	v := uint32(r.bits & (1<<n - 1))
+	r.bits >>= n
+	r.n -= n
+	return v, nil
+}
+
+// huffmanDecoder decodes a canonical prefix code, whose codes are read a bit at a time, most significant first.
+type huffmanDecoder struct {
+	// single is the symbol of a code of one symbol, which takes no bits, or -1.
+	single int
+	counts [vp8lMaxCodeLength + 1]int
+	// symbols are sorted by code.
+	symbols []int
+}
+
+func newHuffmanDecoder(lengths []int) (huffmanDecoder, error) {
+	h := huffmanDecoder{single: -1}
+	var used []int
+	for symbol, l := range lengths {
+		if l > 0 {
+			used = append(used, symbol)
+			h.counts[l]++
+		}
+	}
+	switch len(used) {
+	case 0:
+		return h, errors.New("empty prefix code")
+	case 1:
+		h.single = used[0]
+		return h, nil
+	}
+	// the code must be complete.
+	left := 1
+	for l := 1; l <= vp8lMaxCodeLength; l++ {
+		left = left<<1 - h.counts[l]
+		if left < 0 {
+			return h, errors.New("oversubscribed prefix code")
+		}
+	}
+	if left != 0 {
+		return h, errors.New("incomplete prefix code")
+	}
+	for l := 1; l <= vp8lMaxCodeLength; l++ {
+		for symbol, sl := range lengths {
+			if sl == l {
+				h.symbols = append(h.symbols, symbol)
+			}
+		}
+	}
+	return h, nil
+}
+
+func (h huffmanDecoder) decode(r *vp8lReader) (int, error) {
+	if h.single >= 0 {
+		return h.single, nil
+	}
+	code, first, index := 0, 0, 0
+	for l := 1; l <= vp8lMaxCodeLength; l++ {
+		bit, err := r.read(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= int(bit)
+		if code-first < h.counts[l] {
+			return h.symbols[index+code-first], nil
+		}
+		index += h.counts[l]
+		first = (first + h.counts[l]) << 1
+		code <<= 1
+	}
+	return 0, errors.New("invalid prefix code")
+}
+
+func readPrefixCode(r *vp8lReader, alphabet int) (huffmanDecoder, error) {
+	lengths := make([]int, alphabet)
+	simple, err := r.read(1)
+	if err != nil {
+		return huffmanDecoder{}, err
+	}
+	if simple == 1 {
+		n, _ := r.read(1)
+		first8, _ := r.read(1)
+		s0, err := r.read(1 + 7*uint(first8))
+		if err != nil {
+			return huffmanDecoder{}, err
+		}
+		lengths[s0] = 1
+		if n == 1 {
+			s1, err := r.read(8)
+			if err != nil {
+				return huffmanDecoder{}, err
+			}
+			if int(s1) >= alphabet {
+				return huffmanDecoder{}, errors.New("symbol out of range")
+			}
+			lengths[s1] = 1
+		}
+		return newHuffmanDecoder(lengths)
+	}
+
+	var codeLengthLengths [19]int
+	n, err := r.read(4)
+	if err != nil {
+		return huffmanDecoder{}, err
+	}
+	for i := 0; i < int(n)+4; i++ {
+		l, err := r.read(3)
+		if err != nil {
+			return huffmanDecoder{}, err
+		}
+		codeLengthLengths[vp8lCodeLengthOrder[i]] = int(l)
+	}
+	codeLengthCode, err := newHuffmanDecoder(codeLengthLengths[:])
+	if err != nil {
+		return huffmanDecoder{}, err
+	}
+	maxSymbol := alphabet
+	if limited, _ := r.read(1); limited == 1 {
+		bits, _ := r.read(3)
+		m, err := r.read(2 + 2*uint(bits))
+		if err != nil {
+			return huffmanDecoder{}, err
+		}
+		if maxSymbol = 2 + int(m); maxSymbol > alphabet {
+			return huffmanDecoder{}, errors.New("max symbol out of range")
+		}
+	}
+	prev := 8
+	for symbol := 0; symbol < alphabet && maxSymbol > 0; maxSymbol-- {
+		c, err := codeLengthCode.decode(r)
+		if err != nil {
+			return huffmanDecoder{}, err
+		}
+		if c < 16 {
+			lengths[symbol] = c
+			symbol++
+			if c != 0 {
+				prev = c
+			}
+			continue
+		}
+		repeat, value := 0, 0
+		switch c {
+		case 16:
+			extra, _ := r.read(2)
+			repeat, value = 3+int(extra), prev
+		case 17:
+			extra, _ := r.read(3)
+			repeat = 3 + int(extra)
+		case 18:
+			extra, _ := r.read(7)
+			repeat = 11 + int(extra)
+		}
+		if symbol+repeat > alphabet {
+			return huffmanDecoder{}, errors.New("code lengths out of range")
+		}
+		for ; repeat > 0; repeat-- {
+			lengths[symbol] = value
+			symbol++
+		}
+	}
+	return newHuffmanDecoder(lengths)
+}
+
+// vp8lDistanceMap gives the offsets (dx, dy) of the distance codes for the neighborhood of a pixel.
+var vp8lDistanceMap = [vp8lPlaneCodes][2]int{
+	{0, 1}, {1, 0}, {1, 1}, {-1, 1}, {0, 2}, {2, 0}, {1, 2}, {-1, 2},
+	{2, 1}, {-2, 1}, {2, 2}, {-2, 2}, {0, 3}, {3, 0}, {1, 3}, {-1, 3},
+	{3, 1}, {-3, 1}, {2, 3}, {-2, 3}, {3, 2}, {-3, 2}, {0, 4}, {4, 0},
+	{1, 4}, {-1, 4}, {4, 1}, {-4, 1}, {3, 3}, {-3, 3}, {2, 4}, {-2, 4},
+	{4, 2}, {-4, 2}, {0, 5}, {3, 4}, {-3, 4}, {4, 3}, {-4, 3}, {5, 0},
+	{1, 5}, {-1, 5}, {5, 1}, {-5, 1}, {2, 5}, {-2, 5}, {5, 2}, {-5, 2},
+	{4, 4}, {-4, 4}, {3, 5}, {-3, 5}, {5, 3}, {-5, 3}, {0, 6}, {6, 0},
+	{1, 6}, {-1, 6}, {6, 1}, {-6, 1}, {2, 6}, {-2, 6}, {6, 2}, {-6, 2},
+	{4, 5}, {-4, 5}, {5, 4}, {-5, 4}, {3, 6}, {-3, 6}, {6, 3}, {-6, 3},
+	{0, 7}, {7, 0}, {1, 7}, {-1, 7}, {5, 5}, {-5, 5}, {7, 1}, {-7, 1},
+	{4, 6}, {-4, 6}, {6, 4}, {-6, 4}, {2, 7}, {-2, 7}, {7, 2}, {-7, 2},
+	{3, 7}, {-3, 7}, {7, 3}, {-7, 3}, {5, 6}, {-5, 6}, {6, 5}, {-6, 5},
+	{8, 0}, {4, 7}, {-4, 7}, {7, 4}, {-7, 4}, {8, 1}, {8, 2}, {6, 6},
+	{-6, 6}, {8, 3}, {5, 7}, {-5, 7}, {7, 5}, {-7, 5}, {8, 4}, {6, 7},
+	{-6, 7}, {7, 6}, {-7, 6}, {8, 5}, {7, 7}, {-7, 7}, {8, 6}, {8, 7},
+}
+
+func readPrefixValue(r *vp8lReader, prefix int) (int, error) {
+	if prefix < 4 {
+		return prefix + 1, nil
+	}
+	extraBits := uint(prefix-2) >> 1
+	offset := (2 + prefix&1) << extraBits
+	extra, err := r.read(extraBits)
+	return offset + int(extra) + 1, err
+}
+
+// readEntropyImage decodes width x height pixels; only the main image may have a color cache and meta prefix codes.
+func readEntropyImage(r *vp8lReader, width int, height int, main bool) ([]uint32, error) {
+	var cacheBits uint
+	if cached, _ := r.read(1); cached == 1 {
+		bits, err := r.read(4)
+		if err != nil {
+			return nil, err
+		}
+		if bits < 1 || bits > 11 {
+			return nil, fmt.Errorf("invalid color cache bits %d", bits)
+		}
+		cacheBits = uint(bits)
+	}
+	var prefixBits uint
+	var entropy []uint32
+	groups := 1
+	if main {
+		if meta, _ := r.read(1); meta == 1 {
+			bits, err := r.read(3)
+			if err != nil {
+				return nil, err
+			}
+			prefixBits = uint(bits) + 2
+			entropy, err = readEntropyImage(r, subSampled(width, prefixBits), subSampled(height, prefixBits), false)
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range entropy {
+				if g := int(p>>8&0xffff) + 1; g > groups {
+					groups = g
+				}
+			}
+		}
+	}
+	cacheSize := 0
+	if cacheBits > 0 {
+		cacheSize = 1 << cacheBits
+	}
+	codes := make([][5]huffmanDecoder, groups)
+	for g := range codes {
+		for i, alphabet := range []int{256 + vp8lLengthCodes + cacheSize, 256, 256, 256, vp8lDistanceCodes} {
+			c, err := readPrefixCode(r, alphabet)
+			if err != nil {
+				return nil, err
+			}
+			codes[g][i] = c
+		}
+	}
+
+	pixels := make([]uint32, width*height)
+	cache := make([]uint32, cacheSize)
+	cached := 0
+	addToCache := func(to int) {
+		for ; cached < to; cached++ {
+			if cacheSize > 0 {
+				cache[(0x1e35a7bd*pixels[cached])>>(32-cacheBits)] = pixels[cached]
+			}
+		}
+	}
+	for i := 0; i < len(pixels); {
+		group := codes[0]
+		if entropy != nil {
+			x, y := i%width, i/width
+			group = codes[entropy[(y>>prefixBits)*subSampled(width, prefixBits)+x>>prefixBits]>>8&0xffff]
+		}
+		s, err := group[0].decode(r)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case s < 256:
+			red, err := group[1].decode(r)
+			if err != nil {
+				return nil, err
+			}
+			blue, err := group[2].decode(r)
+			if err != nil {
+				return nil, err
+			}
+			alpha, err := group[3].decode(r)
+			if err != nil {
+				return nil, err
+			}
+			pixels[i] = uint32(alpha)<<24 | uint32(red)<<16 | uint32(s)<<8 | uint32(blue)
+			i++
+		case s < 256+vp8lLengthCodes:
+			length, err := readPrefixValue(r, s-256)
+			if err != nil {
+				return nil, err
+			}
+			d, err := group[4].decode(r)
+			if err != nil {
+				return nil, err
+			}
+			code, err := readPrefixValue(r, d)
+			if err != nil {
+				return nil, err
+			}
+			dist := code - vp8lPlaneCodes
+			if code <= vp8lPlaneCodes {
+				offset := vp8lDistanceMap[code-1]
+				if dist = offset[0] + offset[1]*width; dist < 1 {
+					dist = 1
+				}
+			}
+			if dist > i || i+length > len(pixels) {
+				return nil, fmt.Errorf("backward reference out of range at %d", i)
+			}
+			for ; length > 0; length-- {
+				pixels[i] = pixels[i-dist]
+				i++
+			}
+		default:
+			addToCache(i)
+			pixels[i] = cache[s-256-vp8lLengthCodes]
+			i++
+		}
+		addToCache(i)
+	}
+	return pixels, nil
+}
+
+func subSampled(size int, bits uint) int {
+	return (size + 1<<bits - 1) >> bits
+}
+
+func addPixels(a, b uint32) uint32 {
+	return (a&0xff00ff00+b&0xff00ff00)&0xff00ff00 | (a&0x00ff00ff+b&0x00ff00ff)&0x00ff00ff
+}
+
+func average2(a, b uint32) uint32 {
+	return ((a^b)&0xfefefefe)>>1 + a&b
+}
+
+func channel(p uint32, shift uint) int {
+	return int(p >> shift & 0xff)
+}
+
+func clampByte(v int) uint32 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint32(v)
+}
+
+func predict(mode uint32, l, t, tl, tr uint32) uint32 {
+	switch mode {
+	case 0:
+		return 0xff000000
+	case 1:
+		return l
+	case 2:
+		return t
+	case 3:
+		return tr
+	case 4:
+		return tl
+	case 5:
+		return average2(average2(l, tr), t)
+	case 6:
+		return average2(l, tl)
+	case 7:
+		return average2(l, t)
+	case 8:
+		return average2(tl, t)
+	case 9:
+		return average2(t, tr)
+	case 10:
+		return average2(average2(l, tl), average2(t, tr))
+	case 11:
+		pl, pt := 0, 0
+		for shift := uint(0); shift < 32; shift += 8 {
+			pl += abs(channel(t, shift) - channel(tl, shift))
+			pt += abs(channel(l, shift) - channel(tl, shift))
+		}
+		if pl < pt {
+			return l
+		}
+		return t
+	case 12:
+		var p uint32
+		for shift := uint(0); shift < 32; shift += 8 {
+			p |= clampByte(channel(l, shift)+channel(t, shift)-channel(tl, shift)) << shift
+		}
+		return p
+	case 13:
+		a := average2(l, t)
+		var p uint32
+		for shift := uint(0); shift < 32; shift += 8 {
+			p |= clampByte(channel(a, shift)+(channel(a, shift)-channel(tl, shift))/2) << shift
+		}
+		return p
+	}
+	return 0
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func colorTransformDelta(t uint32, c uint32) int {
+	return int(int8(t)) * int(int8(c)) >> 5
+}
+
+type vp8lTransform struct {
+	kind  uint32
+	bits  uint
+	width int
+	data  []uint32
+}
+
+// decodeTestWebP decodes a lossless WebP image.
+func decodeTestWebP(b []byte) (*image.NRGBA, error) {
+	if len(b) < 12 || string(b[:4]) != "RIFF" || string(b[8:12]) != "WEBP" {
+		return nil, errors.New("not a WebP image")
+	}
+	var data []byte
+	for rest := b[12:]; len(rest) >= 8; {
+		size := int(binary.LittleEndian.Uint32(rest[4:]))
+		if 8+size > len(rest) {
+			return nil, errors.New("truncated chunk")
+		}
+		if string(rest[:4]) == "VP8L" {
+			data = rest[8 : 8+size]
+		}
+		rest = rest[8+size+size&1:]
+	}
+	if data == nil {
+		return nil, errors.New("no VP8L chunk")
+	}
+	r := &vp8lReader{data: data}
+	header, err := r.read(8)
+	if err != nil || header != vp8lSignature {
+		return nil, errors.New("invalid VP8L signature")
+	}
+	w, _ := r.read(14)
+	h, _ := r.read(14)
+	r.read(1)
+	if version, err := r.read(3); err != nil || version != 0 {
+		return nil, errors.New("invalid VP8L version")
+	}
+	width, height := int(w)+1, int(h)+1
+
+	var transforms []vp8lTransform
+	seen := map[uint32]bool{}
+	xsize := width
+	for {
+		more, err := r.read(1)
+		if err != nil {
+			return nil, err
+		}
+		if more == 0 {
+			break
+		}
+		kind, _ := r.read(2)
+		if seen[kind] {
+			return nil, errors.New("repeated transform")
+		}
+		seen[kind] = true
+		t := vp8lTransform{kind: kind, width: xsize}
+		switch kind {
+		case 0, 1:
+			bits, err := r.read(3)
+			if err != nil {
+				return nil, err
+			}
+			t.bits = uint(bits) + 2
+			if t.data, err = readEntropyImage(r, subSampled(xsize, t.bits), subSampled(height, t.bits), false); err != nil {
+				return nil, err
+			}
+		case 3:
+			n, err := r.read(8)
+			if err != nil {
+				return nil, err
+			}
+			if t.data, err = readEntropyImage(r, int(n)+1, 1, false); err != nil {
+				return nil, err
+			}
+			for i := 1; i < len(t.data); i++ {
+				t.data[i] = addPixels(t.data[i], t.data[i-1])
+			}
+			switch {
+			case len(t.data) <= 2:
+				t.bits = 3
+			case len(t.data) <= 4:
+				t.bits = 2
+			case len(t.data) <= 16:
+				t.bits = 1
+			}
+			xsize = subSampled(xsize, t.bits)
+		}
+		transforms = append(transforms, t)
+	}
+	pixels, err := readEntropyImage(r, xsize, height, true)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(transforms) - 1; i >= 0; i-- {
+		t := transforms[i]
+		tw := t.width
+		switch t.kind {
+		case 0:
+			for y := 0; y < height; y++ {
+				for x := 0; x < tw; x++ {
+					j := y*tw + x
+					var p uint32
+					switch {
+					case x == 0 && y == 0:
+						p = 0xff000000
+					case y == 0:
+						p = pixels[j-1]
+					case x == 0:
+						p = pixels[j-tw]
+					default:
+						mode := t.data[(y>>t.bits)*subSampled(tw, t.bits)+x>>t.bits] >> 8 & 0xf
+						p = predict(mode, pixels[j-1], pixels[j-tw], pixels[j-tw-1], pixels[j-tw+1])
+					}
+					pixels[j] = addPixels(pixels[j], p)
+				}
+			}
+		case 1:
+			for j, p := range pixels {
+				x, y := j%tw, j/tw
+				m := t.data[(y>>t.bits)*subSampled(tw, t.bits)+x>>t.bits]
+				green, red, blue := p>>8&0xff, p>>16&0xff, p&0xff
+				red = (red + uint32(colorTransformDelta(m, green))) & 0xff
+				blue = (blue + uint32(colorTransformDelta(m>>8, green)) + uint32(colorTransformDelta(m>>16, red))) & 0xff
+				pixels[j] = p&0xff00ff00 | red<<16 | blue
+			}
+		case 2:
+			for j, p := range pixels {
+				green := p >> 8 & 0xff
+				pixels[j] = p&0xff00ff00 | (p>>16+green)&0xff<<16 | (p+green)&0xff
+			}
+		case 3:
+			packed := subSampled(tw, t.bits)
+			bitsPerPixel := uint(8) >> t.bits
+			unpacked := make([]uint32, tw*height)
+			for y := 0; y < height; y++ {
+				for x := 0; x < tw; x++ {
+					index := int(pixels[y*packed+x>>t.bits] >> 8 & 0xff)
+					if t.bits > 0 {
+						index = index >> (uint(x&(1<<t.bits-1)) * bitsPerPixel) & (1<<bitsPerPixel - 1)
+					}
+					if index < len(t.data) {
+						unpacked[y*tw+x] = t.data[index]
+					}
+				}
+			}
+			pixels = unpacked
+		}
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for i, p := range pixels {
+		img.Pix[4*i], img.Pix[4*i+1], img.Pix[4*i+2], img.Pix[4*i+3] = uint8(p>>16), uint8(p>>8), uint8(p), uint8(p>>24)
+	}
+	return img, nil
+}
+
+// sameImage returns an error describing the first pixel of got which differs from want.
+func sameImage(got *image.NRGBA, want image.Image) error {
+	if got.Bounds().Size() != want.Bounds().Size() {
+		return fmt.Errorf("size %v, want %v", got.Bounds().Size(), want.Bounds().Size())
+	}
+	b := want.Bounds()
+	for y := 0; y < b.Dy(); y++ {
+		for x := 0; x < b.Dx(); x++ {
+			g := got.NRGBAAt(x, y)
+			w := color.NRGBAModel.Convert(want.At(b.Min.X+x, b.Min.Y+y)).(color.NRGBA)
+			if g != w {
+				return fmt.Errorf("pixel (%d, %d) is %v, want %v", x, y, g, w)
+			}
+		}
+	}
+	return nil
+}
+
+func TestDecodeTestWebP(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.lossless.webp"))
+	if err != nil || len(files) == 0 {
+		t.Fatalf("no test images: %v", err)
+	}
+	for _, file := range files {
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decodeTestWebP(b)
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		f, err := os.Open(strings.TrimSuffix(file, ".lossless.webp") + ".png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sameImage(got, want); err != nil {
+			t.Errorf("%s: %v", file, err)
+		}
+	}
+}
+
+func TestEncodeWebP(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+	images := map[string]image.Image{}
+	for _, size := range []image.Point{{1, 1}, {2, 3}, {7, 1}, {1, 9}, {513, 5}, {100, 80}} {
+		noise := image.NewNRGBA(image.Rect(0, 0, size.X, size.Y))
+		random.Read(noise.Pix)
+		images[fmt.Sprintf("noise %v", size)] = noise
+		gradient := image.NewNRGBA(image.Rect(0, 0, size.X, size.Y))
+		for y := 0; y < size.Y; y++ {
+			for x := 0; x < size.X; x++ {
+				gradient.SetNRGBA(x, y, color.NRGBA{R: uint8(x), G: uint8(x + y), B: uint8(y * 3), A: 0xff})
+			}
+		}
+		images[fmt.Sprintf("gradient %v", size)] = gradient
+	}
+	// repeated content exercises backward references, and transparency the alpha channel.
+	stripes := image.NewNRGBA(image.Rect(0, 0, 300, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 300; x++ {
+			stripes.SetNRGBA(x, y, color.NRGBA{R: uint8(x / 10 * 40), G: 0x80, B: 0x20, A: uint8(y / 50 * 80)})
+		}
+	}
+	images["stripes"] = stripes
+	// images which are not NRGBA are converted, and may not start at the origin.
+	gray := image.NewGray(image.Rect(10, 20, 74, 84))
+	random.Read(gray.Pix)
+	images["gray"] = gray
+	for _, file := range []string{"testdata/tux.png", "testdata/blue-purple-pink.png"} {
+		f, err := os.Open(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		images[file] = img
+	}
+
+	for name, img := range images {
+		var buf bytes.Buffer
+		if err := encodeWebP(&buf, img); err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		got, err := decodeTestWebP(buf.Bytes())
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if err := sameImage(got, img); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// The XML Signature algorithms accepted. SHA-1 is not, nor canonicalization with comments.
+const (
+	xmldsigNS       = "http://www.w3.org/2000/09/xmldsig#"
+	xmlExcC14N      = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	xmlEnvelopedSig = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	xmlRSASHA256    = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	xmlRSASHA512    = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	xmlDigestSHA256 = "http://www.w3.org/2001/04/xmlenc#sha256"
+	xmlDigestSHA512 = "http://www.w3.org/2001/04/xmlenc#sha512"
+)
+
+var errInvalidXMLSignature = errors.New("invalid XML signature")
+
+// xmlNode is an element or a text of a parsed document, which keeps the prefixes of names so that the document
+// can be canonicalized as it was signed.
+type xmlNode struct {
+	parent   *xmlNode
+	prefix   string
+	local    string
+	attrs    []xml.Attr
+	children []*xmlNode
+	// ns are the namespaces declared by the element, by prefix, "" for the default one.
+	ns map[string]string
+	// text is the content of a text node, which has no name.
+	text   string
+	isText bool
+}
+
+// parseXMLDocument parses a document without DTD, and returns its root element.
+func parseXMLDocument(b []byte) (*xmlNode, error) {
+	d := xml.NewDecoder(bytes.NewReader(b))
+	var root, current *xmlNode
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if current == nil && root != nil {
+				return nil, errors.New("more than one root element")
+			}
+			n := &xmlNode{parent: current, prefix: t.Name.Space, local: t.Name.Local, ns: map[string]string{}}
+			for _, a := range t.Attr {
+				switch {
+				case a.Name.Space == "" && a.Name.Local == "xmlns":
+					n.ns[""] = a.Value
+				case a.Name.Space == "xmlns":
+					n.ns[a.Name.Local] = a.Value
+				default:
+					n.attrs = append(n.attrs, a)
+				}
+			}
+			if current == nil {
+				root = n
+			} else {
+				current.children = append(current.children, n)
+			}
+			current = n
+		case xml.EndElement:
+			if current == nil || t.Name.Space != current.prefix || t.Name.Local != current.local {
+				return nil, fmt.Errorf("unexpected end element %s", t.Name.Local)
+			}
+			current = current.parent
+		case xml.CharData:
+			if current != nil {
+				current.children = append(current.children, &xmlNode{parent: current, text: string(t), isText: true})
+			}
+		case xml.Directive:
+			return nil, errors.New("DTDs are not allowed")
+		}
+	}
+	if root == nil || current != nil {
+		return nil, errors.New("incomplete document")
+	}
+	return root, nil
+}
+
+// lookupNS returns the namespace bound to prefix in the scope of n.
+func (n *xmlNode) lookupNS(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return "http://www.w3.org/XML/1998/namespace", true
+	}
+	for e := n; e != nil; e = e.parent {
+		if uri, ok := e.ns[prefix]; ok {
+			return uri, true
+		}
+	}
+	return "", false
+}
+
+// is tells whether n is the element local of namespace uri.
+func (n *xmlNode) is(uri string, local string) bool {
+	if n.isText || n.local != local {
+		return false
+	}
+	ns, _ := n.lookupNS(n.prefix)
+	return ns == uri
+}
+
+// attr returns the value of the attribute without namespace name.
+func (n *xmlNode) attr(name string) string {
+	for _, a := range n.attrs {
+		if a.Name.Space == "" && a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// elements returns the child elements local of namespace uri.
+func (n *xmlNode) elements(uri string, local string) []*xmlNode {
+	var found []*xmlNode
+	for _, c := range n.children {
+		if c.is(uri, local) {
+			found = append(found, c)
+		}
+	}
+	return found
+}
+
+// element returns the only child element local of namespace uri, or nil if there is not exactly one.
+func (n *xmlNode) element(uri string, local string) *xmlNode {
+	if found := n.elements(uri, local); len(found) == 1 {
+		return found[0]
+	}
+	return nil
+}
+
+// content returns the text of n, with that of its descendants.
+func (n *xmlNode) content() string {
+	if n.isText {
+		return n.text
+	}
+	var b strings.Builder
+	for _, c := range n.children {
+		b.WriteString(c.content())
+	}
+	return b.String()
+}
+
+// walk calls fn for n and every element below it.
+func (n *xmlNode) walk(fn func(*xmlNode)) {
+	if n.isText {
+		return
+	}
+	fn(n)
+	for _, c := range n.children {
+		c.walk(fn)
+	}
+}
+
+// excC14N writes n, without the element excluded, as Exclusive XML Canonicalization without comments makes it.
+// inclusive are the prefixes treated as by inclusive canonicalization ("#default" for the default namespace);
+// rendered are the namespaces already declared in the output by ancestors.
+func excC14N(b *bytes.Buffer, n *xmlNode, excluded *xmlNode, inclusive []string, rendered map[string]string) {
+	if n.isText {
+		b.WriteString(escapeC14NText(n.text))
+		return
+	}
+	used := map[string]bool{n.prefix: true}
+	for _, a := range n.attrs {
+		if a.Name.Space != "" && a.Name.Space != "xml" {
+			used[a.Name.Space] = true
+		}
+	}
+	for _, p := range inclusive {
+		if p == "#default" {
+			p = ""
+		}
+		if _, ok := n.lookupNS(p); ok {
+			used[p] = true
+		}
+	}
+	var prefixes []string
+	next := map[string]string{}
+	for p, uri := range rendered {
+		next[p] = uri
+	}
+	for p := range used {
+		uri, _ := n.lookupNS(p)
+		if current, ok := rendered[p]; ok && current == uri {
+			continue
+		}
+		// an empty default namespace is only declared to undo one declared above.
+		if p == "" && uri == "" && rendered[""] == "" {
+			continue
+		}
+		prefixes = append(prefixes, p)
+		next[p] = uri
+	}
+	sort.Strings(prefixes)
+
+	name := qualifiedName(n.prefix, n.local)
+	b.WriteString("<" + name)
+	for _, p := range prefixes {
+		if p == "" {
+			b.WriteString(` xmlns="` + escapeC14NAttr(next[p]) + `"`)
+		} else {
+			b.WriteString(" xmlns:" + p + `="` + escapeC14NAttr(next[p]) + `"`)
+		}
+	}
+	attrs := append([]xml.Attr{}, n.attrs...)
+	nsOf := func(a xml.Attr) string {
+		if a.Name.Space == "" {
+			return ""
+		}
+		uri, _ := n.lookupNS(a.Name.Space)
+		return uri
+	}
+	sort.SliceStable(attrs, func(i, j int) bool {
+		if ni, nj := nsOf(attrs[i]), nsOf(attrs[j]); ni != nj {
+			return ni < nj
+		}
+		return attrs[i].Name.Local < attrs[j].Name.Local
+	})
+	for _, a := range attrs {
+		b.WriteString(" " + qualifiedName(a.Name.Space, a.Name.Local) + `="` + escapeC14NAttr(a.Value) + `"`)
+	}
+	b.WriteString(">")
+	for _, c := range n.children {
+		if c != excluded {
+			excC14N(b, c, excluded, inclusive, next)
+		}
+	}
+	b.WriteString("</" + name + ">")
+}
+
+func qualifiedName(prefix string, local string) string {
+	if prefix == "" {
+		return local
+	}
+	return prefix + ":" + local
+}
+
+var (
+	c14nTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+	c14nAttrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+)
+
+func escapeC14NText(s string) string {
+	return c14nTextEscaper.Replace(s)
+}
+
+func escapeC14NAttr(s string) string {
+	return c14nAttrEscaper.Replace(s)
+}
+
+// inclusivePrefixes returns the PrefixList of the InclusiveNamespaces of a transform or canonicalization method.
+func inclusivePrefixes(method *xmlNode) []string {
+	for _, c := range method.children {
+		if c.is(xmlExcC14N, "InclusiveNamespaces") {
+			return strings.Fields(c.attr("PrefixList"))
+		}
+	}
+	return nil
+}
+
+// decodeBase64XML decodes the base64 content of an element, which may be broken into lines.
+func decodeBase64XML(n *xmlNode) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(n.content()), ""))
+}
+
+// verifyXMLSignature checks the enveloped signature of el, a child Signature referring to el by its ID, with one
+// of the certificates. Only the elements below el are then to be trusted: the caller must not look elsewhere
+// in the document, which may have been wrapped around them.
+func verifyXMLSignature(el *xmlNode, certs []*x509.Certificate) error {
+	sig := el.element(xmldsigNS, "Signature")
+	if sig == nil {
+		return fmt.Errorf("%w: %s is not signed", errInvalidXMLSignature, el.local)
+	}
+	signedInfo := sig.element(xmldsigNS, "SignedInfo")
+	if signedInfo == nil {
+		return fmt.Errorf("%w: no SignedInfo", errInvalidXMLSignature)
+	}
+	canonMethod := signedInfo.element(xmldsigNS, "CanonicalizationMethod")
+	if canonMethod == nil || canonMethod.attr("Algorithm") != xmlExcC14N {
+		return fmt.Errorf("%w: unsupported canonicalization", errInvalidXMLSignature)
+	}
+	sigMethod := signedInfo.element(xmldsigNS, "SignatureMethod")
+	if sigMethod == nil {
+		return fmt.Errorf("%w: no SignatureMethod", errInvalidXMLSignature)
+	}
+	var sigHash crypto.Hash
+	switch sigMethod.attr("Algorithm") {
+	case xmlRSASHA256:
+		sigHash = crypto.SHA256
+	case xmlRSASHA512:
+		sigHash = crypto.SHA512
+	default:
+		return fmt.Errorf("%w: unsupported signature method %q", errInvalidXMLSignature, sigMethod.attr("Algorithm"))
+	}
+
+	ref := signedInfo.element(xmldsigNS, "Reference")
+	id := el.attr("ID")
+	if ref == nil || id == "" || ref.attr("URI") != "#"+id {
+		return fmt.Errorf("%w: the signature does not refer to %s", errInvalidXMLSignature, el.local)
+	}
+	// the ID must name el alone, so that the reference cannot be resolved to another element.
+	count := 0
+	root := el
+	for root.parent != nil {
+		root = root.parent
+	}
+	root.walk(func(n *xmlNode) {
+		if n.attr("ID") == id {
+			count++
+		}
+	})
+	if count != 1 {
+		return fmt.Errorf("%w: ID %q is not unique", errInvalidXMLSignature, id)
+	}
+	var inclusive []string
+	enveloped := false
+	if transforms := ref.element(xmldsigNS, "Transforms"); transforms != nil {
+		for _, t := range transforms.elements(xmldsigNS, "Transform") {
+			switch t.attr("Algorithm") {
+			case xmlEnvelopedSig:
+				enveloped = true
+			case xmlExcC14N:
+				inclusive = inclusivePrefixes(t)
+			default:
+				return fmt.Errorf("%w: unsupported transform %q", errInvalidXMLSignature, t.attr("Algorithm"))
+			}
+		}
+	}
+	if !enveloped {
+		return fmt.Errorf("%w: the signature is not enveloped", errInvalidXMLSignature)
+	}
+	digestMethod := ref.element(xmldsigNS, "DigestMethod")
+	digestValue := ref.element(xmldsigNS, "DigestValue")
+	if digestMethod == nil || digestValue == nil {
+		return fmt.Errorf("%w: no digest", errInvalidXMLSignature)
+	}
+	var digest []byte
+	var canonical bytes.Buffer
+	excC14N(&canonical, el, sig, inclusive, map[string]string{})
+	switch digestMethod.attr("Algorithm") {
+	case xmlDigestSHA256:
+		sum := sha256.Sum256(canonical.Bytes())
+		digest = sum[:]
+	case xmlDigestSHA512:
+		sum := sha512.Sum512(canonical.Bytes())
+		digest = sum[:]
+	default:
+		return fmt.Errorf("%w: unsupported digest method %q", errInvalidXMLSignature, digestMethod.attr("Algorithm"))
+	}
+	want, err := decodeBase64XML(digestValue)
+	if err != nil || subtle.ConstantTimeCompare(digest, want) != 1 {
+		return fmt.Errorf("%w: the digest of %s does not match", errInvalidXMLSignature, el.local)
+	}
+
+	sigValue := sig.element(xmldsigNS, "SignatureValue")
+	if sigValue == nil {
+		return fmt.Errorf("%w: no SignatureValue", errInvalidXMLSignature)
+	}
+	signature, err := decodeBase64XML(sigValue)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errInvalidXMLSignature, err)
+	}
+	canonical.Reset()
+	excC14N(&canonical, signedInfo, nil, inclusivePrefixes(canonMethod), map[string]string{})
+	h := sigHash.New()
+	h.Write(canonical.Bytes())
+	hashed := h.Sum(nil)
+	for _, cert := range certs {
+		if key, ok := cert.PublicKey.(*rsa.PublicKey); ok && rsa.VerifyPKCS1v15(key, sigHash, hashed, signature) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: not signed by the identity provider", errInvalidXMLSignature)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyXMLSignature(t *testing.T) {
+	idp := newTestIdP(t)
+	now := time.Now()
+	canonical := testAssertion("_a1", "alice", "_req", now)
+	signed := idp.signedAssertion(t, "_a1", canonical)
+	// the same assertion in the default namespace rather than with a prefix.
+	defaultNS := strings.Replace(strings.Replace(canonical, "xmlns:saml=", "xmlns=", 1), "saml:", "", -1)
+	signedDefaultNS := strings.Replace(defaultNS, "</Issuer>", "</Issuer>"+idp.signature(t, "_a1", defaultNS), 1)
+	const samlNSDecl = ` xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion"`
+
+	for _, tc := range []struct {
+		name string
+		doc  string
+		ok   bool
+	}{
+		{"signed", signed, true},
+		{"namespace declared by the parent", `<r:Response xmlns:r="urn:test"` + samlNSDecl + `>` + strings.Replace(signed, samlNSDecl, "", 1) + `</r:Response>`, true},
+		{"unused namespace of the parent", `<r:Response xmlns:r="urn:test" xmlns:xs="http://www.w3.org/2001/XMLSchema">` + signed + `</r:Response>`, true},
+		{"redundant namespace declaration", strings.Replace(signed, "<saml:Subject>", "<saml:Subject"+samlNSDecl+">", 1), true},
+		{"default namespace", signedDefaultNS, true},
+		{"default namespace declared by the parent", `<Response xmlns="urn:oasis:names:tc:SAML:2.0:assertion">` + strings.Replace(signedDefaultNS, ` xmlns="urn:oasis:names:tc:SAML:2.0:assertion"`, "", 1) + `</Response>`, true},
+		{"namespace rebound to another URI", strings.Replace(signed, "<saml:Subject>", `<saml:Subject xmlns:saml="urn:evil">`, 1), false},
+		{"comment", strings.Replace(signed, "<saml:NameID>alice", "<saml:NameID>al<!-- x -->ice", 1), true},
+		{"modified content", strings.Replace(signed, "<saml:NameID>alice", "<saml:NameID>admin", 1), false},
+		{"added element", strings.Replace(signed, "</saml:Subject>", "<saml:Attribute></saml:Attribute></saml:Subject>", 1), false},
+		{"modified attribute", strings.Replace(signed, `Version="2.0"`, `Version="2.1"`, 1), false},
+		{"no signature", canonical, false},
+		{"duplicate ID", `<r:Response xmlns:r="urn:test">` + signed + `<r:Other ID="_a1"></r:Other></r:Response>`, false},
+		{"reference to another element", strings.Replace(signed, `ID="_a1"`, `ID="_a2"`, 1), false},
+		{"SHA-1", strings.Replace(signed, "xmldsig-more#rsa-sha256", "xmldsig#rsa-sha1", 1), false},
+		{"canonicalization with comments", strings.Replace(signed, `<ds:CanonicalizationMethod Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#">`, `<ds:CanonicalizationMethod Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#WithComments">`, 1), false},
+		{"not enveloped", strings.Replace(signed, `<ds:Transform Algorithm="http://www.w3.org/2000/09/xmldsig#enveloped-signature"></ds:Transform>`, "", 1), false},
+		{"another key", newTestIdP(t).signedAssertion(t, "_a1", canonical), false},
+	} {
+		root, err := parseXMLDocument([]byte(tc.doc))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		var assertion *xmlNode
+		root.walk(func(n *xmlNode) {
+			if assertion == nil && n.is(samlAssertionNS, "Assertion") {
+				assertion = n
+			}
+		})
+		if assertion == nil {
+			t.Errorf("%s: no assertion", tc.name)
+			continue
+		}
+		err = verifyXMLSignature(assertion, idp.provider().certs)
+		if tc.ok && err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		} else if !tc.ok && !errors.Is(err, errInvalidXMLSignature) {
+			t.Errorf("%s: verified, want %v", tc.name, errInvalidXMLSignature)
+		}
+	}
+}
+
+func TestSAMLSignatureWrapping(t *testing.T) {
+	idp := newTestIdP(t)
+	now := time.Now()
+	consume := func(response func(id string) string) (webSession, error) {
+		p := idp.provider()
+		p.logins["_req"] = samlLogin{returnTo: "/files/", expires: now.Add(time.Minute), browser: tokenDigest("browser")}
+		session, _, err := p.consume(base64.StdEncoding.EncodeToString([]byte(response("_req"))), "browser", now)
+		return session, err
+	}
+	canonical := testAssertion("_a1", "alice", "_req", now)
+	signature := idp.signature(t, "_a1", canonical)
+	signed := strings.Replace(canonical, "</saml:Issuer>", "</saml:Issuer>"+signature, 1)
+	evil := testAssertion("_evil", "admin", "_req", now)
+
+	if session, err := consume(func(id string) string { return testResponse(id, signed) }); err != nil || session.user != "alice" {
+		t.Fatalf("signed assertion: %q, %v", session.user, err)
+	}
+	for _, tc := range []struct {
+		name     string
+		response func(id string) string
+	}{
+		{"second assertion", func(id string) string { return testResponse(id, signed, evil) }},
+		{"assertion wrapped in an unsigned one", func(id string) string {
+			return testResponse(id, strings.Replace(evil, "</saml:Subject>", "</saml:Subject><saml:Advice>"+signed+"</saml:Advice>", 1))
+		}},
+		{"signature copied to another assertion", func(id string) string {
+			return testResponse(id, strings.Replace(evil, "</saml:Issuer>", "</saml:Issuer>"+signature, 1))
+		}},
+		{"signature copied to an assertion wrapping the signed one", func(id string) string {
+			wrapper := strings.Replace(evil, "</saml:Issuer>", "</saml:Issuer>"+signature, 1)
+			return testResponse(id, strings.Replace(wrapper, "</saml:Subject>", "</saml:Subject><saml:Advice>"+signed+"</saml:Advice>", 1))
+		}},
+		{"assertion with the ID of the signed one", func(id string) string {
+			impostor := strings.Replace(strings.Replace(evil, `ID="_evil"`, `ID="_a1"`, 1), "</saml:Issuer>", "</saml:Issuer>"+signature, 1)
+			return strings.Replace(testResponse(id, impostor), "<samlp:Status>", "<samlp:Extensions>"+signed+"</samlp:Extensions><samlp:Status>", 1)
+		}},
+		{"unsigned response around a signed one", func(id string) string {
+			return `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" InResponseTo="` + id + `"><samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"></samlp:StatusCode></samlp:Status>` +
+				evil + `<samlp:Extensions>` + testResponse(id, signed) + `</samlp:Extensions></samlp:Response>`
+		}},
+	} {
+		if session, err := consume(tc.response); err == nil {
+			t.Errorf("%s: signed in %q", tc.name, session.user)
+		}
+	}
+}
+
+func TestSAMLCommentInjection(t *testing.T) {
+	idp := newTestIdP(t)
+	now := time.Now()
+	// the identity provider signs the name of a user it knows; a comment must not cut it short.
+	canonical := testAssertion("_a1", "admin@example.com.evil.test", "_req", now)
+	signed := idp.signedAssertion(t, "_a1", canonical)
+	injected := strings.Replace(signed, "admin@example.com.evil.test", "admin@example.com<!---->.evil.test", 1)
+	p := idp.provider()
+	p.logins["_req"] = samlLogin{returnTo: "/files/", expires: now.Add(time.Minute), browser: tokenDigest("browser")}
+	session, _, err := p.consume(base64.StdEncoding.EncodeToString([]byte(testResponse("_req", injected))), "browser", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if session.user != "admin@example.com.evil.test" {
+		t.Errorf("user %q, want admin@example.com.evil.test", session.user)
+	}
+}
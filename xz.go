@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// The decoder below reads the .xz files with LZMA2 compression made by xz and dpkg-deb, which the standard library
+// lacks: only the control archives of Debian packages are read with it, so it decodes the whole file in memory.
+
+var errXZ = errors.New("invalid xz data")
+
+// xzDecode decompresses data, an .xz file, into at most limit bytes.
+func xzDecode(data []byte, limit int) ([]byte, error) {
+	if len(data) < 12 || !bytes.Equal(data[:6], []byte{0xfd, '7', 'z', 'X', 'Z', 0}) {
+		return nil, fmt.Errorf("%w: no xz header", errXZ)
+	}
+	checkSizes := map[byte]int{0: 0, 1: 4, 4: 8, 10: 32}
+	checkSize, ok := checkSizes[data[7]&0x0f]
+	if data[6] != 0 || !ok {
+		return nil, fmt.Errorf("%w: unsupported stream flags", errXZ)
+	}
+	in := data[12:]
+	var out []byte
+	for {
+		if len(in) == 0 {
+			return nil, fmt.Errorf("%w: truncated", errXZ)
+		}
+		// a zero byte starts the index, which follows the last block.
+		if in[0] == 0 {
+			return out, nil
+		}
+		headerSize := (int(in[0]) + 1) * 4
+		if len(in) < headerSize {
+			return nil, fmt.Errorf("%w: truncated block header", errXZ)
+		}
+		header := in[1 : headerSize-4]
+		in = in[headerSize:]
+		flags := header[0]
+		header = header[1:]
+		if flags&0x03 != 0 {
+			return nil, fmt.Errorf("%w: filters other than LZMA2 are not supported", errXZ)
+		}
+		var err error
+		for _, present := range []bool{flags&0x40 != 0, flags&0x80 != 0} {
+			if present {
+				if _, header, err = xzVarint(header); err != nil {
+					return nil, err
+				}
+			}
+		}
+		var id uint64
+		if id, header, err = xzVarint(header); err != nil {
+			return nil, err
+		}
+		if id != 0x21 {
+			return nil, fmt.Errorf("%w: filter %#x is not supported", errXZ, id)
+		}
+		var n int
+		if out, n, err = lzma2Decode(in, out, limit); err != nil {
+			return nil, err
+		}
+		// the compressed data is padded to four bytes, then followed by the check.
+		n = (n + 3) &^ 3
+		if n+checkSize > len(in) {
+			return nil, fmt.Errorf("%w: truncated block", errXZ)
+		}
+		in = in[n+checkSize:]
+	}
+}
+
+func xzVarint(b []byte) (uint64, []byte, error) {
+	var v uint64
+	for i := 0; i < len(b) && i < 9; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i]&0x80 == 0 {
+			return v, b[i+1:], nil
+		}
+	}
+	return 0, nil, fmt.Errorf("%w: bad number", errXZ)
+}
+
+// lzma2Decode appends the data decompressed from the LZMA2 chunks at the start of in to out.
+// It returns out and the number of bytes of in read.
+func lzma2Decode(in []byte, out []byte, limit int) ([]byte, int, error) {
+	d := &lzmaDecoder{out: out, dictStart: len(out), limit: limit}
+	pos := 0
+	needProps := true
+	for {
+		if pos >= len(in) {
+			return nil, 0, fmt.Errorf("%w: truncated LZMA2 data", errXZ)
+		}
+		control := in[pos]
+		pos++
+		switch {
+		case control == 0x00:
+			return d.out, pos, nil
+		case control == 0x01 || control == 0x02:
+			if pos+2 > len(in) {
+				return nil, 0, fmt.Errorf("%w: truncated LZMA2 chunk", errXZ)
+			}
+			size := int(binary.BigEndian.Uint16(in[pos:])) + 1
+			pos += 2
+			if pos+size > len(in) || len(d.out)+size > limit {
+				return nil, 0, fmt.Errorf("%w: truncated or too large LZMA2 chunk", errXZ)
+			}
+			if control == 0x01 {
+				d.dictStart = len(d.out)
+			}
+			d.out = append(d.out, in[pos:pos+size]...)
+			pos += size
+		case control >= 0x80:
+			if pos+4 > len(in) {
+				return nil, 0, fmt.Errorf("%w: truncated LZMA2 chunk", errXZ)
+			}
+			unpacked := int(control&0x1f)<<16 + int(binary.BigEndian.Uint16(in[pos:])) + 1
+			packed := int(binary.BigEndian.Uint16(in[pos+2:])) + 1
+			pos += 4
+			reset := (control >> 5) & 0x03
+			if reset == 3 {
+				d.dictStart = len(d.out)
+			}
+			if reset >= 2 {
+				if pos >= len(in) {
+					return nil, 0, fmt.Errorf("%w: truncated LZMA2 chunk", errXZ)
+				}
+				if err := d.setProps(in[pos]); err != nil {
+					return nil, 0, err
+				}
+				pos++
+				needProps = false
+			}
+			if needProps {
+				return nil, 0, fmt.Errorf("%w: LZMA2 chunk without properties", errXZ)
+			}
+			if reset >= 1 {
+				d.resetState()
+			}
+			if pos+packed > len(in) {
+				return nil, 0, fmt.Errorf("%w: truncated LZMA2 chunk", errXZ)
+			}
+			if err := d.decodeChunk(in[pos:pos+packed], unpacked); err != nil {
+				return nil, 0, err
+			}
+			pos += packed
+		default:
+			return nil, 0, fmt.Errorf("%w: bad LZMA2 control byte %#x", errXZ, control)
+		}
+	}
+}
+
+const (
+	lzmaProbBits   = 11
+	lzmaProbInit   = 1 << (lzmaProbBits - 1)
+	lzmaMoveBits   = 5
+	lzmaStates     = 12
+	lzmaPosStates  = 1 << 4
+	lzmaEndPosSlot = 14
+	lzmaFullDists  = 1 << (lzmaEndPosSlot >> 1)
+	lzmaMatchMin   = 2
+)
+
+// rangeDecoder decodes the bits of an LZMA chunk.
+type rangeDecoder struct {
+	in    []byte
+	pos   int
+	rng   uint32
+	code  uint32
+	error bool
+}
+
+func (rc *rangeDecoder) init(in []byte) error {
+	if len(in) < 5 || in[0] != 0 {
+		return fmt.Errorf("%w: bad LZMA chunk", errXZ)
+	}
+	*rc = rangeDecoder{in: in, pos: 5, rng: 0xffffffff, code: binary.BigEndian.Uint32(in[1:5])}
+	return nil
+}
+
+func (rc *rangeDecoder) normalize() {
+	if rc.rng < 1<<24 {
+		rc.rng <<= 8
+		var b byte
+		if rc.pos < len(rc.in) {
+			b = rc.in[rc.pos]
+		} else {
+			rc.error = true
+		}
+		rc.pos++
+		rc.code = rc.code<<8 | uint32(b)
+	}
+}
+
+func (rc *rangeDecoder) bit(prob *uint16) uint32 {
+	bound := (rc.rng >> lzmaProbBits) * uint32(*prob)
+	var bit uint32
+	if rc.code < bound {
+		rc.rng = bound
+		*prob += (1<<lzmaProbBits - *prob) >> lzmaMoveBits
+	} else {
+		rc.rng -= bound
+		rc.code -= bound
+		*prob -= *prob >> lzmaMoveBits
+		bit = 1
+	}
+	rc.normalize()
+	return bit
+}
+
+func (rc *rangeDecoder) directBits(n uint32) uint32 {
+	var v uint32
+	for ; n > 0; n-- {
+		rc.rng >>= 1
+		rc.code -= rc.rng
+		t := 0 - (rc.code >> 31)
+		rc.code += rc.rng & t
+		v = v<<1 + (t + 1)
+		rc.normalize()
+	}
+	return v
+}
+
+func (rc *rangeDecoder) tree(probs []uint16, bits uint32) uint32 {
+	m := uint32(1)
+	for i := uint32(0); i < bits; i++ {
+		m = m<<1 + rc.bit(&probs[m])
+	}
+	return m - 1<<bits
+}
+
+func (rc *rangeDecoder) reverseTree(probs []uint16, bits uint32) uint32 {
+	m, sym := uint32(1), uint32(0)
+	for i := uint32(0); i < bits; i++ {
+		b := rc.bit(&probs[m])
+		m = m<<1 + b
+		sym |= b << i
+	}
+	return sym
+}
+
+type lzmaLenDecoder struct {
+	choice, choice2 uint16
+	low, mid        [lzmaPosStates][1 << 3]uint16
+	high            [1 << 8]uint16
+}
+
+func (l *lzmaLenDecoder) reset() {
+	l.choice, l.choice2 = lzmaProbInit, lzmaProbInit
+	for i := range l.low {
+		resetProbs(l.low[i][:])
+		resetProbs(l.mid[i][:])
+	}
+	resetProbs(l.high[:])
+}
+
+func (l *lzmaLenDecoder) decode(rc *rangeDecoder, posState uint32) uint32 {
+	if rc.bit(&l.choice) == 0 {
+		return rc.tree(l.low[posState][:], 3)
+	}
+	if rc.bit(&l.choice2) == 0 {
+		return 8 + rc.tree(l.mid[posState][:], 3)
+	}
+	return 16 + rc.tree(l.high[:], 8)
+}
+
+func resetProbs(probs []uint16) {
+	for i := range probs {
+		probs[i] = lzmaProbInit
+	}
+}
+
+// lzmaDecoder decodes LZMA chunks; the dictionary is the whole output since dictStart.
+type lzmaDecoder struct {
+	out       []byte
+	dictStart int
+	limit     int
+
+	lc, lp, pb uint32
+	state      uint32
+	reps       [4]uint32
+
+	literal    []uint16
+	isMatch    [lzmaStates << 4]uint16
+	isRep      [lzmaStates]uint16
+	isRepG0    [lzmaStates]uint16
+	isRepG1    [lzmaStates]uint16
+	isRepG2    [lzmaStates]uint16
+	isRep0Long [lzmaStates << 4]uint16
+	posSlot    [4][1 << 6]uint16
+	posSpecial [1 + lzmaFullDists - lzmaEndPosSlot]uint16
+	align      [1 << 4]uint16
+	matchLen   lzmaLenDecoder
+	repLen     lzmaLenDecoder
+}
+
+func (d *lzmaDecoder) setProps(b byte) error {
+	if b >= 9*5*5 {
+		return fmt.Errorf("%w: bad LZMA properties", errXZ)
+	}
+	d.lc, d.lp, d.pb = uint32(b%9), uint32(b/9%5), uint32(b/45)
+	if d.lc+d.lp > 4 {
+		return fmt.Errorf("%w: bad LZMA properties", errXZ)
+	}
+	d.literal = make([]uint16, 0x300<<(d.lc+d.lp))
+	return nil
+}
+
+func (d *lzmaDecoder) resetState() {
+	d.state = 0
+	d.reps = [4]uint32{}
+	resetProbs(d.literal)
+	resetProbs(d.isMatch[:])
+	resetProbs(d.isRep[:])
+	resetProbs(d.isRepG0[:])
+	resetProbs(d.isRepG1[:])
+	resetProbs(d.isRepG2[:])
+	resetProbs(d.isRep0Long[:])
+	for i := range d.posSlot {
+		resetProbs(d.posSlot[i][:])
+	}
+	resetProbs(d.posSpecial[:])
+	resetProbs(d.align[:])
+	d.matchLen.reset()
+	d.repLen.reset()
+}
+
+// back returns the byte dist+1 bytes back in the dictionary.
+func (d *lzmaDecoder) back(dist uint32) (byte, bool) {
+	i := len(d.out) - int(dist) - 1
+	if i < d.dictStart {
+		return 0, false
+	}
+	return d.out[i], true
+}
+
+func (d *lzmaDecoder) decodeChunk(in []byte, unpacked int) error {
+	var rc rangeDecoder
+	if err := rc.init(in); err != nil {
+		return err
+	}
+	end := len(d.out) + unpacked
+	if end > d.limit {
+		return fmt.Errorf("%w: too large", errXZ)
+	}
+	bad := fmt.Errorf("%w: corrupt LZMA data", errXZ)
+	for len(d.out) < end {
+		if rc.error {
+			return bad
+		}
+		posState := uint32(len(d.out)) & (1<<d.pb - 1)
+		if rc.bit(&d.isMatch[d.state<<4+posState]) == 0 {
+			prev, _ := d.back(0)
+			litState := (uint32(len(d.out))&(1<<d.lp-1))<<d.lc + uint32(prev)>>(8-d.lc)
+			probs := d.literal[0x300*litState : 0x300*(litState+1)]
+			symbol := uint32(1)
+			if d.state >= 7 {
+				match, ok := d.back(d.reps[0])
+				if !ok {
+					return bad
+				}
+				for symbol < 0x100 {
+					matchBit := uint32(match>>7) & 1
+					match <<= 1
+					b := rc.bit(&probs[(1+matchBit)<<8+symbol])
+					symbol = symbol<<1 | b
+					if matchBit != b {
+						break
+					}
+				}
+			}
+			for symbol < 0x100 {
+				symbol = symbol<<1 | rc.bit(&probs[symbol])
+			}
+			d.out = append(d.out, byte(symbol))
+			switch {
+			case d.state < 4:
+				d.state = 0
+			case d.state < 10:
+				d.state -= 3
+			default:
+				d.state -= 6
+			}
+			continue
+		}
+
+		var length uint32
+		if rc.bit(&d.isRep[d.state]) != 0 {
+			if len(d.out) == d.dictStart {
+				return bad
+			}
+			if rc.bit(&d.isRepG0[d.state]) == 0 {
+				if rc.bit(&d.isRep0Long[d.state<<4+posState]) == 0 {
+					if d.state < 7 {
+						d.state = 9
+					} else {
+						d.state = 11
+					}
+					b, _ := d.back(d.reps[0])
+					d.out = append(d.out, b)
+					continue
+				}
+			} else {
+				var dist uint32
+				if rc.bit(&d.isRepG1[d.state]) == 0 {
+					dist = d.reps[1]
+				} else {
+					if rc.bit(&d.isRepG2[d.state]) == 0 {
+						dist = d.reps[2]
+					} else {
+						dist = d.reps[3]
+						d.reps[3] = d.reps[2]
+					}
+					d.reps[2] = d.reps[1]
+				}
+				d.reps[1] = d.reps[0]
+				d.reps[0] = dist
+			}
+			length = d.repLen.decode(&rc, posState)
+			if d.state < 7 {
+				d.state = 8
+			} else {
+				d.state = 11
+			}
+		} else {
+			d.reps[3], d.reps[2], d.reps[1] = d.reps[2], d.reps[1], d.reps[0]
+			length = d.matchLen.decode(&rc, posState)
+			if d.state < 7 {
+				d.state = 7
+			} else {
+				d.state = 10
+			}
+			d.reps[0] = d.decodeDistance(&rc, length)
+			if d.reps[0] == 0xffffffff {
+				// LZMA2 chunks have no end marker.
+				return bad
+			}
+		}
+		length += lzmaMatchMin
+		if int(d.reps[0]) >= len(d.out)-d.dictStart || len(d.out)+int(length) > end {
+			return bad
+		}
+		from := len(d.out) - int(d.reps[0]) - 1
+		for i := 0; i < int(length); i++ {
+			d.out = append(d.out, d.out[from+i])
+		}
+	}
+	if rc.error {
+		return bad
+	}
+	return nil
+}
+
+func (d *lzmaDecoder) decodeDistance(rc *rangeDecoder, length uint32) uint32 {
+	lenState := length
+	if lenState > 3 {
+		lenState = 3
+	}
+	slot := rc.tree(d.posSlot[lenState][:], 6)
+	if slot < 4 {
+		return slot
+	}
+	direct := slot>>1 - 1
+	dist := (2 | slot&1) << direct
+	if slot < lzmaEndPosSlot {
+		return dist + rc.reverseTree(d.posSpecial[dist-slot:], direct)
+	}
+	dist += rc.directBits(direct-4) << 4
+	return dist + rc.reverseTree(d.align[:], 4)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// The files in testdata/xz were made by xz 5.6.4 from text and random, as:
+//
+//	xz -c --check=none|crc32|crc64|sha256 text > text.(check).xz
+//	xz -c -0 text > text.0.xz
+//	xz -c -9e text > text.9e.xz
+//	xz -c --lzma2=preset=6,lc=1,lp=3,pb=0 text > text.lc1lp3pb0.xz
+//	xz -c --lzma2=preset=6,lc=4,lp=0,pb=4 text > text.lc4lp0pb4.xz
+//	xz -c --block-size=8KiB text > text.blocks.xz
+//	xz -c random > random.xz
+//	cat text random text | xz -c > mixed.xz
+//	seq 1 200000 | sed 's/^/line /' | xz -c > lines.xz
+//	printf '' | xz -c > empty.xz
+//	head -c 2000 text | xz -c --delta=dist=4 --lzma2 > delta.xz
+
+func readTestFile(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestXZDecode(t *testing.T) {
+	text := readTestFile(t, "xz/text")
+	random := readTestFile(t, "xz/random")
+	var lines bytes.Buffer
+	for i := 1; i <= 200000; i++ {
+		fmt.Fprintf(&lines, "line %d\n", i)
+	}
+	for _, tc := range []struct {
+		file string
+		want []byte
+	}{
+		{"text.none.xz", text},
+		{"text.crc32.xz", text},
+		{"text.crc64.xz", text},
+		{"text.sha256.xz", text},
+		{"text.0.xz", text},
+		{"text.9e.xz", text},
+		{"text.lc1lp3pb0.xz", text},
+		{"text.lc4lp0pb4.xz", text},
+		// several blocks, each with its own dictionary.
+		{"text.blocks.xz", text},
+		// uncompressed chunks.
+		{"random.xz", random},
+		// compressed chunks referring to the data before uncompressed ones.
+		{"mixed.xz", append(append(append([]byte{}, text...), random...), text...)},
+		// several compressed chunks.
+		{"lines.xz", lines.Bytes()},
+		{"empty.xz", nil},
+	} {
+		got, err := xzDecode(readTestFile(t, "xz/"+tc.file), 8<<20)
+		if err != nil {
+			t.Errorf("%s: %v", tc.file, err)
+		} else if !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: decoded %d bytes which differ from the %d bytes compressed", tc.file, len(got), len(tc.want))
+		}
+	}
+}
+
+func TestXZDecodeErrors(t *testing.T) {
+	data := readTestFile(t, "xz/text.crc64.xz")
+	text := readTestFile(t, "xz/text")
+	corrupt := append([]byte{}, data...)
+	corrupt[len(corrupt)/2] ^= 0x55
+	for _, tc := range []struct {
+		name  string
+		data  []byte
+		limit int
+	}{
+		{"not xz", text, 1 << 20},
+		{"truncated header", data[:10], 1 << 20},
+		{"truncated", data[:len(data)/2], 1 << 20},
+		{"truncated before the index", data[:len(data)-40], 1 << 20},
+		{"corrupt", corrupt, 1 << 20},
+		{"too large", data, len(text) - 1},
+		{"delta filter", readTestFile(t, "xz/delta.xz"), 1 << 20},
+	} {
+		if _, err := xzDecode(tc.data, tc.limit); !errors.Is(err, errXZ) {
+			t.Errorf("%s: %v, want %v", tc.name, err, errXZ)
+		}
+	}
+}
+
+func TestReadDebControl(t *testing.T) {
+	// made with dpkg-deb 1.21.22 as dpkg-deb --root-owner-group -Zxz|gzip -b hello hello_(xz|gzip).deb.
+	for _, file := range []string{"hello_xz.deb", "hello_gzip.deb"} {
+		c, err := readDebControl(filepath.Join("testdata", file))
+		if err != nil {
+			t.Errorf("%s: %v", file, err)
+			continue
+		}
+		for name, want := range map[string]string{"Package": "hello", "Version": "1.0-1", "Architecture": "all", "Description": "test package\n multi-line description."} {
+			if got := c.get(name); got != want {
+				t.Errorf("%s: %s is %q, want %q", file, name, got, want)
+			}
+		}
+	}
+}